@@ -9,16 +9,22 @@
 package activeinactive
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"os/exec"
 	"strconv"
+	"strings"
 
 	"github.com/UpdateHub/updatehub/utils"
 )
 
-// Interface describes the operations related to the Active-Inactive feature
+// Interface describes the operations related to the Active-Inactive
+// feature. The installation sets are numbered from 0 to "Slots() - 1".
 type Interface interface {
 	Active() (int, error)
 	SetActive(active int) error
+	Slots() (int, error)
 }
 
 // DefaultImpl is the default implementation for Interface
@@ -50,3 +56,77 @@ func (i *DefaultImpl) SetActive(active int) error {
 
 	return nil
 }
+
+// Slots returns the number of installation sets of the device, which
+// is 2 unless "updatehub-active-slots" tells otherwise
+func (i *DefaultImpl) Slots() (int, error) {
+	output, err := i.Execute("updatehub-active-slots")
+	if execErr, ok := err.(*exec.Error); ok && execErr.Err == exec.ErrNotFound {
+		return 2, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	slots, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return checkSlots(int(slots))
+}
+
+// Validator is implemented by the backends which keep a bootloader
+// fallback armed after the active installation set is changed, until
+// it is known to be good
+type Validator interface {
+	SetValidated() error
+}
+
+const (
+	activeVariable = "updatehub_active"
+	slotsVariable  = "updatehub_slots"
+)
+
+func checkSlots(slots int) (int, error) {
+	if slots < 2 {
+		return 0, fmt.Errorf("the device must have at least 2 installation sets. Found %d", slots)
+	}
+
+	return slots, nil
+}
+
+// parseEnvironment parses the "name=value" lines of a bootloader
+// environment listing
+func parseEnvironment(output []byte) (map[string]string, error) {
+	env := map[string]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		env[parts[0]] = strings.TrimSpace(parts[1])
+	}
+
+	return env, scanner.Err()
+}
+
+// environmentInt returns the "name" variable of "env" as an int, or
+// "def" when it isn't set
+func environmentInt(env map[string]string, name string, def int, bootloader string) (int, error) {
+	value, ok := env[name]
+	if !ok {
+		return def, nil
+	}
+
+	i, err := strconv.ParseInt(value, 10, 0)
+	if err != nil {
+		return 0, fmt.Errorf("invalid '%s' in the %s environment: %s", name, bootloader, err)
+	}
+
+	return int(i), nil
+}
@@ -10,6 +10,7 @@ package activeinactive
 
 import (
 	"fmt"
+	"os/exec"
 	"testing"
 
 	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
@@ -91,3 +92,41 @@ func TestDefaultImplSetActiveWithExecuteError(t *testing.T) {
 	assert.EqualError(t, err, "execute error")
 	clm.AssertExpectations(t)
 }
+
+func TestDefaultImplSlots(t *testing.T) {
+	testCases := []struct {
+		name          string
+		output        string
+		err           error
+		expectedSlots int
+		expectedErr   string
+	}{
+		{"WithSlots", "3\n", nil, 3, ""},
+		{"WithExecutableNotFound", "", &exec.Error{Name: "updatehub-active-slots", Err: exec.ErrNotFound}, 2, ""},
+		{"WithExecuteError", "", fmt.Errorf("execute error"), 0, "execute error"},
+		{"WithInvalidOutput", "a", nil, 0, "strconv.ParseInt: parsing \"a\": invalid syntax"},
+		{"WithLessThanTwoSlots", "1", nil, 0, "the device must have at least 2 installation sets. Found 1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+			clm.On("Execute", "updatehub-active-slots").Return([]byte(tc.output), tc.err)
+
+			di := DefaultImpl{
+				CmdLineExecuter: clm,
+			}
+
+			slots, err := di.Slots()
+
+			if tc.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedErr)
+			}
+			assert.Equal(t, tc.expectedSlots, slots)
+
+			clm.AssertExpectations(t)
+		})
+	}
+}
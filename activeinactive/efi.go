@@ -0,0 +1,136 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package activeinactive
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// EFIImpl is an implementation of Interface for UEFI systems where
+// each installation set is booted by one of the "Entries" boot
+// entries (as "0001"), through efibootmgr. The active installation
+// set is the currently booted entry. A new one is booted once through
+// "BootNext" and only moved to the top of "BootOrder" after it gets
+// validated, so the firmware falls back to the previous entry when it
+// fails to boot.
+type EFIImpl struct {
+	utils.CmdLineExecuter
+	Entries []string
+}
+
+type efiBootVariables struct {
+	current string
+	next    string
+	order   []string
+}
+
+// Active returns the index of the currently booted entry
+func (i *EFIImpl) Active() (int, error) {
+	vars, err := i.bootVariables()
+	if err != nil {
+		return 0, err
+	}
+
+	return i.indexOf(vars.current)
+}
+
+// SetActive makes the entry of the installation set "active" to be
+// booted next
+func (i *EFIImpl) SetActive(active int) error {
+	if active < 0 || active >= len(i.Entries) {
+		return fmt.Errorf("installation set %d has no EFI boot entry", active)
+	}
+
+	_, err := i.Execute(fmt.Sprintf("efibootmgr -n %s", i.Entries[active]))
+	return err
+}
+
+// SetValidated moves the entry to be booted next, or the current one
+// when none is set, to the top of the boot order
+func (i *EFIImpl) SetValidated() error {
+	vars, err := i.bootVariables()
+	if err != nil {
+		return err
+	}
+
+	entry := vars.current
+	flags := ""
+
+	if vars.next != "" {
+		entry = vars.next
+		flags = "-N "
+	}
+
+	if entry == "" {
+		return fmt.Errorf("no EFI boot entry is in use")
+	}
+
+	order := []string{entry}
+	for _, e := range vars.order {
+		if !strings.EqualFold(e, entry) {
+			order = append(order, e)
+		}
+	}
+
+	_, err = i.Execute(fmt.Sprintf("efibootmgr %s-o %s", flags, strings.Join(order, ",")))
+	return err
+}
+
+// Slots returns the number of installation sets of the device
+func (i *EFIImpl) Slots() (int, error) {
+	return checkSlots(len(i.Entries))
+}
+
+func (i *EFIImpl) indexOf(entry string) (int, error) {
+	for index, e := range i.Entries {
+		if strings.EqualFold(e, entry) {
+			return index, nil
+		}
+	}
+
+	return 0, fmt.Errorf("the booted EFI entry '%s' doesn't belong to any installation set", entry)
+}
+
+// bootVariables returns the boot variables listed by efibootmgr
+func (i *EFIImpl) bootVariables() (*efiBootVariables, error) {
+	output, err := i.Execute("efibootmgr")
+	if err != nil {
+		return nil, err
+	}
+
+	vars := &efiBootVariables{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		value := strings.TrimSpace(parts[1])
+
+		switch parts[0] {
+		case "BootCurrent":
+			vars.current = value
+		case "BootNext":
+			vars.next = value
+		case "BootOrder":
+			if value != "" {
+				vars.order = strings.Split(value, ",")
+			}
+		}
+	}
+
+	return vars, scanner.Err()
+}
@@ -0,0 +1,147 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package activeinactive
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+	"github.com/stretchr/testify/assert"
+)
+
+const efibootmgrOutput = `BootCurrent: 0002
+Timeout: 1 seconds
+BootOrder: 0001,0002,0000
+Boot0000* UEFI Shell
+Boot0001* updatehub A
+Boot0002* updatehub B
+`
+
+func TestEFIImplActive(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "efibootmgr").Return([]byte(efibootmgrOutput), nil)
+
+	ei := EFIImpl{
+		CmdLineExecuter: clm,
+		Entries:         []string{"0001", "0002"},
+	}
+
+	active, err := ei.Active()
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, active)
+
+	clm.AssertExpectations(t)
+}
+
+func TestEFIImplActiveWithUnknownEntry(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "efibootmgr").Return([]byte(efibootmgrOutput), nil)
+
+	ei := EFIImpl{
+		CmdLineExecuter: clm,
+		Entries:         []string{"0003", "0004"},
+	}
+
+	active, err := ei.Active()
+
+	assert.EqualError(t, err, "the booted EFI entry '0002' doesn't belong to any installation set")
+	assert.Equal(t, 0, active)
+
+	clm.AssertExpectations(t)
+}
+
+func TestEFIImplActiveWithExecuteError(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "efibootmgr").Return([]byte(""), fmt.Errorf("execute error"))
+
+	ei := EFIImpl{
+		CmdLineExecuter: clm,
+		Entries:         []string{"0001", "0002"},
+	}
+
+	active, err := ei.Active()
+
+	assert.EqualError(t, err, "execute error")
+	assert.Equal(t, 0, active)
+
+	clm.AssertExpectations(t)
+}
+
+func TestEFIImplSetActive(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "efibootmgr -n 0001").Return([]byte(""), nil)
+
+	ei := EFIImpl{
+		CmdLineExecuter: clm,
+		Entries:         []string{"0001", "0002"},
+	}
+
+	err := ei.SetActive(0)
+	assert.NoError(t, err)
+
+	err = ei.SetActive(2)
+	assert.EqualError(t, err, "installation set 2 has no EFI boot entry")
+
+	clm.AssertExpectations(t)
+}
+
+func TestEFIImplSetValidated(t *testing.T) {
+	testCases := []struct {
+		name            string
+		output          string
+		expectedCmdline string
+	}{
+		{
+			"WithBootCurrent",
+			efibootmgrOutput,
+			"efibootmgr -o 0002,0001,0000",
+		},
+		{
+			"WithBootNext",
+			"BootCurrent: 0002\nBootNext: 0001\nBootOrder: 0002,0001\n",
+			"efibootmgr -N -o 0001,0002",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+			clm.On("Execute", "efibootmgr").Return([]byte(tc.output), nil)
+			clm.On("Execute", tc.expectedCmdline).Return([]byte(""), nil)
+
+			ei := EFIImpl{
+				CmdLineExecuter: clm,
+				Entries:         []string{"0001", "0002"},
+			}
+
+			err := ei.SetValidated()
+			assert.NoError(t, err)
+
+			clm.AssertExpectations(t)
+		})
+	}
+}
+
+func TestEFIImplSlots(t *testing.T) {
+	ei := EFIImpl{
+		Entries: []string{"0001", "0002", "0003"},
+	}
+
+	slots, err := ei.Slots()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, slots)
+
+	ei.Entries = []string{"0001"}
+
+	slots, err = ei.Slots()
+	assert.EqualError(t, err, "the device must have at least 2 installation sets. Found 1")
+	assert.Equal(t, 0, slots)
+}
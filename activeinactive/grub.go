@@ -0,0 +1,79 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package activeinactive
+
+import (
+	"fmt"
+
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// DefaultGrubEnvPath is where the GRUB environment block is usually
+// found
+const DefaultGrubEnvPath = "/boot/grub/grubenv"
+
+// GrubImpl is an implementation of Interface which keeps the active
+// installation set at the "updatehub_active" variable of the GRUB
+// environment block, so "grub.cfg" can choose what to boot from it.
+// The number of installation sets is read from "updatehub_slots",
+// which is 2 when it isn't set.
+type GrubImpl struct {
+	utils.CmdLineExecuter
+	EnvPath string
+}
+
+// Active returns the current active object number, which is 0 while
+// it wasn't set yet
+func (i *GrubImpl) Active() (int, error) {
+	env, err := i.environment()
+	if err != nil {
+		return 0, err
+	}
+
+	return environmentInt(env, activeVariable, 0, "GRUB")
+}
+
+// SetActive sets the current active object number to "active"
+func (i *GrubImpl) SetActive(active int) error {
+	_, err := i.Execute(fmt.Sprintf("grub-editenv '%s' set %s=%d", i.envPath(), activeVariable, active))
+	return err
+}
+
+// Slots returns the number of installation sets of the device
+func (i *GrubImpl) Slots() (int, error) {
+	env, err := i.environment()
+	if err != nil {
+		return 0, err
+	}
+
+	slots, err := environmentInt(env, slotsVariable, 2, "GRUB")
+	if err != nil {
+		return 0, err
+	}
+
+	return checkSlots(slots)
+}
+
+func (i *GrubImpl) envPath() string {
+	if i.EnvPath == "" {
+		return DefaultGrubEnvPath
+	}
+
+	return i.EnvPath
+}
+
+// environment returns the variables of the GRUB environment block
+func (i *GrubImpl) environment() (map[string]string, error) {
+	output, err := i.Execute(fmt.Sprintf("grub-editenv '%s' list", i.envPath()))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseEnvironment(output)
+}
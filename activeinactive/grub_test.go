@@ -0,0 +1,132 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package activeinactive
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrubImplActive(t *testing.T) {
+	testCases := []struct {
+		name           string
+		env            string
+		expectedActive int
+		expectedErr    string
+	}{
+		{"Set", "saved_entry=0\nupdatehub_active=1\n", 1, ""},
+		{"NotSet", "saved_entry=0\n", 0, ""},
+		{"Invalid", "updatehub_active=a\n", 0, "invalid 'updatehub_active' in the GRUB environment: strconv.ParseInt: parsing \"a\": invalid syntax"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+			clm.On("Execute", "grub-editenv '/boot/grub/grubenv' list").Return([]byte(tc.env), nil)
+
+			gi := GrubImpl{
+				CmdLineExecuter: clm,
+			}
+
+			active, err := gi.Active()
+			if tc.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedErr)
+			}
+			assert.Equal(t, tc.expectedActive, active)
+
+			clm.AssertExpectations(t)
+		})
+	}
+}
+
+func TestGrubImplActiveWithExecuteError(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "grub-editenv '/boot/efi/grubenv' list").Return([]byte(""), fmt.Errorf("execute error"))
+
+	gi := GrubImpl{
+		CmdLineExecuter: clm,
+		EnvPath:         "/boot/efi/grubenv",
+	}
+
+	active, err := gi.Active()
+
+	assert.EqualError(t, err, "execute error")
+	assert.Equal(t, 0, active)
+
+	clm.AssertExpectations(t)
+}
+
+func TestGrubImplSetActive(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "grub-editenv '/boot/efi/grubenv' set updatehub_active=1").Return([]byte(""), nil)
+
+	gi := GrubImpl{
+		CmdLineExecuter: clm,
+		EnvPath:         "/boot/efi/grubenv",
+	}
+
+	err := gi.SetActive(1)
+
+	assert.NoError(t, err)
+	clm.AssertExpectations(t)
+}
+
+func TestGrubImplSetActiveWithExecuteError(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "grub-editenv '/boot/grub/grubenv' set updatehub_active=0").Return([]byte(""), fmt.Errorf("execute error"))
+
+	gi := GrubImpl{
+		CmdLineExecuter: clm,
+	}
+
+	err := gi.SetActive(0)
+
+	assert.EqualError(t, err, "execute error")
+	clm.AssertExpectations(t)
+}
+
+func TestGrubImplSlots(t *testing.T) {
+	testCases := []struct {
+		name          string
+		env           string
+		expectedSlots int
+		expectedErr   string
+	}{
+		{"NotSet", "updatehub_active=1\n", 2, ""},
+		{"Set", "updatehub_active=1\nupdatehub_slots=3\n", 3, ""},
+		{"TooFew", "updatehub_slots=1\n", 0, "the device must have at least 2 installation sets. Found 1"},
+		{"Invalid", "updatehub_slots=a\n", 0, "invalid 'updatehub_slots' in the GRUB environment: strconv.ParseInt: parsing \"a\": invalid syntax"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+			clm.On("Execute", "grub-editenv '/boot/grub/grubenv' list").Return([]byte(tc.env), nil)
+
+			gi := GrubImpl{
+				CmdLineExecuter: clm,
+			}
+
+			slots, err := gi.Slots()
+			if tc.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedErr)
+			}
+			assert.Equal(t, tc.expectedSlots, slots)
+
+			clm.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,89 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package activeinactive
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// DefaultUBootBootLimit is the number of boots U-Boot tries the new
+// installation set before falling back
+const DefaultUBootBootLimit = 3
+
+// UBootImpl is an implementation of Interface which keeps the active
+// installation set at the "updatehub_active" variable of the U-Boot
+// environment. Changing it also arms the U-Boot boot count, so when
+// the new installation set doesn't get validated after "BootLimit"
+// boots, U-Boot runs "altbootcmd", which must activate the previous
+// one. The number of installation sets is read from
+// "updatehub_slots", which is 2 when it isn't set.
+type UBootImpl struct {
+	utils.CmdLineExecuter
+	BootLimit int
+}
+
+// Active returns the current active object number, which is 0 while
+// it wasn't set yet
+func (i *UBootImpl) Active() (int, error) {
+	env, err := i.environment()
+	if err != nil {
+		return 0, err
+	}
+
+	return environmentInt(env, activeVariable, 0, "U-Boot")
+}
+
+// SetActive sets the current active object number to "active" and
+// arms the boot count
+func (i *UBootImpl) SetActive(active int) error {
+	bootLimit := i.BootLimit
+	if bootLimit <= 0 {
+		bootLimit = DefaultUBootBootLimit
+	}
+
+	script := fmt.Sprintf("%s %d\nupgrade_available 1\nbootcount 0\nbootlimit %d\n", activeVariable, active, bootLimit)
+
+	_, err := i.ExecuteWithStdin("fw_setenv -s -", bytes.NewBufferString(script))
+	return err
+}
+
+// SetValidated disarms the boot count, so U-Boot keeps booting the
+// active installation set
+func (i *UBootImpl) SetValidated() error {
+	_, err := i.ExecuteWithStdin("fw_setenv -s -", bytes.NewBufferString("upgrade_available 0\nbootcount 0\n"))
+	return err
+}
+
+// Slots returns the number of installation sets of the device
+func (i *UBootImpl) Slots() (int, error) {
+	env, err := i.environment()
+	if err != nil {
+		return 0, err
+	}
+
+	slots, err := environmentInt(env, slotsVariable, 2, "U-Boot")
+	if err != nil {
+		return 0, err
+	}
+
+	return checkSlots(slots)
+}
+
+// environment returns the variables of the U-Boot environment
+func (i *UBootImpl) environment() (map[string]string, error) {
+	output, err := i.Execute("fw_printenv")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseEnvironment(output)
+}
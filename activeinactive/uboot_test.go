@@ -0,0 +1,158 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package activeinactive
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUBootImplActive(t *testing.T) {
+	testCases := []struct {
+		name           string
+		env            string
+		expectedActive int
+		expectedErr    string
+	}{
+		{"Set", "bootcmd=run updatehub_boot\nupdatehub_active=1\n", 1, ""},
+		{"NotSet", "bootcmd=run updatehub_boot\n", 0, ""},
+		{"Invalid", "updatehub_active=a\n", 0, "invalid 'updatehub_active' in the U-Boot environment: strconv.ParseInt: parsing \"a\": invalid syntax"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+			clm.On("Execute", "fw_printenv").Return([]byte(tc.env), nil)
+
+			ui := UBootImpl{
+				CmdLineExecuter: clm,
+			}
+
+			active, err := ui.Active()
+			if tc.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedErr)
+			}
+			assert.Equal(t, tc.expectedActive, active)
+
+			clm.AssertExpectations(t)
+		})
+	}
+}
+
+func TestUBootImplActiveWithExecuteError(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "fw_printenv").Return([]byte(""), fmt.Errorf("execute error"))
+
+	ui := UBootImpl{
+		CmdLineExecuter: clm,
+	}
+
+	active, err := ui.Active()
+
+	assert.EqualError(t, err, "execute error")
+	assert.Equal(t, 0, active)
+
+	clm.AssertExpectations(t)
+}
+
+func TestUBootImplSetActive(t *testing.T) {
+	testCases := []struct {
+		name           string
+		bootLimit      int
+		expectedScript string
+	}{
+		{"DefaultBootLimit", 0, "updatehub_active 1\nupgrade_available 1\nbootcount 0\nbootlimit 3\n"},
+		{"CustomBootLimit", 5, "updatehub_active 1\nupgrade_available 1\nbootcount 0\nbootlimit 5\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+			clm.On("ExecuteWithStdin", "fw_setenv -s -", bytes.NewBufferString(tc.expectedScript)).Return([]byte(""), nil)
+
+			ui := UBootImpl{
+				CmdLineExecuter: clm,
+				BootLimit:       tc.bootLimit,
+			}
+
+			err := ui.SetActive(1)
+
+			assert.NoError(t, err)
+			clm.AssertExpectations(t)
+		})
+	}
+}
+
+func TestUBootImplSetActiveWithExecuteError(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("ExecuteWithStdin", "fw_setenv -s -", bytes.NewBufferString("updatehub_active 0\nupgrade_available 1\nbootcount 0\nbootlimit 3\n")).Return([]byte(""), fmt.Errorf("execute error"))
+
+	ui := UBootImpl{
+		CmdLineExecuter: clm,
+	}
+
+	err := ui.SetActive(0)
+
+	assert.EqualError(t, err, "execute error")
+	clm.AssertExpectations(t)
+}
+
+func TestUBootImplSetValidated(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("ExecuteWithStdin", "fw_setenv -s -", bytes.NewBufferString("upgrade_available 0\nbootcount 0\n")).Return([]byte(""), nil)
+
+	ui := UBootImpl{
+		CmdLineExecuter: clm,
+	}
+
+	err := ui.SetValidated()
+
+	assert.NoError(t, err)
+	clm.AssertExpectations(t)
+}
+
+func TestUBootImplSlots(t *testing.T) {
+	testCases := []struct {
+		name          string
+		env           string
+		expectedSlots int
+		expectedErr   string
+	}{
+		{"NotSet", "updatehub_active=1\n", 2, ""},
+		{"Set", "updatehub_active=1\nupdatehub_slots=4\n", 4, ""},
+		{"TooFew", "updatehub_slots=0\n", 0, "the device must have at least 2 installation sets. Found 0"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+			clm.On("Execute", "fw_printenv").Return([]byte(tc.env), nil)
+
+			ui := UBootImpl{
+				CmdLineExecuter: clm,
+			}
+
+			slots, err := ui.Slots()
+			if tc.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedErr)
+			}
+			assert.Equal(t, tc.expectedSlots, slots)
+
+			clm.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,250 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UpdateHub/updatehub/log"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// AgentChannelEndpoint is where the agent channel is opened
+	AgentChannelEndpoint = "/agent"
+
+	// HelloMessage is the first message sent upstream on each
+	// connection, it identifies the device
+	HelloMessage = "hello"
+	// ReportMessage carries a state report upstream
+	ReportMessage = "report"
+	// CommandMessage carries a command downstream
+	CommandMessage = "command"
+	// ReplyMessage carries the result of a command upstream
+	ReplyMessage = "reply"
+
+	// agentChannelQueueSize is how many messages wait to be sent
+	// upstream, the newer ones are dropped while the queue is full
+	agentChannelQueueSize = 32
+	// agentChannelDialTimeout limits how long a connection may take
+	agentChannelDialTimeout = 30 * time.Second
+)
+
+// AgentMessage is a JSON message of the agent channel. "ID" pairs a
+// command with its reply.
+type AgentMessage struct {
+	Type       string            `json:"type"`
+	ID         string            `json:"id,omitempty"`
+	Command    string            `json:"command,omitempty"`
+	Args       map[string]string `json:"args,omitempty"`
+	PackageUID string            `json:"package-uid,omitempty"`
+	State      string            `json:"state,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Data       interface{}       `json:"data,omitempty"`
+}
+
+// AgentChannel is a WebSocket session with the server which carries
+// the state reports upstream and the commands downstream. The session
+// is opened again whenever it drops, waiting from "minRetry" up to
+// "maxRetry", doubled on each failed attempt.
+type AgentChannel struct {
+	api      *ApiClient
+	endpoint string
+	hello    func() interface{}
+	handle   func(AgentMessage) error
+	minRetry time.Duration
+	maxRetry time.Duration
+
+	send chan AgentMessage
+	stop chan struct{}
+	done chan struct{}
+
+	conn      *websocket.Conn
+	connMutex sync.Mutex
+}
+
+// NewAgentChannel creates an AgentChannel to the "endpoint" of the
+// server "api" talks to, through the same TLS config. The data from
+// "hello" is sent on each connection and "handle" is called for each
+// command, its error is replied to the server.
+func NewAgentChannel(api *ApiClient, endpoint string, hello func() interface{}, minRetry time.Duration, maxRetry time.Duration, handle func(AgentMessage) error) *AgentChannel {
+	return &AgentChannel{
+		api:      api,
+		endpoint: endpoint,
+		hello:    hello,
+		handle:   handle,
+		minRetry: minRetry,
+		maxRetry: maxRetry,
+		send:     make(chan AgentMessage, agentChannelQueueSize),
+	}
+}
+
+// Start opens the session in background
+func (c *AgentChannel) Start() {
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+
+	go c.run()
+}
+
+// Stop closes the session and waits for it
+func (c *AgentChannel) Stop() {
+	close(c.stop)
+
+	c.connMutex.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.connMutex.Unlock()
+
+	<-c.done
+}
+
+// ReportState sends the state report upstream. It's best effort, the
+// report is dropped if it can't be queued.
+func (c *AgentChannel) ReportState(packageUID string, state string) {
+	c.queue(AgentMessage{Type: ReportMessage, PackageUID: packageUID, State: state})
+}
+
+func (c *AgentChannel) queue(m AgentMessage) {
+	select {
+	case c.send <- m:
+	default:
+		log.Debug(fmt.Sprintf("dropping the agent channel '%s' message, the queue is full", m.Type))
+	}
+}
+
+func (c *AgentChannel) run() {
+	defer close(c.done)
+
+	retry := c.minRetry
+
+	for {
+		connected, err := c.session()
+
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+
+		// a session which was established starts the backoff over
+		if connected {
+			retry = c.minRetry
+		}
+
+		log.Warn(fmt.Sprintf("the agent channel dropped, it's opened again in %s: %s", retry, err))
+
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(retry):
+		}
+
+		retry *= 2
+		if retry > c.maxRetry {
+			retry = c.maxRetry
+		}
+	}
+}
+
+// session opens the connection and serves it until it drops. It tells
+// whether the connection was established.
+func (c *AgentChannel) session() (bool, error) {
+	url := serverURL(c.api, c.endpoint)
+
+	config, err := websocket.NewConfig(strings.Replace(url, "http", "ws", 1), url)
+	if err != nil {
+		return false, err
+	}
+
+	config.Dialer = &net.Dialer{Timeout: agentChannelDialTimeout}
+
+	if c.api.https {
+		config.TlsConfig = c.api.transport().TLSClientConfig
+	}
+
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return false, err
+	}
+
+	c.connMutex.Lock()
+	c.conn = conn
+	c.connMutex.Unlock()
+
+	defer func() {
+		c.connMutex.Lock()
+		c.conn = nil
+		c.connMutex.Unlock()
+
+		conn.Close()
+	}()
+
+	// the session may be stopped while connecting
+	select {
+	case <-c.stop:
+		return true, nil
+	default:
+	}
+
+	err = websocket.JSON.Send(conn, AgentMessage{Type: HelloMessage, Data: c.hello()})
+	if err != nil {
+		return true, err
+	}
+
+	received := make(chan error, 1)
+
+	go func() {
+		received <- c.receive(conn)
+	}()
+
+	for {
+		select {
+		case m := <-c.send:
+			err = websocket.JSON.Send(conn, m)
+			if err != nil {
+				return true, err
+			}
+		case err = <-received:
+			return true, err
+		case <-c.stop:
+			return true, nil
+		}
+	}
+}
+
+// receive handles the commands from "conn" until it drops
+func (c *AgentChannel) receive(conn *websocket.Conn) error {
+	for {
+		var m AgentMessage
+
+		err := websocket.JSON.Receive(conn, &m)
+		if err != nil {
+			return err
+		}
+
+		if m.Type != CommandMessage {
+			log.Debug(fmt.Sprintf("ignoring the agent channel '%s' message", m.Type))
+			continue
+		}
+
+		reply := AgentMessage{Type: ReplyMessage, ID: m.ID, Command: m.Command}
+
+		if err := c.handle(m); err != nil {
+			reply.Error = err.Error()
+		}
+
+		c.queue(reply)
+	}
+}
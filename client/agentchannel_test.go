@@ -0,0 +1,103 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func TestAgentChannel(t *testing.T) {
+	var sessions int32
+
+	upstream := make(chan AgentMessage, 10)
+
+	s := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		n := atomic.AddInt32(&sessions, 1)
+
+		var hello AgentMessage
+		assert.NoError(t, websocket.JSON.Receive(conn, &hello))
+		upstream <- hello
+
+		// the first session drops right after the hello
+		if n == 1 {
+			return
+		}
+
+		err := websocket.JSON.Send(conn, AgentMessage{Type: CommandMessage, ID: "1", Command: "probe"})
+		assert.NoError(t, err)
+
+		err = websocket.JSON.Send(conn, AgentMessage{Type: CommandMessage, ID: "2", Command: "unknown"})
+		assert.NoError(t, err)
+
+		for {
+			var m AgentMessage
+			if err := websocket.JSON.Receive(conn, &m); err != nil {
+				return
+			}
+
+			upstream <- m
+		}
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	hello := func() interface{} {
+		return "device"
+	}
+
+	commands := make(chan AgentMessage, 10)
+
+	handle := func(m AgentMessage) error {
+		commands <- m
+
+		if m.Command != "probe" {
+			return errors.New("unknown command")
+		}
+
+		return nil
+	}
+
+	c := NewAgentChannel(NewApiClient(u.Host), "/agent", hello, time.Millisecond, time.Millisecond, handle)
+	c.Start()
+
+	// it's opened again after dropping
+	assert.Equal(t, AgentMessage{Type: HelloMessage, Data: "device"}, <-upstream)
+	assert.Equal(t, AgentMessage{Type: HelloMessage, Data: "device"}, <-upstream)
+
+	assert.Equal(t, "probe", (<-commands).Command)
+	assert.Equal(t, "unknown", (<-commands).Command)
+
+	assert.Equal(t, AgentMessage{Type: ReplyMessage, ID: "1", Command: "probe"}, <-upstream)
+	assert.Equal(t, AgentMessage{Type: ReplyMessage, ID: "2", Command: "unknown", Error: "unknown command"}, <-upstream)
+
+	c.ReportState("puid", "downloading")
+	assert.Equal(t, AgentMessage{Type: ReportMessage, PackageUID: "puid", State: "downloading"}, <-upstream)
+
+	c.Stop()
+}
+
+func TestAgentChannelQueueIsBounded(t *testing.T) {
+	c := NewAgentChannel(NewApiClient("localhost"), "/agent", nil, time.Second, time.Second, nil)
+
+	for i := 0; i < agentChannelQueueSize+10; i++ {
+		c.ReportState("puid", "downloading")
+	}
+
+	assert.Equal(t, agentChannelQueueSize, len(c.send))
+}
@@ -11,6 +11,8 @@ package client
 import (
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 )
 
 // TODO: https support
@@ -18,12 +20,29 @@ import (
 const (
 	UpgradesEndpoint    = "/upgrades"
 	StateReportEndpoint = "/report"
+	LogsEndpoint        = "/logs"
+	HeartbeatEndpoint   = "/heartbeat"
+
+	// SignatureHeader holds the base64 encoded detached signature of
+	// the update metadata
+	SignatureHeader = "UH-Signature"
 )
 
 type ApiClient struct {
 	http.Client
 
 	server string
+	https  bool
+
+	servers      []*apiServer
+	cooldown     time.Duration
+	override     string
+	serversMutex sync.Mutex
+
+	retry    retryState
+	timeouts Timeouts
+
+	insecureRedirects bool
 }
 
 func (client *ApiClient) Request() *ApiRequest {
@@ -33,7 +52,7 @@ func (client *ApiClient) Request() *ApiRequest {
 }
 
 func NewApiClient(server string) *ApiClient {
-	return &ApiClient{Client: http.Client{}, server: server}
+	return &ApiClient{Client: http.Client{CheckRedirect: sameOriginRedirect}, server: server}
 }
 
 type ApiRequest struct {
@@ -50,9 +69,14 @@ func (r *ApiRequest) Client() *ApiClient {
 }
 
 func (r *ApiRequest) Do(req *http.Request) (*http.Response, error) {
-	return r.client.Do(req)
+	return r.client.send(req)
 }
 
 func serverURL(c *ApiClient, path string) string {
-	return fmt.Sprintf("http://%s/%s", c.server, path[1:])
+	scheme := "http"
+	if c.https {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s/%s", scheme, c.address(), path[1:])
 }
@@ -0,0 +1,467 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/pion/dtls"
+
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+const (
+	coapDefaultPort  = "5683"
+	coapsDefaultPort = "5684"
+
+	// coapBlockSize is the preferred size of the blocks of a blockwise
+	// transfer, the server may choose a smaller one
+	coapBlockSize = 1024
+
+	coapAckTimeout    = 2 * time.Second
+	coapMaxRetransmit = 4
+)
+
+// CoAPClient implements the Updater interface over CoAP, which is much
+// lighter than HTTP for devices on constrained networks. The update
+// metadata and objects are transferred blockwise (RFC 7959).
+type CoAPClient struct {
+	dtlsConfig *dtls.Config
+	ackTimeout time.Duration
+}
+
+// NewCoAPClient creates a CoAP updater that talks to the server through
+// plain UDP until EnableDTLS is called
+func NewCoAPClient() *CoAPClient {
+	return &CoAPClient{ackTimeout: coapAckTimeout}
+}
+
+// EnableDTLS makes the client talk to the server through DTLS using the
+// certificates, CA pool and pinned public keys of "config". Only ECDSA
+// client key files are supported.
+func (c *CoAPClient) EnableDTLS(config *tls.Config) error {
+	dtlsConfig := &dtls.Config{
+		RootCAs:    config.RootCAs,
+		ServerName: config.ServerName,
+	}
+
+	if len(config.Certificates) > 0 {
+		cert := config.Certificates[0]
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse client certificate: %s", err)
+		}
+
+		if _, ok := cert.PrivateKey.(*TokenSigner); ok {
+			return errors.New("the token keys can't be used through DTLS")
+		}
+
+		dtlsConfig.Certificate = leaf
+		dtlsConfig.PrivateKey = cert.PrivateKey
+	}
+
+	// the pinned public keys are checked against the server
+	// certificate only, DTLS doesn't give the verified chain
+	if verify := config.VerifyPeerCertificate; verify != nil {
+		dtlsConfig.VerifyPeerCertificate = func(cert *x509.Certificate, verified bool) error {
+			if !verified {
+				return errors.New("the server certificate wasn't verified")
+			}
+
+			return verify([][]byte{cert.Raw}, [][]*x509.Certificate{{cert}})
+		}
+	}
+
+	c.dtlsConfig = dtlsConfig
+
+	return nil
+}
+
+func (c *CoAPClient) CheckUpdate(ctx context.Context, api ApiRequester, uri string, data interface{}) (interface{}, time.Duration, error) {
+	if api == nil {
+		return nil, 0, errors.New("invalid api requester")
+	}
+
+	rawJSON, _ := json.Marshal(data)
+
+	s, err := c.dial(ctx, api.Client())
+	if err != nil {
+		return nil, 0, fmt.Errorf("check update request failed: %s", err)
+	}
+
+	defer s.close()
+
+	var body []byte
+
+	block := coapBlock{size: coapBlockSize}
+
+	for {
+		req := &coapMessage{code: coapPOST, payload: rawJSON}
+		req.setPath(uri)
+		req.addUintOption(coapOptionContentFormat, coapContentFormatJSON)
+
+		if block.num > 0 {
+			req.addUintOption(coapOptionBlock2, block.encode())
+		}
+
+		res, err := s.exchange(req)
+		if err != nil {
+			if ctx.Err() == nil {
+				api.Client().setServerDown(s.server)
+			}
+
+			return nil, 0, fmt.Errorf("check update request failed: %s", err)
+		}
+
+		switch res.code {
+		case coapContent:
+		case coapNotFound:
+			// NotFound is not an error in this case, just means there is no update available
+			return nil, 0, nil
+		default:
+			return nil, 0, fmt.Errorf("invalid response received from the server. Status %s", coapCodeString(res.code))
+		}
+
+		body = append(body, res.payload...)
+
+		value, ok := res.uintOption(coapOptionBlock2)
+		if !ok || !decodeCoAPBlock(value).more {
+			break
+		}
+
+		received := decodeCoAPBlock(value)
+		block = coapBlock{num: received.num + 1, size: received.size}
+	}
+
+	updateMetadata, err := metadata.NewUpdateMetadata(body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse upgrade response: %s", err)
+	}
+
+	return updateMetadata, 0, nil
+}
+
+// FetchUpdate requests the object at "uri" starting from byte
+// "offset". The blocks are requested while the returned reader is
+// read. The number of bytes that remain to be read is only known when
+// the server sends the Size2 option, otherwise it is -1.
+func (c *CoAPClient) FetchUpdate(ctx context.Context, api ApiRequester, uri string, offset int64) (io.ReadCloser, int64, error) {
+	if api == nil {
+		return nil, -1, errors.New("invalid api requester")
+	}
+
+	s, err := c.dial(ctx, api.Client())
+	if err != nil {
+		return nil, -1, fmt.Errorf("fetch update request failed: %s", err)
+	}
+
+	r := &coapBlockReader{
+		session: s,
+		uri:     uri,
+		next:    coapBlock{num: uint32(offset / coapBlockSize), size: coapBlockSize},
+	}
+
+	res, block, err := r.fetch()
+	if err != nil {
+		// the server didn't answer at all
+		if res == nil && ctx.Err() == nil {
+			api.Client().setServerDown(s.server)
+		}
+
+		s.close()
+		return nil, -1, err
+	}
+
+	// the server may have chosen a smaller block size or not used
+	// blockwise transfer at all, so skip what was already downloaded
+	skip := offset - int64(block.num)*int64(block.size)
+	for skip > int64(len(r.buf)) && r.more {
+		skip -= int64(len(r.buf))
+
+		if _, _, err = r.fetch(); err != nil {
+			s.close()
+			return nil, -1, err
+		}
+	}
+
+	if skip < 0 || skip > int64(len(r.buf)) {
+		s.close()
+		return nil, -1, errors.New("failed to skip already downloaded data")
+	}
+
+	r.buf = r.buf[skip:]
+
+	remaining := int64(-1)
+	if size, ok := res.uintOption(coapOptionSize2); ok {
+		remaining = int64(size) - offset
+	}
+
+	return r, remaining, nil
+}
+
+type coapBlockReader struct {
+	session *coapSession
+	uri     string
+	next    coapBlock
+	more    bool
+	buf     []byte
+}
+
+// fetch requests the next block, which is kept at the reader buffer
+func (r *coapBlockReader) fetch() (*coapMessage, coapBlock, error) {
+	req := &coapMessage{code: coapGET}
+	req.setPath(r.uri)
+	req.addUintOption(coapOptionBlock2, r.next.encode())
+
+	res, err := r.session.exchange(req)
+	if err != nil {
+		return nil, coapBlock{}, fmt.Errorf("fetch update request failed: %s", err)
+	}
+
+	if res.code != coapContent {
+		return res, coapBlock{}, &StatusError{StatusCode: coapStatusCode(res.code), message: "failed to fetch update. maybe the file is missing?"}
+	}
+
+	// a response without the Block2 option carries the whole object
+	block := coapBlock{size: len(res.payload)}
+	if value, ok := res.uintOption(coapOptionBlock2); ok {
+		block = decodeCoAPBlock(value)
+	}
+
+	r.buf = res.payload
+	r.more = block.more
+	r.next = coapBlock{num: block.num + 1, size: block.size}
+
+	return res, block, nil
+}
+
+func (r *coapBlockReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if !r.more {
+			return 0, io.EOF
+		}
+
+		if _, _, err := r.fetch(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+func (r *coapBlockReader) Close() error {
+	return r.session.close()
+}
+
+// coapSession exchanges messages with the server, one request at a time
+type coapSession struct {
+	server     string
+	conn       net.Conn
+	messageID  uint16
+	ackTimeout time.Duration
+	incoming   chan *coapMessage
+	done       chan struct{}
+}
+
+// dial opens a session with the server, whose exchanges are aborted
+// once "ctx" is done
+func (c *CoAPClient) dial(ctx context.Context, api *ApiClient) (*coapSession, error) {
+	port := coapDefaultPort
+	if c.dtlsConfig != nil {
+		port = coapsDefaultPort
+	}
+
+	// the UDP "connection" can't tell if the server is reachable, so
+	// the first available server is used and marked down by the
+	// callers when it doesn't answer
+	server := api.availableServers()[0]
+
+	address := server
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, port)
+	}
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.dtlsConfig != nil {
+		config := *c.dtlsConfig
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(address)
+		}
+
+		dtlsConn, err := dtls.Client(conn, &config)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("dtls handshake failed: %s", err)
+		}
+
+		conn = dtlsConn
+	}
+
+	s := &coapSession{
+		server:     server,
+		conn:       conn,
+		messageID:  uint16(rand.Intn(0x10000)),
+		ackTimeout: c.ackTimeout,
+		incoming:   make(chan *coapMessage),
+		done:       make(chan struct{}),
+	}
+
+	go s.receive()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			// the pending read fails, so does the exchange waiting
+			// for it
+			conn.SetDeadline(time.Now())
+		case <-s.done:
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *coapSession) receive() {
+	defer close(s.incoming)
+
+	buf := make([]byte, 2048)
+
+	for {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		m, err := parseCoAPMessage(data)
+		if err != nil {
+			continue
+		}
+
+		select {
+		case s.incoming <- m:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *coapSession) send(m *coapMessage) error {
+	data, err := m.marshal()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.conn.Write(data)
+
+	return err
+}
+
+// exchange sends "req" as a confirmable message and waits for its
+// response, which may be piggybacked on the acknowledgement or sent
+// separately. The request is retransmitted with an exponential back-off
+// until it is acknowledged.
+func (s *coapSession) exchange(req *coapMessage) (*coapMessage, error) {
+	s.messageID++
+
+	req.typ = coapConfirmable
+	req.messageID = s.messageID
+	req.token = make([]byte, 2)
+	binary.BigEndian.PutUint16(req.token, s.messageID)
+
+	timeout := s.ackTimeout
+	acknowledged := false
+
+	if err := s.send(req); err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; attempt <= coapMaxRetransmit; {
+		timer := time.NewTimer(timeout)
+
+		select {
+		case m, ok := <-s.incoming:
+			timer.Stop()
+
+			if !ok {
+				return nil, errors.New("connection closed")
+			}
+
+			if m.messageID == req.messageID && (m.typ == coapAcknowledgement || m.typ == coapReset) {
+				if m.typ == coapReset {
+					return nil, errors.New("request rejected by the server")
+				}
+
+				if m.code == coapEmpty {
+					// the response will be sent separately
+					acknowledged = true
+					continue
+				}
+			} else if m.typ == coapConfirmable || m.typ == coapNonConfirmable {
+				if m.typ == coapConfirmable {
+					ack := &coapMessage{typ: coapAcknowledgement, messageID: m.messageID}
+					if err := s.send(ack); err != nil {
+						return nil, err
+					}
+				}
+			} else {
+				continue
+			}
+
+			if string(m.token) == string(req.token) {
+				return m, nil
+			}
+		case <-timer.C:
+			attempt++
+			timeout *= 2
+
+			if !acknowledged && attempt <= coapMaxRetransmit {
+				if err := s.send(req); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return nil, errors.New("request timed out")
+}
+
+func (s *coapSession) close() error {
+	close(s.done)
+	return s.conn.Close()
+}
+
+func coapCodeString(code uint8) string {
+	return fmt.Sprintf("%d.%02d", code>>5, code&0x1f)
+}
+
+// coapStatusCode returns "code" in the HTTP form, 4.04 is 404
+func coapStatusCode(code uint8) int {
+	return int(code>>5)*100 + int(code&0x1f)
+}
@@ -0,0 +1,278 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// CoAP message types, codes and options (RFC 7252 and RFC 7959) used
+// by the CoAP updater
+const (
+	coapConfirmable     = 0
+	coapNonConfirmable  = 1
+	coapAcknowledgement = 2
+	coapReset           = 3
+
+	coapEmpty    = 0
+	coapGET      = 1
+	coapPOST     = 2
+	coapContent  = 69  // 2.05
+	coapNotFound = 132 // 4.04
+
+	coapOptionURIPath       = 11
+	coapOptionContentFormat = 12
+	coapOptionBlock2        = 23
+	coapOptionSize2         = 28
+
+	coapContentFormatJSON = 50
+
+	coapVersion       = 1
+	coapPayloadMarker = 0xff
+)
+
+type coapOption struct {
+	number uint16
+	value  []byte
+}
+
+type coapMessage struct {
+	typ       uint8
+	code      uint8
+	messageID uint16
+	token     []byte
+	options   []coapOption
+	payload   []byte
+}
+
+func (m *coapMessage) addOption(number uint16, value []byte) {
+	// the options are kept sorted by number, which is the order they
+	// must be encoded
+	i := len(m.options)
+	for i > 0 && m.options[i-1].number > number {
+		i--
+	}
+
+	m.options = append(m.options, coapOption{})
+	copy(m.options[i+1:], m.options[i:])
+	m.options[i] = coapOption{number: number, value: value}
+}
+
+func (m *coapMessage) addUintOption(number uint16, value uint32) {
+	m.addOption(number, encodeCoAPUint(value))
+}
+
+func (m *coapMessage) setPath(path string) {
+	for _, segment := range strings.Split(strings.Trim(path, "/"), "/") {
+		if segment != "" {
+			m.addOption(coapOptionURIPath, []byte(segment))
+		}
+	}
+}
+
+// option returns the first value of the option "number"
+func (m *coapMessage) option(number uint16) ([]byte, bool) {
+	for _, o := range m.options {
+		if o.number == number {
+			return o.value, true
+		}
+	}
+
+	return nil, false
+}
+
+func (m *coapMessage) uintOption(number uint16) (uint32, bool) {
+	value, ok := m.option(number)
+	if !ok {
+		return 0, false
+	}
+
+	return decodeCoAPUint(value), true
+}
+
+func (m *coapMessage) marshal() ([]byte, error) {
+	if len(m.token) > 8 {
+		return nil, errors.New("coap token is too long")
+	}
+
+	data := []byte{coapVersion<<6 | m.typ<<4 | uint8(len(m.token)), m.code, 0, 0}
+	binary.BigEndian.PutUint16(data[2:], m.messageID)
+	data = append(data, m.token...)
+
+	var last uint16
+	for _, o := range m.options {
+		delta, deltaExt := encodeCoAPOptionNibble(int(o.number - last))
+		length, lengthExt := encodeCoAPOptionNibble(len(o.value))
+
+		data = append(data, delta<<4|length)
+		data = append(data, deltaExt...)
+		data = append(data, lengthExt...)
+		data = append(data, o.value...)
+
+		last = o.number
+	}
+
+	if len(m.payload) > 0 {
+		data = append(data, coapPayloadMarker)
+		data = append(data, m.payload...)
+	}
+
+	return data, nil
+}
+
+func parseCoAPMessage(data []byte) (*coapMessage, error) {
+	if len(data) < 4 {
+		return nil, errors.New("coap message is too short")
+	}
+
+	if data[0]>>6 != coapVersion {
+		return nil, errors.New("unsupported coap version")
+	}
+
+	m := &coapMessage{
+		typ:       (data[0] >> 4) & 0x03,
+		code:      data[1],
+		messageID: binary.BigEndian.Uint16(data[2:4]),
+	}
+
+	tokenLength := int(data[0] & 0x0f)
+	if tokenLength > 8 || len(data) < 4+tokenLength {
+		return nil, errors.New("invalid coap token")
+	}
+
+	m.token = data[4 : 4+tokenLength]
+	data = data[4+tokenLength:]
+
+	var number int
+	for len(data) > 0 {
+		if data[0] == coapPayloadMarker {
+			if len(data) == 1 {
+				return nil, errors.New("empty coap payload after marker")
+			}
+
+			m.payload = data[1:]
+			break
+		}
+
+		delta := int(data[0] >> 4)
+		length := int(data[0] & 0x0f)
+		data = data[1:]
+
+		var err error
+
+		delta, data, err = decodeCoAPOptionNibble(delta, data)
+		if err != nil {
+			return nil, err
+		}
+
+		length, data, err = decodeCoAPOptionNibble(length, data)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(data) < length {
+			return nil, errors.New("coap option is truncated")
+		}
+
+		number += delta
+		m.addOption(uint16(number), data[:length])
+		data = data[length:]
+	}
+
+	return m, nil
+}
+
+func encodeCoAPOptionNibble(value int) (uint8, []byte) {
+	switch {
+	case value < 13:
+		return uint8(value), nil
+	case value < 269:
+		return 13, []byte{uint8(value - 13)}
+	}
+
+	ext := make([]byte, 2)
+	binary.BigEndian.PutUint16(ext, uint16(value-269))
+
+	return 14, ext
+}
+
+func decodeCoAPOptionNibble(nibble int, data []byte) (int, []byte, error) {
+	switch nibble {
+	case 13:
+		if len(data) < 1 {
+			return 0, nil, errors.New("coap option is truncated")
+		}
+
+		return int(data[0]) + 13, data[1:], nil
+	case 14:
+		if len(data) < 2 {
+			return 0, nil, errors.New("coap option is truncated")
+		}
+
+		return int(binary.BigEndian.Uint16(data)) + 269, data[2:], nil
+	case 15:
+		return 0, nil, errors.New("invalid coap option")
+	}
+
+	return nibble, data, nil
+}
+
+// encodeCoAPUint encodes "value" using the minimum number of bytes, as
+// required by the uint CoAP option format
+func encodeCoAPUint(value uint32) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, value)
+
+	for len(data) > 0 && data[0] == 0 {
+		data = data[1:]
+	}
+
+	return data
+}
+
+func decodeCoAPUint(data []byte) uint32 {
+	var value uint32
+	for _, b := range data {
+		value = value<<8 | uint32(b)
+	}
+
+	return value
+}
+
+// coapBlock is the value of a Block2 option
+type coapBlock struct {
+	num  uint32
+	more bool
+	size int
+}
+
+func (b coapBlock) encode() uint32 {
+	// the block size is 2^(szx + 4)
+	var szx uint32
+	for (16 << szx) < b.size {
+		szx++
+	}
+
+	value := b.num<<4 | szx
+	if b.more {
+		value |= 0x08
+	}
+
+	return value
+}
+
+func decodeCoAPBlock(value uint32) coapBlock {
+	return coapBlock{
+		num:  value >> 4,
+		more: value&0x08 != 0,
+		size: 16 << (value & 0x07),
+	}
+}
@@ -0,0 +1,523 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/installmodes/imxkobs"
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+// coapTestServer answers each request with the messages returned by
+// "handler", which may return none to drop the request
+type coapTestServer struct {
+	conn     net.PacketConn
+	handler  func(req *coapMessage) []*coapMessage
+	requests chan *coapMessage
+}
+
+func newCoAPTestServer(t *testing.T, handler func(req *coapMessage) []*coapMessage) *coapTestServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	s := &coapTestServer{
+		conn:     conn,
+		handler:  handler,
+		requests: make(chan *coapMessage, 100),
+	}
+
+	go func() {
+		buf := make([]byte, 2048)
+
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			data := make([]byte, n)
+			copy(data, buf[:n])
+
+			req, err := parseCoAPMessage(data)
+			if err != nil {
+				continue
+			}
+
+			s.requests <- req
+
+			for _, res := range s.handler(req) {
+				data, _ := res.marshal()
+				conn.WriteTo(data, addr)
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *coapTestServer) apiRequester() ApiRequester {
+	return NewApiClient(s.conn.LocalAddr().String()).Request()
+}
+
+func (s *coapTestServer) Close() {
+	s.conn.Close()
+}
+
+func newTestCoAPClient() *CoAPClient {
+	c := NewCoAPClient()
+	c.ackTimeout = 10 * time.Millisecond
+	return c
+}
+
+func coapPiggybackedResponse(req *coapMessage, code uint8, payload []byte) *coapMessage {
+	return &coapMessage{
+		typ:       coapAcknowledgement,
+		code:      code,
+		messageID: req.messageID,
+		token:     req.token,
+		payload:   payload,
+	}
+}
+
+// coapBlockResponse serves the block requested by "req" out of "data"
+// using blocks of "size" bytes at most
+func coapBlockResponse(req *coapMessage, data []byte, size int) *coapMessage {
+	block := coapBlock{size: size}
+	if value, ok := req.uintOption(coapOptionBlock2); ok {
+		block = decodeCoAPBlock(value)
+		if block.size > size {
+			block = coapBlock{num: block.num * uint32(block.size/size), size: size}
+		}
+	}
+
+	start := int(block.num) * block.size
+	end := start + block.size
+	if end > len(data) {
+		end = len(data)
+	}
+
+	block.more = end < len(data)
+
+	res := coapPiggybackedResponse(req, coapContent, data[start:end])
+	res.addUintOption(coapOptionBlock2, block.encode())
+	res.addUintOption(coapOptionSize2, uint32(len(data)))
+
+	return res
+}
+
+func coapRequestPath(req *coapMessage) string {
+	segments := []string{}
+	for _, o := range req.options {
+		if o.number == coapOptionURIPath {
+			segments = append(segments, string(o.value))
+		}
+	}
+
+	return "/" + strings.Join(segments, "/")
+}
+
+func TestCoAPMessageMarshalAndParse(t *testing.T) {
+	m := &coapMessage{
+		typ:       coapConfirmable,
+		code:      coapGET,
+		messageID: 0x1234,
+		token:     []byte{0xaa, 0xbb},
+		payload:   []byte("payload"),
+	}
+
+	m.addUintOption(coapOptionSize2, 300)
+	m.setPath("/some/" + strings.Repeat("x", 300))
+	m.addUintOption(coapOptionBlock2, coapBlock{num: 2, more: true, size: 1024}.encode())
+
+	data, err := m.marshal()
+	assert.NoError(t, err)
+
+	parsed, err := parseCoAPMessage(data)
+	assert.NoError(t, err)
+
+	assert.Equal(t, m, parsed)
+	assert.Equal(t, "/some/"+strings.Repeat("x", 300), coapRequestPath(parsed))
+
+	size, ok := parsed.uintOption(coapOptionSize2)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(300), size)
+
+	value, ok := parsed.uintOption(coapOptionBlock2)
+	assert.True(t, ok)
+	assert.Equal(t, coapBlock{num: 2, more: true, size: 1024}, decodeCoAPBlock(value))
+}
+
+func TestParseCoAPMessageWithInvalidData(t *testing.T) {
+	testCases := []struct {
+		name          string
+		data          []byte
+		expectedError string
+	}{
+		{"TooShort", []byte{0x40, 0x01}, "coap message is too short"},
+		{"InvalidVersion", []byte{0x80, 0x01, 0x00, 0x01}, "unsupported coap version"},
+		{"InvalidToken", []byte{0x44, 0x01, 0x00, 0x01, 0xaa}, "invalid coap token"},
+		{"TruncatedOption", []byte{0x40, 0x01, 0x00, 0x01, 0xb4, 'a'}, "coap option is truncated"},
+		{"EmptyPayload", []byte{0x40, 0x01, 0x00, 0x01, 0xff}, "empty coap payload after marker"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := parseCoAPMessage(tc.data)
+			assert.EqualError(t, err, tc.expectedError)
+			assert.Nil(t, m)
+		})
+	}
+}
+
+func TestCoAPCheckUpdateWithInvalidApiRequester(t *testing.T) {
+	c := newTestCoAPClient()
+
+	updateMetadata, extraPoll, err := c.CheckUpdate(context.Background(), nil, UpgradesEndpoint, &metadata.FirmwareMetadata{})
+	assert.Nil(t, updateMetadata)
+	assert.Equal(t, time.Duration(0), extraPoll)
+	assert.EqualError(t, err, "invalid api requester")
+}
+
+func TestCoAPCheckUpdateWithUpdateAvailable(t *testing.T) {
+	// declaration just to register the imxkobs install mode
+	_ = &imxkobs.ImxKobsObject{}
+
+	expectedBody := `{"product-uid": "0123456789", "objects": [[{"mode": "imxkobs", "sha256sum": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"}]], "version": "1.2"}`
+
+	s := newCoAPTestServer(t, func(req *coapMessage) []*coapMessage {
+		// a small block size to force a blockwise transfer
+		return []*coapMessage{coapBlockResponse(req, []byte(expectedBody), 64)}
+	})
+	defer s.Close()
+
+	c := newTestCoAPClient()
+
+	updateMetadata, extraPoll, err := c.CheckUpdate(context.Background(), s.apiRequester(), UpgradesEndpoint, &metadata.FirmwareMetadata{ProductUID: "0123456789"})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), extraPoll)
+
+	um := updateMetadata.(*metadata.UpdateMetadata)
+	assert.Equal(t, "0123456789", um.ProductUID)
+	assert.Equal(t, []byte(expectedBody), um.RawBytes)
+
+	// one request for each block
+	assert.Equal(t, 3, len(s.requests))
+
+	req := <-s.requests
+	assert.Equal(t, uint8(coapPOST), req.code)
+	assert.Equal(t, UpgradesEndpoint, coapRequestPath(req))
+	assert.Contains(t, string(req.payload), `"product-uid":"0123456789"`)
+
+	format, ok := req.uintOption(coapOptionContentFormat)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(coapContentFormatJSON), format)
+}
+
+func TestCoAPCheckUpdateWithNoUpdateAvailable(t *testing.T) {
+	s := newCoAPTestServer(t, func(req *coapMessage) []*coapMessage {
+		return []*coapMessage{coapPiggybackedResponse(req, coapNotFound, nil)}
+	})
+	defer s.Close()
+
+	c := newTestCoAPClient()
+
+	updateMetadata, _, err := c.CheckUpdate(context.Background(), s.apiRequester(), UpgradesEndpoint, &metadata.FirmwareMetadata{})
+	assert.NoError(t, err)
+	assert.Nil(t, updateMetadata)
+}
+
+func TestCoAPCheckUpdateWithInvalidStatus(t *testing.T) {
+	s := newCoAPTestServer(t, func(req *coapMessage) []*coapMessage {
+		return []*coapMessage{coapPiggybackedResponse(req, 160, nil)}
+	})
+	defer s.Close()
+
+	c := newTestCoAPClient()
+
+	updateMetadata, _, err := c.CheckUpdate(context.Background(), s.apiRequester(), UpgradesEndpoint, &metadata.FirmwareMetadata{})
+	assert.EqualError(t, err, "invalid response received from the server. Status 5.00")
+	assert.Nil(t, updateMetadata)
+}
+
+func TestCoAPCheckUpdateWithTimeout(t *testing.T) {
+	s := newCoAPTestServer(t, func(req *coapMessage) []*coapMessage {
+		return nil
+	})
+	defer s.Close()
+
+	c := newTestCoAPClient()
+
+	updateMetadata, _, err := c.CheckUpdate(context.Background(), s.apiRequester(), UpgradesEndpoint, &metadata.FirmwareMetadata{})
+	assert.EqualError(t, err, "check update request failed: request timed out")
+	assert.Nil(t, updateMetadata)
+
+	// the first transmission and its retransmissions
+	assert.Equal(t, coapMaxRetransmit+1, len(s.requests))
+}
+
+func TestCoAPCheckUpdateWithRetransmission(t *testing.T) {
+	var received int
+
+	s := newCoAPTestServer(t, func(req *coapMessage) []*coapMessage {
+		received++
+		if received == 1 {
+			// lost
+			return nil
+		}
+
+		return []*coapMessage{coapPiggybackedResponse(req, coapNotFound, nil)}
+	})
+	defer s.Close()
+
+	c := newTestCoAPClient()
+
+	updateMetadata, _, err := c.CheckUpdate(context.Background(), s.apiRequester(), UpgradesEndpoint, &metadata.FirmwareMetadata{})
+	assert.NoError(t, err)
+	assert.Nil(t, updateMetadata)
+
+	first := <-s.requests
+	second := <-s.requests
+	assert.Equal(t, first.messageID, second.messageID)
+}
+
+func TestCoAPCheckUpdateWithSeparateResponse(t *testing.T) {
+	s := newCoAPTestServer(t, func(req *coapMessage) []*coapMessage {
+		if req.typ == coapAcknowledgement {
+			return nil
+		}
+
+		return []*coapMessage{
+			{typ: coapAcknowledgement, messageID: req.messageID},
+			{typ: coapConfirmable, code: coapNotFound, messageID: req.messageID + 100, token: req.token},
+		}
+	})
+	defer s.Close()
+
+	c := newTestCoAPClient()
+
+	updateMetadata, _, err := c.CheckUpdate(context.Background(), s.apiRequester(), UpgradesEndpoint, &metadata.FirmwareMetadata{})
+	assert.NoError(t, err)
+	assert.Nil(t, updateMetadata)
+
+	req := <-s.requests
+
+	// the separate response must be acknowledged
+	select {
+	case ack := <-s.requests:
+		assert.Equal(t, uint8(coapAcknowledgement), ack.typ)
+		assert.Equal(t, req.messageID+100, ack.messageID)
+	case <-time.After(time.Second):
+		assert.Fail(t, "the separate response wasn't acknowledged")
+	}
+}
+
+func TestCoAPFetchUpdate(t *testing.T) {
+	object := bytes.Repeat([]byte("0123456789"), 300)
+
+	s := newCoAPTestServer(t, func(req *coapMessage) []*coapMessage {
+		if coapRequestPath(req) != "/object" {
+			return []*coapMessage{coapPiggybackedResponse(req, coapNotFound, nil)}
+		}
+
+		return []*coapMessage{coapBlockResponse(req, object, coapBlockSize)}
+	})
+	defer s.Close()
+
+	c := newTestCoAPClient()
+
+	body, length, err := c.FetchUpdate(context.Background(), s.apiRequester(), "/object", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(object)), length)
+
+	data, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.NoError(t, body.Close())
+	assert.Equal(t, object, data)
+
+	// resuming from the middle of a block
+	body, length, err = c.FetchUpdate(context.Background(), s.apiRequester(), "/object", 1500)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(object)-1500), length)
+
+	data, err = ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.NoError(t, body.Close())
+	assert.Equal(t, object[1500:], data)
+}
+
+func TestCoAPFetchUpdateWithSmallerServerBlockSize(t *testing.T) {
+	object := bytes.Repeat([]byte("0123456789"), 300)
+
+	s := newCoAPTestServer(t, func(req *coapMessage) []*coapMessage {
+		return []*coapMessage{coapBlockResponse(req, object, 256)}
+	})
+	defer s.Close()
+
+	c := newTestCoAPClient()
+
+	body, _, err := c.FetchUpdate(context.Background(), s.apiRequester(), "/object", 1500)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.NoError(t, body.Close())
+	assert.Equal(t, object[1500:], data)
+}
+
+func TestCoAPFetchUpdateWithoutBlockwiseTransfer(t *testing.T) {
+	s := newCoAPTestServer(t, func(req *coapMessage) []*coapMessage {
+		return []*coapMessage{coapPiggybackedResponse(req, coapContent, []byte("content"))}
+	})
+	defer s.Close()
+
+	c := newTestCoAPClient()
+
+	body, length, err := c.FetchUpdate(context.Background(), s.apiRequester(), "/object", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), length)
+
+	data, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.NoError(t, body.Close())
+	assert.Equal(t, []byte("ntent"), data)
+}
+
+func TestCoAPFetchUpdateWithNotFound(t *testing.T) {
+	s := newCoAPTestServer(t, func(req *coapMessage) []*coapMessage {
+		return []*coapMessage{coapPiggybackedResponse(req, coapNotFound, nil)}
+	})
+	defer s.Close()
+
+	c := newTestCoAPClient()
+
+	body, length, err := c.FetchUpdate(context.Background(), s.apiRequester(), "/object", 0)
+	assert.EqualError(t, err, "failed to fetch update. maybe the file is missing?")
+	assert.Equal(t, 404, err.(*StatusError).StatusCode)
+	assert.Nil(t, body)
+	assert.Equal(t, int64(-1), length)
+}
+
+func TestCoAPFetchUpdateWithInvalidApiRequester(t *testing.T) {
+	c := newTestCoAPClient()
+
+	body, length, err := c.FetchUpdate(context.Background(), nil, "/object", 0)
+	assert.EqualError(t, err, "invalid api requester")
+	assert.Nil(t, body)
+	assert.Equal(t, int64(-1), length)
+}
+
+func TestCoAPCheckUpdateThroughDTLS(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	caPEM, _, ca := generateCertificate(t, nil, true)
+	certPEM, keyPEM, _ := generateCertificate(t, &ca, false)
+	_, _, serverCert := generateCertificate(t, &ca, false)
+
+	assert.NoError(t, afero.WriteFile(fs, "/client.crt", certPEM, 0644))
+	assert.NoError(t, afero.WriteFile(fs, "/client.key", keyPEM, 0600))
+	assert.NoError(t, afero.WriteFile(fs, "/ca.crt", caPEM, 0644))
+
+	serverLeaf, err := x509.ParseCertificate(serverCert.Certificate[0])
+	assert.NoError(t, err)
+
+	l, err := dtls.Listen("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, &dtls.Config{
+		Certificate: serverLeaf,
+		PrivateKey:  serverCert.PrivateKey,
+		ClientAuth:  dtls.RequireAnyClientCert,
+	})
+	assert.NoError(t, err)
+	defer l.Close(time.Second)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 2048)
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		req, err := parseCoAPMessage(buf[:n])
+		if err != nil {
+			return
+		}
+
+		data, _ := coapPiggybackedResponse(req, coapNotFound, nil).marshal()
+		conn.Write(data)
+	}()
+
+	config, err := NewTLSConfig(fs, "/client.crt", "/client.key", "/ca.crt")
+	assert.NoError(t, err)
+
+	c := NewCoAPClient()
+	assert.NoError(t, c.EnableDTLS(config))
+
+	updateMetadata, _, err := c.CheckUpdate(context.Background(), NewApiClient(l.Addr().String()).Request(), UpgradesEndpoint, &metadata.FirmwareMetadata{})
+	assert.NoError(t, err)
+	assert.Nil(t, updateMetadata)
+}
+
+func TestCoAPCheckUpdateMarksServerDown(t *testing.T) {
+	s := newCoAPTestServer(t, func(req *coapMessage) []*coapMessage {
+		return nil
+	})
+	defer s.Close()
+
+	c := newTestCoAPClient()
+
+	api := s.apiRequester()
+	api.Client().SetServers([]string{s.conn.LocalAddr().String(), "secondary"}, time.Minute)
+
+	_, _, err := c.CheckUpdate(context.Background(), api, UpgradesEndpoint, &metadata.FirmwareMetadata{})
+	assert.EqualError(t, err, "check update request failed: request timed out")
+
+	assert.Equal(t, []string{"secondary", s.conn.LocalAddr().String()}, api.Client().availableServers())
+}
+
+func TestCoAPCheckUpdateWithCancelledContext(t *testing.T) {
+	s := newCoAPTestServer(t, func(req *coapMessage) []*coapMessage {
+		return nil
+	})
+	defer s.Close()
+
+	c := newTestCoAPClient()
+
+	api := s.apiRequester()
+	api.Client().SetServers([]string{s.conn.LocalAddr().String(), "secondary"}, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	_, _, err := c.CheckUpdate(ctx, api, UpgradesEndpoint, &metadata.FirmwareMetadata{})
+	assert.EqualError(t, err, "check update request failed: connection closed")
+
+	// an aborted request says nothing about the server
+	assert.Equal(t, []string{s.conn.LocalAddr().String(), "secondary"}, api.Client().availableServers())
+}
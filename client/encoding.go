@@ -0,0 +1,75 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// acceptedEncodings are the content encodings the objects may be
+// transferred with, in the order they are preferred
+const acceptedEncodings = "zstd, gzip"
+
+// contentEncoding returns the content encoding of "res", an empty
+// string means the body isn't encoded
+func contentEncoding(res *http.Response) string {
+	encoding := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding")))
+	if encoding == "identity" {
+		return ""
+	}
+
+	return encoding
+}
+
+// decodeBody returns the body of "res" decoded from its content
+// encoding. The body is returned as is if it isn't encoded.
+func decodeBody(res *http.Response) (io.ReadCloser, error) {
+	var decoder io.ReadCloser
+
+	switch encoding := contentEncoding(res); encoding {
+	case "":
+		return res.Body, nil
+	case "gzip", "x-gzip":
+		rd, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the gzip content: %s", err)
+		}
+
+		decoder = rd
+	case "zstd":
+		rd, err := zstd.NewReader(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the zstd content: %s", err)
+		}
+
+		decoder = rd.IOReadCloser()
+	default:
+		return nil, fmt.Errorf("unsupported content encoding '%s'", encoding)
+	}
+
+	return &decodedBody{ReadCloser: decoder, body: res.Body}, nil
+}
+
+// decodedBody closes the response body along with its decoder
+type decodedBody struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	b.ReadCloser.Close()
+
+	return b.body.Close()
+}
@@ -0,0 +1,48 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"net/http"
+)
+
+// StatusError is returned when the server answers a request with an
+// unexpected status. The CoAP response codes are given in the same
+// form as the HTTP ones (e.g. 4.04 is 404).
+type StatusError struct {
+	StatusCode int
+
+	message string
+}
+
+func (e *StatusError) Error() string {
+	return e.message
+}
+
+// Permanent tells whether repeating the request won't make a
+// difference, which is the case of the client errors (4xx) but the
+// request timeouts and the throttled requests
+func (e *StatusError) Permanent() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+// IsPermanentError tells whether "err" is a StatusError which won't go
+// away by repeating the request
+func IsPermanentError(err error) bool {
+	if se, ok := err.(*StatusError); ok {
+		return se.Permanent()
+	}
+
+	return false
+}
@@ -0,0 +1,38 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPermanentError(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"NotFound", &StatusError{StatusCode: http.StatusNotFound}, true},
+		{"Forbidden", &StatusError{StatusCode: http.StatusForbidden}, true},
+		{"RequestTimeout", &StatusError{StatusCode: http.StatusRequestTimeout}, false},
+		{"TooManyRequests", &StatusError{StatusCode: http.StatusTooManyRequests}, false},
+		{"ServiceUnavailable", &StatusError{StatusCode: http.StatusServiceUnavailable}, false},
+		{"NetworkError", errors.New("connection refused"), false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, IsPermanentError(tc.err))
+		})
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+type apiServer struct {
+	address   string
+	downUntil time.Time
+}
+
+// SetServers makes the client fail over through "servers", which are
+// tried in the given priority order. A server that can't be reached is
+// marked down and skipped during "cooldown", unless all the others are
+// down as well.
+func (client *ApiClient) SetServers(servers []string, cooldown time.Duration) {
+	client.serversMutex.Lock()
+	defer client.serversMutex.Unlock()
+
+	client.servers = nil
+	client.cooldown = cooldown
+
+	for _, address := range servers {
+		if address != "" {
+			client.servers = append(client.servers, &apiServer{address: address})
+		}
+	}
+
+	if len(client.servers) > 0 {
+		client.server = client.servers[0].address
+	}
+}
+
+// OverrideServer makes the requests to go only to "address" instead of
+// the servers given to SetServers, until it's called again with an
+// empty address
+func (client *ApiClient) OverrideServer(address string) {
+	client.serversMutex.Lock()
+	defer client.serversMutex.Unlock()
+
+	client.override = address
+}
+
+// OverriddenServer returns the address given to OverrideServer, if any
+func (client *ApiClient) OverriddenServer() string {
+	client.serversMutex.Lock()
+	defer client.serversMutex.Unlock()
+
+	return client.override
+}
+
+// address returns the address the requests are aimed at
+func (client *ApiClient) address() string {
+	client.serversMutex.Lock()
+	defer client.serversMutex.Unlock()
+
+	if client.override != "" {
+		return client.override
+	}
+
+	return client.server
+}
+
+// availableServers returns the addresses in the order they must be
+// tried: the servers which are up by priority followed by the down ones
+func (client *ApiClient) availableServers() []string {
+	client.serversMutex.Lock()
+	defer client.serversMutex.Unlock()
+
+	if client.override != "" {
+		return []string{client.override}
+	}
+
+	if len(client.servers) == 0 {
+		return []string{client.server}
+	}
+
+	now := time.Now()
+
+	up := []string{}
+	down := []string{}
+
+	for _, s := range client.servers {
+		if now.Before(s.downUntil) {
+			down = append(down, s.address)
+		} else {
+			up = append(up, s.address)
+		}
+	}
+
+	return append(up, down...)
+}
+
+func (client *ApiClient) setServerDown(address string) {
+	client.setServerDownUntil(address, time.Now().Add(client.cooldown))
+}
+
+func (client *ApiClient) setServerUp(address string) {
+	client.setServerDownUntil(address, time.Time{})
+}
+
+func (client *ApiClient) setServerDownUntil(address string, until time.Time) {
+	client.serversMutex.Lock()
+	defer client.serversMutex.Unlock()
+
+	for _, s := range client.servers {
+		if s.address == address {
+			s.downUntil = until
+		}
+	}
+}
+
+// do sends "req" to the available servers until one of them can be
+// reached. Only the requests aimed at the server are failed over.
+func (client *ApiClient) do(req *http.Request) (*http.Response, error) {
+	servers := client.availableServers()
+
+	if len(servers) == 1 || req.URL.Host != client.server {
+		return client.Client.Do(req)
+	}
+
+	// the body is sent again to each server
+	var body []byte
+	if req.Body != nil {
+		var err error
+
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var res *http.Response
+	var err error
+
+	for _, address := range servers {
+		attempt := new(http.Request)
+		*attempt = *req
+
+		u := *req.URL
+		u.Host = address
+
+		attempt.URL = &u
+		attempt.Host = ""
+
+		if req.Body != nil {
+			attempt.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		res, err = client.Client.Do(attempt)
+		if err == nil {
+			client.setServerUp(address)
+			return res, nil
+		}
+
+		// an aborted request says nothing about the server
+		if req.Context().Err() != nil {
+			return nil, err
+		}
+
+		client.setServerDown(address)
+	}
+
+	return nil, err
+}
@@ -0,0 +1,167 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unreachableAddress returns an address in which nobody is listening
+func unreachableAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	address := l.Addr().String()
+	l.Close()
+
+	return address
+}
+
+func TestApiClientSetServers(t *testing.T) {
+	c := NewApiClient("localhost")
+	assert.Equal(t, []string{"localhost"}, c.availableServers())
+
+	c.SetServers([]string{"primary", "", "secondary", "tertiary"}, time.Minute)
+	assert.Equal(t, "primary", c.server)
+	assert.Equal(t, []string{"primary", "secondary", "tertiary"}, c.availableServers())
+
+	// the down servers are the last resort
+	c.setServerDown("primary")
+	assert.Equal(t, []string{"secondary", "tertiary", "primary"}, c.availableServers())
+
+	c.setServerDown("tertiary")
+	assert.Equal(t, []string{"secondary", "primary", "tertiary"}, c.availableServers())
+
+	// after the cooldown
+	c.setServerDownUntil("primary", time.Now().Add(-time.Second))
+	assert.Equal(t, []string{"primary", "secondary", "tertiary"}, c.availableServers())
+
+	c.setServerUp("tertiary")
+	assert.Equal(t, []string{"primary", "secondary", "tertiary"}, c.availableServers())
+}
+
+func TestApiClientFailover(t *testing.T) {
+	var received []byte
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	unreachable := unreachableAddress(t)
+
+	c := NewApiClient("localhost")
+	c.SetServers([]string{unreachable, u.Host}, time.Minute)
+
+	req, err := http.NewRequest(http.MethodPost, serverURL(c, "/upgrades"), bytes.NewBufferString("body"))
+	assert.NoError(t, err)
+
+	res, err := c.Request().Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []byte("body"), received)
+
+	assert.Equal(t, []string{u.Host, unreachable}, c.availableServers())
+}
+
+func TestApiClientFailoverWithAllServersDown(t *testing.T) {
+	first := unreachableAddress(t)
+	second := unreachableAddress(t)
+
+	c := NewApiClient("localhost")
+	c.SetServers([]string{first, second}, time.Minute)
+
+	req, err := http.NewRequest(http.MethodGet, serverURL(c, "/upgrades"), nil)
+	assert.NoError(t, err)
+
+	res, err := c.Request().Do(req)
+	assert.Error(t, err)
+	assert.Nil(t, res)
+
+	// they are still tried
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	c.SetServers([]string{first, u.Host}, time.Minute)
+	c.setServerDown(u.Host)
+
+	res, err = c.Request().Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []string{u.Host, first}, c.availableServers())
+}
+
+func TestApiClientFailoverOnlyForServerRequests(t *testing.T) {
+	var requested bool
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+	}))
+	defer s.Close()
+
+	c := NewApiClient("localhost")
+	c.SetServers([]string{unreachableAddress(t), unreachableAddress(t)}, time.Minute)
+
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	assert.NoError(t, err)
+
+	_, err = c.Request().Do(req)
+	assert.NoError(t, err)
+	assert.True(t, requested)
+}
+
+func TestApiClientOverrideServer(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	unreachable := unreachableAddress(t)
+
+	c := NewApiClient("localhost")
+	c.SetServers([]string{unreachable}, time.Minute)
+
+	c.OverrideServer(u.Host)
+	assert.Equal(t, u.Host, c.OverriddenServer())
+	assert.Equal(t, []string{u.Host}, c.availableServers())
+
+	req, err := http.NewRequest(http.MethodGet, serverURL(c, "/upgrades"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, u.Host, req.URL.Host)
+
+	res, err := c.Request().Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	// the servers are used again
+	c.OverrideServer("")
+	assert.Equal(t, "", c.OverriddenServer())
+	assert.Equal(t, "http://"+unreachable+"/upgrades", serverURL(c, "/upgrades"))
+}
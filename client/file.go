@@ -0,0 +1,214 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+// fileSignatureSuffix is appended to the path of the update metadata
+// to get the path of its signature
+const fileSignatureSuffix = ".sig"
+
+// FileClient implements the Updater interface over a local dir, such
+// as a mounted medium or a pre-seeded dir, for the devices which can't
+// reach the server. The dir is laid out as the server paths: the update
+// metadata is at "upgrades", its signature (raw, not base64 encoded) at
+// "upgrades.sig" and the objects at "<product-uid>/<package-uid>/<sha256sum>".
+// The update is offered to the devices of its product which run an
+// older version, or any other version when "AllowDowngrade" is set.
+type FileClient struct {
+	AllowDowngrade bool
+
+	fs  afero.Fs
+	dir string
+}
+
+// NewFileClient creates a file updater reading from "dir" of "fsb"
+func NewFileClient(fsb afero.Fs, dir string) *FileClient {
+	return &FileClient{fs: fsb, dir: dir}
+}
+
+// updateFile is a file the updates are read from, of an afero.Fs or of
+// a remote file system
+type updateFile interface {
+	io.ReadSeeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// CheckUpdate reads the update metadata at "uri", there is no update
+// when it's missing. The "data" of the update check tells the product
+// and the version of the device.
+func (c *FileClient) CheckUpdate(ctx context.Context, api ApiRequester, uri string, data interface{}) (interface{}, time.Duration, error) {
+	return checkUpdateFile(c.open, c.path(uri), data, c.AllowDowngrade)
+}
+
+// FetchUpdate opens the object at "uri" from byte "offset"
+func (c *FileClient) FetchUpdate(ctx context.Context, api ApiRequester, uri string, offset int64) (io.ReadCloser, int64, error) {
+	file, err := c.open(c.path(uri))
+	if err != nil {
+		return nil, -1, fmt.Errorf("failed to fetch update: %s", err)
+	}
+
+	return fetchUpdateFile(file, offset)
+}
+
+func (c *FileClient) open(name string) (updateFile, error) {
+	return c.fs.Open(name)
+}
+
+// checkUpdateFile reads the update metadata at "metadataPath" through
+// "open" and its signature next to it. The update is offered when it's
+// of the product of the device ("data") and of a newer version, or of
+// an older one when "allowDowngrade" is set. Unlike the server, a dir
+// can't tell the update is meant to downgrade the device, so a stale
+// medium or mirror doesn't roll the device back.
+func checkUpdateFile(open func(string) (updateFile, error), metadataPath string, data interface{}, allowDowngrade bool) (interface{}, time.Duration, error) {
+	body, err := readUpdateFile(open, metadataPath)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read the update metadata: %s", err)
+	}
+
+	updateMetadata, err := metadata.NewUpdateMetadata(body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse the update metadata at '%s': %s", metadataPath, err)
+	}
+
+	var device struct {
+		ProductUID string `json:"product-uid"`
+		Version    string `json:"version"`
+	}
+
+	rawJSON, _ := json.Marshal(data)
+	json.Unmarshal(rawJSON, &device)
+
+	if updateMetadata.ProductUID != device.ProductUID || updateMetadata.Version == device.Version {
+		return nil, 0, nil
+	}
+
+	if compareVersions(updateMetadata.Version, device.Version) < 0 && !allowDowngrade {
+		return nil, 0, nil
+	}
+
+	signature, err := readUpdateFile(open, metadataPath+fileSignatureSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, fmt.Errorf("failed to read the update metadata signature: %s", err)
+	}
+
+	updateMetadata.Signature = signature
+
+	return updateMetadata, 0, nil
+}
+
+// compareVersions compares the versions "a" and "b" part by part, the
+// parts are split at the dots, dashes, underscores and pluses. The
+// numeric parts are compared as numbers and the others as text, a
+// version followed by more parts is the newer one. It returns -1, 0 or
+// 1 when "a" is older, the same or newer.
+func compareVersions(a string, b string) int {
+	split := func(version string) []string {
+		return strings.FieldsFunc(version, func(r rune) bool {
+			return r == '.' || r == '-' || r == '_' || r == '+'
+		})
+	}
+
+	pa, pb := split(a), split(b)
+
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		x, y := pa[i], pb[i]
+
+		if isNumeric(x) && isNumeric(y) {
+			// compared by their digits so they can't overflow
+			x = strings.TrimLeft(x, "0")
+			y = strings.TrimLeft(y, "0")
+
+			if len(x) != len(y) {
+				if len(x) < len(y) {
+					return -1
+				}
+
+				return 1
+			}
+		}
+
+		if c := strings.Compare(x, y); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case len(pa) < len(pb):
+		return -1
+	case len(pa) > len(pb):
+		return 1
+	}
+
+	return 0
+}
+
+func isNumeric(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return s != ""
+}
+
+func readUpdateFile(open func(string) (updateFile, error), name string) ([]byte, error) {
+	file, err := open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	return ioutil.ReadAll(file)
+}
+
+// fetchUpdateFile skips the first "offset" bytes of "file", which is
+// closed on failure
+func fetchUpdateFile(file updateFile, offset int64) (io.ReadCloser, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, -1, fmt.Errorf("failed to fetch update: %s", err)
+	}
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, -1, fmt.Errorf("failed to skip already downloaded data: %s", err)
+	}
+
+	return file, info.Size() - offset, nil
+}
+
+// path returns the path of "uri" inside the dir, the ".." elements
+// can't leave it
+func (c *FileClient) path(uri string) string {
+	return path.Join(c.dir, path.Clean("/"+uri))
+}
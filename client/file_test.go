@@ -0,0 +1,174 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+const fileTestMetadata = `{
+  "product-uid": "0123456789",
+  "version": "2.0",
+  "objects": [
+    [
+      { "mode": "imxkobs", "sha256sum": "d0b425e00e15a0d36b9b361f02bab63563aed6cb4665083905386c55d5b679fa" }
+    ]
+  ]
+}`
+
+type fileTestDevice struct {
+	Retries int `json:"retries"`
+	metadata.FirmwareMetadata
+}
+
+func newTestFileClient(t *testing.T) (*FileClient, afero.Fs) {
+	fs := afero.NewMemMapFs()
+
+	err := afero.WriteFile(fs, "/media/updates/upgrades", []byte(fileTestMetadata), 0644)
+	assert.NoError(t, err)
+
+	err = afero.WriteFile(fs, "/media/updates/upgrades.sig", []byte("signature"), 0644)
+	assert.NoError(t, err)
+
+	err = afero.WriteFile(fs, "/media/updates/0123456789/puid/sha256sum", []byte("object content"), 0644)
+	assert.NoError(t, err)
+
+	return NewFileClient(fs, "/media/updates"), fs
+}
+
+func TestFileClientCheckUpdate(t *testing.T) {
+	c, _ := newTestFileClient(t)
+
+	device := fileTestDevice{FirmwareMetadata: metadata.FirmwareMetadata{ProductUID: "0123456789", Version: "1.0"}}
+
+	updateMetadata, extraPoll, err := c.CheckUpdate(context.Background(), nil, UpgradesEndpoint, device)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, int(extraPoll))
+
+	m := updateMetadata.(*metadata.UpdateMetadata)
+	assert.Equal(t, "2.0", m.Version)
+	assert.Equal(t, []byte(fileTestMetadata), m.RawBytes)
+	assert.Equal(t, []byte("signature"), m.Signature)
+}
+
+func TestFileClientCheckUpdateWithoutUpdate(t *testing.T) {
+	testCases := []struct {
+		name       string
+		productUID string
+		version    string
+	}{
+		{"AnotherProduct", "9876543210", "1.0"},
+		{"AlreadyInstalled", "0123456789", "2.0"},
+		{"Older", "0123456789", "10.0"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, _ := newTestFileClient(t)
+
+			device := fileTestDevice{FirmwareMetadata: metadata.FirmwareMetadata{ProductUID: tc.productUID, Version: tc.version}}
+
+			updateMetadata, _, err := c.CheckUpdate(context.Background(), nil, UpgradesEndpoint, device)
+			assert.NoError(t, err)
+			assert.Nil(t, updateMetadata)
+		})
+	}
+
+	// without the update metadata
+	c := NewFileClient(afero.NewMemMapFs(), "/media/updates")
+
+	updateMetadata, _, err := c.CheckUpdate(context.Background(), nil, UpgradesEndpoint, fileTestDevice{})
+	assert.NoError(t, err)
+	assert.Nil(t, updateMetadata)
+}
+
+func TestFileClientCheckUpdateWithDowngrade(t *testing.T) {
+	c, _ := newTestFileClient(t)
+	c.AllowDowngrade = true
+
+	device := fileTestDevice{FirmwareMetadata: metadata.FirmwareMetadata{ProductUID: "0123456789", Version: "10.0"}}
+
+	updateMetadata, _, err := c.CheckUpdate(context.Background(), nil, UpgradesEndpoint, device)
+	assert.NoError(t, err)
+
+	m := updateMetadata.(*metadata.UpdateMetadata)
+	assert.Equal(t, "2.0", m.Version)
+}
+
+func TestFileClientCheckUpdateWithInvalidMetadata(t *testing.T) {
+	c, fs := newTestFileClient(t)
+
+	err := afero.WriteFile(fs, "/media/updates/upgrades", []byte("{"), 0644)
+	assert.NoError(t, err)
+
+	_, _, err = c.CheckUpdate(context.Background(), nil, UpgradesEndpoint, fileTestDevice{})
+	assert.EqualError(t, err, "failed to parse the update metadata at '/media/updates/upgrades': unexpected end of JSON input")
+}
+
+func TestFileClientFetchUpdate(t *testing.T) {
+	c, _ := newTestFileClient(t)
+
+	body, contentLength, err := c.FetchUpdate(context.Background(), nil, "/0123456789/puid/sha256sum", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(14), contentLength)
+
+	data, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, "object content", string(data))
+	body.Close()
+
+	// resumed
+	body, contentLength, err = c.FetchUpdate(context.Background(), nil, "/0123456789/puid/sha256sum", 7)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), contentLength)
+
+	data, err = ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+	body.Close()
+
+	_, _, err = c.FetchUpdate(context.Background(), nil, "/0123456789/puid/missing", 0)
+	assert.Error(t, err)
+}
+
+func TestCompareVersions(t *testing.T) {
+	testCases := []struct {
+		a        string
+		b        string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "2.0", -1},
+		{"2.0", "1.0", 1},
+		{"1.9", "1.10", -1},
+		{"1.01", "1.1", 0},
+		{"1.0", "1.0.1", -1},
+		{"1.0-rc1", "1.0-rc2", -1},
+		{"2017.05", "2018.01_1", -1},
+		{"99999999999999999999.0", "1.0", 1},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, compareVersions(tc.a, tc.b), "%s vs %s", tc.a, tc.b)
+	}
+}
+
+func TestFileClientPath(t *testing.T) {
+	c := NewFileClient(afero.NewMemMapFs(), "/media/updates")
+
+	assert.Equal(t, "/media/updates/upgrades", c.path("/upgrades"))
+	assert.Equal(t, "/media/updates/etc/shadow", c.path("/../../etc/shadow"))
+}
@@ -0,0 +1,408 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+const (
+	// GRPCService is the gRPC service the server implements, it's
+	// defined at "updatehub.proto"
+	GRPCService = "updatehub.Agent"
+
+	grpcContentType = "application/grpc"
+	grpcDialTimeout = 30 * time.Second
+)
+
+// gRPC status codes
+const (
+	grpcOK                = 0
+	grpcDeadlineExceeded  = 4
+	grpcNotFound          = 5
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+// GRPCClient implements the Updater and the reporting interfaces over
+// gRPC, for the servers which don't provide the REST API. The update
+// objects are streamed in chunks by the FetchUpdate call.
+type GRPCClient struct {
+	client http.Client
+	scheme string
+}
+
+// NewGRPCClient creates a gRPC client that talks to the server through
+// TLS using "config" or, when it's nil, through plain text HTTP/2
+func NewGRPCClient(config *tls.Config) *GRPCClient {
+	dialer := &net.Dialer{Timeout: grpcDialTimeout}
+
+	t := &http2.Transport{
+		TLSClientConfig: config,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return tls.DialWithDialer(dialer, network, addr, cfg)
+		},
+	}
+
+	c := &GRPCClient{scheme: "https"}
+
+	if config == nil {
+		t.AllowHTTP = true
+		t.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return dialer.Dial(network, addr)
+		}
+
+		c.scheme = "http"
+	}
+
+	c.client.Transport = t
+
+	return c
+}
+
+// CheckUpdate calls "CheckUpdate" with the JSON of "data". The "uri" is
+// only meaningful to the REST API, so it's ignored.
+func (c *GRPCClient) CheckUpdate(ctx context.Context, api ApiRequester, uri string, data interface{}) (interface{}, time.Duration, error) {
+	if api == nil {
+		return nil, 0, errors.New("invalid api requester")
+	}
+
+	rawJSON, _ := json.Marshal(data)
+
+	s, err := c.call(ctx, api.Client(), "CheckUpdate", protoAppendBytes(nil, 1, rawJSON))
+	if err != nil {
+		return nil, 0, fmt.Errorf("check update request failed: %s", err)
+	}
+
+	defer s.close()
+
+	message, err := s.next()
+	if se, ok := err.(*StatusError); ok && se.StatusCode == http.StatusNotFound {
+		// NotFound is not an error in this case, just means there is no update available
+		return nil, 0, nil
+	}
+
+	if err == io.EOF {
+		err = errors.New("empty response")
+	}
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid response received from the server: %s", err)
+	}
+
+	var res grpcCheckUpdateResponse
+
+	err = res.unmarshal(message)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse upgrade response: %s", err)
+	}
+
+	if len(res.updateMetadata) == 0 {
+		return nil, 0, nil
+	}
+
+	updateMetadata, err := metadata.NewUpdateMetadata(res.updateMetadata)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse upgrade response: %s", err)
+	}
+
+	updateMetadata.Signature = res.signature
+
+	return updateMetadata, time.Duration(res.extraPoll), nil
+}
+
+// FetchUpdate calls "FetchUpdate" for the object at "uri" starting from
+// byte "offset", the chunks are received while the returned reader is
+// read. The number of bytes that remain to be read is only known when
+// the server sends the object size, otherwise it is -1.
+func (c *GRPCClient) FetchUpdate(ctx context.Context, api ApiRequester, uri string, offset int64) (io.ReadCloser, int64, error) {
+	if api == nil {
+		return nil, -1, errors.New("invalid api requester")
+	}
+
+	request := protoAppendBytes(nil, 1, []byte(uri))
+	request = protoAppendVarint(request, 2, uint64(offset))
+
+	s, err := c.call(ctx, api.Client(), "FetchUpdate", request)
+	if err != nil {
+		return nil, -1, fmt.Errorf("fetch update request failed: %s", err)
+	}
+
+	r := &grpcChunkReader{stream: s}
+
+	// the first chunk tells whether the object exists and its size
+	chunk, err := r.fetch()
+	if err == io.EOF {
+		// an empty object has no chunks at all
+		return r, 0, nil
+	}
+
+	if err != nil {
+		s.close()
+
+		if se, ok := err.(*StatusError); ok {
+			return nil, -1, &StatusError{StatusCode: se.StatusCode, message: "failed to fetch update: " + se.message}
+		}
+
+		return nil, -1, fmt.Errorf("fetch update request failed: %s", err)
+	}
+
+	remaining := int64(-1)
+	if chunk.size > 0 {
+		remaining = chunk.size - offset
+	}
+
+	return r, remaining, nil
+}
+
+type grpcChunkReader struct {
+	stream *grpcStream
+	buf    []byte
+}
+
+// fetch receives the next chunk, whose data is kept at the reader buffer
+func (r *grpcChunkReader) fetch() (*grpcChunk, error) {
+	message, err := r.stream.next()
+	if err != nil {
+		return nil, err
+	}
+
+	chunk := &grpcChunk{}
+
+	err = chunk.unmarshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	r.buf = chunk.data
+
+	return chunk, nil
+}
+
+func (r *grpcChunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if _, err := r.fetch(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+func (r *grpcChunkReader) Close() error {
+	return r.stream.close()
+}
+
+func (c *GRPCClient) ReportState(api ApiRequester, packageUID string, state string) error {
+	return c.report(api, stateReport(packageUID, state))
+}
+
+// ReportProgress reports the state along with its progress
+func (c *GRPCClient) ReportProgress(api ApiRequester, packageUID string, state string, progress int) error {
+	data := stateReport(packageUID, state)
+	data["progress"] = progress
+
+	return c.report(api, data)
+}
+
+// ReportError reports the state along with the error cause and the
+// event log
+func (c *GRPCClient) ReportError(api ApiRequester, packageUID string, state string, errorMessage string, entries interface{}) error {
+	data := stateReport(packageUID, state)
+	data["error-message"] = errorMessage
+
+	if entries != nil {
+		data["event-log"] = entries
+	}
+
+	return c.report(api, data)
+}
+
+// ReportTelemetry reports the state along with the error cause, the
+// event log and the objects telemetry
+func (c *GRPCClient) ReportTelemetry(api ApiRequester, packageUID string, state string, errorMessage string, entries interface{}, telemetry interface{}) error {
+	return c.report(api, telemetryReport(packageUID, state, errorMessage, entries, telemetry))
+}
+
+// ReportDetailedError reports the state along with the error cause
+// and its details, the event log and the objects telemetry
+func (c *GRPCClient) ReportDetailedError(api ApiRequester, packageUID string, state string, errorMessage string, details interface{}, entries interface{}, telemetry interface{}) error {
+	return c.report(api, detailedErrorReport(packageUID, state, errorMessage, details, entries, telemetry))
+}
+
+// ReportSimulatedState reports the state flagged as simulated
+func (c *GRPCClient) ReportSimulatedState(api ApiRequester, packageUID string, state string) error {
+	data := stateReport(packageUID, state)
+	data["dry-run"] = true
+
+	return c.report(api, data)
+}
+
+// report calls "Report" with the JSON of the REST API report
+func (c *GRPCClient) report(api ApiRequester, data map[string]interface{}) error {
+	if api == nil {
+		return errors.New("invalid api requester")
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	s, err := c.call(context.Background(), api.Client(), "Report", protoAppendBytes(nil, 1, body))
+	if err != nil {
+		return errors.New("report request failed")
+	}
+
+	defer s.close()
+
+	for {
+		_, err = s.next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return errors.New("failed to report state")
+		}
+	}
+}
+
+// call sends "message" to the "method" of the service, failing over
+// through the available servers until one of them can be reached. The
+// call is aborted once "ctx" is done.
+func (c *GRPCClient) call(ctx context.Context, api *ApiClient, method string, message []byte) (*grpcStream, error) {
+	var res *http.Response
+	var err error
+
+	for _, address := range api.availableServers() {
+		url := fmt.Sprintf("%s://%s/%s/%s", c.scheme, address, GRPCService, method)
+
+		var req *http.Request
+
+		req, err = http.NewRequest(http.MethodPost, url, bytes.NewReader(grpcFrame(message)))
+		if err != nil {
+			return nil, err
+		}
+
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", grpcContentType)
+		req.Header.Set("TE", "trailers")
+
+		res, err = c.client.Do(req)
+		if err == nil {
+			api.setServerUp(address)
+			break
+		}
+
+		// an aborted call says nothing about the server
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		api.setServerDown(address)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("the server answered with the HTTP status %d", res.StatusCode)
+	}
+
+	return &grpcStream{res: res}, nil
+}
+
+// grpcStream reads the messages of a gRPC response
+type grpcStream struct {
+	res *http.Response
+}
+
+// next returns the next message of the stream. It returns io.EOF once
+// the stream ends with the OK status or the StatusError of any other.
+func (s *grpcStream) next() ([]byte, error) {
+	message, err := readGRPCMessage(s.res.Body)
+	if err == io.EOF {
+		if se := grpcStatus(s.res); se != nil {
+			return nil, se
+		}
+	}
+
+	return message, err
+}
+
+func (s *grpcStream) close() error {
+	return s.res.Body.Close()
+}
+
+// grpcStatus returns the StatusError of the status the server ended the
+// response with, which only carries the headers when there is no
+// message, or nil if it's OK
+func grpcStatus(res *http.Response) *StatusError {
+	status := res.Trailer.Get("Grpc-Status")
+	message := res.Trailer.Get("Grpc-Message")
+
+	if status == "" {
+		status = res.Header.Get("Grpc-Status")
+		message = res.Header.Get("Grpc-Message")
+	}
+
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return &StatusError{StatusCode: http.StatusInternalServerError, message: "the server didn't send the gRPC status"}
+	}
+
+	if code == grpcOK {
+		return nil
+	}
+
+	return &StatusError{StatusCode: grpcHTTPStatus(code), message: fmt.Sprintf("gRPC status %d: %s", code, message)}
+}
+
+// grpcHTTPStatus returns the HTTP status equivalent to the gRPC "code",
+// so the errors are told apart as the REST ones
+func grpcHTTPStatus(code int) int {
+	switch code {
+	case grpcDeadlineExceeded:
+		return http.StatusRequestTimeout
+	case grpcNotFound:
+		return http.StatusNotFound
+	case grpcPermissionDenied:
+		return http.StatusForbidden
+	case grpcResourceExhausted:
+		return http.StatusTooManyRequests
+	case grpcUnavailable:
+		return http.StatusServiceUnavailable
+	case grpcUnauthenticated:
+		return http.StatusUnauthorized
+	}
+
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,212 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// protobuf wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// grpcMaxMessageSize limits the size of the messages received from the
+// server
+const grpcMaxMessageSize = 16 << 20
+
+// protoField is a decoded field of a protobuf message, "value" holds
+// the varint ones
+type protoField struct {
+	num   int
+	typ   int
+	value uint64
+	data  []byte
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+
+	n := binary.PutUvarint(tmp[:], v)
+
+	return append(buf, tmp[:n]...)
+}
+
+// protoAppendVarint appends the field "num" holding "v" to "buf", a
+// zero value is left out as proto3 does
+func protoAppendVarint(buf []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return buf
+	}
+
+	buf = appendUvarint(buf, uint64(num)<<3|protoVarint)
+
+	return appendUvarint(buf, v)
+}
+
+// protoAppendBytes appends the field "num" holding "data" to "buf", an
+// empty value is left out as proto3 does
+func protoAppendBytes(buf []byte, num int, data []byte) []byte {
+	if len(data) == 0 {
+		return buf
+	}
+
+	buf = appendUvarint(buf, uint64(num)<<3|protoBytes)
+	buf = appendUvarint(buf, uint64(len(data)))
+
+	return append(buf, data...)
+}
+
+// parseProtoMessage decodes the fields of a protobuf message. The
+// fixed size fields aren't used by the agent, so they are skipped.
+func parseProtoMessage(data []byte) ([]protoField, error) {
+	fields := []protoField{}
+
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("invalid protobuf field key")
+		}
+
+		data = data[n:]
+
+		f := protoField{num: int(key >> 3), typ: int(key & 0x7)}
+
+		switch f.typ {
+		case protoVarint:
+			f.value, n = binary.Uvarint(data)
+			if n <= 0 {
+				return nil, errors.New("invalid protobuf varint")
+			}
+
+			data = data[n:]
+		case protoBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return nil, errors.New("invalid protobuf length")
+			}
+
+			f.data = data[n : n+int(size)]
+			data = data[n+int(size):]
+		case protoFixed64, protoFixed32:
+			size := 8
+			if f.typ == protoFixed32 {
+				size = 4
+			}
+
+			if len(data) < size {
+				return nil, errors.New("truncated protobuf field")
+			}
+
+			data = data[size:]
+			continue
+		default:
+			return nil, errors.New("unsupported protobuf wire type")
+		}
+
+		fields = append(fields, f)
+	}
+
+	return fields, nil
+}
+
+// grpcCheckUpdateResponse is the "CheckUpdateResponse" message
+type grpcCheckUpdateResponse struct {
+	updateMetadata []byte
+	signature      []byte
+	extraPoll      int64
+}
+
+func (m *grpcCheckUpdateResponse) unmarshal(data []byte) error {
+	fields, err := parseProtoMessage(data)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			m.updateMetadata = f.data
+		case 2:
+			m.signature = f.data
+		case 3:
+			m.extraPoll = int64(f.value)
+		}
+	}
+
+	return nil
+}
+
+// grpcChunk is the "Chunk" message of the FetchUpdate stream
+type grpcChunk struct {
+	data []byte
+	size int64
+}
+
+func (m *grpcChunk) unmarshal(data []byte) error {
+	fields, err := parseProtoMessage(data)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			m.data = f.data
+		case 2:
+			m.size = int64(f.value)
+		}
+	}
+
+	return nil
+}
+
+// grpcFrame prefixes "message" with the uncompressed flag and its size
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+
+	return append(frame, message...)
+}
+
+// readGRPCMessage reads the next length-prefixed message from "r". It
+// returns io.EOF when "r" ends between messages.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var header [5]byte
+
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	if header[0] != 0 {
+		return nil, errors.New("compressed gRPC messages are not supported")
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > grpcMaxMessageSize {
+		return nil, errors.New("gRPC message too large")
+	}
+
+	message := make([]byte, size)
+
+	if _, err := io.ReadFull(r, message); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	return message, nil
+}
@@ -0,0 +1,358 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/UpdateHub/updatehub/installmodes/imxkobs"
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+type grpcTestRequest struct {
+	method string
+	fields []protoField
+}
+
+// grpcTestServer answers each call with the messages and the status
+// returned by "handler"
+type grpcTestServer struct {
+	*httptest.Server
+	requests chan grpcTestRequest
+}
+
+func newGRPCTestServer(t *testing.T, handler func(req grpcTestRequest) ([][]byte, int)) *grpcTestServer {
+	s := &grpcTestServer{requests: make(chan grpcTestRequest, 10)}
+
+	s.Server = httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, 2, r.ProtoMajor)
+		assert.Equal(t, grpcContentType, r.Header.Get("Content-Type"))
+		assert.Equal(t, "trailers", r.Header.Get("TE"))
+
+		message, err := readGRPCMessage(r.Body)
+		assert.NoError(t, err)
+
+		fields, err := parseProtoMessage(message)
+		assert.NoError(t, err)
+
+		req := grpcTestRequest{method: r.URL.Path, fields: fields}
+		s.requests <- req
+
+		messages, status := handler(req)
+
+		w.Header().Set("Content-Type", grpcContentType)
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+
+		for _, m := range messages {
+			w.Write(grpcFrame(m))
+			w.(http.Flusher).Flush()
+		}
+
+		w.Header().Set("Grpc-Status", strconv.Itoa(status))
+		w.Header().Set("Grpc-Message", "status message")
+	}), &http2.Server{}))
+
+	return s
+}
+
+func (s *grpcTestServer) apiRequester() ApiRequester {
+	u, _ := url.Parse(s.URL)
+
+	return NewApiClient(u.Host).Request()
+}
+
+func TestProtoMessageMarshalAndParse(t *testing.T) {
+	data := protoAppendBytes(nil, 1, []byte("uri"))
+	data = protoAppendVarint(data, 2, 300)
+	// left out
+	data = protoAppendVarint(data, 3, 0)
+	data = protoAppendBytes(data, 4, nil)
+
+	fields, err := parseProtoMessage(data)
+	assert.NoError(t, err)
+	assert.Equal(t, []protoField{
+		{num: 1, typ: protoBytes, data: []byte("uri")},
+		{num: 2, typ: protoVarint, value: 300},
+	}, fields)
+
+	_, err = parseProtoMessage([]byte{0x0a, 0x05, 'u'})
+	assert.EqualError(t, err, "invalid protobuf length")
+}
+
+func TestGRPCCheckUpdateWithInvalidApiRequester(t *testing.T) {
+	c := NewGRPCClient(nil)
+
+	updateMetadata, extraPoll, err := c.CheckUpdate(context.Background(), nil, UpgradesEndpoint, &metadata.FirmwareMetadata{})
+	assert.Nil(t, updateMetadata)
+	assert.Equal(t, time.Duration(0), extraPoll)
+	assert.EqualError(t, err, "invalid api requester")
+}
+
+func TestGRPCCheckUpdateWithUpdateAvailable(t *testing.T) {
+	// declaration just to register the imxkobs install mode
+	_ = &imxkobs.ImxKobsObject{}
+
+	expectedBody := `{"product-uid": "0123456789", "objects": [[{"mode": "imxkobs", "sha256sum": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"}]], "version": "1.2"}`
+
+	s := newGRPCTestServer(t, func(req grpcTestRequest) ([][]byte, int) {
+		res := protoAppendBytes(nil, 1, []byte(expectedBody))
+		res = protoAppendBytes(res, 2, []byte("signature"))
+		res = protoAppendVarint(res, 3, 13)
+
+		return [][]byte{res}, grpcOK
+	})
+	defer s.Close()
+
+	c := NewGRPCClient(nil)
+
+	updateMetadata, extraPoll, err := c.CheckUpdate(context.Background(), s.apiRequester(), UpgradesEndpoint, &metadata.FirmwareMetadata{ProductUID: "0123456789"})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(13), extraPoll)
+
+	um := updateMetadata.(*metadata.UpdateMetadata)
+	assert.Equal(t, "0123456789", um.ProductUID)
+	assert.Equal(t, []byte(expectedBody), um.RawBytes)
+	assert.Equal(t, []byte("signature"), um.Signature)
+
+	req := <-s.requests
+	assert.Equal(t, "/updatehub.Agent/CheckUpdate", req.method)
+	assert.Equal(t, 1, len(req.fields))
+	assert.Contains(t, string(req.fields[0].data), `"product-uid":"0123456789"`)
+}
+
+func TestGRPCCheckUpdateWithNoUpdateAvailable(t *testing.T) {
+	testCases := []struct {
+		name     string
+		messages [][]byte
+		status   int
+	}{
+		{"NotFound", nil, grpcNotFound},
+		{"EmptyMetadata", [][]byte{{}}, grpcOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newGRPCTestServer(t, func(req grpcTestRequest) ([][]byte, int) {
+				return tc.messages, tc.status
+			})
+			defer s.Close()
+
+			c := NewGRPCClient(nil)
+
+			updateMetadata, _, err := c.CheckUpdate(context.Background(), s.apiRequester(), UpgradesEndpoint, &metadata.FirmwareMetadata{})
+			assert.NoError(t, err)
+			assert.Nil(t, updateMetadata)
+		})
+	}
+}
+
+func TestGRPCCheckUpdateWithInvalidStatus(t *testing.T) {
+	s := newGRPCTestServer(t, func(req grpcTestRequest) ([][]byte, int) {
+		return nil, grpcUnavailable
+	})
+	defer s.Close()
+
+	c := NewGRPCClient(nil)
+
+	updateMetadata, _, err := c.CheckUpdate(context.Background(), s.apiRequester(), UpgradesEndpoint, &metadata.FirmwareMetadata{})
+	assert.EqualError(t, err, "invalid response received from the server: gRPC status 14: status message")
+	assert.Nil(t, updateMetadata)
+}
+
+func TestGRPCCheckUpdateMarksServerDown(t *testing.T) {
+	s := newGRPCTestServer(t, func(req grpcTestRequest) ([][]byte, int) {
+		return nil, grpcNotFound
+	})
+	defer s.Close()
+
+	u, _ := url.Parse(s.URL)
+
+	c := NewGRPCClient(nil)
+
+	api := s.apiRequester()
+	api.Client().SetServers([]string{"127.0.0.1:1", u.Host}, time.Minute)
+
+	_, _, err := c.CheckUpdate(context.Background(), api, UpgradesEndpoint, &metadata.FirmwareMetadata{})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{u.Host, "127.0.0.1:1"}, api.Client().availableServers())
+}
+
+func TestGRPCFetchUpdate(t *testing.T) {
+	s := newGRPCTestServer(t, func(req grpcTestRequest) ([][]byte, int) {
+		return [][]byte{
+			protoAppendVarint(protoAppendBytes(nil, 1, []byte("cont")), 2, 10),
+			protoAppendBytes(nil, 1, []byte("ent")),
+		}, grpcOK
+	})
+	defer s.Close()
+
+	c := NewGRPCClient(nil)
+
+	body, contentLength, err := c.FetchUpdate(context.Background(), s.apiRequester(), "/object", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), contentLength)
+
+	data, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+	assert.NoError(t, body.Close())
+
+	req := <-s.requests
+	assert.Equal(t, "/updatehub.Agent/FetchUpdate", req.method)
+	assert.Equal(t, []protoField{
+		{num: 1, typ: protoBytes, data: []byte("/object")},
+		{num: 2, typ: protoVarint, value: 3},
+	}, req.fields)
+}
+
+func TestGRPCFetchUpdateWithStreamError(t *testing.T) {
+	s := newGRPCTestServer(t, func(req grpcTestRequest) ([][]byte, int) {
+		return [][]byte{protoAppendBytes(nil, 1, []byte("cont"))}, grpcUnavailable
+	})
+	defer s.Close()
+
+	c := NewGRPCClient(nil)
+
+	body, contentLength, err := c.FetchUpdate(context.Background(), s.apiRequester(), "/object", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), contentLength)
+
+	data, err := ioutil.ReadAll(body)
+	assert.EqualError(t, err, "gRPC status 14: status message")
+	assert.Equal(t, "cont", string(data))
+	assert.False(t, IsPermanentError(err))
+}
+
+func TestGRPCFetchUpdateWithNotFound(t *testing.T) {
+	s := newGRPCTestServer(t, func(req grpcTestRequest) ([][]byte, int) {
+		return nil, grpcNotFound
+	})
+	defer s.Close()
+
+	c := NewGRPCClient(nil)
+
+	body, contentLength, err := c.FetchUpdate(context.Background(), s.apiRequester(), "/object", 0)
+	assert.EqualError(t, err, "failed to fetch update: gRPC status 5: status message")
+	assert.True(t, IsPermanentError(err))
+	assert.Nil(t, body)
+	assert.Equal(t, int64(-1), contentLength)
+}
+
+func TestGRPCReport(t *testing.T) {
+	testCases := []struct {
+		name           string
+		status         int
+		expectedError  string
+		expectedReport map[string]interface{}
+		report         func(c *GRPCClient, api ApiRequester) error
+	}{
+		{
+			"State",
+			grpcOK,
+			"",
+			map[string]interface{}{"status": "downloading", "package-uid": "puid", "error-message": ""},
+			func(c *GRPCClient, api ApiRequester) error {
+				return c.ReportState(api, "puid", "downloading")
+			},
+		},
+
+		{
+			"Progress",
+			grpcOK,
+			"",
+			map[string]interface{}{"status": "downloading", "package-uid": "puid", "error-message": "", "progress": float64(50)},
+			func(c *GRPCClient, api ApiRequester) error {
+				return c.ReportProgress(api, "puid", "downloading", 50)
+			},
+		},
+
+		{
+			"Error",
+			grpcOK,
+			"",
+			map[string]interface{}{"status": "error", "package-uid": "puid", "error-message": "failure"},
+			func(c *GRPCClient, api ApiRequester) error {
+				return c.ReportError(api, "puid", "error", "failure", nil)
+			},
+		},
+
+		{
+			"DetailedError",
+			grpcOK,
+			"",
+			map[string]interface{}{"status": "error", "package-uid": "puid", "error-message": "failure", "error-details": map[string]interface{}{"class": "install"}},
+			func(c *GRPCClient, api ApiRequester) error {
+				return c.ReportDetailedError(api, "puid", "error", "failure", map[string]string{"class": "install"}, nil, nil)
+			},
+		},
+
+		{
+			"Simulated",
+			grpcOK,
+			"",
+			map[string]interface{}{"status": "installing", "package-uid": "puid", "error-message": "", "dry-run": true},
+			func(c *GRPCClient, api ApiRequester) error {
+				return c.ReportSimulatedState(api, "puid", "installing")
+			},
+		},
+
+		{
+			"Failure",
+			grpcUnavailable,
+			"failed to report state",
+			map[string]interface{}{"status": "downloading", "package-uid": "puid", "error-message": ""},
+			func(c *GRPCClient, api ApiRequester) error {
+				return c.ReportState(api, "puid", "downloading")
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newGRPCTestServer(t, func(req grpcTestRequest) ([][]byte, int) {
+				return [][]byte{{}}, tc.status
+			})
+			defer s.Close()
+
+			err := tc.report(NewGRPCClient(nil), s.apiRequester())
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedError)
+			}
+
+			req := <-s.requests
+			assert.Equal(t, "/updatehub.Agent/Report", req.method)
+
+			var report map[string]interface{}
+			err = json.Unmarshal(req.fields[0].data, &report)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedReport, report)
+		})
+	}
+}
+
+func TestGRPCReportWithInvalidApiRequester(t *testing.T) {
+	err := NewGRPCClient(nil).ReportState(nil, "puid", "downloading")
+	assert.EqualError(t, err, "invalid api requester")
+}
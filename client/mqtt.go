@@ -0,0 +1,89 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/UpdateHub/updatehub/log"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttQoS is the QoS used to subscribe the notifications topic, "at
+// least once" is enough since the agent only probes the server
+const mqttQoS = 1
+
+// mqttConnectWait is how long Connect waits for the first attempt, the
+// next ones are made in the background
+const mqttConnectWait = time.Second
+
+// MQTTNotifier subscribes to a MQTT topic and calls "notify" for each
+// message published there
+type MQTTNotifier struct {
+	client mqtt.Client
+	topic  string
+	notify func()
+}
+
+// NewMQTTNotifier creates a MQTTNotifier for the "broker" (e.g.
+// "tcp://host:1883" or "ssl://host:8883"). "tlsConfig" may be nil.
+// The connection is retried until the broker is reachable and restored
+// whenever it's lost, the topic is subscribed again each time.
+func NewMQTTNotifier(broker string, clientID string, topic string, tlsConfig *tls.Config, notify func()) *MQTTNotifier {
+	n := &MQTTNotifier{
+		topic:  topic,
+		notify: notify,
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(broker)
+	opts.SetClientID(clientID)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetOnConnectHandler(n.subscribe)
+
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	n.client = mqtt.NewClient(opts)
+
+	return n
+}
+
+// Connect connects to the broker. An unreachable broker isn't an
+// error, the connection is retried in the background until it's up.
+func (n *MQTTNotifier) Connect() error {
+	// the token only completes once connected, or on the errors which
+	// retrying won't fix
+	token := n.client.Connect()
+	if token.WaitTimeout(mqttConnectWait) && token.Error() != nil {
+		return fmt.Errorf("failed to connect to the MQTT broker: %s", token.Error())
+	}
+
+	return nil
+}
+
+// Disconnect disconnects from the broker
+func (n *MQTTNotifier) Disconnect() {
+	n.client.Disconnect(250)
+}
+
+func (n *MQTTNotifier) subscribe(c mqtt.Client) {
+	token := c.Subscribe(n.topic, mqttQoS, n.handleMessage)
+	if token.Wait() && token.Error() != nil {
+		log.Warn(fmt.Sprintf("failed to subscribe to the MQTT topic '%s': %s", n.topic, token.Error()))
+	}
+}
+
+func (n *MQTTNotifier) handleMessage(c mqtt.Client, m mqtt.Message) {
+	n.notify()
+}
@@ -0,0 +1,116 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeMQTTToken struct {
+	mqtt.Token
+	err     error
+	pending bool
+}
+
+func (t *fakeMQTTToken) Wait() bool {
+	return true
+}
+
+func (t *fakeMQTTToken) WaitTimeout(time.Duration) bool {
+	return !t.pending
+}
+
+func (t *fakeMQTTToken) Error() error {
+	return t.err
+}
+
+type fakeMQTTClient struct {
+	mqtt.Client
+	connectErr   error
+	connecting   bool
+	subscribeErr error
+	topic        string
+	qos          byte
+	callback     mqtt.MessageHandler
+}
+
+func (c *fakeMQTTClient) Connect() mqtt.Token {
+	return &fakeMQTTToken{err: c.connectErr, pending: c.connecting}
+}
+
+func (c *fakeMQTTClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.topic = topic
+	c.qos = qos
+	c.callback = callback
+
+	return &fakeMQTTToken{err: c.subscribeErr}
+}
+
+func TestNewMQTTNotifier(t *testing.T) {
+	n := NewMQTTNotifier("tcp://localhost:1883", "device", "updatehub/device", nil, func() {})
+	assert.NotNil(t, n.client)
+	assert.Equal(t, "updatehub/device", n.topic)
+	assert.False(t, n.client.IsConnected())
+}
+
+func TestMQTTNotifierNotifiesMessages(t *testing.T) {
+	notifications := 0
+
+	c := &fakeMQTTClient{}
+
+	n := NewMQTTNotifier("tcp://localhost:1883", "device", "updatehub/device", nil, func() {
+		notifications++
+	})
+	n.client = c
+
+	err := n.Connect()
+	assert.NoError(t, err)
+
+	// the broker calls the "OnConnect" handler
+	n.subscribe(c)
+	assert.Equal(t, "updatehub/device", c.topic)
+	assert.Equal(t, byte(mqttQoS), c.qos)
+
+	c.callback(c, nil)
+	c.callback(c, nil)
+	assert.Equal(t, 2, notifications)
+}
+
+func TestMQTTNotifierWithConnectError(t *testing.T) {
+	n := NewMQTTNotifier("tcp://localhost:1883", "device", "updatehub/device", nil, func() {})
+	n.client = &fakeMQTTClient{connectErr: fmt.Errorf("connection refused")}
+
+	err := n.Connect()
+	assert.EqualError(t, err, "failed to connect to the MQTT broker: connection refused")
+}
+
+func TestMQTTNotifierWithUnreachableBroker(t *testing.T) {
+	n := NewMQTTNotifier("tcp://localhost:1883", "device", "updatehub/device", nil, func() {})
+	n.client = &fakeMQTTClient{connecting: true}
+
+	// the connection is retried in the background
+	err := n.Connect()
+	assert.NoError(t, err)
+}
+
+func TestMQTTNotifierWithSubscribeError(t *testing.T) {
+	c := &fakeMQTTClient{subscribeErr: fmt.Errorf("not authorized")}
+
+	n := NewMQTTNotifier("tcp://localhost:1883", "device", "updatehub/device", nil, func() {})
+	n.client = c
+
+	// a failed subscription is only logged
+	n.subscribe(c)
+	assert.Equal(t, "updatehub/device", c.topic)
+}
@@ -0,0 +1,201 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/mdns"
+)
+
+const (
+	// PeerService is the mDNS service advertised by the agents which
+	// serve their objects to the LAN
+	PeerService = "_updatehub._tcp"
+
+	// PeerObjectsEndpoint is where a peer serves its objects, named
+	// after their sha256sum
+	PeerObjectsEndpoint = "/objects"
+
+	// PeerSignatureHeader authenticates the requests of the peers, see
+	// PeerSignature
+	PeerSignatureHeader = "UpdateHub-Peer-Signature"
+
+	// PeerSignatureMaxAge is for how long a signature is accepted
+	// after, or before, the time it was made at. The clocks of the
+	// peers must agree within it.
+	PeerSignatureMaxAge = 2 * time.Minute
+
+	// peerProductField is the TXT field of the advertised service
+	// which holds the product the objects belong to
+	peerProductField = "product="
+)
+
+// PeerSignature is the signature of the request for the object
+// "objectUID" made at "t": the unix time followed by the hex encoded
+// HMAC-SHA256 of both by the "key" shared by the peers. The time
+// keeps a signature seen in the LAN from being replayed later, see
+// VerifyPeerSignature.
+func PeerSignature(key []byte, objectUID string, t time.Time) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+
+	return timestamp + ":" + peerMAC(key, objectUID, timestamp)
+}
+
+// VerifyPeerSignature tells whether "signature" was made by "key" for
+// the object "objectUID" no more than "PeerSignatureMaxAge" away from
+// "now"
+func VerifyPeerSignature(key []byte, objectUID string, signature string, now time.Time) bool {
+	parts := strings.SplitN(signature, ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > PeerSignatureMaxAge || age < -PeerSignatureMaxAge {
+		return false
+	}
+
+	return hmac.Equal([]byte(parts[1]), []byte(peerMAC(key, objectUID, parts[0])))
+}
+
+func peerMAC(key []byte, objectUID string, timestamp string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(objectUID + ":" + timestamp))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// AdvertisePeer advertises through mDNS that the objects of the
+// product "productUID" are served at "port". The advertisement lasts
+// until the returned server is shut down.
+func AdvertisePeer(productUID string, port int) (*mdns.Server, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := mdns.NewMDNSService(host, PeerService, "", "", port, nil, []string{peerProductField + productUID})
+	if err != nil {
+		return nil, err
+	}
+
+	return mdns.NewServer(&mdns.Config{Zone: service})
+}
+
+// DiscoverPeers returns the addresses ("<host>:<port>") of the peers
+// serving the objects of the product "productUID" which answered in
+// "timeout"
+func DiscoverPeers(productUID string, timeout time.Duration) ([]string, error) {
+	entries := make(chan *mdns.ServiceEntry, 16)
+	done := make(chan struct{})
+
+	peers := []string{}
+
+	go func() {
+		defer close(done)
+
+		for e := range entries {
+			if e.AddrV4 == nil || !hasPeerProduct(e.InfoFields, productUID) {
+				continue
+			}
+
+			peers = append(peers, net.JoinHostPort(e.AddrV4.String(), fmt.Sprint(e.Port)))
+		}
+	}()
+
+	params := mdns.DefaultParams(PeerService)
+	params.Entries = entries
+	params.Timeout = timeout
+
+	err := mdns.Query(params)
+
+	close(entries)
+	<-done
+
+	return peers, err
+}
+
+func hasPeerProduct(fields []string, productUID string) bool {
+	for _, f := range fields {
+		if f == peerProductField+productUID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FetchPeerObject requests the object "objectUID", from "offset", to
+// the peer at "address" and returns its body and length. The peer
+// must answer in "timeout".
+func FetchPeerObject(address string, objectUID string, key []byte, offset int64, timeout time.Duration) (io.ReadCloser, int64, error) {
+	url := fmt.Sprintf("http://%s%s/%s", address, PeerObjectsEndpoint, objectUID)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, -1, fmt.Errorf("failed to create peer request: %s", err)
+	}
+
+	req.Header.Set(PeerSignatureHeader, PeerSignature(key, objectUID, time.Now()))
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	c := &http.Client{
+		Transport: &http.Transport{
+			DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+			ResponseHeaderTimeout: timeout,
+		},
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, -1, fmt.Errorf("peer request failed: %s", err)
+	}
+
+	switch {
+	case res.StatusCode == http.StatusPartialContent:
+	case res.StatusCode == http.StatusOK && offset == 0:
+	case res.StatusCode == http.StatusOK:
+		// the whole object was served, so skip what was already
+		// downloaded
+		_, err = io.CopyN(ioutil.Discard, res.Body, offset)
+		if err != nil {
+			res.Body.Close()
+			return nil, -1, fmt.Errorf("failed to skip already downloaded data: %s", err)
+		}
+
+		if res.ContentLength > 0 {
+			res.ContentLength -= offset
+		}
+	default:
+		res.Body.Close()
+		return nil, -1, &StatusError{StatusCode: res.StatusCode, message: fmt.Sprintf("the peer '%s' doesn't serve the object '%s'", address, objectUID)}
+	}
+
+	return res.Body, res.ContentLength, nil
+}
@@ -0,0 +1,125 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newPeerTestServer(t *testing.T, key []byte, ignoreRange bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uid := strings.TrimPrefix(r.URL.Path, PeerObjectsEndpoint+"/")
+
+		if !VerifyPeerSignature(key, uid, r.Header.Get(PeerSignatureHeader), time.Now()) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if uid != "object" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if ignoreRange {
+			r.Header.Del("Range")
+		}
+
+		http.ServeContent(w, r, uid, time.Time{}, bytes.NewReader([]byte("content")))
+	}))
+}
+
+func TestPeerSignature(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+
+	assert.Equal(t, PeerSignature([]byte("key"), "object", now), PeerSignature([]byte("key"), "object", now))
+	assert.NotEqual(t, PeerSignature([]byte("key"), "object", now), PeerSignature([]byte("other"), "object", now))
+	assert.NotEqual(t, PeerSignature([]byte("key"), "object", now), PeerSignature([]byte("key"), "other", now))
+	assert.NotEqual(t, PeerSignature([]byte("key"), "object", now), PeerSignature([]byte("key"), "object", now.Add(time.Second)))
+	assert.True(t, strings.HasPrefix(PeerSignature([]byte("key"), "object", now), "1500000000:"))
+}
+
+func TestVerifyPeerSignature(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	signature := PeerSignature([]byte("key"), "object", now)
+
+	assert.True(t, VerifyPeerSignature([]byte("key"), "object", signature, now))
+	assert.True(t, VerifyPeerSignature([]byte("key"), "object", signature, now.Add(PeerSignatureMaxAge)))
+	assert.True(t, VerifyPeerSignature([]byte("key"), "object", signature, now.Add(-PeerSignatureMaxAge)))
+
+	// replayed too late, or made too far in the future
+	assert.False(t, VerifyPeerSignature([]byte("key"), "object", signature, now.Add(PeerSignatureMaxAge+time.Second)))
+	assert.False(t, VerifyPeerSignature([]byte("key"), "object", signature, now.Add(-PeerSignatureMaxAge-time.Second)))
+
+	assert.False(t, VerifyPeerSignature([]byte("other"), "object", signature, now))
+	assert.False(t, VerifyPeerSignature([]byte("key"), "other", signature, now))
+
+	// the time is part of what is signed
+	forged := "1500000060" + signature[strings.Index(signature, ":"):]
+	assert.False(t, VerifyPeerSignature([]byte("key"), "object", forged, now))
+
+	assert.False(t, VerifyPeerSignature([]byte("key"), "object", "", now))
+	assert.False(t, VerifyPeerSignature([]byte("key"), "object", "invalid:signature", now))
+}
+
+func TestFetchPeerObject(t *testing.T) {
+	testCases := []struct {
+		name        string
+		ignoreRange bool
+		offset      int64
+		expected    string
+	}{
+		{"Whole", false, 0, "content"},
+		{"FromOffset", false, 3, "tent"},
+		{"FromOffsetWithRangeIgnored", true, 3, "tent"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newPeerTestServer(t, []byte("key"), tc.ignoreRange)
+			defer ts.Close()
+
+			body, contentLength, err := FetchPeerObject(strings.TrimPrefix(ts.URL, "http://"), "object", []byte("key"), tc.offset, time.Second)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(tc.expected)), contentLength)
+
+			data, err := ioutil.ReadAll(body)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, string(data))
+			body.Close()
+		})
+	}
+}
+
+func TestFetchPeerObjectFailures(t *testing.T) {
+	ts := newPeerTestServer(t, []byte("key"), false)
+	defer ts.Close()
+
+	address := strings.TrimPrefix(ts.URL, "http://")
+
+	_, _, err := FetchPeerObject(address, "object", []byte("wrong"), 0, time.Second)
+	assert.Equal(t, http.StatusUnauthorized, err.(*StatusError).StatusCode)
+
+	_, _, err = FetchPeerObject(address, "missing", []byte("key"), 0, time.Second)
+	assert.Equal(t, http.StatusNotFound, err.(*StatusError).StatusCode)
+	assert.EqualError(t, err, "the peer '"+address+"' doesn't serve the object 'missing'")
+}
+
+func TestHasPeerProduct(t *testing.T) {
+	assert.True(t, hasPeerProduct([]string{"other=1", "product=0123"}, "0123"))
+	assert.False(t, hasPeerProduct([]string{"product=0123"}, "4567"))
+	assert.False(t, hasPeerProduct(nil, "0123"))
+}
@@ -0,0 +1,182 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// EnableProxy makes the client reach the server through the proxy at
+// "proxyURL", which is an "http", "https" or "socks5" URL that may
+// carry the credentials of an authenticated proxy. The environment
+// settings (HTTP_PROXY, HTTPS_PROXY and NO_PROXY) are used when it is
+// empty. The hosts matching "noProxy" and the loopback ones, where the
+// local API lives, are always reached directly.
+func (client *ApiClient) EnableProxy(proxyURL string, noProxy []string) error {
+	bypass := newProxyBypass(noProxy)
+
+	t := client.transport()
+
+	if proxyURL == "" {
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			if bypass.match(req.URL.Host) {
+				return nil, nil
+			}
+
+			return http.ProxyFromEnvironment(req)
+		}
+
+		return nil
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy '%s': %s", proxyURL, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			if bypass.match(req.URL.Host) {
+				return nil, nil
+			}
+
+			return u, nil
+		}
+	case "socks5":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+
+		direct := client.dialer()
+
+		socks, err := proxy.SOCKS5("tcp", u.Host, auth, direct)
+		if err != nil {
+			return fmt.Errorf("invalid proxy '%s': %s", proxyURL, err)
+		}
+
+		t.Proxy = nil
+		t.DialContext = nil
+		t.Dial = func(network string, addr string) (net.Conn, error) {
+			if bypass.match(addr) {
+				return direct.Dial(network, addr)
+			}
+
+			return socks.Dial(network, addr)
+		}
+	default:
+		return fmt.Errorf("unsupported proxy scheme '%s'", u.Scheme)
+	}
+
+	return nil
+}
+
+// transport returns the HTTP transport of the client, which is created
+// on demand so the TLS and proxy settings can be combined
+func (client *ApiClient) transport() *http.Transport {
+	if t, ok := client.Transport.(*http.Transport); ok {
+		return t
+	}
+
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+	}
+
+	client.Transport = t
+
+	return t
+}
+
+// proxyBypass holds the NO_PROXY like rules of the hosts that must be
+// reached directly: "*" matches every host, "example.com" matches the
+// domain and its subdomains, ".example.com" only the subdomains and
+// "10.0.0.0/8" the addresses inside the network
+type proxyBypass struct {
+	all      bool
+	domains  []string
+	networks []*net.IPNet
+	ips      []net.IP
+}
+
+func newProxyBypass(rules []string) *proxyBypass {
+	b := &proxyBypass{}
+
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+
+		switch {
+		case rule == "":
+		case rule == "*":
+			b.all = true
+		case strings.Contains(rule, "/"):
+			if _, network, err := net.ParseCIDR(rule); err == nil {
+				b.networks = append(b.networks, network)
+			}
+		case net.ParseIP(rule) != nil:
+			b.ips = append(b.ips, net.ParseIP(rule))
+		default:
+			b.domains = append(b.domains, rule)
+		}
+	}
+
+	return b
+}
+
+// match tells whether "addr", in the "host" or "host:port" form, must
+// be reached without the proxy
+func (b *proxyBypass) match(addr string) bool {
+	host := strings.ToLower(addr)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if b.all || host == "localhost" {
+		return true
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsLoopback() {
+			return true
+		}
+
+		for _, network := range b.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+
+		for _, i := range b.ips {
+			if i.Equal(ip) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, domain := range b.domains {
+		if strings.HasPrefix(domain, ".") {
+			if strings.HasSuffix(host, domain) {
+				return true
+			}
+		} else if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,224 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyBypass(t *testing.T) {
+	b := newProxyBypass([]string{"example.com", ".internal", "10.0.0.0/8", "192.168.1.1", " "})
+
+	testCases := []struct {
+		addr     string
+		expected bool
+	}{
+		{"localhost:8080", true},
+		{"127.0.0.1:8080", true},
+		{"[::1]:8080", true},
+		{"example.com", true},
+		{"api.EXAMPLE.com:443", true},
+		{"notexample.com", false},
+		{"internal", false},
+		{"server.internal:80", true},
+		{"10.1.2.3:80", true},
+		{"11.1.2.3:80", false},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"updatehub.io", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.addr, func(t *testing.T) {
+			assert.Equal(t, tc.expected, b.match(tc.addr))
+		})
+	}
+
+	assert.True(t, newProxyBypass([]string{"*"}).match("updatehub.io"))
+}
+
+func TestApiClientEnableProxyWithHTTPProxy(t *testing.T) {
+	var proxied *http.Request
+
+	p := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer p.Close()
+
+	u, err := url.Parse(p.URL)
+	assert.NoError(t, err)
+
+	c := NewApiClient("updatehub.example.com")
+
+	err = c.EnableProxy(fmt.Sprintf("http://user:pass@%s", u.Host), nil)
+	assert.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, serverURL(c, "/upgrades"), nil)
+	assert.NoError(t, err)
+
+	res, err := c.Request().Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	assert.NotNil(t, proxied)
+	assert.Equal(t, "http://updatehub.example.com/upgrades", proxied.RequestURI)
+	assert.Equal(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")), proxied.Header.Get("Proxy-Authorization"))
+}
+
+func TestApiClientEnableProxyBypassesLocalAPI(t *testing.T) {
+	var proxied bool
+
+	p := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = true
+	}))
+	defer p.Close()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	c := NewApiClient(u.Host)
+
+	err = c.EnableProxy(p.URL, nil)
+	assert.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, serverURL(c, "/info"), nil)
+	assert.NoError(t, err)
+
+	res, err := c.Request().Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.False(t, proxied)
+}
+
+// serveSOCKS5 accepts a single SOCKS5 connection authenticated by
+// "user"/"pass" and connects it to "target" whatever is the requested
+// address, which is sent through "requested"
+func serveSOCKS5(t *testing.T, l net.Listener, target string, requested chan string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 512)
+
+	// greeting: version, number of methods and methods
+	_, err = io.ReadFull(conn, buf[:2])
+	assert.NoError(t, err)
+	_, err = io.ReadFull(conn, buf[:buf[1]])
+	assert.NoError(t, err)
+	conn.Write([]byte{5, 2})
+
+	// username/password authentication
+	_, err = io.ReadFull(conn, buf[:2])
+	assert.NoError(t, err)
+	user := make([]byte, buf[1])
+	io.ReadFull(conn, user)
+	io.ReadFull(conn, buf[:1])
+	pass := make([]byte, buf[0])
+	io.ReadFull(conn, pass)
+
+	if string(user) != "user" || string(pass) != "pass" {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	// connect request with a domain name address
+	_, err = io.ReadFull(conn, buf[:5])
+	assert.NoError(t, err)
+	host := make([]byte, buf[4])
+	io.ReadFull(conn, host)
+	io.ReadFull(conn, buf[:2])
+	requested <- net.JoinHostPort(string(host), strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2]))))
+
+	upstream, err := net.Dial("tcp", target)
+	assert.NoError(t, err)
+	defer upstream.Close()
+
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func TestApiClientEnableProxyWithSOCKS5Proxy(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	target, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	requested := make(chan string, 1)
+	go serveSOCKS5(t, l, target.Host, requested)
+
+	c := NewApiClient("updatehub.example.com")
+
+	err = c.EnableProxy(fmt.Sprintf("socks5://user:pass@%s", l.Addr().String()), nil)
+	assert.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, serverURL(c, "/upgrades"), nil)
+	assert.NoError(t, err)
+
+	res, err := c.Request().Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res.Body.Close()
+
+	assert.Equal(t, "updatehub.example.com:80", <-requested)
+}
+
+func TestApiClientEnableProxyWithInvalidProxy(t *testing.T) {
+	c := NewApiClient("localhost")
+
+	err := c.EnableProxy("ftp://proxy", nil)
+	assert.EqualError(t, err, "unsupported proxy scheme 'ftp'")
+
+	err = c.EnableProxy("http://proxy:port", nil)
+	assert.Error(t, err)
+}
+
+func TestApiClientEnableProxyKeepsTLSConfig(t *testing.T) {
+	c := NewApiClient("localhost")
+
+	config, err := NewTLSConfig(nil, "", "", "")
+	assert.NoError(t, err)
+
+	c.EnableTLS(config)
+
+	err = c.EnableProxy("http://proxy:3128", nil)
+	assert.NoError(t, err)
+
+	assert.Equal(t, config, c.Transport.(*http.Transport).TLSClientConfig)
+	assert.True(t, c.https)
+}
@@ -0,0 +1,144 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxRedirects is how many redirects a request follows
+const maxRedirects = 10
+
+// redirectedHeaders are the headers of a request kept when it's
+// redirected elsewhere, the others may identify the device
+var redirectedHeaders = []string{"Range", "Accept-Encoding"}
+
+// sameOriginRedirect follows the redirects within the origin of the
+// request only. The others are returned to the caller, since they
+// would carry the device credentials (its TLS client certificate) to a
+// third party and be checked against the CA and the pins of the server.
+func sameOriginRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+
+	if !sameOrigin(req.URL, via[0].URL) {
+		return http.ErrUseLastResponse
+	}
+
+	return nil
+}
+
+func sameOrigin(a *url.URL, b *url.URL) bool {
+	return a.Scheme == b.Scheme && strings.EqualFold(a.Host, b.Host)
+}
+
+// AllowInsecureRedirects makes the client follow the redirects from
+// HTTPS to plain HTTP, which are refused by default since the signed
+// query params of the redirect URL would be sent in cleartext
+func (client *ApiClient) AllowInsecureRedirects(allow bool) {
+	client.insecureRedirects = allow
+}
+
+// checkRedirectScheme refuses the redirect from "from" to "to" when it
+// downgrades HTTPS to plain HTTP, unless it's allowed
+func (client *ApiClient) checkRedirectScheme(from *url.URL, to *url.URL) error {
+	if from.Scheme == "https" && to.Scheme == "http" && !client.insecureRedirects {
+		return fmt.Errorf("refused the redirect from HTTPS to '%s'", to)
+	}
+
+	return nil
+}
+
+// isRedirect tells whether "res" sends the request elsewhere
+func isRedirect(res *http.Response) bool {
+	switch res.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return res.Header.Get("Location") != ""
+	}
+
+	return false
+}
+
+// followRedirect sends "req" again to where "res" redirected it, which
+// is another origin (e.g. a CDN or an object storage). The URL is kept
+// as is, with its signed query params, while the device credentials
+// are left out: only the redirectedHeaders are sent and the connection
+// is made without the client certificate, the CA bundle and the pins
+// of the server. A redirect from HTTPS to plain HTTP is refused unless
+// it's allowed. "res" is closed.
+func (client *ApiClient) followRedirect(req *http.Request, res *http.Response) (*http.Response, error) {
+	defer res.Body.Close()
+
+	location, err := res.Location()
+	if err != nil {
+		return nil, fmt.Errorf("invalid redirect: %s", err)
+	}
+
+	if location.Scheme != "http" && location.Scheme != "https" {
+		return nil, fmt.Errorf("invalid redirect to '%s'", location)
+	}
+
+	// the request actually sent may have gone to a fallback server
+	from := req.URL
+	if res.Request != nil {
+		from = res.Request.URL
+	}
+
+	err = client.checkRedirectScheme(from, location)
+	if err != nil {
+		return nil, err
+	}
+
+	redirected, err := http.NewRequest(req.Method, location.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	redirected = redirected.WithContext(req.Context())
+
+	for _, name := range redirectedHeaders {
+		if value := req.Header.Get(name); value != "" {
+			redirected.Header.Set(name, value)
+		}
+	}
+
+	return client.redirectClient().Do(redirected)
+}
+
+// redirectClient returns the HTTP client of the redirected requests,
+// it goes through the proxy and has the timeouts of the client but not
+// its TLS settings
+func (client *ApiClient) redirectClient() *http.Client {
+	// the redirected requests are seldom sent to the same place twice
+	t := &http.Transport{Proxy: http.ProxyFromEnvironment, DisableKeepAlives: true}
+
+	if current, ok := client.Transport.(*http.Transport); ok {
+		t.Proxy = current.Proxy
+		t.Dial = current.Dial
+		t.DialContext = current.DialContext
+		t.TLSHandshakeTimeout = current.TLSHandshakeTimeout
+		t.ResponseHeaderTimeout = current.ResponseHeaderTimeout
+		t.IdleConnTimeout = current.IdleConnTimeout
+	}
+
+	return &http.Client{
+		Transport: t,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+
+			return client.checkRedirectScheme(via[len(via)-1].URL, req.URL)
+		},
+	}
+}
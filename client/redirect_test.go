@@ -0,0 +1,181 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApiClientFollowsSameOriginRedirects(t *testing.T) {
+	var s *httptest.Server
+
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved" {
+			http.Redirect(w, r, s.URL+"/object", http.StatusFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	c := NewApiClient(u.Host)
+
+	req, err := http.NewRequest(http.MethodGet, s.URL+"/moved", nil)
+	assert.NoError(t, err)
+
+	res, err := c.Request().Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "/object", res.Request.URL.Path)
+}
+
+func TestApiClientReturnsCrossOriginRedirects(t *testing.T) {
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the redirect was followed")
+	}))
+	defer cdn.Close()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, cdn.URL+"/object", http.StatusFound)
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	c := NewApiClient(u.Host)
+
+	req, err := http.NewRequest(http.MethodGet, s.URL+"/object", nil)
+	assert.NoError(t, err)
+
+	res, err := c.Request().Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+	assert.True(t, isRedirect(res))
+}
+
+func TestSameOrigin(t *testing.T) {
+	parse := func(rawurl string) *url.URL {
+		u, err := url.Parse(rawurl)
+		assert.NoError(t, err)
+		return u
+	}
+
+	assert.True(t, sameOrigin(parse("https://server:8080/a"), parse("https://SERVER:8080/b?x=1")))
+	assert.False(t, sameOrigin(parse("https://server:8080/a"), parse("http://server:8080/a")))
+	assert.False(t, sameOrigin(parse("https://server:8080/a"), parse("https://server:8443/a")))
+	assert.False(t, sameOrigin(parse("https://server/a"), parse("https://cdn.server/a")))
+}
+
+func TestRedirectClientLeavesTheTLSSettingsOut(t *testing.T) {
+	c := NewApiClient("localhost")
+
+	c.EnableTLS(&tls.Config{Certificates: []tls.Certificate{{}}})
+	c.SetTimeouts(Timeouts{TLSHandshake: time.Second, ResponseHeader: 2 * time.Second})
+
+	transport := c.redirectClient().Transport.(*http.Transport)
+	assert.Nil(t, transport.TLSClientConfig)
+	assert.NotNil(t, transport.DialContext)
+	assert.Equal(t, time.Second, transport.TLSHandshakeTimeout)
+	assert.Equal(t, 2*time.Second, transport.ResponseHeaderTimeout)
+}
+
+func newTestRedirect(t *testing.T, from string, location string) (*http.Request, *http.Response) {
+	req, err := http.NewRequest(http.MethodGet, from, nil)
+	assert.NoError(t, err)
+
+	res := &http.Response{
+		StatusCode: http.StatusFound,
+		Header:     http.Header{"Location": []string{location}},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}
+
+	return req, res
+}
+
+func TestFollowRedirectRefusesHTTPSDowngrade(t *testing.T) {
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the redirect was followed")
+	}))
+	defer cdn.Close()
+
+	c := NewApiClient("server")
+
+	req, res := newTestRedirect(t, "https://server/object", cdn.URL+"/object?signature=x")
+
+	_, err := c.followRedirect(req, res)
+	assert.EqualError(t, err, "refused the redirect from HTTPS to '"+cdn.URL+"/object?signature=x'")
+}
+
+func TestFollowRedirectWithInsecureRedirectsAllowed(t *testing.T) {
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "x", r.URL.Query().Get("signature"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer cdn.Close()
+
+	c := NewApiClient("server")
+	c.AllowInsecureRedirects(true)
+
+	req, res := newTestRedirect(t, "https://server/object", cdn.URL+"/object?signature=x")
+
+	redirected, err := c.followRedirect(req, res)
+	assert.NoError(t, err)
+	redirected.Body.Close()
+
+	assert.Equal(t, http.StatusOK, redirected.StatusCode)
+}
+
+func TestCheckRedirectScheme(t *testing.T) {
+	parse := func(rawurl string) *url.URL {
+		u, err := url.Parse(rawurl)
+		assert.NoError(t, err)
+		return u
+	}
+
+	c := NewApiClient("server")
+
+	assert.NoError(t, c.checkRedirectScheme(parse("https://server/a"), parse("https://cdn/a")))
+	assert.NoError(t, c.checkRedirectScheme(parse("http://server/a"), parse("http://cdn/a")))
+	assert.NoError(t, c.checkRedirectScheme(parse("http://server/a"), parse("https://cdn/a")))
+	assert.EqualError(t, c.checkRedirectScheme(parse("https://server/a"), parse("http://cdn/a")), "refused the redirect from HTTPS to 'http://cdn/a'")
+
+	c.AllowInsecureRedirects(true)
+
+	assert.NoError(t, c.checkRedirectScheme(parse("https://server/a"), parse("http://cdn/a")))
+}
+
+func TestRedirectClientRefusesHTTPSDowngrade(t *testing.T) {
+	c := NewApiClient("server")
+
+	from, err := http.NewRequest(http.MethodGet, "https://cdn/object", nil)
+	assert.NoError(t, err)
+
+	to, err := http.NewRequest(http.MethodGet, "http://mirror/object", nil)
+	assert.NoError(t, err)
+
+	err = c.redirectClient().CheckRedirect(to, []*http.Request{from})
+	assert.EqualError(t, err, "refused the redirect from HTTPS to 'http://mirror/object'")
+}
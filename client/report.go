@@ -13,6 +13,8 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strings"
+	"time"
 )
 
 type ReportClient struct {
@@ -22,18 +24,237 @@ type Reporter interface {
 	ReportState(api ApiRequester, packageUID string, state string) error
 }
 
-func (u *ReportClient) ReportState(api ApiRequester, packageUID string, state string) error {
-	if api == nil {
-		return errors.New("invalid api requester")
-	}
+// LogReporter is implemented by the reporters able to ship a batch of
+// the agent event log to "uri", which is either a path at the server or
+// an absolute URL
+type LogReporter interface {
+	ReportLogs(api ApiRequester, uri string, entries interface{}) error
+}
+
+// HeartbeatReporter is implemented by the reporters able to tell the
+// server that the agent is alive, along with "heartbeat" describing
+// the device
+type HeartbeatReporter interface {
+	ReportHeartbeat(api ApiRequester, heartbeat interface{}) error
+}
+
+// ProgressReporter is implemented by the reporters able to send the
+// progress (from 0 to 100) of the current state to the server
+type ProgressReporter interface {
+	ReportProgress(api ApiRequester, packageUID string, state string, progress int) error
+}
+
+// ErrorReporter is implemented by the reporters able to send the cause
+// of an error to the server, along with the agent event log "entries"
+// when they are not nil
+type ErrorReporter interface {
+	ReportError(api ApiRequester, packageUID string, state string, errorMessage string, entries interface{}) error
+}
 
-	url := serverURL(api.Client(), StateReportEndpoint)
+// DetailedErrorReporter is implemented by the reporters able to send,
+// along with the error cause, its "details" gathered by the agent, the
+// event log "entries" and the objects "telemetry" when they are not nil
+type DetailedErrorReporter interface {
+	ReportDetailedError(api ApiRequester, packageUID string, state string, errorMessage string, details interface{}, entries interface{}, telemetry interface{}) error
+}
+
+// SimulatedReporter is implemented by the reporters able to tell the
+// server that a state was only simulated, as done by a dry run
+type SimulatedReporter interface {
+	ReportSimulatedState(api ApiRequester, packageUID string, state string) error
+}
+
+// TelemetryReporter is implemented by the reporters able to send the
+// telemetry of the objects of an update along with the state, the
+// error cause and the event log "entries" when they are not nil
+type TelemetryReporter interface {
+	ReportTelemetry(api ApiRequester, packageUID string, state string, errorMessage string, entries interface{}, telemetry interface{}) error
+}
+
+// StateReport is the report of a state along with the time the agent
+// entered it, which is later than when it's sent if it was queued
+type StateReport struct {
+	Time         time.Time
+	PackageUID   string
+	State        string
+	ErrorMessage string
+	Simulated    bool
+	Details      interface{}
+	Entries      interface{}
+	Telemetry    interface{}
+}
+
+// TimedReporter is implemented by the reporters able to send, along
+// with the report of a state, the time the agent entered it
+type TimedReporter interface {
+	ReportStateAt(api ApiRequester, report *StateReport) error
+}
+
+// ReportForwarder is implemented by the reporters able to send a
+// report as it was received from another agent, as done by a gateway
+type ReportForwarder interface {
+	ForwardReport(api ApiRequester, report json.RawMessage) error
+}
 
+// stateReport returns the data of the report of "state", which the
+// other kinds of reports add to
+func stateReport(packageUID string, state string) map[string]interface{} {
 	data := make(map[string]interface{})
 	data["status"] = state
 	data["package-uid"] = packageUID
 	data["error-message"] = ""
 
+	return data
+}
+
+// telemetryReport returns the data of the report of "state" along
+// with the error cause, the event log and the objects telemetry
+func telemetryReport(packageUID string, state string, errorMessage string, entries interface{}, telemetry interface{}) map[string]interface{} {
+	data := stateReport(packageUID, state)
+	data["error-message"] = errorMessage
+	data["telemetry"] = telemetry
+
+	if entries != nil {
+		data["event-log"] = entries
+	}
+
+	return data
+}
+
+// detailedErrorReport returns the data of the report of "state" along
+// with the error cause and its details, the event log and the objects
+// telemetry
+func detailedErrorReport(packageUID string, state string, errorMessage string, details interface{}, entries interface{}, telemetry interface{}) map[string]interface{} {
+	data := stateReport(packageUID, state)
+	data["error-message"] = errorMessage
+	data["error-details"] = details
+
+	if entries != nil {
+		data["event-log"] = entries
+	}
+
+	if telemetry != nil {
+		data["telemetry"] = telemetry
+	}
+
+	return data
+}
+
+func (u *ReportClient) ReportState(api ApiRequester, packageUID string, state string) error {
+	data := stateReport(packageUID, state)
+
+	return u.report(api, data)
+}
+
+// ReportProgress reports the state along with its progress
+func (u *ReportClient) ReportProgress(api ApiRequester, packageUID string, state string, progress int) error {
+	data := stateReport(packageUID, state)
+	data["progress"] = progress
+
+	return u.report(api, data)
+}
+
+// ReportError reports the state along with the error cause and the
+// event log
+func (u *ReportClient) ReportError(api ApiRequester, packageUID string, state string, errorMessage string, entries interface{}) error {
+	data := stateReport(packageUID, state)
+	data["error-message"] = errorMessage
+
+	if entries != nil {
+		data["event-log"] = entries
+	}
+
+	return u.report(api, data)
+}
+
+// ReportTelemetry reports the state along with the error cause, the
+// event log and the objects telemetry
+func (u *ReportClient) ReportTelemetry(api ApiRequester, packageUID string, state string, errorMessage string, entries interface{}, telemetry interface{}) error {
+	return u.report(api, telemetryReport(packageUID, state, errorMessage, entries, telemetry))
+}
+
+// ReportDetailedError reports the state along with the error cause
+// and its details, the event log and the objects telemetry
+func (u *ReportClient) ReportDetailedError(api ApiRequester, packageUID string, state string, errorMessage string, details interface{}, entries interface{}, telemetry interface{}) error {
+	return u.report(api, detailedErrorReport(packageUID, state, errorMessage, details, entries, telemetry))
+}
+
+// ReportSimulatedState reports the state flagged as simulated
+func (u *ReportClient) ReportSimulatedState(api ApiRequester, packageUID string, state string) error {
+	data := stateReport(packageUID, state)
+	data["dry-run"] = true
+
+	return u.report(api, data)
+}
+
+// ReportStateAt reports the state as the most detailed of the other
+// reports does, along with the time the agent entered it
+func (u *ReportClient) ReportStateAt(api ApiRequester, report *StateReport) error {
+	var data map[string]interface{}
+
+	switch {
+	case report.Simulated:
+		data = stateReport(report.PackageUID, report.State)
+		data["dry-run"] = true
+	case report.Details != nil:
+		data = detailedErrorReport(report.PackageUID, report.State, report.ErrorMessage, report.Details, report.Entries, report.Telemetry)
+	case report.Telemetry != nil:
+		data = telemetryReport(report.PackageUID, report.State, report.ErrorMessage, report.Entries, report.Telemetry)
+	default:
+		data = stateReport(report.PackageUID, report.State)
+		data["error-message"] = report.ErrorMessage
+
+		if report.Entries != nil {
+			data["event-log"] = report.Entries
+		}
+	}
+
+	data["time"] = report.Time.UTC().Format(time.RFC3339)
+
+	return u.report(api, data)
+}
+
+// ReportLogs sends "entries" to "uri"
+func (u *ReportClient) ReportLogs(api ApiRequester, uri string, entries interface{}) error {
+	if api == nil {
+		return errors.New("invalid api requester")
+	}
+
+	url := uri
+	if strings.HasPrefix(uri, "/") {
+		url = serverURL(api.Client(), uri)
+	}
+
+	return u.post(api, url, entries)
+}
+
+// ReportHeartbeat sends "heartbeat" to the heartbeat endpoint
+func (u *ReportClient) ReportHeartbeat(api ApiRequester, heartbeat interface{}) error {
+	if api == nil {
+		return errors.New("invalid api requester")
+	}
+
+	return u.post(api, serverURL(api.Client(), HeartbeatEndpoint), heartbeat)
+}
+
+// ForwardReport sends "report" unchanged
+func (u *ReportClient) ForwardReport(api ApiRequester, report json.RawMessage) error {
+	if api == nil {
+		return errors.New("invalid api requester")
+	}
+
+	return u.post(api, serverURL(api.Client(), StateReportEndpoint), report)
+}
+
+func (u *ReportClient) report(api ApiRequester, data map[string]interface{}) error {
+	if api == nil {
+		return errors.New("invalid api requester")
+	}
+
+	return u.post(api, serverURL(api.Client(), StateReportEndpoint), data)
+}
+
+func (u *ReportClient) post(api ApiRequester, url string, data interface{}) error {
 	body, err := json.Marshal(data)
 	if err != nil {
 		return err
@@ -56,7 +277,7 @@ func (u *ReportClient) ReportState(api ApiRequester, packageUID string, state st
 		return nil
 	}
 
-	return errors.New("failed to report state")
+	return &StatusError{StatusCode: res.StatusCode, message: "failed to report state"}
 }
 
 func NewReportClient() *ReportClient {
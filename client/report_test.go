@@ -16,6 +16,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -79,3 +80,460 @@ func TestReportState(t *testing.T) {
 
 	assert.Equal(t, expectedBody, body)
 }
+
+func TestReportStateRejected(t *testing.T) {
+	httpStatus := http.StatusBadRequest
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(httpStatus)
+	}))
+
+	defer s.Close()
+
+	url, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	c := NewApiClient(url.Host)
+	reporter := NewReportClient()
+
+	err = reporter.ReportState(c.Request(), "packageUID", "state")
+	assert.EqualError(t, err, "failed to report state")
+	assert.True(t, IsPermanentError(err))
+
+	httpStatus = http.StatusServiceUnavailable
+
+	err = reporter.ReportState(c.Request(), "packageUID", "state")
+	assert.EqualError(t, err, "failed to report state")
+	assert.False(t, IsPermanentError(err))
+}
+
+func TestReportProgress(t *testing.T) {
+	rawBody := []byte{}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := new(bytes.Buffer)
+
+		_, err := buf.ReadFrom(r.Body)
+		assert.NoError(t, err)
+
+		rawBody = buf.Bytes()
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer s.Close()
+
+	url, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	c := NewApiClient(url.Host)
+
+	reporter := NewReportClient()
+
+	err = reporter.ReportProgress(c.Request(), "packageUID", "installing", 40)
+	assert.NoError(t, err)
+
+	var body map[string]interface{}
+
+	err = json.Unmarshal(rawBody, &body)
+	assert.NoError(t, err)
+
+	expectedBody := make(map[string]interface{})
+	expectedBody["error-message"] = ""
+	expectedBody["package-uid"] = "packageUID"
+	expectedBody["status"] = "installing"
+	expectedBody["progress"] = float64(40)
+
+	assert.Equal(t, expectedBody, body)
+}
+
+func TestReportProgressWithInvalidApiRequester(t *testing.T) {
+	reporter := NewReportClient()
+
+	err := reporter.ReportProgress(nil, "packageUID", "installing", 40)
+	assert.EqualError(t, err, "invalid api requester")
+}
+
+func TestReportError(t *testing.T) {
+	rawBody := []byte{}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := new(bytes.Buffer)
+
+		_, err := buf.ReadFrom(r.Body)
+		assert.NoError(t, err)
+
+		rawBody = buf.Bytes()
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer s.Close()
+
+	url, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	c := NewApiClient(url.Host)
+
+	reporter := NewReportClient()
+
+	entries := []map[string]string{{"type": "state", "state": "installing"}}
+
+	err = reporter.ReportError(c.Request(), "packageUID", "error", "install failed", entries)
+	assert.NoError(t, err)
+
+	var body map[string]interface{}
+
+	err = json.Unmarshal(rawBody, &body)
+	assert.NoError(t, err)
+
+	expectedBody := make(map[string]interface{})
+	expectedBody["error-message"] = "install failed"
+	expectedBody["package-uid"] = "packageUID"
+	expectedBody["status"] = "error"
+	expectedBody["event-log"] = []interface{}{map[string]interface{}{"type": "state", "state": "installing"}}
+
+	assert.Equal(t, expectedBody, body)
+
+	// the event log isn't attached
+	err = reporter.ReportError(c.Request(), "packageUID", "error", "install failed", nil)
+	assert.NoError(t, err)
+
+	body = nil
+
+	err = json.Unmarshal(rawBody, &body)
+	assert.NoError(t, err)
+
+	delete(expectedBody, "event-log")
+
+	assert.Equal(t, expectedBody, body)
+}
+
+func TestReportTelemetry(t *testing.T) {
+	rawBody := []byte{}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := new(bytes.Buffer)
+
+		_, err := buf.ReadFrom(r.Body)
+		assert.NoError(t, err)
+
+		rawBody = buf.Bytes()
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer s.Close()
+
+	url, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	c := NewApiClient(url.Host)
+
+	reporter := NewReportClient()
+
+	telemetry := []map[string]interface{}{{"object": "sha256sum", "install-time-ms": 1500}}
+
+	err = reporter.ReportTelemetry(c.Request(), "packageUID", "installed", "", nil, telemetry)
+	assert.NoError(t, err)
+
+	var body map[string]interface{}
+
+	err = json.Unmarshal(rawBody, &body)
+	assert.NoError(t, err)
+
+	expectedBody := make(map[string]interface{})
+	expectedBody["error-message"] = ""
+	expectedBody["package-uid"] = "packageUID"
+	expectedBody["status"] = "installed"
+	expectedBody["telemetry"] = []interface{}{map[string]interface{}{"object": "sha256sum", "install-time-ms": float64(1500)}}
+
+	assert.Equal(t, expectedBody, body)
+}
+
+func TestReportDetailedError(t *testing.T) {
+	rawBody := []byte{}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := new(bytes.Buffer)
+
+		_, err := buf.ReadFrom(r.Body)
+		assert.NoError(t, err)
+
+		rawBody = buf.Bytes()
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer s.Close()
+
+	url, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	c := NewApiClient(url.Host)
+
+	reporter := NewReportClient()
+
+	details := map[string]interface{}{"class": "install", "object-mode": "raw", "log": []string{"warning: failed"}}
+	entries := []map[string]string{{"type": "state", "state": "installing"}}
+	telemetry := []map[string]interface{}{{"object": "sha256sum", "outcome": "failed"}}
+
+	err = reporter.ReportDetailedError(c.Request(), "packageUID", "error", "install failed", details, entries, telemetry)
+	assert.NoError(t, err)
+
+	var body map[string]interface{}
+
+	err = json.Unmarshal(rawBody, &body)
+	assert.NoError(t, err)
+
+	expectedBody := make(map[string]interface{})
+	expectedBody["error-message"] = "install failed"
+	expectedBody["package-uid"] = "packageUID"
+	expectedBody["status"] = "error"
+	expectedBody["error-details"] = map[string]interface{}{"class": "install", "object-mode": "raw", "log": []interface{}{"warning: failed"}}
+	expectedBody["event-log"] = []interface{}{map[string]interface{}{"type": "state", "state": "installing"}}
+	expectedBody["telemetry"] = []interface{}{map[string]interface{}{"object": "sha256sum", "outcome": "failed"}}
+
+	assert.Equal(t, expectedBody, body)
+
+	// neither the event log nor the telemetry are attached
+	err = reporter.ReportDetailedError(c.Request(), "packageUID", "error", "install failed", details, nil, nil)
+	assert.NoError(t, err)
+
+	body = nil
+
+	err = json.Unmarshal(rawBody, &body)
+	assert.NoError(t, err)
+
+	delete(expectedBody, "event-log")
+	delete(expectedBody, "telemetry")
+
+	assert.Equal(t, expectedBody, body)
+}
+
+func TestReportSimulatedState(t *testing.T) {
+	rawBody := []byte{}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := new(bytes.Buffer)
+
+		_, err := buf.ReadFrom(r.Body)
+		assert.NoError(t, err)
+
+		rawBody = buf.Bytes()
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer s.Close()
+
+	url, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	c := NewApiClient(url.Host)
+
+	reporter := NewReportClient()
+
+	err = reporter.ReportSimulatedState(c.Request(), "packageUID", "installed")
+	assert.NoError(t, err)
+
+	var body map[string]interface{}
+
+	err = json.Unmarshal(rawBody, &body)
+	assert.NoError(t, err)
+
+	expectedBody := make(map[string]interface{})
+	expectedBody["error-message"] = ""
+	expectedBody["package-uid"] = "packageUID"
+	expectedBody["status"] = "installed"
+	expectedBody["dry-run"] = true
+
+	assert.Equal(t, expectedBody, body)
+}
+
+func TestReportStateAt(t *testing.T) {
+	rawBody := []byte{}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := new(bytes.Buffer)
+
+		_, err := buf.ReadFrom(r.Body)
+		assert.NoError(t, err)
+
+		rawBody = buf.Bytes()
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer s.Close()
+
+	url, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	c := NewApiClient(url.Host)
+
+	reporter := NewReportClient()
+
+	testCases := []struct {
+		name         string
+		report       *StateReport
+		expectedBody map[string]interface{}
+	}{
+		{
+			"State",
+			&StateReport{PackageUID: "packageUID", State: "downloading"},
+			map[string]interface{}{"status": "downloading", "error-message": ""},
+		},
+		{
+			"Simulated",
+			&StateReport{PackageUID: "packageUID", State: "installed", Simulated: true},
+			map[string]interface{}{"status": "installed", "error-message": "", "dry-run": true},
+		},
+		{
+			"Error",
+			&StateReport{PackageUID: "packageUID", State: "error", ErrorMessage: "install failed", Entries: []string{"installing"}},
+			map[string]interface{}{"status": "error", "error-message": "install failed", "event-log": []interface{}{"installing"}},
+		},
+		{
+			"DetailedError",
+			&StateReport{PackageUID: "packageUID", State: "error", ErrorMessage: "install failed", Details: map[string]string{"class": "install"}},
+			map[string]interface{}{"status": "error", "error-message": "install failed", "error-details": map[string]interface{}{"class": "install"}},
+		},
+		{
+			"Telemetry",
+			&StateReport{PackageUID: "packageUID", State: "installed", Telemetry: []string{"sha256sum"}},
+			map[string]interface{}{"status": "installed", "error-message": "", "telemetry": []interface{}{"sha256sum"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.report.Time = time.Date(2017, time.June, 1, 10, 0, 0, 0, time.FixedZone("BRT", -3*60*60))
+
+			err := reporter.ReportStateAt(c.Request(), tc.report)
+			assert.NoError(t, err)
+
+			var body map[string]interface{}
+
+			err = json.Unmarshal(rawBody, &body)
+			assert.NoError(t, err)
+
+			tc.expectedBody["package-uid"] = "packageUID"
+			tc.expectedBody["time"] = "2017-06-01T13:00:00Z"
+
+			assert.Equal(t, tc.expectedBody, body)
+		})
+	}
+}
+
+func TestForwardReport(t *testing.T) {
+	var path string
+	rawBody := []byte{}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := new(bytes.Buffer)
+
+		_, err := buf.ReadFrom(r.Body)
+		assert.NoError(t, err)
+
+		path = r.URL.Path
+		rawBody = buf.Bytes()
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer s.Close()
+
+	url, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	c := NewApiClient(url.Host)
+
+	reporter := NewReportClient()
+
+	report := json.RawMessage(`{"status":"downloading","package-uid":"packageUID","progress":50}`)
+
+	err = reporter.ForwardReport(c.Request(), report)
+	assert.NoError(t, err)
+	assert.Equal(t, StateReportEndpoint, path)
+	assert.Equal(t, []byte(report), rawBody)
+}
+
+func TestReportLogs(t *testing.T) {
+	var path string
+	rawBody := []byte{}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := new(bytes.Buffer)
+
+		_, err := buf.ReadFrom(r.Body)
+		assert.NoError(t, err)
+
+		path = r.URL.Path
+		rawBody = buf.Bytes()
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer s.Close()
+
+	url, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	c := NewApiClient(url.Host)
+
+	reporter := NewReportClient()
+
+	entries := []map[string]string{{"type": "error", "message": "install failed"}}
+
+	err = reporter.ReportLogs(c.Request(), LogsEndpoint, entries)
+	assert.NoError(t, err)
+	assert.Equal(t, LogsEndpoint, path)
+	assert.Equal(t, `[{"message":"install failed","type":"error"}]`, string(rawBody))
+
+	// a custom endpoint
+	err = reporter.ReportLogs(NewApiClient("localhost").Request(), s.URL+"/custom", entries)
+	assert.NoError(t, err)
+	assert.Equal(t, "/custom", path)
+}
+
+func TestReportLogsWithInvalidApiRequester(t *testing.T) {
+	reporter := NewReportClient()
+
+	err := reporter.ReportLogs(nil, LogsEndpoint, nil)
+	assert.EqualError(t, err, "invalid api requester")
+}
+
+func TestReportHeartbeat(t *testing.T) {
+	var path string
+	rawBody := []byte{}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := new(bytes.Buffer)
+
+		_, err := buf.ReadFrom(r.Body)
+		assert.NoError(t, err)
+
+		path = r.URL.Path
+		rawBody = buf.Bytes()
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer s.Close()
+
+	url, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	c := NewApiClient(url.Host)
+
+	reporter := NewReportClient()
+
+	err = reporter.ReportHeartbeat(c.Request(), map[string]interface{}{"state": "idle"})
+	assert.NoError(t, err)
+	assert.Equal(t, HeartbeatEndpoint, path)
+	assert.Equal(t, `{"state":"idle"}`, string(rawBody))
+
+	err = reporter.ReportHeartbeat(nil, nil)
+	assert.EqualError(t, err, "invalid api requester")
+}
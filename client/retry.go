@@ -0,0 +1,287 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned, without reaching the server, while the
+// circuit breaker is open
+var ErrCircuitOpen = errors.New("the server is failing, the request wasn't sent")
+
+// RetryPolicy makes the client repeat the requests to the server which
+// fail because of it (unreachable, timed out or answered with 5xx, 408
+// or 429) up to "Retries" times. The first retry waits "Backoff", which
+// doubles on each new one up to "MaxBackoff", and a random part of up
+// to its half is taken off so the devices don't retry in lockstep.
+//
+// After "BreakerThreshold" requests failing in a row, even after their
+// retries, the circuit breaker opens and the requests fail right away
+// with ErrCircuitOpen for "BreakerCooldown". A single request is sent
+// then, which closes the breaker if it succeeds. A zero
+// "BreakerThreshold" disables the breaker.
+type RetryPolicy struct {
+	Retries          int
+	Backoff          time.Duration
+	MaxBackoff       time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// RequestHooks are called as the requests to the server are sent, so
+// they can be measured. They are called from the goroutine sending the
+// request, so they must not block.
+type RequestHooks struct {
+	// OnAttempt is called after each attempt of a request with its
+	// status code, zero when the server wasn't reached, or its error
+	OnAttempt func(req *http.Request, attempt int, statusCode int, err error, duration time.Duration)
+	// OnBreakerChange is called when the circuit breaker opens or
+	// closes
+	OnBreakerChange func(open bool)
+}
+
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+type retryState struct {
+	policy  RetryPolicy
+	hooks   RequestHooks
+	breaker circuitBreaker
+	mutex   sync.Mutex
+}
+
+// SetRetryPolicy makes the client retry the failed requests to the
+// server as told by "policy", the zero RetryPolicy sends them once
+func (client *ApiClient) SetRetryPolicy(policy RetryPolicy) {
+	client.retry.mutex.Lock()
+	defer client.retry.mutex.Unlock()
+
+	client.retry.policy = policy
+	client.retry.breaker = circuitBreaker{}
+}
+
+// SetRequestHooks sets the hooks called as the requests to the server
+// are sent
+func (client *ApiClient) SetRequestHooks(hooks RequestHooks) {
+	client.retry.mutex.Lock()
+	defer client.retry.mutex.Unlock()
+
+	client.retry.hooks = hooks
+}
+
+// send sends "req" through the circuit breaker, retrying it as told by
+// the retry policy. Only the requests aimed at the server are retried.
+func (client *ApiClient) send(req *http.Request) (*http.Response, error) {
+	if !client.aimedAtServer(req) {
+		return client.do(req)
+	}
+
+	client.retry.mutex.Lock()
+	policy := client.retry.policy
+	hooks := client.retry.hooks
+	client.retry.mutex.Unlock()
+
+	if !client.allowRequest(time.Now()) {
+		return nil, ErrCircuitOpen
+	}
+
+	// the body is sent again on each attempt
+	var body []byte
+	if req.Body != nil && policy.Retries > 0 {
+		var err error
+
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var res *http.Response
+	var err error
+
+	for attempt := 1; ; attempt++ {
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		started := time.Now()
+
+		res, err = client.do(req)
+
+		if hooks.OnAttempt != nil {
+			statusCode := 0
+			if res != nil {
+				statusCode = res.StatusCode
+			}
+
+			hooks.OnAttempt(req, attempt, statusCode, err, time.Since(started))
+		}
+
+		// an aborted request says nothing about the server
+		if err != nil && req.Context().Err() != nil {
+			client.releaseProbe()
+			return nil, err
+		}
+
+		if !retriable(res, err) || attempt > policy.Retries {
+			break
+		}
+
+		if res != nil {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		select {
+		case <-time.After(retryBackoff(policy, attempt)):
+		case <-req.Context().Done():
+			client.releaseProbe()
+			return nil, req.Context().Err()
+		}
+	}
+
+	client.recordResult(!retriable(res, err), time.Now())
+
+	return res, err
+}
+
+// aimedAtServer tells whether "req" goes to the server, as opposed to
+// the peers or the custom endpoints
+func (client *ApiClient) aimedAtServer(req *http.Request) bool {
+	if req.URL.Host == client.address() {
+		return true
+	}
+
+	client.serversMutex.Lock()
+	defer client.serversMutex.Unlock()
+
+	for _, s := range client.servers {
+		if s.address == req.URL.Host {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retriable tells whether the request answered with "res", or failed
+// with "err", failed because of the server
+func retriable(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	switch res.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+
+	return res.StatusCode >= 500
+}
+
+// retryBackoff returns how long to wait before the retry that follows
+// "attempt"
+func retryBackoff(policy RetryPolicy, attempt int) time.Duration {
+	delay := policy.Backoff
+
+	for i := 1; i < attempt && (policy.MaxBackoff <= 0 || delay < policy.MaxBackoff); i++ {
+		delay *= 2
+	}
+
+	if policy.MaxBackoff > 0 && delay > policy.MaxBackoff {
+		delay = policy.MaxBackoff
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// allowRequest tells whether a request can be sent at "now". Once the
+// cooldown of the open breaker is over, a single request is let through
+// to probe the server.
+func (client *ApiClient) allowRequest(now time.Time) bool {
+	client.retry.mutex.Lock()
+	defer client.retry.mutex.Unlock()
+
+	b := &client.retry.breaker
+
+	if client.retry.policy.BreakerThreshold <= 0 || b.openUntil.IsZero() {
+		return true
+	}
+
+	if now.Before(b.openUntil) || b.probing {
+		return false
+	}
+
+	b.probing = true
+
+	return true
+}
+
+// releaseProbe lets another request probe the server, the aborted one
+// told nothing about it
+func (client *ApiClient) releaseProbe() {
+	client.retry.mutex.Lock()
+	defer client.retry.mutex.Unlock()
+
+	client.retry.breaker.probing = false
+}
+
+// recordResult opens or closes the circuit breaker given whether the
+// last request to the server succeeded
+func (client *ApiClient) recordResult(succeeded bool, now time.Time) {
+	client.retry.mutex.Lock()
+
+	policy := client.retry.policy
+	hook := client.retry.hooks.OnBreakerChange
+	b := &client.retry.breaker
+
+	if policy.BreakerThreshold <= 0 {
+		client.retry.mutex.Unlock()
+		return
+	}
+
+	wasOpen := !b.openUntil.IsZero()
+	b.probing = false
+
+	if succeeded {
+		b.failures = 0
+		b.openUntil = time.Time{}
+	} else {
+		b.failures++
+
+		if b.failures >= policy.BreakerThreshold {
+			b.openUntil = now.Add(policy.BreakerCooldown)
+		}
+	}
+
+	isOpen := !b.openUntil.IsZero()
+
+	client.retry.mutex.Unlock()
+
+	// the hook is called unlocked, so it can use the client
+	if hook != nil && isOpen != wasOpen {
+		hook(isOpen)
+	}
+}
@@ -0,0 +1,263 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFlappingServer returns a server answering with "statuses", one
+// per request, and then with 200. The bodies it got are sent to
+// "bodies".
+func newFlappingServer(statuses []int, bodies chan string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if bodies != nil {
+			bodies <- string(body)
+		}
+
+		status := http.StatusOK
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+
+		w.WriteHeader(status)
+	}))
+}
+
+func newRetryTestClient(t *testing.T, s *httptest.Server, policy RetryPolicy) *ApiClient {
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	c := NewApiClient(u.Host)
+	c.SetRetryPolicy(policy)
+
+	return c
+}
+
+func TestRetryOnServerErrors(t *testing.T) {
+	bodies := make(chan string, 10)
+
+	s := newFlappingServer([]int{http.StatusBadGateway, http.StatusTooManyRequests}, bodies)
+	defer s.Close()
+
+	c := newRetryTestClient(t, s, RetryPolicy{Retries: 2, Backoff: time.Millisecond})
+
+	attempts := []int{}
+	c.SetRequestHooks(RequestHooks{
+		OnAttempt: func(req *http.Request, attempt int, statusCode int, err error, duration time.Duration) {
+			attempts = append(attempts, statusCode)
+		},
+	})
+
+	req, err := http.NewRequest(http.MethodPost, serverURL(c, StateReportEndpoint), bytes.NewBufferString("report"))
+	assert.NoError(t, err)
+
+	res, err := c.Request().Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	assert.Equal(t, []int{http.StatusBadGateway, http.StatusTooManyRequests, http.StatusOK}, attempts)
+
+	// the body is sent on each attempt
+	assert.Equal(t, "report", <-bodies)
+	assert.Equal(t, "report", <-bodies)
+	assert.Equal(t, "report", <-bodies)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	s := newFlappingServer([]int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable}, nil)
+	defer s.Close()
+
+	c := newRetryTestClient(t, s, RetryPolicy{Retries: 1, Backoff: time.Millisecond})
+
+	req, err := http.NewRequest(http.MethodGet, serverURL(c, UpgradesEndpoint), nil)
+	assert.NoError(t, err)
+
+	// the last answer is returned
+	res, err := c.Request().Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+}
+
+func TestRetryDoesntRepeatClientErrors(t *testing.T) {
+	s := newFlappingServer([]int{http.StatusNotFound}, nil)
+	defer s.Close()
+
+	c := newRetryTestClient(t, s, RetryPolicy{Retries: 3, Backoff: time.Millisecond})
+
+	req, err := http.NewRequest(http.MethodGet, serverURL(c, UpgradesEndpoint), nil)
+	assert.NoError(t, err)
+
+	res, err := c.Request().Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestRetryOnUnreachableServer(t *testing.T) {
+	c := NewApiClient(unreachableAddress(t))
+	c.SetRetryPolicy(RetryPolicy{Retries: 2, Backoff: time.Millisecond})
+
+	attempts := 0
+	c.SetRequestHooks(RequestHooks{
+		OnAttempt: func(req *http.Request, attempt int, statusCode int, err error, duration time.Duration) {
+			attempts = attempt
+			assert.Equal(t, 0, statusCode)
+			assert.Error(t, err)
+		},
+	})
+
+	req, err := http.NewRequest(http.MethodGet, serverURL(c, UpgradesEndpoint), nil)
+	assert.NoError(t, err)
+
+	_, err = c.Request().Do(req)
+	assert.Error(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestRetryAborted(t *testing.T) {
+	s := newFlappingServer([]int{http.StatusServiceUnavailable}, nil)
+	defer s.Close()
+
+	c := newRetryTestClient(t, s, RetryPolicy{Retries: 1, Backoff: time.Hour, BreakerThreshold: 1, BreakerCooldown: time.Hour})
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c.SetRequestHooks(RequestHooks{
+		OnAttempt: func(req *http.Request, attempt int, statusCode int, err error, duration time.Duration) {
+			cancel()
+		},
+	})
+
+	req, err := http.NewRequest(http.MethodGet, serverURL(c, UpgradesEndpoint), nil)
+	assert.NoError(t, err)
+
+	_, err = c.Request().Do(req.WithContext(ctx))
+	assert.Equal(t, context.Canceled, err)
+
+	// an aborted request doesn't trip the breaker
+	assert.True(t, c.allowRequest(time.Now()))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+
+	testCases := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{10, 5 * time.Second},
+	}
+
+	for _, tc := range testCases {
+		delay := retryBackoff(policy, tc.attempt)
+		assert.True(t, delay <= tc.max)
+		assert.True(t, delay >= tc.max/2)
+	}
+
+	assert.Equal(t, time.Duration(0), retryBackoff(RetryPolicy{}, 1))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	c := NewApiClient("localhost")
+	c.SetRetryPolicy(RetryPolicy{BreakerThreshold: 2, BreakerCooldown: time.Minute})
+
+	changes := []bool{}
+	c.SetRequestHooks(RequestHooks{
+		OnBreakerChange: func(open bool) {
+			changes = append(changes, open)
+		},
+	})
+
+	now := time.Now()
+
+	assert.True(t, c.allowRequest(now))
+	c.recordResult(false, now)
+	assert.True(t, c.allowRequest(now))
+	c.recordResult(false, now)
+
+	// tripped
+	assert.False(t, c.allowRequest(now))
+	assert.False(t, c.allowRequest(now.Add(59*time.Second)))
+	assert.Equal(t, []bool{true}, changes)
+
+	// a single request probes the server after the cooldown
+	now = now.Add(time.Minute)
+
+	assert.True(t, c.allowRequest(now))
+	assert.False(t, c.allowRequest(now))
+
+	c.recordResult(false, now)
+	assert.False(t, c.allowRequest(now.Add(59*time.Second)))
+
+	now = now.Add(time.Minute)
+
+	assert.True(t, c.allowRequest(now))
+	c.recordResult(true, now)
+
+	assert.True(t, c.allowRequest(now))
+	assert.True(t, c.allowRequest(now))
+	assert.Equal(t, []bool{true, false}, changes)
+}
+
+func TestCircuitBreakerRejectsRequests(t *testing.T) {
+	s := newFlappingServer([]int{http.StatusInternalServerError}, nil)
+	defer s.Close()
+
+	c := newRetryTestClient(t, s, RetryPolicy{BreakerThreshold: 1, BreakerCooldown: time.Hour})
+
+	req, err := http.NewRequest(http.MethodGet, serverURL(c, UpgradesEndpoint), nil)
+	assert.NoError(t, err)
+
+	res, err := c.Request().Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+
+	_, err = c.Request().Do(req)
+	assert.Equal(t, ErrCircuitOpen, err)
+
+	// the requests to elsewhere aren't affected
+	other := newFlappingServer(nil, nil)
+	defer other.Close()
+
+	req, err = http.NewRequest(http.MethodGet, other.URL+"/custom", nil)
+	assert.NoError(t, err)
+
+	res, err = c.Request().Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestRetryWithoutPolicy(t *testing.T) {
+	s := newFlappingServer([]int{http.StatusInternalServerError}, nil)
+	defer s.Close()
+
+	c := newRetryTestClient(t, s, RetryPolicy{})
+
+	req, err := http.NewRequest(http.MethodPost, serverURL(c, StateReportEndpoint), bytes.NewBufferString("report"))
+	assert.NoError(t, err)
+
+	res, err := c.Request().Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+}
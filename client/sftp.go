@@ -0,0 +1,241 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	sftpDefaultPort = "22"
+
+	// sftpHandshakeTimeout bounds the SSH handshake, which isn't
+	// aborted by the context of the request
+	sftpHandshakeTimeout = 30 * time.Second
+)
+
+// SFTPConfig holds how the SFTP server is reached. The server is
+// authenticated by one of the "HostKeys", given as the SHA-256
+// fingerprints of its host keys ("SHA256:..."), and the device by its
+// key ("Signer"). The older versions are only offered when
+// "AllowDowngrade" is set, as by the FileClient.
+type SFTPConfig struct {
+	Signer         ssh.Signer
+	HostKeys       []string
+	ConnectTimeout time.Duration
+	AllowDowngrade bool
+}
+
+// SFTPClient implements the Updater interface over SFTP, for the
+// infrastructures which expose the updates through SSH only. The dir
+// of the server URL is laid out as the one of the FileClient. A new
+// connection is made for each request, since they are seldom made.
+type SFTPClient struct {
+	address string
+	dir     string
+	config  *ssh.ClientConfig
+	timeout time.Duration
+
+	allowDowngrade bool
+}
+
+// NewSFTPClient creates a SFTP updater for the "serverURL", as
+// "sftp://user@host[:port]/dir"
+func NewSFTPClient(serverURL string, config SFTPConfig) (*SFTPClient, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Scheme != "sftp" || u.Host == "" || u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("invalid SFTP server URL '%s'", serverURL)
+	}
+
+	if config.Signer == nil {
+		return nil, errors.New("missing the SFTP client key")
+	}
+
+	hostKeyCallback, err := PinHostKeys(config.HostKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), sftpDefaultPort)
+	}
+
+	dir := u.Path
+	if dir == "" {
+		// the home dir of the user
+		dir = "."
+	}
+
+	return &SFTPClient{
+		address: address,
+		dir:     dir,
+		config: &ssh.ClientConfig{
+			User:            u.User.Username(),
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(config.Signer)},
+			HostKeyCallback: hostKeyCallback,
+		},
+		timeout: config.ConnectTimeout,
+
+		allowDowngrade: config.AllowDowngrade,
+	}, nil
+}
+
+// PinHostKeys returns a host key callback accepting only the keys of
+// the SHA-256 "fingerprints"
+func PinHostKeys(fingerprints []string) (ssh.HostKeyCallback, error) {
+	if len(fingerprints) == 0 {
+		return nil, errors.New("no SFTP host key is pinned")
+	}
+
+	pinned := map[string]bool{}
+	for _, fingerprint := range fingerprints {
+		if !strings.HasPrefix(fingerprint, "SHA256:") {
+			return nil, fmt.Errorf("invalid host key fingerprint '%s', it must be like 'SHA256:...'", fingerprint)
+		}
+
+		pinned[fingerprint] = true
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		if !pinned[fingerprint] {
+			return fmt.Errorf("the host key of '%s' (%s) isn't pinned", hostname, fingerprint)
+		}
+
+		return nil
+	}, nil
+}
+
+// CheckUpdate reads the update metadata at "uri" of the server, as
+// the FileClient does
+func (c *SFTPClient) CheckUpdate(ctx context.Context, api ApiRequester, uri string, data interface{}) (interface{}, time.Duration, error) {
+	session, err := c.connect(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("check update request failed: %s", err)
+	}
+
+	defer session.Close()
+
+	return checkUpdateFile(session.open, c.path(uri), data, c.allowDowngrade)
+}
+
+// FetchUpdate opens the object at "uri" of the server from byte
+// "offset". The connection is closed along with the body.
+func (c *SFTPClient) FetchUpdate(ctx context.Context, api ApiRequester, uri string, offset int64) (io.ReadCloser, int64, error) {
+	session, err := c.connect(ctx)
+	if err != nil {
+		return nil, -1, fmt.Errorf("fetch update request failed: %s", err)
+	}
+
+	file, err := session.open(c.path(uri))
+	if err != nil {
+		session.Close()
+		return nil, -1, fmt.Errorf("failed to fetch update: %s", err)
+	}
+
+	body, contentLength, err := fetchUpdateFile(file, offset)
+	if err != nil {
+		session.Close()
+		return nil, -1, err
+	}
+
+	return &sftpBody{ReadCloser: body, session: session}, contentLength, nil
+}
+
+func (c *SFTPClient) path(uri string) string {
+	return path.Join(c.dir, path.Clean("/"+uri))
+}
+
+// connect opens a SFTP session with the server, which is closed once
+// "ctx" is done
+func (c *SFTPClient) connect(ctx context.Context) (*sftpSession, error) {
+	dialer := &net.Dialer{Timeout: c.timeout}
+
+	conn, err := dialer.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sftpSession{conn: conn, done: make(chan struct{})}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.done:
+		}
+	}()
+
+	conn.SetDeadline(time.Now().Add(sftpHandshakeTimeout))
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, c.address, c.config)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	s.sftp, err = sftp.NewClient(ssh.NewClient(sshConn, chans, reqs))
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+type sftpSession struct {
+	conn net.Conn
+	sftp *sftp.Client
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *sftpSession) open(name string) (updateFile, error) {
+	return s.sftp.Open(name)
+}
+
+// Close closes the connection, which ends the SSH and SFTP sessions
+// over it
+func (s *sftpSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+
+	return nil
+}
+
+// sftpBody closes the session along with the fetched object
+type sftpBody struct {
+	io.ReadCloser
+	session *sftpSession
+}
+
+func (b *sftpBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.session.Close()
+
+	return err
+}
@@ -0,0 +1,222 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.NoError(t, err)
+
+	return signer
+}
+
+// startTestSFTPServer serves the local file system over SFTP to the
+// "clientKey" only. It returns its address and host key.
+func startTestSFTPServer(t *testing.T, clientKey ssh.PublicKey) (string, ssh.Signer, func()) {
+	hostKey := newTestSigner(t)
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go serveTestSFTP(conn, config)
+		}
+	}()
+
+	return l.Addr().String(), hostKey, func() { l.Close() }
+}
+
+func serveTestSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range requests {
+				// the payload is the length prefixed subsystem name
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+
+				if ok {
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						channel.Close()
+						return
+					}
+
+					go func() {
+						server.Serve()
+						channel.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func newTestSFTPClient(t *testing.T) (*SFTPClient, string, func()) {
+	dir, err := ioutil.TempDir("", "sftp-test")
+	assert.NoError(t, err)
+
+	err = ioutil.WriteFile(path.Join(dir, "upgrades"), []byte(fileTestMetadata), 0644)
+	assert.NoError(t, err)
+
+	err = os.MkdirAll(path.Join(dir, "0123456789/puid"), 0755)
+	assert.NoError(t, err)
+
+	err = ioutil.WriteFile(path.Join(dir, "0123456789/puid/sha256sum"), []byte("object content"), 0644)
+	assert.NoError(t, err)
+
+	clientKey := newTestSigner(t)
+
+	address, hostKey, stop := startTestSFTPServer(t, clientKey.PublicKey())
+
+	c, err := NewSFTPClient("sftp://updatehub@"+address+dir, SFTPConfig{
+		Signer:   clientKey,
+		HostKeys: []string{ssh.FingerprintSHA256(hostKey.PublicKey())},
+	})
+	assert.NoError(t, err)
+
+	return c, dir, func() {
+		stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNewSFTPClient(t *testing.T) {
+	signer := newTestSigner(t)
+	hostKeys := []string{ssh.FingerprintSHA256(signer.PublicKey())}
+
+	c, err := NewSFTPClient("sftp://updatehub@localhost/srv/updates", SFTPConfig{Signer: signer, HostKeys: hostKeys})
+	assert.NoError(t, err)
+	assert.Equal(t, "localhost:22", c.address)
+	assert.Equal(t, "updatehub", c.config.User)
+	assert.Equal(t, "/srv/updates/upgrades", c.path("/upgrades"))
+
+	c, err = NewSFTPClient("sftp://updatehub@localhost:2222", SFTPConfig{Signer: signer, HostKeys: hostKeys})
+	assert.NoError(t, err)
+	assert.Equal(t, "localhost:2222", c.address)
+	assert.Equal(t, "upgrades", c.path("/upgrades"))
+
+	_, err = NewSFTPClient("sftp://localhost/srv/updates", SFTPConfig{Signer: signer, HostKeys: hostKeys})
+	assert.EqualError(t, err, "invalid SFTP server URL 'sftp://localhost/srv/updates'")
+
+	_, err = NewSFTPClient("sftp://updatehub@localhost", SFTPConfig{HostKeys: hostKeys})
+	assert.EqualError(t, err, "missing the SFTP client key")
+
+	_, err = NewSFTPClient("sftp://updatehub@localhost", SFTPConfig{Signer: signer})
+	assert.EqualError(t, err, "no SFTP host key is pinned")
+
+	_, err = NewSFTPClient("sftp://updatehub@localhost", SFTPConfig{Signer: signer, HostKeys: []string{"invalid"}})
+	assert.EqualError(t, err, "invalid host key fingerprint 'invalid', it must be like 'SHA256:...'")
+}
+
+func TestSFTPClientCheckUpdate(t *testing.T) {
+	c, _, stop := newTestSFTPClient(t)
+	defer stop()
+
+	device := fileTestDevice{FirmwareMetadata: metadata.FirmwareMetadata{ProductUID: "0123456789", Version: "1.0"}}
+
+	updateMetadata, _, err := c.CheckUpdate(context.Background(), nil, UpgradesEndpoint, device)
+	assert.NoError(t, err)
+	assert.Equal(t, "2.0", updateMetadata.(*metadata.UpdateMetadata).Version)
+	assert.Nil(t, updateMetadata.(*metadata.UpdateMetadata).Signature)
+
+	// already installed
+	device.Version = "2.0"
+
+	updateMetadata, _, err = c.CheckUpdate(context.Background(), nil, UpgradesEndpoint, device)
+	assert.NoError(t, err)
+	assert.Nil(t, updateMetadata)
+}
+
+func TestSFTPClientFetchUpdate(t *testing.T) {
+	c, _, stop := newTestSFTPClient(t)
+	defer stop()
+
+	body, contentLength, err := c.FetchUpdate(context.Background(), nil, "/0123456789/puid/sha256sum", 7)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), contentLength)
+
+	data, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+	assert.NoError(t, body.Close())
+
+	_, _, err = c.FetchUpdate(context.Background(), nil, "/0123456789/puid/missing", 0)
+	assert.Error(t, err)
+}
+
+func TestSFTPClientWithUnpinnedHostKey(t *testing.T) {
+	c, _, stop := newTestSFTPClient(t)
+	defer stop()
+
+	var err error
+	c.config.HostKeyCallback, err = PinHostKeys([]string{ssh.FingerprintSHA256(newTestSigner(t).PublicKey())})
+	assert.NoError(t, err)
+
+	_, _, err = c.CheckUpdate(context.Background(), nil, UpgradesEndpoint, fileTestDevice{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "isn't pinned")
+}
@@ -0,0 +1,208 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UpdateHub/updatehub/log"
+)
+
+const (
+	// NotificationsEndpoint is where the server pushes its events
+	NotificationsEndpoint = "/notifications"
+
+	// UpdateAvailableEvent tells that there is an update for the device
+	UpdateAvailableEvent = "update-available"
+	// ProbeEvent asks the device to check for an update right away
+	ProbeEvent = "probe"
+	// RollbackEvent asks the device to revert its last update
+	RollbackEvent = "rollback"
+)
+
+// SSEEvent is an event of a Server-Sent Events stream
+type SSEEvent struct {
+	Name string
+	Data string
+}
+
+// SSENotifier keeps a Server-Sent Events stream open with the server
+// and calls "notify" for each event pushed there. The stream is
+// requested again, after "retry", whenever it drops.
+type SSENotifier struct {
+	api      ApiRequester
+	endpoint string
+	data     func() interface{}
+	retry    time.Duration
+	notify   func(SSEEvent)
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	mutex  sync.Mutex
+}
+
+// NewSSENotifier creates a SSENotifier for the "endpoint" of the
+// server. The stream is requested with the JSON from "data", which
+// identifies the device.
+func NewSSENotifier(api ApiRequester, endpoint string, data func() interface{}, retry time.Duration, notify func(SSEEvent)) *SSENotifier {
+	return &SSENotifier{
+		api:      api,
+		endpoint: endpoint,
+		data:     data,
+		retry:    retry,
+		notify:   notify,
+	}
+}
+
+// Start opens the stream in background, it does nothing if it was
+// already started
+func (n *SSENotifier) Start() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.cancel != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	n.cancel = cancel
+	n.done = make(chan struct{})
+
+	go n.run(ctx, n.done)
+}
+
+// Stop closes the stream and waits for it
+func (n *SSENotifier) Stop() {
+	n.mutex.Lock()
+	cancel, done := n.cancel, n.done
+	n.cancel = nil
+	n.mutex.Unlock()
+
+	if cancel == nil {
+		return
+	}
+
+	cancel()
+	<-done
+}
+
+func (n *SSENotifier) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	for {
+		err := n.listen(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		log.Warn(fmt.Sprintf("the notifications stream dropped, it's requested again in %s: %s", n.retry, err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(n.retry):
+		}
+	}
+}
+
+// listen requests the stream and reads its events until it drops
+func (n *SSENotifier) listen(ctx context.Context) error {
+	rawJSON, err := json.Marshal(n.data())
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, serverURL(n.api.Client(), n.endpoint), bytes.NewBuffer(rawJSON))
+	if err != nil {
+		return err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+
+	res, err := n.api.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("the notifications request failed with the status %d", res.StatusCode)
+	}
+
+	err = ReadSSEEvents(res.Body, n.notify)
+	if err == nil {
+		err = io.EOF
+	}
+
+	return err
+}
+
+// ReadSSEEvents reads the events of a Server-Sent Events stream from
+// "r", calling "handle" for each one, until it ends. The comments and
+// the fields other than "event" and "data" are ignored.
+func ReadSSEEvents(r io.Reader, handle func(SSEEvent)) error {
+	scanner := bufio.NewScanner(r)
+
+	event := SSEEvent{}
+	data := []string{}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" {
+			if event.Name != "" || len(data) > 0 {
+				if event.Name == "" {
+					event.Name = "message"
+				}
+
+				event.Data = strings.Join(data, "\n")
+				handle(event)
+			}
+
+			event = SSEEvent{}
+			data = []string{}
+
+			continue
+		}
+
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		switch field {
+		case "event":
+			event.Name = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+
+	return scanner.Err()
+}
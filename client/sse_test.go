@@ -0,0 +1,106 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadSSEEvents(t *testing.T) {
+	stream := strings.Join([]string{
+		": keepalive",
+		"",
+		"event: update-available",
+		"data: {\"version\": \"2.0\"}",
+		"",
+		"retry: 1000",
+		"event:probe",
+		"",
+		"data: first",
+		"data: second",
+		"",
+		"event: unfinished",
+	}, "\n")
+
+	events := []SSEEvent{}
+
+	err := ReadSSEEvents(strings.NewReader(stream), func(e SSEEvent) {
+		events = append(events, e)
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []SSEEvent{
+		{Name: "update-available", Data: `{"version": "2.0"}`},
+		{Name: "probe", Data: ""},
+		{Name: "message", Data: "first\nsecond"},
+	}, events)
+}
+
+func TestSSENotifier(t *testing.T) {
+	var connections int32
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, NotificationsEndpoint, r.URL.Path)
+		assert.Equal(t, "text/event-stream", r.Header.Get("Accept"))
+
+		var body map[string]string
+		err := json.NewDecoder(r.Body).Decode(&body)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"product-uid": "uid"}, body)
+
+		n := atomic.AddInt32(&connections, 1)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+
+		// the first stream drops right after its event
+		fmt.Fprintf(w, "event: probe\ndata: %d\n\n", n)
+		w.(http.Flusher).Flush()
+
+		if n > 1 {
+			<-r.Context().Done()
+		}
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	events := make(chan SSEEvent, 10)
+
+	data := func() interface{} {
+		return map[string]string{"product-uid": "uid"}
+	}
+
+	n := NewSSENotifier(NewApiClient(u.Host).Request(), NotificationsEndpoint, data, time.Millisecond, func(e SSEEvent) {
+		events <- e
+	})
+
+	n.Start()
+
+	assert.Equal(t, SSEEvent{Name: "probe", Data: "1"}, <-events)
+	assert.Equal(t, SSEEvent{Name: "probe", Data: "2"}, <-events)
+
+	n.Stop()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&connections))
+
+	// stopping twice is fine
+	n.Stop()
+}
@@ -0,0 +1,52 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"net"
+	"time"
+)
+
+// Timeouts bound each step of the requests, so a connection which went
+// half-open (as they often do on cellular links) fails the request
+// instead of hanging it. The TCP keep-alive probes are sent every
+// "KeepAlive" to notice the dead connections, including the ones idle
+// in the pool for up to "IdleConn". A zero timeout means no limit.
+type Timeouts struct {
+	Connect        time.Duration
+	TLSHandshake   time.Duration
+	ResponseHeader time.Duration
+	IdleConn       time.Duration
+	KeepAlive      time.Duration
+}
+
+// SetTimeouts makes the requests of the client bound by "timeouts"
+func (client *ApiClient) SetTimeouts(timeouts Timeouts) {
+	client.timeouts = timeouts
+
+	t := client.transport()
+
+	// the proxy dials through its own dialer
+	if t.Dial == nil {
+		t.DialContext = client.dialer().DialContext
+	}
+
+	t.TLSHandshakeTimeout = timeouts.TLSHandshake
+	t.ResponseHeaderTimeout = timeouts.ResponseHeader
+	t.IdleConnTimeout = timeouts.IdleConn
+}
+
+// dialer returns the dialer of the connections to the server, bound by
+// the timeouts of the client
+func (client *ApiClient) dialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   client.timeouts.Connect,
+		KeepAlive: client.timeouts.KeepAlive,
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApiClientSetTimeouts(t *testing.T) {
+	c := NewApiClient("localhost")
+
+	c.SetTimeouts(Timeouts{
+		Connect:        time.Second,
+		TLSHandshake:   2 * time.Second,
+		ResponseHeader: 3 * time.Second,
+		IdleConn:       4 * time.Second,
+		KeepAlive:      5 * time.Second,
+	})
+
+	transport := c.Transport.(*http.Transport)
+	assert.NotNil(t, transport.DialContext)
+	assert.Equal(t, 2*time.Second, transport.TLSHandshakeTimeout)
+	assert.Equal(t, 3*time.Second, transport.ResponseHeaderTimeout)
+	assert.Equal(t, 4*time.Second, transport.IdleConnTimeout)
+
+	dialer := c.dialer()
+	assert.Equal(t, time.Second, dialer.Timeout)
+	assert.Equal(t, 5*time.Second, dialer.KeepAlive)
+}
+
+func TestApiClientSetTimeoutsWithSocksProxy(t *testing.T) {
+	c := NewApiClient("localhost")
+
+	err := c.EnableProxy("socks5://127.0.0.1:1080", nil)
+	assert.NoError(t, err)
+
+	c.SetTimeouts(Timeouts{Connect: time.Second})
+
+	// the connections are still made through the proxy
+	transport := c.Transport.(*http.Transport)
+	assert.Nil(t, transport.DialContext)
+	assert.NotNil(t, transport.Dial)
+}
+
+func TestApiClientResponseHeaderTimeout(t *testing.T) {
+	done := make(chan bool)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a server which never answers
+		<-done
+	}))
+	defer s.Close()
+	defer close(done)
+
+	c := NewApiClient("localhost")
+	c.SetTimeouts(Timeouts{ResponseHeader: 50 * time.Millisecond})
+
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	assert.NoError(t, err)
+
+	started := time.Now()
+
+	_, err = c.Request().Do(req)
+	assert.Error(t, err)
+	assert.True(t, time.Since(started) < 5*time.Second)
+}
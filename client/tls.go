@@ -0,0 +1,108 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/afero"
+)
+
+// NewTLSConfig creates a TLS config that authenticates the client with
+// the certificate/key pair found at "certPath" and "keyPath", no client
+// certificate is used if "certPath" is empty. If "caPath" is not empty,
+// the server certificate is verified against the CA bundle found there
+// instead of the system pool.
+func NewTLSConfig(fsb afero.Fs, certPath string, keyPath string, caPath string) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if certPath != "" {
+		certPEM, err := afero.ReadFile(fsb, certPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client certificate: %s", err)
+		}
+
+		keyPEM, err := afero.ReadFile(fsb, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client key: %s", err)
+		}
+
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if caPath != "" {
+		caPEM, err := afero.ReadFile(fsb, caPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("failed to parse CA bundle: no certificate found")
+		}
+
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+// PinPublicKeys makes "config" accept only the servers whose verified
+// certificate chain has a public key among "pins", which are the base64
+// encoded SHA-256 hashes of the DER encoded SubjectPublicKeyInfo. That
+// is what the following outputs for a PEM certificate:
+//
+//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der |
+//	    openssl dgst -sha256 -binary | base64
+func PinPublicKeys(config *tls.Config, pins []string) error {
+	hashes := map[[sha256.Size]byte]bool{}
+
+	for _, pin := range pins {
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("invalid public key pin '%s'", pin)
+		}
+
+		var key [sha256.Size]byte
+		copy(key[:], hash)
+
+		hashes[key] = true
+	}
+
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if hashes[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+					return nil
+				}
+			}
+		}
+
+		return errors.New("the server certificate doesn't match any pinned public key")
+	}
+
+	return nil
+}
+
+// EnableTLS makes the client talk to the server through HTTPS using
+// "config", which is the way to perform mutual authentication
+func (client *ApiClient) EnableTLS(config *tls.Config) {
+	client.transport().TLSClientConfig = config
+	client.https = true
+}
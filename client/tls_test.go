@@ -0,0 +1,284 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// generateCertificate creates a certificate signed by "parent" (or a
+// self-signed one if "parent" is nil) and returns it PEM encoded along
+// with its PEM encoded key
+func generateCertificate(t *testing.T, parent *tls.Certificate, isCA bool) ([]byte, []byte, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+
+	parentCert := template
+	var parentKey interface{} = key
+
+	if parent != nil {
+		parentCert, err = x509.ParseCertificate(parent.Certificate[0])
+		assert.NoError(t, err)
+		parentKey = parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.NoError(t, err)
+
+	return certPEM, keyPEM, cert
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	caPEM, _, _ := generateCertificate(t, nil, true)
+	certPEM, keyPEM, _ := generateCertificate(t, nil, false)
+
+	assert.NoError(t, afero.WriteFile(fs, "/client.crt", certPEM, 0644))
+	assert.NoError(t, afero.WriteFile(fs, "/client.key", keyPEM, 0600))
+	assert.NoError(t, afero.WriteFile(fs, "/ca.crt", caPEM, 0644))
+
+	config, err := NewTLSConfig(fs, "/client.crt", "/client.key", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(config.Certificates))
+	assert.Nil(t, config.RootCAs)
+
+	config, err = NewTLSConfig(fs, "/client.crt", "/client.key", "/ca.crt")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(config.Certificates))
+	assert.NotNil(t, config.RootCAs)
+
+	// without client certificate only the server is verified
+	config, err = NewTLSConfig(fs, "", "", "/ca.crt")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(config.Certificates))
+	assert.NotNil(t, config.RootCAs)
+}
+
+func TestNewTLSConfigWithErrors(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	certPEM, keyPEM, _ := generateCertificate(t, nil, false)
+
+	assert.NoError(t, afero.WriteFile(fs, "/client.crt", certPEM, 0644))
+	assert.NoError(t, afero.WriteFile(fs, "/client.key", keyPEM, 0600))
+	assert.NoError(t, afero.WriteFile(fs, "/invalid", []byte("invalid"), 0644))
+
+	testCases := []struct {
+		name          string
+		certPath      string
+		keyPath       string
+		caPath        string
+		expectedError string
+	}{
+		{
+			"CertificateNotFound",
+			"/missing.crt",
+			"/client.key",
+			"",
+			"failed to read client certificate: open /missing.crt: file does not exist",
+		},
+		{
+			"KeyNotFound",
+			"/client.crt",
+			"/missing.key",
+			"",
+			"failed to read client key: open /missing.key: file does not exist",
+		},
+		{
+			"InvalidKeyPair",
+			"/client.crt",
+			"/invalid",
+			"",
+			"failed to load client certificate: tls: failed to find any PEM data in key input",
+		},
+		{
+			"CANotFound",
+			"/client.crt",
+			"/client.key",
+			"/missing.crt",
+			"failed to read CA bundle: open /missing.crt: file does not exist",
+		},
+		{
+			"InvalidCA",
+			"/client.crt",
+			"/client.key",
+			"/invalid",
+			"failed to parse CA bundle: no certificate found",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := NewTLSConfig(fs, tc.certPath, tc.keyPath, tc.caPath)
+			assert.Nil(t, config)
+			assert.EqualError(t, err, tc.expectedError)
+		})
+	}
+}
+
+func TestApiClientEnableTLS(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	caPEM, _, ca := generateCertificate(t, nil, true)
+	certPEM, keyPEM, _ := generateCertificate(t, &ca, false)
+	_, _, serverCert := generateCertificate(t, &ca, false)
+
+	assert.NoError(t, afero.WriteFile(fs, "/client.crt", certPEM, 0644))
+	assert.NoError(t, afero.WriteFile(fs, "/client.key", keyPEM, 0600))
+	assert.NoError(t, afero.WriteFile(fs, "/ca.crt", caPEM, 0644))
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+
+	var peerCertificates int
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerCertificates = len(r.TLS.PeerCertificates)
+		w.WriteHeader(http.StatusOK)
+	}))
+	s.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	s.StartTLS()
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	c := NewApiClient(u.Host)
+
+	config, err := NewTLSConfig(fs, "/client.crt", "/client.key", "/ca.crt")
+	assert.NoError(t, err)
+
+	c.EnableTLS(config)
+
+	assert.Equal(t, "https://"+u.Host+"/test", serverURL(c, "/test"))
+
+	req, err := http.NewRequest(http.MethodGet, serverURL(c, "/test"), nil)
+	assert.NoError(t, err)
+
+	res, err := c.Request().Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, 1, peerCertificates)
+}
+
+func TestPinPublicKeys(t *testing.T) {
+	caPEM, _, ca := generateCertificate(t, nil, true)
+	_, _, serverCert := generateCertificate(t, &ca, false)
+	_, _, otherCert := generateCertificate(t, nil, false)
+
+	pin := func(cert tls.Certificate) string {
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		assert.NoError(t, err)
+
+		hash := sha256.Sum256(parsed.RawSubjectPublicKeyInfo)
+
+		return base64.StdEncoding.EncodeToString(hash[:])
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	s.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	s.StartTLS()
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name          string
+		pins          []string
+		expectedError string
+	}{
+		{"ServerKey", []string{pin(otherCert), pin(serverCert)}, ""},
+		{"CAKey", []string{pin(ca)}, ""},
+		{"OtherKey", []string{pin(otherCert)}, "the server certificate doesn't match any pinned public key"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := &tls.Config{RootCAs: pool}
+
+			err := PinPublicKeys(config, tc.pins)
+			assert.NoError(t, err)
+
+			c := NewApiClient(u.Host)
+			c.EnableTLS(config)
+
+			req, err := http.NewRequest(http.MethodGet, serverURL(c, "/test"), nil)
+			assert.NoError(t, err)
+
+			res, err := c.Request().Do(req)
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+				res.Body.Close()
+			} else {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.expectedError)
+			}
+		})
+	}
+}
+
+func TestPinPublicKeysWithInvalidPin(t *testing.T) {
+	for _, pin := range []string{"invalid", "c2hvcnQ="} {
+		err := PinPublicKeys(&tls.Config{}, []string{pin})
+		assert.EqualError(t, err, fmt.Sprintf("invalid public key pin '%s'", pin))
+	}
+}
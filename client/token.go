@@ -0,0 +1,152 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+var tokenHashNames = map[crypto.Hash]string{
+	crypto.SHA1:   "sha1",
+	crypto.SHA256: "sha256",
+	crypto.SHA384: "sha384",
+	crypto.SHA512: "sha512",
+}
+
+// IsTokenKey tells whether "uri" refers to a key kept by a hardware
+// token, a PKCS#11 URI (RFC 7512) or a TPM2 persistent handle (e.g.
+// "tpm2:0x81000001"), instead of a key file
+func IsTokenKey(uri string) bool {
+	return strings.HasPrefix(uri, "pkcs11:") || strings.HasPrefix(uri, "tpm2:")
+}
+
+// TokenSigner is a crypto.Signer whose private key never leaves the
+// token, the signatures are made by the helper command as:
+//
+//	<helper> sign <uri> <hash> [pss]
+//
+// which reads the base64 encoded digest from its standard input and
+// outputs the base64 encoded signature. The "pss" argument asks for
+// the RSA-PSS padding.
+type TokenSigner struct {
+	executer  utils.CmdLineExecuter
+	helper    string
+	uri       string
+	publicKey crypto.PublicKey
+}
+
+// NewTokenSigner creates a signer of the token key at "uri", whose
+// public half is "publicKey"
+func NewTokenSigner(executer utils.CmdLineExecuter, helper string, uri string, publicKey crypto.PublicKey) *TokenSigner {
+	return &TokenSigner{
+		executer:  executer,
+		helper:    helper,
+		uri:       uri,
+		publicKey: publicKey,
+	}
+}
+
+func (s *TokenSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+func (s *TokenSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash, ok := tokenHashNames[opts.HashFunc()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash function for the token key '%s'", s.uri)
+	}
+
+	cmdline := fmt.Sprintf("'%s' sign '%s' %s", s.helper, s.uri, hash)
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		cmdline += " pss"
+	}
+
+	stdin := strings.NewReader(base64.StdEncoding.EncodeToString(digest) + "\n")
+
+	output, err := s.executer.ExecuteWithStdin(cmdline, stdin)
+	if err != nil {
+		return nil, fmt.Errorf("the token failed to sign with the key '%s': %s", s.uri, err)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(output)))
+	if err != nil {
+		return nil, fmt.Errorf("the token signature made with the key '%s' isn't base64 encoded", s.uri)
+	}
+
+	return signature, nil
+}
+
+// TokenPublicKey reads the public key of the token key at "uri", the
+// helper command is run as:
+//
+//	<helper> public-key <uri>
+//
+// and must output it PEM encoded
+func TokenPublicKey(executer utils.CmdLineExecuter, helper string, uri string) (crypto.PublicKey, error) {
+	output, err := executer.Execute(fmt.Sprintf("'%s' public-key '%s'", helper, uri))
+	if err != nil {
+		return nil, fmt.Errorf("the token failed to read the public key '%s': %s", uri, err)
+	}
+
+	return metadata.ParsePublicKey(output)
+}
+
+// TokenKeyPair loads the client certificate at "certPath" whose private
+// key is the token key at "uri", so the TLS handshakes are signed by
+// the token
+func TokenKeyPair(fsb afero.Fs, certPath string, executer utils.CmdLineExecuter, helper string, uri string) (tls.Certificate, error) {
+	certPEM, err := afero.ReadFile(fsb, certPath)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to read client certificate: %s", err)
+	}
+
+	cert := tls.Certificate{}
+
+	for {
+		var block *pem.Block
+
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			break
+		}
+
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+
+	if len(cert.Certificate) == 0 {
+		return tls.Certificate{}, errors.New("failed to load client certificate: no certificate found")
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load client certificate: %s", err)
+	}
+
+	cert.Leaf = leaf
+	cert.PrivateKey = NewTokenSigner(executer, helper, uri, leaf.PublicKey)
+
+	return cert, nil
+}
@@ -0,0 +1,192 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package client
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+)
+
+// testTokenHelper plays the key store helper with "key" as the token
+// key at "tpm2:0x81000001"
+type testTokenHelper struct {
+	key crypto.Signer
+}
+
+func (h *testTokenHelper) Execute(cmdline string) ([]byte, error) {
+	return h.ExecuteWithStdin(cmdline, nil)
+}
+
+func (h *testTokenHelper) ExecuteWithStdin(cmdline string, stdin io.Reader) ([]byte, error) {
+	args := strings.Fields(strings.Replace(cmdline, "'", "", -1))
+	if len(args) < 3 || args[0] != "/helper" || args[2] != "tpm2:0x81000001" {
+		return nil, errors.New("unknown key")
+	}
+
+	switch args[1] {
+	case "public-key":
+		der, err := x509.MarshalPKIXPublicKey(h.key.Public())
+		if err != nil {
+			return nil, err
+		}
+
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+	case "sign":
+		input, _ := ioutil.ReadAll(stdin)
+
+		digest, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(input)))
+		if err != nil {
+			return nil, err
+		}
+
+		signature, err := h.key.Sign(rand.Reader, digest, crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+
+		return []byte(base64.StdEncoding.EncodeToString(signature) + "\n"), nil
+	}
+
+	return nil, errors.New("unknown command")
+}
+
+func TestIsTokenKey(t *testing.T) {
+	assert.True(t, IsTokenKey("pkcs11:token=device;object=client"))
+	assert.True(t, IsTokenKey("tpm2:0x81000001"))
+	assert.False(t, IsTokenKey("/etc/updatehub/client.key"))
+	assert.False(t, IsTokenKey(""))
+}
+
+func TestTokenKeyPair(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	caPEM, _, ca := generateCertificate(t, nil, true)
+	certPEM, _, clientCert := generateCertificate(t, &ca, false)
+	_, _, serverCert := generateCertificate(t, &ca, false)
+
+	assert.NoError(t, afero.WriteFile(fs, "/client.crt", certPEM, 0644))
+	assert.NoError(t, afero.WriteFile(fs, "/ca.crt", caPEM, 0644))
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+
+	var peerCertificates int
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerCertificates = len(r.TLS.PeerCertificates)
+		w.WriteHeader(http.StatusOK)
+	}))
+	s.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	s.StartTLS()
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	config, err := NewTLSConfig(fs, "", "", "/ca.crt")
+	assert.NoError(t, err)
+
+	helper := &testTokenHelper{key: clientCert.PrivateKey.(crypto.Signer)}
+
+	cert, err := TokenKeyPair(fs, "/client.crt", helper, "/helper", "tpm2:0x81000001")
+	assert.NoError(t, err)
+	assert.IsType(t, &TokenSigner{}, cert.PrivateKey)
+
+	config.Certificates = []tls.Certificate{cert}
+
+	c := NewApiClient(u.Host)
+	c.EnableTLS(config)
+
+	req, err := http.NewRequest(http.MethodGet, serverURL(c, "/test"), nil)
+	assert.NoError(t, err)
+
+	res, err := c.Request().Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, 1, peerCertificates)
+}
+
+func TestTokenKeyPairWithoutCertificate(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	_, err := TokenKeyPair(fs, "/client.crt", &cmdlinemock.CmdLineExecuterMock{}, "/helper", "tpm2:0x81000001")
+	assert.EqualError(t, err, "failed to read client certificate: open /client.crt: file does not exist")
+
+	assert.NoError(t, afero.WriteFile(fs, "/client.crt", []byte("invalid"), 0644))
+
+	_, err = TokenKeyPair(fs, "/client.crt", &cmdlinemock.CmdLineExecuterMock{}, "/helper", "tpm2:0x81000001")
+	assert.EqualError(t, err, "failed to load client certificate: no certificate found")
+}
+
+func TestTokenSignerSign(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	s := NewTokenSigner(clm, "/helper", "pkcs11:object=client", nil)
+
+	stdin := mock.MatchedBy(func(r *strings.Reader) bool {
+		data, _ := ioutil.ReadAll(r)
+		r.Seek(0, 0)
+
+		return string(data) == base64.StdEncoding.EncodeToString([]byte("digest"))+"\n"
+	})
+
+	clm.On("ExecuteWithStdin", "'/helper' sign 'pkcs11:object=client' sha256 pss", stdin).Return([]byte("c2lnbmF0dXJl\n"), nil).Once()
+
+	signature, err := s.Sign(rand.Reader, []byte("digest"), &rsa.PSSOptions{Hash: crypto.SHA256})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("signature"), signature)
+
+	clm.On("ExecuteWithStdin", "'/helper' sign 'pkcs11:object=client' sha384", stdin).Return([]byte{}, errors.New("locked")).Once()
+
+	_, err = s.Sign(rand.Reader, []byte("digest"), crypto.SHA384)
+	assert.EqualError(t, err, "the token failed to sign with the key 'pkcs11:object=client': locked")
+
+	_, err = s.Sign(rand.Reader, []byte("digest"), crypto.MD5)
+	assert.EqualError(t, err, "unsupported hash function for the token key 'pkcs11:object=client'")
+
+	clm.AssertExpectations(t)
+}
+
+func TestTokenPublicKey(t *testing.T) {
+	_, _, cert := generateCertificate(t, nil, false)
+
+	helper := &testTokenHelper{key: cert.PrivateKey.(crypto.Signer)}
+
+	key, err := TokenPublicKey(helper, "/helper", "tpm2:0x81000001")
+	assert.NoError(t, err)
+	assert.Equal(t, helper.key.Public(), key)
+
+	_, err = TokenPublicKey(helper, "/helper", "tpm2:0x81000002")
+	assert.EqualError(t, err, "the token failed to read the public key 'tpm2:0x81000002': unknown key")
+}
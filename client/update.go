@@ -10,6 +10,8 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -18,20 +20,60 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/UpdateHub/updatehub/log"
 	"github.com/UpdateHub/updatehub/metadata"
 )
 
+// PollingIntervalHeader tells, in seconds, how often the device should
+// poll from now on. A zero interval means as configured.
+const PollingIntervalHeader = "Polling-Interval"
+
+// maxPollingIntervalSeconds caps the interval told by the server, so
+// it can't overflow once converted to a time.Duration
+const maxPollingIntervalSeconds = 365 * 24 * 60 * 60
+
 type UpdateClient struct {
+	// the polling interval told on the last update check
+	pollingInterval    time.Duration
+	pollingIntervalSet bool
+	mutex              sync.Mutex
 }
 
+// Updater checks for and fetches the updates. The requests are aborted
+// once "ctx" is done, including the read of a fetched body.
 type Updater interface {
-	CheckUpdate(api ApiRequester, uri string, data interface{}) (interface{}, time.Duration, error)
-	FetchUpdate(api ApiRequester, uri string) (io.ReadCloser, int64, error)
+	CheckUpdate(ctx context.Context, api ApiRequester, uri string, data interface{}) (interface{}, time.Duration, error)
+	FetchUpdate(ctx context.Context, api ApiRequester, uri string, offset int64) (io.ReadCloser, int64, error)
+}
+
+// PollingIntervalReader is implemented by the updaters which can be
+// told by the server how often the device should poll
+type PollingIntervalReader interface {
+	// LastPollingInterval returns the polling interval told on the
+	// last update check, if any
+	LastPollingInterval() (time.Duration, bool)
+}
+
+// ForwardedUpdate is the answer of the server to a forwarded update
+// check, kept as received. "Metadata" is nil when there is no update.
+type ForwardedUpdate struct {
+	Metadata        []byte
+	Signature       string // the SignatureHeader value
+	ExtraPoll       string // the "Add-Extra-Poll" header value
+	PollingInterval string // the PollingIntervalHeader value
+}
+
+// UpdateForwarder is implemented by the updaters able to send an
+// update check as it was received from another agent, as done by a
+// gateway
+type UpdateForwarder interface {
+	ForwardCheckUpdate(api ApiRequester, uri string, request json.RawMessage) (*ForwardedUpdate, error)
 }
 
-func (u *UpdateClient) CheckUpdate(api ApiRequester, uri string, data interface{}) (interface{}, time.Duration, error) {
+func (u *UpdateClient) CheckUpdate(ctx context.Context, api ApiRequester, uri string, data interface{}) (interface{}, time.Duration, error) {
 	if api == nil {
 		return nil, 0, errors.New("invalid api requester")
 	}
@@ -45,8 +87,11 @@ func (u *UpdateClient) CheckUpdate(api ApiRequester, uri string, data interface{
 		return nil, 0, errors.New("failed to create check update request")
 	}
 
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/json")
 
+	u.setPollingInterval(0, false)
+
 	res, err := api.Do(req)
 	if err != nil {
 		return nil, 0, errors.New("check update request failed")
@@ -64,12 +109,94 @@ func (u *UpdateClient) CheckUpdate(api ApiRequester, uri string, data interface{
 				return nil, 0, errors.New("failed to parse extra poll header")
 			}
 		}
+
+		// a malformed polling interval doesn't fail the check, the
+		// polling goes on as it was
+		if v := res.Header.Get(PollingIntervalHeader); v != "" {
+			seconds, perr := strconv.ParseInt(v, 10, 64)
+			if perr != nil || seconds < 0 {
+				log.Warn(fmt.Sprintf("ignoring the invalid polling interval header '%s'", v))
+			} else {
+				if seconds > maxPollingIntervalSeconds {
+					seconds = maxPollingIntervalSeconds
+				}
+
+				u.setPollingInterval(time.Duration(seconds)*time.Second, true)
+			}
+		}
 	}
 
 	return r, time.Duration(extraPoll), err
 }
 
-func (u *UpdateClient) FetchUpdate(api ApiRequester, uri string) (io.ReadCloser, int64, error) {
+// LastPollingInterval implements the PollingIntervalReader interface
+func (u *UpdateClient) LastPollingInterval() (time.Duration, bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.pollingInterval, u.pollingIntervalSet
+}
+
+func (u *UpdateClient) setPollingInterval(interval time.Duration, set bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.pollingInterval = interval
+	u.pollingIntervalSet = set
+}
+
+// ForwardCheckUpdate sends the update check "request" unchanged. The
+// update metadata isn't parsed, so the install modes of its objects
+// don't need to be supported.
+func (u *UpdateClient) ForwardCheckUpdate(api ApiRequester, uri string, request json.RawMessage) (*ForwardedUpdate, error) {
+	if api == nil {
+		return nil, errors.New("invalid api requester")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, serverURL(api.Client(), uri), bytes.NewReader(request))
+	if err != nil {
+		return nil, errors.New("failed to create check update request")
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := api.Do(req)
+	if err != nil {
+		return nil, errors.New("check update request failed")
+	}
+
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %s", err)
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return &ForwardedUpdate{
+			Metadata:        body,
+			Signature:       res.Header.Get(SignatureHeader),
+			ExtraPoll:       res.Header.Get("Add-Extra-Poll"),
+			PollingInterval: res.Header.Get(PollingIntervalHeader),
+		}, nil
+	case http.StatusNotFound:
+		return &ForwardedUpdate{
+			ExtraPoll:       res.Header.Get("Add-Extra-Poll"),
+			PollingInterval: res.Header.Get(PollingIntervalHeader),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("invalid response received from the server. Status %d", res.StatusCode)
+}
+
+// FetchUpdate requests the object at "uri" starting from byte
+// "offset". It returns the response body and the number of bytes that
+// remain to be read from it. A whole object may be transferred
+// compressed, in which case the body is decoded while it is read and
+// the number of bytes is unknown (-1). The resumed downloads aren't
+// compressed since a range of the compressed object can't be decoded.
+func (u *UpdateClient) FetchUpdate(ctx context.Context, api ApiRequester, uri string, offset int64) (io.ReadCloser, int64, error) {
 	if api == nil {
 		return nil, -1, errors.New("invalid api requester")
 	}
@@ -81,17 +208,79 @@ func (u *UpdateClient) FetchUpdate(api ApiRequester, uri string) (io.ReadCloser,
 		return nil, -1, fmt.Errorf("failed to create fetch update request: %s", err)
 	}
 
+	req = req.WithContext(ctx)
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("Accept-Encoding", "identity")
+	} else {
+		req.Header.Set("Accept-Encoding", acceptedEncodings)
+	}
+
 	res, err := api.Do(req)
 	if err != nil {
 		return nil, -1, fmt.Errorf("fetch update request failed: %s", err)
 	}
 
-	if res.StatusCode != http.StatusOK {
+	// the objects may be served by a CDN or an object storage
+	if isRedirect(res) && api.Client() != nil {
+		res, err = api.Client().followRedirect(req, res)
+		if err != nil {
+			return nil, -1, fmt.Errorf("fetch update request failed: %s", err)
+		}
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		res.Body.Close()
+
+		// the object was already downloaded to its end, it's up to
+		// its sha256sum to tell whether it's the whole object
+		if offset > 0 {
+			return ioutil.NopCloser(bytes.NewReader(nil)), 0, nil
+		}
+
+		return nil, -1, &StatusError{StatusCode: res.StatusCode, message: "failed to fetch update. maybe the file is missing?"}
+	default:
 		res.Body.Close()
-		return nil, -1, errors.New("failed to fetch update. maybe the file is missing?")
+
+		return nil, -1, &StatusError{StatusCode: res.StatusCode, message: "failed to fetch update. maybe the file is missing?"}
 	}
 
-	return res.Body, res.ContentLength, nil
+	encoded := contentEncoding(res) != ""
+
+	if encoded && res.StatusCode == http.StatusPartialContent {
+		res.Body.Close()
+		return nil, -1, errors.New("the server answered the resumed download with compressed partial content")
+	}
+
+	body, err := decodeBody(res)
+	if err != nil {
+		res.Body.Close()
+		return nil, -1, err
+	}
+
+	contentLength := res.ContentLength
+	if encoded {
+		contentLength = -1
+	}
+
+	if res.StatusCode == http.StatusOK && offset > 0 {
+		// the server ignored the "Range" header, so skip what was
+		// already downloaded
+		_, err = io.CopyN(ioutil.Discard, body, offset)
+		if err != nil {
+			body.Close()
+			return nil, -1, fmt.Errorf("failed to skip already downloaded data: %s", err)
+		}
+
+		if contentLength > 0 {
+			contentLength -= offset
+		}
+	}
+
+	return body, contentLength, nil
 }
 
 func processUpgradeResponse(res *http.Response) (interface{}, error) {
@@ -107,6 +296,13 @@ func processUpgradeResponse(res *http.Response) (interface{}, error) {
 			return nil, fmt.Errorf("failed to parse upgrade response: %s", err)
 		}
 
+		if v := res.Header.Get(SignatureHeader); v != "" {
+			data.Signature, err = base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode update metadata signature: %s", err)
+			}
+		}
+
 		return data, nil
 	case http.StatusNotFound:
 		// NotFound is not an error in this case, just means there is no update available
@@ -9,16 +9,24 @@
 package client
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/UpdateHub/updatehub/installmodes/imxkobs"
 	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -34,7 +42,7 @@ func TestCheckUpdateWithInvalidApiRequester(t *testing.T) {
 		Version:          "version-value",
 	}
 
-	updateMetadata, extraPoll, err := uc.CheckUpdate(nil, UpgradesEndpoint, fm)
+	updateMetadata, extraPoll, err := uc.CheckUpdate(context.Background(), nil, UpgradesEndpoint, fm)
 
 	assert.Nil(t, updateMetadata)
 	assert.Equal(t, time.Duration(0), extraPoll)
@@ -55,7 +63,7 @@ func TestCheckUpdateWithNewRequestError(t *testing.T) {
 		Version:          "version-value",
 	}
 
-	updateMetadata, extraPoll, err := uc.CheckUpdate(ac.Request(), "/resource%s", fm)
+	updateMetadata, extraPoll, err := uc.CheckUpdate(context.Background(), ac.Request(), "/resource%s", fm)
 
 	assert.Nil(t, updateMetadata)
 	assert.Equal(t, time.Duration(0), extraPoll)
@@ -76,7 +84,7 @@ func TestCheckUpdateWithApiDoError(t *testing.T) {
 		Version:          "version-value",
 	}
 
-	updateMetadata, extraPoll, err := uc.CheckUpdate(ac.Request(), "/resource", fm)
+	updateMetadata, extraPoll, err := uc.CheckUpdate(context.Background(), ac.Request(), "/resource", fm)
 
 	assert.Nil(t, updateMetadata)
 	assert.Equal(t, time.Duration(0), extraPoll)
@@ -109,7 +117,7 @@ func TestCheckUpdateWithExtraPollHeaderError(t *testing.T) {
 		Version:          "version-value",
 	}
 
-	updateMetadata, extraPoll, err := uc.CheckUpdate(ac.Request(), path, fm)
+	updateMetadata, extraPoll, err := uc.CheckUpdate(context.Background(), ac.Request(), path, fm)
 
 	assert.Nil(t, updateMetadata)
 	assert.Equal(t, time.Duration(0), extraPoll)
@@ -142,7 +150,7 @@ func TestCheckUpdateWithResponseBodyReadError(t *testing.T) {
 		Version:          "version-value",
 	}
 
-	updateMetadata, extraPoll, err := uc.CheckUpdate(ac.Request(), path, fm)
+	updateMetadata, extraPoll, err := uc.CheckUpdate(context.Background(), ac.Request(), path, fm)
 
 	assert.Nil(t, updateMetadata)
 	assert.Equal(t, time.Duration(0), extraPoll)
@@ -175,7 +183,7 @@ func TestCheckUpdateWithResponseBodyParseError(t *testing.T) {
 		Version:          "version-value",
 	}
 
-	updateMetadata, extraPoll, err := uc.CheckUpdate(ac.Request(), path, fm)
+	updateMetadata, extraPoll, err := uc.CheckUpdate(context.Background(), ac.Request(), path, fm)
 
 	assert.Nil(t, updateMetadata)
 	assert.Equal(t, time.Duration(0), extraPoll)
@@ -208,7 +216,7 @@ func TestCheckUpdateWithInvalidStatusCode(t *testing.T) {
 		Version:          "version-value",
 	}
 
-	updateMetadata, extraPoll, err := uc.CheckUpdate(ac.Request(), path, fm)
+	updateMetadata, extraPoll, err := uc.CheckUpdate(context.Background(), ac.Request(), path, fm)
 
 	assert.Nil(t, updateMetadata)
 	assert.Equal(t, time.Duration(0), extraPoll)
@@ -241,7 +249,7 @@ func TestCheckUpdateWithNoUpdateAvailable(t *testing.T) {
 		Version:          "version-value",
 	}
 
-	updateMetadata, extraPoll, err := uc.CheckUpdate(ac.Request(), path, fm)
+	updateMetadata, extraPoll, err := uc.CheckUpdate(context.Background(), ac.Request(), path, fm)
 
 	assert.Nil(t, updateMetadata)
 	assert.Equal(t, time.Duration(3), extraPoll)
@@ -288,7 +296,7 @@ func TestCheckUpdateWithUpdateAvailable(t *testing.T) {
 		Version:          "version-value",
 	}
 
-	updateMetadata, extraPoll, err := uc.CheckUpdate(ac.Request(), path, fm)
+	updateMetadata, extraPoll, err := uc.CheckUpdate(context.Background(), ac.Request(), path, fm)
 
 	assert.Equal(t, time.Duration(0), extraPoll)
 	assert.NoError(t, err)
@@ -307,10 +315,61 @@ func TestCheckUpdateWithUpdateAvailable(t *testing.T) {
 	assert.Equal(t, "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", um.Objects[0][0].GetObjectMetadata().Sha256sum)
 }
 
+func TestCheckUpdateWithSignature(t *testing.T) {
+	// declaration just to register the imxkobs install mode
+	_ = &imxkobs.ImxKobsObject{}
+
+	expectedBody := `{"product-uid": "0123456789", "objects": [[{"mode": "imxkobs", "sha256sum": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"}]], "version": "1.2"}`
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(SignatureHeader, base64.StdEncoding.EncodeToString([]byte("signature")))
+		w.Write([]byte(expectedBody))
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	ac := NewApiClient(u.Host)
+
+	uc := NewUpdateClient()
+
+	updateMetadata, _, err := uc.CheckUpdate(context.Background(), ac.Request(), "/resource", &metadata.FirmwareMetadata{})
+	assert.NoError(t, err)
+
+	um := updateMetadata.(*metadata.UpdateMetadata)
+
+	assert.Equal(t, []byte(expectedBody), um.RawBytes)
+	assert.Equal(t, []byte("signature"), um.Signature)
+}
+
+func TestCheckUpdateWithInvalidSignatureEncoding(t *testing.T) {
+	// declaration just to register the imxkobs install mode
+	_ = &imxkobs.ImxKobsObject{}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(SignatureHeader, "#invalid#")
+		w.Write([]byte(`{"product-uid": "0123456789", "objects": []}`))
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	ac := NewApiClient(u.Host)
+
+	uc := NewUpdateClient()
+
+	updateMetadata, _, err := uc.CheckUpdate(context.Background(), ac.Request(), "/resource", &metadata.FirmwareMetadata{})
+
+	assert.Nil(t, updateMetadata)
+	assert.EqualError(t, err, "failed to decode update metadata signature: illegal base64 data at input byte 0")
+}
+
 func TestFetchUpdateWithInvalidApiRequester(t *testing.T) {
 	uc := NewUpdateClient()
 
-	body, contentLength, err := uc.FetchUpdate(nil, "/resource")
+	body, contentLength, err := uc.FetchUpdate(context.Background(), nil, "/resource", 0)
 
 	assert.Nil(t, body)
 	assert.Equal(t, int64(-1), contentLength)
@@ -322,7 +381,7 @@ func TestFetchUpdateWithNewRequestError(t *testing.T) {
 
 	uc := NewUpdateClient()
 
-	body, contentLength, err := uc.FetchUpdate(ac.Request(), "/resource%s")
+	body, contentLength, err := uc.FetchUpdate(context.Background(), ac.Request(), "/resource%s", 0)
 
 	assert.Nil(t, body)
 	assert.Equal(t, int64(-1), contentLength)
@@ -335,7 +394,7 @@ func TestFetchUpdateWithApiDoError(t *testing.T) {
 
 	uc := NewUpdateClient()
 
-	body, contentLength, err := uc.FetchUpdate(ac.Request(), "/resource")
+	body, contentLength, err := uc.FetchUpdate(context.Background(), ac.Request(), "/resource", 0)
 
 	assert.Nil(t, body)
 	assert.Equal(t, int64(-1), contentLength)
@@ -360,11 +419,12 @@ func TestFetchUpdateWithHTTPError(t *testing.T) {
 
 	uc := NewUpdateClient()
 
-	body, contentLength, err := uc.FetchUpdate(ac.Request(), path)
+	body, contentLength, err := uc.FetchUpdate(context.Background(), ac.Request(), path, 0)
 
 	assert.Nil(t, body)
 	assert.Equal(t, int64(-1), contentLength)
 	assert.EqualError(t, err, "failed to fetch update. maybe the file is missing?")
+	assert.True(t, IsPermanentError(err))
 }
 
 func TestFetchUpdateWithSuccess(t *testing.T) {
@@ -384,7 +444,7 @@ func TestFetchUpdateWithSuccess(t *testing.T) {
 
 	uc := NewUpdateClient()
 
-	body, contentLength, err := uc.FetchUpdate(ac.Request(), path)
+	body, contentLength, err := uc.FetchUpdate(context.Background(), ac.Request(), path, 0)
 	defer body.Close()
 
 	assert.Equal(t, int64(len(expectedBody)), contentLength)
@@ -398,6 +458,387 @@ func TestFetchUpdateWithSuccess(t *testing.T) {
 	assert.Equal(t, expectedBody, buffer)
 }
 
+func TestFetchUpdateWithOffset(t *testing.T) {
+	content := []byte("expected body")
+
+	var rangeHeader string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeHeader = r.Header.Get("Range")
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	ac := NewApiClient(u.Host)
+
+	uc := NewUpdateClient()
+
+	body, contentLength, err := uc.FetchUpdate(context.Background(), ac.Request(), "/resource", 9)
+	assert.NoError(t, err)
+	defer body.Close()
+
+	assert.Equal(t, "bytes=9-", rangeHeader)
+	assert.Equal(t, int64(4), contentLength)
+
+	data, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("body"), data)
+}
+
+func TestFetchUpdateWithOffsetAtTheEnd(t *testing.T) {
+	content := []byte("expected body")
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "" {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	ac := NewApiClient(u.Host)
+
+	uc := NewUpdateClient()
+
+	// the object was already downloaded to its end
+	body, contentLength, err := uc.FetchUpdate(context.Background(), ac.Request(), "/resource", int64(len(content)))
+	assert.NoError(t, err)
+	defer body.Close()
+
+	assert.Equal(t, int64(0), contentLength)
+
+	data, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+
+	// it's an error when nothing was downloaded
+	_, _, err = uc.FetchUpdate(context.Background(), ac.Request(), "/resource", 0)
+	assert.EqualError(t, err, "failed to fetch update. maybe the file is missing?")
+}
+
+func TestFetchUpdateWithRedirect(t *testing.T) {
+	content := []byte("expected body")
+
+	var rangeHeader string
+	var signature string
+
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeHeader = r.Header.Get("Range")
+		signature = r.URL.Query().Get("signature")
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+	}))
+	defer cdn.Close()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, cdn.URL+"/objects/sha256sum?signature=c2lnbmVk", http.StatusFound)
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	ac := NewApiClient(u.Host)
+
+	uc := NewUpdateClient()
+
+	body, contentLength, err := uc.FetchUpdate(context.Background(), ac.Request(), "/resource", 9)
+	assert.NoError(t, err)
+	defer body.Close()
+
+	// the signed query params and the range are kept
+	assert.Equal(t, "c2lnbmVk", signature)
+	assert.Equal(t, "bytes=9-", rangeHeader)
+	assert.Equal(t, int64(4), contentLength)
+
+	data, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("body"), data)
+}
+
+func TestFetchUpdateWithInvalidRedirect(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "ftp://cdn/object")
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	ac := NewApiClient(u.Host)
+
+	uc := NewUpdateClient()
+
+	_, _, err = uc.FetchUpdate(context.Background(), ac.Request(), "/resource", 0)
+	assert.EqualError(t, err, "fetch update request failed: invalid redirect to 'ftp://cdn/object'")
+}
+
+func TestFetchUpdateWithOffsetAndRangeNotSupported(t *testing.T) {
+	content := []byte("expected body")
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(content)))
+		w.Write(content)
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	ac := NewApiClient(u.Host)
+
+	uc := NewUpdateClient()
+
+	body, contentLength, err := uc.FetchUpdate(context.Background(), ac.Request(), "/resource", 9)
+	assert.NoError(t, err)
+	defer body.Close()
+
+	assert.Equal(t, int64(4), contentLength)
+
+	data, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("body"), data)
+}
+
+func TestFetchUpdateWithCompressedContent(t *testing.T) {
+	content := []byte("expected body")
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(content)
+	gw.Close()
+
+	zw, err := zstd.NewWriter(nil)
+	assert.NoError(t, err)
+	zstdCompressed := zw.EncodeAll(content, nil)
+
+	testCases := []struct {
+		name     string
+		encoding string
+		data     []byte
+	}{
+		{"Gzip", "gzip", gzipped.Bytes()},
+		{"Zstd", "zstd", zstdCompressed},
+		{"Identity", "identity", content},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var acceptEncoding string
+
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				acceptEncoding = r.Header.Get("Accept-Encoding")
+				w.Header().Set("Content-Encoding", tc.encoding)
+				w.Write(tc.data)
+			}))
+			defer s.Close()
+
+			u, err := url.Parse(s.URL)
+			assert.NoError(t, err)
+
+			ac := NewApiClient(u.Host)
+
+			uc := NewUpdateClient()
+
+			body, contentLength, err := uc.FetchUpdate(context.Background(), ac.Request(), "/resource", 0)
+			assert.NoError(t, err)
+			defer body.Close()
+
+			assert.Equal(t, "zstd, gzip", acceptEncoding)
+
+			if tc.encoding == "identity" {
+				assert.Equal(t, int64(len(content)), contentLength)
+			} else {
+				assert.Equal(t, int64(-1), contentLength)
+			}
+
+			data, err := ioutil.ReadAll(body)
+			assert.NoError(t, err)
+			assert.Equal(t, content, data)
+		})
+	}
+}
+
+func TestFetchUpdateWithOffsetIsntCompressed(t *testing.T) {
+	content := []byte("expected body")
+
+	var acceptEncoding string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	ac := NewApiClient(u.Host)
+
+	uc := NewUpdateClient()
+
+	body, _, err := uc.FetchUpdate(context.Background(), ac.Request(), "/resource", 9)
+	assert.NoError(t, err)
+	defer body.Close()
+
+	assert.Equal(t, "identity", acceptEncoding)
+}
+
+func TestFetchUpdateWithCompressedPartialContent(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusPartialContent)
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	ac := NewApiClient(u.Host)
+
+	uc := NewUpdateClient()
+
+	body, contentLength, err := uc.FetchUpdate(context.Background(), ac.Request(), "/resource", 9)
+	assert.Nil(t, body)
+	assert.Equal(t, int64(-1), contentLength)
+	assert.EqualError(t, err, "the server answered the resumed download with compressed partial content")
+}
+
+func TestFetchUpdateWithUnsupportedEncoding(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Write([]byte("data"))
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	ac := NewApiClient(u.Host)
+
+	uc := NewUpdateClient()
+
+	body, contentLength, err := uc.FetchUpdate(context.Background(), ac.Request(), "/resource", 0)
+	assert.Nil(t, body)
+	assert.Equal(t, int64(-1), contentLength)
+	assert.EqualError(t, err, "unsupported content encoding 'br'")
+}
+
+func TestForwardCheckUpdate(t *testing.T) {
+	var request []byte
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		request, err = ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		if r.URL.Path == "/no-update" {
+			w.Header().Set("Add-Extra-Poll", "3")
+			w.Header().Set(PollingIntervalHeader, "7200")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set(SignatureHeader, "c2lnbmF0dXJl")
+		fmt.Fprint(w, `{"objects": [[{"mode": "unknown"}]]}`)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	assert.NoError(t, err)
+
+	ac := NewApiClient(u.Host)
+
+	uc := NewUpdateClient()
+
+	// the metadata isn't parsed, so its install modes don't matter
+	update, err := uc.ForwardCheckUpdate(ac.Request(), UpgradesEndpoint, json.RawMessage(`{"product-uid":"0123"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"product-uid":"0123"}`, string(request))
+	assert.Equal(t, &ForwardedUpdate{Metadata: []byte(`{"objects": [[{"mode": "unknown"}]]}`), Signature: "c2lnbmF0dXJl"}, update)
+
+	update, err = uc.ForwardCheckUpdate(ac.Request(), "/no-update", json.RawMessage(`{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, &ForwardedUpdate{ExtraPoll: "3", PollingInterval: "7200"}, update)
+
+	update, err = uc.ForwardCheckUpdate(ac.Request(), "/error", json.RawMessage(`{}`))
+	assert.Nil(t, update)
+	assert.EqualError(t, err, "invalid response received from the server. Status 502")
+
+	update, err = uc.ForwardCheckUpdate(nil, UpgradesEndpoint, nil)
+	assert.Nil(t, update)
+	assert.EqualError(t, err, "invalid api requester")
+}
+
+func TestCheckUpdateWithPollingInterval(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/polling-interval":
+			w.Header().Set(PollingIntervalHeader, "7200")
+		case "/negative-polling-interval":
+			w.Header().Set(PollingIntervalHeader, "-1")
+		case "/malformed-polling-interval":
+			w.Header().Set(PollingIntervalHeader, "2h")
+		case "/huge-polling-interval":
+			w.Header().Set(PollingIntervalHeader, "9223372036854775807")
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	assert.NoError(t, err)
+
+	ac := NewApiClient(u.Host)
+
+	uc := NewUpdateClient()
+
+	_, _, err = uc.CheckUpdate(context.Background(), ac.Request(), "/polling-interval", nil)
+	assert.NoError(t, err)
+
+	interval, ok := uc.LastPollingInterval()
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Hour, interval)
+
+	// not told on the next one
+	_, _, err = uc.CheckUpdate(context.Background(), ac.Request(), UpgradesEndpoint, nil)
+	assert.NoError(t, err)
+
+	_, ok = uc.LastPollingInterval()
+	assert.False(t, ok)
+
+	// the invalid ones are ignored
+	for _, uri := range []string{"/negative-polling-interval", "/malformed-polling-interval"} {
+		_, _, err = uc.CheckUpdate(context.Background(), ac.Request(), uri, nil)
+		assert.NoError(t, err)
+
+		_, ok = uc.LastPollingInterval()
+		assert.False(t, ok)
+	}
+
+	_, _, err = uc.CheckUpdate(context.Background(), ac.Request(), "/huge-polling-interval", nil)
+	assert.NoError(t, err)
+
+	interval, ok = uc.LastPollingInterval()
+	assert.True(t, ok)
+	assert.Equal(t, 365*24*time.Hour, interval)
+}
+
 type testHttpHandler struct {
 	Path         string
 	ResponseBody string
@@ -478,3 +919,47 @@ func StartNewTestHttpServer(address string, handler http.Handler) (int, *http.Se
 
 	return port, server, nil
 }
+
+func TestFetchUpdateWithCancelledContext(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("12345"))
+		w.(http.Flusher).Flush()
+
+		// the rest of the body never comes
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	ac := NewApiClient(u.Host)
+	ac.SetServers([]string{u.Host, "secondary"}, time.Minute)
+
+	uc := NewUpdateClient()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	body, contentLength, err := uc.FetchUpdate(ctx, ac.Request(), "/resource", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), contentLength)
+
+	defer body.Close()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	// the read of the body is aborted
+	data, err := ioutil.ReadAll(body)
+	assert.Error(t, err)
+	assert.Equal(t, "12345", string(data))
+
+	// an aborted request says nothing about the server
+	_, _, err = uc.CheckUpdate(ctx, ac.Request(), UpgradesEndpoint, &metadata.FirmwareMetadata{})
+	assert.EqualError(t, err, "check update request failed")
+	assert.Equal(t, []string{u.Host, "secondary"}, ac.availableServers())
+}
@@ -9,11 +9,10 @@
 package main
 
 const (
-	// The system settings are the settings configured in the client-side and will be read-only
-	systemSettingsPath = "/etc/updatehub.conf"
-	// The runtime settings are the settings that may can change during the execution of UpdateHub
-	// These settings are persisted to keep the behaviour across of device's reboot
-	runtimeSettingsPath = "/var/lib/updatehub.conf"
 	// The path on which will be located the scripts that provide the firmware metadata
 	firmwareMetadataDirPath = "/usr/share/updatehub"
+	// The address of the agent API, which is meant to be used only by local clients
+	agentAddress = "127.0.0.1:8080"
+	// The argument which requests an update probe to the running agent
+	probeCommand = "probe"
 )
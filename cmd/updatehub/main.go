@@ -9,15 +9,20 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 
 	"github.com/OSSystems/pkg/log"
 	"github.com/Sirupsen/logrus"
 	"github.com/spf13/afero"
 
-	"github.com/UpdateHub/updatehub/client"
 	_ "github.com/UpdateHub/updatehub/installmodes/copy"
 	"github.com/UpdateHub/updatehub/metadata"
 	"github.com/UpdateHub/updatehub/server"
@@ -27,50 +32,243 @@ import (
 
 func main() {
 	log.SetLevel(logrus.WarnLevel)
+	updatehub.SetLogLevel(updatehub.LogLevelWarning)
+
+	// systemd connects the standard error of the services to journald
+	if os.Getenv("JOURNAL_STREAM") != "" {
+		logger := logrus.New()
+		logger.Level = logrus.DebugLevel
+		logger.Formatter = &updatehub.JournaldFormatter{Formatter: logger.Formatter}
+
+		updatehub.SetLogger(updatehub.NewLogrusLogger(logger))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == updatehub.FetcherCommand {
+		os.Exit(runFetcher())
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == probeCommand {
+		os.Exit(runProbe(os.Args[2:]))
+	}
+
+	dryRun := flag.Bool("dry-run", false, "check for, download and verify the updates without installing them")
+	checkConfig := flag.Bool("check-config", false, "validate the settings and exit, non-zero if any is invalid")
+	flag.Parse()
 
 	osFs := afero.NewOsFs()
 
-	fm, err := metadata.NewFirmwareMetadata(firmwareMetadataDirPath, osFs, &utils.CmdLine{})
+	if *checkConfig {
+		os.Exit(runCheckConfig(osFs))
+	}
+
+	loader := &metadata.FirmwareMetadataLoader{
+		BasePath:        firmwareMetadataDirPath,
+		Store:           osFs,
+		CmdLineExecuter: &utils.CmdLine{},
+	}
+
+	fm, err := loader.Load()
 	if err != nil {
 		log.Fatal(err)
 		os.Exit(1)
 	}
 
-	backend, err := server.NewAgentBackend()
+	if fm == nil {
+		log.Fatal("no device identity was found in the firmware metadata")
+		os.Exit(1)
+	}
+
+	uh := updatehub.New(
+		updatehub.WithFileSystem(osFs),
+		updatehub.WithFirmwareMetadata(*fm, loader),
+		updatehub.WithDryRun(*dryRun),
+	)
+
+	if err = uh.LoadSettings(); err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	if err = uh.ValidateUpdate(); err != nil {
+		log.Error(err)
+	}
+
+	if err = uh.SetupPrivilegeSeparation(os.Args[0]); err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	backend, err := server.NewAgentBackend(uh)
 	if err != nil {
 		log.Fatal(err)
 		os.Exit(1)
 	}
 
+	// the agent API is meant to be used only by local clients
 	go func() {
 		router := server.NewBackendRouter(backend)
-		if err := http.ListenAndServe(":8080", router.HTTPRouter); err != nil {
+		if err := http.ListenAndServe(agentAddress, router.HTTPRouter); err != nil {
 			log.Fatal(err)
 		}
 	}()
 
-	uh := &updatehub.UpdateHub{
-		State:               updatehub.NewIdleState(),
-		API:                 client.NewApiClient("localhost:8080"),
-		Updater:             client.NewUpdateClient(),
-		TimeStep:            time.Minute,
-		Store:               osFs,
-		FirmwareMetadata:    *fm,
-		SystemSettingsPath:  systemSettingsPath,
-		RuntimeSettingsPath: runtimeSettingsPath,
-		Reporter:            client.NewReportClient(),
+	if err = uh.StartMQTT(); err != nil {
+		log.Warn(err)
 	}
 
-	uh.Controller = uh
+	if _, err = uh.StartPush(); err != nil {
+		log.Warn(err)
+	}
 
-	if err = uh.LoadSettings(); err != nil {
+	if err = uh.StartChannel(); err != nil {
+		log.Warn(err)
+	}
+
+	peerBackend, err := server.NewPeerBackend(uh)
+	if err != nil {
 		log.Fatal(err)
 		os.Exit(1)
 	}
 
+	if err = uh.StartPeers(server.NewBackendRouter(peerBackend).HTTPRouter); err != nil {
+		log.Warn(err)
+	}
+
+	gatewayBackend, err := server.NewGatewayBackend(uh)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	if err = uh.StartGateway(server.NewBackendRouter(gatewayBackend).HTTPRouter); err != nil {
+		log.Warn(err)
+	}
+
 	uh.StartPolling()
 
+	// SIGUSR1 probes for an update right away
+	probes := make(chan os.Signal, 1)
+	signal.Notify(probes, syscall.SIGUSR1)
+
+	go func() {
+		for range probes {
+			if err := uh.ProbeUpdate(); err != nil {
+				log.Warn(err)
+			}
+		}
+	}()
+
+	// SIGHUP reloads the settings
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+
+	go func() {
+		for range reloads {
+			if err := uh.ReloadSettings(); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+
 	d := updatehub.NewDaemon(uh)
 
 	os.Exit(d.Run())
 }
+
+// stdio is the connection to the privileged half of the agent
+type stdio struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// runFetcher serves the update checks and downloads requested by the
+// privileged half of the agent, through the standard input and output
+func runFetcher() int {
+	uh := updatehub.New()
+
+	if err := uh.LoadSettings(); err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	if err := updatehub.ServeFetcher(uh, &stdio{Reader: os.Stdin, WriteCloser: os.Stdout}); err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	return 0
+}
+
+// runCheckConfig validates the settings, each invalid one is printed
+// on its own line
+func runCheckConfig(fs afero.Fs) int {
+	uh := updatehub.New(updatehub.WithFileSystem(fs))
+
+	err := uh.CheckSettings()
+	if se, ok := err.(*updatehub.SettingsError); ok {
+		for _, p := range se.Problems {
+			fmt.Fprintln(os.Stderr, p)
+		}
+
+		return 1
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Println("the settings are valid")
+
+	return 0
+}
+
+// runProbe requests an update probe to the running agent, which checks
+// for it at the server address given in "args", if any
+func runProbe(args []string) int {
+	var body struct {
+		ServerAddress string `json:"server-address,omitempty"`
+	}
+
+	if len(args) > 1 {
+		log.Error("usage: updatehub probe [server-address]")
+		return 1
+	}
+
+	if len(args) == 1 {
+		body.ServerAddress = args[0]
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	res, err := http.Post(fmt.Sprintf("http://%s/probe", agentAddress), "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	defer res.Body.Close()
+
+	var reply struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&reply)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	if res.StatusCode != http.StatusAccepted {
+		log.Error(reply.Error)
+		return 1
+	}
+
+	fmt.Println(reply.Message)
+
+	return 0
+}
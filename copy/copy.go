@@ -42,7 +42,32 @@ type Interface interface {
 		compressed bool) error
 }
 
+// ProgressNotifier is implemented by the copy backends able to notify
+// how many bytes were written so far
+type ProgressNotifier interface {
+	SetProgressFunc(fn func(written int64))
+}
+
 type ExtendedIO struct {
+	progress func(written int64)
+}
+
+// SetProgressFunc sets "fn" to be called each time a chunk is written
+func (eio *ExtendedIO) SetProgressFunc(fn func(written int64)) {
+	eio.progress = fn
+}
+
+// NotifyProgress makes "backend", when it is a ProgressNotifier, call
+// "fn" with the amount of bytes written so far out of "total"
+func NotifyProgress(backend Interface, fn func(written int64, total int64), total int64) {
+	pn, ok := backend.(ProgressNotifier)
+	if !ok || fn == nil {
+		return
+	}
+
+	pn.SetProgressFunc(func(written int64) {
+		fn(written, total)
+	})
 }
 
 // Copy copies from rd to wr until EOF or timeout is reached on rd or it was cancelled
@@ -55,6 +80,7 @@ func (eio ExtendedIO) Copy(wr io.Writer, rd io.Reader, timeout time.Duration, ca
 	buf := make([]byte, chunkSize)
 	readErrChan := make(chan error)
 	toSkip := skip
+	written := int64(0)
 
 Loop:
 	for i := 0; i != count; i++ {
@@ -96,6 +122,11 @@ Loop:
 				if err != nil {
 					return false, err
 				}
+
+				written += int64(n)
+				if eio.progress != nil {
+					eio.progress(written)
+				}
 			}
 		}
 	}
@@ -83,6 +83,26 @@ func TestCopy(t *testing.T) {
 	assert.Equal(t, data, buff.String())
 }
 
+func TestCopyWithProgress(t *testing.T) {
+	buff := bytes.NewBuffer(nil)
+
+	rd := bytes.NewReader([]byte("12345"))
+
+	progress := []int64{}
+
+	eio := &ExtendedIO{}
+	NotifyProgress(eio, func(written int64, total int64) {
+		assert.Equal(t, int64(5), total)
+		progress = append(progress, written)
+	}, 5)
+
+	cancelled, err := eio.Copy(buff, rd, time.Minute, nil, 2, 0, -1, false)
+	assert.NoError(t, err)
+	assert.False(t, cancelled)
+	assert.Equal(t, "12345", buff.String())
+	assert.Equal(t, []int64{2, 4, 5}, progress)
+}
+
 func TestCopyTimeoutHasReached(t *testing.T) {
 	rd := NewTimedReader("123")
 
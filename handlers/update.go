@@ -8,8 +8,39 @@
 
 package handlers
 
+import "io"
+
 type InstallUpdateHandler interface {
 	Setup() error
 	Install(downloadDir string) error
 	Cleanup() error
 }
+
+// ProgressFunc receives how many bytes of an object were already
+// installed out of "total". "total" is 0 when it isn't known.
+type ProgressFunc func(installed int64, total int64)
+
+// ProgressReporter is an optional interface implemented by the
+// handlers able to tell the progress of long running installations
+type ProgressReporter interface {
+	SetProgressFunc(fn ProgressFunc)
+}
+
+// StreamInstaller is an optional interface implemented by the
+// handlers able to install an object straight from the download
+// stream, so it doesn't need to be stored in the download dir first.
+// Streamable tells whether the object, as described by its metadata,
+// can be installed that way.
+type StreamInstaller interface {
+	Streamable() bool
+	InstallFromStream(rd io.Reader) error
+}
+
+// IdempotentInstaller is an optional interface implemented by the
+// handlers whose installation can be done again over an interrupted
+// one, like the ones which overwrite their whole target. When the
+// installation of any other handler is interrupted by a power loss the
+// whole package is installed again.
+type IdempotentInstaller interface {
+	Idempotent() bool
+}
@@ -0,0 +1,72 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package installifdifferent
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// installIfDifferentCommand probes the installed version through the
+// output of "command", like the firmware version of an attached
+// microcontroller. When "regexp" is given the version is its first
+// submatch (or the whole match without submatches), otherwise it is
+// the whole output. The object is installed when the version differs
+// from "version" or can't be found in the output.
+func installIfDifferentCommand(cle utils.CmdLineExecuter, probe map[string]interface{}) (bool, error) {
+	command, ok := probe["command"].(string)
+	if !ok || command == "" {
+		return false, fmt.Errorf("install-if-different command must be a non-empty string")
+	}
+
+	version, ok := probe["version"].(string)
+	if !ok {
+		return false, fmt.Errorf("install-if-different command probe must have a version")
+	}
+
+	var re *regexp.Regexp
+
+	if expr, ok := probe["regexp"]; ok {
+		s, ok := expr.(string)
+		if !ok {
+			return false, fmt.Errorf("install-if-different regexp must be a string")
+		}
+
+		var err error
+
+		re, err = regexp.Compile(s)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	output, err := cle.Execute(command)
+	if err != nil {
+		return false, err
+	}
+
+	installed := strings.TrimSpace(string(output))
+
+	if re != nil {
+		matched := re.FindStringSubmatch(installed)
+		if matched == nil {
+			return true, nil
+		}
+
+		installed = matched[0]
+		if len(matched) > 1 {
+			installed = matched[1]
+		}
+	}
+
+	return installed != version, nil
+}
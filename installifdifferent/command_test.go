@@ -0,0 +1,166 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package installifdifferent
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func objectWithInstallIfDifferentCommand(probe string) string {
+	return fmt.Sprintf(`{
+        "mode": "test",
+        "target": "/dev/ttyS1",
+        "target-type": "device",
+        "install-if-different": %s
+	}`, probe)
+}
+
+func registerTestInstallMode() installmodes.InstallMode {
+	return installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "test",
+		CheckRequirements: func() error { return nil },
+		GetObject:         func() interface{} { return &testObjectWithoutIIDSupport{} },
+	})
+}
+
+func TestProceedWithCommand(t *testing.T) {
+	mode := registerTestInstallMode()
+	defer mode.Unregister()
+
+	testCases := []struct {
+		name            string
+		probe           string
+		output          string
+		expectedInstall bool
+	}{
+		{
+			"WithVersionMatch",
+			`{"version": "1.2.0", "command": "mcu-version /dev/ttyS1"}`,
+			"1.2.0\n",
+			false,
+		},
+		{
+			"WithoutVersionMatch",
+			`{"version": "1.2.0", "command": "mcu-version /dev/ttyS1"}`,
+			"1.1.9\n",
+			true,
+		},
+		{
+			"WithRegexpSubmatch",
+			`{"version": "1.2.0", "command": "mcu-version /dev/ttyS1", "regexp": "firmware v(\\S+)"}`,
+			"bootloader v0.3\nfirmware v1.2.0 (release)\n",
+			false,
+		},
+		{
+			"WithRegexpMatch",
+			`{"version": "1.2.0", "command": "mcu-version /dev/ttyS1", "regexp": "\\d+\\.\\d+\\.\\d+"}`,
+			"firmware 1.3.0\n",
+			true,
+		},
+		{
+			"WithoutRegexpMatch",
+			`{"version": "1.2.0", "command": "mcu-version /dev/ttyS1", "regexp": "firmware v(\\S+)"}`,
+			"no response\n",
+			true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+			clm.On("Execute", "mcu-version /dev/ttyS1").Return([]byte(tc.output), nil)
+
+			iif := &DefaultImpl{FileSystemBackend: afero.NewMemMapFs(), CmdLineExecuter: clm}
+
+			o, err := metadata.NewObjectMetadata([]byte(objectWithInstallIfDifferentCommand(tc.probe)))
+			assert.NoError(t, err)
+
+			install, err := iif.Proceed(o)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedInstall, install)
+
+			clm.AssertExpectations(t)
+		})
+	}
+}
+
+func TestProceedWithCommandWithExecuteError(t *testing.T) {
+	mode := registerTestInstallMode()
+	defer mode.Unregister()
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "mcu-version /dev/ttyS1").Return([]byte(""), fmt.Errorf("execute error"))
+
+	iif := &DefaultImpl{FileSystemBackend: afero.NewMemMapFs(), CmdLineExecuter: clm}
+
+	o, err := metadata.NewObjectMetadata([]byte(objectWithInstallIfDifferentCommand(`{"version": "1.2.0", "command": "mcu-version /dev/ttyS1"}`)))
+	assert.NoError(t, err)
+
+	install, err := iif.Proceed(o)
+	assert.EqualError(t, err, "execute error")
+	assert.False(t, install)
+
+	clm.AssertExpectations(t)
+}
+
+func TestProceedWithInvalidCommand(t *testing.T) {
+	mode := registerTestInstallMode()
+	defer mode.Unregister()
+
+	testCases := []struct {
+		name        string
+		probe       string
+		expectedErr string
+	}{
+		{
+			"WithEmptyCommand",
+			`{"version": "1.2.0", "command": ""}`,
+			"install-if-different command must be a non-empty string",
+		},
+		{
+			"WithoutVersion",
+			`{"command": "mcu-version /dev/ttyS1"}`,
+			"install-if-different command probe must have a version",
+		},
+		{
+			"WithNonStringRegexp",
+			`{"version": "1.2.0", "command": "mcu-version /dev/ttyS1", "regexp": 1}`,
+			"install-if-different regexp must be a string",
+		},
+		{
+			"WithInvalidRegexp",
+			`{"version": "1.2.0", "command": "mcu-version /dev/ttyS1", "regexp": "("}`,
+			"error parsing regexp: missing closing ): `(`",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+
+			iif := &DefaultImpl{FileSystemBackend: afero.NewMemMapFs(), CmdLineExecuter: clm}
+
+			o, err := metadata.NewObjectMetadata([]byte(objectWithInstallIfDifferentCommand(tc.probe)))
+			assert.NoError(t, err)
+
+			install, err := iif.Proceed(o)
+			assert.EqualError(t, err, tc.expectedErr)
+			assert.False(t, install)
+
+			clm.AssertExpectations(t)
+		})
+	}
+}
@@ -10,6 +10,8 @@ package installifdifferent
 
 import (
 	"fmt"
+	"io"
+	"os"
 
 	"github.com/UpdateHub/updatehub/installmodes"
 	"github.com/UpdateHub/updatehub/metadata"
@@ -23,35 +25,54 @@ type Interface interface {
 
 type DefaultImpl struct {
 	FileSystemBackend afero.Fs
+	CmdLineExecuter   utils.CmdLineExecuter
 }
 
 func (iid *DefaultImpl) Proceed(o metadata.Object) (bool, error) {
+	// a command probe doesn't depend on the target
+	probe, ok := o.GetObjectMetadata().InstallIfDifferent.(map[string]interface{})
+	if ok {
+		if _, hasCommand := probe["command"]; hasCommand {
+			cle := iid.CmdLineExecuter
+			if cle == nil {
+				cle = &utils.CmdLine{}
+			}
+
+			return installIfDifferentCommand(cle, probe)
+		}
+	}
+
 	om, err := installmodes.GetObject(o.GetObjectMetadata().Mode)
 	if err != nil {
 		return false, err
 	}
 
-	tg, ok := om.(TargetGetter)
-
-	if !ok {
+	if _, ok := om.(TargetGetter); !ok {
 		// "o" does NOT support install-if-different
 		return true, nil
 	}
 
-	// "o" does support install-if-different
+	// "o" does support install-if-different, its target is known
+	// after the setup
+	target := o.(TargetGetter).GetTarget()
+	fsb := iid.FileSystemBackend
 
-	target := tg.GetTarget()
+	if rg, ok := o.(TargetRangeGetter); ok {
+		if offset, size := rg.GetTargetRange(); size > 0 {
+			fsb = &targetRangeFs{Fs: fsb, target: target, offset: offset, size: size}
+		}
+	}
 
 	sha256sum, ok := o.GetObjectMetadata().InstallIfDifferent.(string)
 	if ok {
 		// is string, so is a Sha256Sum
-		return installIfDifferentSha256Sum(iid.FileSystemBackend, target, sha256sum)
+		return installIfDifferentSha256Sum(fsb, target, sha256sum)
 	}
 
 	pattern, ok := o.GetObjectMetadata().InstallIfDifferent.(map[string]interface{})
 	if ok {
 		// is object, so is a Pattern
-		return installIfDifferentPattern(iid.FileSystemBackend, target, pattern)
+		return installIfDifferentPattern(fsb, target, pattern)
 	}
 
 	return false, fmt.Errorf("unknown install-if-different format")
@@ -61,6 +82,72 @@ type TargetGetter interface {
 	GetTarget() string
 }
 
+// TargetRangeGetter is implemented by the objects whose target is
+// larger than the image written to it, like flash partitions and UBI
+// volumes, so only the "size" bytes from "offset" are probed. The
+// whole target is probed when "size" is 0.
+type TargetRangeGetter interface {
+	GetTargetRange() (offset int64, size int64)
+}
+
+// targetRangeFs opens "target" as the "size" bytes from "offset" of
+// it, so the probes don't read past the image written to it. The other
+// files are opened from the underlying filesystem.
+type targetRangeFs struct {
+	afero.Fs
+
+	target string
+	offset int64
+	size   int64
+}
+
+func (fs *targetRangeFs) Open(name string) (afero.File, error) {
+	file, err := fs.Fs.Open(name)
+	if err != nil || name != fs.target {
+		return file, err
+	}
+
+	return &sectionFile{File: file, section: io.NewSectionReader(file, fs.offset, fs.size)}, nil
+}
+
+// sectionFile reads a section of the file it wraps
+type sectionFile struct {
+	afero.File
+
+	section *io.SectionReader
+}
+
+func (f *sectionFile) Read(p []byte) (int, error) {
+	return f.section.Read(p)
+}
+
+func (f *sectionFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.section.ReadAt(p, off)
+}
+
+func (f *sectionFile) Seek(offset int64, whence int) (int64, error) {
+	return f.section.Seek(offset, whence)
+}
+
+func (f *sectionFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &sectionFileInfo{FileInfo: info, size: f.section.Size()}, nil
+}
+
+type sectionFileInfo struct {
+	os.FileInfo
+
+	size int64
+}
+
+func (fi *sectionFileInfo) Size() int64 {
+	return fi.size
+}
+
 func installIfDifferentSha256Sum(fsb afero.Fs, target string, sha256sum string) (bool, error) {
 	calculatedSha256sum, err := utils.FileSha256sum(fsb, target)
 	if err != nil {
@@ -11,6 +11,8 @@ package installifdifferent
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"testing"
 
 	"github.com/UpdateHub/updatehub/installmodes"
@@ -105,6 +107,14 @@ type testObjectWithoutIIDSupport struct {
 	metadata.ObjectMetadata
 }
 
+type testObjectWithRange struct {
+	testObject
+}
+
+func (to *testObjectWithRange) GetTargetRange() (int64, int64) {
+	return 4, 5
+}
+
 func TestProceedWithGetObjectError(t *testing.T) {
 	memFs := afero.NewMemMapFs()
 
@@ -118,7 +128,7 @@ func TestProceedWithGetObjectError(t *testing.T) {
 		GetObject:         func() interface{} { return &testObjectWithoutIIDSupport{} },
 	})
 
-	iif := &DefaultImpl{memFs}
+	iif := &DefaultImpl{FileSystemBackend: memFs}
 
 	o, err := metadata.NewObjectMetadata([]byte(ObjectWithInstallIfDifferentSha256Sum))
 	assert.NoError(t, err)
@@ -144,7 +154,7 @@ func TestProceedWithoutInstallIfDifferentSupport(t *testing.T) {
 	})
 	defer mode.Unregister()
 
-	iif := &DefaultImpl{memFs}
+	iif := &DefaultImpl{FileSystemBackend: memFs}
 
 	o, err := metadata.NewObjectMetadata([]byte(ObjectWithoutInstallIfDifferent))
 	assert.NoError(t, err)
@@ -168,7 +178,7 @@ func TestProceedWithSha256SumMatch(t *testing.T) {
 	})
 	defer mode.Unregister()
 
-	iif := &DefaultImpl{memFs}
+	iif := &DefaultImpl{FileSystemBackend: memFs}
 
 	o, err := metadata.NewObjectMetadata([]byte(ObjectWithInstallIfDifferentSha256Sum))
 	assert.NoError(t, err)
@@ -192,7 +202,7 @@ func TestProceedWithSha256SumWithoutMatch(t *testing.T) {
 	})
 	defer mode.Unregister()
 
-	iif := &DefaultImpl{memFs}
+	iif := &DefaultImpl{FileSystemBackend: memFs}
 
 	o, err := metadata.NewObjectMetadata([]byte(ObjectWithInstallIfDifferentSha256Sum))
 	assert.NoError(t, err)
@@ -212,7 +222,7 @@ func TestProceedWithSha256SumWithOpenError(t *testing.T) {
 	})
 	defer mode.Unregister()
 
-	iif := &DefaultImpl{memFs}
+	iif := &DefaultImpl{FileSystemBackend: memFs}
 
 	o, err := metadata.NewObjectMetadata([]byte(ObjectWithInstallIfDifferentSha256Sum))
 	assert.NoError(t, err)
@@ -243,7 +253,7 @@ func TestProceedWithPatternWithVersionMatch(t *testing.T) {
 	})
 	defer mode.Unregister()
 
-	iif := &DefaultImpl{fs}
+	iif := &DefaultImpl{FileSystemBackend: fs}
 
 	o, err := metadata.NewObjectMetadata([]byte(ObjectWithInstallIfDifferentPattern))
 	assert.NoError(t, err)
@@ -275,7 +285,7 @@ func TestProceedWithPatternWithoutVersionMatch(t *testing.T) {
 	})
 	defer mode.Unregister()
 
-	iif := &DefaultImpl{fs}
+	iif := &DefaultImpl{FileSystemBackend: fs}
 
 	o, err := metadata.NewObjectMetadata([]byte(ObjectWithInstallIfDifferentPattern))
 	assert.NoError(t, err)
@@ -299,7 +309,7 @@ func TestProceedWithPatternWithUnknownPattern(t *testing.T) {
 	})
 	defer mode.Unregister()
 
-	iif := &DefaultImpl{memFs}
+	iif := &DefaultImpl{FileSystemBackend: memFs}
 
 	o, err := metadata.NewObjectMetadata([]byte(ObjectWithInstallIfDifferentPatternWithArrayPattern))
 	assert.NoError(t, err)
@@ -323,7 +333,7 @@ func TestProceedWithPatternWithInvalidPattern(t *testing.T) {
 	})
 	defer mode.Unregister()
 
-	iif := &DefaultImpl{memFs}
+	iif := &DefaultImpl{FileSystemBackend: memFs}
 
 	o, err := metadata.NewObjectMetadata([]byte(ObjectWithInstallIfDifferentPatternWithInvalidPattern))
 	assert.NoError(t, err)
@@ -344,7 +354,7 @@ func TestProceedWithPatternWithCaptureError(t *testing.T) {
 	})
 	defer mode.Unregister()
 
-	iif := &DefaultImpl{fs}
+	iif := &DefaultImpl{FileSystemBackend: fs}
 
 	o, err := metadata.NewObjectMetadata([]byte(ObjectWithInstallIfDifferentPattern))
 	assert.NoError(t, err)
@@ -370,7 +380,7 @@ func TestProceedWithUnknownFormatError(t *testing.T) {
 	})
 	defer mode.Unregister()
 
-	iif := &DefaultImpl{memFs}
+	iif := &DefaultImpl{FileSystemBackend: memFs}
 
 	o, err := metadata.NewObjectMetadata([]byte(ObjectWithInstallIfDifferentUnknownFormat))
 	assert.NoError(t, err)
@@ -379,3 +389,94 @@ func TestProceedWithUnknownFormatError(t *testing.T) {
 	assert.EqualError(t, err, "unknown install-if-different format")
 	assert.False(t, install)
 }
+
+func TestProceedWithTargetRange(t *testing.T) {
+	testCases := []struct {
+		name            string
+		content         string
+		expectedInstall bool
+	}{
+		// the sha256sum of "dummy", surrounded by the unused flash
+		{"WithSha256SumMatch", "\xff\xff\xff\xffdummy\xff\xff", false},
+		{"WithSha256SumWithoutMatch", "\xff\xff\xff\xffdumm\xff\xff\xff", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			memFs := afero.NewMemMapFs()
+
+			err := afero.WriteFile(memFs, testObjectGetTargetReturn, []byte(tc.content), 0666)
+			assert.NoError(t, err)
+
+			mode := installmodes.RegisterInstallMode(installmodes.InstallMode{
+				Name:              "test",
+				CheckRequirements: func() error { return nil },
+				GetObject:         func() interface{} { return &testObjectWithRange{} },
+			})
+			defer mode.Unregister()
+
+			iif := &DefaultImpl{FileSystemBackend: memFs}
+
+			o, err := metadata.NewObjectMetadata([]byte(ObjectWithInstallIfDifferentSha256Sum))
+			assert.NoError(t, err)
+
+			install, err := iif.Proceed(o)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedInstall, install)
+		})
+	}
+}
+
+func TestProceedWithTargetRangeWithOpenError(t *testing.T) {
+	mode := installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "test",
+		CheckRequirements: func() error { return nil },
+		GetObject:         func() interface{} { return &testObjectWithRange{} },
+	})
+	defer mode.Unregister()
+
+	iif := &DefaultImpl{FileSystemBackend: afero.NewMemMapFs()}
+
+	o, err := metadata.NewObjectMetadata([]byte(ObjectWithInstallIfDifferentSha256Sum))
+	assert.NoError(t, err)
+
+	install, err := iif.Proceed(o)
+	assert.EqualError(t, err, fmt.Sprintf("open %s: file does not exist", testObjectGetTargetReturn))
+	assert.False(t, install)
+}
+
+func TestTargetRangeFs(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+
+	err := afero.WriteFile(memFs, "/dev/mtd1", []byte("\xff\xff\xff\xffdummy\xff\xff"), 0666)
+	assert.NoError(t, err)
+
+	err = afero.WriteFile(memFs, "/tmp/other", []byte("other"), 0666)
+	assert.NoError(t, err)
+
+	fs := &targetRangeFs{Fs: memFs, target: "/dev/mtd1", offset: 4, size: 5}
+
+	data, err := afero.ReadFile(fs, "/dev/mtd1")
+	assert.NoError(t, err)
+	assert.Equal(t, "dummy", string(data))
+
+	file, err := fs.Open("/dev/mtd1")
+	assert.NoError(t, err)
+	defer file.Close()
+
+	info, err := file.Stat()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size())
+
+	_, err = file.Seek(2, io.SeekStart)
+	assert.NoError(t, err)
+
+	data, err = ioutil.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "mmy", string(data))
+
+	// the other files are read as they are
+	data, err = afero.ReadFile(fs, "/tmp/other")
+	assert.NoError(t, err)
+	assert.Equal(t, "other", string(data))
+}
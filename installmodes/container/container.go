@@ -0,0 +1,111 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package container
+
+import (
+	"fmt"
+	"os/exec"
+	"path"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+func init() {
+	installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "container",
+		CheckRequirements: func() error { return nil },
+		GetObject:         getObject,
+	})
+}
+
+func getObject() interface{} {
+	return &ContainerObject{
+		CmdLineExecuter: &utils.CmdLine{},
+	}
+}
+
+// the container runtimes supported, all of them share the docker
+// command line
+var supportedRuntimes = []string{"docker", "podman"}
+
+// ContainerObject encapsulates the "container" handler data and
+// functions. It loads a container image into the local container
+// runtime and restarts the services that run it.
+type ContainerObject struct {
+	metadata.ObjectMetadata
+	utils.CmdLineExecuter
+
+	Runtime         string   `json:"runtime,omitempty"`
+	Image           string   `json:"image,omitempty"`
+	RestartServices []string `json:"restart-services,omitempty"`
+
+	runtime string // this is NOT obtained from the json but from the "Setup()"
+}
+
+// Setup implementation for the "container" handler
+func (c *ContainerObject) Setup() error {
+	runtime := c.Runtime
+	if runtime == "" {
+		runtime = "docker"
+	}
+
+	supported := false
+	for _, r := range supportedRuntimes {
+		if r == runtime {
+			supported = true
+		}
+	}
+
+	if !supported {
+		return fmt.Errorf("runtime '%s' is not supported for the 'container' handler. Its value must be either 'docker' or 'podman'", runtime)
+	}
+
+	_, err := exec.LookPath(runtime)
+	if err != nil {
+		return err
+	}
+
+	c.runtime = runtime
+
+	return nil
+}
+
+// Install implementation for the "container" handler. The image is
+// pulled from the registry when "image" is set, otherwise the
+// downloaded tarball is loaded. The services are restarted afterwards.
+func (c *ContainerObject) Install(downloadDir string) error {
+	var cmdline string
+	if c.Image != "" {
+		cmdline = fmt.Sprintf("%s pull %s", c.runtime, c.Image)
+	} else {
+		// the runtime decompresses the tarball by itself
+		cmdline = fmt.Sprintf("%s load -i %s", c.runtime, path.Join(downloadDir, c.Sha256sum))
+	}
+
+	_, err := c.Execute(cmdline)
+	if err != nil {
+		return err
+	}
+
+	for _, service := range c.RestartServices {
+		_, err = c.Execute(fmt.Sprintf("systemctl restart %s", service))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Cleanup implementation for the "container" handler
+func (c *ContainerObject) Cleanup() error {
+	return nil
+}
@@ -0,0 +1,165 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package container
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/installmodes/internal/testsutils"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+func setupRuntimesPath(t *testing.T, binaries []string) func() {
+	testPath := testsutils.SetupCheckRequirementsDir(t, binaries)
+
+	oldPath := os.Getenv("PATH")
+	err := os.Setenv("PATH", testPath)
+	assert.NoError(t, err)
+
+	return func() {
+		os.Setenv("PATH", oldPath)
+		os.RemoveAll(testPath)
+	}
+}
+
+func TestContainerInit(t *testing.T) {
+	val, err := installmodes.GetObject("container")
+	assert.NoError(t, err)
+
+	c1, ok := val.(*ContainerObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"installmodes.GetObject()\" to ContainerObject")
+	}
+
+	c2, ok := getObject().(*ContainerObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"getObject()\" to ContainerObject")
+	}
+
+	assert.Equal(t, c2, c1)
+
+	_, ok = c1.CmdLineExecuter.(*utils.CmdLine)
+	if !ok {
+		t.Error("Failed to cast default implementation of \"CmdLineExecuter\" to CmdLine")
+	}
+}
+
+func TestContainerSetup(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Runtime  string
+		Expected string
+	}{
+		{"DefaultRuntime", "", "docker"},
+		{"Docker", "docker", "docker"},
+		{"Podman", "podman", "podman"},
+	}
+
+	restore := setupRuntimesPath(t, []string{"docker", "podman"})
+	defer restore()
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			c := ContainerObject{Runtime: tc.Runtime}
+
+			err := c.Setup()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Expected, c.runtime)
+		})
+	}
+}
+
+func TestContainerSetupWithNotSupportedRuntime(t *testing.T) {
+	c := ContainerObject{Runtime: "rkt"}
+
+	err := c.Setup()
+	assert.EqualError(t, err, "runtime 'rkt' is not supported for the 'container' handler. Its value must be either 'docker' or 'podman'")
+}
+
+func TestContainerSetupWithRuntimeNotFound(t *testing.T) {
+	restore := setupRuntimesPath(t, []string{"docker"})
+	defer restore()
+
+	c := ContainerObject{Runtime: "podman"}
+
+	err := c.Setup()
+	assert.EqualError(t, err, "exec: \"podman\": executable file not found in $PATH")
+}
+
+func TestContainerInstallFromTarball(t *testing.T) {
+	sha256sum := "71c88745e5a72067f94aae0ecec6d45af8b0f6e1a37ef695df0b56711e192b86"
+	downloadDir := "/dummy-download-dir"
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", fmt.Sprintf("docker load -i %s", path.Join(downloadDir, sha256sum))).Return([]byte("Loaded image: app:2.0"), nil)
+	clm.On("Execute", "systemctl restart app").Return([]byte(""), nil)
+	clm.On("Execute", "systemctl restart app-worker").Return([]byte(""), nil)
+
+	c := ContainerObject{CmdLineExecuter: clm, RestartServices: []string{"app", "app-worker"}}
+	c.Sha256sum = sha256sum
+	c.runtime = "docker"
+
+	err := c.Install(downloadDir)
+	assert.NoError(t, err)
+
+	clm.AssertExpectations(t)
+}
+
+func TestContainerInstallFromRegistry(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "podman pull registry.example.com/app:2.0").Return([]byte(""), nil)
+
+	c := ContainerObject{CmdLineExecuter: clm, Image: "registry.example.com/app:2.0"}
+	c.runtime = "podman"
+
+	err := c.Install("/dummy-download-dir")
+	assert.NoError(t, err)
+
+	clm.AssertExpectations(t)
+}
+
+func TestContainerInstallWithLoadFailure(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "docker load -i /dummy-download-dir/sha256sum").Return([]byte("error"), fmt.Errorf("Error executing command"))
+
+	c := ContainerObject{CmdLineExecuter: clm, RestartServices: []string{"app"}}
+	c.Sha256sum = "sha256sum"
+	c.runtime = "docker"
+
+	err := c.Install("/dummy-download-dir")
+	assert.EqualError(t, err, "Error executing command")
+
+	clm.AssertExpectations(t)
+}
+
+func TestContainerInstallWithRestartFailure(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "docker pull app:2.0").Return([]byte(""), nil)
+	clm.On("Execute", "systemctl restart app").Return([]byte("error"), fmt.Errorf("Error executing command"))
+
+	c := ContainerObject{CmdLineExecuter: clm, Image: "app:2.0", RestartServices: []string{"app", "other"}}
+	c.runtime = "docker"
+
+	err := c.Install("/dummy-download-dir")
+	assert.EqualError(t, err, "Error executing command")
+
+	clm.AssertExpectations(t)
+}
+
+func TestContainerCleanupNil(t *testing.T) {
+	c := ContainerObject{}
+	assert.Nil(t, c.Cleanup())
+}
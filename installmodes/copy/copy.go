@@ -15,6 +15,7 @@ import (
 	"github.com/spf13/afero"
 
 	"github.com/UpdateHub/updatehub/copy"
+	"github.com/UpdateHub/updatehub/handlers"
 	"github.com/UpdateHub/updatehub/installifdifferent"
 	"github.com/UpdateHub/updatehub/installmodes"
 	"github.com/UpdateHub/updatehub/libarchive"
@@ -41,7 +42,11 @@ func init() {
 	})
 }
 
-// CopyObject encapsulates the "copy" handler data and functions
+// CopyObject encapsulates the "copy" handler data and functions. The
+// object is written to a temporary file next to the target, which
+// replaces the target only once it's complete and on the disk, so an
+// interrupted install never leaves a half-written target in place.
+// With "sync-target" the target device is also flushed.
 type CopyObject struct {
 	metadata.ObjectMetadata
 	metadata.CompressedObject
@@ -64,6 +69,9 @@ type CopyObject struct {
 	MustFormat    bool        `json:"format?,omitempty"`
 	MountOptions  string      `json:"mount-options,omitempty"`
 	ChunkSize     int         `json:"chunk-size,omitempty"`
+	SyncTarget    bool        `json:"sync-target,omitempty"`
+
+	progress handlers.ProgressFunc
 }
 
 // Setup implementation for the "copy" handler
@@ -105,33 +113,99 @@ func (cp *CopyObject) Install(downloadDir string) error {
 	errorList := []error{}
 
 	sourcePath := path.Join(downloadDir, cp.Sha256sum)
-	err = cp.CopyBackend.CopyFile(cp.FileSystemBackend, cp.LibArchiveBackend, sourcePath, cp.targetPath, cp.ChunkSize, 0, 0, -1, true, cp.Compressed)
+	if cp.progress != nil {
+		copy.NotifyProgress(cp.CopyBackend, cp.progress, cp.sourceSize(sourcePath))
+	}
+
+	tempPath := atomicTempPath(cp.targetPath)
+
+	err = cp.CopyBackend.CopyFile(cp.FileSystemBackend, cp.LibArchiveBackend, sourcePath, tempPath, cp.ChunkSize, 0, 0, -1, true, cp.Compressed)
 	if err != nil {
 		errorList = append(errorList, err)
 	}
 
 	if len(errorList) == 0 {
-		err = cp.Permissions.ApplyChmod(cp.FileSystemBackend, cp.targetPath, cp.TargetMode)
+		// the target replaced keeps its mode and owner, unless they
+		// are set, and its extended attributes
+		err = cp.Permissions.CopyAttributes(cp.FileSystemBackend, cp.targetPath, tempPath, cp.TargetMode == "", cp.TargetUID == nil && cp.TargetGID == nil)
 		if err != nil {
 			errorList = append(errorList, err)
 		}
+	}
 
-		err = cp.Permissions.ApplyChown(cp.targetPath, cp.TargetUID, cp.TargetGID)
+	if len(errorList) == 0 {
+		err = cp.Permissions.ApplyChmod(cp.FileSystemBackend, tempPath, cp.TargetMode)
+		if err != nil {
+			errorList = append(errorList, err)
+		}
+
+		err = cp.Permissions.ApplyChown(tempPath, cp.TargetUID, cp.TargetGID)
 		if err != nil {
 			errorList = append(errorList, err)
 		}
 	}
 
+	if len(errorList) == 0 {
+		err = cp.replaceTarget(tempPath)
+		if err != nil {
+			errorList = append(errorList, err)
+		}
+	}
+
+	if len(errorList) > 0 {
+		cp.FileSystemBackend.Remove(tempPath)
+	}
+
 	umountErr := cp.Umount(tempDirPath)
 	if umountErr != nil {
 		errorList = append(errorList, umountErr)
 	} else {
 		cp.FileSystemBackend.RemoveAll(tempDirPath)
+
+		if cp.SyncTarget && len(errorList) == 0 {
+			err = syncFile(cp.FileSystemBackend, cp.Target)
+			if err != nil {
+				errorList = append(errorList, err)
+			}
+		}
 	}
 
 	return utils.MergeErrorList(errorList)
 }
 
+// replaceTarget renames the complete "tempPath" over the target, the
+// data and the rename itself are flushed to the disk
+func (cp *CopyObject) replaceTarget(tempPath string) error {
+	err := syncFile(cp.FileSystemBackend, tempPath)
+	if err != nil {
+		return err
+	}
+
+	err = cp.FileSystemBackend.Rename(tempPath, cp.targetPath)
+	if err != nil {
+		return err
+	}
+
+	return syncFile(cp.FileSystemBackend, path.Dir(cp.targetPath))
+}
+
+// atomicTempPath returns the temporary file "target" is written to,
+// which is at the same directory so it can be renamed over it
+func atomicTempPath(target string) string {
+	return path.Join(path.Dir(target), "."+path.Base(target)+".updatehub-tmp")
+}
+
+// syncFile flushes the file, directory or device at "name" to the disk
+func syncFile(fs afero.Fs, name string) error {
+	file, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
 // Cleanup implementation for the "copy" handler
 func (cp *CopyObject) Cleanup() error {
 	return nil
@@ -141,3 +215,29 @@ func (cp *CopyObject) Cleanup() error {
 func (cp *CopyObject) GetTarget() string {
 	return cp.targetPath
 }
+
+// Idempotent implementation for the "copy" handler, the target file is
+// overwritten
+func (cp *CopyObject) Idempotent() bool {
+	return true
+}
+
+// SetProgressFunc implementation for the "copy" handler
+func (cp *CopyObject) SetProgressFunc(fn handlers.ProgressFunc) {
+	cp.progress = fn
+}
+
+// sourceSize returns the size of the data that will be written to
+// the target or 0 when it is unknown
+func (cp *CopyObject) sourceSize(sourcePath string) int64 {
+	if cp.Compressed {
+		return int64(cp.UncompressedSize)
+	}
+
+	info, err := cp.FileSystemBackend.Stat(sourcePath)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
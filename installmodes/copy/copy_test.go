@@ -10,6 +10,7 @@ package copy
 
 import (
 	"fmt"
+	"os"
 	"path"
 	"testing"
 
@@ -23,6 +24,7 @@ import (
 	"github.com/UpdateHub/updatehub/utils"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func TestCopyInit(t *testing.T) {
@@ -175,7 +177,7 @@ func TestCopyInstallWithCopyFileError(t *testing.T) {
 	downloadDir := "/dummy-download-dir"
 
 	cm := &copymock.CopyMock{}
-	cm.On("CopyFile", memFs, lam, path.Join(downloadDir, sha256sum), path.Join(tempDirPath, targetPath), 128*1024, 0, 0, -1, true, compressed).Return(fmt.Errorf("copy file error"))
+	cm.On("CopyFile", memFs, lam, path.Join(downloadDir, sha256sum), atomicTempPath(path.Join(tempDirPath, targetPath)), 128*1024, 0, 0, -1, true, compressed).Return(fmt.Errorf("copy file error"))
 
 	cp := CopyObject{
 		FileSystemHelper:  fsm,
@@ -232,11 +234,16 @@ func TestCopyInstallWithUmountError(t *testing.T) {
 	downloadDir := "/dummy-download-dir"
 
 	cm := &copymock.CopyMock{}
-	cm.On("CopyFile", memFs, lam, path.Join(downloadDir, sha256sum), path.Join(tempDirPath, targetPath), 128*1024, 0, 0, -1, true, compressed).Return(nil)
+	cm.On("CopyFile", memFs, lam, path.Join(downloadDir, sha256sum), atomicTempPath(path.Join(tempDirPath, targetPath)), 128*1024, 0, 0, -1, true, compressed).Return(nil)
+
+	// written by "CopyFile"
+	err = afero.WriteFile(memFs, atomicTempPath(path.Join(tempDirPath, targetPath)), []byte("content"), 0644)
+	assert.NoError(t, err)
 
 	pm := &permissionsmock.PermissionsMock{}
-	pm.On("ApplyChmod", memFs, path.Join(tempDirPath, targetPath), mode).Return(nil)
-	pm.On("ApplyChown", path.Join(tempDirPath, targetPath), uid, gid).Return(nil)
+	pm.On("CopyAttributes", memFs, path.Join(tempDirPath, targetPath), atomicTempPath(path.Join(tempDirPath, targetPath)), false, false).Return(nil)
+	pm.On("ApplyChmod", memFs, atomicTempPath(path.Join(tempDirPath, targetPath)), mode).Return(nil)
+	pm.On("ApplyChown", atomicTempPath(path.Join(tempDirPath, targetPath)), uid, gid).Return(nil)
 
 	cp := CopyObject{
 		FileSystemHelper:  fsm,
@@ -270,6 +277,151 @@ func TestCopyInstallWithUmountError(t *testing.T) {
 
 	expectedTargetPath := path.Join(tempDirPath, targetPath)
 	assert.Equal(t, expectedTargetPath, cp.GetTarget())
+
+	// the target was replaced before the umount
+	data, err := afero.ReadFile(memFs, expectedTargetPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+
+	tempExists, err := afero.Exists(memFs, atomicTempPath(expectedTargetPath))
+	assert.False(t, tempExists)
+	assert.NoError(t, err)
+}
+
+func TestCopyInstallWithSyncTarget(t *testing.T) {
+	testCases := []struct {
+		Name          string
+		DeviceExists  bool
+		ExpectedError string
+	}{
+		{"DeviceExists", true, ""},
+		{"DeviceNotFound", false, "open /dev/xx1: file does not exist"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			memFs := afero.NewMemMapFs()
+			lam := &libarchivemock.LibArchiveMock{}
+
+			if tc.DeviceExists {
+				err := afero.WriteFile(memFs, "/dev/xx1", nil, 0644)
+				assert.NoError(t, err)
+			}
+
+			tempDirPath, err := afero.TempDir(memFs, "", "copy-handler")
+			assert.NoError(t, err)
+
+			targetPath := path.Join(tempDirPath, "/inner-path")
+
+			var installed string
+
+			fsm := &filesystemmock.FileSystemHelperMock{}
+			fsm.On("TempDir", memFs, "copy-handler").Return(tempDirPath, nil)
+			fsm.On("Mount", "/dev/xx1", tempDirPath, "ext4", "").Return(nil)
+			fsm.On("Umount", tempDirPath).Run(func(args mock.Arguments) {
+				data, err := afero.ReadFile(memFs, targetPath)
+				assert.NoError(t, err)
+				installed = string(data)
+
+				tempExists, err := afero.Exists(memFs, atomicTempPath(targetPath))
+				assert.False(t, tempExists)
+				assert.NoError(t, err)
+			}).Return(nil)
+
+			cm := &copymock.CopyMock{}
+			cm.On("CopyFile", memFs, lam, "/dummy-download-dir/sha256sum", atomicTempPath(targetPath), 128*1024, 0, 0, -1, true, false).Run(func(args mock.Arguments) {
+				err := afero.WriteFile(memFs, atomicTempPath(targetPath), []byte("content"), 0644)
+				assert.NoError(t, err)
+			}).Return(nil)
+
+			pm := &permissionsmock.PermissionsMock{}
+			pm.On("CopyAttributes", memFs, targetPath, atomicTempPath(targetPath), true, true).Return(nil)
+			pm.On("ApplyChmod", memFs, atomicTempPath(targetPath), "").Return(nil)
+			pm.On("ApplyChown", atomicTempPath(targetPath), nil, nil).Return(nil)
+
+			cp := CopyObject{
+				FileSystemHelper:  fsm,
+				CopyBackend:       cm,
+				Permissions:       pm,
+				FileSystemBackend: memFs,
+				LibArchiveBackend: lam,
+				ChunkSize:         128 * 1024,
+				SyncTarget:        true,
+			}
+			cp.Target = "/dev/xx1"
+			cp.TargetPath = "/inner-path"
+			cp.FSType = "ext4"
+			cp.Sha256sum = "sha256sum"
+
+			err = cp.Install("/dummy-download-dir")
+			if tc.ExpectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.ExpectedError)
+			}
+
+			assert.Equal(t, "content", installed)
+
+			fsm.AssertExpectations(t)
+			cm.AssertExpectations(t)
+			pm.AssertExpectations(t)
+		})
+	}
+}
+
+func TestCopyInstallKeepsTheTargetAttributes(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	lam := &libarchivemock.LibArchiveMock{}
+
+	tempDirPath, err := afero.TempDir(memFs, "", "copy-handler")
+	assert.NoError(t, err)
+
+	targetPath := path.Join(tempDirPath, "/inner-path")
+
+	err = afero.WriteFile(memFs, targetPath, []byte("previous"), 0600)
+	assert.NoError(t, err)
+
+	var installedMode os.FileMode
+
+	fsm := &filesystemmock.FileSystemHelperMock{}
+	fsm.On("TempDir", memFs, "copy-handler").Return(tempDirPath, nil)
+	fsm.On("Mount", "/dev/xx1", tempDirPath, "ext4", "").Return(nil)
+	fsm.On("Umount", tempDirPath).Run(func(args mock.Arguments) {
+		fi, err := memFs.Stat(targetPath)
+		assert.NoError(t, err)
+		installedMode = fi.Mode()
+	}).Return(nil)
+
+	cm := &copymock.CopyMock{}
+	cm.On("CopyFile", memFs, lam, "/dummy-download-dir/sha256sum", atomicTempPath(targetPath), 128*1024, 0, 0, -1, true, false).Run(func(args mock.Arguments) {
+		err := afero.WriteFile(memFs, atomicTempPath(targetPath), []byte("content"), 0644)
+		assert.NoError(t, err)
+	}).Return(nil)
+
+	cp := CopyObject{
+		FileSystemHelper:  fsm,
+		CopyBackend:       cm,
+		Permissions:       &utils.PermissionsDefaultImpl{},
+		FileSystemBackend: memFs,
+		LibArchiveBackend: lam,
+		ChunkSize:         128 * 1024,
+	}
+	cp.Target = "/dev/xx1"
+	cp.TargetPath = "/inner-path"
+	cp.FSType = "ext4"
+	cp.Sha256sum = "sha256sum"
+
+	err = cp.Install("/dummy-download-dir")
+	assert.NoError(t, err)
+
+	assert.Equal(t, os.FileMode(0600), installedMode)
+
+	fsm.AssertExpectations(t)
+	cm.AssertExpectations(t)
+}
+
+func TestAtomicTempPath(t *testing.T) {
+	assert.Equal(t, "/tmp/mnt/etc/.app.conf.updatehub-tmp", atomicTempPath("/tmp/mnt/etc/app.conf"))
 }
 
 func TestCopyInstallWithCopyFileANDUmountErrors(t *testing.T) {
@@ -294,7 +446,7 @@ func TestCopyInstallWithCopyFileANDUmountErrors(t *testing.T) {
 	downloadDir := "/dummy-download-dir"
 
 	cm := &copymock.CopyMock{}
-	cm.On("CopyFile", memFs, lam, path.Join(downloadDir, sha256sum), path.Join(tempDirPath, targetPath), 128*1024, 0, 0, -1, true, compressed).Return(fmt.Errorf("copy file error"))
+	cm.On("CopyFile", memFs, lam, path.Join(downloadDir, sha256sum), atomicTempPath(path.Join(tempDirPath, targetPath)), 128*1024, 0, 0, -1, true, compressed).Return(fmt.Errorf("copy file error"))
 
 	cp := CopyObject{
 		FileSystemHelper:  fsm,
@@ -351,11 +503,12 @@ func TestCopyInstallWithChmodAndChownErrors(t *testing.T) {
 	downloadDir := "/dummy-download-dir"
 
 	cm := &copymock.CopyMock{}
-	cm.On("CopyFile", memFs, lam, path.Join(downloadDir, sha256sum), path.Join(tempDirPath, targetPath), 128*1024, 0, 0, -1, true, compressed).Return(nil)
+	cm.On("CopyFile", memFs, lam, path.Join(downloadDir, sha256sum), atomicTempPath(path.Join(tempDirPath, targetPath)), 128*1024, 0, 0, -1, true, compressed).Return(nil)
 
 	pm := &permissionsmock.PermissionsMock{}
-	pm.On("ApplyChmod", memFs, path.Join(tempDirPath, targetPath), mode).Return(fmt.Errorf("chmod error"))
-	pm.On("ApplyChown", path.Join(tempDirPath, targetPath), uid, gid).Return(fmt.Errorf("chown error"))
+	pm.On("CopyAttributes", memFs, path.Join(tempDirPath, targetPath), atomicTempPath(path.Join(tempDirPath, targetPath)), false, false).Return(nil)
+	pm.On("ApplyChmod", memFs, atomicTempPath(path.Join(tempDirPath, targetPath)), mode).Return(fmt.Errorf("chmod error"))
+	pm.On("ApplyChown", atomicTempPath(path.Join(tempDirPath, targetPath)), uid, gid).Return(fmt.Errorf("chown error"))
 
 	cp := CopyObject{
 		FileSystemHelper:  fsm,
@@ -494,11 +647,16 @@ func TestCopyInstallWithSuccess(t *testing.T) {
 			downloadDir := "/dummy-download-dir"
 
 			cm := &copymock.CopyMock{}
-			cm.On("CopyFile", memFs, lam, path.Join(downloadDir, tc.Sha256sum), path.Join(tempDirPath, tc.TargetPath), tc.ChunkSize, 0, 0, -1, true, tc.Compressed).Return(nil)
+			cm.On("CopyFile", memFs, lam, path.Join(downloadDir, tc.Sha256sum), atomicTempPath(path.Join(tempDirPath, tc.TargetPath)), tc.ChunkSize, 0, 0, -1, true, tc.Compressed).Return(nil)
+
+			// written by "CopyFile"
+			err = afero.WriteFile(memFs, atomicTempPath(path.Join(tempDirPath, tc.TargetPath)), []byte("content"), 0644)
+			assert.NoError(t, err)
 
 			pm := &permissionsmock.PermissionsMock{}
-			pm.On("ApplyChmod", memFs, path.Join(tempDirPath, tc.TargetPath), tc.TargetMode).Return(nil)
-			pm.On("ApplyChown", path.Join(tempDirPath, tc.TargetPath), tc.TargetUID, tc.TargetGID).Return(nil)
+			pm.On("CopyAttributes", memFs, path.Join(tempDirPath, tc.TargetPath), atomicTempPath(path.Join(tempDirPath, tc.TargetPath)), tc.TargetMode == "", tc.TargetUID == nil && tc.TargetGID == nil).Return(nil)
+			pm.On("ApplyChmod", memFs, atomicTempPath(path.Join(tempDirPath, tc.TargetPath)), tc.TargetMode).Return(nil)
+			pm.On("ApplyChown", atomicTempPath(path.Join(tempDirPath, tc.TargetPath)), tc.TargetUID, tc.TargetGID).Return(nil)
 
 			cp := CopyObject{
 				FileSystemHelper:  fsm,
@@ -0,0 +1,211 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package delta
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/copy"
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/libarchive"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// patchedSuffix is appended to the name of the patch to get the name
+// of the reconstructed image, which must not be taken for an object
+const patchedSuffix = ".patched"
+
+var patchBinaries = map[string]string{
+	"bsdiff": "bspatch",
+	"xdelta": "xdelta3",
+}
+
+func init() {
+	installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "delta",
+		CheckRequirements: checkRequirements,
+		GetObject:         getObject,
+	})
+}
+
+func checkRequirements() error {
+	var err error
+
+	// only one of the patch formats must be available
+	for _, binary := range patchBinaries {
+		_, err = exec.LookPath(binary)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func getObject() interface{} {
+	return &DeltaObject{
+		CmdLineExecuter:   &utils.CmdLine{},
+		CopyBackend:       &copy.ExtendedIO{},
+		LibArchiveBackend: &libarchive.LibArchive{},
+		FileSystemBackend: afero.NewOsFs(),
+		Format:            "bsdiff",
+		ChunkSize:         128 * 1024,
+	}
+}
+
+// DeltaObject encapsulates the "delta" handler data and functions
+type DeltaObject struct {
+	metadata.ObjectMetadata
+	utils.CmdLineExecuter
+	CopyBackend       copy.Interface `json:"-"`
+	LibArchiveBackend libarchive.API `json:"-"`
+	FileSystemBackend afero.Fs
+	patchedPath       string
+
+	Target          string `json:"target"`
+	TargetType      string `json:"target-type"`
+	TargetSha256sum string `json:"target-sha256sum"`
+	Source          string `json:"source,omitempty"` // defaults to "target"
+	SourceSha256sum string `json:"source-sha256sum"`
+	SourceSize      int64  `json:"source-size,omitempty"` // the whole source when 0
+	Format          string `json:"format,omitempty"`
+	ChunkSize       int    `json:"chunk-size,omitempty"`
+}
+
+// Setup implementation for the "delta" handler
+func (d *DeltaObject) Setup() error {
+	if d.TargetType != "device" {
+		return fmt.Errorf("target-type '%s' is not supported for the 'delta' handler. Its value must be 'device'", d.TargetType)
+	}
+
+	if _, ok := patchBinaries[d.Format]; !ok {
+		return fmt.Errorf("format '%s' is not supported for the 'delta' handler. Its value must be 'bsdiff' or 'xdelta'", d.Format)
+	}
+
+	if d.SourceSha256sum == "" || d.TargetSha256sum == "" {
+		return fmt.Errorf("the 'delta' handler requires both 'source-sha256sum' and 'target-sha256sum'")
+	}
+
+	if d.SourceSize < 0 {
+		return fmt.Errorf("source-size '%d' is not supported for the 'delta' handler. Its value must not be negative", d.SourceSize)
+	}
+
+	return nil
+}
+
+// Install implementation for the "delta" handler. It reconstructs the
+// new image from the currently installed one and the downloaded
+// patch, verifies it and then writes it to the target. Only the first
+// "source-size" bytes of the source are verified, since a partition is
+// usually larger than the image written to it.
+func (d *DeltaObject) Install(downloadDir string) (err error) {
+	source := d.Source
+	if source == "" {
+		source = d.Target
+	}
+
+	err = checkSha256sum(d.FileSystemBackend, source, d.SourceSize, d.SourceSha256sum)
+	if err != nil {
+		return fmt.Errorf("the installed image can't be patched: %s", err)
+	}
+
+	patchPath := path.Join(downloadDir, d.Sha256sum)
+	d.patchedPath = patchPath + patchedSuffix
+
+	defer func() {
+		if err != nil {
+			// the patch tool may have left a partial image behind
+			_ = d.FileSystemBackend.Remove(d.patchedPath)
+			d.patchedPath = ""
+		}
+	}()
+
+	_, err = d.Execute(cmdlineForPatch(d.Format, source, patchPath, d.patchedPath))
+	if err != nil {
+		return err
+	}
+
+	err = checkSha256sum(d.FileSystemBackend, d.patchedPath, 0, d.TargetSha256sum)
+	if err != nil {
+		return fmt.Errorf("the reconstructed image is invalid: %s", err)
+	}
+
+	return d.CopyBackend.CopyFile(d.FileSystemBackend, d.LibArchiveBackend, d.patchedPath, d.Target, d.ChunkSize, 0, 0, -1, true, false)
+}
+
+// Cleanup implementation for the "delta" handler
+func (d *DeltaObject) Cleanup() error {
+	if d.patchedPath == "" {
+		return nil
+	}
+
+	err := d.FileSystemBackend.Remove(d.patchedPath)
+	if err != nil {
+		return err
+	}
+
+	d.patchedPath = ""
+
+	return nil
+}
+
+// GetTarget implementation for the "delta" handler
+func (d *DeltaObject) GetTarget() string {
+	return d.Target
+}
+
+func cmdlineForPatch(format string, source string, patch string, output string) string {
+	switch format {
+	case "xdelta":
+		return fmt.Sprintf("xdelta3 -d -f -s %s %s %s", source, patch, output)
+	}
+
+	return fmt.Sprintf("bspatch %s %s %s", source, output, patch)
+}
+
+// checkSha256sum verifies the first "size" bytes of "filePath", or
+// the whole file when "size" is 0
+func checkSha256sum(fsb afero.Fs, filePath string, size int64, expectedSha256sum string) error {
+	file, err := fsb.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+
+	if size > 0 {
+		_, err = io.CopyN(hash, file, size)
+		if err == io.EOF {
+			return fmt.Errorf("'%s' is smaller than %d bytes", filePath, size)
+		}
+	} else {
+		_, err = io.Copy(hash, file)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	calculatedSha256sum := hex.EncodeToString(hash.Sum(nil))
+
+	if calculatedSha256sum != expectedSha256sum {
+		return fmt.Errorf("sha256sum's don't match. Expected: %s / Calculated: %s", expectedSha256sum, calculatedSha256sum)
+	}
+
+	return nil
+}
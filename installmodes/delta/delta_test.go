@@ -0,0 +1,381 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package delta
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/installmodes/internal/testsutils"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+	"github.com/UpdateHub/updatehub/testsmocks/copymock"
+	"github.com/UpdateHub/updatehub/testsmocks/libarchivemock"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+const (
+	downloadDir   = "/download-dir"
+	targetDevice  = "/dev/xx1"
+	patchSha256   = "5bdbf286cb4adcff26befa2183f3167c053bc565036736eaa2ae429fe910d93c"
+	sourceContent = "old image"
+	targetContent = "new image"
+)
+
+func newTestDeltaObject(fs afero.Fs, clm *cmdlinemock.CmdLineExecuterMock, cm *copymock.CopyMock, lam *libarchivemock.LibArchiveMock) *DeltaObject {
+	d := &DeltaObject{
+		CmdLineExecuter:   clm,
+		CopyBackend:       cm,
+		LibArchiveBackend: lam,
+		FileSystemBackend: fs,
+		Target:            targetDevice,
+		TargetType:        "device",
+		TargetSha256sum:   utils.DataSha256sum([]byte(targetContent)),
+		SourceSha256sum:   utils.DataSha256sum([]byte(sourceContent)),
+		Format:            "bsdiff",
+		ChunkSize:         128 * 1024,
+	}
+	d.Sha256sum = patchSha256
+
+	return d
+}
+
+func TestDeltaInit(t *testing.T) {
+	val, err := installmodes.GetObject("delta")
+	assert.NoError(t, err)
+
+	d1, ok := val.(*DeltaObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"installmodes.GetObject()\" to DeltaObject")
+	}
+
+	d2, ok := getObject().(*DeltaObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"getObject()\" to DeltaObject")
+	}
+
+	assert.Equal(t, d2, d1)
+	assert.Equal(t, "bsdiff", d1.Format)
+}
+
+func TestDeltaCheckRequirements(t *testing.T) {
+	for format, binary := range patchBinaries {
+		t.Run(format, func(t *testing.T) {
+			testPath := testsutils.SetupCheckRequirementsDir(t, []string{binary})
+			defer os.RemoveAll(testPath)
+
+			path := os.Getenv("PATH")
+			defer os.Setenv("PATH", path)
+			os.Setenv("PATH", testPath)
+
+			err := checkRequirements()
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestDeltaCheckRequirementsWithBinariesNotFound(t *testing.T) {
+	testPath := testsutils.SetupCheckRequirementsDir(t, []string{})
+	defer os.RemoveAll(testPath)
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", testPath)
+
+	err := checkRequirements()
+	assert.Error(t, err)
+}
+
+func TestDeltaSetup(t *testing.T) {
+	testCases := []struct {
+		Name          string
+		TargetType    string
+		Format        string
+		SourceSha256  string
+		SourceSize    int64
+		ExpectedError error
+	}{
+		{
+			"WithSuccess",
+			"device",
+			"xdelta",
+			"sourcesha256",
+			1024,
+			nil,
+		},
+		{
+			"WithNotSupportedTargetType",
+			"ubivolume",
+			"bsdiff",
+			"sourcesha256",
+			0,
+			fmt.Errorf("target-type 'ubivolume' is not supported for the 'delta' handler. Its value must be 'device'"),
+		},
+		{
+			"WithNotSupportedFormat",
+			"device",
+			"vcdiff",
+			"sourcesha256",
+			0,
+			fmt.Errorf("format 'vcdiff' is not supported for the 'delta' handler. Its value must be 'bsdiff' or 'xdelta'"),
+		},
+		{
+			"WithoutSourceSha256sum",
+			"device",
+			"bsdiff",
+			"",
+			0,
+			fmt.Errorf("the 'delta' handler requires both 'source-sha256sum' and 'target-sha256sum'"),
+		},
+		{
+			"WithNegativeSourceSize",
+			"device",
+			"bsdiff",
+			"sourcesha256",
+			-1,
+			fmt.Errorf("source-size '-1' is not supported for the 'delta' handler. Its value must not be negative"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			d := DeltaObject{
+				TargetType:      tc.TargetType,
+				Format:          tc.Format,
+				SourceSha256sum: tc.SourceSha256,
+				SourceSize:      tc.SourceSize,
+				TargetSha256sum: "targetsha256",
+			}
+
+			err := d.Setup()
+			assert.Equal(t, tc.ExpectedError, err)
+		})
+	}
+}
+
+func TestDeltaInstallWithSuccess(t *testing.T) {
+	testCases := []struct {
+		Name            string
+		Format          string
+		Source          string
+		SourceSize      int64
+		SourceContent   string
+		ExpectedCmdline string
+	}{
+		{
+			"WithBsdiff",
+			"bsdiff",
+			"",
+			0,
+			sourceContent,
+			fmt.Sprintf("bspatch %s %s %s", targetDevice, path.Join(downloadDir, patchSha256+patchedSuffix), path.Join(downloadDir, patchSha256)),
+		},
+		{
+			"WithXdeltaAndSource",
+			"xdelta",
+			"/dev/xx2",
+			0,
+			sourceContent,
+			fmt.Sprintf("xdelta3 -d -f -s /dev/xx2 %s %s", path.Join(downloadDir, patchSha256), path.Join(downloadDir, patchSha256+patchedSuffix)),
+		},
+		{
+			"WithSourceLargerThanSourceSize",
+			"bsdiff",
+			"",
+			int64(len(sourceContent)),
+			sourceContent + "trailing partition data",
+			fmt.Sprintf("bspatch %s %s %s", targetDevice, path.Join(downloadDir, patchSha256+patchedSuffix), path.Join(downloadDir, patchSha256)),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+			cm := &copymock.CopyMock{}
+			lam := &libarchivemock.LibArchiveMock{}
+
+			d := newTestDeltaObject(fs, clm, cm, lam)
+			d.Format = tc.Format
+			d.Source = tc.Source
+			d.SourceSize = tc.SourceSize
+
+			source := d.Source
+			if source == "" {
+				source = d.Target
+			}
+
+			err := afero.WriteFile(fs, source, []byte(tc.SourceContent), 0666)
+			assert.NoError(t, err)
+
+			patchedPath := path.Join(downloadDir, patchSha256+patchedSuffix)
+
+			clm.On("Execute", tc.ExpectedCmdline).Return([]byte(""), nil).Run(func(args mock.Arguments) {
+				afero.WriteFile(fs, patchedPath, []byte(targetContent), 0666)
+			})
+			cm.On("CopyFile", fs, lam, patchedPath, targetDevice, 128*1024, 0, 0, -1, true, false).Return(nil)
+
+			err = d.Install(downloadDir)
+			assert.NoError(t, err)
+
+			err = d.Cleanup()
+			assert.NoError(t, err)
+
+			exists, err := afero.Exists(fs, patchedPath)
+			assert.NoError(t, err)
+			assert.False(t, exists)
+
+			assert.Equal(t, targetDevice, d.GetTarget())
+
+			clm.AssertExpectations(t)
+			cm.AssertExpectations(t)
+			lam.AssertExpectations(t)
+		})
+	}
+}
+
+func TestDeltaInstallWithSourceSha256sumMismatch(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	cm := &copymock.CopyMock{}
+	lam := &libarchivemock.LibArchiveMock{}
+
+	d := newTestDeltaObject(fs, clm, cm, lam)
+
+	err := afero.WriteFile(fs, targetDevice, []byte("another image"), 0666)
+	assert.NoError(t, err)
+
+	err = d.Install(downloadDir)
+	assert.EqualError(t, err, fmt.Sprintf("the installed image can't be patched: sha256sum's don't match. Expected: %s / Calculated: %s", d.SourceSha256sum, utils.DataSha256sum([]byte("another image"))))
+
+	clm.AssertExpectations(t)
+	cm.AssertExpectations(t)
+	lam.AssertExpectations(t)
+}
+
+func TestDeltaInstallWithSourceSmallerThanSourceSize(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	cm := &copymock.CopyMock{}
+	lam := &libarchivemock.LibArchiveMock{}
+
+	d := newTestDeltaObject(fs, clm, cm, lam)
+	d.SourceSize = int64(len(sourceContent)) + 1
+
+	err := afero.WriteFile(fs, targetDevice, []byte(sourceContent), 0666)
+	assert.NoError(t, err)
+
+	err = d.Install(downloadDir)
+	assert.EqualError(t, err, fmt.Sprintf("the installed image can't be patched: '%s' is smaller than %d bytes", targetDevice, d.SourceSize))
+
+	clm.AssertExpectations(t)
+	cm.AssertExpectations(t)
+	lam.AssertExpectations(t)
+}
+
+func TestDeltaInstallWithPatchError(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	cm := &copymock.CopyMock{}
+	lam := &libarchivemock.LibArchiveMock{}
+
+	d := newTestDeltaObject(fs, clm, cm, lam)
+
+	err := afero.WriteFile(fs, targetDevice, []byte(sourceContent), 0666)
+	assert.NoError(t, err)
+
+	patchedPath := path.Join(downloadDir, patchSha256+patchedSuffix)
+
+	clm.On("Execute", mock.Anything).Return([]byte(""), fmt.Errorf("bspatch error")).Run(func(args mock.Arguments) {
+		afero.WriteFile(fs, patchedPath, []byte("partial"), 0666)
+	})
+
+	err = d.Install(downloadDir)
+	assert.EqualError(t, err, "bspatch error")
+
+	exists, err := afero.Exists(fs, patchedPath)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	clm.AssertExpectations(t)
+	cm.AssertExpectations(t)
+	lam.AssertExpectations(t)
+}
+
+func TestDeltaInstallWithReconstructedImageMismatch(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	cm := &copymock.CopyMock{}
+	lam := &libarchivemock.LibArchiveMock{}
+
+	d := newTestDeltaObject(fs, clm, cm, lam)
+
+	err := afero.WriteFile(fs, targetDevice, []byte(sourceContent), 0666)
+	assert.NoError(t, err)
+
+	patchedPath := path.Join(downloadDir, patchSha256+patchedSuffix)
+
+	clm.On("Execute", mock.Anything).Return([]byte(""), nil).Run(func(args mock.Arguments) {
+		afero.WriteFile(fs, patchedPath, []byte("corrupted image"), 0666)
+	})
+
+	err = d.Install(downloadDir)
+	assert.EqualError(t, err, fmt.Sprintf("the reconstructed image is invalid: sha256sum's don't match. Expected: %s / Calculated: %s", d.TargetSha256sum, utils.DataSha256sum([]byte("corrupted image"))))
+
+	exists, err := afero.Exists(fs, patchedPath)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	clm.AssertExpectations(t)
+	cm.AssertExpectations(t)
+	lam.AssertExpectations(t)
+}
+
+func TestDeltaInstallWithCopyFileError(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	cm := &copymock.CopyMock{}
+	lam := &libarchivemock.LibArchiveMock{}
+
+	d := newTestDeltaObject(fs, clm, cm, lam)
+
+	err := afero.WriteFile(fs, targetDevice, []byte(sourceContent), 0666)
+	assert.NoError(t, err)
+
+	patchedPath := path.Join(downloadDir, patchSha256+patchedSuffix)
+
+	clm.On("Execute", mock.Anything).Return([]byte(""), nil).Run(func(args mock.Arguments) {
+		afero.WriteFile(fs, patchedPath, []byte(targetContent), 0666)
+	})
+	cm.On("CopyFile", fs, lam, patchedPath, targetDevice, 128*1024, 0, 0, -1, true, false).Return(fmt.Errorf("copy file error"))
+
+	err = d.Install(downloadDir)
+	assert.EqualError(t, err, "copy file error")
+
+	exists, err := afero.Exists(fs, patchedPath)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	clm.AssertExpectations(t)
+	cm.AssertExpectations(t)
+	lam.AssertExpectations(t)
+}
+
+func TestDeltaCleanupWithoutInstall(t *testing.T) {
+	d := DeltaObject{}
+
+	err := d.Cleanup()
+	assert.NoError(t, err)
+}
@@ -0,0 +1,183 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package eficapsule
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/copy"
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/libarchive"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+func init() {
+	installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "efi-capsule",
+		CheckRequirements: func() error { return nil },
+		GetObject:         getObject,
+	})
+}
+
+func getObject() interface{} {
+	return &EfiCapsuleObject{
+		CmdLineExecuter:   &utils.CmdLine{},
+		LibArchiveBackend: &libarchive.LibArchive{},
+		FileSystemBackend: afero.NewOsFs(),
+		CopyBackend:       &copy.ExtendedIO{},
+		ChunkSize:         128 * 1024,
+	}
+}
+
+const (
+	efivarsDir = "/sys/firmware/efi/efivars"
+
+	// the variables are defined by the EFI_GLOBAL_VARIABLE GUID
+	osIndicationsVariable          = "OsIndications-8be4df61-93ca-11d2-aa0d-00e098032b8c"
+	osIndicationsSupportedVariable = "OsIndicationsSupported-8be4df61-93ca-11d2-aa0d-00e098032b8c"
+
+	// EFI_OS_INDICATIONS_FILE_CAPSULE_DELIVERY_SUPPORTED
+	fileCapsuleDelivery = uint64(0x04)
+
+	// EFI_VARIABLE_NON_VOLATILE | EFI_VARIABLE_BOOTSERVICE_ACCESS | EFI_VARIABLE_RUNTIME_ACCESS
+	osIndicationsAttributes = uint32(0x07)
+
+	defaultEspPath  = "/boot/efi"
+	defaultFilename = "updatehub.cap"
+)
+
+// EfiCapsuleObject encapsulates the "efi-capsule" handler data and
+// functions. It stages an UEFI capsule at the EFI System Partition and
+// asks the firmware to process it on the next boot.
+type EfiCapsuleObject struct {
+	metadata.ObjectMetadata
+	metadata.CompressedObject
+	utils.CmdLineExecuter
+	LibArchiveBackend libarchive.API `json:"-"`
+	FileSystemBackend afero.Fs
+	CopyBackend       copy.Interface `json:"-"`
+
+	EspPath   string `json:"esp-path,omitempty"`
+	Filename  string `json:"filename,omitempty"`
+	ChunkSize int    `json:"chunk-size,omitempty"`
+}
+
+// Setup implementation for the "efi-capsule" handler. It checks the
+// firmware supports the capsules delivered on disk.
+func (e *EfiCapsuleObject) Setup() error {
+	if e.EspPath == "" {
+		e.EspPath = defaultEspPath
+	}
+
+	if e.Filename == "" {
+		e.Filename = defaultFilename
+	}
+
+	if path.Base(e.Filename) != e.Filename {
+		return fmt.Errorf("filename '%s' must not have a directory for the 'efi-capsule' handler", e.Filename)
+	}
+
+	supported, err := e.readVariable(osIndicationsSupportedVariable)
+	if err != nil {
+		return fmt.Errorf("failed to read the UEFI OS indications supported: %s", err)
+	}
+
+	if supported&fileCapsuleDelivery == 0 {
+		return fmt.Errorf("the firmware doesn't support capsules delivered on disk")
+	}
+
+	return nil
+}
+
+// Install implementation for the "efi-capsule" handler
+func (e *EfiCapsuleObject) Install(downloadDir string) error {
+	capsuleDir := path.Join(e.EspPath, "EFI", "UpdateCapsule")
+
+	err := e.FileSystemBackend.MkdirAll(capsuleDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	sourcePath := path.Join(downloadDir, e.Sha256sum)
+
+	err = e.CopyBackend.CopyFile(e.FileSystemBackend, e.LibArchiveBackend, sourcePath, path.Join(capsuleDir, e.Filename), e.ChunkSize, 0, 0, -1, true, e.Compressed)
+	if err != nil {
+		return err
+	}
+
+	indications, err := e.readVariable(osIndicationsVariable)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return e.writeVariable(osIndicationsVariable, indications|fileCapsuleDelivery)
+}
+
+// Cleanup implementation for the "efi-capsule" handler
+func (e *EfiCapsuleObject) Cleanup() error {
+	return nil
+}
+
+// GetTarget implementation for the "efi-capsule" handler
+func (e *EfiCapsuleObject) GetTarget() string {
+	return path.Join(e.EspPath, "EFI", "UpdateCapsule", e.Filename)
+}
+
+// readVariable returns the value of an UINT64 UEFI variable, the
+// efivarfs files start with the 4 bytes of the attributes
+func (e *EfiCapsuleObject) readVariable(name string) (uint64, error) {
+	data, err := afero.ReadFile(e.FileSystemBackend, path.Join(efivarsDir, name))
+	if err != nil {
+		return 0, err
+	}
+
+	if len(data) != 12 {
+		return 0, fmt.Errorf("UEFI variable '%s' has an unexpected size: %d bytes", name, len(data))
+	}
+
+	return binary.LittleEndian.Uint64(data[4:]), nil
+}
+
+func (e *EfiCapsuleObject) writeVariable(name string, value uint64) error {
+	variablePath := path.Join(efivarsDir, name)
+
+	// the kernel makes the existing variables immutable
+	exists, err := afero.Exists(e.FileSystemBackend, variablePath)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		_, err = e.Execute(fmt.Sprintf("chattr -i %s", variablePath))
+		if err != nil {
+			return err
+		}
+	}
+
+	data := make([]byte, 12)
+	binary.LittleEndian.PutUint32(data[0:4], osIndicationsAttributes)
+	binary.LittleEndian.PutUint64(data[4:], value)
+
+	// efivarfs requires the variable to be written at once
+	file, err := e.FileSystemBackend.OpenFile(variablePath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(data)
+
+	return err
+}
@@ -0,0 +1,216 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package eficapsule
+
+import (
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+	"github.com/UpdateHub/updatehub/testsmocks/copymock"
+	"github.com/UpdateHub/updatehub/testsmocks/libarchivemock"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+func writeVariable(t *testing.T, fs afero.Fs, name string, data []byte) {
+	err := afero.WriteFile(fs, path.Join(efivarsDir, name), data, 0644)
+	assert.NoError(t, err)
+}
+
+func TestEfiCapsuleInit(t *testing.T) {
+	val, err := installmodes.GetObject("efi-capsule")
+	assert.NoError(t, err)
+
+	e1, ok := val.(*EfiCapsuleObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"installmodes.GetObject()\" to EfiCapsuleObject")
+	}
+
+	e2, ok := getObject().(*EfiCapsuleObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"getObject()\" to EfiCapsuleObject")
+	}
+
+	assert.Equal(t, e2, e1)
+
+	_, ok = e1.CmdLineExecuter.(*utils.CmdLine)
+	if !ok {
+		t.Error("Failed to cast default implementation of \"CmdLineExecuter\" to CmdLine")
+	}
+}
+
+func TestEfiCapsuleSetup(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	writeVariable(t, fs, osIndicationsSupportedVariable, []byte{6, 0, 0, 0, 0x05, 0, 0, 0, 0, 0, 0, 0})
+
+	e := EfiCapsuleObject{FileSystemBackend: fs}
+	assert.NoError(t, e.Setup())
+	assert.Equal(t, "/boot/efi/EFI/UpdateCapsule/updatehub.cap", e.GetTarget())
+}
+
+func TestEfiCapsuleSetupWithUnsupportedFirmware(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Data     []byte
+		Expected string
+	}{
+		{
+			"NotSupported",
+			[]byte{6, 0, 0, 0, 0x01, 0, 0, 0, 0, 0, 0, 0},
+			"the firmware doesn't support capsules delivered on disk",
+		},
+		{
+			"InvalidVariable",
+			[]byte{6, 0, 0, 0, 0x04},
+			"failed to read the UEFI OS indications supported: UEFI variable 'OsIndicationsSupported-8be4df61-93ca-11d2-aa0d-00e098032b8c' has an unexpected size: 5 bytes",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			writeVariable(t, fs, osIndicationsSupportedVariable, tc.Data)
+
+			e := EfiCapsuleObject{FileSystemBackend: fs}
+			assert.EqualError(t, e.Setup(), tc.Expected)
+		})
+	}
+
+	e := EfiCapsuleObject{FileSystemBackend: afero.NewMemMapFs()}
+	assert.Error(t, e.Setup())
+}
+
+func TestEfiCapsuleSetupWithInvalidFilename(t *testing.T) {
+	e := EfiCapsuleObject{Filename: "../capsule.cap"}
+	assert.EqualError(t, e.Setup(), "filename '../capsule.cap' must not have a directory for the 'efi-capsule' handler")
+}
+
+func TestEfiCapsuleInstall(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Existing []byte
+	}{
+		{"VariableNotSet", nil},
+		{"VariableSet", []byte{7, 0, 0, 0, 0x01, 0, 0, 0, 0, 0, 0, 0}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			writeVariable(t, fs, osIndicationsSupportedVariable, []byte{6, 0, 0, 0, 0x04, 0, 0, 0, 0, 0, 0, 0})
+
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+			expectedIndications := byte(0x04)
+
+			if tc.Existing != nil {
+				writeVariable(t, fs, osIndicationsVariable, tc.Existing)
+				clm.On("Execute", fmt.Sprintf("chattr -i %s", path.Join(efivarsDir, osIndicationsVariable))).Return([]byte(""), nil)
+				expectedIndications = 0x05
+			}
+
+			lam := &libarchivemock.LibArchiveMock{}
+
+			cpm := &copymock.CopyMock{}
+			cpm.On("CopyFile", fs, lam, "/dummy-download-dir/sha256sum", "/esp/EFI/UpdateCapsule/firmware.cap", 128*1024, 0, 0, -1, true, true).Return(nil)
+
+			e := EfiCapsuleObject{
+				CmdLineExecuter:   clm,
+				LibArchiveBackend: lam,
+				FileSystemBackend: fs,
+				CopyBackend:       cpm,
+				EspPath:           "/esp",
+				Filename:          "firmware.cap",
+				ChunkSize:         128 * 1024,
+			}
+			e.Sha256sum = "sha256sum"
+			e.Compressed = true
+
+			assert.NoError(t, e.Setup())
+			assert.NoError(t, e.Install("/dummy-download-dir"))
+
+			data, err := afero.ReadFile(fs, path.Join(efivarsDir, osIndicationsVariable))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte{7, 0, 0, 0, expectedIndications, 0, 0, 0, 0, 0, 0, 0}, data)
+
+			isDir, err := afero.IsDir(fs, "/esp/EFI/UpdateCapsule")
+			assert.NoError(t, err)
+			assert.True(t, isDir)
+
+			clm.AssertExpectations(t)
+			lam.AssertExpectations(t)
+			cpm.AssertExpectations(t)
+		})
+	}
+}
+
+func TestEfiCapsuleInstallWithCopyFailure(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	lam := &libarchivemock.LibArchiveMock{}
+
+	cpm := &copymock.CopyMock{}
+	cpm.On("CopyFile", fs, lam, "/dummy-download-dir/sha256sum", "/boot/efi/EFI/UpdateCapsule/updatehub.cap", 0, 0, 0, -1, true, false).Return(fmt.Errorf("copy error"))
+
+	e := EfiCapsuleObject{
+		LibArchiveBackend: lam,
+		FileSystemBackend: fs,
+		CopyBackend:       cpm,
+		EspPath:           defaultEspPath,
+		Filename:          defaultFilename,
+	}
+	e.Sha256sum = "sha256sum"
+
+	assert.EqualError(t, e.Install("/dummy-download-dir"), "copy error")
+
+	exists, err := afero.Exists(fs, path.Join(efivarsDir, osIndicationsVariable))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	lam.AssertExpectations(t)
+	cpm.AssertExpectations(t)
+}
+
+func TestEfiCapsuleInstallWithChattrFailure(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	writeVariable(t, fs, osIndicationsVariable, []byte{7, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", fmt.Sprintf("chattr -i %s", path.Join(efivarsDir, osIndicationsVariable))).Return([]byte("error"), fmt.Errorf("Error executing command"))
+
+	lam := &libarchivemock.LibArchiveMock{}
+
+	cpm := &copymock.CopyMock{}
+	cpm.On("CopyFile", fs, lam, "/dummy-download-dir/sha256sum", "/boot/efi/EFI/UpdateCapsule/updatehub.cap", 0, 0, 0, -1, true, false).Return(nil)
+
+	e := EfiCapsuleObject{
+		CmdLineExecuter:   clm,
+		LibArchiveBackend: lam,
+		FileSystemBackend: fs,
+		CopyBackend:       cpm,
+		EspPath:           defaultEspPath,
+		Filename:          defaultFilename,
+	}
+	e.Sha256sum = "sha256sum"
+
+	assert.EqualError(t, e.Install("/dummy-download-dir"), "Error executing command")
+
+	clm.AssertExpectations(t)
+	lam.AssertExpectations(t)
+	cpm.AssertExpectations(t)
+}
+
+func TestEfiCapsuleCleanupNil(t *testing.T) {
+	e := EfiCapsuleObject{}
+	assert.Nil(t, e.Cleanup())
+}
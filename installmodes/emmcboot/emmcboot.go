@@ -0,0 +1,204 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package emmcboot
+
+import (
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/copy"
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/libarchive"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+func init() {
+	installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "emmc-boot",
+		CheckRequirements: checkRequirements,
+		GetObject:         getObject,
+	})
+}
+
+func checkRequirements() error {
+	_, err := exec.LookPath("mmc")
+
+	return err
+}
+
+func getObject() interface{} {
+	return &EMMCBootObject{
+		CmdLineExecuter:   &utils.CmdLine{},
+		LibArchiveBackend: &libarchive.LibArchive{},
+		FileSystemBackend: afero.NewOsFs(),
+		CopyBackend:       &copy.ExtendedIO{},
+		ChunkSize:         128 * 1024,
+	}
+}
+
+const sysBlockDir = "/sys/block"
+
+var partitionConfigRegexp = regexp.MustCompile(`PARTITION_CONFIG: 0x([0-9a-fA-F]+)`)
+
+// EMMCBootObject encapsulates the "emmc-boot" handler data and
+// functions. It writes a bootloader image to one of the hardware boot
+// partitions of the eMMC "target", "boot0" or "boot1". The "inactive"
+// one, which the eMMC isn't booting from, is written by default. The
+// read-only protection of the boot partition is lifted through sysfs
+// during the write, and the boot area of the PARTITION_CONFIG register
+// is switched to the written partition only after it's written, if
+// "switch-boot-partition?" is set.
+type EMMCBootObject struct {
+	metadata.ObjectMetadata
+	metadata.CompressedObject
+	utils.CmdLineExecuter
+	LibArchiveBackend libarchive.API `json:"-"`
+	FileSystemBackend afero.Fs
+	CopyBackend       copy.Interface `json:"-"`
+
+	Target              string `json:"target"`
+	BootPartition       string `json:"boot-partition,omitempty"`
+	SwitchBootPartition bool   `json:"switch-boot-partition?,omitempty"`
+	BootAck             bool   `json:"boot-ack?,omitempty"`
+	ChunkSize           int    `json:"chunk-size,omitempty"`
+	Seek                int    `json:"seek,omitempty"`
+
+	// these are NOT obtained from the json but from the "Setup()"
+	partition  int
+	restoreRO  bool
+	targetPath string
+}
+
+// Setup implementation for the "emmc-boot" handler
+func (e *EMMCBootObject) Setup() error {
+	if e.Target == "" {
+		return fmt.Errorf("the 'emmc-boot' handler requires the eMMC device as target")
+	}
+
+	switch e.BootPartition {
+	case "boot0":
+		e.partition = 0
+	case "boot1":
+		e.partition = 1
+	case "", "inactive":
+		active, err := e.activeBootPartition()
+		if err != nil {
+			return err
+		}
+
+		// the "boot0" is written when the eMMC boots from the user area
+		e.partition = 0
+		if active == 0 {
+			e.partition = 1
+		}
+	default:
+		return fmt.Errorf("boot-partition '%s' is not supported for the 'emmc-boot' handler. Its value must be either 'boot0', 'boot1' or 'inactive'", e.BootPartition)
+	}
+
+	e.targetPath = fmt.Sprintf("%sboot%d", e.Target, e.partition)
+
+	forceRO := e.forceROPath()
+
+	value, err := afero.ReadFile(e.FileSystemBackend, forceRO)
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(string(value)) != "0" {
+		err = afero.WriteFile(e.FileSystemBackend, forceRO, []byte("0"), 0644)
+		if err != nil {
+			return fmt.Errorf("failed to clear the read-only attribute of '%s': %s", e.targetPath, err)
+		}
+
+		e.restoreRO = true
+	}
+
+	return nil
+}
+
+// Install implementation for the "emmc-boot" handler
+func (e *EMMCBootObject) Install(downloadDir string) error {
+	srcPath := path.Join(downloadDir, e.Sha256sum)
+
+	err := e.CopyBackend.CopyFile(e.FileSystemBackend, e.LibArchiveBackend, srcPath, e.targetPath, e.ChunkSize, 0, e.Seek, -1, false, e.Compressed)
+	if err != nil {
+		return err
+	}
+
+	if !e.SwitchBootPartition {
+		return nil
+	}
+
+	ack := 0
+	if e.BootAck {
+		ack = 1
+	}
+
+	// the boot area of PARTITION_CONFIG is 1 for "boot0" and 2 for "boot1"
+	_, err = e.Execute(fmt.Sprintf("mmc bootpart enable %d %d %s", e.partition+1, ack, e.Target))
+
+	return err
+}
+
+// Cleanup implementation for the "emmc-boot" handler, the read-only
+// attribute of the boot partition is set back
+func (e *EMMCBootObject) Cleanup() error {
+	if !e.restoreRO {
+		return nil
+	}
+
+	e.restoreRO = false
+
+	return afero.WriteFile(e.FileSystemBackend, e.forceROPath(), []byte("1"), 0644)
+}
+
+// GetTarget implementation for the "emmc-boot" handler
+func (e *EMMCBootObject) GetTarget() string {
+	return e.targetPath
+}
+
+func (e *EMMCBootObject) forceROPath() string {
+	return path.Join(sysBlockDir, path.Base(e.targetPath), "force_ro")
+}
+
+// activeBootPartition returns the boot partition the eMMC boots from
+// according to its PARTITION_CONFIG register, or -1 if it boots from
+// the user area or the boot is disabled
+func (e *EMMCBootObject) activeBootPartition() (int, error) {
+	output, err := e.Execute(fmt.Sprintf("mmc extcsd read %s", e.Target))
+	if err != nil {
+		return -1, err
+	}
+
+	matches := partitionConfigRegexp.FindStringSubmatch(string(output))
+	if matches == nil {
+		return -1, fmt.Errorf("failed to find the PARTITION_CONFIG register of '%s'", e.Target)
+	}
+
+	config, err := strconv.ParseUint(matches[1], 16, 8)
+	if err != nil {
+		return -1, err
+	}
+
+	switch (config >> 3) & 0x7 {
+	case 1:
+		return 0, nil
+	case 2:
+		return 1, nil
+	default:
+		return -1, nil
+	}
+}
@@ -0,0 +1,238 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package emmcboot
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/installmodes/internal/testsutils"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+	"github.com/UpdateHub/updatehub/testsmocks/copymock"
+	"github.com/UpdateHub/updatehub/testsmocks/libarchivemock"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+const extcsdOutput = `=============================================
+  Extended CSD rev 1.8 (MMC 5.1)
+=============================================
+
+Boot configuration bytes [PARTITION_CONFIG: 0x%s]
+`
+
+func TestEMMCBootInit(t *testing.T) {
+	val, err := installmodes.GetObject("emmc-boot")
+	assert.NoError(t, err)
+
+	e1, ok := val.(*EMMCBootObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"installmodes.GetObject()\" to EMMCBootObject")
+	}
+
+	e2, ok := getObject().(*EMMCBootObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"getObject()\" to EMMCBootObject")
+	}
+
+	assert.Equal(t, e2, e1)
+
+	_, ok = e1.CmdLineExecuter.(*utils.CmdLine)
+	if !ok {
+		t.Error("Failed to cast default implementation of \"CmdLineExecuter\" to CmdLine")
+	}
+}
+
+func TestEMMCBootCheckRequirements(t *testing.T) {
+	testPath := testsutils.SetupCheckRequirementsDir(t, []string{"mmc"})
+	defer os.RemoveAll(testPath)
+
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+
+	err := os.Setenv("PATH", testPath)
+	assert.NoError(t, err)
+
+	assert.NoError(t, checkRequirements())
+
+	os.Remove(path.Join(testPath, "mmc"))
+	assert.EqualError(t, checkRequirements(), "exec: \"mmc\": executable file not found in $PATH")
+}
+
+func TestEMMCBootSetup(t *testing.T) {
+	testCases := []struct {
+		Name              string
+		BootPartition     string
+		PartitionConfig   string
+		ExpectedTarget    string
+		ExpectedPartition int
+	}{
+		{"WithBoot0", "boot0", "", "/dev/mmcblk0boot0", 0},
+		{"WithBoot1", "boot1", "", "/dev/mmcblk0boot1", 1},
+		{"WithInactiveBoot1", "inactive", "48", "/dev/mmcblk0boot1", 1},
+		{"WithInactiveBoot0", "", "50", "/dev/mmcblk0boot0", 0},
+		{"WithInactiveFromUserArea", "", "78", "/dev/mmcblk0boot0", 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			memFs := afero.NewMemMapFs()
+
+			forceRO := path.Join(sysBlockDir, path.Base(tc.ExpectedTarget), "force_ro")
+			assert.NoError(t, afero.WriteFile(memFs, forceRO, []byte("1\n"), 0644))
+
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+			if tc.PartitionConfig != "" {
+				clm.On("Execute", "mmc extcsd read /dev/mmcblk0").Return([]byte(fmt.Sprintf(extcsdOutput, tc.PartitionConfig)), nil)
+			}
+
+			e := EMMCBootObject{CmdLineExecuter: clm, FileSystemBackend: memFs}
+			e.Target = "/dev/mmcblk0"
+			e.BootPartition = tc.BootPartition
+
+			assert.NoError(t, e.Setup())
+			assert.Equal(t, tc.ExpectedTarget, e.GetTarget())
+			assert.Equal(t, tc.ExpectedPartition, e.partition)
+
+			// the read-only attribute is cleared during the write
+			data, err := afero.ReadFile(memFs, forceRO)
+			assert.NoError(t, err)
+			assert.Equal(t, "0", string(data))
+
+			assert.NoError(t, e.Cleanup())
+
+			data, err = afero.ReadFile(memFs, forceRO)
+			assert.NoError(t, err)
+			assert.Equal(t, "1", string(data))
+
+			clm.AssertExpectations(t)
+		})
+	}
+}
+
+func TestEMMCBootSetupWithWritablePartition(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+
+	forceRO := path.Join(sysBlockDir, "mmcblk0boot1", "force_ro")
+	assert.NoError(t, afero.WriteFile(memFs, forceRO, []byte("0\n"), 0644))
+
+	e := EMMCBootObject{FileSystemBackend: memFs}
+	e.Target = "/dev/mmcblk0"
+	e.BootPartition = "boot1"
+
+	assert.NoError(t, e.Setup())
+	assert.NoError(t, e.Cleanup())
+
+	// it's left as it was
+	data, err := afero.ReadFile(memFs, forceRO)
+	assert.NoError(t, err)
+	assert.Equal(t, "0\n", string(data))
+}
+
+func TestEMMCBootSetupWithErrors(t *testing.T) {
+	e := EMMCBootObject{FileSystemBackend: afero.NewMemMapFs()}
+	assert.EqualError(t, e.Setup(), "the 'emmc-boot' handler requires the eMMC device as target")
+
+	e.Target = "/dev/mmcblk0"
+	e.BootPartition = "user"
+	assert.EqualError(t, e.Setup(), "boot-partition 'user' is not supported for the 'emmc-boot' handler. Its value must be either 'boot0', 'boot1' or 'inactive'")
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "mmc extcsd read /dev/mmcblk0").Return([]byte("unexpected"), nil)
+
+	e.CmdLineExecuter = clm
+	e.BootPartition = "inactive"
+	assert.EqualError(t, e.Setup(), "failed to find the PARTITION_CONFIG register of '/dev/mmcblk0'")
+
+	clm.AssertExpectations(t)
+}
+
+func TestEMMCBootInstall(t *testing.T) {
+	testCases := []struct {
+		Name                string
+		SwitchBootPartition bool
+		BootAck             bool
+		ExpectedCmdline     string
+	}{
+		{"WithoutSwitch", false, false, ""},
+		{"WithSwitch", true, false, "mmc bootpart enable 2 0 /dev/mmcblk0"},
+		{"WithSwitchAndAck", true, true, "mmc bootpart enable 2 1 /dev/mmcblk0"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			memFs := afero.NewMemMapFs()
+			lam := &libarchivemock.LibArchiveMock{}
+
+			sha256sum := "5bdbf286cb4adcff26befa2183f3167c053bc565036736eaa2ae429fe910d93c"
+			downloadDir := "/dummy-download-dir"
+
+			cm := &copymock.CopyMock{}
+			cm.On("CopyFile", memFs, lam, path.Join(downloadDir, sha256sum), "/dev/mmcblk0boot1", 512, 0, 2, -1, false, false).Return(nil)
+
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+			if tc.ExpectedCmdline != "" {
+				clm.On("Execute", tc.ExpectedCmdline).Return([]byte(""), nil)
+			}
+
+			e := EMMCBootObject{
+				CmdLineExecuter:     clm,
+				LibArchiveBackend:   lam,
+				FileSystemBackend:   memFs,
+				CopyBackend:         cm,
+				Target:              "/dev/mmcblk0",
+				SwitchBootPartition: tc.SwitchBootPartition,
+				BootAck:             tc.BootAck,
+				ChunkSize:           512,
+				Seek:                2,
+			}
+			e.Sha256sum = sha256sum
+			e.partition = 1
+			e.targetPath = "/dev/mmcblk0boot1"
+
+			assert.NoError(t, e.Install(downloadDir))
+
+			cm.AssertExpectations(t)
+			clm.AssertExpectations(t)
+		})
+	}
+}
+
+func TestEMMCBootInstallWithCopyError(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	lam := &libarchivemock.LibArchiveMock{}
+
+	cm := &copymock.CopyMock{}
+	cm.On("CopyFile", memFs, lam, "/dummy-download-dir/sha256sum", "/dev/mmcblk0boot0", 512, 0, 0, -1, false, false).Return(fmt.Errorf("copy file error"))
+
+	// the boot area isn't switched to a partial bootloader
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	e := EMMCBootObject{
+		CmdLineExecuter:     clm,
+		LibArchiveBackend:   lam,
+		FileSystemBackend:   memFs,
+		CopyBackend:         cm,
+		Target:              "/dev/mmcblk0",
+		SwitchBootPartition: true,
+		ChunkSize:           512,
+	}
+	e.Sha256sum = "sha256sum"
+	e.targetPath = "/dev/mmcblk0boot0"
+
+	assert.EqualError(t, e.Install("/dummy-download-dir"), "copy file error")
+
+	cm.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
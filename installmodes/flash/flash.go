@@ -10,6 +10,8 @@ package flash
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"path"
 
@@ -106,11 +108,53 @@ func (f *FlashObject) Install(downloadDir string) error {
 	return err
 }
 
+// Streamable implementation for the "flash" handler
+func (f *FlashObject) Streamable() bool {
+	return true
+}
+
+// InstallFromStream implementation for the "flash" handler. The NAND
+// devices are written by "nandwrite" from its standard input, so the
+// bad blocks are still skipped, while the NOR ones are written directly
+// after they are erased.
+func (f *FlashObject) InstallFromStream(rd io.Reader) error {
+	isNand, err := f.MtdUtils.MtdIsNAND(f.targetDevice)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Execute(fmt.Sprintf("flash_erase %s 0 0", f.targetDevice))
+	if err != nil {
+		return err
+	}
+
+	if isNand {
+		_, err = f.ExecuteWithStdin(fmt.Sprintf("nandwrite -p %s -", f.targetDevice), rd)
+		return err
+	}
+
+	target, err := f.FileSystemBackend.OpenFile(f.targetDevice, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	_, err = io.Copy(target, rd)
+
+	return err
+}
+
 // Cleanup implementation for the "flash" handler
 func (f *FlashObject) Cleanup() error {
 	return nil
 }
 
+// Idempotent implementation for the "flash" handler, the target is
+// erased before it's written
+func (f *FlashObject) Idempotent() bool {
+	return true
+}
+
 // GetTarget implementation for the "flash" handler
 func (f *FlashObject) GetTarget() string {
 	return f.targetDevice + "ro"
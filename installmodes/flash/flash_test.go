@@ -9,6 +9,7 @@
 package flash
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path"
@@ -350,3 +351,76 @@ func TestFlashInstallWithNandwriteFailure(t *testing.T) {
 	expectedTargetDevice := mtddevice + "ro"
 	assert.Equal(t, expectedTargetDevice, f.GetTarget())
 }
+
+func TestFlashStreamable(t *testing.T) {
+	f := FlashObject{}
+	assert.True(t, f.Streamable())
+}
+
+func TestFlashInstallFromStreamWithNAND(t *testing.T) {
+	mtddevice := "/dev/mtd9"
+	rd := bytes.NewReader([]byte("content"))
+
+	mum := &mtdmock.MtdUtilsMock{}
+	mum.On("MtdIsNAND", mtddevice).Return(true, nil)
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", fmt.Sprintf("flash_erase %s 0 0", mtddevice)).Return([]byte("combinedOutput"), nil)
+	clm.On("ExecuteWithStdin", fmt.Sprintf("nandwrite -p %s -", mtddevice), rd).Return([]byte("combinedOutput"), nil)
+
+	f := FlashObject{FileSystemBackend: afero.NewMemMapFs(), MtdUtils: mum, CmdLineExecuter: clm}
+	f.targetDevice = mtddevice
+
+	err := f.InstallFromStream(rd)
+	assert.NoError(t, err)
+
+	mum.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestFlashInstallFromStreamWithNOR(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+
+	mtddevice := "/dev/mtd9"
+
+	err := afero.WriteFile(memFs, mtddevice, []byte("erased-device"), 0644)
+	assert.NoError(t, err)
+
+	mum := &mtdmock.MtdUtilsMock{}
+	mum.On("MtdIsNAND", mtddevice).Return(false, nil)
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", fmt.Sprintf("flash_erase %s 0 0", mtddevice)).Return([]byte("combinedOutput"), nil)
+
+	f := FlashObject{FileSystemBackend: memFs, MtdUtils: mum, CmdLineExecuter: clm}
+	f.targetDevice = mtddevice
+
+	err = f.InstallFromStream(bytes.NewReader([]byte("content")))
+	assert.NoError(t, err)
+
+	data, err := afero.ReadFile(memFs, mtddevice)
+	assert.NoError(t, err)
+	assert.Equal(t, "contentdevice", string(data))
+
+	mum.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestFlashInstallFromStreamWithFlashEraseFailure(t *testing.T) {
+	mtddevice := "/dev/mtd9"
+
+	mum := &mtdmock.MtdUtilsMock{}
+	mum.On("MtdIsNAND", mtddevice).Return(true, nil)
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", fmt.Sprintf("flash_erase %s 0 0", mtddevice)).Return([]byte("error"), fmt.Errorf("Error executing command"))
+
+	f := FlashObject{FileSystemBackend: afero.NewMemMapFs(), MtdUtils: mum, CmdLineExecuter: clm}
+	f.targetDevice = mtddevice
+
+	err := f.InstallFromStream(bytes.NewReader([]byte("content")))
+	assert.EqualError(t, err, "Error executing command")
+
+	mum.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
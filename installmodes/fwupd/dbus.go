@@ -0,0 +1,123 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package fwupd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/godbus/dbus"
+)
+
+const (
+	fwupdBusName   = "org.freedesktop.fwupd"
+	fwupdInterface = "org.freedesktop.fwupd"
+	fwupdPath      = "/"
+)
+
+// dbusDaemon talks to the fwupd daemon through the system bus
+type dbusDaemon struct{}
+
+func (d *dbusDaemon) Install(device string, firmwarePath string, options map[string]bool, progress func(percentage uint32)) error {
+	firmware, err := os.Open(firmwarePath)
+	if err != nil {
+		return err
+	}
+	defer firmware.Close()
+
+	// a private connection, so it can be closed
+	conn, err := dbus.SystemBusPrivate()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err = conn.Auth(nil); err != nil {
+		return err
+	}
+
+	if err = conn.Hello(); err != nil {
+		return err
+	}
+
+	// fwupd tells its progress through its "Percentage" property
+	rule := fmt.Sprintf("type='signal',sender='%s',path='%s',interface='org.freedesktop.DBus.Properties',member='PropertiesChanged'", fwupdBusName, fwupdPath)
+
+	call := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, rule)
+	if call.Err != nil {
+		return call.Err
+	}
+
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go forwardPercentage(signals, done, progress)
+
+	variants := map[string]dbus.Variant{}
+	for name, value := range options {
+		variants[name] = dbus.MakeVariant(value)
+	}
+
+	daemon := conn.Object(fwupdBusName, fwupdPath)
+
+	call = daemon.Call(fwupdInterface+".Install", 0, device, dbus.UnixFD(firmware.Fd()), variants)
+
+	return fwupdErrorFromDBus(call.Err)
+}
+
+func forwardPercentage(signals chan *dbus.Signal, done chan struct{}, progress func(percentage uint32)) {
+	for {
+		select {
+		case <-done:
+			return
+		case signal, ok := <-signals:
+			if !ok {
+				return
+			}
+
+			if len(signal.Body) < 2 {
+				continue
+			}
+
+			changed, ok := signal.Body[1].(map[string]dbus.Variant)
+			if !ok {
+				continue
+			}
+
+			if percentage, ok := changed["Percentage"].Value().(uint32); ok {
+				progress(percentage)
+			}
+		}
+	}
+}
+
+// fwupdErrorFromDBus turns the errors replied by fwupd into a
+// FwupdError
+func fwupdErrorFromDBus(err error) error {
+	var de dbus.Error
+
+	switch e := err.(type) {
+	case dbus.Error:
+		de = e
+	case *dbus.Error:
+		de = *e
+	default:
+		return err
+	}
+
+	message := ""
+	if len(de.Body) > 0 {
+		message, _ = de.Body[0].(string)
+	}
+
+	return &FwupdError{Name: de.Name, Message: message}
+}
@@ -0,0 +1,174 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package fwupd
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/UpdateHub/updatehub/handlers"
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/log"
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+func init() {
+	installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "fwupd",
+		CheckRequirements: func() error { return nil },
+		GetObject:         getObject,
+	})
+}
+
+func getObject() interface{} {
+	return &FwupdObject{
+		Device: anyDevice,
+	}
+}
+
+// fwupd picks the devices matching the cabinet archive
+const anyDevice = "*"
+
+// fwupdDaemon is the part of the fwupd D-Bus API used by the handler
+type fwupdDaemon interface {
+	// Install hands the firmware to fwupd, "progress" receives the
+	// percentage done while it's installed
+	Install(device string, firmwarePath string, options map[string]bool, progress func(percentage uint32)) error
+}
+
+// FwupdError is an error returned by the fwupd daemon, "Name" is the
+// D-Bus error name
+type FwupdError struct {
+	Name    string
+	Message string
+}
+
+func (e *FwupdError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Name, e.Message)
+}
+
+// the fwupd errors telling the firmware is already installed
+var fwupdUpToDateErrors = []string{
+	"org.freedesktop.fwupd.NothingToDo",
+	"org.freedesktop.fwupd.VersionSame",
+}
+
+// the explanation of the fwupd errors sent in the reports
+var fwupdErrorMessages = map[string]string{
+	"org.freedesktop.fwupd.VersionNewer":       "the device runs a newer firmware, 'allow-older' must be set to downgrade it",
+	"org.freedesktop.fwupd.AlreadyPending":     "an update of the device is already pending",
+	"org.freedesktop.fwupd.AuthFailed":         "the agent isn't authorized to update the device",
+	"org.freedesktop.fwupd.PermissionDenied":   "the agent isn't authorized to update the device",
+	"org.freedesktop.fwupd.InvalidFile":        "the firmware file is invalid",
+	"org.freedesktop.fwupd.NotFound":           "no device matches the firmware",
+	"org.freedesktop.fwupd.NotSupported":       "the device doesn't support the firmware",
+	"org.freedesktop.fwupd.SignatureInvalid":   "the firmware signature is invalid",
+	"org.freedesktop.fwupd.AcPowerRequired":    "the device must be on AC power",
+	"org.freedesktop.fwupd.BatteryLevelTooLow": "the battery level is too low",
+	"org.freedesktop.fwupd.NeedsUserAction":    "the device needs a user action",
+	"org.freedesktop.fwupd.BrokenSystem":       "the system is in a state fwupd can't update",
+}
+
+// FwupdObject encapsulates the "fwupd" handler data and functions.
+// It hands a cabinet archive (or a firmware blob, when the "device"
+// ID is given) to the fwupd daemon, which updates the peripherals
+// like the NVMe drives, docks and NICs. With "offline" the update is
+// scheduled to the next boot.
+type FwupdObject struct {
+	metadata.ObjectMetadata
+
+	Device         string `json:"device,omitempty"`
+	AllowOlder     bool   `json:"allow-older,omitempty"`
+	AllowReinstall bool   `json:"allow-reinstall,omitempty"`
+	Offline        bool   `json:"offline,omitempty"`
+
+	progress handlers.ProgressFunc
+	daemon   fwupdDaemon // replaced by the tests, nil means the D-Bus daemon
+}
+
+// Setup implementation for the "fwupd" handler
+func (f *FwupdObject) Setup() error {
+	if f.Compressed {
+		return fmt.Errorf("the 'fwupd' handler doesn't support compressed objects")
+	}
+
+	if f.Device == "" {
+		f.Device = anyDevice
+	}
+
+	return nil
+}
+
+// Install implementation for the "fwupd" handler
+func (f *FwupdObject) Install(downloadDir string) error {
+	daemon := f.daemon
+	if daemon == nil {
+		daemon = &dbusDaemon{}
+	}
+
+	options := map[string]bool{
+		"allow-older":     f.AllowOlder,
+		"allow-reinstall": f.AllowReinstall,
+		"offline":         f.Offline,
+	}
+
+	err := daemon.Install(f.Device, path.Join(downloadDir, f.Sha256sum), options, f.notifyProgress)
+
+	fe, ok := err.(*FwupdError)
+	if !ok {
+		return err
+	}
+
+	for _, name := range fwupdUpToDateErrors {
+		if fe.Name == name {
+			log.Info(fmt.Sprintf("the firmware of '%s' is already installed: %s", f.Device, fe.Message))
+			return nil
+		}
+	}
+
+	if message, ok := fwupdErrorMessages[fe.Name]; ok {
+		return fmt.Errorf("fwupd failed to install the firmware: %s (%s)", message, fe.Message)
+	}
+
+	return fmt.Errorf("fwupd failed to install the firmware: %s", fe)
+}
+
+// notifyProgress forwards the percentage done by fwupd as the bytes
+// of the object, or as is out of 100 when its size isn't known
+func (f *FwupdObject) notifyProgress(percentage uint32) {
+	if f.progress == nil {
+		return
+	}
+
+	if percentage > 100 {
+		percentage = 100
+	}
+
+	if f.Size <= 0 {
+		f.progress(int64(percentage), 100)
+		return
+	}
+
+	f.progress(f.Size*int64(percentage)/100, f.Size)
+}
+
+// Cleanup implementation for the "fwupd" handler
+func (f *FwupdObject) Cleanup() error {
+	return nil
+}
+
+// GetTarget implementation for the "fwupd" handler
+func (f *FwupdObject) GetTarget() string {
+	return f.Device
+}
+
+// SetProgressFunc implementation for the "fwupd" handler
+func (f *FwupdObject) SetProgressFunc(fn handlers.ProgressFunc) {
+	f.progress = fn
+}
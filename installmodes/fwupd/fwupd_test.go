@@ -0,0 +1,165 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package fwupd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/godbus/dbus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+)
+
+// fakeDaemon reports the "percentages" then replies "err"
+type fakeDaemon struct {
+	percentages []uint32
+	err         error
+
+	device       string
+	firmwarePath string
+	options      map[string]bool
+}
+
+func (d *fakeDaemon) Install(device string, firmwarePath string, options map[string]bool, progress func(percentage uint32)) error {
+	d.device = device
+	d.firmwarePath = firmwarePath
+	d.options = options
+
+	for _, p := range d.percentages {
+		progress(p)
+	}
+
+	return d.err
+}
+
+func TestFwupdInit(t *testing.T) {
+	val, err := installmodes.GetObject("fwupd")
+	assert.NoError(t, err)
+
+	f1, ok := val.(*FwupdObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"installmodes.GetObject()\" to FwupdObject")
+	}
+
+	f2, ok := getObject().(*FwupdObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"getObject()\" to FwupdObject")
+	}
+
+	assert.Equal(t, f2, f1)
+}
+
+func TestFwupdSetup(t *testing.T) {
+	f := FwupdObject{}
+	assert.NoError(t, f.Setup())
+	assert.Equal(t, "*", f.GetTarget())
+
+	f = FwupdObject{}
+	f.Compressed = true
+	assert.EqualError(t, f.Setup(), "the 'fwupd' handler doesn't support compressed objects")
+}
+
+func TestFwupdInstall(t *testing.T) {
+	d := &fakeDaemon{percentages: []uint32{0, 50, 100}}
+
+	f := getObject().(*FwupdObject)
+	f.Device = "2082b5e0-7a64-478a-b1b2-e3404fab6dad"
+	f.AllowOlder = true
+	f.Sha256sum = "sha256sum"
+	f.Size = 1000
+	f.daemon = d
+
+	var progress [][2]int64
+	f.SetProgressFunc(func(installed int64, total int64) {
+		progress = append(progress, [2]int64{installed, total})
+	})
+
+	assert.NoError(t, f.Setup())
+	assert.NoError(t, f.Install("/dummy-download-dir"))
+
+	assert.Equal(t, "2082b5e0-7a64-478a-b1b2-e3404fab6dad", d.device)
+	assert.Equal(t, "/dummy-download-dir/sha256sum", d.firmwarePath)
+	assert.Equal(t, map[string]bool{"allow-older": true, "allow-reinstall": false, "offline": false}, d.options)
+	assert.Equal(t, [][2]int64{{0, 1000}, {500, 1000}, {1000, 1000}}, progress)
+}
+
+func TestFwupdInstallWithErrors(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Err      error
+		Expected string
+	}{
+		{
+			"AlreadyInstalled",
+			&FwupdError{Name: "org.freedesktop.fwupd.VersionSame", Message: "Specified firmware is already installed"},
+			"",
+		},
+		{
+			"NothingToDo",
+			&FwupdError{Name: "org.freedesktop.fwupd.NothingToDo", Message: "No supported devices found"},
+			"",
+		},
+		{
+			"VersionNewer",
+			&FwupdError{Name: "org.freedesktop.fwupd.VersionNewer", Message: "Specified firmware is older than installed"},
+			"fwupd failed to install the firmware: the device runs a newer firmware, 'allow-older' must be set to downgrade it (Specified firmware is older than installed)",
+		},
+		{
+			"UnknownError",
+			&FwupdError{Name: "org.freedesktop.fwupd.Internal", Message: "failed to write"},
+			"fwupd failed to install the firmware: org.freedesktop.fwupd.Internal: failed to write",
+		},
+		{
+			"NotFwupdError",
+			fmt.Errorf("connection refused"),
+			"connection refused",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			f := getObject().(*FwupdObject)
+			f.daemon = &fakeDaemon{err: tc.Err}
+
+			err := f.Install("/dummy-download-dir")
+			if tc.Expected == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.Expected)
+			}
+		})
+	}
+}
+
+func TestFwupdProgressWithoutSize(t *testing.T) {
+	var installed, total int64
+
+	f := getObject().(*FwupdObject)
+	f.SetProgressFunc(func(i int64, t int64) {
+		installed, total = i, t
+	})
+
+	f.notifyProgress(120)
+
+	assert.Equal(t, int64(100), installed)
+	assert.Equal(t, int64(100), total)
+}
+
+func TestFwupdErrorFromDBus(t *testing.T) {
+	err := fwupdErrorFromDBus(dbus.Error{Name: "org.freedesktop.fwupd.NotFound", Body: []interface{}{"no such device"}})
+	assert.Equal(t, &FwupdError{Name: "org.freedesktop.fwupd.NotFound", Message: "no such device"}, err)
+
+	err = fwupdErrorFromDBus(&dbus.Error{Name: "org.freedesktop.fwupd.Internal"})
+	assert.Equal(t, &FwupdError{Name: "org.freedesktop.fwupd.Internal"}, err)
+
+	assert.Nil(t, fwupdErrorFromDBus(nil))
+	assert.EqualError(t, fwupdErrorFromDBus(fmt.Errorf("error")), "error")
+}
@@ -0,0 +1,134 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package mcufirmware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// the STK500v1 protocol, spoken by the Arduino (optiboot) bootloader
+const (
+	stkOk            = 0x10
+	stkInSync        = 0x14
+	stkCrcEOP        = 0x20
+	stkGetSync       = 0x30
+	stkEnterProgMode = 0x50
+	stkLeaveProgMode = 0x51
+	stkLoadAddress   = 0x55
+	stkProgPage      = 0x64
+	stkReadPage      = 0x74
+
+	// the bootloader may still be starting after the reset
+	avrSyncAttempts = 5
+
+	avrPageSize = 128
+)
+
+// flashAVR writes and verifies the segments, page by page, then
+// leaves the bootloader which starts the firmware
+func flashAVR(port io.ReadWriter, segments []segment) error {
+	var err error
+
+	for attempt := 0; attempt < avrSyncAttempts; attempt++ {
+		if _, err = avrCommand(port, []byte{stkGetSync}, 0); err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := avrCommand(port, []byte{stkEnterProgMode}, 0); err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		for offset := 0; offset < len(s.data); offset += avrPageSize {
+			end := offset + avrPageSize
+			if end > len(s.data) {
+				end = len(s.data)
+			}
+
+			if err := avrWritePage(port, s.address+uint32(offset), s.data[offset:end]); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = avrCommand(port, []byte{stkLeaveProgMode}, 0)
+
+	return err
+}
+
+// avrCommand sends the command and returns the "size" bytes of its
+// answer
+func avrCommand(port io.ReadWriter, command []byte, size int) ([]byte, error) {
+	if _, err := port.Write(append(append([]byte{}, command...), stkCrcEOP)); err != nil {
+		return nil, err
+	}
+
+	answer := make([]byte, size+2)
+
+	n, err := io.ReadFull(port, answer)
+	if n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("no answer from the AVR bootloader")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if answer[0] != stkInSync || answer[size+1] != stkOk {
+		return nil, fmt.Errorf("the AVR bootloader is out of sync")
+	}
+
+	return answer[1 : size+1], nil
+}
+
+func avrLoadAddress(port io.ReadWriter, address uint32) error {
+	// the flash is addressed in words
+	word := address / 2
+
+	_, err := avrCommand(port, []byte{stkLoadAddress, byte(word), byte(word >> 8)}, 0)
+
+	return err
+}
+
+func avrWritePage(port io.ReadWriter, address uint32, data []byte) error {
+	size := []byte{byte(len(data) >> 8), byte(len(data))}
+
+	if err := avrLoadAddress(port, address); err != nil {
+		return err
+	}
+
+	command := append([]byte{stkProgPage}, size...)
+	command = append(command, 'F')
+	command = append(command, data...)
+
+	if _, err := avrCommand(port, command, 0); err != nil {
+		return err
+	}
+
+	if err := avrLoadAddress(port, address); err != nil {
+		return err
+	}
+
+	written, err := avrCommand(port, []byte{stkReadPage, size[0], size[1], 'F'}, len(data))
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(written, data) {
+		return fmt.Errorf("the AVR flash at 0x%04x doesn't match the image", address)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package mcufirmware
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAVR emulates the STK500v1 bootloader, each command must be
+// written at once
+type fakeAVR struct {
+	bytes.Buffer
+
+	// the bootloader ignores the first syncs
+	startingSyncs int
+	corrupt       bool
+
+	flash    map[uint32]byte
+	address  uint32
+	progMode bool
+	left     bool
+}
+
+func newFakeAVR() *fakeAVR {
+	return &fakeAVR{flash: map[uint32]byte{}}
+}
+
+func (f *fakeAVR) Write(p []byte) (int, error) {
+	if p[0] == stkGetSync && f.startingSyncs > 0 {
+		f.startingSyncs--
+		return len(p), nil
+	}
+
+	f.WriteByte(stkInSync)
+
+	switch p[0] {
+	case stkEnterProgMode:
+		f.progMode = true
+	case stkLeaveProgMode:
+		f.progMode = false
+		f.left = true
+	case stkLoadAddress:
+		f.address = (uint32(p[1]) | uint32(p[2])<<8) * 2
+	case stkProgPage:
+		for i, b := range p[4 : len(p)-1] {
+			f.flash[f.address+uint32(i)] = b
+		}
+	case stkReadPage:
+		size := uint32(p[1])<<8 | uint32(p[2])
+
+		for i := uint32(0); i < size; i++ {
+			b := f.flash[f.address+i]
+			if f.corrupt {
+				b ^= 0xFF
+			}
+
+			f.WriteByte(b)
+		}
+	}
+
+	f.WriteByte(stkOk)
+
+	return len(p), nil
+}
+
+func (f *fakeAVR) Close() error {
+	return nil
+}
+
+func TestFlashAVR(t *testing.T) {
+	data := bytes.Repeat([]byte{0x01, 0x02, 0x03}, 100)
+
+	f := newFakeAVR()
+	f.startingSyncs = 2
+
+	err := flashAVR(f, []segment{{address: 0, data: data}, {address: 0x1000, data: []byte{0x04}}})
+	assert.NoError(t, err)
+
+	for i, b := range data {
+		assert.Equal(t, b, f.flash[uint32(i)])
+	}
+
+	assert.Equal(t, byte(0x04), f.flash[0x1000])
+	assert.False(t, f.progMode)
+	assert.True(t, f.left)
+}
+
+func TestFlashAVRWithVerifyFailure(t *testing.T) {
+	f := newFakeAVR()
+	f.corrupt = true
+
+	err := flashAVR(f, []segment{{address: 0x80, data: []byte{0x01, 0x02}}})
+	assert.EqualError(t, err, "the AVR flash at 0x0080 doesn't match the image")
+	assert.False(t, f.left)
+}
+
+func TestFlashAVRWithoutBootloader(t *testing.T) {
+	f := newFakeAVR()
+	f.startingSyncs = avrSyncAttempts
+
+	err := flashAVR(f, nil)
+	assert.EqualError(t, err, "no answer from the AVR bootloader")
+}
+
+func TestFlashAVROutOfSync(t *testing.T) {
+	port := &bytes.Buffer{}
+	port.Write([]byte{0x00, 0x00})
+
+	err := flashAVR(port, nil)
+	assert.EqualError(t, err, "the AVR bootloader is out of sync")
+}
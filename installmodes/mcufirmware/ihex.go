@@ -0,0 +1,99 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package mcufirmware
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// segment is a contiguous part of the memory of the microcontroller
+type segment struct {
+	address uint32
+	data    []byte
+}
+
+// the Intel HEX record types
+const (
+	ihexData                   = 0x00
+	ihexEndOfFile              = 0x01
+	ihexExtendedSegmentAddress = 0x02
+	ihexStartSegmentAddress    = 0x03
+	ihexExtendedLinearAddress  = 0x04
+	ihexStartLinearAddress     = 0x05
+)
+
+// parseIntelHex returns the segments of an Intel HEX image, the
+// adjacent data records are merged into a single segment
+func parseIntelHex(data []byte) ([]segment, error) {
+	segments := []segment{}
+
+	var base uint32
+
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(line, ":") {
+			return nil, fmt.Errorf("invalid Intel HEX record at line %d", n+1)
+		}
+
+		record, err := hex.DecodeString(line[1:])
+		if err != nil || len(record) < 5 || len(record) != int(record[0])+5 {
+			return nil, fmt.Errorf("invalid Intel HEX record at line %d", n+1)
+		}
+
+		var sum byte
+		for _, b := range record {
+			sum += b
+		}
+
+		if sum != 0 {
+			return nil, fmt.Errorf("invalid Intel HEX checksum at line %d", n+1)
+		}
+
+		offset := uint32(record[1])<<8 | uint32(record[2])
+		payload := record[4 : len(record)-1]
+
+		switch record[3] {
+		case ihexData:
+			address := base + offset
+
+			last := len(segments) - 1
+			if last >= 0 && segments[last].address+uint32(len(segments[last].data)) == address {
+				segments[last].data = append(segments[last].data, payload...)
+			} else {
+				segments = append(segments, segment{address: address, data: append([]byte{}, payload...)})
+			}
+		case ihexEndOfFile:
+			return segments, nil
+		case ihexExtendedSegmentAddress:
+			if len(payload) != 2 {
+				return nil, fmt.Errorf("invalid Intel HEX record at line %d", n+1)
+			}
+
+			base = (uint32(payload[0])<<8 | uint32(payload[1])) << 4
+		case ihexExtendedLinearAddress:
+			if len(payload) != 2 {
+				return nil, fmt.Errorf("invalid Intel HEX record at line %d", n+1)
+			}
+
+			base = (uint32(payload[0])<<8 | uint32(payload[1])) << 16
+		case ihexStartSegmentAddress, ihexStartLinearAddress:
+			// the bootloaders start the firmware at its reset vector
+		default:
+			return nil, fmt.Errorf("unsupported Intel HEX record type %d at line %d", record[3], n+1)
+		}
+	}
+
+	return nil, fmt.Errorf("the Intel HEX image has no end of file record")
+}
@@ -0,0 +1,79 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package mcufirmware
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testIntelHex = `:020000040800F2
+:0400000001020304F2
+:020004000506EF
+:0101000007F7
+:0400000508000000EF
+:020000021000EC
+:0100000009F6
+:00000001FF
+`
+
+func TestParseIntelHex(t *testing.T) {
+	segments, err := parseIntelHex([]byte(testIntelHex))
+	assert.NoError(t, err)
+
+	expected := []segment{
+		{address: 0x08000000, data: []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}},
+		{address: 0x08000100, data: []byte{0x07}},
+		{address: 0x00010000, data: []byte{0x09}},
+	}
+
+	assert.Equal(t, expected, segments)
+}
+
+func TestParseIntelHexWithInvalidImage(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Data     string
+		Expected string
+	}{
+		{
+			"InvalidChecksum",
+			":0400000001020304F3\n:00000001FF\n",
+			"invalid Intel HEX checksum at line 1",
+		},
+		{
+			"InvalidLength",
+			":0500000001020304F2\n:00000001FF\n",
+			"invalid Intel HEX record at line 1",
+		},
+		{
+			"MissingColon",
+			":0400000001020304F2\n00000001FF\n",
+			"invalid Intel HEX record at line 2",
+		},
+		{
+			"UnsupportedRecordType",
+			":00000006FA\n",
+			"unsupported Intel HEX record type 6 at line 1",
+		},
+		{
+			"MissingEndOfFile",
+			":0400000001020304F2\n",
+			"the Intel HEX image has no end of file record",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			_, err := parseIntelHex([]byte(tc.Data))
+			assert.EqualError(t, err, tc.Expected)
+		})
+	}
+}
@@ -0,0 +1,229 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package mcufirmware
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/log"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+func init() {
+	installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "mcu-firmware",
+		CheckRequirements: func() error { return nil },
+		GetObject:         getObject,
+	})
+}
+
+func getObject() interface{} {
+	return &MCUFirmwareObject{
+		CmdLineExecuter:   &utils.CmdLine{},
+		FileSystemBackend: afero.NewOsFs(),
+		Format:            "bin",
+		BaudRate:          115200,
+		Retries:           3,
+	}
+}
+
+// the STM32 flash is mapped at this address
+const stm32FlashAddress = 0x08000000
+
+// MCUFirmwareObject encapsulates the "mcu-firmware" handler data and
+// functions. It delivers a firmware image to a microcontroller
+// attached to the serial "device", either through the "command"
+// flasher, which is given the device and the image path, or through
+// the "stm32" (AN3155) or "avr" (STK500v1) bootloaders. The delivery
+// is tried again up to "retries" times, each attempt starting by the
+// "reset-command" which puts the microcontroller in its bootloader.
+// The "version-command" output must then match "version".
+type MCUFirmwareObject struct {
+	metadata.ObjectMetadata
+	utils.CmdLineExecuter
+	FileSystemBackend afero.Fs
+
+	Device         string `json:"device"`
+	Protocol       string `json:"protocol"`
+	Format         string `json:"format,omitempty"`  // "bin" or "hex"
+	Address        uint32 `json:"address,omitempty"` // where a "bin" image is written
+	BaudRate       int    `json:"baud-rate,omitempty"`
+	FlasherCommand string `json:"flasher-command,omitempty"`
+	ResetCommand   string `json:"reset-command,omitempty"`
+	Retries        int    `json:"retries,omitempty"`
+	Version        string `json:"version,omitempty"`
+	VersionCommand string `json:"version-command,omitempty"`
+
+	// openPort opens the serial device, it's replaced by the tests
+	openPort func(device string) (io.ReadWriteCloser, error)
+}
+
+// Setup implementation for the "mcu-firmware" handler
+func (m *MCUFirmwareObject) Setup() error {
+	if m.Device == "" {
+		return fmt.Errorf("the 'mcu-firmware' handler requires a 'device'")
+	}
+
+	switch m.Protocol {
+	case "command":
+		if m.FlasherCommand == "" {
+			return fmt.Errorf("the 'command' protocol of the 'mcu-firmware' handler requires a 'flasher-command'")
+		}
+	case "stm32", "avr":
+	default:
+		return fmt.Errorf("protocol '%s' is not supported by the 'mcu-firmware' handler", m.Protocol)
+	}
+
+	if m.Format != "bin" && m.Format != "hex" {
+		return fmt.Errorf("format '%s' is not supported by the 'mcu-firmware' handler", m.Format)
+	}
+
+	if m.Version != "" && m.VersionCommand == "" {
+		return fmt.Errorf("the 'mcu-firmware' handler requires a 'version-command' to confirm the version")
+	}
+
+	if m.Protocol == "stm32" && m.Address == 0 {
+		m.Address = stm32FlashAddress
+	}
+
+	if m.Retries < 1 {
+		m.Retries = 1
+	}
+
+	return nil
+}
+
+// Install implementation for the "mcu-firmware" handler
+func (m *MCUFirmwareObject) Install(downloadDir string) error {
+	imagePath := path.Join(downloadDir, m.Sha256sum)
+
+	var segments []segment
+	var err error
+
+	if m.Protocol != "command" {
+		segments, err = m.readImage(imagePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	for attempt := 1; attempt <= m.Retries; attempt++ {
+		err = m.deliver(imagePath, segments)
+		if err == nil {
+			break
+		}
+
+		log.Warn(fmt.Sprintf("failed to deliver the firmware to '%s' (attempt %d of %d): %s", m.Device, attempt, m.Retries, err))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return m.confirmVersion()
+}
+
+// Cleanup implementation for the "mcu-firmware" handler
+func (m *MCUFirmwareObject) Cleanup() error {
+	return nil
+}
+
+// GetTarget implementation for the "mcu-firmware" handler
+func (m *MCUFirmwareObject) GetTarget() string {
+	return m.Device
+}
+
+// readImage returns the memory segments of the image
+func (m *MCUFirmwareObject) readImage(imagePath string) ([]segment, error) {
+	data, err := afero.ReadFile(m.FileSystemBackend, imagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Format == "hex" {
+		return parseIntelHex(data)
+	}
+
+	return []segment{{address: m.Address, data: data}}, nil
+}
+
+// deliver makes one attempt to deliver the image to the
+// microcontroller
+func (m *MCUFirmwareObject) deliver(imagePath string, segments []segment) error {
+	if m.ResetCommand != "" {
+		if _, err := m.Execute(m.ResetCommand); err != nil {
+			return err
+		}
+	}
+
+	if m.Protocol == "command" {
+		_, err := m.Execute(fmt.Sprintf("%s %s %s", m.FlasherCommand, m.Device, imagePath))
+		return err
+	}
+
+	// the reads time out after a second ("time" is in tenths of a
+	// second), the slow answers like the one to the STM32 erase are
+	// read again. The STM32 bootloader requires the even parity.
+	parity := "-parenb"
+	if m.Protocol == "stm32" {
+		parity = "parenb -parodd"
+	}
+
+	_, err := m.Execute(fmt.Sprintf("stty -F %s %d raw -echo cs8 %s -cstopb min 0 time 10", m.Device, m.BaudRate, parity))
+	if err != nil {
+		return err
+	}
+
+	open := m.openPort
+	if open == nil {
+		open = openSerialPort
+	}
+
+	port, err := open(m.Device)
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+
+	if m.Protocol == "stm32" {
+		return flashSTM32(port, segments)
+	}
+
+	return flashAVR(port, segments)
+}
+
+// confirmVersion checks the microcontroller runs the expected version
+func (m *MCUFirmwareObject) confirmVersion() error {
+	if m.Version == "" {
+		return nil
+	}
+
+	output, err := m.Execute(m.VersionCommand)
+	if err != nil {
+		return err
+	}
+
+	if version := strings.TrimSpace(string(output)); version != m.Version {
+		return fmt.Errorf("the microcontroller at '%s' runs the version '%s' instead of '%s'", m.Device, version, m.Version)
+	}
+
+	return nil
+}
+
+func openSerialPort(device string) (io.ReadWriteCloser, error) {
+	return os.OpenFile(device, os.O_RDWR, 0)
+}
@@ -0,0 +1,240 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package mcufirmware
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+func TestMCUFirmwareInit(t *testing.T) {
+	val, err := installmodes.GetObject("mcu-firmware")
+	assert.NoError(t, err)
+
+	m1, ok := val.(*MCUFirmwareObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"installmodes.GetObject()\" to MCUFirmwareObject")
+	}
+
+	m2, ok := getObject().(*MCUFirmwareObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"getObject()\" to MCUFirmwareObject")
+	}
+
+	assert.Equal(t, m2, m1)
+
+	_, ok = m1.CmdLineExecuter.(*utils.CmdLine)
+	if !ok {
+		t.Error("Failed to cast default implementation of \"CmdLineExecuter\" to CmdLine")
+	}
+}
+
+func TestMCUFirmwareSetup(t *testing.T) {
+	m := getObject().(*MCUFirmwareObject)
+	m.Device = "/dev/ttyUSB0"
+	m.Protocol = "stm32"
+	m.Retries = 0
+
+	assert.NoError(t, m.Setup())
+	assert.Equal(t, uint32(stm32FlashAddress), m.Address)
+	assert.Equal(t, 1, m.Retries)
+	assert.Equal(t, "/dev/ttyUSB0", m.GetTarget())
+}
+
+func TestMCUFirmwareSetupWithInvalidFields(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Object   MCUFirmwareObject
+		Expected string
+	}{
+		{
+			"MissingDevice",
+			MCUFirmwareObject{Protocol: "avr", Format: "bin"},
+			"the 'mcu-firmware' handler requires a 'device'",
+		},
+		{
+			"UnsupportedProtocol",
+			MCUFirmwareObject{Device: "/dev/ttyUSB0", Protocol: "pic", Format: "bin"},
+			"protocol 'pic' is not supported by the 'mcu-firmware' handler",
+		},
+		{
+			"MissingFlasherCommand",
+			MCUFirmwareObject{Device: "/dev/ttyUSB0", Protocol: "command", Format: "bin"},
+			"the 'command' protocol of the 'mcu-firmware' handler requires a 'flasher-command'",
+		},
+		{
+			"UnsupportedFormat",
+			MCUFirmwareObject{Device: "/dev/ttyUSB0", Protocol: "avr", Format: "elf"},
+			"format 'elf' is not supported by the 'mcu-firmware' handler",
+		},
+		{
+			"MissingVersionCommand",
+			MCUFirmwareObject{Device: "/dev/ttyUSB0", Protocol: "avr", Format: "bin", Version: "1.0"},
+			"the 'mcu-firmware' handler requires a 'version-command' to confirm the version",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.EqualError(t, tc.Object.Setup(), tc.Expected)
+		})
+	}
+}
+
+func TestMCUFirmwareInstallWithFlasherCommand(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "mcu-reset --bootloader").Return([]byte(""), nil)
+	clm.On("Execute", "mcu-flash /dev/ttyUSB0 /dummy-download-dir/sha256sum").Return([]byte("error"), fmt.Errorf("Error executing command")).Once()
+	clm.On("Execute", "mcu-flash /dev/ttyUSB0 /dummy-download-dir/sha256sum").Return([]byte(""), nil).Once()
+	clm.On("Execute", "mcu-version").Return([]byte("1.2.0\n"), nil)
+
+	m := MCUFirmwareObject{
+		CmdLineExecuter: clm,
+		Device:          "/dev/ttyUSB0",
+		Protocol:        "command",
+		Format:          "bin",
+		FlasherCommand:  "mcu-flash",
+		ResetCommand:    "mcu-reset --bootloader",
+		Retries:         2,
+		Version:         "1.2.0",
+		VersionCommand:  "mcu-version",
+	}
+	m.Sha256sum = "sha256sum"
+
+	assert.NoError(t, m.Setup())
+	assert.NoError(t, m.Install("/dummy-download-dir"))
+
+	clm.AssertNumberOfCalls(t, "Execute", 5)
+	clm.AssertExpectations(t)
+}
+
+func TestMCUFirmwareInstallWithFlasherFailure(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "mcu-flash /dev/ttyUSB0 /dummy-download-dir/sha256sum").Return([]byte("error"), fmt.Errorf("Error executing command"))
+
+	m := MCUFirmwareObject{
+		CmdLineExecuter: clm,
+		Device:          "/dev/ttyUSB0",
+		Protocol:        "command",
+		Format:          "bin",
+		FlasherCommand:  "mcu-flash",
+		Retries:         3,
+	}
+	m.Sha256sum = "sha256sum"
+
+	assert.EqualError(t, m.Install("/dummy-download-dir"), "Error executing command")
+
+	clm.AssertNumberOfCalls(t, "Execute", 3)
+	clm.AssertExpectations(t)
+}
+
+func TestMCUFirmwareInstallWithVersionMismatch(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "mcu-flash /dev/ttyUSB0 /dummy-download-dir/sha256sum").Return([]byte(""), nil)
+	clm.On("Execute", "mcu-version").Return([]byte("1.1.0\n"), nil)
+
+	m := MCUFirmwareObject{
+		CmdLineExecuter: clm,
+		Device:          "/dev/ttyUSB0",
+		Protocol:        "command",
+		Format:          "bin",
+		FlasherCommand:  "mcu-flash",
+		Retries:         1,
+		Version:         "1.2.0",
+		VersionCommand:  "mcu-version",
+	}
+	m.Sha256sum = "sha256sum"
+
+	assert.EqualError(t, m.Install("/dummy-download-dir"), "the microcontroller at '/dev/ttyUSB0' runs the version '1.1.0' instead of '1.2.0'")
+
+	clm.AssertExpectations(t)
+}
+
+func TestMCUFirmwareInstallWithSTM32Bootloader(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	err := afero.WriteFile(fs, "/dummy-download-dir/sha256sum", []byte(testIntelHex), 0644)
+	assert.NoError(t, err)
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "stty -F /dev/ttyUSB0 57600 raw -echo cs8 parenb -parodd -cstopb min 0 time 10").Return([]byte(""), nil)
+
+	f := newFakeSTM32(true)
+
+	m := MCUFirmwareObject{
+		CmdLineExecuter:   clm,
+		FileSystemBackend: fs,
+		Device:            "/dev/ttyUSB0",
+		Protocol:          "stm32",
+		Format:            "hex",
+		BaudRate:          57600,
+		Retries:           1,
+		openPort: func(device string) (io.ReadWriteCloser, error) {
+			assert.Equal(t, "/dev/ttyUSB0", device)
+			return f, nil
+		},
+	}
+	m.Sha256sum = "sha256sum"
+
+	assert.NoError(t, m.Setup())
+	assert.NoError(t, m.Install("/dummy-download-dir"))
+
+	assert.Equal(t, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}, f.read(0x08000000, 6))
+	assert.Equal(t, uint32(0x08000000), f.started)
+
+	clm.AssertExpectations(t)
+}
+
+func TestMCUFirmwareInstallWithAVRBootloader(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	err := afero.WriteFile(fs, "/dummy-download-dir/sha256sum", []byte{0x0C, 0x94, 0x5C, 0x00}, 0644)
+	assert.NoError(t, err)
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "stty -F /dev/ttyACM0 115200 raw -echo cs8 -parenb -cstopb min 0 time 10").Return([]byte(""), nil)
+
+	f := newFakeAVR()
+
+	m := getObject().(*MCUFirmwareObject)
+	m.CmdLineExecuter = clm
+	m.FileSystemBackend = fs
+	m.Device = "/dev/ttyACM0"
+	m.Protocol = "avr"
+	m.openPort = func(device string) (io.ReadWriteCloser, error) {
+		return f, nil
+	}
+	m.Sha256sum = "sha256sum"
+
+	assert.NoError(t, m.Setup())
+	assert.NoError(t, m.Install("/dummy-download-dir"))
+
+	assert.Equal(t, map[uint32]byte{0: 0x0C, 1: 0x94, 2: 0x5C, 3: 0x00}, f.flash)
+	assert.True(t, f.left)
+
+	clm.AssertExpectations(t)
+}
+
+func TestMCUFirmwareInstallWithMissingImage(t *testing.T) {
+	m := getObject().(*MCUFirmwareObject)
+	m.FileSystemBackend = afero.NewMemMapFs()
+	m.Device = "/dev/ttyACM0"
+	m.Protocol = "avr"
+	m.Sha256sum = "sha256sum"
+
+	assert.Error(t, m.Install("/dummy-download-dir"))
+}
@@ -0,0 +1,254 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package mcufirmware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// the STM32 bootloader protocol (AN3155)
+const (
+	stm32Sync          = 0x7F
+	stm32Ack           = 0x79
+	stm32Nack          = 0x1F
+	stm32Get           = 0x00
+	stm32ReadMemory    = 0x11
+	stm32Go            = 0x21
+	stm32WriteMemory   = 0x31
+	stm32Erase         = 0x43
+	stm32ExtendedErase = 0x44
+
+	// the most bytes a write or read memory command transfers
+	stm32BlockSize = 256
+)
+
+// stm32EraseTimeout is how long the bootloader may take to answer the
+// global erase, which lasts tens of seconds on the big flashes. Each
+// read of the port still times out after a second.
+var stm32EraseTimeout = 60 * time.Second
+
+// flashSTM32 erases the flash of the microcontroller, writes and
+// verifies the segments, then starts the firmware
+func flashSTM32(port io.ReadWriter, segments []segment) error {
+	if _, err := port.Write([]byte{stm32Sync}); err != nil {
+		return err
+	}
+
+	if err := stm32ReadAck(port); err != nil {
+		return err
+	}
+
+	commands, err := stm32GetCommands(port)
+	if err != nil {
+		return err
+	}
+
+	if err := stm32EraseAll(port, commands); err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		for offset := 0; offset < len(s.data); offset += stm32BlockSize {
+			end := offset + stm32BlockSize
+			if end > len(s.data) {
+				end = len(s.data)
+			}
+
+			address := s.address + uint32(offset)
+
+			if err := stm32WriteBlock(port, address, s.data[offset:end]); err != nil {
+				return err
+			}
+
+			if err := stm32VerifyBlock(port, address, s.data[offset:end]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(segments) == 0 {
+		return nil
+	}
+
+	if err := stm32SendCommand(port, stm32Go); err != nil {
+		return err
+	}
+
+	return stm32SendAddress(port, segments[0].address)
+}
+
+// stm32ReadAck reads the answer of the bootloader
+func stm32ReadAck(port io.Reader) error {
+	b, err := stm32ReadByte(port)
+	if err != nil {
+		return err
+	}
+
+	return stm32CheckAck(b)
+}
+
+// stm32ReadSlowAck reads the answer of the bootloader to a command
+// that takes up to "timeout", the port is read again until then
+func stm32ReadSlowAck(port io.Reader, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		b, err := stm32ReadByte(port)
+		if err == nil {
+			return stm32CheckAck(b)
+		}
+
+		if time.Now().After(deadline) {
+			return err
+		}
+	}
+}
+
+func stm32CheckAck(b byte) error {
+	switch b {
+	case stm32Ack:
+		return nil
+	case stm32Nack:
+		return fmt.Errorf("the STM32 bootloader refused the command")
+	}
+
+	return fmt.Errorf("unexpected answer 0x%02x from the STM32 bootloader", b)
+}
+
+func stm32ReadByte(port io.Reader) (byte, error) {
+	b := make([]byte, 1)
+
+	n, err := port.Read(b)
+	if n == 0 {
+		if err == nil || err == io.EOF {
+			err = fmt.Errorf("no answer from the STM32 bootloader")
+		}
+
+		return 0, err
+	}
+
+	return b[0], nil
+}
+
+// stm32SendCommand sends the command followed by its complement
+func stm32SendCommand(port io.ReadWriter, command byte) error {
+	if _, err := port.Write([]byte{command, command ^ 0xFF}); err != nil {
+		return err
+	}
+
+	return stm32ReadAck(port)
+}
+
+// stm32SendData sends the data followed by its XOR checksum
+func stm32SendData(port io.ReadWriter, data []byte) error {
+	var checksum byte
+	for _, b := range data {
+		checksum ^= b
+	}
+
+	if _, err := port.Write(append(append([]byte{}, data...), checksum)); err != nil {
+		return err
+	}
+
+	return stm32ReadAck(port)
+}
+
+func stm32SendAddress(port io.ReadWriter, address uint32) error {
+	return stm32SendData(port, []byte{byte(address >> 24), byte(address >> 16), byte(address >> 8), byte(address)})
+}
+
+// stm32GetCommands returns the commands supported by the bootloader
+func stm32GetCommands(port io.ReadWriter) ([]byte, error) {
+	if err := stm32SendCommand(port, stm32Get); err != nil {
+		return nil, err
+	}
+
+	n, err := stm32ReadByte(port)
+	if err != nil {
+		return nil, err
+	}
+
+	// the bootloader version and the commands
+	answer := make([]byte, int(n)+1)
+	if _, err := io.ReadFull(port, answer); err != nil {
+		return nil, err
+	}
+
+	return answer[1:], stm32ReadAck(port)
+}
+
+// stm32EraseAll makes a global erase, through the extended erase
+// command when the bootloader supports it. The bootloader answers once
+// the flash is erased.
+func stm32EraseAll(port io.ReadWriter, commands []byte) error {
+	// the special code of the global erase followed by its checksum
+	code := []byte{0xFF, 0xFF, 0x00}
+	command := byte(stm32ExtendedErase)
+
+	if bytes.IndexByte(commands, stm32ExtendedErase) < 0 {
+		code = []byte{0xFF, 0x00}
+		command = stm32Erase
+	}
+
+	if err := stm32SendCommand(port, command); err != nil {
+		return err
+	}
+
+	if _, err := port.Write(code); err != nil {
+		return err
+	}
+
+	return stm32ReadSlowAck(port, stm32EraseTimeout)
+}
+
+func stm32WriteBlock(port io.ReadWriter, address uint32, data []byte) error {
+	// the flash is written in words
+	block := append([]byte{}, data...)
+	for len(block)%4 != 0 {
+		block = append(block, 0xFF)
+	}
+
+	if err := stm32SendCommand(port, stm32WriteMemory); err != nil {
+		return err
+	}
+
+	if err := stm32SendAddress(port, address); err != nil {
+		return err
+	}
+
+	return stm32SendData(port, append([]byte{byte(len(block) - 1)}, block...))
+}
+
+func stm32VerifyBlock(port io.ReadWriter, address uint32, data []byte) error {
+	if err := stm32SendCommand(port, stm32ReadMemory); err != nil {
+		return err
+	}
+
+	if err := stm32SendAddress(port, address); err != nil {
+		return err
+	}
+
+	if err := stm32SendCommand(port, byte(len(data)-1)); err != nil {
+		return err
+	}
+
+	written := make([]byte, len(data))
+	if _, err := io.ReadFull(port, written); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(written, data) {
+		return fmt.Errorf("the STM32 flash at 0x%08x doesn't match the image", address)
+	}
+
+	return nil
+}
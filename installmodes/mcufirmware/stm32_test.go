@@ -0,0 +1,217 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package mcufirmware
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSTM32 emulates the STM32 bootloader, each frame must be
+// written at once
+type fakeSTM32 struct {
+	bytes.Buffer
+
+	extendedErase bool
+	corrupt       bool
+
+	// the reads which find nothing while the flash is erased
+	eraseReads int
+
+	flash   map[uint32]byte
+	erased  bool
+	started uint32
+	state   string
+	address uint32
+}
+
+func newFakeSTM32(extendedErase bool) *fakeSTM32 {
+	return &fakeSTM32{extendedErase: extendedErase, flash: map[uint32]byte{}, state: "sync"}
+}
+
+func (f *fakeSTM32) ack() {
+	f.WriteByte(stm32Ack)
+}
+
+func (f *fakeSTM32) Write(p []byte) (int, error) {
+	switch f.state {
+	case "sync":
+		if len(p) == 1 && p[0] == stm32Sync {
+			f.ack()
+			f.state = "idle"
+		}
+	case "idle":
+		f.ack()
+
+		switch p[0] {
+		case stm32Get:
+			erase := byte(stm32Erase)
+			if f.extendedErase {
+				erase = stm32ExtendedErase
+			}
+
+			f.Buffer.Write([]byte{5, 0x31, stm32Get, stm32ReadMemory, stm32Go, stm32WriteMemory, erase})
+			f.ack()
+		case stm32Erase, stm32ExtendedErase:
+			f.state = "erase"
+		case stm32WriteMemory:
+			f.state = "write-address"
+		case stm32ReadMemory:
+			f.state = "read-address"
+		case stm32Go:
+			f.state = "go-address"
+		}
+	case "erase":
+		f.erased = true
+		f.state = "idle"
+
+		if f.eraseReads > 0 {
+			f.state = "erasing"
+		} else {
+			f.ack()
+		}
+	case "write-address", "read-address", "go-address":
+		f.address = uint32(p[0])<<24 | uint32(p[1])<<16 | uint32(p[2])<<8 | uint32(p[3])
+		f.ack()
+
+		switch f.state {
+		case "write-address":
+			f.state = "write-data"
+		case "read-address":
+			f.state = "read-size"
+		default:
+			f.started = f.address
+			f.state = "idle"
+		}
+	case "write-data":
+		for i, b := range p[1 : len(p)-1] {
+			f.flash[f.address+uint32(i)] = b
+		}
+
+		f.state = "idle"
+		f.ack()
+	case "read-size":
+		f.ack()
+
+		for i := uint32(0); i <= uint32(p[0]); i++ {
+			b := f.flash[f.address+i]
+			if f.corrupt {
+				b ^= 0xFF
+			}
+
+			f.WriteByte(b)
+		}
+
+		f.state = "idle"
+	}
+
+	return len(p), nil
+}
+
+func (f *fakeSTM32) Read(p []byte) (int, error) {
+	if f.state == "erasing" {
+		if f.eraseReads > 0 {
+			f.eraseReads--
+			return 0, io.EOF
+		}
+
+		f.state = "idle"
+		f.ack()
+	}
+
+	return f.Buffer.Read(p)
+}
+
+func (f *fakeSTM32) Close() error {
+	return nil
+}
+
+func (f *fakeSTM32) read(address uint32, size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = f.flash[address+uint32(i)]
+	}
+
+	return data
+}
+
+func TestFlashSTM32(t *testing.T) {
+	data := bytes.Repeat([]byte{0x01, 0x02, 0x03}, 202)
+
+	for _, extendedErase := range []bool{false, true} {
+		f := newFakeSTM32(extendedErase)
+
+		err := flashSTM32(f, []segment{{address: stm32FlashAddress, data: data}})
+		assert.NoError(t, err)
+
+		assert.True(t, f.erased)
+		assert.Equal(t, data, f.read(stm32FlashAddress, len(data)))
+		// the last word was padded
+		assert.Equal(t, []byte{0xFF, 0xFF}, f.read(stm32FlashAddress+uint32(len(data)), 2))
+		assert.Equal(t, uint32(stm32FlashAddress), f.started)
+	}
+}
+
+func TestFlashSTM32WithSlowErase(t *testing.T) {
+	for _, extendedErase := range []bool{false, true} {
+		f := newFakeSTM32(extendedErase)
+		f.eraseReads = 30
+
+		err := flashSTM32(f, []segment{{address: stm32FlashAddress, data: []byte{0x01, 0x02, 0x03, 0x04}}})
+		assert.NoError(t, err)
+
+		assert.True(t, f.erased)
+		assert.Equal(t, uint32(stm32FlashAddress), f.started)
+	}
+}
+
+func TestFlashSTM32WithEraseTimeout(t *testing.T) {
+	defer func(timeout time.Duration) {
+		stm32EraseTimeout = timeout
+	}(stm32EraseTimeout)
+
+	stm32EraseTimeout = 10 * time.Millisecond
+
+	f := newFakeSTM32(true)
+	f.eraseReads = math.MaxInt32
+
+	err := flashSTM32(f, []segment{{address: stm32FlashAddress, data: []byte{0x01}}})
+	assert.EqualError(t, err, "no answer from the STM32 bootloader")
+	assert.Equal(t, uint32(0), f.started)
+}
+
+func TestFlashSTM32WithVerifyFailure(t *testing.T) {
+	f := newFakeSTM32(true)
+	f.corrupt = true
+
+	err := flashSTM32(f, []segment{{address: stm32FlashAddress, data: []byte{0x01, 0x02, 0x03, 0x04}}})
+	assert.EqualError(t, err, "the STM32 flash at 0x08000000 doesn't match the image")
+	assert.Equal(t, uint32(0), f.started)
+}
+
+func TestFlashSTM32WithoutBootloader(t *testing.T) {
+	f := newFakeSTM32(true)
+	f.state = "silent"
+
+	err := flashSTM32(f, []segment{{address: stm32FlashAddress, data: []byte{0x01}}})
+	assert.EqualError(t, err, "no answer from the STM32 bootloader")
+}
+
+func TestFlashSTM32WithNack(t *testing.T) {
+	port := &bytes.Buffer{}
+	port.WriteByte(stm32Nack)
+
+	err := flashSTM32(port, nil)
+	assert.EqualError(t, err, "the STM32 bootloader refused the command")
+}
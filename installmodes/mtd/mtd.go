@@ -0,0 +1,236 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package mtd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/installifdifferent"
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+func init() {
+	installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "mtd",
+		CheckRequirements: checkRequirements,
+		GetObject:         getObject,
+	})
+}
+
+func checkRequirements() error {
+	for _, binary := range []string{"nandwrite", "nanddump", "flash_erase"} {
+		_, err := exec.LookPath(binary)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getObject() interface{} {
+	return &MtdObject{
+		CmdLineExecuter:   &utils.CmdLine{},
+		FileSystemBackend: afero.NewOsFs(),
+		MtdUtils:          &utils.MtdUtilsImpl{},
+	}
+}
+
+// MtdObject encapsulates the "mtd" handler data and functions. It
+// writes an image at "offset" of a raw MTD partition. On NAND devices
+// the bad blocks are skipped both when erasing, writing and reading
+// the image back.
+type MtdObject struct {
+	metadata.ObjectMetadata
+	utils.CmdLineExecuter
+	FileSystemBackend afero.Fs
+	utils.MtdUtils
+	installifdifferent.TargetGetter
+
+	Target     string `json:"target"`
+	TargetType string `json:"target-type"`
+	Offset     int64  `json:"offset,omitempty"`
+	Erase      *bool  `json:"erase?,omitempty"`
+	Verify     bool   `json:"verify?,omitempty"`
+
+	targetDevice string // this is NOT obtained from the json but from the "Setup()"
+}
+
+// Setup implementation for the "mtd" handler
+func (m *MtdObject) Setup() error {
+	switch m.TargetType {
+	case "device":
+		m.targetDevice = m.Target
+	case "mtdname":
+		td, err := m.MtdUtils.GetTargetDeviceFromMtdName(m.FileSystemBackend, m.Target)
+		if err != nil {
+			return err
+		}
+
+		m.targetDevice = td
+	default:
+		return fmt.Errorf("target-type '%s' is not supported for the 'mtd' handler. Its value must be either 'device' or 'mtdname'", m.TargetType)
+	}
+
+	if m.Offset < 0 {
+		return fmt.Errorf("offset must not be negative for the 'mtd' handler")
+	}
+
+	return nil
+}
+
+// Install implementation for the "mtd" handler
+func (m *MtdObject) Install(downloadDir string) error {
+	isNand, err := m.MtdUtils.MtdIsNAND(m.targetDevice)
+	if err != nil {
+		return err
+	}
+
+	// erase from the offset up to the end of the partition, it is the
+	// default since the flash can't be written otherwise
+	if m.Erase == nil || *m.Erase {
+		_, err = m.Execute(fmt.Sprintf("flash_erase %s %d 0", m.targetDevice, m.Offset))
+		if err != nil {
+			return err
+		}
+	}
+
+	srcPath := path.Join(downloadDir, m.Sha256sum)
+
+	if isNand {
+		_, err = m.Execute(fmt.Sprintf("nandwrite -p -s %d %s %s", m.Offset, m.targetDevice, srcPath))
+	} else {
+		err = m.writeNOR(srcPath)
+	}
+
+	if err != nil || !m.Verify {
+		return err
+	}
+
+	return m.verify(srcPath, isNand)
+}
+
+// Cleanup implementation for the "mtd" handler
+func (m *MtdObject) Cleanup() error {
+	return nil
+}
+
+// GetTarget implementation for the "mtd" handler
+func (m *MtdObject) GetTarget() string {
+	return m.targetDevice + "ro"
+}
+
+// GetTargetRange implementation for the "mtd" handler, only the
+// image is probed. A NAND bad block within it makes the image to be
+// installed again.
+func (m *MtdObject) GetTargetRange() (int64, int64) {
+	return m.Offset, m.Size
+}
+
+func (m *MtdObject) writeNOR(srcPath string) error {
+	source, err := m.FileSystemBackend.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := m.FileSystemBackend.OpenFile(m.targetDevice, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	_, err = target.Seek(m.Offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(target, source)
+
+	return err
+}
+
+// verify reads the image back from the device and compares it to
+// "srcPath". The NAND pages are dumped by "nanddump", which skips
+// the same bad blocks skipped by "nandwrite".
+func (m *MtdObject) verify(srcPath string, isNand bool) error {
+	info, err := m.FileSystemBackend.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+
+	size := info.Size()
+
+	readBackPath := m.targetDevice
+	readBackOffset := m.Offset
+
+	if isNand {
+		readBackPath = srcPath + ".readback"
+		readBackOffset = 0
+
+		defer m.FileSystemBackend.Remove(readBackPath)
+
+		_, err = m.Execute(fmt.Sprintf("nanddump -q --bb=skipbad --omitoob -s %d -l %d -f %s %s", m.Offset, size, readBackPath, m.targetDevice))
+		if err != nil {
+			return err
+		}
+	}
+
+	expected, err := m.sha256sum(srcPath, 0, size)
+	if err != nil {
+		return err
+	}
+
+	written, err := m.sha256sum(readBackPath, readBackOffset, size)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(expected, written) {
+		return fmt.Errorf("the data read back from '%s' doesn't match the image", m.targetDevice)
+	}
+
+	return nil
+}
+
+func (m *MtdObject) sha256sum(filePath string, offset int64, size int64) ([]byte, error) {
+	file, err := m.FileSystemBackend.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+
+	n, err := io.CopyN(hash, file, size)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if n != size {
+		return nil, fmt.Errorf("the data read back from '%s' is %d bytes long instead of %d", m.targetDevice, n, size)
+	}
+
+	return hash.Sum(nil), nil
+}
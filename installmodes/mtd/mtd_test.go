@@ -0,0 +1,243 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package mtd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/installmodes/internal/testsutils"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+	"github.com/UpdateHub/updatehub/testsmocks/mtdmock"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+const (
+	downloadDir = "/dummy-download-dir"
+	sha256sum   = "71c88745e5a72067f94aae0ecec6d45af8b0f6e1a37ef695df0b56711e192b86"
+)
+
+func newTestMtdObject(t *testing.T, isNand bool) (*MtdObject, *cmdlinemock.CmdLineExecuterMock, *mtdmock.MtdUtilsMock) {
+	fs := afero.NewMemMapFs()
+
+	err := afero.WriteFile(fs, path.Join(downloadDir, sha256sum), []byte("image"), 0644)
+	assert.NoError(t, err)
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	mum := &mtdmock.MtdUtilsMock{}
+	mum.On("MtdIsNAND", "/dev/mtd3").Return(isNand, nil)
+
+	m := &MtdObject{
+		CmdLineExecuter:   clm,
+		FileSystemBackend: fs,
+		MtdUtils:          mum,
+		Target:            "/dev/mtd3",
+		TargetType:        "device",
+	}
+	m.Sha256sum = sha256sum
+
+	assert.NoError(t, m.Setup())
+
+	return m, clm, mum
+}
+
+func TestMtdInit(t *testing.T) {
+	val, err := installmodes.GetObject("mtd")
+	assert.NoError(t, err)
+
+	m1, ok := val.(*MtdObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"installmodes.GetObject()\" to MtdObject")
+	}
+
+	m2, ok := getObject().(*MtdObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"getObject()\" to MtdObject")
+	}
+
+	assert.Equal(t, m2, m1)
+
+	_, ok = m1.CmdLineExecuter.(*utils.CmdLine)
+	if !ok {
+		t.Error("Failed to cast default implementation of \"CmdLineExecuter\" to CmdLine")
+	}
+}
+
+func TestMtdCheckRequirements(t *testing.T) {
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+
+	for _, binary := range []string{"nandwrite", "nanddump", "flash_erase"} {
+		t.Run(binary, func(t *testing.T) {
+			testPath := testsutils.SetupCheckRequirementsDir(t, []string{"nandwrite", "nanddump", "flash_erase"})
+			defer os.RemoveAll(testPath)
+
+			err := os.Setenv("PATH", testPath)
+			assert.NoError(t, err)
+
+			assert.NoError(t, checkRequirements())
+
+			os.Remove(path.Join(testPath, binary))
+			assert.EqualError(t, checkRequirements(), fmt.Sprintf("exec: \"%s\": executable file not found in $PATH", binary))
+		})
+	}
+}
+
+func TestMtdSetup(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	mum := &mtdmock.MtdUtilsMock{}
+	mum.On("GetTargetDeviceFromMtdName", fs, "system0").Return("/dev/mtd3", nil)
+
+	m := MtdObject{FileSystemBackend: fs, MtdUtils: mum, Target: "system0", TargetType: "mtdname", Offset: 4096}
+	m.Size = 1024
+	assert.NoError(t, m.Setup())
+	assert.Equal(t, "/dev/mtd3ro", m.GetTarget())
+
+	offset, size := m.GetTargetRange()
+	assert.Equal(t, int64(4096), offset)
+	assert.Equal(t, int64(1024), size)
+
+	mum.AssertExpectations(t)
+}
+
+func TestMtdSetupWithInvalidObject(t *testing.T) {
+	m := MtdObject{TargetType: "ubivolume"}
+	assert.EqualError(t, m.Setup(), "target-type 'ubivolume' is not supported for the 'mtd' handler. Its value must be either 'device' or 'mtdname'")
+
+	m = MtdObject{TargetType: "device", Offset: -1}
+	assert.EqualError(t, m.Setup(), "offset must not be negative for the 'mtd' handler")
+}
+
+func TestMtdInstallNAND(t *testing.T) {
+	m, clm, mum := newTestMtdObject(t, true)
+	m.Offset = 131072
+
+	clm.On("Execute", "flash_erase /dev/mtd3 131072 0").Return([]byte(""), nil)
+	clm.On("Execute", fmt.Sprintf("nandwrite -p -s 131072 /dev/mtd3 %s", path.Join(downloadDir, sha256sum))).Return([]byte(""), nil)
+
+	assert.NoError(t, m.Install(downloadDir))
+
+	clm.AssertExpectations(t)
+	mum.AssertExpectations(t)
+}
+
+func TestMtdInstallNANDWithoutErase(t *testing.T) {
+	m, clm, mum := newTestMtdObject(t, true)
+
+	erase := false
+	m.Erase = &erase
+
+	clm.On("Execute", fmt.Sprintf("nandwrite -p -s 0 /dev/mtd3 %s", path.Join(downloadDir, sha256sum))).Return([]byte(""), nil)
+
+	assert.NoError(t, m.Install(downloadDir))
+
+	clm.AssertExpectations(t)
+	mum.AssertExpectations(t)
+}
+
+func TestMtdInstallNANDWithVerify(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		ReadBack string
+		Expected string
+	}{
+		{"Match", "image\xff\xff\xff", ""},
+		{"Mismatch", "imagf\xff\xff\xff", "the data read back from '/dev/mtd3' doesn't match the image"},
+		{"Short", "ima", "the data read back from '/dev/mtd3' is 3 bytes long instead of 5"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			m, clm, mum := newTestMtdObject(t, true)
+			m.Verify = true
+
+			srcPath := path.Join(downloadDir, sha256sum)
+			readBackPath := srcPath + ".readback"
+
+			clm.On("Execute", "flash_erase /dev/mtd3 0 0").Return([]byte(""), nil)
+			clm.On("Execute", fmt.Sprintf("nandwrite -p -s 0 /dev/mtd3 %s", srcPath)).Return([]byte(""), nil)
+			clm.On("Execute", fmt.Sprintf("nanddump -q --bb=skipbad --omitoob -s 0 -l 5 -f %s /dev/mtd3", readBackPath)).Run(func(args mock.Arguments) {
+				afero.WriteFile(m.FileSystemBackend, readBackPath, []byte(tc.ReadBack), 0644)
+			}).Return([]byte(""), nil)
+
+			err := m.Install(downloadDir)
+			if tc.Expected == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.Expected)
+			}
+
+			exists, _ := afero.Exists(m.FileSystemBackend, readBackPath)
+			assert.False(t, exists)
+
+			clm.AssertExpectations(t)
+			mum.AssertExpectations(t)
+		})
+	}
+}
+
+func TestMtdInstallNORWithVerify(t *testing.T) {
+	m, clm, mum := newTestMtdObject(t, false)
+	m.Offset = 2
+	m.Verify = true
+
+	err := afero.WriteFile(m.FileSystemBackend, "/dev/mtd3", []byte("\xff\xff\xff\xff\xff\xff\xff\xff"), 0644)
+	assert.NoError(t, err)
+
+	clm.On("Execute", "flash_erase /dev/mtd3 2 0").Return([]byte(""), nil)
+
+	assert.NoError(t, m.Install(downloadDir))
+
+	data, err := afero.ReadFile(m.FileSystemBackend, "/dev/mtd3")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("\xff\xffimage\xff"), data)
+
+	clm.AssertExpectations(t)
+	mum.AssertExpectations(t)
+}
+
+func TestMtdInstallWithEraseFailure(t *testing.T) {
+	m, clm, mum := newTestMtdObject(t, true)
+
+	clm.On("Execute", "flash_erase /dev/mtd3 0 0").Return([]byte("error"), fmt.Errorf("Error executing command"))
+
+	assert.EqualError(t, m.Install(downloadDir), "Error executing command")
+
+	clm.AssertExpectations(t)
+	mum.AssertExpectations(t)
+}
+
+func TestMtdInstallWithMtdIsNANDFailure(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	mum := &mtdmock.MtdUtilsMock{}
+	mum.On("MtdIsNAND", "/dev/mtd3").Return(false, fmt.Errorf("MTD error"))
+
+	m := MtdObject{CmdLineExecuter: clm, MtdUtils: mum, Target: "/dev/mtd3", TargetType: "device"}
+	assert.NoError(t, m.Setup())
+
+	assert.EqualError(t, m.Install(downloadDir), "MTD error")
+
+	clm.AssertExpectations(t)
+	mum.AssertExpectations(t)
+}
+
+func TestMtdCleanupNil(t *testing.T) {
+	m := MtdObject{}
+	assert.Nil(t, m.Cleanup())
+}
@@ -0,0 +1,116 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package ostree
+
+import (
+	"fmt"
+	"os/exec"
+	"path"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+func init() {
+	installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "ostree",
+		CheckRequirements: checkRequirements,
+		GetObject:         getObject,
+	})
+}
+
+func checkRequirements() error {
+	_, err := exec.LookPath("ostree")
+
+	return err
+}
+
+func getObject() interface{} {
+	return &OSTreeObject{
+		CmdLineExecuter: &utils.CmdLine{},
+	}
+}
+
+const defaultRepo = "/ostree/repo"
+
+// OSTreeObject encapsulates the "ostree" handler data and functions. The
+// commit is either applied from a static delta shipped in the package
+// or pulled from "remote", then it is deployed. The booted deployment
+// is kept by OSTree, so the system can still boot into it if the new
+// one fails.
+type OSTreeObject struct {
+	metadata.ObjectMetadata
+	utils.CmdLineExecuter
+
+	Repo         string `json:"repo,omitempty"`
+	Remote       string `json:"remote,omitempty"`
+	Ref          string `json:"ref,omitempty"`
+	Commit       string `json:"commit,omitempty"`
+	OSName       string `json:"os,omitempty"`
+	NotAsDefault bool   `json:"not-as-default?,omitempty"`
+
+	revision string // this is NOT obtained from the json but from the "Setup()"
+}
+
+// Setup implementation for the "ostree" handler
+func (o *OSTreeObject) Setup() error {
+	if o.Repo == "" {
+		o.Repo = defaultRepo
+	}
+
+	switch {
+	case o.Remote != "" && o.Ref != "":
+		o.revision = fmt.Sprintf("%s:%s", o.Remote, o.Ref)
+	case o.Remote == "" && o.Ref == "" && o.Commit != "":
+		o.revision = o.Commit
+	default:
+		return fmt.Errorf("the 'ostree' handler requires either both 'remote' and 'ref' or a 'commit' applied from a static delta")
+	}
+
+	return nil
+}
+
+// Install implementation for the "ostree" handler
+func (o *OSTreeObject) Install(downloadDir string) error {
+	var cmdline string
+	if o.Remote != "" {
+		cmdline = fmt.Sprintf("ostree pull --repo=%s %s %s", o.Repo, o.Remote, o.Ref)
+	} else {
+		cmdline = fmt.Sprintf("ostree static-delta apply-offline --repo=%s %s", o.Repo, path.Join(downloadDir, o.Sha256sum))
+	}
+
+	_, err := o.Execute(cmdline)
+	if err != nil {
+		return err
+	}
+
+	cmdline = "ostree admin deploy"
+
+	if o.OSName != "" {
+		cmdline += " --os=" + o.OSName
+	}
+
+	// on active/inactive updates the deployment to boot is chosen by
+	// the "updatehub-active-set" of the device, after the install
+	if o.NotAsDefault {
+		cmdline += " --not-as-default"
+	}
+
+	cmdline += " " + o.revision
+
+	_, err = o.Execute(cmdline)
+
+	return err
+}
+
+// Cleanup implementation for the "ostree" handler
+func (o *OSTreeObject) Cleanup() error {
+	return nil
+}
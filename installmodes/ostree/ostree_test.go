@@ -0,0 +1,143 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package ostree
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/installmodes/internal/testsutils"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+func TestOSTreeInit(t *testing.T) {
+	val, err := installmodes.GetObject("ostree")
+	assert.NoError(t, err)
+
+	o1, ok := val.(*OSTreeObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"installmodes.GetObject()\" to OSTreeObject")
+	}
+
+	o2, ok := getObject().(*OSTreeObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"getObject()\" to OSTreeObject")
+	}
+
+	assert.Equal(t, o2, o1)
+
+	_, ok = o1.CmdLineExecuter.(*utils.CmdLine)
+	if !ok {
+		t.Error("Failed to cast default implementation of \"CmdLineExecuter\" to CmdLine")
+	}
+}
+
+func TestOSTreeCheckRequirements(t *testing.T) {
+	testPath := testsutils.SetupCheckRequirementsDir(t, []string{"ostree"})
+	defer os.RemoveAll(testPath)
+
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+
+	err := os.Setenv("PATH", testPath)
+	assert.NoError(t, err)
+
+	assert.NoError(t, checkRequirements())
+
+	os.Remove(testPath + "/ostree")
+	assert.EqualError(t, checkRequirements(), "exec: \"ostree\": executable file not found in $PATH")
+}
+
+func TestOSTreeSetup(t *testing.T) {
+	o := OSTreeObject{Remote: "origin", Ref: "os/stable"}
+	assert.NoError(t, o.Setup())
+	assert.Equal(t, defaultRepo, o.Repo)
+	assert.Equal(t, "origin:os/stable", o.revision)
+
+	o = OSTreeObject{Repo: "/sysroot/ostree/repo", Commit: "3c8f1ab"}
+	assert.NoError(t, o.Setup())
+	assert.Equal(t, "/sysroot/ostree/repo", o.Repo)
+	assert.Equal(t, "3c8f1ab", o.revision)
+}
+
+func TestOSTreeSetupWithMissingRevision(t *testing.T) {
+	testCases := []OSTreeObject{
+		{},
+		{Remote: "origin"},
+		{Ref: "os/stable", Commit: "3c8f1ab"},
+	}
+
+	for _, o := range testCases {
+		err := o.Setup()
+		assert.EqualError(t, err, "the 'ostree' handler requires either both 'remote' and 'ref' or a 'commit' applied from a static delta")
+	}
+}
+
+func TestOSTreeInstallFromStaticDelta(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "ostree static-delta apply-offline --repo=/ostree/repo /dummy-download-dir/sha256sum").Return([]byte(""), nil)
+	clm.On("Execute", "ostree admin deploy --os=apollo --not-as-default 3c8f1ab").Return([]byte(""), nil)
+
+	o := OSTreeObject{CmdLineExecuter: clm, Commit: "3c8f1ab", OSName: "apollo", NotAsDefault: true}
+	o.Sha256sum = "sha256sum"
+
+	assert.NoError(t, o.Setup())
+	assert.NoError(t, o.Install("/dummy-download-dir"))
+
+	clm.AssertExpectations(t)
+}
+
+func TestOSTreeInstallFromRemote(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "ostree pull --repo=/ostree/repo origin os/stable").Return([]byte(""), nil)
+	clm.On("Execute", "ostree admin deploy origin:os/stable").Return([]byte(""), nil)
+
+	o := OSTreeObject{CmdLineExecuter: clm, Remote: "origin", Ref: "os/stable"}
+
+	assert.NoError(t, o.Setup())
+	assert.NoError(t, o.Install("/dummy-download-dir"))
+
+	clm.AssertExpectations(t)
+}
+
+func TestOSTreeInstallWithPullFailure(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "ostree pull --repo=/ostree/repo origin os/stable").Return([]byte("error"), fmt.Errorf("Error executing command"))
+
+	o := OSTreeObject{CmdLineExecuter: clm, Remote: "origin", Ref: "os/stable"}
+
+	assert.NoError(t, o.Setup())
+	assert.EqualError(t, o.Install("/dummy-download-dir"), "Error executing command")
+
+	clm.AssertExpectations(t)
+}
+
+func TestOSTreeInstallWithDeployFailure(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "ostree static-delta apply-offline --repo=/ostree/repo /dummy-download-dir/sha256sum").Return([]byte(""), nil)
+	clm.On("Execute", "ostree admin deploy 3c8f1ab").Return([]byte("error"), fmt.Errorf("Error executing command"))
+
+	o := OSTreeObject{CmdLineExecuter: clm, Commit: "3c8f1ab"}
+	o.Sha256sum = "sha256sum"
+
+	assert.NoError(t, o.Setup())
+	assert.EqualError(t, o.Install("/dummy-download-dir"), "Error executing command")
+
+	clm.AssertExpectations(t)
+}
+
+func TestOSTreeCleanupNil(t *testing.T) {
+	o := OSTreeObject{}
+	assert.Nil(t, o.Cleanup())
+}
@@ -0,0 +1,325 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package partitiontable
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+func init() {
+	installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "partition-table",
+		CheckRequirements: checkRequirements,
+		GetObject:         getObject,
+	})
+}
+
+func checkRequirements() error {
+	for _, binary := range []string{"sfdisk", "partx"} {
+		_, err := exec.LookPath(binary)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getObject() interface{} {
+	return &PartitionTableObject{
+		CmdLineExecuter: &utils.CmdLine{},
+	}
+}
+
+var partitionNumberRegexp = regexp.MustCompile(`(\d+)$`)
+
+// Partition is a partition of the layout, its "start" and "size" are
+// in sectors and a zero "size" takes the rest of the device
+type Partition struct {
+	Number int    `json:"number"`
+	Start  int64  `json:"start"`
+	Size   int64  `json:"size,omitempty"`
+	Type   string `json:"type,omitempty"`
+	Name   string `json:"name,omitempty"`
+	UUID   string `json:"uuid,omitempty"`
+}
+
+// PartitionTableObject encapsulates the "partition-table" handler data
+// and functions. It applies the declared "partitions" layout to the
+// "target" device through "sfdisk". The partitions can be created,
+// grown, relabeled or have their type changed freely, but a change
+// which destroys the data of a partition, like removing, moving or
+// shrinking it, is refused unless the partition is listed as
+// "expendable".
+type PartitionTableObject struct {
+	metadata.ObjectMetadata
+	utils.CmdLineExecuter
+
+	Target     string      `json:"target"`
+	Label      string      `json:"label"`
+	Partitions []Partition `json:"partitions"`
+	Expendable []int       `json:"expendable,omitempty"`
+
+	// these are NOT obtained from the json but from the "Setup()"
+	currentLabel      string
+	currentPartitions map[int]Partition
+}
+
+// Setup implementation for the "partition-table" handler, it checks
+// the layout can be applied safely
+func (p *PartitionTableObject) Setup() error {
+	if p.Target == "" {
+		return fmt.Errorf("the 'partition-table' handler requires a target device")
+	}
+
+	if p.Label != "gpt" && p.Label != "dos" {
+		return fmt.Errorf("label '%s' is not supported for the 'partition-table' handler. Its value must be either 'gpt' or 'dos'", p.Label)
+	}
+
+	numbers := map[int]bool{}
+	for _, partition := range p.Partitions {
+		if partition.Number <= 0 || numbers[partition.Number] {
+			return fmt.Errorf("invalid partition number %d for the 'partition-table' handler", partition.Number)
+		}
+
+		if partition.Start <= 0 {
+			return fmt.Errorf("the partition %d requires a start sector", partition.Number)
+		}
+
+		numbers[partition.Number] = true
+	}
+
+	err := p.readCurrentLayout()
+	if err != nil {
+		return err
+	}
+
+	return p.checkDestructiveChanges()
+}
+
+// Install implementation for the "partition-table" handler. The
+// partition table is only written when it differs from the layout, so
+// a retried install doesn't touch the device again.
+func (p *PartitionTableObject) Install(downloadDir string) error {
+	if !p.changed() {
+		return nil
+	}
+
+	_, err := p.ExecuteWithStdin(fmt.Sprintf("sfdisk --no-reread %s", p.Target), bytes.NewBufferString(p.script()))
+	if err != nil {
+		return err
+	}
+
+	// the partitions in use are left as they are by the kernel
+	_, err = p.Execute(fmt.Sprintf("partx -u %s", p.Target))
+
+	return err
+}
+
+// Cleanup implementation for the "partition-table" handler
+func (p *PartitionTableObject) Cleanup() error {
+	return nil
+}
+
+// GetTarget implementation for the "partition-table" handler
+func (p *PartitionTableObject) GetTarget() string {
+	return p.Target
+}
+
+func (p *PartitionTableObject) readCurrentLayout() error {
+	output, err := p.Execute(fmt.Sprintf("sfdisk --json %s", p.Target))
+	if err != nil {
+		return err
+	}
+
+	dump := struct {
+		PartitionTable struct {
+			Label      string `json:"label"`
+			Partitions []struct {
+				Node  string `json:"node"`
+				Start int64  `json:"start"`
+				Size  int64  `json:"size"`
+				Type  string `json:"type"`
+				Name  string `json:"name"`
+				UUID  string `json:"uuid"`
+			} `json:"partitions"`
+		} `json:"partitiontable"`
+	}{}
+
+	err = json.Unmarshal(output, &dump)
+	if err != nil {
+		return fmt.Errorf("failed to parse the partition table of '%s': %s", p.Target, err)
+	}
+
+	p.currentLabel = dump.PartitionTable.Label
+	p.currentPartitions = map[int]Partition{}
+
+	for _, partition := range dump.PartitionTable.Partitions {
+		matches := partitionNumberRegexp.FindStringSubmatch(partition.Node)
+		if matches == nil {
+			return fmt.Errorf("failed to parse the partition table of '%s': unknown partition '%s'", p.Target, partition.Node)
+		}
+
+		number, _ := strconv.Atoi(matches[1])
+
+		p.currentPartitions[number] = Partition{
+			Number: number,
+			Start:  partition.Start,
+			Size:   partition.Size,
+			Type:   partition.Type,
+			Name:   partition.Name,
+			UUID:   partition.UUID,
+		}
+	}
+
+	return nil
+}
+
+func (p *PartitionTableObject) expendable(number int) bool {
+	for _, n := range p.Expendable {
+		if n == number {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkDestructiveChanges refuses the layout if it removes, moves or
+// shrinks a partition which isn't expendable. Replacing the label
+// removes all of them.
+func (p *PartitionTableObject) checkDestructiveChanges() error {
+	declared := map[int]Partition{}
+	for _, partition := range p.Partitions {
+		declared[partition.Number] = partition
+	}
+
+	numbers := []int{}
+	for number := range p.currentPartitions {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	for _, number := range numbers {
+		if p.expendable(number) {
+			continue
+		}
+
+		current := p.currentPartitions[number]
+		partition, ok := declared[number]
+
+		switch {
+		case p.currentLabel != p.Label:
+			return fmt.Errorf("refusing to replace the '%s' label of '%s', the partition %d isn't expendable", p.currentLabel, p.Target, number)
+		case !ok:
+			return fmt.Errorf("refusing to remove the partition %d of '%s', it isn't expendable", number, p.Target)
+		case partition.Start != current.Start:
+			return fmt.Errorf("refusing to move the partition %d of '%s', it isn't expendable", number, p.Target)
+		case partition.Size != 0 && partition.Size < current.Size:
+			return fmt.Errorf("refusing to shrink the partition %d of '%s', it isn't expendable", number, p.Target)
+		}
+	}
+
+	return nil
+}
+
+// changed tells whether the layout differs from the partition table
+func (p *PartitionTableObject) changed() bool {
+	if p.currentLabel != p.Label || len(p.currentPartitions) != len(p.Partitions) {
+		return true
+	}
+
+	for _, partition := range p.Partitions {
+		current, ok := p.currentPartitions[partition.Number]
+		if !ok || current.Start != partition.Start || (partition.Size != 0 && current.Size != partition.Size) {
+			return true
+		}
+
+		// sfdisk dumps the GUIDs in upper case
+		if (partition.Type != "" && !strings.EqualFold(partition.Type, current.Type)) || (partition.UUID != "" && !strings.EqualFold(partition.UUID, current.UUID)) {
+			return true
+		}
+
+		if p.Label == "gpt" && partition.Name != current.Name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// script returns the "sfdisk" script of the layout. The type and the
+// uuid of the kept partitions are preserved unless declared, so the
+// "PARTUUID" references to them keep working.
+func (p *PartitionTableObject) script() string {
+	script := &bytes.Buffer{}
+
+	fmt.Fprintf(script, "label: %s\nunit: sectors\n\n", p.Label)
+
+	for _, partition := range p.Partitions {
+		current, kept := p.currentPartitions[partition.Number]
+		kept = kept && p.currentLabel == p.Label
+
+		fmt.Fprintf(script, "%s : start=%d", p.partitionNode(partition.Number), partition.Start)
+
+		if partition.Size != 0 {
+			fmt.Fprintf(script, ", size=%d", partition.Size)
+		}
+
+		partitionType := partition.Type
+		if partitionType == "" && kept {
+			partitionType = current.Type
+		}
+
+		if partitionType != "" {
+			fmt.Fprintf(script, ", type=%s", partitionType)
+		}
+
+		if p.Label == "gpt" {
+			uuid := partition.UUID
+			if uuid == "" && kept {
+				uuid = current.UUID
+			}
+
+			if uuid != "" {
+				fmt.Fprintf(script, ", uuid=%s", uuid)
+			}
+
+			if partition.Name != "" {
+				fmt.Fprintf(script, ", name=%s", strconv.Quote(partition.Name))
+			}
+		}
+
+		script.WriteString("\n")
+	}
+
+	return script.String()
+}
+
+// partitionNode returns the device of the partition "number", like
+// "/dev/sda1" or "/dev/mmcblk0p1"
+func (p *PartitionTableObject) partitionNode(number int) string {
+	last := p.Target[len(p.Target)-1]
+	if last >= '0' && last <= '9' {
+		return fmt.Sprintf("%sp%d", p.Target, number)
+	}
+
+	return fmt.Sprintf("%s%d", p.Target, number)
+}
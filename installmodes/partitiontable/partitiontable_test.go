@@ -0,0 +1,268 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package partitiontable
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/installmodes/internal/testsutils"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+const (
+	efiType   = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	linuxType = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+)
+
+const sfdiskDump = `{
+   "partitiontable": {
+      "label": "gpt",
+      "id": "6A2F33F4-5A3A-4E4B-8A39-2B4E2A6C1B47",
+      "device": "/dev/mmcblk0",
+      "unit": "sectors",
+      "firstlba": 34,
+      "lastlba": 30535646,
+      "partitions": [
+         {"node": "/dev/mmcblk0p1", "start": 2048, "size": 131072, "type": "C12A7328-F81F-11D2-BA4B-00A0C93EC93B", "uuid": "8F3E1A0B-1111-4C8E-9A6F-000000000001", "name": "boot"},
+         {"node": "/dev/mmcblk0p2", "start": 133120, "size": 2097152, "type": "0FC63DAF-8483-4772-8E79-3D69D8477DE4", "uuid": "8F3E1A0B-1111-4C8E-9A6F-000000000002", "name": "rootfs-a"},
+         {"node": "/dev/mmcblk0p3", "start": 2230272, "size": 2097152, "type": "0FC63DAF-8483-4772-8E79-3D69D8477DE4", "uuid": "8F3E1A0B-1111-4C8E-9A6F-000000000003", "name": "rootfs-b"}
+      ]
+   }
+}`
+
+func currentLayout() []Partition {
+	return []Partition{
+		{Number: 1, Start: 2048, Size: 131072, Type: efiType, Name: "boot"},
+		{Number: 2, Start: 133120, Size: 2097152, Type: linuxType, Name: "rootfs-a"},
+		{Number: 3, Start: 2230272, Size: 2097152, Type: linuxType, Name: "rootfs-b"},
+	}
+}
+
+func TestPartitionTableInit(t *testing.T) {
+	val, err := installmodes.GetObject("partition-table")
+	assert.NoError(t, err)
+
+	p1, ok := val.(*PartitionTableObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"installmodes.GetObject()\" to PartitionTableObject")
+	}
+
+	p2, ok := getObject().(*PartitionTableObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"getObject()\" to PartitionTableObject")
+	}
+
+	assert.Equal(t, p2, p1)
+
+	_, ok = p1.CmdLineExecuter.(*utils.CmdLine)
+	if !ok {
+		t.Error("Failed to cast default implementation of \"CmdLineExecuter\" to CmdLine")
+	}
+}
+
+func TestPartitionTableCheckRequirements(t *testing.T) {
+	testPath := testsutils.SetupCheckRequirementsDir(t, []string{"sfdisk", "partx"})
+	defer os.RemoveAll(testPath)
+
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+
+	err := os.Setenv("PATH", testPath)
+	assert.NoError(t, err)
+
+	assert.NoError(t, checkRequirements())
+
+	os.Remove(path.Join(testPath, "partx"))
+	assert.EqualError(t, checkRequirements(), "exec: \"partx\": executable file not found in $PATH")
+}
+
+func TestPartitionTableSetupWithInvalidLayout(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Object   PartitionTableObject
+		Expected string
+	}{
+		{
+			"NoTarget",
+			PartitionTableObject{Label: "gpt"},
+			"the 'partition-table' handler requires a target device",
+		},
+		{
+			"UnknownLabel",
+			PartitionTableObject{Target: "/dev/mmcblk0", Label: "bsd"},
+			"label 'bsd' is not supported for the 'partition-table' handler. Its value must be either 'gpt' or 'dos'",
+		},
+		{
+			"DuplicatedNumber",
+			PartitionTableObject{Target: "/dev/mmcblk0", Label: "gpt", Partitions: []Partition{{Number: 1, Start: 2048}, {Number: 1, Start: 4096}}},
+			"invalid partition number 1 for the 'partition-table' handler",
+		},
+		{
+			"NoStart",
+			PartitionTableObject{Target: "/dev/mmcblk0", Label: "gpt", Partitions: []Partition{{Number: 1}}},
+			"the partition 1 requires a start sector",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.EqualError(t, tc.Object.Setup(), tc.Expected)
+		})
+	}
+}
+
+func TestPartitionTableSetupWithDestructiveChanges(t *testing.T) {
+	removed := currentLayout()[:2]
+
+	moved := currentLayout()
+	moved[2].Start = 4327424
+
+	shrunk := currentLayout()
+	shrunk[1].Size = 1048576
+
+	testCases := []struct {
+		Name       string
+		Label      string
+		Partitions []Partition
+		Expendable []int
+		Expected   string
+	}{
+		{"Remove", "gpt", removed, nil, "refusing to remove the partition 3 of '/dev/mmcblk0', it isn't expendable"},
+		{"Move", "gpt", moved, nil, "refusing to move the partition 3 of '/dev/mmcblk0', it isn't expendable"},
+		{"Shrink", "gpt", shrunk, []int{3}, "refusing to shrink the partition 2 of '/dev/mmcblk0', it isn't expendable"},
+		{"ReplaceLabel", "dos", currentLayout(), []int{2, 3}, "refusing to replace the 'gpt' label of '/dev/mmcblk0', the partition 1 isn't expendable"},
+		{"RemoveExpendable", "gpt", removed, []int{3}, ""},
+		{"MoveExpendable", "gpt", moved, []int{3}, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+			clm.On("Execute", "sfdisk --json /dev/mmcblk0").Return([]byte(sfdiskDump), nil)
+
+			p := PartitionTableObject{
+				CmdLineExecuter: clm,
+				Target:          "/dev/mmcblk0",
+				Label:           tc.Label,
+				Partitions:      tc.Partitions,
+				Expendable:      tc.Expendable,
+			}
+
+			err := p.Setup()
+			if tc.Expected == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.Expected)
+			}
+
+			clm.AssertExpectations(t)
+		})
+	}
+}
+
+func TestPartitionTableSetupWithInvalidDump(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "sfdisk --json /dev/mmcblk0").Return([]byte("invalid"), nil)
+
+	p := PartitionTableObject{CmdLineExecuter: clm, Target: "/dev/mmcblk0", Label: "gpt"}
+
+	err := p.Setup()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to parse the partition table of '/dev/mmcblk0'")
+
+	clm.AssertExpectations(t)
+}
+
+func TestPartitionTableInstall(t *testing.T) {
+	partitions := currentLayout()
+	partitions[2].Size = 0
+	partitions[2].Name = "data"
+	partitions = append(partitions, Partition{Number: 4, Start: 4327424, Size: 2097152, Type: linuxType, Name: "rootfs-c"})
+
+	expectedScript := `label: gpt
+unit: sectors
+
+/dev/mmcblk0p1 : start=2048, size=131072, type=C12A7328-F81F-11D2-BA4B-00A0C93EC93B, uuid=8F3E1A0B-1111-4C8E-9A6F-000000000001, name="boot"
+/dev/mmcblk0p2 : start=133120, size=2097152, type=0FC63DAF-8483-4772-8E79-3D69D8477DE4, uuid=8F3E1A0B-1111-4C8E-9A6F-000000000002, name="rootfs-a"
+/dev/mmcblk0p3 : start=2230272, type=0FC63DAF-8483-4772-8E79-3D69D8477DE4, uuid=8F3E1A0B-1111-4C8E-9A6F-000000000003, name="data"
+/dev/mmcblk0p4 : start=4327424, size=2097152, type=0FC63DAF-8483-4772-8E79-3D69D8477DE4, name="rootfs-c"
+`
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "sfdisk --json /dev/mmcblk0").Return([]byte(sfdiskDump), nil)
+	clm.On("ExecuteWithStdin", "sfdisk --no-reread /dev/mmcblk0", mock.MatchedBy(func(r *bytes.Buffer) bool {
+		content, _ := ioutil.ReadAll(r)
+		return string(content) == expectedScript
+	})).Return([]byte(""), nil)
+	clm.On("Execute", "partx -u /dev/mmcblk0").Return([]byte(""), nil)
+
+	p := PartitionTableObject{
+		CmdLineExecuter: clm,
+		Target:          "/dev/mmcblk0",
+		Label:           "gpt",
+		Partitions:      partitions,
+	}
+
+	assert.NoError(t, p.Setup())
+	assert.NoError(t, p.Install("/dummy-download-dir"))
+	assert.NoError(t, p.Cleanup())
+	assert.Equal(t, "/dev/mmcblk0", p.GetTarget())
+
+	clm.AssertExpectations(t)
+}
+
+func TestPartitionTableInstallWithSameLayout(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "sfdisk --json /dev/mmcblk0").Return([]byte(sfdiskDump), nil)
+
+	partitions := currentLayout()
+	partitions[0].Type = "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
+
+	p := PartitionTableObject{
+		CmdLineExecuter: clm,
+		Target:          "/dev/mmcblk0",
+		Label:           "gpt",
+		Partitions:      partitions,
+	}
+
+	// the device isn't touched
+	assert.NoError(t, p.Setup())
+	assert.NoError(t, p.Install("/dummy-download-dir"))
+
+	clm.AssertExpectations(t)
+}
+
+func TestPartitionTableInstallWithSfdiskError(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "sfdisk --json /dev/sda").Return([]byte(`{"partitiontable": {"label": "dos", "partitions": []}}`), nil)
+	clm.On("ExecuteWithStdin", "sfdisk --no-reread /dev/sda", mock.Anything).Return([]byte(""), fmt.Errorf("sfdisk error"))
+
+	p := PartitionTableObject{
+		CmdLineExecuter: clm,
+		Target:          "/dev/sda",
+		Label:           "dos",
+		Partitions:      []Partition{{Number: 1, Start: 2048, Type: "83"}},
+	}
+
+	assert.NoError(t, p.Setup())
+	assert.EqualError(t, p.Install("/dummy-download-dir"), "sfdisk error")
+	assert.Equal(t, "/dev/sda1 : start=2048, type=83\n", p.script()[len("label: dos\nunit: sectors\n\n"):])
+
+	clm.AssertExpectations(t)
+}
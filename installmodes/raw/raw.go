@@ -10,15 +10,23 @@ package raw
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/afero"
 
 	"github.com/UpdateHub/updatehub/copy"
+	"github.com/UpdateHub/updatehub/handlers"
 	"github.com/UpdateHub/updatehub/installifdifferent"
 	"github.com/UpdateHub/updatehub/installmodes"
 	"github.com/UpdateHub/updatehub/libarchive"
 	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
 )
 
 func init() {
@@ -27,9 +35,13 @@ func init() {
 		CheckRequirements: func() error { return nil },
 		GetObject: func() interface{} {
 			return &RawObject{
+				FileSystemHelper: &utils.FileSystem{
+					CmdLineExecuter: &utils.CmdLine{},
+				},
 				LibArchiveBackend: &libarchive.LibArchive{},
 				FileSystemBackend: afero.NewOsFs(),
 				CopyBackend:       &copy.ExtendedIO{},
+				CmdLineExecuter:   &utils.CmdLine{},
 				ChunkSize:         128 * 1024,
 				Count:             -1,
 				Truncate:          true,
@@ -46,6 +58,8 @@ type RawObject struct {
 	FileSystemBackend afero.Fs
 	CopyBackend       copy.Interface `json:"-"`
 	installifdifferent.TargetGetter
+	utils.CmdLineExecuter
+	utils.FileSystemHelper `json:"-"`
 
 	Target     string `json:"target"`
 	TargetType string `json:"target-type"`
@@ -54,29 +68,289 @@ type RawObject struct {
 	Seek       int    `json:"seek,omitempty"`
 	Count      int    `json:"count,omitempty"`
 	Truncate   bool   `json:"truncate,omitempty"`
+	LVSize     int64  `json:"lv-size,omitempty"`
+
+	// the filesystem of the image, which is grown to fill the target
+	// once it's written
+	GrowFilesystem string `json:"grow-filesystem,omitempty"`
+
+	progress     handlers.ProgressFunc
+	deactivateLV bool // the "lvm" target was inactive before the "Setup()"
 }
 
 // Setup implementation for the "raw" handler
 func (r *RawObject) Setup() error {
-	if r.TargetType != "device" {
-		return fmt.Errorf("target-type '%s' is not supported for the 'raw' handler. Its value must be 'device'", r.TargetType)
+	switch r.GrowFilesystem {
+	case "", "ext2", "ext3", "ext4", "f2fs", "xfs", "btrfs":
+	default:
+		return fmt.Errorf("grow-filesystem '%s' is not supported for the 'raw' handler. Its value must be one of 'ext2', 'ext3', 'ext4', 'f2fs', 'xfs' or 'btrfs'", r.GrowFilesystem)
+	}
+
+	switch r.TargetType {
+	case "device":
+		return nil
+	case "lvm":
+		return r.setupLogicalVolume()
+	default:
+		return fmt.Errorf("target-type '%s' is not supported for the 'raw' handler. Its value must be either 'device' or 'lvm'", r.TargetType)
+	}
+}
+
+// setupLogicalVolume prepares the "<volume group>/<logical volume>"
+// target to be written. The logical volume is created or extended to
+// hold the object, the "lv-size" if it's set, then deactivated, which
+// fails if it's in use, and activated again for the write.
+func (r *RawObject) setupLogicalVolume() error {
+	vg, lv, err := r.logicalVolume()
+	if err != nil {
+		return err
+	}
+
+	size := r.LVSize
+	if size <= 0 {
+		size = int64(r.Seek*r.ChunkSize) + r.dataSize()
+	}
+
+	output, err := r.Execute(fmt.Sprintf("lvs --noheadings --units b --nosuffix -o lv_size,lv_attr %s/%s", vg, lv))
+	if err != nil {
+		// the logical volume doesn't exist yet
+		_, err = r.Execute(fmt.Sprintf("lvcreate -y -n %s -L %db %s", lv, size, vg))
+		if err != nil {
+			return err
+		}
+
+		r.deactivateLV = true
+
+		return nil
+	}
+
+	fields := strings.Fields(string(output))
+	if len(fields) != 2 {
+		return fmt.Errorf("failed to parse the 'lvs' output of the '%s' logical volume: '%s'", r.Target, strings.TrimSpace(string(output)))
+	}
+
+	current, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse the 'lvs' output of the '%s' logical volume: '%s'", r.Target, strings.TrimSpace(string(output)))
+	}
+
+	// the 5th character of the attributes is 'a' when it's active
+	active := len(fields[1]) > 4 && fields[1][4] == 'a'
+
+	if active {
+		_, err = r.Execute(fmt.Sprintf("lvchange -an %s/%s", vg, lv))
+		if err != nil {
+			return err
+		}
+	}
+
+	if current < size {
+		_, err = r.Execute(fmt.Sprintf("lvextend -L %db %s/%s", size, vg, lv))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = r.Execute(fmt.Sprintf("lvchange -ay %s/%s", vg, lv))
+	if err != nil {
+		return err
 	}
 
+	r.deactivateLV = !active
+
 	return nil
 }
 
+// logicalVolume splits the "lvm" target into its volume group and
+// logical volume names
+func (r *RawObject) logicalVolume() (string, string, error) {
+	names := strings.Split(r.Target, "/")
+	if len(names) != 2 || names[0] == "" || names[1] == "" {
+		return "", "", fmt.Errorf("invalid 'lvm' target '%s'. Its value must be '<volume group>/<logical volume>'", r.Target)
+	}
+
+	return names[0], names[1], nil
+}
+
+// targetPath returns the path written by the handler
+func (r *RawObject) targetPath() string {
+	if r.TargetType == "lvm" {
+		return path.Join("/dev", r.Target)
+	}
+
+	return r.Target
+}
+
 // Install implementation for the "raw" handler
 func (r *RawObject) Install(downloadDir string) error {
 	srcPath := path.Join(downloadDir, r.Sha256sum)
-	return r.CopyBackend.CopyFile(r.FileSystemBackend, r.LibArchiveBackend, srcPath, r.Target, r.ChunkSize, r.Skip, r.Seek, r.Count, r.Truncate, r.Compressed)
+
+	if r.progress != nil {
+		copy.NotifyProgress(r.CopyBackend, r.progress, r.sourceSize(srcPath))
+	}
+
+	err := r.CopyBackend.CopyFile(r.FileSystemBackend, r.LibArchiveBackend, srcPath, r.targetPath(), r.ChunkSize, r.Skip, r.Seek, r.Count, r.Truncate, r.Compressed)
+	if err != nil {
+		return err
+	}
+
+	return r.growFilesystem()
 }
 
-// Cleanup implementation for the "raw" handler
+// Streamable implementation for the "raw" handler, only the
+// uncompressed objects can be written while they are downloaded
+func (r *RawObject) Streamable() bool {
+	return !r.Compressed
+}
+
+// InstallFromStream implementation for the "raw" handler. It writes
+// "rd" to the target honoring the same "skip", "seek", "count" and
+// "truncate" options of Install.
+func (r *RawObject) InstallFromStream(rd io.Reader) error {
+	flags := os.O_RDWR | os.O_CREATE
+	if r.Truncate {
+		flags = flags | os.O_TRUNC
+	}
+
+	target, err := r.FileSystemBackend.OpenFile(r.targetPath(), flags, 0666)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	_, err = target.Seek(int64(r.Seek*r.ChunkSize), io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	// a stream can't be seeked, so the skipped data is discarded
+	_, err = io.CopyN(ioutil.Discard, rd, int64(r.Skip*r.ChunkSize))
+	if err != nil {
+		return err
+	}
+
+	if r.progress != nil {
+		copy.NotifyProgress(r.CopyBackend, r.progress, r.Size)
+	}
+
+	_, err = r.CopyBackend.Copy(target, rd, 30*time.Second, nil, r.ChunkSize, 0, r.Count, false)
+	if err != nil {
+		return err
+	}
+
+	// the filesystem must be on the disk before it's grown
+	err = target.Close()
+	if err != nil {
+		return err
+	}
+
+	return r.growFilesystem()
+}
+
+// growFilesystem grows the written filesystem to fill the target, so
+// the same image fits the devices with different partition sizes. The
+// ext and f2fs filesystems are grown offline, while the xfs and btrfs
+// ones can only be grown once mounted.
+func (r *RawObject) growFilesystem() error {
+	target := r.targetPath()
+
+	switch r.GrowFilesystem {
+	case "":
+		return nil
+	case "ext2", "ext3", "ext4":
+		_, err := r.Execute(fmt.Sprintf("resize2fs %s", target))
+		return err
+	case "f2fs":
+		_, err := r.Execute(fmt.Sprintf("resize.f2fs %s", target))
+		return err
+	}
+
+	tempDirPath, err := r.TempDir(r.FileSystemBackend, "raw-handler")
+	if err != nil {
+		return err
+	}
+	// we can't "defer os.RemoveAll(tempDirPath)" here because it
+	// could happen an "Umount" error and then the mounted dir
+	// contents would be removed as well
+
+	err = r.Mount(target, tempDirPath, r.GrowFilesystem, "")
+	if err != nil {
+		r.FileSystemBackend.RemoveAll(tempDirPath)
+		return err
+	}
+
+	errorList := []error{}
+
+	cmdline := fmt.Sprintf("xfs_growfs %s", tempDirPath)
+	if r.GrowFilesystem == "btrfs" {
+		cmdline = fmt.Sprintf("btrfs filesystem resize max %s", tempDirPath)
+	}
+
+	_, err = r.Execute(cmdline)
+	if err != nil {
+		errorList = append(errorList, err)
+	}
+
+	umountErr := r.Umount(tempDirPath)
+	if umountErr != nil {
+		errorList = append(errorList, umountErr)
+	} else {
+		r.FileSystemBackend.RemoveAll(tempDirPath)
+	}
+
+	return utils.MergeErrorList(errorList)
+}
+
+// Cleanup implementation for the "raw" handler, the "lvm" target is
+// left inactive if it was before the "Setup()"
 func (r *RawObject) Cleanup() error {
-	return nil
+	if !r.deactivateLV {
+		return nil
+	}
+
+	r.deactivateLV = false
+
+	_, err := r.Execute(fmt.Sprintf("lvchange -an %s", r.Target))
+
+	return err
 }
 
 // GetTarget implementation for the "raw" handler
 func (r *RawObject) GetTarget() string {
-	return r.Target
+	return r.targetPath()
+}
+
+// Idempotent implementation for the "raw" handler, the same data is
+// written at the same place again
+func (r *RawObject) Idempotent() bool {
+	return true
+}
+
+// SetProgressFunc implementation for the "raw" handler
+func (r *RawObject) SetProgressFunc(fn handlers.ProgressFunc) {
+	r.progress = fn
+}
+
+// dataSize returns the size of the data of the object once written
+func (r *RawObject) dataSize() int64 {
+	if r.Compressed {
+		return int64(r.UncompressedSize)
+	}
+
+	return r.Size
+}
+
+// sourceSize returns the size of the data that will be written to
+// the target or 0 when it is unknown
+func (r *RawObject) sourceSize(sourcePath string) int64 {
+	if r.Compressed {
+		return int64(r.UncompressedSize)
+	}
+
+	info, err := r.FileSystemBackend.Stat(sourcePath)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
 }
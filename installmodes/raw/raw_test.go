@@ -9,16 +9,21 @@
 package raw
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path"
 	"testing"
 
 	"github.com/UpdateHub/updatehub/copy"
 	"github.com/UpdateHub/updatehub/installmodes"
 	"github.com/UpdateHub/updatehub/libarchive"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
 	"github.com/UpdateHub/updatehub/testsmocks/copymock"
 	"github.com/UpdateHub/updatehub/testsmocks/filesystemmock"
 	"github.com/UpdateHub/updatehub/testsmocks/libarchivemock"
+	"github.com/UpdateHub/updatehub/utils"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 )
@@ -34,9 +39,13 @@ func TestRawInit(t *testing.T) {
 
 	osFs := afero.NewOsFs()
 	r2 := &RawObject{
+		FileSystemHelper: &utils.FileSystem{
+			CmdLineExecuter: &utils.CmdLine{},
+		},
 		LibArchiveBackend: &libarchive.LibArchive{},
 		FileSystemBackend: osFs,
 		CopyBackend:       &copy.ExtendedIO{},
+		CmdLineExecuter:   &utils.CmdLine{},
 		ChunkSize:         128 * 1024,
 		Skip:              0,
 		Seek:              0,
@@ -59,15 +68,251 @@ func TestRawSetupWithNotSupportedTargetTypes(t *testing.T) {
 
 	r.TargetType = "ubivolume"
 	err := r.Setup()
-	assert.EqualError(t, err, "target-type 'ubivolume' is not supported for the 'raw' handler. Its value must be 'device'")
+	assert.EqualError(t, err, "target-type 'ubivolume' is not supported for the 'raw' handler. Its value must be either 'device' or 'lvm'")
 
 	r.TargetType = "mtdname"
 	err = r.Setup()
-	assert.EqualError(t, err, "target-type 'mtdname' is not supported for the 'raw' handler. Its value must be 'device'")
+	assert.EqualError(t, err, "target-type 'mtdname' is not supported for the 'raw' handler. Its value must be either 'device' or 'lvm'")
 
 	r.TargetType = "someother"
 	err = r.Setup()
-	assert.EqualError(t, err, "target-type 'someother' is not supported for the 'raw' handler. Its value must be 'device'")
+	assert.EqualError(t, err, "target-type 'someother' is not supported for the 'raw' handler. Its value must be either 'device' or 'lvm'")
+}
+
+func TestRawSetupWithLVMTarget(t *testing.T) {
+	testCases := []struct {
+		Name             string
+		LVSize           int64
+		LvsOutput        string
+		LvsError         error
+		ExpectedCmdlines []string
+		ExpectedCleanup  bool
+	}{
+		{
+			"WithNewLogicalVolume",
+			0,
+			"",
+			fmt.Errorf("Failed to find logical volume \"vg0/rootfs-b\""),
+			[]string{"lvcreate -y -n rootfs-b -L 4096b vg0"},
+			true,
+		},
+
+		{
+			"WithInactiveLogicalVolume",
+			0,
+			"  8192 -wi-------\n",
+			nil,
+			[]string{"lvchange -ay vg0/rootfs-b"},
+			true,
+		},
+
+		{
+			"WithActiveLogicalVolume",
+			0,
+			"  8192 -wi-a-----\n",
+			nil,
+			[]string{"lvchange -an vg0/rootfs-b", "lvchange -ay vg0/rootfs-b"},
+			false,
+		},
+
+		{
+			"WithSmallerLogicalVolume",
+			16384,
+			"  8192 -wi-a-----\n",
+			nil,
+			[]string{"lvchange -an vg0/rootfs-b", "lvextend -L 16384b vg0/rootfs-b", "lvchange -ay vg0/rootfs-b"},
+			false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+			clm.On("Execute", "lvs --noheadings --units b --nosuffix -o lv_size,lv_attr vg0/rootfs-b").Return([]byte(tc.LvsOutput), tc.LvsError).Once()
+			for _, cmdline := range tc.ExpectedCmdlines {
+				clm.On("Execute", cmdline).Return([]byte(""), nil).Once()
+			}
+
+			r := RawObject{CmdLineExecuter: clm}
+			r.Target = "vg0/rootfs-b"
+			r.TargetType = "lvm"
+			r.ChunkSize = 1024
+			r.Seek = 1
+			r.Size = 3072
+			r.LVSize = tc.LVSize
+
+			err := r.Setup()
+			assert.NoError(t, err)
+
+			if tc.ExpectedCleanup {
+				clm.On("Execute", "lvchange -an vg0/rootfs-b").Return([]byte(""), nil).Once()
+			}
+
+			err = r.Cleanup()
+			assert.NoError(t, err)
+
+			assert.Equal(t, "/dev/vg0/rootfs-b", r.GetTarget())
+
+			clm.AssertExpectations(t)
+		})
+	}
+}
+
+func TestRawSetupWithLVMTargetErrors(t *testing.T) {
+	r := RawObject{}
+	r.TargetType = "lvm"
+	r.Target = "rootfs-b"
+
+	err := r.Setup()
+	assert.EqualError(t, err, "invalid 'lvm' target 'rootfs-b'. Its value must be '<volume group>/<logical volume>'")
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "lvs --noheadings --units b --nosuffix -o lv_size,lv_attr vg0/rootfs-b").Return([]byte("unexpected\n"), nil)
+
+	r.CmdLineExecuter = clm
+	r.Target = "vg0/rootfs-b"
+
+	err = r.Setup()
+	assert.EqualError(t, err, "failed to parse the 'lvs' output of the 'vg0/rootfs-b' logical volume: 'unexpected'")
+
+	// a logical volume in use can't be deactivated
+	clm = &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "lvs --noheadings --units b --nosuffix -o lv_size,lv_attr vg0/rootfs-b").Return([]byte("  8192 -wi-ao----\n"), nil)
+	clm.On("Execute", "lvchange -an vg0/rootfs-b").Return([]byte(""), fmt.Errorf("Logical volume vg0/rootfs-b in use."))
+
+	r.CmdLineExecuter = clm
+
+	err = r.Setup()
+	assert.EqualError(t, err, "Logical volume vg0/rootfs-b in use.")
+
+	clm.AssertExpectations(t)
+}
+
+func TestRawSetupWithNotSupportedGrowFilesystem(t *testing.T) {
+	r := RawObject{}
+	r.TargetType = "device"
+	r.GrowFilesystem = "vfat"
+
+	err := r.Setup()
+	assert.EqualError(t, err, "grow-filesystem 'vfat' is not supported for the 'raw' handler. Its value must be one of 'ext2', 'ext3', 'ext4', 'f2fs', 'xfs' or 'btrfs'")
+}
+
+func TestRawInstallWithGrowFilesystem(t *testing.T) {
+	testCases := []struct {
+		Name            string
+		GrowFilesystem  string
+		ExpectedCmdline string
+		Online          bool
+	}{
+		{"WithExt4", "ext4", "resize2fs /dev/xx1", false},
+		{"WithF2fs", "f2fs", "resize.f2fs /dev/xx1", false},
+		{"WithXfs", "xfs", "xfs_growfs /tmp/raw-handler", true},
+		{"WithBtrfs", "btrfs", "btrfs filesystem resize max /tmp/raw-handler", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			memFs := afero.NewMemMapFs()
+			lam := &libarchivemock.LibArchiveMock{}
+
+			sha256sum := "5bdbf286cb4adcff26befa2183f3167c053bc565036736eaa2ae429fe910d93c"
+			downloadDir := "/dummy-download-dir"
+
+			cm := &copymock.CopyMock{}
+			cm.On("CopyFile", memFs, lam, path.Join(downloadDir, sha256sum), "/dev/xx1", 128*1024, 0, 0, -1, true, false).Return(nil)
+
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+			clm.On("Execute", tc.ExpectedCmdline).Return([]byte(""), nil)
+
+			fsm := &filesystemmock.FileSystemHelperMock{}
+			if tc.Online {
+				assert.NoError(t, memFs.MkdirAll("/tmp/raw-handler", 0755))
+
+				fsm.On("TempDir", memFs, "raw-handler").Return("/tmp/raw-handler", nil)
+				fsm.On("Mount", "/dev/xx1", "/tmp/raw-handler", tc.GrowFilesystem, "").Return(nil)
+				fsm.On("Umount", "/tmp/raw-handler").Return(nil)
+			}
+
+			r := RawObject{
+				CopyBackend:       cm,
+				FileSystemBackend: memFs,
+				LibArchiveBackend: lam,
+				CmdLineExecuter:   clm,
+				FileSystemHelper:  fsm,
+				ChunkSize:         128 * 1024,
+				Count:             -1,
+				Truncate:          true,
+			}
+			r.Target = "/dev/xx1"
+			r.TargetType = "device"
+			r.Sha256sum = sha256sum
+			r.GrowFilesystem = tc.GrowFilesystem
+
+			err := r.Install(downloadDir)
+			assert.NoError(t, err)
+
+			exists, err := afero.Exists(memFs, "/tmp/raw-handler")
+			assert.NoError(t, err)
+			assert.False(t, exists)
+
+			cm.AssertExpectations(t)
+			clm.AssertExpectations(t)
+			fsm.AssertExpectations(t)
+		})
+	}
+}
+
+func TestRawInstallWithGrowFilesystemError(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	assert.NoError(t, memFs.MkdirAll("/tmp/raw-handler", 0755))
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "xfs_growfs /tmp/raw-handler").Return([]byte(""), fmt.Errorf("xfs_growfs error"))
+
+	// it's umounted even if it couldn't be grown
+	fsm := &filesystemmock.FileSystemHelperMock{}
+	fsm.On("TempDir", memFs, "raw-handler").Return("/tmp/raw-handler", nil)
+	fsm.On("Mount", "/dev/xx1", "/tmp/raw-handler", "xfs", "").Return(nil)
+	fsm.On("Umount", "/tmp/raw-handler").Return(nil)
+
+	r := RawObject{CmdLineExecuter: clm, FileSystemHelper: fsm, FileSystemBackend: memFs}
+	r.Target = "/dev/xx1"
+	r.TargetType = "device"
+	r.GrowFilesystem = "xfs"
+
+	err := r.growFilesystem()
+	assert.EqualError(t, err, "xfs_growfs error")
+
+	clm.AssertExpectations(t)
+	fsm.AssertExpectations(t)
+}
+
+func TestRawInstallWithLVMTarget(t *testing.T) {
+	fsbm := &filesystemmock.FileSystemBackendMock{}
+	lam := &libarchivemock.LibArchiveMock{}
+
+	sha256sum := "5bdbf286cb4adcff26befa2183f3167c053bc565036736eaa2ae429fe910d93c"
+	downloadDir := "/dummy-download-dir"
+
+	cm := &copymock.CopyMock{}
+	cm.On("CopyFile", fsbm, lam, path.Join(downloadDir, sha256sum), "/dev/vg0/rootfs-b", 128*1024, 0, 0, -1, true, false).Return(nil)
+
+	r := RawObject{
+		CopyBackend:       cm,
+		FileSystemBackend: fsbm,
+		LibArchiveBackend: lam,
+		ChunkSize:         128 * 1024,
+		Count:             -1,
+		Truncate:          true,
+	}
+	r.Target = "vg0/rootfs-b"
+	r.TargetType = "lvm"
+	r.Sha256sum = sha256sum
+
+	err := r.Install(downloadDir)
+	assert.NoError(t, err)
+
+	cm.AssertExpectations(t)
 }
 
 func TestRawInstallWithCopyFileError(t *testing.T) {
@@ -170,6 +415,90 @@ func TestRawInstallWithSuccess(t *testing.T) {
 	}
 }
 
+func TestRawInstallWithProgress(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+
+	downloadDir := "/dummy-download-dir"
+	sha256sum := "5bdbf286cb4adcff26befa2183f3167c053bc565036736eaa2ae429fe910d93c"
+
+	err := afero.WriteFile(memFs, path.Join(downloadDir, sha256sum), []byte("12345"), 0644)
+	assert.NoError(t, err)
+
+	r := RawObject{CopyBackend: &copy.ExtendedIO{}, FileSystemBackend: memFs, LibArchiveBackend: &libarchive.LibArchive{}}
+	r.Target = "/dev/xx1"
+	r.TargetType = "device"
+	r.Sha256sum = sha256sum
+	r.ChunkSize = 2
+	r.Count = -1
+	r.Truncate = true
+
+	progress := [][2]int64{}
+	r.SetProgressFunc(func(installed int64, total int64) {
+		progress = append(progress, [2]int64{installed, total})
+	})
+
+	err = r.Install(downloadDir)
+	assert.NoError(t, err)
+	assert.Equal(t, [][2]int64{{2, 5}, {4, 5}, {5, 5}}, progress)
+
+	data, err := afero.ReadFile(memFs, "/dev/xx1")
+	assert.NoError(t, err)
+	assert.Equal(t, "12345", string(data))
+}
+
+func TestRawStreamable(t *testing.T) {
+	r := RawObject{}
+	assert.True(t, r.Streamable())
+
+	r.Compressed = true
+	assert.False(t, r.Streamable())
+}
+
+func TestRawInstallFromStream(t *testing.T) {
+	// the afero in-memory files can't be overwritten in the middle
+	testPath, err := ioutil.TempDir("", "raw-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testPath)
+
+	osFs := afero.NewOsFs()
+	targetPath := path.Join(testPath, "xx1")
+
+	err = afero.WriteFile(osFs, targetPath, []byte("abcdefghij"), 0644)
+	assert.NoError(t, err)
+
+	r := RawObject{CopyBackend: &copy.ExtendedIO{}, FileSystemBackend: osFs}
+	r.Target = targetPath
+	r.TargetType = "device"
+	r.Size = 5
+	r.ChunkSize = 2
+	r.Skip = 1
+	r.Seek = 1
+	r.Count = 2
+
+	progress := [][2]int64{}
+	r.SetProgressFunc(func(installed int64, total int64) {
+		progress = append(progress, [2]int64{installed, total})
+	})
+
+	err = r.InstallFromStream(bytes.NewReader([]byte("1234567")))
+	assert.NoError(t, err)
+	assert.Equal(t, [][2]int64{{2, 5}, {4, 5}}, progress)
+
+	data, err := afero.ReadFile(osFs, targetPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "ab3456ghij", string(data))
+}
+
+func TestRawInstallFromStreamWithOpenError(t *testing.T) {
+	r := RawObject{CopyBackend: &copy.ExtendedIO{}, FileSystemBackend: afero.NewReadOnlyFs(afero.NewMemMapFs())}
+	r.Target = "/dev/xx1"
+	r.ChunkSize = 2
+	r.Count = -1
+
+	err := r.InstallFromStream(bytes.NewReader([]byte("1234567")))
+	assert.Error(t, err)
+}
+
 func TestRawCleanupNil(t *testing.T) {
 	r := RawObject{}
 	assert.Nil(t, r.Cleanup())
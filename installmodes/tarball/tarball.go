@@ -62,6 +62,10 @@ type TarballObject struct {
 	MustFormat    bool   `json:"format?,omitempty"`
 	MountOptions  string `json:"mount-options,omitempty"`
 
+	// PreservePermissions tells whether the permissions stored in the
+	// tarball are restored, which is the default
+	PreservePermissions *bool `json:"preserve-permissions?,omitempty"`
+
 	targetDevice string // this is NOT obtained from the json but from the "Setup()"
 }
 
@@ -119,7 +123,7 @@ func (tb *TarballObject) Install(downloadDir string) error {
 	errorList := []error{}
 
 	sourcePath := path.Join(downloadDir, tb.Sha256sum)
-	err = tb.LibArchiveBackend.Unpack(sourcePath, targetPath, false)
+	err = tb.LibArchiveBackend.UnpackWithOptions(sourcePath, targetPath, false, tb.preservePermissions())
 	if err != nil {
 		errorList = append(errorList, err)
 	}
@@ -134,6 +138,10 @@ func (tb *TarballObject) Install(downloadDir string) error {
 	return utils.MergeErrorList(errorList)
 }
 
+func (tb *TarballObject) preservePermissions() bool {
+	return tb.PreservePermissions == nil || *tb.PreservePermissions
+}
+
 // Cleanup implementation for the "tarball" handler
 func (tb *TarballObject) Cleanup() error {
 	return nil
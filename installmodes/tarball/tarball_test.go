@@ -9,6 +9,7 @@
 package tarball
 
 import (
+	"encoding/json"
 	"fmt"
 	"path"
 	"testing"
@@ -271,7 +272,7 @@ func TestTarballInstallWithExtractError(t *testing.T) {
 	cm := &copymock.CopyMock{}
 
 	lam := &libarchivemock.LibArchiveMock{}
-	lam.On("Unpack", sourcePath, path.Join(tempDirPath, targetPath), false).Return(fmt.Errorf("unpack error"))
+	lam.On("UnpackWithOptions", sourcePath, path.Join(tempDirPath, targetPath), false, true).Return(fmt.Errorf("unpack error"))
 
 	tb := TarballObject{
 		FileSystemHelper:  fsm,
@@ -322,7 +323,7 @@ func TestTarballInstallWithUmountError(t *testing.T) {
 	cm := &copymock.CopyMock{}
 
 	lam := &libarchivemock.LibArchiveMock{}
-	lam.On("Unpack", sourcePath, path.Join(tempDirPath, targetPath), false).Return(nil)
+	lam.On("UnpackWithOptions", sourcePath, path.Join(tempDirPath, targetPath), false, true).Return(nil)
 
 	tb := TarballObject{
 		FileSystemHelper:  fsm,
@@ -373,7 +374,7 @@ func TestTarballInstallWithUnpackANDUmountErrors(t *testing.T) {
 	cm := &copymock.CopyMock{}
 
 	lam := &libarchivemock.LibArchiveMock{}
-	lam.On("Unpack", sourcePath, path.Join(tempDirPath, targetPath), false).Return(fmt.Errorf("unpack error"))
+	lam.On("UnpackWithOptions", sourcePath, path.Join(tempDirPath, targetPath), false, true).Return(fmt.Errorf("unpack error"))
 
 	tb := TarballObject{
 		FileSystemHelper:  fsm,
@@ -424,7 +425,7 @@ func TestTarballInstallWithSuccess(t *testing.T) {
 	cm := &copymock.CopyMock{}
 
 	lam := &libarchivemock.LibArchiveMock{}
-	lam.On("Unpack", sourcePath, path.Join(tempDirPath, targetPath), false).Return(nil)
+	lam.On("UnpackWithOptions", sourcePath, path.Join(tempDirPath, targetPath), false, true).Return(nil)
 
 	tb := TarballObject{
 		FileSystemHelper:  fsm,
@@ -452,6 +453,60 @@ func TestTarballInstallWithSuccess(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestTarballInstallWithoutPreservingPermissions(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+
+	tempDirPath, err := afero.TempDir(memFs, "", "tarball-handler")
+	assert.NoError(t, err)
+
+	targetDevice := "/dev/xx1"
+	targetPath := "/inner-path"
+	fsType := "ext4"
+	mountOptions := "-o rw"
+	sha256sum := "b5f11b9a8090325b79bc9222d5e8ccc084427aa1d2a2532d80a59ecca2ca6f4e"
+	compressed := true
+	downloadDir := "/dummy-download-dir"
+	sourcePath := path.Join(downloadDir, sha256sum)
+
+	fsm := &filesystemmock.FileSystemHelperMock{}
+	fsm.On("TempDir", memFs, "tarball-handler").Return(tempDirPath, nil)
+	fsm.On("Mount", targetDevice, tempDirPath, fsType, mountOptions).Return(nil)
+	fsm.On("Umount", tempDirPath).Return(nil)
+
+	cm := &copymock.CopyMock{}
+
+	lam := &libarchivemock.LibArchiveMock{}
+	lam.On("UnpackWithOptions", sourcePath, path.Join(tempDirPath, targetPath), false, false).Return(nil)
+
+	tb := TarballObject{
+		FileSystemHelper:  fsm,
+		CopyBackend:       cm,
+		FileSystemBackend: memFs,
+		LibArchiveBackend: lam,
+	}
+
+	tb.Target = targetDevice
+	tb.TargetPath = targetPath
+	tb.FSType = fsType
+	tb.MountOptions = mountOptions
+	tb.Sha256sum = sha256sum
+	tb.Compressed = compressed
+
+	err = json.Unmarshal([]byte(`{"preserve-permissions?": false}`), &tb)
+	assert.NoError(t, err)
+
+	err = tb.Install(downloadDir)
+
+	assert.NoError(t, err)
+	fsm.AssertExpectations(t)
+	cm.AssertExpectations(t)
+	lam.AssertExpectations(t)
+
+	tempDirExists, err := afero.Exists(memFs, tempDirPath)
+	assert.False(t, tempDirExists)
+	assert.NoError(t, err)
+}
+
 func TestTarballCleanupNil(t *testing.T) {
 	tb := TarballObject{}
 	assert.Nil(t, tb.Cleanup())
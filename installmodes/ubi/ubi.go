@@ -0,0 +1,187 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package ubi
+
+import (
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/copy"
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/libarchive"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+func init() {
+	installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "ubi",
+		CheckRequirements: checkRequirements,
+		GetObject:         getObject,
+	})
+}
+
+func checkRequirements() error {
+	for _, binary := range []string{"ubiupdatevol", "ubinfo"} {
+		_, err := exec.LookPath(binary)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getObject() interface{} {
+	cle := &utils.CmdLine{}
+
+	return &UbiObject{
+		CmdLineExecuter:   cle,
+		CopyBackend:       &copy.ExtendedIO{},
+		LibArchiveBackend: &libarchive.LibArchive{},
+		FileSystemBackend: afero.NewOsFs(),
+		UbifsUtils: &utils.UbifsUtilsImpl{
+			CmdLineExecuter: cle,
+		},
+	}
+}
+
+var (
+	ubinfoTypeRegexp = regexp.MustCompile(`(?m)^Type:\s+(\w+)$`)
+	ubinfoSizeRegexp = regexp.MustCompile(`(?m)^Size:\s+\d+ LEBs \((\d+) bytes`)
+)
+
+// UbiObject encapsulates the "ubi" handler data and functions. It
+// writes a raw image into an UBI volume, found by its name.
+type UbiObject struct {
+	metadata.ObjectMetadata
+	metadata.CompressedObject
+	utils.CmdLineExecuter
+	utils.UbifsUtils
+	CopyBackend       copy.Interface `json:"-"`
+	LibArchiveBackend libarchive.API `json:"-"`
+	FileSystemBackend afero.Fs
+
+	Target     string `json:"target"`
+	TargetType string `json:"target-type"`
+	VolumeType string `json:"volume-type,omitempty"` // "dynamic" or "static", empty means any
+
+	// these are NOT obtained from the json but from the "Setup()"
+	targetDevice string
+	volumeType   string
+	volumeSize   int64
+}
+
+// Setup implementation for the "ubi" handler. It looks up the volume
+// and checks it is of the expected type.
+func (u *UbiObject) Setup() error {
+	if u.TargetType != "ubivolume" {
+		return fmt.Errorf("target-type '%s' is not supported for the 'ubi' handler. Its value must be 'ubivolume'", u.TargetType)
+	}
+
+	switch u.VolumeType {
+	case "", "dynamic", "static":
+	default:
+		return fmt.Errorf("volume-type '%s' is not supported for the 'ubi' handler. Its value must be either 'dynamic' or 'static'", u.VolumeType)
+	}
+
+	targetDevice, err := u.GetTargetDeviceFromUbiVolumeName(u.FileSystemBackend, u.Target)
+	if err != nil {
+		return err
+	}
+
+	output, err := u.Execute(fmt.Sprintf("ubinfo %s", targetDevice))
+	if err != nil {
+		return err
+	}
+
+	matchedType := ubinfoTypeRegexp.FindStringSubmatch(string(output))
+	matchedSize := ubinfoSizeRegexp.FindStringSubmatch(string(output))
+	if matchedType == nil || matchedSize == nil {
+		return fmt.Errorf("failed to get the type and size of UBI volume '%s'", u.Target)
+	}
+
+	size, err := strconv.ParseInt(matchedSize[1], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	if u.VolumeType != "" && u.VolumeType != matchedType[1] {
+		return fmt.Errorf("UBI volume '%s' is %s but a %s one is expected", u.Target, matchedType[1], u.VolumeType)
+	}
+
+	u.targetDevice = targetDevice
+	u.volumeType = matchedType[1]
+	u.volumeSize = size
+
+	return nil
+}
+
+// Install implementation for the "ubi" handler
+func (u *UbiObject) Install(downloadDir string) error {
+	srcPath := path.Join(downloadDir, u.Sha256sum)
+
+	imageSize, err := u.imageSize(srcPath)
+	if err != nil {
+		return err
+	}
+
+	if imageSize > u.volumeSize {
+		return fmt.Errorf("the image (%d bytes) doesn't fit in UBI volume '%s' (%d bytes)", imageSize, u.Target, u.volumeSize)
+	}
+
+	if u.Compressed {
+		// the data size must be told since it is read from the stdin
+		cmdline := fmt.Sprintf("ubiupdatevol -s %d %s -", imageSize, u.targetDevice)
+		return u.CopyBackend.CopyToProcessStdin(u.FileSystemBackend, u.LibArchiveBackend, srcPath, cmdline, u.Compressed)
+	}
+
+	_, err = u.Execute(fmt.Sprintf("ubiupdatevol %s %s", u.targetDevice, srcPath))
+
+	return err
+}
+
+// Cleanup implementation for the "ubi" handler
+func (u *UbiObject) Cleanup() error {
+	return nil
+}
+
+// GetTarget implementation for the "ubi" handler
+func (u *UbiObject) GetTarget() string {
+	return u.targetDevice
+}
+
+// GetTargetRange implementation for the "ubi" handler, only the
+// image is probed
+func (u *UbiObject) GetTargetRange() (int64, int64) {
+	if u.Compressed {
+		return 0, int64(u.UncompressedSize)
+	}
+
+	return 0, u.Size
+}
+
+// imageSize returns the size of the data written to the volume
+func (u *UbiObject) imageSize(srcPath string) (int64, error) {
+	if u.Compressed {
+		return int64(u.UncompressedSize), nil
+	}
+
+	info, err := u.FileSystemBackend.Stat(srcPath)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
@@ -0,0 +1,320 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package ubi
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/installmodes/internal/testsutils"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+	"github.com/UpdateHub/updatehub/testsmocks/copymock"
+	"github.com/UpdateHub/updatehub/testsmocks/libarchivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/ubifsmock"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+const ubinfoOutputTemplate = `Volume ID:   0 (on ubi0)
+Type:        %s
+Alignment:   1
+Size:        407 LEBs (52512768 bytes, 50.1 MiB)
+State:       OK
+Name:        system0
+Character device major/minor: 249:1
+`
+
+func newTestUbiObject(volumeType string) (*UbiObject, *cmdlinemock.CmdLineExecuterMock, *ubifsmock.UbifsUtilsMock) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	uum := &ubifsmock.UbifsUtilsMock{}
+
+	u := &UbiObject{
+		CmdLineExecuter:   clm,
+		UbifsUtils:        uum,
+		FileSystemBackend: afero.NewMemMapFs(),
+	}
+	u.TargetType = "ubivolume"
+	u.Target = "system0"
+	u.VolumeType = volumeType
+	u.Sha256sum = "71c88745e5a72067f94aae0ecec6d45af8b0f6e1a37ef695df0b56711e192b86"
+
+	uum.On("GetTargetDeviceFromUbiVolumeName", u.FileSystemBackend, "system0").Return("/dev/ubi0_0", nil)
+
+	return u, clm, uum
+}
+
+func TestUbiInit(t *testing.T) {
+	val, err := installmodes.GetObject("ubi")
+	assert.NoError(t, err)
+
+	u1, ok := val.(*UbiObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"installmodes.GetObject()\" to UbiObject")
+	}
+
+	u2, ok := getObject().(*UbiObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"getObject()\" to UbiObject")
+	}
+
+	assert.Equal(t, u2, u1)
+}
+
+func TestUbiGetObject(t *testing.T) {
+	u, ok := getObject().(*UbiObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"getObject()\" to UbiObject")
+	}
+
+	_, ok = u.CmdLineExecuter.(*utils.CmdLine)
+	if !ok {
+		t.Error("Failed to cast default implementation of \"CmdLineExecuter\" to CmdLine")
+	}
+}
+
+func TestUbiCheckRequirementsWithBinariesNotFound(t *testing.T) {
+	for _, binary := range []string{"ubiupdatevol", "ubinfo"} {
+		t.Run(binary, func(t *testing.T) {
+			testPath := testsutils.SetupCheckRequirementsDir(t, []string{"ubiupdatevol", "ubinfo"})
+			defer os.RemoveAll(testPath)
+
+			err := os.Setenv("PATH", testPath)
+			assert.NoError(t, err)
+
+			os.Remove(path.Join(testPath, binary))
+
+			err = checkRequirements()
+			assert.EqualError(t, err, fmt.Sprintf("exec: \"%s\": executable file not found in $PATH", binary))
+		})
+	}
+}
+
+func TestUbiCheckRequirementsWithBinariesFound(t *testing.T) {
+	testPath := testsutils.SetupCheckRequirementsDir(t, []string{"ubiupdatevol", "ubinfo"})
+	defer os.RemoveAll(testPath)
+
+	err := os.Setenv("PATH", testPath)
+	assert.NoError(t, err)
+
+	assert.NoError(t, checkRequirements())
+}
+
+func TestUbiSetup(t *testing.T) {
+	testCases := []struct {
+		Name       string
+		VolumeType string
+		Output     string
+	}{
+		{"AnyVolumeType", "", "static"},
+		{"Dynamic", "dynamic", "dynamic"},
+		{"Static", "static", "static"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			u, clm, uum := newTestUbiObject(tc.VolumeType)
+			clm.On("Execute", "ubinfo /dev/ubi0_0").Return([]byte(fmt.Sprintf(ubinfoOutputTemplate, tc.Output)), nil)
+
+			err := u.Setup()
+			assert.NoError(t, err)
+			assert.Equal(t, "/dev/ubi0_0", u.GetTarget())
+			assert.Equal(t, tc.Output, u.volumeType)
+			assert.Equal(t, int64(52512768), u.volumeSize)
+
+			clm.AssertExpectations(t)
+			uum.AssertExpectations(t)
+		})
+	}
+}
+
+func TestUbiSetupWithNotSupportedTargetType(t *testing.T) {
+	u := UbiObject{TargetType: "mtdname"}
+
+	err := u.Setup()
+	assert.EqualError(t, err, "target-type 'mtdname' is not supported for the 'ubi' handler. Its value must be 'ubivolume'")
+}
+
+func TestUbiSetupWithNotSupportedVolumeType(t *testing.T) {
+	u := UbiObject{TargetType: "ubivolume", VolumeType: "unknown"}
+
+	err := u.Setup()
+	assert.EqualError(t, err, "volume-type 'unknown' is not supported for the 'ubi' handler. Its value must be either 'dynamic' or 'static'")
+}
+
+func TestUbiSetupWithVolumeTypeMismatch(t *testing.T) {
+	u, clm, uum := newTestUbiObject("static")
+	clm.On("Execute", "ubinfo /dev/ubi0_0").Return([]byte(fmt.Sprintf(ubinfoOutputTemplate, "dynamic")), nil)
+
+	err := u.Setup()
+	assert.EqualError(t, err, "UBI volume 'system0' is dynamic but a static one is expected")
+
+	clm.AssertExpectations(t)
+	uum.AssertExpectations(t)
+}
+
+func TestUbiSetupWithVolumeNotFound(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	uum := &ubifsmock.UbifsUtilsMock{}
+	fs := afero.NewMemMapFs()
+
+	uum.On("GetTargetDeviceFromUbiVolumeName", fs, "system0").Return("", fmt.Errorf("UBI volume 'system0' wasn't found"))
+
+	u := UbiObject{CmdLineExecuter: clm, UbifsUtils: uum, FileSystemBackend: fs}
+	u.TargetType = "ubivolume"
+	u.Target = "system0"
+
+	err := u.Setup()
+	assert.EqualError(t, err, "UBI volume 'system0' wasn't found")
+
+	clm.AssertExpectations(t)
+	uum.AssertExpectations(t)
+}
+
+func TestUbiSetupWithUbinfoFailure(t *testing.T) {
+	u, clm, uum := newTestUbiObject("")
+	clm.On("Execute", "ubinfo /dev/ubi0_0").Return([]byte("error"), fmt.Errorf("Error executing command"))
+
+	err := u.Setup()
+	assert.EqualError(t, err, "Error executing command")
+
+	clm.AssertExpectations(t)
+	uum.AssertExpectations(t)
+}
+
+func TestUbiSetupWithUnexpectedUbinfoOutput(t *testing.T) {
+	u, clm, uum := newTestUbiObject("")
+	clm.On("Execute", "ubinfo /dev/ubi0_0").Return([]byte("unexpected"), nil)
+
+	err := u.Setup()
+	assert.EqualError(t, err, "failed to get the type and size of UBI volume 'system0'")
+
+	clm.AssertExpectations(t)
+	uum.AssertExpectations(t)
+}
+
+func TestUbiCleanupNil(t *testing.T) {
+	u := UbiObject{}
+	assert.Nil(t, u.Cleanup())
+}
+
+func TestUbiGetTargetRange(t *testing.T) {
+	u, _, _ := newTestUbiObject("")
+	u.Size = 2048
+
+	offset, size := u.GetTargetRange()
+	assert.Equal(t, int64(0), offset)
+	assert.Equal(t, int64(2048), size)
+
+	u.Compressed = true
+	u.UncompressedSize = 4096
+
+	offset, size = u.GetTargetRange()
+	assert.Equal(t, int64(0), offset)
+	assert.Equal(t, int64(4096), size)
+}
+
+func TestUbiInstallWithSuccessNonCompressed(t *testing.T) {
+	u, clm, uum := newTestUbiObject("")
+	clm.On("Execute", "ubinfo /dev/ubi0_0").Return([]byte(fmt.Sprintf(ubinfoOutputTemplate, "dynamic")), nil)
+
+	downloadDir := "/dummy-download-dir"
+	sourcePath := path.Join(downloadDir, u.Sha256sum)
+
+	err := afero.WriteFile(u.FileSystemBackend, sourcePath, []byte("content"), 0644)
+	assert.NoError(t, err)
+
+	clm.On("Execute", fmt.Sprintf("ubiupdatevol /dev/ubi0_0 %s", sourcePath)).Return([]byte("combinedoutput"), nil)
+
+	assert.NoError(t, u.Setup())
+	assert.NoError(t, u.Install(downloadDir))
+
+	clm.AssertExpectations(t)
+	uum.AssertExpectations(t)
+}
+
+func TestUbiInstallWithSuccessCompressed(t *testing.T) {
+	u, clm, uum := newTestUbiObject("static")
+	clm.On("Execute", "ubinfo /dev/ubi0_0").Return([]byte(fmt.Sprintf(ubinfoOutputTemplate, "static")), nil)
+
+	downloadDir := "/dummy-download-dir"
+	sourcePath := path.Join(downloadDir, u.Sha256sum)
+
+	lam := &libarchivemock.LibArchiveMock{}
+
+	cpm := &copymock.CopyMock{}
+	cpm.On("CopyToProcessStdin", u.FileSystemBackend, lam, sourcePath, "ubiupdatevol -s 12345678 /dev/ubi0_0 -", true).Return(nil)
+
+	u.LibArchiveBackend = lam
+	u.CopyBackend = cpm
+	u.Compressed = true
+	u.UncompressedSize = 12345678
+
+	assert.NoError(t, u.Setup())
+	assert.NoError(t, u.Install(downloadDir))
+
+	clm.AssertExpectations(t)
+	uum.AssertExpectations(t)
+	lam.AssertExpectations(t)
+	cpm.AssertExpectations(t)
+}
+
+func TestUbiInstallWithImageLargerThanVolume(t *testing.T) {
+	u, clm, uum := newTestUbiObject("")
+	clm.On("Execute", "ubinfo /dev/ubi0_0").Return([]byte(fmt.Sprintf(ubinfoOutputTemplate, "dynamic")), nil)
+
+	u.Compressed = true
+	u.UncompressedSize = 52512769
+
+	assert.NoError(t, u.Setup())
+
+	err := u.Install("/dummy-download-dir")
+	assert.EqualError(t, err, "the image (52512769 bytes) doesn't fit in UBI volume 'system0' (52512768 bytes)")
+
+	clm.AssertExpectations(t)
+	uum.AssertExpectations(t)
+}
+
+func TestUbiInstallWithMissingImage(t *testing.T) {
+	u, clm, uum := newTestUbiObject("")
+	clm.On("Execute", "ubinfo /dev/ubi0_0").Return([]byte(fmt.Sprintf(ubinfoOutputTemplate, "dynamic")), nil)
+
+	assert.NoError(t, u.Setup())
+
+	err := u.Install("/dummy-download-dir")
+	assert.Error(t, err)
+
+	clm.AssertExpectations(t)
+	uum.AssertExpectations(t)
+}
+
+func TestUbiInstallWithUbiUpdateVolFailure(t *testing.T) {
+	u, clm, uum := newTestUbiObject("")
+	clm.On("Execute", "ubinfo /dev/ubi0_0").Return([]byte(fmt.Sprintf(ubinfoOutputTemplate, "dynamic")), nil)
+
+	downloadDir := "/dummy-download-dir"
+	sourcePath := path.Join(downloadDir, u.Sha256sum)
+
+	err := afero.WriteFile(u.FileSystemBackend, sourcePath, []byte("content"), 0644)
+	assert.NoError(t, err)
+
+	clm.On("Execute", fmt.Sprintf("ubiupdatevol /dev/ubi0_0 %s", sourcePath)).Return([]byte("error"), fmt.Errorf("Error executing command"))
+
+	assert.NoError(t, u.Setup())
+
+	err = u.Install(downloadDir)
+	assert.EqualError(t, err, "Error executing command")
+
+	clm.AssertExpectations(t)
+	uum.AssertExpectations(t)
+}
@@ -0,0 +1,118 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package ubootenv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strings"
+)
+
+// headerSize returns the size of the header which precedes the
+// variables: the CRC32 and, on redundant environments, the flags byte
+func headerSize(redundant bool) int {
+	if redundant {
+		return 5
+	}
+
+	return 4
+}
+
+// parseEnvironment decodes an environment copy as written by U-Boot,
+// returning its variables and flags. An error is returned if the CRC
+// doesn't match, which means the copy is corrupted or the layout
+// declared for it is wrong.
+func parseEnvironment(data []byte, redundant bool) (map[string]string, byte, error) {
+	header := headerSize(redundant)
+	if len(data) <= header {
+		return nil, 0, fmt.Errorf("environment size must be greater than %d bytes", header)
+	}
+
+	var flags byte
+	if redundant {
+		flags = data[4]
+	}
+
+	body := data[header:]
+
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[0:4]) {
+		return nil, 0, fmt.Errorf("environment CRC doesn't match")
+	}
+
+	vars := map[string]string{}
+
+	for _, entry := range bytes.Split(body, []byte{0}) {
+		// the variables end with an empty entry
+		if len(entry) == 0 {
+			break
+		}
+
+		parts := strings.SplitN(string(entry), "=", 2)
+		if len(parts) != 2 {
+			return nil, 0, fmt.Errorf("invalid environment entry '%s'", entry)
+		}
+
+		vars[parts[0]] = parts[1]
+	}
+
+	return vars, flags, nil
+}
+
+// encodeEnvironment encodes "vars" into an environment copy of "size"
+// bytes, sorted by name as U-Boot does
+func encodeEnvironment(vars map[string]string, size int, redundant bool, flags byte) ([]byte, error) {
+	header := headerSize(redundant)
+
+	names := []string{}
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	body := &bytes.Buffer{}
+	for _, name := range names {
+		body.WriteString(fmt.Sprintf("%s=%s", name, vars[name]))
+		body.WriteByte(0)
+	}
+	body.WriteByte(0)
+
+	if header+body.Len() > size {
+		return nil, fmt.Errorf("environment variables (%d bytes) don't fit in the environment (%d bytes)", body.Len(), size-header)
+	}
+
+	data := make([]byte, size)
+	copy(data[header:], body.Bytes())
+
+	binary.LittleEndian.PutUint32(data[0:4], crc32.ChecksumIEEE(data[header:]))
+
+	if redundant {
+		data[4] = flags
+	}
+
+	return data, nil
+}
+
+// newestCopy tells which of the two valid redundant copies is the
+// current one, following the U-Boot rules for the flags wrap around.
+// It returns 0 for the first copy and 1 for the second.
+func newestCopy(flags1 byte, flags2 byte) int {
+	switch {
+	case flags1 == 0xff && flags2 == 0:
+		return 1
+	case flags2 == 0xff && flags1 == 0:
+		return 0
+	case flags2 > flags1:
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,63 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package ubootenv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvironmentRoundTrip(t *testing.T) {
+	vars := map[string]string{"bootcmd": "run boot_a", "bootdelay": "3"}
+
+	for _, redundant := range []bool{false, true} {
+		data, err := encodeEnvironment(vars, 64, redundant, 7)
+		assert.NoError(t, err)
+		assert.Equal(t, 64, len(data))
+
+		decoded, flags, err := parseEnvironment(data, redundant)
+		assert.NoError(t, err)
+		assert.Equal(t, vars, decoded)
+
+		if redundant {
+			assert.Equal(t, byte(7), flags)
+			assert.Equal(t, "bootcmd=run boot_a\x00bootdelay=3\x00\x00", string(data[5:37]))
+		} else {
+			assert.Equal(t, byte(0), flags)
+			assert.Equal(t, "bootcmd=run boot_a\x00bootdelay=3\x00\x00", string(data[4:36]))
+		}
+	}
+}
+
+func TestEncodeEnvironmentTooLarge(t *testing.T) {
+	_, err := encodeEnvironment(map[string]string{"bootcmd": "run boot_a"}, 16, false, 0)
+	assert.EqualError(t, err, "environment variables (20 bytes) don't fit in the environment (12 bytes)")
+}
+
+func TestParseEnvironmentWithBadCRC(t *testing.T) {
+	data, err := encodeEnvironment(map[string]string{"a": "b"}, 32, false, 0)
+	assert.NoError(t, err)
+
+	data[10] = 'x'
+
+	_, _, err = parseEnvironment(data, false)
+	assert.EqualError(t, err, "environment CRC doesn't match")
+
+	_, _, err = parseEnvironment(data[:4], false)
+	assert.EqualError(t, err, "environment size must be greater than 4 bytes")
+}
+
+func TestNewestCopy(t *testing.T) {
+	assert.Equal(t, 0, newestCopy(1, 1))
+	assert.Equal(t, 0, newestCopy(2, 1))
+	assert.Equal(t, 1, newestCopy(1, 2))
+	assert.Equal(t, 1, newestCopy(0xff, 0))
+	assert.Equal(t, 0, newestCopy(0, 0xff))
+}
@@ -0,0 +1,245 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package ubootenv
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+func init() {
+	installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "uboot-env",
+		CheckRequirements: func() error { return nil },
+		GetObject:         getObject,
+	})
+}
+
+func getObject() interface{} {
+	return &UBootEnvObject{
+		CmdLineExecuter:   &utils.CmdLine{},
+		FileSystemBackend: afero.NewOsFs(),
+	}
+}
+
+// UBootEnvObject encapsulates the "uboot-env" handler data and
+// functions. It applies "variables" to the U-Boot environment, a
+// variable with an empty value is removed. When "target" is empty the
+// environment is changed through "fw_setenv", otherwise the
+// environment layout must be declared and it is written directly to
+// "target".
+type UBootEnvObject struct {
+	metadata.ObjectMetadata
+	utils.CmdLineExecuter
+	FileSystemBackend afero.Fs
+
+	Variables map[string]string `json:"variables"`
+
+	// the variables which must be present on the current environment,
+	// it makes sure the right environment is being changed
+	ExpectedVariables []string `json:"expected-variables,omitempty"`
+
+	Target          string `json:"target,omitempty"`
+	Offset          int64  `json:"env-offset,omitempty"`
+	Size            int    `json:"env-size,omitempty"`
+	Redundant       bool   `json:"redundant?,omitempty"`
+	TargetRedundant string `json:"target-redundant,omitempty"`
+	OffsetRedundant int64  `json:"env-offset-redundant,omitempty"`
+}
+
+// Setup implementation for the "uboot-env" handler
+func (u *UBootEnvObject) Setup() error {
+	if len(u.Variables) == 0 {
+		return fmt.Errorf("the 'uboot-env' handler requires at least one variable")
+	}
+
+	if u.Target == "" {
+		_, err := exec.LookPath("fw_setenv")
+		return err
+	}
+
+	if u.Size <= headerSize(u.Redundant) {
+		return fmt.Errorf("env-size must be greater than %d bytes for the 'uboot-env' handler", headerSize(u.Redundant))
+	}
+
+	if u.Redundant && u.TargetRedundant == "" {
+		u.TargetRedundant = u.Target
+	}
+
+	if u.Redundant && u.TargetRedundant == u.Target && u.OffsetRedundant == u.Offset {
+		return fmt.Errorf("the redundant environment must not overlap the main one")
+	}
+
+	return nil
+}
+
+// Install implementation for the "uboot-env" handler
+func (u *UBootEnvObject) Install(downloadDir string) error {
+	if u.Target == "" {
+		return u.installWithFwSetenv()
+	}
+
+	return u.installDirectly()
+}
+
+// Cleanup implementation for the "uboot-env" handler
+func (u *UBootEnvObject) Cleanup() error {
+	return nil
+}
+
+// GetTarget implementation for the "uboot-env" handler
+func (u *UBootEnvObject) GetTarget() string {
+	return u.Target
+}
+
+func (u *UBootEnvObject) checkExpectedVariables(vars map[string]string) error {
+	missing := []string{}
+	for _, name := range u.ExpectedVariables {
+		if _, ok := vars[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("the U-Boot environment doesn't have the expected variables: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+func (u *UBootEnvObject) installWithFwSetenv() error {
+	if len(u.ExpectedVariables) > 0 {
+		output, err := u.Execute("fw_printenv")
+		if err != nil {
+			return err
+		}
+
+		vars := map[string]string{}
+		for _, line := range strings.Split(string(output), "\n") {
+			parts := strings.SplitN(line, "=", 2)
+			if len(parts) == 2 {
+				vars[parts[0]] = parts[1]
+			}
+		}
+
+		err = u.checkExpectedVariables(vars)
+		if err != nil {
+			return err
+		}
+	}
+
+	names := []string{}
+	for name := range u.Variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// a script line without value removes the variable
+	script := &bytes.Buffer{}
+	for _, name := range names {
+		script.WriteString(strings.TrimSpace(fmt.Sprintf("%s %s", name, u.Variables[name])) + "\n")
+	}
+
+	_, err := u.ExecuteWithStdin("fw_setenv -s -", script)
+
+	return err
+}
+
+func (u *UBootEnvObject) readCopy(target string, offset int64) (map[string]string, byte, error) {
+	file, err := u.FileSystemBackend.Open(target)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	data := make([]byte, u.Size)
+
+	_, err = file.ReadAt(data, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return parseEnvironment(data, u.Redundant)
+}
+
+func (u *UBootEnvObject) writeCopy(target string, offset int64, vars map[string]string, flags byte) error {
+	data, err := encodeEnvironment(vars, u.Size, u.Redundant, flags)
+	if err != nil {
+		return err
+	}
+
+	file, err := u.FileSystemBackend.OpenFile(target, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteAt(data, offset)
+	if err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+// installDirectly changes the environment stored at "target". On
+// redundant environments the oldest copy is overwritten, so the current
+// one is kept in case of a power loss.
+func (u *UBootEnvObject) installDirectly() error {
+	vars, flags, err := u.readCopy(u.Target, u.Offset)
+
+	target := u.Target
+	offset := u.Offset
+
+	if u.Redundant {
+		redundantVars, redundantFlags, redundantErr := u.readCopy(u.TargetRedundant, u.OffsetRedundant)
+
+		switch {
+		case err != nil && redundantErr != nil:
+			return fmt.Errorf("failed to read the U-Boot environment: %s", err)
+		case err != nil || (redundantErr == nil && newestCopy(flags, redundantFlags) == 1):
+			vars = redundantVars
+			flags = redundantFlags
+		default:
+			target = u.TargetRedundant
+			offset = u.OffsetRedundant
+		}
+
+		err = nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to read the U-Boot environment: %s", err)
+	}
+
+	err = u.checkExpectedVariables(vars)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range u.Variables {
+		if value == "" {
+			delete(vars, name)
+		} else {
+			vars[name] = value
+		}
+	}
+
+	return u.writeCopy(target, offset, vars, flags+1)
+}
@@ -0,0 +1,271 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package ubootenv
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/installmodes/internal/testsutils"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+const envSize = 64
+
+func writeTestEnvironment(t *testing.T, fs afero.Fs, target string, offset int64, vars map[string]string, redundant bool, flags byte) {
+	data, err := encodeEnvironment(vars, envSize, redundant, flags)
+	assert.NoError(t, err)
+
+	file, err := fs.OpenFile(target, os.O_RDWR|os.O_CREATE, 0644)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	_, err = file.WriteAt(data, offset)
+	assert.NoError(t, err)
+}
+
+func readTestEnvironment(t *testing.T, fs afero.Fs, target string, offset int64, redundant bool) (map[string]string, byte) {
+	content, err := afero.ReadFile(fs, target)
+	assert.NoError(t, err)
+
+	vars, flags, err := parseEnvironment(content[offset:offset+envSize], redundant)
+	assert.NoError(t, err)
+
+	return vars, flags
+}
+
+func TestUBootEnvInit(t *testing.T) {
+	val, err := installmodes.GetObject("uboot-env")
+	assert.NoError(t, err)
+
+	u1, ok := val.(*UBootEnvObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"installmodes.GetObject()\" to UBootEnvObject")
+	}
+
+	u2, ok := getObject().(*UBootEnvObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"getObject()\" to UBootEnvObject")
+	}
+
+	assert.Equal(t, u2, u1)
+
+	_, ok = u1.CmdLineExecuter.(*utils.CmdLine)
+	if !ok {
+		t.Error("Failed to cast default implementation of \"CmdLineExecuter\" to CmdLine")
+	}
+}
+
+func TestUBootEnvSetup(t *testing.T) {
+	testPath := testsutils.SetupCheckRequirementsDir(t, []string{"fw_setenv"})
+	defer os.RemoveAll(testPath)
+
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+
+	err := os.Setenv("PATH", testPath)
+	assert.NoError(t, err)
+
+	u := UBootEnvObject{Variables: map[string]string{"a": "b"}}
+	assert.NoError(t, u.Setup())
+
+	u = UBootEnvObject{Variables: map[string]string{"a": "b"}, Target: "/dev/mmcblk0", Size: envSize, Redundant: true, OffsetRedundant: envSize}
+	assert.NoError(t, u.Setup())
+	assert.Equal(t, "/dev/mmcblk0", u.TargetRedundant)
+}
+
+func TestUBootEnvSetupWithInvalidLayout(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Object   UBootEnvObject
+		Expected string
+	}{
+		{
+			"NoVariables",
+			UBootEnvObject{},
+			"the 'uboot-env' handler requires at least one variable",
+		},
+		{
+			"NoSize",
+			UBootEnvObject{Variables: map[string]string{"a": "b"}, Target: "/dev/mmcblk0"},
+			"env-size must be greater than 4 bytes for the 'uboot-env' handler",
+		},
+		{
+			"Overlapping",
+			UBootEnvObject{Variables: map[string]string{"a": "b"}, Target: "/dev/mmcblk0", Size: envSize, Redundant: true},
+			"the redundant environment must not overlap the main one",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.EqualError(t, tc.Object.Setup(), tc.Expected)
+		})
+	}
+}
+
+func TestUBootEnvInstallWithFwSetenv(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "fw_printenv").Return([]byte("bootcmd=run boot_a\nbootdelay=3\n"), nil)
+	clm.On("ExecuteWithStdin", "fw_setenv -s -", mock.MatchedBy(func(r *bytes.Buffer) bool {
+		content, _ := ioutil.ReadAll(r)
+		return string(content) == "bootcmd run boot_b\nbootdelay\n"
+	})).Return([]byte(""), nil)
+
+	u := UBootEnvObject{
+		CmdLineExecuter:   clm,
+		Variables:         map[string]string{"bootdelay": "", "bootcmd": "run boot_b"},
+		ExpectedVariables: []string{"bootcmd"},
+	}
+
+	assert.NoError(t, u.Install("/dummy-download-dir"))
+
+	clm.AssertExpectations(t)
+}
+
+func TestUBootEnvInstallWithFwSetenvAndMissingVariables(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "fw_printenv").Return([]byte("bootdelay=3\n"), nil)
+
+	u := UBootEnvObject{
+		CmdLineExecuter:   clm,
+		Variables:         map[string]string{"bootcmd": "run boot_b"},
+		ExpectedVariables: []string{"bootcmd", "bootdelay", "slot"},
+	}
+
+	err := u.Install("/dummy-download-dir")
+	assert.EqualError(t, err, "the U-Boot environment doesn't have the expected variables: bootcmd, slot")
+
+	clm.AssertExpectations(t)
+}
+
+func TestUBootEnvInstallWithFwSetenvFailure(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("ExecuteWithStdin", "fw_setenv -s -", mock.Anything).Return([]byte("error"), fmt.Errorf("Error executing command"))
+
+	u := UBootEnvObject{CmdLineExecuter: clm, Variables: map[string]string{"bootcmd": "run boot_b"}}
+
+	assert.EqualError(t, u.Install("/dummy-download-dir"), "Error executing command")
+
+	clm.AssertExpectations(t)
+}
+
+func TestUBootEnvInstallDirectly(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	writeTestEnvironment(t, fs, "/dev/mmcblk0", 16, map[string]string{"bootcmd": "run boot_a", "bootdelay": "3"}, false, 0)
+
+	u := UBootEnvObject{
+		FileSystemBackend: fs,
+		Variables:         map[string]string{"bootcmd": "run boot_b", "bootdelay": "", "slot": "b"},
+		ExpectedVariables: []string{"bootcmd"},
+		Target:            "/dev/mmcblk0",
+		Offset:            16,
+		Size:              envSize,
+	}
+
+	assert.NoError(t, u.Setup())
+	assert.NoError(t, u.Install("/dummy-download-dir"))
+
+	vars, _ := readTestEnvironment(t, fs, "/dev/mmcblk0", 16, false)
+	assert.Equal(t, map[string]string{"bootcmd": "run boot_b", "slot": "b"}, vars)
+}
+
+func TestUBootEnvInstallDirectlyWithRedundantEnvironment(t *testing.T) {
+	testCases := []struct {
+		Name          string
+		Flags         byte
+		RedundantFlag byte
+		Corrupted     string
+		WrittenTarget string
+		ExpectedFlags byte
+	}{
+		{"MainIsNewest", 5, 4, "", "/dev/mtd2", 6},
+		{"RedundantIsNewest", 4, 5, "", "/dev/mtd1", 6},
+		{"FlagsWrapAround", 0, 0xff, "", "/dev/mtd2", 1},
+		{"MainIsCorrupted", 5, 4, "/dev/mtd1", "/dev/mtd1", 5},
+		{"RedundantIsCorrupted", 4, 5, "/dev/mtd2", "/dev/mtd2", 5},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+
+			writeTestEnvironment(t, fs, "/dev/mtd1", 0, map[string]string{"slot": "main"}, true, tc.Flags)
+			writeTestEnvironment(t, fs, "/dev/mtd2", 0, map[string]string{"slot": "redundant"}, true, tc.RedundantFlag)
+
+			if tc.Corrupted != "" {
+				assert.NoError(t, afero.WriteFile(fs, tc.Corrupted, make([]byte, envSize), 0644))
+			}
+
+			u := UBootEnvObject{
+				FileSystemBackend: fs,
+				Variables:         map[string]string{"upgrade_available": "1"},
+				Target:            "/dev/mtd1",
+				Size:              envSize,
+				Redundant:         true,
+				TargetRedundant:   "/dev/mtd2",
+			}
+
+			assert.NoError(t, u.Setup())
+			assert.NoError(t, u.Install("/dummy-download-dir"))
+
+			vars, flags := readTestEnvironment(t, fs, tc.WrittenTarget, 0, true)
+			assert.Equal(t, tc.ExpectedFlags, flags)
+			assert.Equal(t, "1", vars["upgrade_available"])
+		})
+	}
+}
+
+func TestUBootEnvInstallDirectlyWithCorruptedEnvironment(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	assert.NoError(t, afero.WriteFile(fs, "/dev/mmcblk0", make([]byte, envSize), 0644))
+
+	u := UBootEnvObject{
+		FileSystemBackend: fs,
+		Variables:         map[string]string{"bootcmd": "run boot_b"},
+		Target:            "/dev/mmcblk0",
+		Size:              envSize,
+	}
+
+	err := u.Install("/dummy-download-dir")
+	assert.EqualError(t, err, "failed to read the U-Boot environment: environment CRC doesn't match")
+}
+
+func TestUBootEnvInstallDirectlyWithMissingVariables(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	writeTestEnvironment(t, fs, "/dev/mmcblk0", 0, map[string]string{"bootdelay": "3"}, false, 0)
+
+	u := UBootEnvObject{
+		FileSystemBackend: fs,
+		Variables:         map[string]string{"bootcmd": "run boot_b"},
+		ExpectedVariables: []string{"bootcmd"},
+		Target:            "/dev/mmcblk0",
+		Size:              envSize,
+	}
+
+	err := u.Install("/dummy-download-dir")
+	assert.EqualError(t, err, "the U-Boot environment doesn't have the expected variables: bootcmd")
+}
+
+func TestUBootEnvCleanupNil(t *testing.T) {
+	u := UBootEnvObject{}
+	assert.Nil(t, u.Cleanup())
+}
@@ -0,0 +1,218 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package verity
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+func init() {
+	installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "dm-verity",
+		CheckRequirements: func() error { return nil },
+		GetObject:         getObject,
+	})
+}
+
+func getObject() interface{} {
+	return &VerityObject{
+		CmdLineExecuter:   &utils.CmdLine{},
+		FileSystemBackend: afero.NewOsFs(),
+		CmdlineParameter:  "roothash",
+	}
+}
+
+// VerityObject encapsulates the "dm-verity" handler data and
+// functions. The object is the hash tree of a rootfs image, with its
+// verity superblock, generated by "veritysetup format". It is written
+// to "target" at "hash-offset" and, once the hash tree is verified
+// against "data-device" (if set), the "root-hash" is provisioned to the
+// bootloader through the "uboot-variable" and/or the kernel command line
+// stored in "cmdline-file", so the new rootfs is verified on the next
+// boot.
+type VerityObject struct {
+	metadata.ObjectMetadata
+	utils.CmdLineExecuter
+	FileSystemBackend afero.Fs
+
+	Target     string `json:"target"`
+	HashOffset int64  `json:"hash-offset,omitempty"`
+	DataDevice string `json:"data-device,omitempty"`
+	RootHash   string `json:"root-hash"`
+
+	UBootVariable    string `json:"uboot-variable,omitempty"`
+	CmdlineFile      string `json:"cmdline-file,omitempty"`
+	CmdlineParameter string `json:"cmdline-parameter,omitempty"`
+}
+
+// Setup implementation for the "dm-verity" handler
+func (v *VerityObject) Setup() error {
+	if v.Target == "" {
+		return fmt.Errorf("the 'dm-verity' handler requires a target to write the hash tree")
+	}
+
+	digest, err := hex.DecodeString(v.RootHash)
+	if err != nil || len(digest) == 0 {
+		return fmt.Errorf("invalid root-hash '%s' for the 'dm-verity' handler", v.RootHash)
+	}
+
+	if v.UBootVariable == "" && v.CmdlineFile == "" {
+		return fmt.Errorf("the 'dm-verity' handler requires either an uboot-variable or a cmdline-file to provision the root hash")
+	}
+
+	if v.CmdlineParameter == "" {
+		v.CmdlineParameter = "roothash"
+	}
+
+	if v.DataDevice != "" {
+		_, err = exec.LookPath("veritysetup")
+		if err != nil {
+			return err
+		}
+	}
+
+	if v.UBootVariable != "" {
+		_, err = exec.LookPath("fw_setenv")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Install implementation for the "dm-verity" handler. The root hash is
+// only provisioned after the hash tree is written, so a failed install
+// never points the bootloader to a missing hash tree.
+func (v *VerityObject) Install(downloadDir string) error {
+	err := v.writeHashTree(path.Join(downloadDir, v.Sha256sum))
+	if err != nil {
+		return err
+	}
+
+	if v.DataDevice != "" {
+		_, err = v.Execute(fmt.Sprintf("veritysetup verify --hash-offset=%d %s %s %s", v.HashOffset, v.DataDevice, v.Target, v.RootHash))
+		if err != nil {
+			return fmt.Errorf("failed to verify the hash tree of '%s': %s", v.DataDevice, err)
+		}
+	}
+
+	if v.UBootVariable != "" {
+		_, err = v.ExecuteWithStdin("fw_setenv -s -", bytes.NewBufferString(fmt.Sprintf("%s %s\n", v.UBootVariable, v.RootHash)))
+		if err != nil {
+			return err
+		}
+	}
+
+	if v.CmdlineFile != "" {
+		return v.updateCmdline()
+	}
+
+	return nil
+}
+
+// Cleanup implementation for the "dm-verity" handler
+func (v *VerityObject) Cleanup() error {
+	return nil
+}
+
+// GetTarget implementation for the "dm-verity" handler
+func (v *VerityObject) GetTarget() string {
+	return v.Target
+}
+
+func (v *VerityObject) writeHashTree(srcPath string) error {
+	src, err := v.FileSystemBackend.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	target, err := v.FileSystemBackend.OpenFile(v.Target, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	_, err = target.Seek(v.HashOffset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(target, src)
+	if err != nil {
+		return err
+	}
+
+	return target.Sync()
+}
+
+// updateCmdline sets the "cmdline-parameter" of the kernel command line
+// stored in "cmdline-file" to the root hash. The file is replaced
+// atomically, so a power loss leaves either the old or the new one.
+func (v *VerityObject) updateCmdline() error {
+	content, err := afero.ReadFile(v.FileSystemBackend, v.CmdlineFile)
+	if err != nil {
+		return err
+	}
+
+	param := fmt.Sprintf("%s=%s", v.CmdlineParameter, v.RootHash)
+
+	found := false
+	args := strings.Fields(string(content))
+	for i, arg := range args {
+		if strings.HasPrefix(arg, v.CmdlineParameter+"=") {
+			args[i] = param
+			found = true
+		}
+	}
+
+	if !found {
+		args = append(args, param)
+	}
+
+	info, err := v.FileSystemBackend.Stat(v.CmdlineFile)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := v.CmdlineFile + ".tmp"
+
+	file, err := v.FileSystemBackend.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write([]byte(strings.Join(args, " ") + "\n"))
+	if err == nil {
+		err = file.Sync()
+	}
+
+	file.Close()
+
+	if err != nil {
+		v.FileSystemBackend.Remove(tmpPath)
+		return err
+	}
+
+	return v.FileSystemBackend.Rename(tmpPath, v.CmdlineFile)
+}
@@ -0,0 +1,234 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package verity
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/installmodes/internal/testsutils"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+const (
+	rootHash  = "4392712ba01368efdf14b05c76f9e4df0d53664630b5d48632ed17a137f39076"
+	sha256sum = "5bdbf286cb4adcff26befa2183f3167c053bc565036736eaa2ae429fe910d93c"
+)
+
+func TestVerityInit(t *testing.T) {
+	val, err := installmodes.GetObject("dm-verity")
+	assert.NoError(t, err)
+
+	v1, ok := val.(*VerityObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"installmodes.GetObject()\" to VerityObject")
+	}
+
+	v2, ok := getObject().(*VerityObject)
+	if !ok {
+		t.Error("Failed to cast return value of \"getObject()\" to VerityObject")
+	}
+
+	assert.Equal(t, v2, v1)
+
+	_, ok = v1.CmdLineExecuter.(*utils.CmdLine)
+	if !ok {
+		t.Error("Failed to cast default implementation of \"CmdLineExecuter\" to CmdLine")
+	}
+}
+
+func TestVeritySetup(t *testing.T) {
+	testPath := testsutils.SetupCheckRequirementsDir(t, []string{"veritysetup", "fw_setenv"})
+	defer os.RemoveAll(testPath)
+
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+
+	err := os.Setenv("PATH", testPath)
+	assert.NoError(t, err)
+
+	v := VerityObject{Target: "/dev/mmcblk0p4", RootHash: rootHash, CmdlineFile: "/boot/cmdline.txt"}
+	assert.NoError(t, v.Setup())
+	assert.Equal(t, "roothash", v.CmdlineParameter)
+
+	v = VerityObject{Target: "/dev/mmcblk0p4", RootHash: rootHash, DataDevice: "/dev/mmcblk0p3", UBootVariable: "verity_roothash"}
+	assert.NoError(t, v.Setup())
+
+	os.Remove(path.Join(testPath, "veritysetup"))
+	assert.EqualError(t, v.Setup(), "exec: \"veritysetup\": executable file not found in $PATH")
+}
+
+func TestVeritySetupWithInvalidFields(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Object   VerityObject
+		Expected string
+	}{
+		{
+			"NoTarget",
+			VerityObject{RootHash: rootHash, CmdlineFile: "/boot/cmdline.txt"},
+			"the 'dm-verity' handler requires a target to write the hash tree",
+		},
+		{
+			"InvalidRootHash",
+			VerityObject{Target: "/dev/mmcblk0p4", RootHash: "xyz", CmdlineFile: "/boot/cmdline.txt"},
+			"invalid root-hash 'xyz' for the 'dm-verity' handler",
+		},
+		{
+			"NoRootHash",
+			VerityObject{Target: "/dev/mmcblk0p4", CmdlineFile: "/boot/cmdline.txt"},
+			"invalid root-hash '' for the 'dm-verity' handler",
+		},
+		{
+			"NoBootloaderTarget",
+			VerityObject{Target: "/dev/mmcblk0p4", RootHash: rootHash},
+			"the 'dm-verity' handler requires either an uboot-variable or a cmdline-file to provision the root hash",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.EqualError(t, tc.Object.Setup(), tc.Expected)
+		})
+	}
+}
+
+func TestVerityInstallWithCmdline(t *testing.T) {
+	// the afero in-memory files can't be overwritten in the middle
+	testPath, err := ioutil.TempDir("", "verity-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testPath)
+
+	osFs := afero.NewOsFs()
+
+	downloadDir := path.Join(testPath, "download")
+	assert.NoError(t, osFs.MkdirAll(downloadDir, 0755))
+	assert.NoError(t, afero.WriteFile(osFs, path.Join(downloadDir, sha256sum), []byte("hash"), 0644))
+
+	target := path.Join(testPath, "mmcblk0p4")
+	assert.NoError(t, afero.WriteFile(osFs, target, []byte("abcdefghij"), 0644))
+
+	cmdline := path.Join(testPath, "cmdline.txt")
+	assert.NoError(t, afero.WriteFile(osFs, cmdline, []byte("console=ttyS0 roothash=0000 rootwait\n"), 0644))
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", fmt.Sprintf("veritysetup verify --hash-offset=2 /dev/mmcblk0p3 %s %s", target, rootHash)).Return([]byte(""), nil)
+
+	v := VerityObject{
+		CmdLineExecuter:   clm,
+		FileSystemBackend: osFs,
+		Target:            target,
+		HashOffset:        2,
+		DataDevice:        "/dev/mmcblk0p3",
+		RootHash:          rootHash,
+		CmdlineFile:       cmdline,
+		CmdlineParameter:  "roothash",
+	}
+	v.Sha256sum = sha256sum
+
+	assert.NoError(t, v.Install(downloadDir))
+
+	data, err := afero.ReadFile(osFs, target)
+	assert.NoError(t, err)
+	assert.Equal(t, "abhashghij", string(data))
+
+	data, err = afero.ReadFile(osFs, cmdline)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("console=ttyS0 roothash=%s rootwait\n", rootHash), string(data))
+
+	exists, err := afero.Exists(osFs, cmdline+".tmp")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.Equal(t, target, v.GetTarget())
+
+	clm.AssertExpectations(t)
+}
+
+func TestVerityInstallWithUBootVariable(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+
+	assert.NoError(t, afero.WriteFile(memFs, path.Join("/dummy-download-dir", sha256sum), []byte("hash"), 0644))
+	assert.NoError(t, afero.WriteFile(memFs, "/boot/cmdline.txt", []byte("console=ttyS0"), 0644))
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("ExecuteWithStdin", "fw_setenv -s -", mock.MatchedBy(func(r *bytes.Buffer) bool {
+		content, _ := ioutil.ReadAll(r)
+		return string(content) == fmt.Sprintf("verity_roothash %s\n", rootHash)
+	})).Return([]byte(""), nil)
+
+	v := VerityObject{
+		CmdLineExecuter:   clm,
+		FileSystemBackend: memFs,
+		Target:            "/dev/mmcblk0p4",
+		RootHash:          rootHash,
+		UBootVariable:     "verity_roothash",
+		CmdlineFile:       "/boot/cmdline.txt",
+		CmdlineParameter:  "dm-mod.roothash",
+	}
+	v.Sha256sum = sha256sum
+
+	assert.NoError(t, v.Install("/dummy-download-dir"))
+
+	data, err := afero.ReadFile(memFs, "/dev/mmcblk0p4")
+	assert.NoError(t, err)
+	assert.Equal(t, "hash", string(data))
+
+	// the parameter is appended when missing
+	data, err = afero.ReadFile(memFs, "/boot/cmdline.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("console=ttyS0 dm-mod.roothash=%s\n", rootHash), string(data))
+
+	clm.AssertExpectations(t)
+}
+
+func TestVerityInstallWithVerifyError(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+
+	assert.NoError(t, afero.WriteFile(memFs, path.Join("/dummy-download-dir", sha256sum), []byte("hash"), 0644))
+	assert.NoError(t, afero.WriteFile(memFs, "/boot/cmdline.txt", []byte("console=ttyS0\n"), 0644))
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", fmt.Sprintf("veritysetup verify --hash-offset=0 /dev/mmcblk0p3 /dev/mmcblk0p4 %s", rootHash)).Return([]byte(""), fmt.Errorf("Verification failed"))
+
+	v := VerityObject{
+		CmdLineExecuter:   clm,
+		FileSystemBackend: memFs,
+		Target:            "/dev/mmcblk0p4",
+		DataDevice:        "/dev/mmcblk0p3",
+		RootHash:          rootHash,
+		CmdlineFile:       "/boot/cmdline.txt",
+		CmdlineParameter:  "roothash",
+	}
+	v.Sha256sum = sha256sum
+
+	assert.EqualError(t, v.Install("/dummy-download-dir"), "failed to verify the hash tree of '/dev/mmcblk0p3': Verification failed")
+
+	// the root hash isn't provisioned
+	data, err := afero.ReadFile(memFs, "/boot/cmdline.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "console=ttyS0\n", string(data))
+
+	clm.AssertExpectations(t)
+}
+
+func TestVerityCleanup(t *testing.T) {
+	v := VerityObject{}
+	assert.NoError(t, v.Cleanup())
+}
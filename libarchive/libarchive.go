@@ -54,6 +54,7 @@ type API interface {
 	EntrySize(e ArchiveEntry) int64
 	EntrySizeIsSet(e ArchiveEntry) bool
 	Unpack(tarballPath string, targetPath string, enableRaw bool) error
+	UnpackWithOptions(tarballPath string, targetPath string, enableRaw bool, preservePermissions bool) error
 }
 
 // LibArchive is the default implementation of API
@@ -195,6 +196,14 @@ func (la LibArchive) EntrySizeIsSet(e ArchiveEntry) bool {
 // Unpack contains the algorithm to extract files from a tarball and
 // put them on a directory
 func (la LibArchive) Unpack(tarballPath string, targetPath string, enableRaw bool) error {
+	return la.UnpackWithOptions(tarballPath, targetPath, enableRaw, true)
+}
+
+// UnpackWithOptions is like Unpack but the permissions, ACLs and file
+// flags stored in the tarball are only restored if
+// "preservePermissions" is true. Otherwise the files are created
+// honoring the umask.
+func (la LibArchive) UnpackWithOptions(tarballPath string, targetPath string, enableRaw bool, preservePermissions bool) error {
 	originalDir, err := os.Getwd()
 	if err != nil {
 		return err
@@ -206,7 +215,7 @@ func (la LibArchive) Unpack(tarballPath string, targetPath string, enableRaw boo
 	}
 	defer os.Chdir(originalDir)
 
-	err = extractTarball(la, tarballPath, enableRaw)
+	err = extractTarball(la, tarballPath, enableRaw, preservePermissions)
 	if err != nil {
 		return err
 	}
@@ -268,7 +277,7 @@ func (r Reader) Free() {
 	r.API.ReadFree(r.Archive)
 }
 
-func extractTarball(api API, filename string, enableRaw bool) error {
+func extractTarball(api API, filename string, enableRaw bool, preservePermissions bool) error {
 	source := api.NewRead()
 	defer api.ReadFree(source)
 
@@ -280,9 +289,11 @@ func extractTarball(api API, filename string, enableRaw bool) error {
 	}
 
 	flags := C.ARCHIVE_EXTRACT_TIME
-	flags |= C.ARCHIVE_EXTRACT_PERM
-	flags |= C.ARCHIVE_EXTRACT_ACL
-	flags |= C.ARCHIVE_EXTRACT_FFLAGS
+	if preservePermissions {
+		flags |= C.ARCHIVE_EXTRACT_PERM
+		flags |= C.ARCHIVE_EXTRACT_ACL
+		flags |= C.ARCHIVE_EXTRACT_FFLAGS
+	}
 
 	target := api.WriteDiskNew()
 	defer api.WriteFree(target)
@@ -14,6 +14,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"syscall"
 	"testing"
 
 	"github.com/spf13/afero"
@@ -85,6 +86,50 @@ func TestUnpackWithExtractTarballError(t *testing.T) {
 	assert.Equal(t, originalDir, newDir)
 }
 
+func TestUnpackWithOptionsPermissions(t *testing.T) {
+	testCases := []struct {
+		Name                string
+		PreservePermissions bool
+		ExpectedMode        os.FileMode
+	}{
+		{"Preserved", true, 0666},
+		{"NotPreserved", false, 0644},
+	}
+
+	oldUmask := syscall.Umask(0022)
+	defer syscall.Umask(oldUmask)
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			fs := afero.NewOsFs()
+
+			targetPath, err := afero.TempDir(fs, "", "Unpack-test")
+			assert.NoError(t, err)
+			defer fs.RemoveAll(targetPath)
+
+			tarballPath := path.Join(targetPath, "output.tar")
+
+			file, err := fs.Create(tarballPath)
+			assert.NoError(t, err)
+
+			tw := tar.NewWriter(file)
+			assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "source.txt", Mode: 0666, Size: 7}))
+			_, err = tw.Write([]byte("content"))
+			assert.NoError(t, err)
+			assert.NoError(t, tw.Close())
+			file.Close()
+
+			la := LibArchive{}
+			err = la.UnpackWithOptions(tarballPath, targetPath, false, tc.PreservePermissions)
+			assert.NoError(t, err)
+
+			info, err := fs.Stat(path.Join(targetPath, "source.txt"))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.ExpectedMode, info.Mode().Perm())
+		})
+	}
+}
+
 func generateCorruptedTarball(fsBackend afero.Fs) (string, error) {
 	tarballPath := "/tmp/output.tar.gz"
 	file, err := fsBackend.Create(tarballPath)
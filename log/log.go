@@ -0,0 +1,69 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+// Package log is the log of the packages the agent is built from, like
+// the clients, the install modes and the server. The agent takes it
+// over, so they write to its Logger and are filtered by its log level
+// (see updatehub.SetLogger and updatehub.SetLogLevel). It writes to the
+// standard logrus logger until then.
+package log
+
+import (
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Writer is where the entries are written
+type Writer interface {
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Warn(args ...interface{})
+	Error(args ...interface{})
+}
+
+var (
+	writer Writer = logrus.StandardLogger()
+	mutex  sync.RWMutex
+)
+
+// SetWriter makes the entries to be written to "w", nil restores the
+// standard logrus logger
+func SetWriter(w Writer) {
+	if w == nil {
+		w = logrus.StandardLogger()
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	writer = w
+}
+
+func Debug(args ...interface{}) {
+	current().Debug(args...)
+}
+
+func Info(args ...interface{}) {
+	current().Info(args...)
+}
+
+func Warn(args ...interface{}) {
+	current().Warn(args...)
+}
+
+func Error(args ...interface{}) {
+	current().Error(args...)
+}
+
+func current() Writer {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	return writer
+}
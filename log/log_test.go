@@ -0,0 +1,42 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package log
+
+import (
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetWriter(t *testing.T) {
+	l, hook := test.NewNullLogger()
+	l.Level = logrus.DebugLevel
+
+	SetWriter(l)
+	defer SetWriter(nil)
+
+	Debug("debug")
+	Info("info")
+	Warn("warn")
+	Error("error")
+
+	levels := []logrus.Level{}
+	for _, entry := range hook.Entries {
+		levels = append(levels, entry.Level)
+	}
+
+	assert.Equal(t, []logrus.Level{logrus.DebugLevel, logrus.InfoLevel, logrus.WarnLevel, logrus.ErrorLevel}, levels)
+	assert.Equal(t, "error", hook.LastEntry().Message)
+
+	// back to the standard logger
+	SetWriter(nil)
+	assert.Equal(t, logrus.StandardLogger(), current())
+}
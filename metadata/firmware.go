@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strings"
 	"syscall"
 
 	"github.com/spf13/afero"
@@ -55,7 +56,7 @@ func NewFirmwareMetadata(basePath string, store afero.Fs, cmd utils.CmdLineExecu
 	}
 
 	deviceIdentity, err := executeHooks(path.Join(basePath, "device-identity.d"), store, cmd)
-	if err != nil || len(deviceIdentity) == 0 {
+	if err != nil {
 		return nil, err
 	}
 
@@ -73,9 +74,85 @@ func NewFirmwareMetadata(basePath string, store afero.Fs, cmd utils.CmdLineExecu
 		Version:          string(version),
 	}
 
+	err = firmwareMetadata.executePlugins(path.Join(basePath, "firmware-metadata.d"), store, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(firmwareMetadata.DeviceIdentity) == 0 {
+		return nil, nil
+	}
+
 	return firmwareMetadata, nil
 }
 
+// executePlugins runs the executables found at "basePath" in name
+// order, merging their outputs into "fm" so a plugin overrides what
+// was set by the previous ones. Each output line is a
+// "<field>=<value>", in which "<field>" is "product-uid", "version",
+// "hardware", "hardware-revision", "device-identity.<key>" or
+// "device-attributes.<key>".
+func (fm *FirmwareMetadata) executePlugins(basePath string, store afero.Fs, cmd utils.CmdLineExecuter) error {
+	files, err := afero.ReadDir(store, basePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || file.Mode()&syscall.S_IXUSR == 0 {
+			continue
+		}
+
+		pluginPath := path.Join(basePath, file.Name())
+
+		output, err := cmd.Execute(pluginPath)
+		if err != nil {
+			return err
+		}
+
+		keyValue, err := keyValueParser(bytes.NewReader(output))
+		if err != nil {
+			return fmt.Errorf("invalid output of firmware metadata plugin '%s': %s", pluginPath, err)
+		}
+
+		for k, v := range keyValue {
+			switch {
+			case k == "product-uid":
+				fm.ProductUID = v
+			case k == "version":
+				fm.Version = v
+			case k == "hardware":
+				fm.Hardware = v
+			case k == "hardware-revision":
+				fm.HardwareRevision = v
+			case strings.HasPrefix(k, "device-identity."):
+				fm.DeviceIdentity[strings.TrimPrefix(k, "device-identity.")] = v
+			case strings.HasPrefix(k, "device-attributes."):
+				fm.DeviceAttributes[strings.TrimPrefix(k, "device-attributes.")] = v
+			default:
+				return fmt.Errorf("firmware metadata plugin '%s' set the unknown field '%s'", pluginPath, k)
+			}
+		}
+	}
+
+	return nil
+}
+
+// FirmwareMetadataLoader loads the firmware metadata from the scripts
+// at "BasePath", it allows the metadata to be loaded again whenever
+// it may have changed
+type FirmwareMetadataLoader struct {
+	BasePath        string
+	Store           afero.Fs
+	CmdLineExecuter utils.CmdLineExecuter
+}
+
+// Load runs the scripts and returns the firmware metadata, it is nil
+// if no device identity was found
+func (l *FirmwareMetadataLoader) Load() (*FirmwareMetadata, error) {
+	return NewFirmwareMetadata(l.BasePath, l.Store, l.CmdLineExecuter)
+}
+
 func executeHooks(basePath string, store afero.Fs, cmd utils.CmdLineExecuter) (map[string]string, error) {
 	files, err := afero.ReadDir(store, basePath)
 	if err != nil && !os.IsNotExist(err) {
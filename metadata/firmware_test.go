@@ -352,6 +352,111 @@ func TestNewFirmwareMetadataWithDeviceAttributesError(t *testing.T) {
 	clm.AssertExpectations(t)
 }
 
+func TestNewFirmwareMetadataWithPlugins(t *testing.T) {
+	metadataPath := "/"
+
+	expected := &FirmwareMetadata{
+		ProductUID: "productuid-value",
+		DeviceIdentity: map[string]string{
+			"id1":  "value1",
+			"imei": "356938035643809",
+		},
+		DeviceAttributes: map[string]string{
+			"attr1":   "value1",
+			"carrier": "acme",
+		},
+		Hardware:         "board",
+		HardwareRevision: "revB",
+		Version:          "2.0",
+	}
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	clm.On("Execute", path.Join(metadataPath, "product-uid")).Return([]byte("productuid-value"), nil)
+	clm.On("Execute", path.Join(metadataPath, "hardware")).Return([]byte("board"), nil)
+	clm.On("Execute", path.Join(metadataPath, "hardware-revision")).Return([]byte("revA"), nil)
+	clm.On("Execute", path.Join(metadataPath, "version")).Return([]byte("1.1"), nil)
+	clm.On("Execute", path.Join(metadataPath, "/device-attributes.d/attr1")).Return([]byte("attr1=value1"), nil)
+	clm.On("Execute", path.Join(metadataPath, "/firmware-metadata.d/10-modem")).Return([]byte("device-identity.imei=356938035643809\ndevice-attributes.carrier=acme\nhardware-revision=revA"), nil)
+	clm.On("Execute", path.Join(metadataPath, "/firmware-metadata.d/20-secure-element")).Return([]byte("device-identity.id1=value1\nhardware-revision=revB\nversion=2.0"), nil)
+
+	store := afero.NewMemMapFs()
+
+	files := map[string]string{
+		"/device-attributes.d/attr1":             "attr1=value1",
+		"/firmware-metadata.d/10-modem":          "",
+		"/firmware-metadata.d/20-secure-element": "",
+	}
+
+	for k, v := range files {
+		err := afero.WriteFile(store, k, []byte(v), 0700)
+		assert.NoError(t, err)
+	}
+
+	// not executable
+	err := afero.WriteFile(store, "/firmware-metadata.d/README", []byte(""), 0644)
+	assert.NoError(t, err)
+
+	loader := &FirmwareMetadataLoader{BasePath: metadataPath, Store: store, CmdLineExecuter: clm}
+
+	firmwareMetadata, err := loader.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, firmwareMetadata)
+
+	clm.AssertExpectations(t)
+}
+
+func TestNewFirmwareMetadataWithPluginErrors(t *testing.T) {
+	testCases := []struct {
+		name        string
+		output      string
+		err         error
+		expectedErr string
+	}{
+		{
+			"WithExecuteError",
+			"",
+			fmt.Errorf("execute error"),
+			"execute error",
+		},
+		{
+			"WithInvalidOutput",
+			"imei",
+			nil,
+			"invalid output of firmware metadata plugin '/firmware-metadata.d/plugin': '=' expected on line 1",
+		},
+		{
+			"WithUnknownField",
+			"imei=356938035643809",
+			nil,
+			"firmware metadata plugin '/firmware-metadata.d/plugin' set the unknown field 'imei'",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+
+			clm.On("Execute", "/product-uid").Return([]byte("productuid-value"), nil)
+			clm.On("Execute", "/hardware").Return([]byte(""), nil)
+			clm.On("Execute", "/hardware-revision").Return([]byte(""), nil)
+			clm.On("Execute", "/version").Return([]byte(""), nil)
+			clm.On("Execute", "/firmware-metadata.d/plugin").Return([]byte(tc.output), tc.err)
+
+			store := afero.NewMemMapFs()
+
+			err := afero.WriteFile(store, "/firmware-metadata.d/plugin", []byte(""), 0700)
+			assert.NoError(t, err)
+
+			firmwareMetadata, err := NewFirmwareMetadata("/", store, clm)
+			assert.EqualError(t, err, tc.expectedErr)
+			assert.Nil(t, firmwareMetadata)
+
+			clm.AssertExpectations(t)
+		})
+	}
+}
+
 func TestCheckSupportedHardware(t *testing.T) {
 	testCases := []struct {
 		name             string
@@ -24,7 +24,73 @@ type ObjectMetadata struct {
 	Sha256sum          string      `json:"sha256sum"`
 	Mode               string      `json:"mode"`
 	Compressed         bool        `json:"bool"`
+	Size               int64       `json:"size,omitempty"`
 	InstallIfDifferent interface{} `json:"install-if-different,omitempty"`
+	Encryption         *Encryption `json:"encryption,omitempty"`
+	Signature          []byte      `json:"signature,omitempty"` // base64 encoded, see VerifySignature
+	Chunks             []Chunk     `json:"chunks,omitempty"`
+	ChunkStore         string      `json:"chunk-store,omitempty"` // see Chunk
+	Seed               string      `json:"seed,omitempty"`        // see Chunk
+}
+
+// Chunk is an entry of the optional chunk table of an object, which
+// is the concatenation of its chunks in the order they are listed.
+// Each chunk is checked as soon as it's downloaded, so only the bad
+// or missing ones are downloaded again.
+//
+// When the object has a "chunk-store", the server path where each
+// chunk is found named after its sha256sum, the object isn't
+// downloaded as a whole but assembled from its chunks. The chunks
+// found at the same offset of the "seed", usually the currently
+// installed image, are taken from it instead of being downloaded.
+type Chunk struct {
+	Size      int64  `json:"size"`
+	Sha256sum string `json:"sha256sum"`
+}
+
+// ChunksSize returns the size of the object made of "chunks"
+func ChunksSize(chunks []Chunk) int64 {
+	var size int64
+	for _, c := range chunks {
+		size += c.Size
+	}
+
+	return size
+}
+
+// ChunkStart returns the offset of the chunk which holds the byte at
+// "offset", so a download can be resumed from its start. The end of
+// the chunk table is returned for the offsets past it.
+func ChunkStart(chunks []Chunk, offset int64) int64 {
+	var start int64
+	for _, c := range chunks {
+		if offset < start+c.Size {
+			return start
+		}
+
+		start += c.Size
+	}
+
+	return start
+}
+
+// Encryption describes how an encrypted object was encrypted. The
+// "sha256sum" of the object is still the one of its plaintext.
+//
+// The object is split in segments of "segment-size" bytes, each one
+// sealed by AES-GCM with the content key and the nonce made of the
+// 8 bytes "nonce" followed by the big endian 32 bits index of the
+// segment. The additional data is a single byte, 1 for the last
+// segment and 0 for the others, so a truncated object is detected.
+//
+// The content key is wrapped for the device: it's sealed by AES-GCM
+// with the device key and the "wrapped-key" is the 12 bytes nonce
+// followed by the sealed content key.
+type Encryption struct {
+	Algorithm   string `json:"algorithm"`
+	WrappedKey  []byte `json:"wrapped-key"`
+	Nonce       []byte `json:"nonce"`
+	SegmentSize int64  `json:"segment-size"`
 }
 
 func NewObjectMetadata(bytes []byte) (Object, error) {
@@ -66,6 +132,35 @@ type CompressedObject struct {
 	UncompressedSize float64 `json:"required-uncompressed-size"`
 }
 
+// compressedObject is implemented by the objects embedding
+// CompressedObject
+type compressedObject interface {
+	compressedSize() float64
+}
+
+func (c CompressedObject) compressedSize() float64 {
+	return c.CompressedSize
+}
+
+// DownloadSize returns the number of bytes "o" takes once downloaded,
+// which is its "size" or, when it isn't known, the size of its chunks
+// or its required compressed size. It returns 0 when none is known.
+func DownloadSize(o Object) int64 {
+	if size := o.GetObjectMetadata().Size; size > 0 {
+		return size
+	}
+
+	if size := ChunksSize(o.GetObjectMetadata().Chunks); size > 0 {
+		return size
+	}
+
+	if c, ok := o.(compressedObject); ok {
+		return int64(c.compressedSize())
+	}
+
+	return 0
+}
+
 type Object interface {
 	handlers.InstallUpdateHandler
 
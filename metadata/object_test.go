@@ -19,6 +19,20 @@ type TestObject struct {
 	Object
 }
 
+type TestObjectWithMetadata struct {
+	Object
+	ObjectMetadata
+}
+
+func (o TestObjectWithMetadata) GetObjectMetadata() ObjectMetadata {
+	return o.ObjectMetadata
+}
+
+type TestSizedCompressedObject struct {
+	TestObjectWithMetadata
+	CompressedObject
+}
+
 func TestObjectFromValidJson(t *testing.T) {
 	mode := installmodes.RegisterInstallMode(installmodes.InstallMode{
 		Name:              "test",
@@ -41,3 +55,66 @@ func TestObjectFromInvalidJson(t *testing.T) {
 	assert.Nil(t, obj)
 	assert.Error(t, err)
 }
+
+func TestDownloadSize(t *testing.T) {
+	sized := TestObjectWithMetadata{ObjectMetadata: ObjectMetadata{Size: 100}}
+	assert.Equal(t, int64(100), DownloadSize(sized))
+
+	compressed := TestSizedCompressedObject{CompressedObject: CompressedObject{CompressedSize: 50}}
+	assert.Equal(t, int64(50), DownloadSize(compressed))
+
+	compressed.Size = 80
+	assert.Equal(t, int64(80), DownloadSize(compressed))
+
+	assert.Equal(t, int64(0), DownloadSize(TestObjectWithMetadata{}))
+
+	chunked := TestObjectWithMetadata{ObjectMetadata: ObjectMetadata{Chunks: []Chunk{{Size: 10}, {Size: 5}}}}
+	assert.Equal(t, int64(15), DownloadSize(chunked))
+}
+
+func TestChunkStart(t *testing.T) {
+	chunks := []Chunk{{Size: 10}, {Size: 10}, {Size: 5}}
+
+	assert.Equal(t, int64(25), ChunksSize(chunks))
+
+	testCases := []struct {
+		offset        int64
+		expectedStart int64
+	}{
+		{0, 0},
+		{9, 0},
+		{10, 10},
+		{19, 10},
+		{24, 20},
+		{25, 25},
+		{30, 25},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expectedStart, ChunkStart(chunks, tc.offset), "offset %d", tc.offset)
+	}
+
+	assert.Equal(t, int64(0), ChunkStart(nil, 10))
+}
+
+func TestObjectWithChunksFromJson(t *testing.T) {
+	mode := installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "test",
+		CheckRequirements: func() error { return nil },
+		GetObject:         func() interface{} { return &TestObjectWithMetadata{} },
+	})
+
+	defer mode.Unregister()
+
+	obj, err := NewObjectMetadata([]byte(`{
+	  "mode": "test",
+	  "sha256sum": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+	  "chunks": [
+	    { "size": 2, "sha256sum": "a" },
+	    { "size": 2, "sha256sum": "b" }
+	  ]
+	}`))
+	assert.NoError(t, err)
+
+	assert.Equal(t, []Chunk{{Size: 2, Sha256sum: "a"}, {Size: 2, Sha256sum: "b"}}, obj.GetObjectMetadata().Chunks)
+}
@@ -0,0 +1,201 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package metadata
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// ParsePublicKey parses a PEM encoded RSA or ECDSA public key
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block containing the public key")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %s", err)
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("public key type '%T' is not supported", key)
+}
+
+// TrustedKey is a public key trusted to verify the signatures while
+// it's valid. Its validity is given by the optional "Not-Before" and
+// "Not-After" headers (RFC 3339) of its PEM block, so the keys can be
+// rotated.
+type TrustedKey struct {
+	Key       crypto.PublicKey
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// ParseTrustedKey parses a PEM encoded RSA or ECDSA public key along
+// with its validity
+func ParseTrustedKey(data []byte) (*TrustedKey, error) {
+	key, err := ParsePublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+
+	tk := &TrustedKey{Key: key}
+
+	validity := []struct {
+		header string
+		t      *time.Time
+	}{
+		{"Not-Before", &tk.NotBefore},
+		{"Not-After", &tk.NotAfter},
+	}
+
+	for _, v := range validity {
+		value, ok := block.Headers[v.header]
+		if !ok {
+			continue
+		}
+
+		*v.t, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid '%s' of the public key: '%s'", v.header, value)
+		}
+	}
+
+	return tk, nil
+}
+
+// ValidAt tells whether the key is valid at "t"
+func (k *TrustedKey) ValidAt(t time.Time) bool {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+
+	return k.NotAfter.IsZero() || !t.After(k.NotAfter)
+}
+
+// KeyFingerprint returns the hex encoded SHA256 digest of the
+// SubjectPublicKeyInfo of "key", which identifies it
+func KeyFingerprint(key crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.Sum256(der)
+
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// VerifySignature checks the detached "Signature" against the raw
+// metadata bytes. The signature must be a RSA PKCS#1 v1.5 or an ASN.1
+// encoded ECDSA signature of the SHA256 digest of the raw bytes.
+func (m *UpdateMetadata) VerifySignature(key crypto.PublicKey) error {
+	return m.VerifySignatureWithKeys([]crypto.PublicKey{key})
+}
+
+// VerifySignatureWithKeys is like VerifySignature, but it's enough
+// that one of "keys" verifies the signature
+func (m *UpdateMetadata) VerifySignatureWithKeys(keys []crypto.PublicKey) error {
+	if len(m.Signature) == 0 {
+		return errors.New("update metadata is not signed")
+	}
+
+	digest := sha256.Sum256(m.RawBytes)
+
+	var err error
+
+	for _, key := range keys {
+		err = verifySignature(key, digest[:], m.Signature, "update metadata")
+		if err == nil {
+			return nil
+		}
+	}
+
+	if err == nil {
+		err = errors.New("no public key to verify the update metadata signature")
+	}
+
+	return err
+}
+
+// VerifySignature checks the object "Signature" against "keys", it's
+// enough that one of them verifies it. The signature is the same as
+// the one of the update metadata, but of the object SHA256 digest, so
+// the object must still be checked against its "sha256sum".
+func (o ObjectMetadata) VerifySignature(keys []crypto.PublicKey) error {
+	if len(o.Signature) == 0 {
+		return fmt.Errorf("object '%s' is not signed", o.Sha256sum)
+	}
+
+	digest, err := hex.DecodeString(o.Sha256sum)
+	if err != nil || len(digest) != sha256.Size {
+		return fmt.Errorf("invalid object sha256sum '%s'", o.Sha256sum)
+	}
+
+	for _, key := range keys {
+		err = verifySignature(key, digest, o.Signature, fmt.Sprintf("object '%s'", o.Sha256sum))
+		if err == nil {
+			return nil
+		}
+	}
+
+	if err == nil {
+		err = errors.New("no public key to verify the object signatures")
+	}
+
+	return err
+}
+
+// verifySignature checks "signature" of the SHA256 "digest" of "what"
+func verifySignature(key crypto.PublicKey, digest []byte, signature []byte, what string) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, signature)
+		if err != nil {
+			return fmt.Errorf("invalid %s signature: %s", what, err)
+		}
+
+		return nil
+	case *ecdsa.PublicKey:
+		var sig struct {
+			R, S *big.Int
+		}
+
+		_, err := asn1.Unmarshal(signature, &sig)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s signature: %s", what, err)
+		}
+
+		if !ecdsa.Verify(k, digest, sig.R, sig.S) {
+			return fmt.Errorf("invalid %s signature", what)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("public key type '%T' is not supported", key)
+}
@@ -0,0 +1,242 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package metadata
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodePublicKey(t *testing.T, key crypto.PublicKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	assert.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestParsePublicKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	key, err := ParsePublicKey(encodePublicKey(t, &rsaKey.PublicKey))
+	assert.NoError(t, err)
+	assert.Equal(t, &rsaKey.PublicKey, key)
+
+	key, err = ParsePublicKey(encodePublicKey(t, &ecdsaKey.PublicKey))
+	assert.NoError(t, err)
+	assert.Equal(t, &ecdsaKey.PublicKey, key)
+}
+
+func TestParsePublicKeyWithInvalidData(t *testing.T) {
+	key, err := ParsePublicKey([]byte("invalid"))
+	assert.Nil(t, key)
+	assert.EqualError(t, err, "failed to decode PEM block containing the public key")
+
+	key, err = ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("invalid")}))
+	assert.Nil(t, key)
+	assert.Error(t, err)
+}
+
+func TestVerifySignature(t *testing.T) {
+	rawBytes := []byte(`{"product-uid": "0123456789"}`)
+	digest := sha256.Sum256(rawBytes)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+
+	rsaSignature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	assert.NoError(t, err)
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	ecdsaSignature, err := ecdsaKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		Name      string
+		Key       crypto.PublicKey
+		Signature []byte
+		Valid     bool
+	}{
+		{"RSA", &rsaKey.PublicKey, rsaSignature, true},
+		{"RSAWithWrongSignature", &rsaKey.PublicKey, ecdsaSignature, false},
+		{"ECDSA", &ecdsaKey.PublicKey, ecdsaSignature, true},
+		{"ECDSAWithWrongSignature", &ecdsaKey.PublicKey, rsaSignature, false},
+		{"Unsigned", &rsaKey.PublicKey, nil, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := &UpdateMetadata{RawBytes: rawBytes, Signature: tc.Signature}
+
+			err := m.VerifySignature(tc.Key)
+			if tc.Valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestVerifySignatureWithTamperedMetadata(t *testing.T) {
+	rawBytes := []byte(`{"product-uid": "0123456789"}`)
+	digest := sha256.Sum256(rawBytes)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	assert.NoError(t, err)
+
+	m := &UpdateMetadata{RawBytes: []byte(`{"product-uid": "9876543210"}`), Signature: signature}
+
+	err = m.VerifySignature(&rsaKey.PublicKey)
+	assert.EqualError(t, err, "invalid update metadata signature: crypto/rsa: verification error")
+}
+
+func TestVerifySignatureWithUnsupportedKey(t *testing.T) {
+	m := &UpdateMetadata{Signature: []byte("signature")}
+
+	err := m.VerifySignature("key")
+	assert.EqualError(t, err, "public key type 'string' is not supported")
+}
+
+func TestVerifySignatureWithKeys(t *testing.T) {
+	rawBytes := []byte(`{"product-uid": "0123456789"}`)
+	digest := sha256.Sum256(rawBytes)
+
+	oldKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	signature, err := newKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err)
+
+	m := &UpdateMetadata{RawBytes: rawBytes, Signature: signature}
+
+	assert.NoError(t, m.VerifySignatureWithKeys([]crypto.PublicKey{&oldKey.PublicKey, &newKey.PublicKey}))
+	assert.EqualError(t, m.VerifySignatureWithKeys([]crypto.PublicKey{&oldKey.PublicKey}), "invalid update metadata signature: crypto/rsa: verification error")
+	assert.EqualError(t, m.VerifySignatureWithKeys(nil), "no public key to verify the update metadata signature")
+}
+
+func TestParseTrustedKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+
+	data := pem.EncodeToMemory(&pem.Block{
+		Type:    "PUBLIC KEY",
+		Headers: map[string]string{"Not-Before": "2017-01-01T00:00:00Z", "Not-After": "2018-01-01T00:00:00Z"},
+		Bytes:   der,
+	})
+
+	tk, err := ParseTrustedKey(data)
+	assert.NoError(t, err)
+	assert.Equal(t, &key.PublicKey, tk.Key)
+	assert.Equal(t, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), tk.NotBefore.UTC())
+	assert.Equal(t, time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), tk.NotAfter.UTC())
+
+	assert.False(t, tk.ValidAt(time.Date(2016, 12, 31, 0, 0, 0, 0, time.UTC)))
+	assert.True(t, tk.ValidAt(time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)))
+	assert.True(t, tk.ValidAt(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)))
+	assert.False(t, tk.ValidAt(time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)))
+
+	// without validity it's valid forever
+	tk, err = ParseTrustedKey(encodePublicKey(t, &key.PublicKey))
+	assert.NoError(t, err)
+	assert.True(t, tk.NotBefore.IsZero())
+	assert.True(t, tk.NotAfter.IsZero())
+	assert.True(t, tk.ValidAt(time.Now()))
+
+	data = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Headers: map[string]string{"Not-After": "tomorrow"}, Bytes: der})
+
+	_, err = ParseTrustedKey(data)
+	assert.EqualError(t, err, "invalid 'Not-After' of the public key: 'tomorrow'")
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+
+	digest := sha256.Sum256(der)
+
+	fingerprint, err := KeyFingerprint(&key.PublicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(digest[:]), fingerprint)
+
+	_, err = KeyFingerprint("key")
+	assert.Error(t, err)
+}
+
+func TestObjectVerifySignature(t *testing.T) {
+	content := []byte("test")
+	digest := sha256.Sum256(content)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	signature, err := ecdsaKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err)
+
+	keys := []crypto.PublicKey{&rsaKey.PublicKey, &ecdsaKey.PublicKey}
+
+	o := ObjectMetadata{Sha256sum: hex.EncodeToString(digest[:]), Signature: signature}
+
+	// any of the keys verifies it
+	err = o.VerifySignature(keys)
+	assert.NoError(t, err)
+
+	err = o.VerifySignature(keys[:1])
+	assert.EqualError(t, err, "invalid object '9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08' signature: crypto/rsa: verification error")
+
+	err = o.VerifySignature(nil)
+	assert.EqualError(t, err, "no public key to verify the object signatures")
+
+	// the signature is bound to the sha256sum
+	tampered := ObjectMetadata{Sha256sum: "ea8a4e45fb19a0f7ca792157d2bb3dcecfe6cfa770852cb4ab8f2c8c4a87f6cd", Signature: signature}
+
+	err = tampered.VerifySignature(keys[1:])
+	assert.EqualError(t, err, "invalid object 'ea8a4e45fb19a0f7ca792157d2bb3dcecfe6cfa770852cb4ab8f2c8c4a87f6cd' signature")
+
+	unsigned := ObjectMetadata{Sha256sum: o.Sha256sum}
+
+	err = unsigned.VerifySignature(keys)
+	assert.EqualError(t, err, "object '9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08' is not signed")
+
+	invalid := ObjectMetadata{Sha256sum: "invalid", Signature: signature}
+
+	err = invalid.VerifySignature(keys)
+	assert.EqualError(t, err, "invalid object sha256sum 'invalid'")
+}
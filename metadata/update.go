@@ -24,7 +24,11 @@ type UpdateMetadata struct {
 	Version           string     `json:"version"`
 	Objects           [][]Object `json:"-"`
 	SupportedHardware []Hardware `json:"supported-hardware"`
+	TrustedKeys       []string   `json:"trusted-keys,omitempty"` // PEM encoded, see ParseTrustedKey
+	RevokedKeys       []string   `json:"revoked-keys,omitempty"` // fingerprints, see KeyFingerprint
+	Script            string     `json:"script,omitempty"`       // starlark source which installs the update
 	RawBytes          []byte
+	Signature         []byte `json:"-"`
 }
 
 func NewUpdateMetadata(bytes []byte) (*UpdateMetadata, error) {
@@ -9,17 +9,23 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
+
+	"github.com/UpdateHub/updatehub/log"
+	"github.com/UpdateHub/updatehub/updatehub"
 )
 
 type AgentBackend struct {
+	uh *updatehub.UpdateHub
 }
 
-func NewAgentBackend() (*AgentBackend, error) {
-	ab := &AgentBackend{}
+func NewAgentBackend(uh *updatehub.UpdateHub) (*AgentBackend, error) {
+	ab := &AgentBackend{uh: uh}
 
 	return ab, nil
 }
@@ -27,9 +33,179 @@ func NewAgentBackend() (*AgentBackend, error) {
 func (ab *AgentBackend) Routes() []Route {
 	return []Route{
 		{Method: "GET", Path: "/", Handle: ab.index},
+		{Method: "GET", Path: "/status", Handle: ab.status},
+		{Method: "POST", Path: "/probe", Handle: ab.probe},
+		{Method: "POST", Path: "/reload", Handle: ab.reload},
+		{Method: "POST", Path: "/abort-download", Handle: ab.abortDownload},
+		{Method: "POST", Path: "/pause-download", Handle: ab.pauseDownload},
+		{Method: "POST", Path: "/resume-download", Handle: ab.resumeDownload},
+		{Method: "POST", Path: "/approve", Handle: ab.approve},
+		{Method: "POST", Path: "/reject", Handle: ab.reject},
+		{Method: "POST", Path: "/cleanup-download-dir", Handle: ab.cleanupDownloadDir},
+		{Method: "GET", Path: "/firmware-metadata", Handle: ab.firmwareMetadata},
+		{Method: "GET", Path: "/log", Handle: ab.eventLog},
+		{Method: "GET", Path: "/audit", Handle: ab.auditLog},
+		{Method: "GET", Path: "/log-level", Handle: ab.logLevel},
+		{Method: "POST", Path: "/log-level", Handle: ab.setLogLevel},
 	}
 }
 
 func (ab *AgentBackend) index(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	fmt.Fprintf(w, "Agent backend index")
 }
+
+func (ab *AgentBackend) status(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	writeJSON(w, http.StatusOK, ab.uh.Status())
+}
+
+// probe requests an update check, which is done at the "server-address"
+// of the optional JSON body instead of the configured servers
+func (ab *AgentBackend) probe(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer r.Body.Close()
+
+	var args struct {
+		ServerAddress string `json:"server-address"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&args)
+	if err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid probe request: %s", err)})
+		return
+	}
+
+	err = ab.uh.ProbeUpdateWithServer(args.ServerAddress)
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"message": "probe requested"})
+}
+
+// reload applies the settings changed since the agent started, as
+// SIGHUP does
+func (ab *AgentBackend) reload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	err := ab.uh.ReloadSettings()
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "settings reloaded"})
+}
+
+func (ab *AgentBackend) abortDownload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	err := ab.uh.AbortDownload()
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"message": "download aborted"})
+}
+
+func (ab *AgentBackend) pauseDownload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	err := ab.uh.PauseDownload()
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"message": "download paused"})
+}
+
+func (ab *AgentBackend) resumeDownload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	err := ab.uh.ResumeDownload()
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"message": "download resumed"})
+}
+
+func (ab *AgentBackend) approve(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	err := ab.uh.ApproveUpdate()
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"message": "update approved"})
+}
+
+func (ab *AgentBackend) reject(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	err := ab.uh.RejectUpdate()
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"message": "update rejected"})
+}
+
+// cleanupDownloadDir removes the objects of the download dir which
+// aren't needed anymore, as done whenever the agent goes idle
+func (ab *AgentBackend) cleanupDownloadDir(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	freed, err := ab.uh.CleanupDownloadDir()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": fmt.Sprintf("%d bytes freed", freed)})
+}
+
+func (ab *AgentBackend) firmwareMetadata(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	writeJSON(w, http.StatusOK, ab.uh.GetFirmwareMetadata())
+}
+
+func (ab *AgentBackend) eventLog(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	writeJSON(w, http.StatusOK, ab.uh.EventLog())
+}
+
+// auditLog exports the audit log, a log whose chain is broken is still
+// exported but it isn't "verified"
+func (ab *AgentBackend) auditLog(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	writeJSON(w, http.StatusOK, ab.uh.AuditLog())
+}
+
+func (ab *AgentBackend) logLevel(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	writeJSON(w, http.StatusOK, map[string]string{"level": updatehub.GetLogLevel().String()})
+}
+
+// setLogLevel changes the log level to the "level" of the JSON body,
+// which is either "silent", "warning", "info" or "verbose"
+func (ab *AgentBackend) setLogLevel(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer r.Body.Close()
+
+	var args struct {
+		Level string `json:"level"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&args)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid log level request: %s", err)})
+		return
+	}
+
+	level, err := updatehub.ParseLogLevel(args.Level)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	updatehub.SetLogLevel(level)
+
+	writeJSON(w, http.StatusOK, map[string]string{"level": level.String()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Warn(err)
+	}
+}
@@ -9,34 +9,68 @@
 package server
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/updatehub"
 )
 
 func TestNewAgentBackend(t *testing.T) {
-	ab, err := NewAgentBackend()
+	uh := &updatehub.UpdateHub{}
+
+	ab, err := NewAgentBackend(uh)
 
 	assert.NoError(t, err)
+	assert.Equal(t, uh, ab.uh)
 
 	routes := ab.Routes()
 
-	assert.Equal(t, 1, len(routes))
-	assert.Equal(t, "GET", routes[0].Method)
-	assert.Equal(t, "/", routes[0].Path)
+	expectedRoutes := []struct {
+		method   string
+		path     string
+		function interface{}
+	}{
+		{"GET", "/", ab.index},
+		{"GET", "/status", ab.status},
+		{"POST", "/probe", ab.probe},
+		{"POST", "/reload", ab.reload},
+		{"POST", "/abort-download", ab.abortDownload},
+		{"POST", "/pause-download", ab.pauseDownload},
+		{"POST", "/resume-download", ab.resumeDownload},
+		{"POST", "/approve", ab.approve},
+		{"POST", "/reject", ab.reject},
+		{"POST", "/cleanup-download-dir", ab.cleanupDownloadDir},
+		{"GET", "/firmware-metadata", ab.firmwareMetadata},
+		{"GET", "/log", ab.eventLog},
+		{"GET", "/audit", ab.auditLog},
+		{"GET", "/log-level", ab.logLevel},
+		{"POST", "/log-level", ab.setLogLevel},
+	}
+
+	assert.Equal(t, len(expectedRoutes), len(routes))
 
-	expectedFunction := reflect.ValueOf(ab.index)
-	receivedFunction := reflect.ValueOf(routes[0].Handle)
+	for i, expected := range expectedRoutes {
+		assert.Equal(t, expected.method, routes[i].Method)
+		assert.Equal(t, expected.path, routes[i].Path)
 
-	assert.Equal(t, expectedFunction.Pointer(), receivedFunction.Pointer())
+		expectedFunction := reflect.ValueOf(expected.function)
+		receivedFunction := reflect.ValueOf(routes[i].Handle)
+
+		assert.Equal(t, expectedFunction.Pointer(), receivedFunction.Pointer())
+	}
 }
 
 func TestIndexRoute(t *testing.T) {
-	ab, err := NewAgentBackend()
+	ab, err := NewAgentBackend(&updatehub.UpdateHub{})
 	assert.NoError(t, err)
 
 	router := NewBackendRouter(ab)
@@ -50,3 +84,463 @@ func TestIndexRoute(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, []byte("Agent backend index"), bodyContent)
 }
+
+func TestStatusRoute(t *testing.T) {
+	uh := &updatehub.UpdateHub{State: updatehub.NewIdleState()}
+
+	ab, err := NewAgentBackend(uh)
+	assert.NoError(t, err)
+
+	router := NewBackendRouter(ab)
+	server := httptest.NewServer(router.HTTPRouter)
+	defer server.Close()
+
+	r, err := http.Get(server.URL + "/status")
+	assert.NoError(t, err)
+	defer r.Body.Close()
+
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+	var status updatehub.Status
+	err = json.NewDecoder(r.Body).Decode(&status)
+	assert.NoError(t, err)
+	assert.Equal(t, uh.Status(), status)
+	assert.Equal(t, "idle", status.State)
+}
+
+func TestProbeRoute(t *testing.T) {
+	testCases := []struct {
+		name           string
+		state          updatehub.State
+		body           string
+		expectedStatus int
+		expectedBody   map[string]string
+	}{
+		{
+			"WhenIdle",
+			updatehub.NewIdleState(),
+			"",
+			http.StatusAccepted,
+			map[string]string{"message": "probe requested"},
+		},
+
+		{
+			"WithServerAddress",
+			updatehub.NewIdleState(),
+			`{"server-address": "commissioning:8080"}`,
+			http.StatusAccepted,
+			map[string]string{"message": "probe requested"},
+		},
+
+		{
+			"WithInvalidBody",
+			updatehub.NewIdleState(),
+			"{",
+			http.StatusBadRequest,
+			map[string]string{"error": "invalid probe request: unexpected EOF"},
+		},
+
+		{
+			"WhenDownloading",
+			updatehub.NewDownloadingState(&metadata.UpdateMetadata{}),
+			"",
+			http.StatusConflict,
+			map[string]string{"error": "can't probe for updates while in the 'downloading' state"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ab, err := NewAgentBackend(&updatehub.UpdateHub{State: tc.state})
+			assert.NoError(t, err)
+
+			router := NewBackendRouter(ab)
+			server := httptest.NewServer(router.HTTPRouter)
+			defer server.Close()
+
+			r, err := http.Post(server.URL+"/probe", "application/json", strings.NewReader(tc.body))
+			assert.NoError(t, err)
+			defer r.Body.Close()
+
+			assert.Equal(t, tc.expectedStatus, r.StatusCode)
+
+			var body map[string]string
+			err = json.NewDecoder(r.Body).Decode(&body)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedBody, body)
+		})
+	}
+}
+
+func TestReloadRoute(t *testing.T) {
+	testCases := []struct {
+		name           string
+		settings       string
+		expectedStatus int
+		expectedBody   map[string]string
+	}{
+		{
+			"WithValidSettings",
+			"[Polling]\nInterval=2h\n",
+			http.StatusOK,
+			map[string]string{"message": "settings reloaded"},
+		},
+
+		{
+			"WithInvalidSettings",
+			"[Approval]\nInstallMode=later\n",
+			http.StatusConflict,
+			map[string]string{"error": "failed to reload the settings: invalid settings: [Approval] InstallMode: invalid approval mode 'later'"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			uh := &updatehub.UpdateHub{
+				State:               updatehub.NewIdleState(),
+				Store:               afero.NewMemMapFs(),
+				SystemSettingsPath:  "/systempath",
+				RuntimeSettingsPath: "/runtimepath",
+			}
+
+			err := uh.LoadSettings()
+			assert.NoError(t, err)
+
+			err = afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte(tc.settings), 0644)
+			assert.NoError(t, err)
+
+			ab, err := NewAgentBackend(uh)
+			assert.NoError(t, err)
+
+			router := NewBackendRouter(ab)
+			server := httptest.NewServer(router.HTTPRouter)
+			defer server.Close()
+
+			r, err := http.Post(server.URL+"/reload", "application/json", nil)
+			assert.NoError(t, err)
+			defer r.Body.Close()
+
+			assert.Equal(t, tc.expectedStatus, r.StatusCode)
+
+			var body map[string]string
+			err = json.NewDecoder(r.Body).Decode(&body)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedBody, body)
+		})
+	}
+}
+
+func TestAbortDownloadRoute(t *testing.T) {
+	testCases := []struct {
+		name           string
+		state          updatehub.State
+		expectedStatus int
+		expectedBody   map[string]string
+	}{
+		{
+			"WhenDownloading",
+			updatehub.NewDownloadingState(&metadata.UpdateMetadata{}),
+			http.StatusAccepted,
+			map[string]string{"message": "download aborted"},
+		},
+
+		{
+			"WhenIdle",
+			updatehub.NewIdleState(),
+			http.StatusConflict,
+			map[string]string{"error": "there is no download in progress"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ab, err := NewAgentBackend(&updatehub.UpdateHub{State: tc.state})
+			assert.NoError(t, err)
+
+			router := NewBackendRouter(ab)
+			server := httptest.NewServer(router.HTTPRouter)
+			defer server.Close()
+
+			r, err := http.Post(server.URL+"/abort-download", "application/json", nil)
+			assert.NoError(t, err)
+			defer r.Body.Close()
+
+			assert.Equal(t, tc.expectedStatus, r.StatusCode)
+
+			var body map[string]string
+			err = json.NewDecoder(r.Body).Decode(&body)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedBody, body)
+		})
+	}
+}
+
+func TestPauseAndResumeDownloadRoutes(t *testing.T) {
+	ab, err := NewAgentBackend(&updatehub.UpdateHub{State: updatehub.NewDownloadingState(&metadata.UpdateMetadata{})})
+	assert.NoError(t, err)
+
+	router := NewBackendRouter(ab)
+	server := httptest.NewServer(router.HTTPRouter)
+	defer server.Close()
+
+	testCases := []struct {
+		path           string
+		expectedStatus int
+		expectedBody   map[string]string
+	}{
+		{"/resume-download", http.StatusConflict, map[string]string{"error": "the download isn't paused"}},
+		{"/pause-download", http.StatusAccepted, map[string]string{"message": "download paused"}},
+		{"/pause-download", http.StatusConflict, map[string]string{"error": "the download is already paused"}},
+		{"/resume-download", http.StatusAccepted, map[string]string{"message": "download resumed"}},
+	}
+
+	for _, tc := range testCases {
+		r, err := http.Post(server.URL+tc.path, "application/json", nil)
+		assert.NoError(t, err)
+
+		assert.Equal(t, tc.expectedStatus, r.StatusCode)
+
+		var body map[string]string
+		err = json.NewDecoder(r.Body).Decode(&body)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expectedBody, body)
+
+		r.Body.Close()
+	}
+}
+
+func TestApproveAndRejectRoutes(t *testing.T) {
+	m := &metadata.UpdateMetadata{}
+
+	testCases := []struct {
+		name           string
+		state          updatehub.State
+		path           string
+		expectedStatus int
+		expectedBody   map[string]string
+	}{
+		{
+			"ApproveWhenAwaiting",
+			updatehub.NewAwaitingInstallApprovalState(m, updatehub.NewInstallingState(m, nil, nil, nil, nil)),
+			"/approve",
+			http.StatusAccepted,
+			map[string]string{"message": "update approved"},
+		},
+
+		{
+			"RejectWhenAwaiting",
+			updatehub.NewAwaitingRebootApprovalState(m, updatehub.NewWaitingForRebootState(m)),
+			"/reject",
+			http.StatusAccepted,
+			map[string]string{"message": "update rejected"},
+		},
+
+		{
+			"ApproveWhenIdle",
+			updatehub.NewIdleState(),
+			"/approve",
+			http.StatusConflict,
+			map[string]string{"error": "there is no approval pending"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ab, err := NewAgentBackend(&updatehub.UpdateHub{State: tc.state})
+			assert.NoError(t, err)
+
+			router := NewBackendRouter(ab)
+			server := httptest.NewServer(router.HTTPRouter)
+			defer server.Close()
+
+			r, err := http.Post(server.URL+tc.path, "application/json", nil)
+			assert.NoError(t, err)
+			defer r.Body.Close()
+
+			assert.Equal(t, tc.expectedStatus, r.StatusCode)
+
+			var body map[string]string
+			err = json.NewDecoder(r.Body).Decode(&body)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedBody, body)
+		})
+	}
+}
+
+func TestFirmwareMetadataRoute(t *testing.T) {
+	uh := &updatehub.UpdateHub{
+		FirmwareMetadata: metadata.FirmwareMetadata{
+			ProductUID:       "productuid-value",
+			DeviceIdentity:   map[string]string{"id1": "id1-value"},
+			DeviceAttributes: map[string]string{"attr1": "attr1-value"},
+			Hardware:         "hardware-value",
+			HardwareRevision: "hardware-revision-value",
+			Version:          "version-value",
+		},
+	}
+
+	ab, err := NewAgentBackend(uh)
+	assert.NoError(t, err)
+
+	router := NewBackendRouter(ab)
+	server := httptest.NewServer(router.HTTPRouter)
+	defer server.Close()
+
+	r, err := http.Get(server.URL + "/firmware-metadata")
+	assert.NoError(t, err)
+	defer r.Body.Close()
+
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+
+	var fm metadata.FirmwareMetadata
+	err = json.NewDecoder(r.Body).Decode(&fm)
+	assert.NoError(t, err)
+	assert.Equal(t, uh.FirmwareMetadata, fm)
+}
+
+func TestEventLogRoute(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	err := afero.WriteFile(fs, "/var/lib/updatehub/event-log.json", []byte(`[{"time":"2017-01-01T00:00:00Z","type":"error","state":"error","package-uid":"puid","message":"install failed"}]`), 0644)
+	assert.NoError(t, err)
+
+	uh := &updatehub.UpdateHub{Store: fs}
+
+	err = uh.LoadSettings()
+	assert.NoError(t, err)
+
+	ab, err := NewAgentBackend(uh)
+	assert.NoError(t, err)
+
+	router := NewBackendRouter(ab)
+	server := httptest.NewServer(router.HTTPRouter)
+	defer server.Close()
+
+	r, err := http.Get(server.URL + "/log")
+	assert.NoError(t, err)
+	defer r.Body.Close()
+
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+
+	var events []updatehub.Event
+	err = json.NewDecoder(r.Body).Decode(&events)
+	assert.NoError(t, err)
+	assert.Equal(t, uh.EventLog(), events)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "install failed", events[0].Message)
+}
+
+func TestAuditLogRoute(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	uh := &updatehub.UpdateHub{Store: fs, SystemSettingsPath: "/etc/updatehub.conf"}
+
+	err := afero.WriteFile(fs, uh.SystemSettingsPath, []byte("[AuditLog]\nPath=/var/lib/updatehub/audit.log\nKey=/etc/updatehub/audit.key\n"), 0644)
+	assert.NoError(t, err)
+
+	err = afero.WriteFile(fs, "/etc/updatehub/audit.key", []byte("device key\n"), 0600)
+	assert.NoError(t, err)
+
+	err = uh.LoadSettings()
+	assert.NoError(t, err)
+
+	ab, err := NewAgentBackend(uh)
+	assert.NoError(t, err)
+
+	router := NewBackendRouter(ab)
+	server := httptest.NewServer(router.HTTPRouter)
+	defer server.Close()
+
+	r, err := http.Get(server.URL + "/audit")
+	assert.NoError(t, err)
+	defer r.Body.Close()
+
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+
+	var report updatehub.AuditReport
+	err = json.NewDecoder(r.Body).Decode(&report)
+	assert.NoError(t, err)
+	assert.Equal(t, updatehub.AuditReport{Entries: []updatehub.AuditEntry{}, Verified: true}, report)
+}
+
+func TestCleanupDownloadDirRoute(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	// an object no package refers to
+	err := afero.WriteFile(fs, "/tmp/9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", []byte("test"), 0644)
+	assert.NoError(t, err)
+
+	uh := &updatehub.UpdateHub{Store: fs}
+
+	err = uh.LoadSettings()
+	assert.NoError(t, err)
+
+	ab, err := NewAgentBackend(uh)
+	assert.NoError(t, err)
+
+	router := NewBackendRouter(ab)
+	server := httptest.NewServer(router.HTTPRouter)
+	defer server.Close()
+
+	r, err := http.Post(server.URL+"/cleanup-download-dir", "application/json", nil)
+	assert.NoError(t, err)
+	defer r.Body.Close()
+
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+
+	var body map[string]string
+	err = json.NewDecoder(r.Body).Decode(&body)
+	assert.NoError(t, err)
+	assert.Equal(t, "4 bytes freed", body["message"])
+
+	exists, err := afero.Exists(fs, "/tmp/9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestLogLevelRoutes(t *testing.T) {
+	defer updatehub.SetLogLevel(updatehub.GetLogLevel())
+
+	updatehub.SetLogLevel(updatehub.LogLevelWarning)
+
+	ab, err := NewAgentBackend(&updatehub.UpdateHub{})
+	assert.NoError(t, err)
+
+	router := NewBackendRouter(ab)
+	server := httptest.NewServer(router.HTTPRouter)
+	defer server.Close()
+
+	request := func(method string, body string) (int, map[string]string) {
+		req, err := http.NewRequest(method, server.URL+"/log-level", strings.NewReader(body))
+		assert.NoError(t, err)
+
+		r, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer r.Body.Close()
+
+		var response map[string]string
+		err = json.NewDecoder(r.Body).Decode(&response)
+		assert.NoError(t, err)
+
+		return r.StatusCode, response
+	}
+
+	status, body := request("GET", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, map[string]string{"level": "warning"}, body)
+
+	status, body = request("POST", `{"level": "verbose"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, map[string]string{"level": "verbose"}, body)
+	assert.Equal(t, updatehub.LogLevelVerbose, updatehub.GetLogLevel())
+
+	status, body = request("POST", `{"level": "loud"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, map[string]string{"error": "invalid log level 'loud'"}, body)
+	assert.Equal(t, updatehub.LogLevelVerbose, updatehub.GetLogLevel())
+
+	status, body = request("POST", "{")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, map[string]string{"error": "invalid log level request: unexpected EOF"}, body)
+}
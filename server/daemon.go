@@ -11,7 +11,7 @@ package server
 import (
 	"path"
 
-	"github.com/OSSystems/pkg/log"
+	"github.com/UpdateHub/updatehub/log"
 	"github.com/fsnotify/fsnotify"
 )
 
@@ -0,0 +1,183 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/log"
+	"github.com/UpdateHub/updatehub/updatehub"
+)
+
+// gatewayMaxRequestSize bounds the update checks and the reports of
+// the downstream agents, in bytes
+const gatewayMaxRequestSize = 1 << 20
+
+// GatewayBackend serves the server API to the downstream agents of an
+// agent running as their update gateway
+type GatewayBackend struct {
+	uh *updatehub.UpdateHub
+}
+
+func NewGatewayBackend(uh *updatehub.UpdateHub) (*GatewayBackend, error) {
+	gb := &GatewayBackend{uh: uh}
+
+	return gb, nil
+}
+
+func (gb *GatewayBackend) Routes() []Route {
+	return []Route{
+		{Method: "POST", Path: client.UpgradesEndpoint, Handle: gb.checkUpdate},
+		{Method: "POST", Path: client.StateReportEndpoint, Handle: gb.report},
+		{Method: "GET", Path: "/:product/:package/:object", Handle: gb.object},
+	}
+}
+
+func (gb *GatewayBackend) checkUpdate(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer r.Body.Close()
+
+	request, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, gatewayMaxRequestSize))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	update, err := gb.uh.GatewayCheckUpdate(request)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if update.ExtraPoll != "" {
+		w.Header().Set("Add-Extra-Poll", update.ExtraPoll)
+	}
+
+	if update.PollingInterval != "" {
+		w.Header().Set(client.PollingIntervalHeader, update.PollingInterval)
+	}
+
+	if update.Metadata == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "no update available"})
+		return
+	}
+
+	if update.Signature != "" {
+		w.Header().Set(client.SignatureHeader, update.Signature)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, err := w.Write(update.Metadata); err != nil {
+		log.Warn(err)
+	}
+}
+
+// report forwards the report, it's accepted even if it was only
+// queued
+func (gb *GatewayBackend) report(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer r.Body.Close()
+
+	report, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, gatewayMaxRequestSize))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if !json.Valid(report) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid report"})
+		return
+	}
+
+	err = gb.uh.GatewayReport(report)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "report accepted"})
+}
+
+// object serves the object from the cache, or from the server while
+// it's cached
+func (gb *GatewayBackend) object(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	uid := p.ByName("object")
+
+	if file, err := gb.uh.CachedGatewayObject(uid); err == nil {
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+
+		http.ServeContent(w, r, uid, info.ModTime(), file)
+		return
+	}
+
+	offset := rangeOffset(r.Header.Get("Range"))
+
+	body, contentLength, err := gb.uh.FetchGatewayObject(p.ByName("product"), p.ByName("package"), uid, offset)
+	if se, ok := err.(*client.StatusError); ok {
+		writeJSON(w, se.StatusCode, map[string]string{"error": se.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	if contentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	}
+
+	status := http.StatusOK
+	if offset > 0 {
+		status = http.StatusPartialContent
+
+		if contentLength > 0 {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", offset, offset+contentLength-1))
+		}
+	}
+
+	w.WriteHeader(status)
+
+	if _, err := io.Copy(w, body); err != nil {
+		log.Warn(err)
+	}
+}
+
+// rangeOffset returns where the range "bytes=<offset>-" starts, the
+// other ranges aren't supported and the whole object is served
+func rangeOffset(header string) int64 {
+	if !strings.HasPrefix(header, "bytes=") || !strings.HasSuffix(header, "-") {
+		return 0
+	}
+
+	offset, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(header, "bytes="), "-"), 10, 64)
+	if err != nil || offset < 0 {
+		return 0
+	}
+
+	return offset
+}
@@ -0,0 +1,189 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/updatehub"
+)
+
+const gatewayTestObjectUID = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+func newGatewayTestServer(t *testing.T) (*httptest.Server, *httptest.Server) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case client.UpgradesEndpoint:
+			w.Header().Set(client.SignatureHeader, "c2lnbmF0dXJl")
+			w.Header().Set("Add-Extra-Poll", "3")
+			fmt.Fprint(w, `{"product-uid": "0123456789"}`)
+		case client.StateReportEndpoint:
+			w.WriteHeader(http.StatusOK)
+		case "/0123456789/package/" + gatewayTestObjectUID:
+			fmt.Fprint(w, "test")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	u, err := url.Parse(upstream.URL)
+	assert.NoError(t, err)
+
+	fs := afero.NewMemMapFs()
+
+	err = afero.WriteFile(fs, "/etc/updatehub.conf", []byte("[Gateway]\nCacheDir=/cache\n"), 0644)
+	assert.NoError(t, err)
+
+	uh := &updatehub.UpdateHub{
+		Store:              fs,
+		SystemSettingsPath: "/etc/updatehub.conf",
+	}
+
+	err = uh.LoadSettings()
+	assert.NoError(t, err)
+
+	uh.API = client.NewApiClient(u.Host)
+	uh.Updater = client.NewUpdateClient()
+	uh.Reporter = client.NewReportClient()
+
+	gb, err := NewGatewayBackend(uh)
+	assert.NoError(t, err)
+
+	router := NewBackendRouter(gb)
+
+	return httptest.NewServer(router.HTTPRouter), upstream
+}
+
+func TestNewGatewayBackend(t *testing.T) {
+	uh := &updatehub.UpdateHub{}
+
+	gb, err := NewGatewayBackend(uh)
+
+	assert.NoError(t, err)
+	assert.Equal(t, uh, gb.uh)
+
+	routes := gb.Routes()
+
+	expectedRoutes := []struct {
+		method   string
+		path     string
+		function interface{}
+	}{
+		{"POST", "/upgrades", gb.checkUpdate},
+		{"POST", "/report", gb.report},
+		{"GET", "/:product/:package/:object", gb.object},
+	}
+
+	assert.Equal(t, len(expectedRoutes), len(routes))
+
+	for i, expected := range expectedRoutes {
+		assert.Equal(t, expected.method, routes[i].Method)
+		assert.Equal(t, expected.path, routes[i].Path)
+
+		expectedFunction := reflect.ValueOf(expected.function)
+		receivedFunction := reflect.ValueOf(routes[i].Handle)
+
+		assert.Equal(t, expectedFunction.Pointer(), receivedFunction.Pointer())
+	}
+}
+
+func TestGatewayCheckUpdateRoute(t *testing.T) {
+	gateway, upstream := newGatewayTestServer(t)
+	defer gateway.Close()
+	defer upstream.Close()
+
+	r, err := http.Post(gateway.URL+"/upgrades", "application/json", strings.NewReader(`{"product-uid": "0123456789"}`))
+	assert.NoError(t, err)
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(r.Body)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, "c2lnbmF0dXJl", r.Header.Get(client.SignatureHeader))
+	assert.Equal(t, "3", r.Header.Get("Add-Extra-Poll"))
+	assert.Equal(t, `{"product-uid": "0123456789"}`, string(body))
+}
+
+func TestGatewayReportRoute(t *testing.T) {
+	gateway, upstream := newGatewayTestServer(t)
+	defer gateway.Close()
+	defer upstream.Close()
+
+	r, err := http.Post(gateway.URL+"/report", "application/json", strings.NewReader(`{"status": "installed"}`))
+	assert.NoError(t, err)
+	r.Body.Close()
+
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+
+	r, err = http.Post(gateway.URL+"/report", "application/json", strings.NewReader(`{"status":`))
+	assert.NoError(t, err)
+	r.Body.Close()
+
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+
+	// too big
+	r, err = http.Post(gateway.URL+"/report", "application/json", strings.NewReader(`{"status": "`+strings.Repeat("x", gatewayMaxRequestSize)+`"}`))
+	assert.NoError(t, err)
+	r.Body.Close()
+
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+}
+
+func TestGatewayObjectRoute(t *testing.T) {
+	gateway, upstream := newGatewayTestServer(t)
+	defer gateway.Close()
+	defer upstream.Close()
+
+	u, err := url.Parse(gateway.URL)
+	assert.NoError(t, err)
+
+	uc := client.NewUpdateClient()
+	api := client.NewApiClient(u.Host)
+
+	// fetched from the server, then from the cache
+	for i := 0; i < 2; i++ {
+		body, _, err := uc.FetchUpdate(context.Background(), api.Request(), "/0123456789/package/"+gatewayTestObjectUID, 0)
+		assert.NoError(t, err)
+
+		data, err := ioutil.ReadAll(body)
+		assert.NoError(t, err)
+		assert.Equal(t, "test", string(data))
+		body.Close()
+	}
+
+	upstream.Close()
+
+	body, _, err := uc.FetchUpdate(context.Background(), api.Request(), "/0123456789/package/"+gatewayTestObjectUID, 2)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, "st", string(data))
+	body.Close()
+}
+
+func TestRangeOffset(t *testing.T) {
+	assert.Equal(t, int64(0), rangeOffset(""))
+	assert.Equal(t, int64(10), rangeOffset("bytes=10-"))
+	assert.Equal(t, int64(0), rangeOffset("bytes=10-20"))
+	assert.Equal(t, int64(0), rangeOffset("bytes=-10"))
+}
@@ -0,0 +1,64 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/updatehub"
+)
+
+// PeerBackend serves the objects of the download dir to the peers of
+// the LAN
+type PeerBackend struct {
+	uh *updatehub.UpdateHub
+}
+
+func NewPeerBackend(uh *updatehub.UpdateHub) (*PeerBackend, error) {
+	pb := &PeerBackend{uh: uh}
+
+	return pb, nil
+}
+
+func (pb *PeerBackend) Routes() []Route {
+	return []Route{
+		{Method: "GET", Path: client.PeerObjectsEndpoint + "/:uid", Handle: pb.object},
+	}
+}
+
+// object serves the object "uid", the "Range" requests resume the
+// downloads of the peers
+func (pb *PeerBackend) object(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	uid := p.ByName("uid")
+
+	if !pb.uh.AuthorizedPeer(uid, r.Header.Get(client.PeerSignatureHeader)) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid peer signature"})
+		return
+	}
+
+	file, err := pb.uh.OpenPeerObject(uid)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "object not found"})
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	http.ServeContent(w, r, uid, info.ModTime(), file)
+}
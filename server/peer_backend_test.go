@@ -0,0 +1,74 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/updatehub"
+)
+
+func TestNewPeerBackend(t *testing.T) {
+	uh := &updatehub.UpdateHub{}
+
+	pb, err := NewPeerBackend(uh)
+
+	assert.NoError(t, err)
+	assert.Equal(t, uh, pb.uh)
+
+	routes := pb.Routes()
+
+	assert.Equal(t, 1, len(routes))
+	assert.Equal(t, "GET", routes[0].Method)
+	assert.Equal(t, "/objects/:uid", routes[0].Path)
+	assert.Equal(t, reflect.ValueOf(pb.object).Pointer(), reflect.ValueOf(routes[0].Handle).Pointer())
+}
+
+func TestPeerObjectRoute(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	err := afero.WriteFile(fs, "/etc/updatehub.conf", []byte("[Peer]\nKey=/etc/peer.key\n"), 0644)
+	assert.NoError(t, err)
+	err = afero.WriteFile(fs, "/etc/peer.key", []byte("secret\n"), 0600)
+	assert.NoError(t, err)
+
+	uh := &updatehub.UpdateHub{Store: fs, SystemSettingsPath: "/etc/updatehub.conf"}
+
+	err = uh.LoadSettings()
+	assert.NoError(t, err)
+
+	pb, err := NewPeerBackend(uh)
+	assert.NoError(t, err)
+
+	router := NewBackendRouter(pb)
+	server := httptest.NewServer(router.HTTPRouter)
+	defer server.Close()
+
+	address := strings.TrimPrefix(server.URL, "http://")
+	uid := strings.Repeat("a", 64)
+
+	_, _, err = client.FetchPeerObject(address, uid, []byte("wrong"), 0, time.Second)
+	assert.Equal(t, http.StatusUnauthorized, err.(*client.StatusError).StatusCode)
+
+	// an object no package refers to isn't served
+	err = afero.WriteFile(fs, "/tmp/"+uid, []byte("test"), 0644)
+	assert.NoError(t, err)
+
+	_, _, err = client.FetchPeerObject(address, uid, []byte("secret"), 0, time.Second)
+	assert.Equal(t, http.StatusNotFound, err.(*client.StatusError).StatusCode)
+}
@@ -12,7 +12,7 @@ import (
 	"fmt"
 	"net/http"
 
-	"github.com/OSSystems/pkg/log"
+	"github.com/UpdateHub/updatehub/log"
 	"github.com/julienschmidt/httprouter"
 )
 
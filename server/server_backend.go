@@ -16,7 +16,7 @@ import (
 	"os"
 	"path"
 
-	"github.com/OSSystems/pkg/log"
+	"github.com/UpdateHub/updatehub/log"
 	"github.com/UpdateHub/updatehub/metadata"
 	"github.com/julienschmidt/httprouter"
 )
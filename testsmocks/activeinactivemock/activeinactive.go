@@ -23,3 +23,17 @@ func (aim *ActiveInactiveMock) SetActive(active int) error {
 	args := aim.Called(active)
 	return args.Error(0)
 }
+
+func (aim *ActiveInactiveMock) Slots() (int, error) {
+	args := aim.Called()
+	return args.Int(0), args.Error(1)
+}
+
+type ValidatorActiveInactiveMock struct {
+	ActiveInactiveMock
+}
+
+func (vaim *ValidatorActiveInactiveMock) SetValidated() error {
+	args := vaim.Called()
+	return args.Error(0)
+}
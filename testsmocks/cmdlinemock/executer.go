@@ -8,7 +8,11 @@
 
 package cmdlinemock
 
-import "github.com/stretchr/testify/mock"
+import (
+	"io"
+
+	"github.com/stretchr/testify/mock"
+)
 
 type CmdLineExecuterMock struct {
 	mock.Mock
@@ -18,3 +22,8 @@ func (clm *CmdLineExecuterMock) Execute(cmdline string) ([]byte, error) {
 	args := clm.Called(cmdline)
 	return args.Get(0).([]byte), args.Error(1)
 }
+
+func (clm *CmdLineExecuterMock) ExecuteWithStdin(cmdline string, stdin io.Reader) ([]byte, error) {
+	args := clm.Called(cmdline, stdin)
+	return args.Get(0).([]byte), args.Error(1)
+}
@@ -99,3 +99,8 @@ func (lam *LibArchiveMock) Unpack(tarballPath string, targetPath string, enableR
 	args := lam.Called(tarballPath, targetPath, enableRaw)
 	return args.Error(0)
 }
+
+func (lam *LibArchiveMock) UnpackWithOptions(tarballPath string, targetPath string, enableRaw bool, preservePermissions bool) error {
+	args := lam.Called(tarballPath, targetPath, enableRaw, preservePermissions)
+	return args.Error(0)
+}
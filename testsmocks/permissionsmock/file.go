@@ -26,3 +26,8 @@ func (pm *PermissionsMock) ApplyChown(filepath string, uid interface{}, gid inte
 	args := pm.Called(filepath, uid, gid)
 	return args.Error(0)
 }
+
+func (pm *PermissionsMock) CopyAttributes(fsb afero.Fs, source string, target string, mode bool, owner bool) error {
+	args := pm.Called(fsb, source, target, mode, owner)
+	return args.Error(0)
+}
@@ -9,6 +9,7 @@
 package updatermock
 
 import (
+	"context"
 	"io"
 	"time"
 
@@ -20,12 +21,12 @@ type UpdaterMock struct {
 	mock.Mock
 }
 
-func (um *UpdaterMock) CheckUpdate(api client.ApiRequester, uri string, data interface{}) (interface{}, time.Duration, error) {
+func (um *UpdaterMock) CheckUpdate(ctx context.Context, api client.ApiRequester, uri string, data interface{}) (interface{}, time.Duration, error) {
 	args := um.Called(api, uri, data)
 	return args.Get(0), args.Get(1).(time.Duration), args.Error(2)
 }
 
-func (um *UpdaterMock) FetchUpdate(api client.ApiRequester, uri string) (io.ReadCloser, int64, error) {
-	args := um.Called(api, uri)
+func (um *UpdaterMock) FetchUpdate(ctx context.Context, api client.ApiRequester, uri string, offset int64) (io.ReadCloser, int64, error) {
+	args := um.Called(api, uri, offset)
 	return args.Get(0).(io.ReadCloser), args.Get(1).(int64), args.Error(2)
 }
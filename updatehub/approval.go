@@ -0,0 +1,174 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+const (
+	// ApprovalModeAuto installs and reboots without asking
+	ApprovalModeAuto = "auto"
+	// ApprovalModeManual waits for the approval
+	ApprovalModeManual = "manual"
+)
+
+// validateApprovalMode fails if the approval "mode" is unknown
+func validateApprovalMode(mode string) error {
+	switch mode {
+	case "", ApprovalModeAuto, ApprovalModeManual:
+		return nil
+	}
+
+	return fmt.Errorf("invalid approval mode '%s'", mode)
+}
+
+// awaitApproval returns the state awaiting the approval of "next"
+// when it requires one, "next" itself otherwise. The installation and
+// the reboot are approved beforehand in a dry run, since nothing is
+// changed.
+func (uh *UpdateHub) awaitApproval(next State) State {
+	if uh.DryRun {
+		return next
+	}
+
+	m := next.(ReportableState).UpdateMetadata()
+
+	switch next.(type) {
+	case *InstallingState:
+		if uh.settings.ApprovalInstallMode == ApprovalModeManual {
+			return NewAwaitingInstallApprovalState(m, next)
+		}
+	case *WaitingForRebootState:
+		if uh.settings.ApprovalRebootMode == ApprovalModeManual {
+			return NewAwaitingRebootApprovalState(m, next)
+		}
+	}
+
+	return next
+}
+
+// AwaitingApprovalState is the State interface implementation for the
+// UpdateHubStateAwaitingInstallApproval and the
+// UpdateHubStateAwaitingRebootApproval
+type AwaitingApprovalState struct {
+	BaseState
+	CancellableState
+
+	updateMetadata *metadata.UpdateMetadata
+	next           State
+	decision       chan bool
+}
+
+// ID returns the state id
+func (state *AwaitingApprovalState) ID() UpdateHubState {
+	return state.id
+}
+
+// UpdateMetadata is the ReportableState interface implementation
+func (state *AwaitingApprovalState) UpdateMetadata() *metadata.UpdateMetadata {
+	return state.updateMetadata
+}
+
+// Cancel cancels a state if it is cancellable
+func (state *AwaitingApprovalState) Cancel(ok bool) bool {
+	return state.CancellableState.Cancel(ok)
+}
+
+// Next returns the state that is handled once approved
+func (state *AwaitingApprovalState) Next() State {
+	return state.next
+}
+
+// Decide approves or rejects the state, it returns false if it was
+// already decided
+func (state *AwaitingApprovalState) Decide(approved bool) bool {
+	select {
+	case state.decision <- approved:
+		return true
+	default:
+		return false
+	}
+}
+
+// action is the name of what is approved, given to the approval
+// callbacks
+func (state *AwaitingApprovalState) action() string {
+	if state.id == UpdateHubStateAwaitingRebootApproval {
+		return "reboot"
+	}
+
+	return "install"
+}
+
+// Handle for AwaitingApprovalState blocks until the approval is
+// decided, through Decide or by the callbacks at
+// "ApprovalCallbacksDir", which are run as "<callback> install|reboot
+// <package-uid>" and must all succeed to approve it. It goes to the
+// state it was holding if approved and back to the idle state if
+// rejected or cancelled.
+func (state *AwaitingApprovalState) Handle(uh *UpdateHub) (State, bool) {
+	packageUID := state.updateMetadata.PackageUID()
+
+	callbacks, err := uh.listCallbacks(uh.settings.ApprovalCallbacksDir)
+	if err != nil {
+		log.Warn("failed to list the approval callbacks: ", err)
+	}
+
+	// the callbacks may block waiting for the user, so the approval
+	// can still be decided meanwhile
+	if len(callbacks) > 0 {
+		go func() {
+			err := uh.runCallbacks(uh.settings.ApprovalCallbacksDir, state.action(), packageUID)
+			if err != nil {
+				log.Info(fmt.Sprintf("%s not approved by callback: %s", state.action(), err))
+			}
+
+			state.Decide(err == nil)
+		}()
+	}
+
+	select {
+	case approved := <-state.decision:
+		if approved {
+			return state.next, false
+		}
+
+		log.Info(fmt.Sprintf("%s of '%s' rejected", state.action(), packageUID))
+	case <-state.cancel:
+	}
+
+	return NewIdleState(), false
+}
+
+func newAwaitingApprovalState(id UpdateHubState, updateMetadata *metadata.UpdateMetadata, next State) *AwaitingApprovalState {
+	state := &AwaitingApprovalState{
+		BaseState:        BaseState{id: id},
+		CancellableState: CancellableState{cancel: make(chan bool, 1)},
+		updateMetadata:   updateMetadata,
+		next:             next,
+		decision:         make(chan bool, 1),
+	}
+
+	return state
+}
+
+// NewAwaitingInstallApprovalState creates a new AwaitingApprovalState
+// which goes to the installing state "next" once approved
+func NewAwaitingInstallApprovalState(updateMetadata *metadata.UpdateMetadata, next State) *AwaitingApprovalState {
+	return newAwaitingApprovalState(UpdateHubStateAwaitingInstallApproval, updateMetadata, next)
+}
+
+// NewAwaitingRebootApprovalState creates a new AwaitingApprovalState
+// which goes to the waiting for reboot state "next" once approved
+func NewAwaitingRebootApprovalState(updateMetadata *metadata.UpdateMetadata, next State) *AwaitingApprovalState {
+	return newAwaitingApprovalState(UpdateHubStateAwaitingRebootApproval, updateMetadata, next)
+}
@@ -0,0 +1,166 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+)
+
+func TestAwaitApproval(t *testing.T) {
+	m := &metadata.UpdateMetadata{RawBytes: []byte("metadata")}
+
+	installing := NewInstallingState(m, nil, nil, nil, nil)
+	waitingForReboot := NewWaitingForRebootState(m)
+
+	testCases := []struct {
+		name          string
+		installMode   string
+		rebootMode    string
+		dryRun        bool
+		next          State
+		expectedState UpdateHubState
+	}{
+		{"InstallWithAutoMode", ApprovalModeAuto, ApprovalModeManual, false, installing, UpdateHubStateInstalling},
+		{"InstallWithManualMode", ApprovalModeManual, ApprovalModeAuto, false, installing, UpdateHubStateAwaitingInstallApproval},
+		{"RebootWithAutoMode", ApprovalModeManual, ApprovalModeAuto, false, waitingForReboot, UpdateHubStateWaitingForReboot},
+		{"RebootWithManualMode", ApprovalModeAuto, ApprovalModeManual, false, waitingForReboot, UpdateHubStateAwaitingRebootApproval},
+		{"WithDryRun", ApprovalModeManual, ApprovalModeManual, true, installing, UpdateHubStateInstalling},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			uh, _ := newTestUpdateHub(nil, nil)
+			uh.settings.ApprovalInstallMode = tc.installMode
+			uh.settings.ApprovalRebootMode = tc.rebootMode
+			uh.DryRun = tc.dryRun
+
+			state := uh.awaitApproval(tc.next)
+			assert.Equal(t, tc.expectedState, state.ID())
+
+			if approval, ok := state.(*AwaitingApprovalState); ok {
+				assert.Equal(t, tc.next, approval.Next())
+				assert.Equal(t, m, approval.UpdateMetadata())
+			}
+		})
+	}
+}
+
+func TestValidateApprovalMode(t *testing.T) {
+	assert.NoError(t, validateApprovalMode(""))
+	assert.NoError(t, validateApprovalMode(ApprovalModeAuto))
+	assert.NoError(t, validateApprovalMode(ApprovalModeManual))
+	assert.EqualError(t, validateApprovalMode("later"), "invalid approval mode 'later'")
+}
+
+func TestAwaitingApprovalStateDecidedByAPI(t *testing.T) {
+	m := &metadata.UpdateMetadata{RawBytes: []byte("metadata")}
+	next := NewInstallingState(m, nil, nil, nil, nil)
+
+	testCases := []struct {
+		name     string
+		decide   func(uh *UpdateHub) error
+		expected State
+	}{
+		{"Approved", (*UpdateHub).ApproveUpdate, next},
+		{"Rejected", (*UpdateHub).RejectUpdate, NewIdleState()},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			uh, _ := newTestUpdateHub(NewAwaitingInstallApprovalState(m, next), nil)
+
+			err := tc.decide(uh)
+			assert.NoError(t, err)
+
+			// it's decided only once
+			err = tc.decide(uh)
+			assert.EqualError(t, err, "the approval was already decided")
+
+			state, _ := uh.State.Handle(uh)
+			assert.IsType(t, tc.expected, state)
+
+			if tc.expected == next {
+				assert.Equal(t, next, state)
+			}
+		})
+	}
+}
+
+func TestApproveUpdateWithoutApprovalPending(t *testing.T) {
+	uh, _ := newTestUpdateHub(NewIdleState(), nil)
+
+	assert.EqualError(t, uh.ApproveUpdate(), "there is no approval pending")
+	assert.EqualError(t, uh.RejectUpdate(), "there is no approval pending")
+}
+
+func TestAwaitingApprovalStateDecidedByCallbacks(t *testing.T) {
+	m := &metadata.UpdateMetadata{RawBytes: []byte("metadata")}
+	next := NewWaitingForRebootState(m)
+
+	testCases := []struct {
+		name          string
+		err           error
+		expectedState UpdateHubState
+	}{
+		{"Approved", nil, UpdateHubStateWaitingForReboot},
+		{"Rejected", fmt.Errorf("not now"), UpdateHubStateIdle},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+
+			uh, _ := newTestUpdateHub(NewAwaitingRebootApprovalState(m, next), nil)
+			uh.CmdLineExecuter = clm
+			uh.settings.ApprovalCallbacksDir = "/approval-callbacks.d"
+
+			err := afero.WriteFile(uh.Store, "/approval-callbacks.d/ask", []byte(""), 0755)
+			assert.NoError(t, err)
+
+			clm.On("Execute", fmt.Sprintf("'/approval-callbacks.d/ask' reboot %s", m.PackageUID())).Return([]byte(""), tc.err).Once()
+
+			state, _ := uh.State.Handle(uh)
+			assert.Equal(t, UpdateHubState(tc.expectedState), state.ID())
+
+			clm.AssertExpectations(t)
+		})
+	}
+}
+
+func TestAwaitingApprovalStateCancel(t *testing.T) {
+	m := &metadata.UpdateMetadata{RawBytes: []byte("metadata")}
+
+	uh, _ := newTestUpdateHub(NewAwaitingInstallApprovalState(m, NewInstallingState(m, nil, nil, nil, nil)), nil)
+
+	uh.State.Cancel(true)
+
+	state, _ := uh.State.Handle(uh)
+	assert.IsType(t, &IdleState{}, state)
+}
+
+func TestStateDownloadingWithInstallApproval(t *testing.T) {
+	m := &metadata.UpdateMetadata{RawBytes: []byte("metadata")}
+
+	uh, _ := newTestUpdateHub(NewDownloadingState(m), nil)
+	uh.Controller = &testController{}
+	uh.settings.ApprovalInstallMode = ApprovalModeManual
+	uh.settings.DownloadSpaceMargin = 0
+
+	state, _ := uh.State.Handle(uh)
+	assert.Equal(t, UpdateHubState(UpdateHubStateAwaitingInstallApproval), state.ID())
+	assert.IsType(t, &InstallingState{}, state.(*AwaitingApprovalState).Next())
+	assert.Equal(t, "awaiting-install-approval", StateToString(state.ID()))
+}
@@ -0,0 +1,481 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+// The operations recorded by the audit log
+const (
+	AuditCheck          = "check"
+	AuditVerifyMetadata = "verify-metadata"
+	AuditDownload       = "download"
+	AuditVerifyObject   = "verify-object"
+	AuditInstall        = "install"
+	AuditSwitchSlot     = "switch-slot"
+)
+
+// The results of the audited operations
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditEntry is an entry of the audit log. Its "Hash" is the
+// HMAC-SHA256 of the entry, with an empty "Hash", by the key of the
+// device. As the entry includes the hash of the previous one, changing
+// or removing an entry breaks the chain, and without the key the chain
+// can't be made again.
+type AuditEntry struct {
+	Sequence   int64     `json:"sequence"`
+	Time       time.Time `json:"time"`
+	Operation  string    `json:"operation"`
+	PackageUID string    `json:"package-uid,omitempty"`
+	Digests    []string  `json:"digests,omitempty"` // the sha256sums of the metadata or of the objects
+	Slot       *int      `json:"slot,omitempty"`    // the installation set switched to
+	Result     string    `json:"result"`
+	Message    string    `json:"message,omitempty"`
+	PrevHash   string    `json:"prev-hash"`
+	Hash       string    `json:"hash"`
+}
+
+// computeHash returns the hash of "e" by "key", see AuditEntry
+func (e AuditEntry) computeHash(key []byte) (string, error) {
+	e.Hash = ""
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// AuditReport is the exported audit log along with the result of the
+// verification of its chain
+type AuditReport struct {
+	Entries  []AuditEntry `json:"entries"`
+	Verified bool         `json:"verified"`
+	Error    string       `json:"error,omitempty"`
+}
+
+// AuditLog is the append-only, hash-chained log of the update
+// operations, saved at "path" one JSON entry per line. Once it gets
+// bigger than "maxSize" it is rotated to "path.1", and so on up to
+// "path.<maxFiles>", the chain goes on across the files.
+type AuditLog struct {
+	fs       afero.Fs
+	path     string
+	key      []byte
+	maxSize  int64
+	maxFiles int
+	size     int64
+	sequence int64
+	lastHash string
+	mutex    sync.Mutex
+}
+
+// NewAuditLog opens the audit log at "path", whose entries are chained
+// by "key". An entry torn by a power loss while it was written is
+// discarded, the new entries are chained to the last complete one.
+func NewAuditLog(fs afero.Fs, path string, key []byte, maxSize int64, maxFiles int) (*AuditLog, error) {
+	l := &AuditLog{fs: fs, path: path, key: key, maxSize: maxSize, maxFiles: maxFiles}
+
+	err := l.repair()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// the last entry is in the last rotated file right after a rotation
+	for _, name := range []string{path, l.rotatedPath(1)} {
+		entries, err := l.read(name)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if len(entries) > 0 {
+			last := entries[len(entries)-1]
+
+			l.sequence = last.Sequence
+			l.lastHash = last.Hash
+
+			break
+		}
+	}
+
+	return l, nil
+}
+
+// Add chains "e" to the last entry and appends it to the log
+func (l *AuditLog) Add(e AuditEntry) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	e.Sequence = l.sequence + 1
+	e.Time = e.Time.UTC()
+	e.PrevHash = l.lastHash
+
+	hash, err := e.computeHash(l.key)
+	if err != nil {
+		return err
+	}
+
+	e.Hash = hash
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+
+	err = l.fs.MkdirAll(filepath.Dir(l.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+		err = l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := l.fs.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(data)
+	if err != nil {
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+
+	l.size += int64(len(data))
+	l.sequence = e.Sequence
+	l.lastHash = e.Hash
+
+	return nil
+}
+
+// Entries returns the entries of the log, the oldest first, including
+// the ones of the rotated files
+func (l *AuditLog) Entries() ([]AuditEntry, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entries := []AuditEntry{}
+
+	names := []string{}
+	for i := l.maxFiles; i > 0; i-- {
+		names = append(names, l.rotatedPath(i))
+	}
+
+	for _, name := range append(names, l.path) {
+		fileEntries, err := l.read(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, fileEntries...)
+	}
+
+	return entries, nil
+}
+
+// VerifyAuditLog checks the chain of "entries" by "key", it fails at
+// the first entry which was changed or whose predecessor was removed.
+// The first entry may be a later one than the first of all, as the
+// oldest files of the log are discarded when it is rotated.
+func VerifyAuditLog(key []byte, entries []AuditEntry) error {
+	for i, e := range entries {
+		if i > 0 && (e.Sequence != entries[i-1].Sequence+1 || e.PrevHash != entries[i-1].Hash) {
+			return fmt.Errorf("the audit log chain is broken at entry %d", e.Sequence)
+		}
+
+		hash, err := e.computeHash(key)
+		if err != nil {
+			return err
+		}
+
+		if !hmac.Equal([]byte(hash), []byte(e.Hash)) {
+			return fmt.Errorf("the audit log entry %d was tampered with", e.Sequence)
+		}
+	}
+
+	return nil
+}
+
+func (l *AuditLog) rotatedPath(n int) string {
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+// rotate moves the log to "path.1", after shifting the files already
+// rotated, the oldest one is discarded
+func (l *AuditLog) rotate() error {
+	err := l.fs.Remove(l.rotatedPath(l.maxFiles))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for i := l.maxFiles - 1; i > 0; i-- {
+		err = l.fs.Rename(l.rotatedPath(i), l.rotatedPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if l.maxFiles > 0 {
+		err = l.fs.Rename(l.path, l.rotatedPath(1))
+	} else {
+		err = l.fs.Remove(l.path)
+	}
+	if err != nil {
+		return err
+	}
+
+	l.size = 0
+
+	return nil
+}
+
+// repair truncates the log before its last line when it isn't a
+// complete entry, which happens when the agent is stopped, or the
+// power is lost, while an entry is written. The other lines aren't
+// touched, a corrupted entry in the middle of the log is an error.
+func (l *AuditLog) repair() error {
+	data, err := afero.ReadFile(l.fs, l.path)
+	if err != nil {
+		return err
+	}
+
+	l.size = int64(len(data))
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	content := bytes.TrimRight(data, "\n")
+	start := bytes.LastIndexByte(content, '\n') + 1
+
+	var e AuditEntry
+	complete := len(content) == 0 || json.Unmarshal(content[start:], &e) == nil
+
+	if complete && data[len(data)-1] == '\n' {
+		return nil
+	}
+
+	file, err := l.fs.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if complete {
+		// only the line break of the last entry is missing
+		_, err = file.Write([]byte{'\n'})
+		l.size++
+	} else {
+		log.Warn(fmt.Sprintf("discarding the torn last entry of the audit log '%s'", l.path))
+
+		err = file.Truncate(int64(start))
+		l.size = int64(start)
+	}
+	if err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+func (l *AuditLog) read(name string) ([]AuditEntry, error) {
+	data, err := afero.ReadFile(l.fs, name)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []AuditEntry{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		var e AuditEntry
+
+		err = json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid audit log entry at line %d of '%s': %s", line, name, err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
+
+// setupAuditLog opens the audit log. Unlike the event log, a corrupted
+// audit log isn't discarded, the operations just aren't audited until
+// it is dealt with.
+func (uh *UpdateHub) setupAuditLog() {
+	uh.auditLog = nil
+
+	if uh.settings.AuditLogPath == "" {
+		return
+	}
+
+	var auditLog *AuditLog
+
+	key, err := uh.auditKey()
+	if err == nil {
+		auditLog, err = NewAuditLog(uh.Store, uh.settings.AuditLogPath, key, uh.settings.AuditLogMaxSize, uh.settings.AuditLogMaxFiles)
+	}
+	if err != nil {
+		log.Error("failed to open the audit log, the update operations won't be audited: ", err)
+		return
+	}
+
+	uh.auditLog = auditLog
+}
+
+// auditKey returns the key of the device which chains the entries of
+// the audit log
+func (uh *UpdateHub) auditKey() ([]byte, error) {
+	if uh.settings.AuditLogKeyPath == "" {
+		return nil, errors.New("the audit log key must be set")
+	}
+
+	key, err := afero.ReadFile(uh.Store, uh.settings.AuditLogKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the audit log key: %s", err)
+	}
+
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, errors.New("the audit log key is empty")
+	}
+
+	return key, nil
+}
+
+// AuditLog returns the entries of the audit log, the oldest first,
+// along with the verification of their chain
+func (uh *UpdateHub) AuditLog() *AuditReport {
+	report := &AuditReport{Entries: []AuditEntry{}}
+
+	if uh.auditLog == nil {
+		report.Error = "the audit log is disabled"
+		return report
+	}
+
+	entries, err := uh.auditLog.Entries()
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	report.Entries = entries
+
+	err = VerifyAuditLog(uh.auditLog.key, entries)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	report.Verified = true
+
+	return report
+}
+
+// audit records the operation "e" on the audit log. It's a failure
+// when "cause" is given, which is recorded as its message.
+func (uh *UpdateHub) audit(e AuditEntry, cause error) {
+	if uh.auditLog == nil {
+		return
+	}
+
+	e.Time = uh.clock().Now()
+	e.Result = AuditSuccess
+
+	if cause != nil {
+		e.Result = AuditFailure
+		e.Message = cause.Error()
+	}
+
+	err := uh.auditLog.Add(e)
+	if err != nil {
+		log.Warn("failed to audit the operation: ", err)
+	}
+}
+
+// auditUpdate records the "operation" on the update of
+// "updateMetadata", which is identified by the sha256sum of its raw
+// metadata
+func (uh *UpdateHub) auditUpdate(operation string, updateMetadata *metadata.UpdateMetadata, cause error) {
+	digest := sha256.Sum256(updateMetadata.RawBytes)
+
+	uh.audit(AuditEntry{
+		Operation:  operation,
+		PackageUID: updateMetadata.PackageUID(),
+		Digests:    []string{hex.EncodeToString(digest[:])},
+	}, cause)
+}
+
+// auditObject records the "operation" on the object "objectUID" of the
+// package "packageUID"
+func (uh *UpdateHub) auditObject(operation string, packageUID string, objectUID string, cause error) {
+	uh.audit(AuditEntry{
+		Operation:  operation,
+		PackageUID: packageUID,
+		Digests:    []string{objectUID},
+	}, cause)
+}
+
+// auditSwitchSlot records the switch to the installation set "slot"
+// for the package "packageUID"
+func (uh *UpdateHub) auditSwitchSlot(packageUID string, slot int, cause error) {
+	uh.audit(AuditEntry{
+		Operation:  AuditSwitchSlot,
+		PackageUID: packageUID,
+		Slot:       &slot,
+	}, cause)
+}
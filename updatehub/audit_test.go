@@ -0,0 +1,315 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+var testAuditKey = []byte("device key")
+
+func TestAuditLog(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	l, err := NewAuditLog(fs, "/var/lib/updatehub/audit.log", testAuditKey, 0, 0)
+	assert.NoError(t, err)
+
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	err = l.Add(AuditEntry{Time: now, Operation: AuditCheck, PackageUID: "puid", Digests: []string{"digest"}, Result: AuditSuccess})
+	assert.NoError(t, err)
+
+	// the chain goes on after a restart
+	l, err = NewAuditLog(fs, "/var/lib/updatehub/audit.log", testAuditKey, 0, 0)
+	assert.NoError(t, err)
+
+	slot := 1
+	err = l.Add(AuditEntry{Time: now, Operation: AuditSwitchSlot, PackageUID: "puid", Slot: &slot, Result: AuditFailure, Message: "set active error"})
+	assert.NoError(t, err)
+
+	entries, err := l.Entries()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+
+	assert.Equal(t, int64(1), entries[0].Sequence)
+	assert.Equal(t, "", entries[0].PrevHash)
+	assert.Equal(t, now, entries[0].Time)
+	assert.Equal(t, []string{"digest"}, entries[0].Digests)
+
+	assert.Equal(t, int64(2), entries[1].Sequence)
+	assert.Equal(t, entries[0].Hash, entries[1].PrevHash)
+	assert.Equal(t, 1, *entries[1].Slot)
+	assert.Equal(t, "set active error", entries[1].Message)
+
+	assert.NoError(t, VerifyAuditLog(testAuditKey, entries))
+}
+
+func TestAuditLogEntriesWithoutLog(t *testing.T) {
+	l, err := NewAuditLog(afero.NewMemMapFs(), "/audit.log", testAuditKey, 0, 0)
+	assert.NoError(t, err)
+
+	entries, err := l.Entries()
+	assert.NoError(t, err)
+	assert.Equal(t, []AuditEntry{}, entries)
+}
+
+func TestNewAuditLogWithCorruptedLog(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	err := afero.WriteFile(fs, "/audit.log", []byte("{\"sequence\":1}\ncorrupted\n{\"sequence\":3}\n"), 0644)
+	assert.NoError(t, err)
+
+	_, err = NewAuditLog(fs, "/audit.log", testAuditKey, 0, 0)
+	assert.EqualError(t, err, "invalid audit log entry at line 2 of '/audit.log': invalid character 'c' looking for beginning of value")
+}
+
+func TestNewAuditLogWithTornEntry(t *testing.T) {
+	testCases := []struct {
+		name string
+		tail string
+	}{
+		{"Torn", "{\"sequence\":2,\"ti"},
+		{"TornWithLineBreak", "{\"sequence\":2,\"ti\n"},
+		{"Zeroed", "\x00\x00\x00\x00"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+
+			l, err := NewAuditLog(fs, "/audit.log", testAuditKey, 0, 0)
+			assert.NoError(t, err)
+
+			err = l.Add(AuditEntry{Operation: AuditCheck, Result: AuditSuccess})
+			assert.NoError(t, err)
+
+			data, err := afero.ReadFile(fs, "/audit.log")
+			assert.NoError(t, err)
+
+			err = afero.WriteFile(fs, "/audit.log", append(data, []byte(tc.tail)...), 0644)
+			assert.NoError(t, err)
+
+			l, err = NewAuditLog(fs, "/audit.log", testAuditKey, 0, 0)
+			assert.NoError(t, err)
+
+			err = l.Add(AuditEntry{Operation: AuditDownload, Result: AuditSuccess})
+			assert.NoError(t, err)
+
+			entries, err := l.Entries()
+			assert.NoError(t, err)
+			assert.Equal(t, 2, len(entries))
+			assert.NoError(t, VerifyAuditLog(testAuditKey, entries))
+		})
+	}
+}
+
+func TestNewAuditLogWithoutLastLineBreak(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	l, err := NewAuditLog(fs, "/audit.log", testAuditKey, 0, 0)
+	assert.NoError(t, err)
+
+	err = l.Add(AuditEntry{Operation: AuditCheck, Result: AuditSuccess})
+	assert.NoError(t, err)
+
+	data, err := afero.ReadFile(fs, "/audit.log")
+	assert.NoError(t, err)
+
+	err = afero.WriteFile(fs, "/audit.log", data[:len(data)-1], 0644)
+	assert.NoError(t, err)
+
+	// the complete entry is kept
+	l, err = NewAuditLog(fs, "/audit.log", testAuditKey, 0, 0)
+	assert.NoError(t, err)
+
+	err = l.Add(AuditEntry{Operation: AuditDownload, Result: AuditSuccess})
+	assert.NoError(t, err)
+
+	entries, err := l.Entries()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.NoError(t, VerifyAuditLog(testAuditKey, entries))
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	l, err := NewAuditLog(fs, "/audit.log", testAuditKey, 1, 2)
+	assert.NoError(t, err)
+
+	// each entry is bigger than the maximum size so it gets its own
+	// file
+	for i := 0; i < 4; i++ {
+		err = l.Add(AuditEntry{Operation: AuditCheck, Result: AuditSuccess})
+		assert.NoError(t, err)
+	}
+
+	for _, name := range []string{"/audit.log", "/audit.log.1", "/audit.log.2"} {
+		exists, err := afero.Exists(fs, name)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	}
+
+	exists, err := afero.Exists(fs, "/audit.log.3")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// the oldest entry was discarded
+	entries, err := l.Entries()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, int64(2), entries[0].Sequence)
+	assert.Equal(t, int64(4), entries[2].Sequence)
+	assert.NoError(t, VerifyAuditLog(testAuditKey, entries))
+
+	// the chain goes on after a restart right after a rotation
+	err = fs.Rename("/audit.log", "/audit.log.1")
+	assert.NoError(t, err)
+
+	l, err = NewAuditLog(fs, "/audit.log", testAuditKey, 1, 2)
+	assert.NoError(t, err)
+
+	err = l.Add(AuditEntry{Operation: AuditDownload, Result: AuditSuccess})
+	assert.NoError(t, err)
+
+	entries, err = l.Entries()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), entries[len(entries)-1].Sequence)
+	assert.Equal(t, entries[len(entries)-2].Hash, entries[len(entries)-1].PrevHash)
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	newEntries := func() []AuditEntry {
+		l, err := NewAuditLog(afero.NewMemMapFs(), "/audit.log", testAuditKey, 0, 0)
+		assert.NoError(t, err)
+
+		for _, operation := range []string{AuditCheck, AuditDownload, AuditInstall} {
+			err = l.Add(AuditEntry{Operation: operation, PackageUID: "puid", Result: AuditSuccess})
+			assert.NoError(t, err)
+		}
+
+		entries, err := l.Entries()
+		assert.NoError(t, err)
+
+		return entries
+	}
+
+	entries := newEntries()
+	assert.NoError(t, VerifyAuditLog(testAuditKey, entries))
+
+	entries = newEntries()
+	entries[1].Result = AuditFailure
+	assert.EqualError(t, VerifyAuditLog(testAuditKey, entries), "the audit log entry 2 was tampered with")
+
+	entries = newEntries()
+	entries = append(entries[:1], entries[2:]...)
+	assert.EqualError(t, VerifyAuditLog(testAuditKey, entries), "the audit log chain is broken at entry 3")
+
+	// rehashing a changed entry breaks its successor
+	entries = newEntries()
+	entries[1].PackageUID = "other"
+	entries[1].Hash, _ = entries[1].computeHash(testAuditKey)
+	assert.EqualError(t, VerifyAuditLog(testAuditKey, entries), "the audit log chain is broken at entry 3")
+
+	// the chain can't be made again without the key
+	entries = newEntries()
+	entries[2].Result = AuditFailure
+	entries[2].Hash, _ = entries[2].computeHash([]byte("other"))
+	assert.EqualError(t, VerifyAuditLog(testAuditKey, entries), "the audit log entry 3 was tampered with")
+}
+
+func TestUpdateHubAuditLog(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	report := uh.AuditLog()
+	assert.Equal(t, &AuditReport{Entries: []AuditEntry{}, Error: "the audit log is disabled"}, report)
+
+	uh.settings.AuditLogPath = "/var/lib/updatehub/audit.log"
+	uh.settings.AuditLogKeyPath = "/etc/updatehub/audit.key"
+
+	err := afero.WriteFile(uh.Store, uh.settings.AuditLogKeyPath, []byte("device key\n"), 0600)
+	assert.NoError(t, err)
+
+	uh.setupAuditLog()
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	uh.auditUpdate(AuditDownload, m, nil)
+	uh.auditObject(AuditInstall, m.PackageUID(), "sha256sum", errors.New("install error"))
+	uh.auditSwitchSlot(m.PackageUID(), 1, nil)
+
+	report = uh.AuditLog()
+	assert.True(t, report.Verified)
+	assert.Equal(t, "", report.Error)
+	assert.Equal(t, 3, len(report.Entries))
+
+	digest := sha256.Sum256(m.RawBytes)
+
+	assert.Equal(t, AuditDownload, report.Entries[0].Operation)
+	assert.Equal(t, m.PackageUID(), report.Entries[0].PackageUID)
+	assert.Equal(t, []string{hex.EncodeToString(digest[:])}, report.Entries[0].Digests)
+	assert.Equal(t, AuditSuccess, report.Entries[0].Result)
+
+	assert.Equal(t, AuditInstall, report.Entries[1].Operation)
+	assert.Equal(t, []string{"sha256sum"}, report.Entries[1].Digests)
+	assert.Equal(t, AuditFailure, report.Entries[1].Result)
+	assert.Equal(t, "install error", report.Entries[1].Message)
+
+	assert.Equal(t, AuditSwitchSlot, report.Entries[2].Operation)
+	assert.Equal(t, 1, *report.Entries[2].Slot)
+
+	// tampering with the log is reported
+	data, err := afero.ReadFile(uh.Store, uh.settings.AuditLogPath)
+	assert.NoError(t, err)
+
+	err = afero.WriteFile(uh.Store, uh.settings.AuditLogPath, []byte(strings.Replace(string(data), "install error", "installed", 1)), 0644)
+	assert.NoError(t, err)
+
+	report = uh.AuditLog()
+	assert.False(t, report.Verified)
+	assert.Equal(t, "the audit log entry 2 was tampered with", report.Error)
+	assert.Equal(t, 3, len(report.Entries))
+}
+
+func TestStateUpdateCheckAudit(t *testing.T) {
+	uh, _ := newTestUpdateHub(NewUpdateCheckState(), nil)
+	uh.Controller = &testController{updateAvailable: true, extraPoll: 0}
+	uh.settings.AuditLogPath = "/var/lib/updatehub/audit.log"
+	uh.settings.AuditLogKeyPath = "/etc/updatehub/audit.key"
+
+	err := afero.WriteFile(uh.Store, uh.settings.AuditLogKeyPath, []byte("device key\n"), 0600)
+	assert.NoError(t, err)
+
+	uh.setupAuditLog()
+
+	next, _ := uh.State.Handle(uh)
+	assert.IsType(t, &DownloadingState{}, next)
+
+	entries, err := uh.auditLog.Entries()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+
+	assert.Equal(t, AuditCheck, entries[0].Operation)
+	assert.Equal(t, AuditVerifyMetadata, entries[1].Operation)
+	assert.Equal(t, AuditSuccess, entries[1].Result)
+}
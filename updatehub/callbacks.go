@@ -0,0 +1,103 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// runStateChangeCallbacks runs the callbacks found at
+// "StateChangeCallbacksDir" as:
+//
+//	<callback> <enter|leave> <state> [package-uid]
+func (uh *UpdateHub) runStateChangeCallbacks(action string, state State) error {
+	args := []string{action, StateToString(state.ID())}
+
+	if rs, ok := state.(ReportableState); ok && rs.UpdateMetadata() != nil {
+		args = append(args, rs.UpdateMetadata().PackageUID())
+	}
+
+	return uh.runCallbacks(uh.settings.StateChangeCallbacksDir, args...)
+}
+
+// runCallbacks runs, in lexical order, each executable found at "dir"
+// passing "args" to it. It stops at the first callback that fails and
+// returns its error.
+func (uh *UpdateHub) runCallbacks(dir string, args ...string) error {
+	callbacks, err := uh.listCallbacks(dir)
+	if err != nil {
+		return err
+	}
+
+	var executer utils.CmdLineExecuter = uh.CmdLineExecuter
+	if executer == nil {
+		executer = &utils.CmdLine{}
+	}
+
+	for _, callback := range callbacks {
+		cmdline := fmt.Sprintf("'%s'", callback)
+		if len(args) > 0 {
+			cmdline = fmt.Sprintf("%s %s", cmdline, strings.Join(args, " "))
+		}
+
+		_, err := executer.Execute(cmdline)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listCallbacks returns the paths of the executables found at "dir",
+// in lexical order. A missing "dir" has none.
+func (uh *UpdateHub) listCallbacks(dir string) ([]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	files, err := afero.ReadDir(uh.Store, dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	callbacks := []string{}
+
+	for _, file := range files {
+		if !file.Mode().IsRegular() || file.Mode().Perm()&0111 == 0 {
+			continue
+		}
+
+		callbacks = append(callbacks, path.Join(dir, file.Name()))
+	}
+
+	return callbacks, nil
+}
+
+// cancellableByCallback tells whether a failed "enter" callback
+// prevents "state" from being handled
+func cancellableByCallback(state State) bool {
+	switch state.(type) {
+	case *DownloadingState, *InstallingState:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,158 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+)
+
+const callbacksDir = "/callbacks.d"
+
+func setupTestCallbacks(t *testing.T, uh *UpdateHub) {
+	uh.settings.StateChangeCallbacksDir = callbacksDir
+
+	err := afero.WriteFile(uh.Store, callbacksDir+"/20-second", []byte(""), 0755)
+	assert.NoError(t, err)
+	err = afero.WriteFile(uh.Store, callbacksDir+"/10-first", []byte(""), 0755)
+	assert.NoError(t, err)
+	err = afero.WriteFile(uh.Store, callbacksDir+"/README", []byte(""), 0644)
+	assert.NoError(t, err)
+}
+
+func TestRunStateChangeCallbacks(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.CmdLineExecuter = clm
+
+	setupTestCallbacks(t, uh)
+
+	clm.On("Execute", "'/callbacks.d/10-first' enter idle").Return([]byte(""), nil).Once()
+	clm.On("Execute", "'/callbacks.d/20-second' enter idle").Return([]byte(""), nil).Once()
+
+	err := uh.runStateChangeCallbacks("enter", NewIdleState())
+	assert.NoError(t, err)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestRunStateChangeCallbacksWithPackageUID(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.CmdLineExecuter = clm
+
+	setupTestCallbacks(t, uh)
+
+	updateMetadata := &metadata.UpdateMetadata{RawBytes: []byte("metadata")}
+	packageUID := updateMetadata.PackageUID()
+
+	clm.On("Execute", fmt.Sprintf("'/callbacks.d/10-first' leave downloading %s", packageUID)).Return([]byte(""), nil).Once()
+	clm.On("Execute", fmt.Sprintf("'/callbacks.d/20-second' leave downloading %s", packageUID)).Return([]byte(""), nil).Once()
+
+	err := uh.runStateChangeCallbacks("leave", NewDownloadingState(updateMetadata))
+	assert.NoError(t, err)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestRunStateChangeCallbacksWithError(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.CmdLineExecuter = clm
+
+	setupTestCallbacks(t, uh)
+
+	clm.On("Execute", "'/callbacks.d/10-first' enter idle").Return([]byte(""), fmt.Errorf("callback error")).Once()
+
+	err := uh.runStateChangeCallbacks("enter", NewIdleState())
+	assert.EqualError(t, err, "callback error")
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestRunStateChangeCallbacksWithoutDir(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.CmdLineExecuter = clm
+	uh.settings.StateChangeCallbacksDir = callbacksDir
+
+	err := uh.runStateChangeCallbacks("enter", NewIdleState())
+	assert.NoError(t, err)
+
+	uh.settings.StateChangeCallbacksDir = ""
+
+	err = uh.runStateChangeCallbacks("enter", NewIdleState())
+	assert.NoError(t, err)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestDaemonHandleStateCancelledByCallback(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.CmdLineExecuter = clm
+	uh.Controller = &testController{}
+
+	setupTestCallbacks(t, uh)
+
+	updateMetadata := &metadata.UpdateMetadata{}
+	clm.On("Execute", fmt.Sprintf("'/callbacks.d/10-first' enter downloading %s", updateMetadata.PackageUID())).Return([]byte(""), fmt.Errorf("machine in use")).Once()
+
+	d := NewDaemon(uh)
+
+	next := d.handleState(NewDownloadingState(updateMetadata))
+	assert.IsType(t, &IdleState{}, next)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestDaemonHandleStateNotCancellableByCallback(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.CmdLineExecuter = clm
+	uh.Controller = &testController{updateAvailable: true}
+
+	setupTestCallbacks(t, uh)
+
+	clm.On("Execute", "'/callbacks.d/10-first' enter update-check").Return([]byte(""), fmt.Errorf("callback error")).Once()
+	clm.On("Execute", "'/callbacks.d/10-first' leave update-check").Return([]byte(""), nil).Once()
+	clm.On("Execute", "'/callbacks.d/20-second' leave update-check").Return([]byte(""), nil).Once()
+
+	d := NewDaemon(uh)
+
+	next := d.handleState(NewUpdateCheckState())
+	assert.IsType(t, &DownloadingState{}, next)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
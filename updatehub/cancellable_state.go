@@ -8,6 +8,10 @@
 
 package updatehub
 
+import (
+	"context"
+)
+
 type CancellableState struct {
 	BaseState
 	cancel chan bool
@@ -25,3 +29,31 @@ func (cs *CancellableState) Wait() {
 func (cs *CancellableState) Stop() {
 	close(cs.cancel)
 }
+
+// Context returns a context derived from "parent" which is cancelled
+// once the state is cancelled. The "release" function must be called
+// once the context isn't used anymore, a cancel that arrives after it
+// is left for the state.
+func (cs *CancellableState) Context(parent context.Context) (ctx context.Context, release func()) {
+	ctx, cancel := context.WithCancel(parent)
+
+	released := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		select {
+		case <-cs.cancel:
+			cancel()
+		case <-released:
+		}
+	}()
+
+	return ctx, func() {
+		close(released)
+		<-done
+
+		cancel()
+	}
+}
@@ -0,0 +1,67 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancellableStateContext(t *testing.T) {
+	cs := &CancellableState{cancel: make(chan bool, 1)}
+
+	ctx, release := cs.Context(context.Background())
+	defer release()
+
+	cs.Cancel(true)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the context wasn't cancelled")
+	}
+
+	assert.Equal(t, context.Canceled, ctx.Err())
+}
+
+func TestCancellableStateContextWithParent(t *testing.T) {
+	cs := &CancellableState{cancel: make(chan bool, 1)}
+
+	parent, cancel := context.WithCancel(context.Background())
+
+	ctx, release := cs.Context(parent)
+	defer release()
+
+	cancel()
+
+	<-ctx.Done()
+	assert.Equal(t, context.Canceled, ctx.Err())
+}
+
+func TestCancellableStateContextReleased(t *testing.T) {
+	cs := &CancellableState{cancel: make(chan bool, 1)}
+
+	ctx, release := cs.Context(context.Background())
+	release()
+
+	assert.Equal(t, context.Canceled, ctx.Err())
+
+	// a cancel that arrives after the release is left for the state
+	cs.Cancel(true)
+
+	select {
+	case ok := <-cs.cancel:
+		assert.True(t, ok)
+	default:
+		t.Fatal("the cancel was consumed by the released context")
+	}
+}
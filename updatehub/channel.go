@@ -0,0 +1,75 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/UpdateHub/updatehub/client"
+)
+
+// StartChannel opens, if enabled, the WebSocket session with the
+// server. The state reports are sent through it as well, and the
+// server can command the agent to "probe" (at the "server-address"
+// argument, if any), to "abort" the download in progress, to
+// "set-poll-interval" to the "interval" argument or to "rollback" the
+// last update.
+func (uh *UpdateHub) StartChannel() error {
+	s := uh.settings.ChannelSettings
+
+	if !s.ChannelEnabled {
+		return nil
+	}
+
+	if s.ChannelEndpoint == "" {
+		return errors.New("the channel endpoint must be set")
+	}
+
+	uh.channel = client.NewAgentChannel(uh.API, s.ChannelEndpoint, uh.pushRequestData, s.ChannelRetryInterval, s.ChannelMaxRetryInterval, uh.handleChannelCommand)
+	uh.channel.Start()
+
+	return nil
+}
+
+// StopChannel closes the WebSocket session, if open
+func (uh *UpdateHub) StopChannel() {
+	if uh.channel != nil {
+		uh.channel.Stop()
+		uh.channel = nil
+	}
+}
+
+func (uh *UpdateHub) handleChannelCommand(m client.AgentMessage) error {
+	switch m.Command {
+	case "probe":
+		return uh.ProbeUpdateWithServer(m.Args["server-address"])
+	case "abort":
+		return uh.AbortDownload()
+	case "rollback":
+		return uh.RollbackUpdate()
+	case "set-poll-interval":
+		interval, err := time.ParseDuration(m.Args["interval"])
+		if err != nil {
+			return fmt.Errorf("invalid polling interval '%s'", m.Args["interval"])
+		}
+
+		if interval < uh.TimeStep {
+			return fmt.Errorf("the polling interval can't be shorter than %s", uh.TimeStep)
+		}
+
+		// it's used from the next poll on
+		uh.settings.PollingInterval = interval
+
+		return nil
+	}
+
+	return fmt.Errorf("unknown command '%s'", m.Command)
+}
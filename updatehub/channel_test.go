@@ -0,0 +1,171 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+func TestStartChannelDisabled(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	err := uh.StartChannel()
+	assert.NoError(t, err)
+	assert.Nil(t, uh.channel)
+}
+
+func TestStartChannelWithoutEndpoint(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.settings.ChannelEnabled = true
+	uh.settings.ChannelEndpoint = ""
+
+	err := uh.StartChannel()
+	assert.EqualError(t, err, "the channel endpoint must be set")
+}
+
+func TestHandleChannelCommand(t *testing.T) {
+	testCases := []struct {
+		name             string
+		state            State
+		command          client.AgentMessage
+		expectedError    string
+		expectedInterval time.Duration
+	}{
+		{
+			"Probe",
+			NewIdleState(),
+			client.AgentMessage{Command: "probe"},
+			"",
+			time.Hour,
+		},
+
+		{
+			"ProbeWhileDownloading",
+			NewDownloadingState(&metadata.UpdateMetadata{}),
+			client.AgentMessage{Command: "probe"},
+			"can't probe for updates while in the 'downloading' state",
+			time.Hour,
+		},
+
+		{
+			"AbortWithoutDownload",
+			NewIdleState(),
+			client.AgentMessage{Command: "abort"},
+			"there is no download in progress",
+			time.Hour,
+		},
+
+		{
+			"SetPollInterval",
+			NewIdleState(),
+			client.AgentMessage{Command: "set-poll-interval", Args: map[string]string{"interval": "30m"}},
+			"",
+			30 * time.Minute,
+		},
+
+		{
+			"SetPollIntervalTooShort",
+			NewIdleState(),
+			client.AgentMessage{Command: "set-poll-interval", Args: map[string]string{"interval": "1ms"}},
+			"the polling interval can't be shorter than 1s",
+			time.Hour,
+		},
+
+		{
+			"SetInvalidPollInterval",
+			NewIdleState(),
+			client.AgentMessage{Command: "set-poll-interval", Args: map[string]string{"interval": "often"}},
+			"invalid polling interval 'often'",
+			time.Hour,
+		},
+
+		{
+			"Unknown",
+			NewIdleState(),
+			client.AgentMessage{Command: "reboot"},
+			"unknown command 'reboot'",
+			time.Hour,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			uh, _ := newTestUpdateHub(tc.state, nil)
+			uh.settings.PollingInterval = time.Hour
+
+			err := uh.handleChannelCommand(tc.command)
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedError)
+			}
+
+			assert.Equal(t, tc.expectedInterval, uh.settings.PollingInterval)
+		})
+	}
+}
+
+func TestChannelCarriesReportsAndCommands(t *testing.T) {
+	upstream := make(chan client.AgentMessage, 10)
+
+	s := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		err := websocket.JSON.Send(conn, client.AgentMessage{Type: client.CommandMessage, ID: "1", Command: "probe"})
+		assert.NoError(t, err)
+
+		for {
+			var m client.AgentMessage
+			if err := websocket.JSON.Receive(conn, &m); err != nil {
+				return
+			}
+
+			upstream <- m
+		}
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	m := &metadata.UpdateMetadata{RawBytes: []byte("metadata")}
+
+	uh, _ := newTestUpdateHub(NewIdleState(), nil)
+	uh.API = client.NewApiClient(u.Host)
+	uh.Reporter = &recordingReporter{}
+	uh.settings.ChannelEnabled = true
+
+	err = uh.StartChannel()
+	assert.NoError(t, err)
+	defer uh.StopChannel()
+
+	assert.Equal(t, client.HelloMessage, (<-upstream).Type)
+	assert.Equal(t, client.AgentMessage{Type: client.ReplyMessage, ID: "1", Command: "probe"}, <-upstream)
+
+	select {
+	case <-uh.probeRequests():
+	case <-time.After(time.Second):
+		t.Error("the probe command wasn't handled")
+	}
+
+	uh.State = NewDownloadingState(m)
+
+	err = uh.ReportCurrentState()
+	assert.NoError(t, err)
+
+	assert.Equal(t, client.AgentMessage{Type: client.ReportMessage, PackageUID: m.PackageUID(), State: "downloading"}, <-upstream)
+	assert.Equal(t, []string{m.PackageUID() + ":downloading"}, uh.Reporter.(*recordingReporter).reports)
+}
@@ -0,0 +1,127 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+// chunkError is returned when a downloaded chunk doesn't match its
+// sha256sum. The download is resumed from "offset", the start of the
+// chunk.
+type chunkError struct {
+	index  int
+	offset int64
+}
+
+func (e *chunkError) Error() string {
+	return fmt.Sprintf("the chunk %d, at offset %d, doesn't match its sha256sum", e.index, e.offset)
+}
+
+// chunkVerifier checks each chunk of an object once it's completely
+// written
+type chunkVerifier struct {
+	io.Writer
+
+	chunks  []metadata.Chunk
+	index   int   // of the chunk being written
+	start   int64 // of the chunk being written
+	written int64 // of the chunk being written
+	hash    hash.Hash
+}
+
+// newChunkVerifier creates a chunkVerifier for an object whose
+// "chunks" are written into "wr" from "offset", which must be the
+// start of a chunk
+func newChunkVerifier(wr io.Writer, chunks []metadata.Chunk, offset int64) *chunkVerifier {
+	v := &chunkVerifier{Writer: wr, chunks: chunks, hash: sha256.New()}
+
+	for v.index < len(chunks) && v.start+chunks[v.index].Size <= offset {
+		v.start += chunks[v.index].Size
+		v.index++
+	}
+
+	return v
+}
+
+func (v *chunkVerifier) Write(p []byte) (int, error) {
+	n, err := v.Writer.Write(p)
+
+	data := p[:n]
+
+	for len(data) > 0 {
+		if v.index >= len(v.chunks) {
+			return n, fmt.Errorf("the object is bigger than its %d chunks", len(v.chunks))
+		}
+
+		chunk := v.chunks[v.index]
+
+		part := chunk.Size - v.written
+		if int64(len(data)) < part {
+			part = int64(len(data))
+		}
+
+		v.hash.Write(data[:part])
+		v.written += part
+		data = data[part:]
+
+		if v.written < chunk.Size {
+			break
+		}
+
+		if hex.EncodeToString(v.hash.Sum(nil)) != chunk.Sha256sum {
+			return n, &chunkError{index: v.index, offset: v.start}
+		}
+
+		v.index++
+		v.start += chunk.Size
+		v.written = 0
+		v.hash.Reset()
+	}
+
+	return n, err
+}
+
+// complete fails if any chunk is missing
+func (v *chunkVerifier) complete() error {
+	if v.index < len(v.chunks) {
+		return fmt.Errorf("the object is missing %d of its %d chunks", len(v.chunks)-v.index, len(v.chunks))
+	}
+
+	return nil
+}
+
+// alignDownloadOffset returns where the download of an object, which
+// stopped at "offset", must be resumed from: the start of the
+// encryption segment and of the chunk it stopped at
+func alignDownloadOffset(offset int64, decrypter *objectDecrypter, chunks []metadata.Chunk) int64 {
+	for {
+		aligned := offset
+
+		if decrypter != nil {
+			aligned = decrypter.align(aligned)
+		}
+
+		if len(chunks) > 0 {
+			aligned = metadata.ChunkStart(chunks, aligned)
+		}
+
+		if aligned == offset {
+			return offset
+		}
+
+		offset = aligned
+	}
+}
@@ -0,0 +1,174 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/copy"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/updatermock"
+)
+
+// "test" split in "te" and "st"
+const validJSONMetadataWithChunks = `{
+  "product-uid": "0123456789",
+  "objects": [
+    [
+      {
+        "mode": "test",
+        "sha256sum": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+        "chunks": [
+          { "size": 2, "sha256sum": "2d6c9a90dd38f6852515274cde41a8cd8e7e1a7a053835334ec7e29f61b918dd" },
+          { "size": 2, "sha256sum": "56af4bde70a47ae7d0f1ebb30e45ed336165d5c9ec00ba9a92311e33a4256d74" }
+        ]
+      }
+    ]
+  ]
+}`
+
+var testChunks = []metadata.Chunk{
+	{Size: 2, Sha256sum: "2d6c9a90dd38f6852515274cde41a8cd8e7e1a7a053835334ec7e29f61b918dd"},
+	{Size: 2, Sha256sum: "56af4bde70a47ae7d0f1ebb30e45ed336165d5c9ec00ba9a92311e33a4256d74"},
+}
+
+func TestChunkVerifier(t *testing.T) {
+	var buf bytes.Buffer
+
+	v := newChunkVerifier(&buf, testChunks, 0)
+
+	_, err := v.Write([]byte("t"))
+	assert.NoError(t, err)
+	assert.Error(t, v.complete())
+
+	_, err = v.Write([]byte("es"))
+	assert.NoError(t, err)
+
+	_, err = v.Write([]byte("t"))
+	assert.NoError(t, err)
+	assert.NoError(t, v.complete())
+	assert.Equal(t, "test", buf.String())
+
+	_, err = v.Write([]byte("!"))
+	assert.EqualError(t, err, "the object is bigger than its 2 chunks")
+}
+
+func TestChunkVerifierWithBadChunk(t *testing.T) {
+	var buf bytes.Buffer
+
+	v := newChunkVerifier(&buf, testChunks, 0)
+
+	n, err := v.Write([]byte("tezz"))
+	assert.Equal(t, 4, n)
+	assert.Equal(t, &chunkError{index: 1, offset: 2}, err)
+	assert.EqualError(t, err, "the chunk 1, at offset 2, doesn't match its sha256sum")
+}
+
+func TestChunkVerifierFromOffset(t *testing.T) {
+	var buf bytes.Buffer
+
+	v := newChunkVerifier(&buf, testChunks, 2)
+
+	_, err := v.Write([]byte("st"))
+	assert.NoError(t, err)
+	assert.NoError(t, v.complete())
+}
+
+func TestAlignDownloadOffset(t *testing.T) {
+	assert.Equal(t, int64(3), alignDownloadOffset(3, nil, nil))
+	assert.Equal(t, int64(2), alignDownloadOffset(3, nil, testChunks))
+	assert.Equal(t, int64(4), alignDownloadOffset(4, nil, testChunks))
+}
+
+func TestUpdateHubFetchUpdateWithBadChunk(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.CopyBackend = copy.ExtendedIO{}
+	uh.settings.DownloadMaxAttempts = 3
+	uh.settings.DownloadRetryInterval = time.Millisecond
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadataWithChunks))
+	assert.NoError(t, err)
+
+	objectUID := updateMetadata.Objects[0][0].GetObjectMetadata().Sha256sum
+	uri := path.Join("/", uh.FirmwareMetadata.ProductUID, updateMetadata.PackageUID(), objectUID)
+
+	// only the second chunk is downloaded again
+	um := &updatermock.UpdaterMock{}
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(ioutil.NopCloser(bytes.NewReader([]byte("tezz"))), int64(4), nil).Once()
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(2)).Return(ioutil.NopCloser(bytes.NewReader([]byte("st"))), int64(2), nil).Once()
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.NoError(t, err)
+
+	objectPath := path.Join(uh.settings.DownloadDir, objectUID)
+
+	data, err := afero.ReadFile(uh.Store, objectPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", string(data))
+
+	digest, err := readDownloadDigest(uh.Store, objectPath)
+	assert.NoError(t, err)
+	assert.Equal(t, objectUID, digest)
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestUpdateHubFetchUpdateResumesChunk(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.CopyBackend = copy.ExtendedIO{}
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadataWithChunks))
+	assert.NoError(t, err)
+
+	objectUID := updateMetadata.Objects[0][0].GetObjectMetadata().Sha256sum
+	objectPath := path.Join(uh.settings.DownloadDir, objectUID)
+
+	// stopped in the middle of the second chunk
+	err = afero.WriteFile(uh.Store, objectPath, []byte("tes"), 0644)
+	assert.NoError(t, err)
+	err = afero.WriteFile(uh.Store, objectPath+partialDownloadSuffix, nil, 0644)
+	assert.NoError(t, err)
+
+	uri := path.Join("/", uh.FirmwareMetadata.ProductUID, updateMetadata.PackageUID(), objectUID)
+
+	um := &updatermock.UpdaterMock{}
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(2)).Return(ioutil.NopCloser(bytes.NewReader([]byte("st"))), int64(2), nil).Once()
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.NoError(t, err)
+
+	data, err := afero.ReadFile(uh.Store, objectPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", string(data))
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
@@ -0,0 +1,235 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+const (
+	// currentMetadataFileName is the file, inside the download dir,
+	// which keeps the update metadata of the package last downloaded
+	currentMetadataFileName = "current-metadata.json"
+
+	// installedMetadataFileName is the file, inside the download dir,
+	// which keeps the update metadata of the package last installed
+	installedMetadataFileName = "installed-metadata.json"
+)
+
+// downloadedObject is an object found at the download dir along with
+// its partial download marker and download digest
+type downloadedObject struct {
+	uid     string
+	files   []string
+	size    int64
+	modTime time.Time
+}
+
+// CleanupDownloadDir removes the objects of the download dir that
+// aren't referenced by the current package, the one being or last
+// downloaded, or by the last installed package. The objects of the
+// installed package are then removed, oldest first, while the download
+// dir is bigger than "DownloadDirMaxSize". The objects of the current
+// package are never removed unless it's the installed one. Only the
+// files named after an object are considered. It returns how many
+// bytes were freed.
+func (uh *UpdateHub) CleanupDownloadDir() (int64, error) {
+	objects, err := uh.downloadedObjects()
+	if err != nil {
+		return 0, err
+	}
+
+	current := uh.referencedObjects(currentMetadataFileName, persistedMetadataFileName)
+	installed := uh.referencedObjects(installedMetadataFileName)
+
+	var freed, total int64
+
+	kept := []*downloadedObject{}
+
+	for _, o := range objects {
+		if !current[o.uid] && !installed[o.uid] {
+			n, err := uh.removeDownloadedObject(o)
+			freed += n
+			if err != nil {
+				return freed, err
+			}
+
+			continue
+		}
+
+		total += o.size
+
+		if !current[o.uid] {
+			kept = append(kept, o)
+		}
+	}
+
+	max := uh.settings.DownloadDirMaxSize
+	if max <= 0 {
+		return freed, nil
+	}
+
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].modTime.Before(kept[j].modTime)
+	})
+
+	for _, o := range kept {
+		if total <= max {
+			break
+		}
+
+		n, err := uh.removeDownloadedObject(o)
+		freed += n
+		total -= n
+		if err != nil {
+			return freed, err
+		}
+	}
+
+	return freed, nil
+}
+
+// cleanupDownloadDir is CleanupDownloadDir whose failure is only
+// logged
+func (uh *UpdateHub) cleanupDownloadDir() {
+	freed, err := uh.CleanupDownloadDir()
+	if err != nil {
+		log.Warn("failed to clean up the download dir: ", err)
+	}
+
+	if freed > 0 {
+		log.Info(fmt.Sprintf("%d bytes freed from the download dir", freed))
+	}
+}
+
+// downloadedObjects returns the objects found at the download dir
+func (uh *UpdateHub) downloadedObjects() ([]*downloadedObject, error) {
+	files, err := afero.ReadDir(uh.Store, uh.settings.DownloadDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []*downloadedObject{}
+	byUID := map[string]*downloadedObject{}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		uid := strings.TrimSuffix(strings.TrimSuffix(f.Name(), partialDownloadSuffix), downloadDigestSuffix)
+		if !isObjectUID(uid) {
+			continue
+		}
+
+		o, ok := byUID[uid]
+		if !ok {
+			o = &downloadedObject{uid: uid}
+			byUID[uid] = o
+			objects = append(objects, o)
+		}
+
+		o.files = append(o.files, f.Name())
+		o.size += f.Size()
+
+		if f.ModTime().After(o.modTime) {
+			o.modTime = f.ModTime()
+		}
+	}
+
+	return objects, nil
+}
+
+// removeDownloadedObject removes the files of "o" and returns how many
+// bytes were freed
+func (uh *UpdateHub) removeDownloadedObject(o *downloadedObject) (int64, error) {
+	// the marker goes last, so an interrupted removal is taken as a
+	// partial download
+	sort.Slice(o.files, func(i, j int) bool {
+		return !strings.HasSuffix(o.files[i], partialDownloadSuffix) && strings.HasSuffix(o.files[j], partialDownloadSuffix)
+	})
+
+	for _, name := range o.files {
+		err := uh.Store.Remove(path.Join(uh.settings.DownloadDir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+
+	return o.size, nil
+}
+
+// referencedObjects returns the objects of the update metadata kept at
+// the "files" of the download dir, the ones that can't be read are
+// ignored
+func (uh *UpdateHub) referencedObjects(files ...string) map[string]bool {
+	referenced := map[string]bool{}
+
+	for _, name := range files {
+		updateMetadata, err := uh.keptUpdateMetadata(name)
+		if err != nil {
+			continue
+		}
+
+		for _, objects := range updateMetadata.Objects {
+			for _, o := range objects {
+				referenced[o.GetObjectMetadata().Sha256sum] = true
+			}
+		}
+	}
+
+	return referenced
+}
+
+// keepUpdateMetadata writes "updateMetadata" to the file "name" of the
+// download dir, so the objects of its package are kept by the cleanup
+func (uh *UpdateHub) keepUpdateMetadata(name string, updateMetadata *metadata.UpdateMetadata) error {
+	err := uh.Store.MkdirAll(uh.settings.DownloadDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	return afero.WriteFile(uh.Store, path.Join(uh.settings.DownloadDir, name), updateMetadata.RawBytes, 0644)
+}
+
+// keptUpdateMetadata reads the update metadata kept at the file
+// "name" of the download dir
+func (uh *UpdateHub) keptUpdateMetadata(name string) (*metadata.UpdateMetadata, error) {
+	data, err := afero.ReadFile(uh.Store, path.Join(uh.settings.DownloadDir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	return metadata.NewUpdateMetadata(data)
+}
+
+// isObjectUID tells whether "name" is a sha256sum, which names the
+// object files
+func isObjectUID(name string) bool {
+	if len(name) != 64 {
+		return false
+	}
+
+	_, err := hex.DecodeString(name)
+
+	return err == nil
+}
@@ -0,0 +1,202 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+var (
+	currentObjectUID   = strings.Repeat("1", 64)
+	installedObjectUID = strings.Repeat("2", 64)
+	olderObjectUID     = strings.Repeat("3", 64)
+	staleObjectUID     = strings.Repeat("4", 64)
+)
+
+func newCleanupTestMetadata(t *testing.T, objectUIDs ...string) *metadata.UpdateMetadata {
+	objects := []string{}
+	for _, uid := range objectUIDs {
+		objects = append(objects, fmt.Sprintf(`{ "mode": "test", "sha256sum": "%s" }`, uid))
+	}
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(fmt.Sprintf(`{
+	  "product-uid": "0123456789",
+	  "objects": [ [ %s ] ]
+	}`, strings.Join(objects, ", "))))
+	assert.NoError(t, err)
+
+	return updateMetadata
+}
+
+func writeCleanupTestObject(t *testing.T, uh *UpdateHub, name string, size int, modTime time.Time) {
+	p := path.Join(uh.settings.DownloadDir, name)
+
+	err := afero.WriteFile(uh.Store, p, make([]byte, size), 0644)
+	assert.NoError(t, err)
+
+	err = uh.Store.Chtimes(p, modTime, modTime)
+	assert.NoError(t, err)
+}
+
+func TestCleanupDownloadDir(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	err := uh.keepUpdateMetadata(currentMetadataFileName, newCleanupTestMetadata(t, currentObjectUID))
+	assert.NoError(t, err)
+	err = uh.keepUpdateMetadata(installedMetadataFileName, newCleanupTestMetadata(t, installedObjectUID))
+	assert.NoError(t, err)
+
+	now := time.Now()
+
+	writeCleanupTestObject(t, uh, currentObjectUID, 10, now)
+	writeCleanupTestObject(t, uh, currentObjectUID+partialDownloadSuffix, 0, now)
+	writeCleanupTestObject(t, uh, installedObjectUID, 20, now)
+	writeCleanupTestObject(t, uh, installedObjectUID+downloadDigestSuffix, 5, now)
+	writeCleanupTestObject(t, uh, staleObjectUID, 30, now)
+	writeCleanupTestObject(t, uh, staleObjectUID+downloadDigestSuffix, 5, now)
+	writeCleanupTestObject(t, uh, staleObjectUID+partialDownloadSuffix, 0, now)
+	writeCleanupTestObject(t, uh, "other-file", 40, now)
+
+	freed, err := uh.CleanupDownloadDir()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(35), freed)
+
+	for _, name := range []string{
+		currentObjectUID,
+		currentObjectUID + partialDownloadSuffix,
+		installedObjectUID,
+		installedObjectUID + downloadDigestSuffix,
+		currentMetadataFileName,
+		installedMetadataFileName,
+		"other-file",
+	} {
+		exists, err := afero.Exists(uh.Store, path.Join(uh.settings.DownloadDir, name))
+		assert.NoError(t, err)
+		assert.True(t, exists, name)
+	}
+
+	for _, name := range []string{
+		staleObjectUID,
+		staleObjectUID + downloadDigestSuffix,
+		staleObjectUID + partialDownloadSuffix,
+	} {
+		exists, err := afero.Exists(uh.Store, path.Join(uh.settings.DownloadDir, name))
+		assert.NoError(t, err)
+		assert.False(t, exists, name)
+	}
+}
+
+func TestCleanupDownloadDirWithMaxSize(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.settings.DownloadDirMaxSize = 40
+
+	err := uh.keepUpdateMetadata(currentMetadataFileName, newCleanupTestMetadata(t, currentObjectUID))
+	assert.NoError(t, err)
+	err = uh.keepUpdateMetadata(installedMetadataFileName, newCleanupTestMetadata(t, installedObjectUID, olderObjectUID))
+	assert.NoError(t, err)
+
+	now := time.Now()
+
+	writeCleanupTestObject(t, uh, currentObjectUID, 30, now)
+	writeCleanupTestObject(t, uh, installedObjectUID, 10, now)
+	writeCleanupTestObject(t, uh, olderObjectUID, 10, now.Add(-time.Hour))
+
+	// the oldest object of the installed package is removed first
+	freed, err := uh.CleanupDownloadDir()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), freed)
+
+	exists, err := afero.Exists(uh.Store, path.Join(uh.settings.DownloadDir, olderObjectUID))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	exists, err = afero.Exists(uh.Store, path.Join(uh.settings.DownloadDir, installedObjectUID))
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// the objects of the current package are kept even over the limit
+	uh.settings.DownloadDirMaxSize = 10
+
+	freed, err = uh.CleanupDownloadDir()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), freed)
+
+	exists, err = afero.Exists(uh.Store, path.Join(uh.settings.DownloadDir, currentObjectUID))
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestCleanupDownloadDirKeepsPersistedState(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	// the package of the state resumed after a restart
+	err := uh.persistState(NewDownloadingState(newCleanupTestMetadata(t, currentObjectUID)))
+	assert.NoError(t, err)
+
+	writeCleanupTestObject(t, uh, currentObjectUID, 10, time.Now())
+
+	freed, err := uh.CleanupDownloadDir()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), freed)
+}
+
+func TestCleanupDownloadDirWithoutDownloadDir(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.settings.DownloadDir = "/missing"
+
+	freed, err := uh.CleanupDownloadDir()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), freed)
+}
+
+func TestIdleStateCleansUpDownloadDir(t *testing.T) {
+	uh, _ := newTestUpdateHub(NewIdleState(), nil)
+
+	writeCleanupTestObject(t, uh, staleObjectUID, 10, time.Now())
+
+	uh.State.Handle(uh)
+
+	exists, err := afero.Exists(uh.Store, path.Join(uh.settings.DownloadDir, staleObjectUID))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestInstalledStateKeepsUpdateMetadata(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.settings.AutoRebootAfterInstall = false
+
+	updateMetadata := newCleanupTestMetadata(t, installedObjectUID)
+
+	NewInstalledState(updateMetadata).Handle(uh)
+
+	data, err := afero.ReadFile(uh.Store, path.Join(uh.settings.DownloadDir, installedMetadataFileName))
+	assert.NoError(t, err)
+	assert.Equal(t, updateMetadata.RawBytes, data)
+}
@@ -0,0 +1,43 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"time"
+)
+
+// Clock is the source of time of the state machine, it can be replaced
+// to control the time on simulations. The waits of the system clock
+// are measured by the monotonic clock, so they aren't affected by the
+// wall clock being set. The network timeouts and the watchdog aren't
+// part of the state machine and are kept in real time.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// clock returns the "Clock" of "uh", which is the system one unless it
+// was replaced
+func (uh *UpdateHub) clock() Clock {
+	if uh.Clock == nil {
+		return realClock{}
+	}
+
+	return uh.Clock
+}
@@ -0,0 +1,159 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+)
+
+// Status describes what the agent is currently doing
+type Status struct {
+	State            string            `json:"state"`
+	DownloadProgress DownloadProgress  `json:"download-progress"`
+	InstallProgress  InstallProgress   `json:"install-progress"`
+	DownloadPaused   bool              `json:"download-paused"`
+	DataUsage        DataUsage         `json:"data-usage"`
+	Telemetry        []ObjectTelemetry `json:"telemetry"`
+}
+
+// Status returns the current status of the agent
+func (uh *UpdateHub) Status() Status {
+	status := Status{
+		DownloadProgress: uh.DownloadProgress(),
+		InstallProgress:  uh.InstallProgress(),
+		DataUsage:        uh.DataUsage(),
+		Telemetry:        uh.ObjectTelemetry(),
+	}
+
+	current := uh.CurrentState()
+
+	if current != nil {
+		status.State = StateToString(current.ID())
+	}
+
+	if state, ok := current.(*DownloadingState); ok {
+		status.DownloadPaused = state.Paused()
+	}
+
+	return status
+}
+
+// ProbeUpdate makes the agent check for an update right away instead
+// of waiting for the next poll. It is only possible while the agent is
+// idle or polling.
+func (uh *UpdateHub) ProbeUpdate() error {
+	return uh.ProbeUpdateWithServer("")
+}
+
+// ProbeUpdateWithServer is like ProbeUpdate, but the update is checked
+// at "server" instead of the configured servers. The update found is
+// also downloaded and reported there, the configured servers are used
+// again once the agent is back to idle. An empty "server" is the same
+// as ProbeUpdate.
+func (uh *UpdateHub) ProbeUpdateWithServer(server string) error {
+	// the media are probed by the agent only
+	if scheme, _ := splitServerScheme(server); scheme == "file" {
+		return fmt.Errorf("can't probe for updates at '%s'", server)
+	}
+
+	return uh.probeAt(server)
+}
+
+// probeAt requests the probe at "server", see overrideServer
+func (uh *UpdateHub) probeAt(server string) error {
+	switch state := uh.CurrentState(); state.(type) {
+	case *IdleState, *PollState:
+	default:
+		return fmt.Errorf("can't probe for updates while in the '%s' state", StateToString(state.ID()))
+	}
+
+	select {
+	case uh.probeRequests() <- server:
+	default:
+		// a probe is already pending
+	}
+
+	return nil
+}
+
+// AbortDownload cancels the download in progress. The objects already
+// (partially) downloaded are kept so they can be resumed later.
+func (uh *UpdateHub) AbortDownload() error {
+	state, ok := uh.CurrentState().(*DownloadingState)
+	if !ok {
+		return fmt.Errorf("there is no download in progress")
+	}
+
+	state.Cancel(true)
+
+	return nil
+}
+
+// PauseDownload interrupts the download in progress, so the device
+// can yield its bandwidth, until ResumeDownload is called. The objects
+// already (partially) downloaded are kept.
+func (uh *UpdateHub) PauseDownload() error {
+	state, ok := uh.CurrentState().(*DownloadingState)
+	if !ok {
+		return fmt.Errorf("there is no download in progress")
+	}
+
+	if !state.Pause() {
+		return fmt.Errorf("the download is already paused")
+	}
+
+	return nil
+}
+
+// ResumeDownload continues the download paused by PauseDownload
+func (uh *UpdateHub) ResumeDownload() error {
+	state, ok := uh.CurrentState().(*DownloadingState)
+	if !ok {
+		return fmt.Errorf("there is no download in progress")
+	}
+
+	if !state.Resume() {
+		return fmt.Errorf("the download isn't paused")
+	}
+
+	return nil
+}
+
+// ApproveUpdate approves the installation or the reboot the agent is
+// awaiting the approval of
+func (uh *UpdateHub) ApproveUpdate() error {
+	return uh.decideApproval(true)
+}
+
+// RejectUpdate rejects the installation or the reboot the agent is
+// awaiting the approval of, the agent goes back to idle
+func (uh *UpdateHub) RejectUpdate() error {
+	return uh.decideApproval(false)
+}
+
+func (uh *UpdateHub) decideApproval(approved bool) error {
+	state, ok := uh.CurrentState().(*AwaitingApprovalState)
+	if !ok {
+		return fmt.Errorf("there is no approval pending")
+	}
+
+	if !state.Decide(approved) {
+		return fmt.Errorf("the approval was already decided")
+	}
+
+	return nil
+}
+
+func (uh *UpdateHub) probeRequests() chan string {
+	uh.probeOnce.Do(func() {
+		uh.probe = make(chan string, 1)
+	})
+
+	return uh.probe
+}
@@ -0,0 +1,311 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+)
+
+func TestUpdateHubStatus(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(NewIdleState(), aim)
+	uh.resetDownloadProgress(3)
+	uh.addDownloadedObject(10)
+
+	assert.Equal(t, Status{
+		State:            "idle",
+		DownloadProgress: DownloadProgress{TotalObjects: 3, DownloadedObjects: 1, DownloadedBytes: 10},
+		DataUsage:        uh.DataUsage(),
+	}, uh.Status())
+
+	aim.AssertExpectations(t)
+}
+
+func TestUpdateHubProbeUpdateWhilePolling(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+
+	poll := NewPollState(uh)
+	poll.interval = time.Hour
+	uh.State = poll
+
+	err := uh.ProbeUpdate()
+	assert.NoError(t, err)
+
+	// a second probe request is merged with the pending one
+	err = uh.ProbeUpdate()
+	assert.NoError(t, err)
+
+	next, _ := poll.Handle(uh)
+	assert.IsType(t, &UpdateCheckState{}, next)
+
+	aim.AssertExpectations(t)
+}
+
+func TestUpdateHubProbeUpdateWhileIdleWithPollingDisabled(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(NewIdleState(), aim)
+	uh.settings.PollingEnabled = false
+
+	err := uh.ProbeUpdate()
+	assert.NoError(t, err)
+
+	next, _ := uh.State.Handle(uh)
+	assert.IsType(t, &UpdateCheckState{}, next)
+
+	aim.AssertExpectations(t)
+}
+
+func TestUpdateHubProbeUpdateWithServer(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(NewIdleState(), aim)
+	uh.Controller = &testController{}
+	uh.settings.PollingEnabled = false
+
+	err := uh.ProbeUpdateWithServer("commissioning:8080")
+	assert.NoError(t, err)
+
+	next, _ := uh.State.Handle(uh)
+	assert.Equal(t, newProbeState("commissioning:8080"), next)
+
+	// the update is checked at the given server
+	next, _ = next.Handle(uh)
+	assert.IsType(t, &IdleState{}, next)
+	assert.Equal(t, "commissioning:8080", uh.API.OverriddenServer())
+
+	// until the agent is idle again
+	uh.settings.PollingEnabled = true
+
+	next.Handle(uh)
+	assert.Equal(t, "", uh.API.OverriddenServer())
+
+	aim.AssertExpectations(t)
+}
+
+func TestUpdateHubProbeUpdateWhileDownloading(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(NewDownloadingState(&metadata.UpdateMetadata{}), aim)
+
+	err := uh.ProbeUpdate()
+	assert.EqualError(t, err, "can't probe for updates while in the 'downloading' state")
+
+	aim.AssertExpectations(t)
+}
+
+func TestUpdateHubAbortDownload(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(NewDownloadingState(&metadata.UpdateMetadata{}), aim)
+	uh.Controller = &testController{}
+
+	err := uh.AbortDownload()
+	assert.NoError(t, err)
+
+	// aborting twice must not block
+	err = uh.AbortDownload()
+	assert.NoError(t, err)
+
+	next, _ := uh.State.Handle(uh)
+	assert.IsType(t, &IdleState{}, next)
+
+	aim.AssertExpectations(t)
+}
+
+// blockingController blocks its first FetchUpdate until it is
+// interrupted through "ctx", and then until "hold" is closed if set
+type blockingController struct {
+	testController
+
+	fetches int32
+	started chan bool
+	hold    chan bool
+}
+
+func (c *blockingController) FetchUpdate(ctx context.Context, updateMetadata *metadata.UpdateMetadata) error {
+	if atomic.AddInt32(&c.fetches, 1) == 1 {
+		c.started <- true
+		<-ctx.Done()
+
+		if c.hold != nil {
+			<-c.hold
+		}
+	}
+
+	return nil
+}
+
+func TestUpdateHubPauseAndResumeDownload(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(NewDownloadingState(&metadata.UpdateMetadata{}), aim)
+
+	c := &blockingController{started: make(chan bool, 1)}
+	uh.Controller = c
+
+	next := make(chan State)
+	go func() {
+		state, _ := uh.State.Handle(uh)
+		next <- state
+	}()
+
+	<-c.started
+
+	err := uh.PauseDownload()
+	assert.NoError(t, err)
+	assert.True(t, uh.Status().DownloadPaused)
+
+	err = uh.PauseDownload()
+	assert.EqualError(t, err, "the download is already paused")
+
+	// it isn't resumed until it is asked to
+	select {
+	case <-next:
+		t.Fatal("the paused download finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	err = uh.ResumeDownload()
+	assert.NoError(t, err)
+
+	assert.IsType(t, &InstallingState{}, <-next)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&c.fetches))
+	assert.False(t, uh.Status().DownloadPaused)
+
+	aim.AssertExpectations(t)
+}
+
+func TestUpdateHubResumeDownloadBeforeItIsInterrupted(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(NewDownloadingState(&metadata.UpdateMetadata{}), aim)
+
+	c := &blockingController{started: make(chan bool, 1), hold: make(chan bool)}
+	uh.Controller = c
+
+	next := make(chan State)
+	go func() {
+		state, _ := uh.State.Handle(uh)
+		next <- state
+	}()
+
+	<-c.started
+
+	err := uh.PauseDownload()
+	assert.NoError(t, err)
+
+	// resumed while the interrupted download is still returning
+	err = uh.ResumeDownload()
+	assert.NoError(t, err)
+
+	close(c.hold)
+
+	// the interrupted download isn't taken as finished
+	assert.IsType(t, &InstallingState{}, <-next)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&c.fetches))
+
+	aim.AssertExpectations(t)
+}
+
+func TestUpdateHubAbortPausedDownload(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(NewDownloadingState(&metadata.UpdateMetadata{}), aim)
+
+	c := &blockingController{started: make(chan bool, 1)}
+	uh.Controller = c
+
+	next := make(chan State)
+	go func() {
+		state, _ := uh.State.Handle(uh)
+		next <- state
+	}()
+
+	<-c.started
+
+	err := uh.PauseDownload()
+	assert.NoError(t, err)
+
+	err = uh.AbortDownload()
+	assert.NoError(t, err)
+
+	assert.IsType(t, &IdleState{}, <-next)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&c.fetches))
+
+	aim.AssertExpectations(t)
+}
+
+func TestUpdateHubDownloadAbortedByDaemonStop(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(NewDownloadingState(&metadata.UpdateMetadata{}), aim)
+
+	c := &blockingController{started: make(chan bool, 1)}
+	uh.Controller = c
+
+	d := NewDaemon(uh)
+	uh.ctx = d.ctx
+
+	next := make(chan State)
+	go func() {
+		state, _ := uh.State.Handle(uh)
+		next <- state
+	}()
+
+	<-c.started
+
+	d.Stop()
+
+	assert.IsType(t, &IdleState{}, <-next)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&c.fetches))
+
+	aim.AssertExpectations(t)
+}
+
+func TestUpdateHubPauseAndResumeWithoutDownload(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(NewIdleState(), aim)
+
+	err := uh.PauseDownload()
+	assert.EqualError(t, err, "there is no download in progress")
+
+	err = uh.ResumeDownload()
+	assert.EqualError(t, err, "there is no download in progress")
+
+	uh.State = NewDownloadingState(&metadata.UpdateMetadata{})
+
+	err = uh.ResumeDownload()
+	assert.EqualError(t, err, "the download isn't paused")
+
+	aim.AssertExpectations(t)
+}
+
+func TestUpdateHubAbortDownloadWithoutDownload(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(NewIdleState(), aim)
+
+	err := uh.AbortDownload()
+	assert.EqualError(t, err, "there is no download in progress")
+
+	aim.AssertExpectations(t)
+}
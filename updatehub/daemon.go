@@ -9,37 +9,62 @@
 package updatehub
 
 import (
-	"github.com/Sirupsen/logrus"
-	"github.com/OSSystems/pkg/log"
+	"context"
+	"sync/atomic"
 )
 
 type Daemon struct {
-	uh   *UpdateHub
-	stop bool
+	uh       *UpdateHub
+	stop     bool
+	ctx      context.Context
+	shutdown context.CancelFunc
+	notify   func(state string) error
 }
 
 func NewDaemon(uh *UpdateHub) *Daemon {
+	ctx, shutdown := context.WithCancel(context.Background())
+
 	return &Daemon{
-		uh: uh,
+		uh:       uh,
+		ctx:      ctx,
+		shutdown: shutdown,
+		notify:   sdNotify,
 	}
 }
 
+// Stop makes Run to return once the current state is handled, the
+// update check or the download in progress is aborted
 func (d *Daemon) Stop() {
 	d.stop = true
+	d.shutdown()
 }
 
 func (d *Daemon) Run() int {
-	for {
-		err := d.uh.ReportCurrentState()
-		if err != nil {
-			log.WithFields(logrus.Fields{
-				"state": StateToString(d.uh.State.ID()),
-			}).Warn("Failed to report status")
-		}
+	// the states abort their requests once the daemon is stopped
+	d.uh.ctx = d.ctx
+
+	// the settings are reloaded by the daemon from now on
+	atomic.StoreInt32(&d.uh.daemonRunning, 1)
+	defer atomic.StoreInt32(&d.uh.daemonRunning, 0)
+
+	// resume the state the agent was at before being restarted
+	if state := d.uh.RestoreState(); state != nil {
+		d.uh.changeState(state)
+	}
+
+	d.sdNotify("READY=1")
+
+	stopWatchdog := d.startWatchdog(watchdogInterval())
+	defer stopWatchdog()
 
-		state, _ := d.uh.State.Handle(d.uh)
+	stopHeartbeatReports := d.startHeartbeatReports(d.uh.settings.HeartbeatInterval)
+	defer stopHeartbeatReports()
 
-		d.uh.State = state
+	stopMediumWatcher := d.startMediumWatcher()
+	defer stopMediumWatcher()
+
+	for {
+		state := d.Step()
 
 		if d.stop || state.ID() == UpdateHubStateExit {
 			if finalState, _ := state.(*ExitState); finalState != nil {
@@ -50,3 +75,82 @@ func (d *Daemon) Run() int {
 		}
 	}
 }
+
+// Step handles the current state, as done by each iteration of Run,
+// and returns the next one
+func (d *Daemon) Step() State {
+	// the settings reloaded while the previous state was handled
+	d.uh.applySettingsReloads()
+
+	// installing and rebooting must wait for the maintenance window
+	d.uh.changeState(d.uh.waitForMaintenanceWindow(d.uh.CurrentState()))
+
+	// and for enough power, so they aren't interrupted by a flat battery
+	d.uh.changeState(d.uh.waitForPower(d.uh.CurrentState()))
+
+	state := d.uh.CurrentState()
+
+	d.uh.heartbeat.enter(state.ID())
+	d.sdNotify("STATUS=" + StateToString(state.ID()))
+
+	err := d.uh.ReportCurrentState()
+	if err != nil {
+		log.WithFields(LogFields{
+			"state": StateToString(state.ID()),
+		}).Warn("Failed to report status")
+	}
+
+	d.uh.changeState(d.handleState(state))
+
+	return d.uh.CurrentState()
+}
+
+// handleState handles "state" running the state change callbacks
+// before and after it. A failed "enter" callback cancels the
+// cancellable states, in that case the agent goes back to idle.
+func (d *Daemon) handleState(state State) State {
+	d.uh.recordState(state)
+
+	err := d.uh.persistState(state)
+	if err != nil {
+		log.WithFields(LogFields{
+			"state": StateToString(state.ID()),
+		}).Warn("Failed to persist state: ", err)
+	}
+
+	err = d.uh.runStateChangeCallbacks("enter", state)
+	if err != nil {
+		if cancellableByCallback(state) {
+			log.WithFields(LogFields{
+				"state": StateToString(state.ID()),
+			}).Info("State cancelled by callback: ", err)
+
+			return NewIdleState()
+		}
+
+		log.WithFields(LogFields{
+			"state": StateToString(state.ID()),
+		}).Warn("State enter callback failed: ", err)
+	}
+
+	next, _ := state.Handle(d.uh)
+
+	d.uh.trackFailures(state, next)
+	d.uh.describeError(state, next)
+
+	err = d.uh.runStateChangeCallbacks("leave", state)
+	if err != nil {
+		log.WithFields(LogFields{
+			"state": StateToString(state.ID()),
+		}).Warn("State leave callback failed: ", err)
+	}
+
+	return next
+}
+
+func (d *Daemon) sdNotify(state string) {
+	err := d.notify(state)
+	if err != nil {
+		log.Warn("failed to notify systemd: ", err)
+	}
+}
@@ -13,7 +13,6 @@ import (
 	"reflect"
 	"testing"
 
-	"github.com/OSSystems/pkg/log"
 	"github.com/Sirupsen/logrus"
 	"github.com/Sirupsen/logrus/hooks/test"
 	"github.com/UpdateHub/updatehub/client"
@@ -63,9 +62,9 @@ func TestDaemonStop(t *testing.T) {
 
 func TestDaemonFailedToReportStatus(t *testing.T) {
 	logger, hook := test.NewNullLogger()
-	log.SetLogger(logger)
+	SetLogger(NewLogrusLogger(logger))
 
-	defer log.SetLogger(logrus.StandardLogger())
+	defer SetLogger(nil)
 	defer hook.Reset()
 
 	aim := &activeinactivemock.ActiveInactiveMock{}
@@ -91,9 +90,9 @@ func TestDaemonFailedToReportStatus(t *testing.T) {
 
 func TestDaemonExitStateStop(t *testing.T) {
 	logger, hook := test.NewNullLogger()
-	log.SetLogger(logger)
+	SetLogger(NewLogrusLogger(logger))
 
-	defer log.SetLogger(logrus.StandardLogger())
+	defer SetLogger(nil)
 	defer hook.Reset()
 
 	aim := &activeinactivemock.ActiveInactiveMock{}
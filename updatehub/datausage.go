@@ -0,0 +1,184 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	dataUsageDayLayout   = "2006-01-02"
+	dataUsageMonthLayout = "2006-01"
+)
+
+// errDataCapReached is returned by the object downloads once the data
+// cap of the current period is reached
+var errDataCapReached = errors.New("the data cap was reached")
+
+// DataUsage holds the bytes downloaded by the updates on the current
+// day and month along with their caps, 0 means no cap
+type DataUsage struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day-bytes"`
+	DailyCap   int64  `json:"daily-cap"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month-bytes"`
+	MonthlyCap int64  `json:"monthly-cap"`
+}
+
+// DataUsage returns the data usage of the current period
+func (uh *UpdateHub) DataUsage() DataUsage {
+	// nothing was downloaded before the settings are loaded
+	if uh.settings == nil {
+		return DataUsage{}
+	}
+
+	uh.persistedStateMutex.Lock()
+	defer uh.persistedStateMutex.Unlock()
+
+	p := uh.currentDataUsage()
+
+	return DataUsage{
+		Day:        p.DataUsageDay,
+		DayBytes:   p.DataUsageDayBytes,
+		DailyCap:   uh.settings.DataUsageDailyCap,
+		Month:      p.DataUsageMonth,
+		MonthBytes: p.DataUsageMonthBytes,
+		MonthlyCap: uh.settings.DataUsageMonthlyCap,
+	}
+}
+
+// currentDataUsage starts over the counters of the periods that are
+// over. It must be called with the persisted state mutex held.
+func (uh *UpdateHub) currentDataUsage() *PersistentDataUsageSettings {
+	p := &uh.settings.PersistentDataUsageSettings
+
+	now := uh.clock().Now()
+
+	if day := now.Format(dataUsageDayLayout); p.DataUsageDay != day {
+		p.DataUsageDay = day
+		p.DataUsageDayBytes = 0
+	}
+
+	if month := now.Format(dataUsageMonthLayout); p.DataUsageMonth != month {
+		p.DataUsageMonth = month
+		p.DataUsageMonthBytes = 0
+	}
+
+	return p
+}
+
+// dataAllowance returns how many bytes can still be downloaded in the
+// current period, -1 means no limit
+func (uh *UpdateHub) dataAllowance() int64 {
+	uh.persistedStateMutex.Lock()
+	defer uh.persistedStateMutex.Unlock()
+
+	p := uh.currentDataUsage()
+
+	allowance := int64(-1)
+
+	limit := func(dataCap int64, used int64) {
+		if dataCap <= 0 {
+			return
+		}
+
+		left := dataCap - used
+		if left < 0 {
+			left = 0
+		}
+
+		if allowance < 0 || left < allowance {
+			allowance = left
+		}
+	}
+
+	limit(uh.settings.DataUsageDailyCap, p.DataUsageDayBytes)
+	limit(uh.settings.DataUsageMonthlyCap, p.DataUsageMonthBytes)
+
+	return allowance
+}
+
+// dataCapReached tells whether the downloads must be deferred to the
+// next period
+func (uh *UpdateHub) dataCapReached() bool {
+	return uh.dataAllowance() == 0
+}
+
+func (uh *UpdateHub) addDataUsage(n int64) {
+	uh.persistedStateMutex.Lock()
+	defer uh.persistedStateMutex.Unlock()
+
+	p := uh.currentDataUsage()
+	p.DataUsageDayBytes += n
+	p.DataUsageMonthBytes += n
+}
+
+func (uh *UpdateHub) saveDataUsage() {
+	uh.persistedStateMutex.Lock()
+	defer uh.persistedStateMutex.Unlock()
+
+	err := uh.saveRuntimeSettings()
+	if err != nil {
+		log.Warn("failed to save the data usage: ", err)
+	}
+}
+
+// nextDataUsagePeriod returns when the data cap reached is lifted
+func (uh *UpdateHub) nextDataUsagePeriod() time.Time {
+	now := uh.clock().Now()
+
+	uh.persistedStateMutex.Lock()
+	monthReached := uh.settings.DataUsageMonthlyCap > 0 && uh.currentDataUsage().DataUsageMonthBytes >= uh.settings.DataUsageMonthlyCap
+	uh.persistedStateMutex.Unlock()
+
+	if monthReached {
+		return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+	}
+
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+}
+
+// meterDownload wraps "rd" so the bytes read from it are accounted to
+// the data usage, which is saved when it is closed. Reading fails with
+// errDataCapReached instead of going over the data cap.
+func (uh *UpdateHub) meterDownload(rd io.ReadCloser) io.ReadCloser {
+	return &meteredReader{ReadCloser: rd, uh: uh}
+}
+
+type meteredReader struct {
+	io.ReadCloser
+	uh *UpdateHub
+}
+
+func (r *meteredReader) Read(p []byte) (int, error) {
+	allowance := r.uh.dataAllowance()
+	if allowance == 0 {
+		return 0, errDataCapReached
+	}
+
+	if allowance > 0 && int64(len(p)) > allowance {
+		p = p[:allowance]
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.uh.addDataUsage(int64(n))
+	}
+
+	return n, err
+}
+
+func (r *meteredReader) Close() error {
+	r.uh.saveDataUsage()
+
+	return r.ReadCloser.Close()
+}
@@ -0,0 +1,217 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/copy"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/updatermock"
+)
+
+func TestDataUsage(t *testing.T) {
+	clock := &testClock{now: time.Date(2017, time.June, 30, 10, 0, 0, 0, time.Local)}
+
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.Clock = clock
+	uh.settings.DataUsageDailyCap = 100
+
+	uh.addDataUsage(10)
+	uh.addDataUsage(20)
+
+	assert.Equal(t, DataUsage{
+		Day:        "2017-06-30",
+		DayBytes:   30,
+		DailyCap:   100,
+		Month:      "2017-06",
+		MonthBytes: 30,
+	}, uh.DataUsage())
+
+	// both start over on a new month
+	clock.now = time.Date(2017, time.July, 1, 0, 0, 0, 0, time.Local)
+
+	uh.addDataUsage(5)
+
+	assert.Equal(t, DataUsage{
+		Day:        "2017-07-01",
+		DayBytes:   5,
+		DailyCap:   100,
+		Month:      "2017-07",
+		MonthBytes: 5,
+	}, uh.DataUsage())
+
+	// only the day starts over on a new day
+	clock.now = time.Date(2017, time.July, 2, 0, 0, 0, 0, time.Local)
+
+	uh.addDataUsage(7)
+
+	assert.Equal(t, DataUsage{
+		Day:        "2017-07-02",
+		DayBytes:   7,
+		DailyCap:   100,
+		Month:      "2017-07",
+		MonthBytes: 12,
+	}, uh.DataUsage())
+}
+
+func TestDataAllowance(t *testing.T) {
+	testCases := []struct {
+		name              string
+		dailyCap          int64
+		monthlyCap        int64
+		expectedAllowance int64
+	}{
+		{"WithoutCaps", 0, 0, -1},
+		{"WithDailyCap", 100, 0, 60},
+		{"WithMonthlyCap", 0, 1000, 850},
+		{"WithBothCaps", 100, 170, 20},
+		{"WithDailyCapReached", 40, 1000, 0},
+		{"WithMonthlyCapReached", 100, 150, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			uh, _ := newTestUpdateHub(nil, nil)
+			uh.Clock = &testClock{now: time.Date(2017, time.June, 30, 10, 0, 0, 0, time.Local)}
+			uh.settings.DataUsageDailyCap = tc.dailyCap
+			uh.settings.DataUsageMonthlyCap = tc.monthlyCap
+			uh.settings.PersistentDataUsageSettings = PersistentDataUsageSettings{
+				DataUsageDay:        "2017-06-30",
+				DataUsageDayBytes:   40,
+				DataUsageMonth:      "2017-06",
+				DataUsageMonthBytes: 150,
+			}
+
+			assert.Equal(t, tc.expectedAllowance, uh.dataAllowance())
+			assert.Equal(t, tc.expectedAllowance == 0, uh.dataCapReached())
+		})
+	}
+}
+
+func TestNextDataUsagePeriod(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.Clock = &testClock{now: time.Date(2017, time.June, 30, 10, 0, 0, 0, time.Local)}
+	uh.settings.DataUsageDailyCap = 10
+	uh.settings.DataUsageMonthlyCap = 100
+
+	uh.addDataUsage(10)
+	assert.Equal(t, time.Date(2017, time.July, 1, 0, 0, 0, 0, time.Local), uh.nextDataUsagePeriod())
+
+	uh.settings.DataUsageDailyCap = 0
+	uh.addDataUsage(90)
+	assert.Equal(t, time.Date(2017, time.July, 1, 0, 0, 0, 0, time.Local), uh.nextDataUsagePeriod())
+
+	uh.Clock = &testClock{now: time.Date(2017, time.June, 10, 10, 0, 0, 0, time.Local)}
+	uh.settings.PersistentDataUsageSettings = PersistentDataUsageSettings{
+		DataUsageDay:        "2017-06-10",
+		DataUsageMonth:      "2017-06",
+		DataUsageMonthBytes: 100,
+	}
+	assert.Equal(t, time.Date(2017, time.July, 1, 0, 0, 0, 0, time.Local), uh.nextDataUsagePeriod())
+}
+
+func TestUpdateHubFetchUpdateWithDataCap(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.CopyBackend = copy.ExtendedIO{}
+	uh.RuntimeSettingsPath = "/runtime.conf"
+	uh.settings.DownloadMaxAttempts = 3
+	uh.settings.DownloadRetryInterval = time.Millisecond
+	uh.settings.DataUsageDailyCap = 2
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	objectUID := updateMetadata.Objects[0][0].GetObjectMetadata().Sha256sum
+	uri := path.Join("/", uh.FirmwareMetadata.ProductUID, updateMetadata.PackageUID(), objectUID)
+
+	// it isn't retried once the cap is reached
+	um := &updatermock.UpdaterMock{}
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(ioutil.NopCloser(bytes.NewReader([]byte("test"))), int64(4), nil).Once()
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.Equal(t, errDataCapReached, err)
+	assert.True(t, uh.dataCapReached())
+
+	// kept to be resumed in the next period
+	data, err := afero.ReadFile(uh.Store, path.Join(uh.settings.DownloadDir, objectUID))
+	assert.NoError(t, err)
+	assert.Equal(t, "te", string(data))
+
+	// saved so it survives a restart
+	data, err = afero.ReadFile(uh.Store, uh.RuntimeSettingsPath)
+	assert.NoError(t, err)
+
+	runtimeSettings, err := LoadSettings(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), runtimeSettings.DataUsageDayBytes)
+	assert.Equal(t, int64(2), runtimeSettings.DataUsageMonthBytes)
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestDownloadingStateWithDataCapReached(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	uh, _ := newTestUpdateHub(NewDownloadingState(updateMetadata), aim)
+	uh.settings.DataUsageMonthlyCap = 10
+	uh.addDataUsage(10)
+
+	uh.Controller = &testController{fetchUpdateError: errDataCapReached}
+
+	next, _ := uh.State.Handle(uh)
+	assert.IsType(t, &IdleState{}, next)
+
+	// any other error still fails the download
+	uh.settings.DataUsageMonthlyCap = 0
+	uh.Controller = &testController{fetchUpdateError: errors.New("fetch error")}
+
+	next, _ = NewDownloadingState(updateMetadata).Handle(uh)
+	assert.IsType(t, &ErrorState{}, next)
+
+	aim.AssertExpectations(t)
+}
+
+func TestUpdateCheckStateWithDataCapReached(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(NewUpdateCheckState(), aim)
+	uh.settings.DataUsageDailyCap = 10
+	uh.addDataUsage(10)
+
+	uh.Controller = &testController{updateAvailable: true, extraPoll: -1}
+
+	next, _ := uh.State.Handle(uh)
+	assert.IsType(t, &IdleState{}, next)
+
+	aim.AssertExpectations(t)
+}
@@ -0,0 +1,153 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// assembleObject returns the content of the delta object "obj" from
+// "offset", which must be the start of a chunk, and its length. The
+// chunks are taken from the seed when it holds them at the same
+// offset and downloaded from the chunk store otherwise, the downloads
+// are throttled by "limiter" and aborted once "ctx" is cancelled.
+func (uh *UpdateHub) assembleObject(ctx context.Context, obj metadata.Object, offset int64, limiter *utils.RateLimiter) (io.ReadCloser, int64, error) {
+	om := obj.GetObjectMetadata()
+
+	if len(om.Chunks) == 0 {
+		return nil, -1, errors.New("the delta object has no chunks to be assembled from")
+	}
+
+	if om.Encryption != nil {
+		return nil, -1, errors.New("the encrypted objects can't be assembled from chunks")
+	}
+
+	r := &assembledReader{
+		uh:      uh,
+		ctx:     ctx,
+		object:  om,
+		limiter: limiter,
+	}
+
+	for r.index < len(om.Chunks) && r.offset+om.Chunks[r.index].Size <= offset {
+		r.offset += om.Chunks[r.index].Size
+		r.index++
+	}
+
+	if om.Seed != "" {
+		seed, err := uh.Store.Open(om.Seed)
+		if err != nil {
+			log.Warn(fmt.Sprintf("downloading every chunk of the object '%s' since its seed can't be read: %s", om.Sha256sum, err))
+		} else {
+			r.seed = seed
+		}
+	}
+
+	return r, metadata.ChunksSize(om.Chunks) - r.offset, nil
+}
+
+// assembledReader reads the chunks of a delta object in order
+type assembledReader struct {
+	uh      *UpdateHub
+	ctx     context.Context
+	object  metadata.ObjectMetadata
+	seed    afero.File
+	limiter *utils.RateLimiter
+
+	index    int   // of the next chunk
+	offset   int64 // of the next chunk
+	chunk    io.ReadCloser
+	total    int64
+	fromSeed int64
+}
+
+func (r *assembledReader) Read(p []byte) (int, error) {
+	for {
+		if r.chunk != nil {
+			n, err := r.chunk.Read(p)
+			if err != io.EOF {
+				return n, err
+			}
+
+			r.chunk.Close()
+			r.chunk = nil
+
+			if n > 0 {
+				return n, nil
+			}
+		}
+
+		if r.index >= len(r.object.Chunks) {
+			return 0, io.EOF
+		}
+
+		chunk, err := r.openChunk(r.object.Chunks[r.index], r.offset)
+		if err != nil {
+			return 0, err
+		}
+
+		r.chunk = chunk
+		r.total += r.object.Chunks[r.index].Size
+		r.offset += r.object.Chunks[r.index].Size
+		r.index++
+	}
+}
+
+// openChunk returns the content of "chunk", which starts at "offset"
+func (r *assembledReader) openChunk(chunk metadata.Chunk, offset int64) (io.ReadCloser, error) {
+	if r.seed != nil {
+		data := make([]byte, chunk.Size)
+
+		n, _ := r.seed.ReadAt(data, offset)
+		if int64(n) == chunk.Size {
+			digest := sha256.Sum256(data)
+
+			if hex.EncodeToString(digest[:]) == chunk.Sha256sum {
+				r.fromSeed += chunk.Size
+				return ioutil.NopCloser(bytes.NewReader(data)), nil
+			}
+		}
+	}
+
+	body, _, err := r.uh.fetchObjectBody(r.ctx, path.Join(r.object.ChunkStore, chunk.Sha256sum), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.limiter.Reader(body), nil
+}
+
+func (r *assembledReader) Close() error {
+	if r.chunk != nil {
+		r.chunk.Close()
+	}
+
+	if r.total > 0 {
+		log.Info(fmt.Sprintf("%d of the %d bytes of the object '%s' assembled were taken from its seed", r.fromSeed, r.total, r.object.Sha256sum))
+	}
+
+	if r.seed != nil {
+		return r.seed.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/copy"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/updatermock"
+)
+
+// "test" split in "te" and "st", assembled from "/chunks" and the
+// seed "/dev/seed"
+const validJSONMetadataWithDelta = `{
+  "product-uid": "0123456789",
+  "objects": [
+    [
+      {
+        "mode": "test",
+        "sha256sum": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+        "chunk-store": "/chunks",
+        "seed": "/dev/seed",
+        "chunks": [
+          { "size": 2, "sha256sum": "2d6c9a90dd38f6852515274cde41a8cd8e7e1a7a053835334ec7e29f61b918dd" },
+          { "size": 2, "sha256sum": "56af4bde70a47ae7d0f1ebb30e45ed336165d5c9ec00ba9a92311e33a4256d74" }
+        ]
+      }
+    ]
+  ]
+}`
+
+func TestUpdateHubFetchUpdateAssemblesDeltaObject(t *testing.T) {
+	testCases := []struct {
+		name    string
+		seed    []byte
+		fetched []metadata.Chunk
+	}{
+		{
+			"WithSeed",
+			[]byte("teXX"),
+			testChunks[1:],
+		},
+		{
+			"WithMatchingSeed",
+			[]byte("test"),
+			nil,
+		},
+		{
+			"WithoutSeed",
+			nil,
+			testChunks,
+		},
+	}
+
+	chunkData := map[string]string{
+		testChunks[0].Sha256sum: "te",
+		testChunks[1].Sha256sum: "st",
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mode := newTestInstallMode()
+			defer mode.Unregister()
+
+			aim := &activeinactivemock.ActiveInactiveMock{}
+
+			uh, _ := newTestUpdateHub(&PollState{}, aim)
+			uh.CopyBackend = copy.ExtendedIO{}
+
+			if tc.seed != nil {
+				err := afero.WriteFile(uh.Store, "/dev/seed", tc.seed, 0644)
+				assert.NoError(t, err)
+			}
+
+			updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadataWithDelta))
+			assert.NoError(t, err)
+
+			um := &updatermock.UpdaterMock{}
+			for _, chunk := range tc.fetched {
+				data := chunkData[chunk.Sha256sum]
+				um.On("FetchUpdate", uh.API.Request(), path.Join("/chunks", chunk.Sha256sum), int64(0)).Return(ioutil.NopCloser(bytes.NewReader([]byte(data))), int64(len(data)), nil).Once()
+			}
+			uh.Updater = um
+
+			err = uh.FetchUpdate(context.Background(), updateMetadata)
+			assert.NoError(t, err)
+
+			objectUID := updateMetadata.Objects[0][0].GetObjectMetadata().Sha256sum
+
+			data, err := afero.ReadFile(uh.Store, path.Join(uh.settings.DownloadDir, objectUID))
+			assert.NoError(t, err)
+			assert.Equal(t, "test", string(data))
+
+			aim.AssertExpectations(t)
+			um.AssertExpectations(t)
+		})
+	}
+}
+
+func TestAssembleObjectFromOffset(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadataWithDelta))
+	assert.NoError(t, err)
+
+	err = afero.WriteFile(uh.Store, "/dev/seed", []byte("test"), 0644)
+	assert.NoError(t, err)
+
+	body, contentLength, err := uh.assembleObject(context.Background(), updateMetadata.Objects[0][0], 2, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), contentLength)
+
+	data, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, "st", string(data))
+	assert.NoError(t, body.Close())
+}
+
+func TestAssembleObjectWithEncryption(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	obj, err := metadata.NewObjectMetadata([]byte(`{
+	  "mode": "test",
+	  "sha256sum": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+	  "chunk-store": "/chunks",
+	  "chunks": [ { "size": 4, "sha256sum": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08" } ],
+	  "encryption": { "algorithm": "aes-256-gcm", "segment-size": 4 }
+	}`))
+	assert.NoError(t, err)
+
+	_, _, err = uh.assembleObject(context.Background(), obj, 0, nil)
+	assert.EqualError(t, err, "the encrypted objects can't be assembled from chunks")
+}
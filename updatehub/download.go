@@ -0,0 +1,697 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// partialDownloadSuffix is appended to an object path to create the
+// marker that flags an incomplete download
+const partialDownloadSuffix = ".partial"
+
+// downloadDigestSuffix is appended to an object path to create the
+// file which keeps the sha256sum calculated while it was downloaded
+const downloadDigestSuffix = ".sha256sum"
+
+// downloadDigest is the content of the download digest file. The size
+// tells whether the object was changed after it was downloaded.
+type downloadDigest struct {
+	Sha256sum string `json:"sha256sum"`
+	Size      int64  `json:"size"`
+}
+
+// DownloadProgress holds the aggregated progress of the objects being
+// downloaded
+type DownloadProgress struct {
+	TotalObjects      int   `json:"total-objects"`
+	DownloadedObjects int   `json:"downloaded-objects"`
+	DownloadedBytes   int64 `json:"downloaded-bytes"`
+}
+
+// DownloadProgress returns the progress of the current (or last) download
+func (uh *UpdateHub) DownloadProgress() DownloadProgress {
+	uh.downloadProgressMutex.Lock()
+	defer uh.downloadProgressMutex.Unlock()
+
+	return uh.downloadProgress
+}
+
+func (uh *UpdateHub) resetDownloadProgress(totalObjects int) {
+	uh.downloadProgressMutex.Lock()
+	defer uh.downloadProgressMutex.Unlock()
+
+	uh.downloadProgress = DownloadProgress{TotalObjects: totalObjects}
+}
+
+func (uh *UpdateHub) addDownloadedObject(size int64) {
+	uh.downloadProgressMutex.Lock()
+	defer uh.downloadProgressMutex.Unlock()
+
+	uh.downloadProgress.DownloadedObjects++
+	uh.downloadProgress.DownloadedBytes += size
+
+	uh.heartbeat.beat()
+}
+
+// objectURI returns the server path an object is downloaded from
+func (uh *UpdateHub) objectURI(packageUID string, objectUID string) string {
+	uri := "/"
+	uri = path.Join(uri, uh.FirmwareMetadata.ProductUID)
+	uri = path.Join(uri, packageUID)
+	uri = path.Join(uri, objectUID)
+
+	return uri
+}
+
+// objectsToDownload returns the "objects" that must be stored in the
+// download dir, which are all but the ones streamed during the
+// installation
+func (uh *UpdateHub) objectsToDownload(objects []metadata.Object) []metadata.Object {
+	list := []metadata.Object{}
+
+	for _, obj := range objects {
+		if _, streamed := uh.streamInstaller(obj); !streamed {
+			list = append(list, obj)
+		}
+	}
+
+	return list
+}
+
+// checkDownloadSpace verifies the download dir has room for the
+// objects of "updateMetadata" that will be downloaded, plus the
+// configured safety margin. The bytes already downloaded by a previous
+// attempt are discounted. Nothing is checked when the metadata doesn't
+// tell the object sizes.
+func (uh *UpdateHub) checkDownloadSpace(updateMetadata *metadata.UpdateMetadata) error {
+	known := false
+	for _, objects := range updateMetadata.Objects {
+		for _, obj := range objects {
+			if metadata.DownloadSize(obj) > 0 {
+				known = true
+			}
+		}
+	}
+
+	if !known {
+		return nil
+	}
+
+	indexToInstall, err := GetIndexOfObjectToBeInstalled(uh.activeInactiveBackend, updateMetadata)
+	if err != nil {
+		return err
+	}
+
+	var required int64
+
+	for _, obj := range uh.objectsToDownload(updateMetadata.Objects[indexToInstall]) {
+		size := metadata.DownloadSize(obj)
+
+		objectPath := path.Join(uh.settings.DownloadDir, obj.GetObjectMetadata().Sha256sum)
+		if info, err := uh.Store.Stat(objectPath); err == nil {
+			size -= info.Size()
+		}
+
+		if size > 0 {
+			required += size
+		}
+	}
+
+	required += uh.settings.DownloadSpaceMargin
+
+	available, err := utils.FreeSpace(uh.settings.DownloadDir)
+	if err != nil {
+		return err
+	}
+
+	if uint64(required) > available {
+		return fmt.Errorf("not enough space to download the update at '%s': %d bytes required, %d bytes available", uh.settings.DownloadDir, required, available)
+	}
+
+	return nil
+}
+
+func (uh *UpdateHub) fetchObjectsInParallel(ctx context.Context, packageUID string, objects []metadata.Object, workers int, limiter *utils.RateLimiter) error {
+	// the whole download fails once an object fails, so the other
+	// objects aren't worth downloading anymore
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan metadata.Object)
+	errs := make(chan error, len(objects))
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for obj := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+
+				err := uh.fetchObjectWithRetries(ctx, packageUID, obj, limiter)
+				if err != nil {
+					cancel()
+				}
+
+				errs <- err
+			}
+		}()
+	}
+
+feed:
+	for _, obj := range objects {
+		select {
+		case jobs <- obj:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	errorList := []error{}
+	for err := range errs {
+		if err != nil {
+			errorList = append(errorList, err)
+		}
+	}
+
+	return utils.MergeErrorList(errorList)
+}
+
+// fetchObjectWithRetries fetches "obj" up to the configured number of
+// attempts. Each new attempt resumes the download after an exponential
+// backoff with jitter. The errors that won't go away by trying again,
+// like a missing object or a local file error, aren't retried.
+func (uh *UpdateHub) fetchObjectWithRetries(ctx context.Context, packageUID string, obj metadata.Object, limiter *utils.RateLimiter) error {
+	attempts := uh.settings.DownloadMaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := uh.fetchObject(ctx, packageUID, obj, limiter)
+
+		// the request aborted by the cancellation isn't an error
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if err == nil || attempt >= attempts || !retryableDownloadError(err) {
+			if err != nil {
+				uh.recordObjectFailure(packageUID, obj)
+			}
+
+			return err
+		}
+
+		delay := uh.downloadRetryDelay(attempt)
+
+		log.Warn(fmt.Sprintf("failed to download object '%s' (attempt %d of %d), retrying in %s: %s",
+			obj.GetObjectMetadata().Sha256sum, attempt, attempts, delay, err))
+
+		// a download cancelled while waiting is resumed later
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-uh.clock().After(delay):
+		}
+	}
+}
+
+func retryableDownloadError(err error) bool {
+	if err == errDataCapReached {
+		return false
+	}
+
+	if _, ok := err.(*os.PathError); ok {
+		return false
+	}
+
+	return !client.IsPermanentError(err)
+}
+
+// downloadRetryDelay returns how long to wait before the attempt that
+// follows "attempt". The delay doubles on each attempt, up to the
+// configured maximum, and a random part of up to its half is taken
+// off so the devices don't retry in lockstep.
+func (uh *UpdateHub) downloadRetryDelay(attempt int) time.Duration {
+	delay := uh.settings.DownloadRetryInterval
+	max := uh.settings.DownloadMaxRetryInterval
+
+	for i := 1; i < attempt && (max <= 0 || delay < max); i++ {
+		delay *= 2
+	}
+
+	if max > 0 && delay > max {
+		delay = max
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// fetchObject downloads "obj" from the peers of the LAN serving it, or
+// else from the server. An object corrupted by a peer is downloaded
+// again from the server.
+func (uh *UpdateHub) fetchObject(ctx context.Context, packageUID string, obj metadata.Object, limiter *utils.RateLimiter) error {
+	err := uh.downloadObject(ctx, packageUID, obj, limiter, true)
+	if _, ok := err.(*corruptPeerObjectError); ok {
+		log.Warn(err)
+
+		return uh.downloadObject(ctx, packageUID, obj, limiter, false)
+	}
+
+	return err
+}
+
+func (uh *UpdateHub) downloadObject(ctx context.Context, packageUID string, obj metadata.Object, limiter *utils.RateLimiter, fromPeers bool) error {
+	objectUID := obj.GetObjectMetadata().Sha256sum
+
+	uri := uh.objectURI(packageUID, objectUID)
+
+	objectPath := path.Join(uh.settings.DownloadDir, objectUID)
+
+	// already downloaded before the agent was restarted
+	if uh.objectCompleted(UpdateHubStateDownloading, packageUID, objectUID) {
+		if info, err := uh.Store.Stat(objectPath); err == nil {
+			uh.addDownloadedObject(info.Size())
+			return nil
+		}
+	}
+
+	// a valid object left by a previous attempt isn't fetched again
+	if uh.reusableObject(objectUID) {
+		if info, err := uh.Store.Stat(objectPath); err == nil {
+			log.Info(fmt.Sprintf("reusing the object '%s' already downloaded", objectUID))
+
+			uh.addDownloadedObject(info.Size())
+
+			return uh.setObjectCompleted(UpdateHubStateDownloading, packageUID, objectUID)
+		}
+	}
+
+	digestPath := objectPath + downloadDigestSuffix
+
+	err := uh.Store.Remove(digestPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	decrypter, err := uh.objectDecrypter(obj)
+	if err != nil {
+		return err
+	}
+
+	wr, offset, err := uh.openDownloadTarget(objectPath)
+	if err != nil {
+		return err
+	}
+	defer wr.Close()
+
+	chunks := obj.GetObjectMetadata().Chunks
+
+	// an encrypted object is resumed from the start of a segment, so
+	// the part of the one it stopped at is downloaded again. So is a
+	// chunked object from the start of a chunk, so it can be checked.
+	if aligned := alignDownloadOffset(offset, decrypter, chunks); aligned != offset {
+		offset = aligned
+
+		err = wr.Truncate(offset)
+		if err != nil {
+			return err
+		}
+
+		_, err = wr.Seek(offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the object is hashed while it is written so it doesn't need to
+	// be read again to be checked. When the download is resumed only
+	// the part already downloaded is read.
+	var target io.Writer = wr
+
+	var verifier *chunkVerifier
+	if len(chunks) > 0 {
+		verifier = newChunkVerifier(wr, chunks, offset)
+		target = verifier
+	}
+
+	digest := &digestWriter{Writer: target, hash: sha256.New(), size: offset, heartbeat: &uh.heartbeat}
+
+	if offset > 0 {
+		err = uh.hashDownloadedPart(digest.hash, objectPath, offset)
+		if err != nil {
+			return err
+		}
+	}
+
+	fetchOffset := offset
+	if decrypter != nil {
+		fetchOffset = decrypter.ciphertextOffset(offset)
+	}
+
+	started := uh.clock().Now()
+
+	var body io.ReadCloser
+	var contentLength int64
+	var peer string
+
+	// a delta object is assembled from its chunks, only the ones not
+	// found at the seed are downloaded
+	if obj.GetObjectMetadata().ChunkStore != "" {
+		body, contentLength, err = uh.assembleObject(ctx, obj, offset, limiter)
+	} else {
+		// the peers of the LAN are tried before the server, their
+		// transfers aren't throttled nor accounted as data usage
+		if fromPeers {
+			body, contentLength, peer, err = uh.fetchObjectFromPeers(obj, offset)
+		}
+		if !fromPeers || err != nil {
+			body, contentLength, err = uh.fetchObjectBody(ctx, uri, fetchOffset)
+			if err == nil {
+				body = limiter.Reader(body)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if decrypter != nil {
+		body = decrypter.reader(body, offset)
+	}
+
+	defer body.Close()
+
+	cancel, release := cancelChannel(ctx)
+	defer release()
+
+	cancelled, err := uh.CopyBackend.Copy(digest, body, uh.settings.DownloadStallTimeout, cancel, utils.ChunkSize, 0, -1, false)
+	if err != nil && ctx.Err() == nil {
+		// only the bad chunk and the following ones are downloaded
+		// again by the next attempt
+		if ce, ok := err.(*chunkError); ok {
+			if terr := wr.Truncate(ce.offset); terr != nil {
+				return terr
+			}
+
+			if peer != "" {
+				uh.dropPeer(peer)
+				return &corruptPeerObjectError{peer: peer, objectUID: objectUID}
+			}
+		}
+
+		return err
+	}
+
+	// a cancelled download keeps its marker so it can be resumed later
+	if cancelled || ctx.Err() != nil {
+		return nil
+	}
+
+	// the peers aren't trusted, what they served is checked before it
+	// is kept. As the bad part is unknown the object is downloaded
+	// again from its start.
+	if peer != "" && hex.EncodeToString(digest.hash.Sum(nil)) != objectUID {
+		uh.dropPeer(peer)
+
+		if err = wr.Truncate(0); err != nil {
+			return err
+		}
+
+		return &corruptPeerObjectError{peer: peer, objectUID: objectUID}
+	}
+
+	if verifier != nil {
+		err = verifier.complete()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = uh.writeDownloadDigest(digestPath, digest)
+	if err != nil {
+		return err
+	}
+
+	err = uh.Store.Remove(objectPath + partialDownloadSuffix)
+	if err != nil {
+		return err
+	}
+
+	// the content length is the one of the ciphertext, and it's
+	// unknown when the object was transferred compressed
+	if decrypter != nil || contentLength < 0 {
+		contentLength = digest.size - offset
+	}
+
+	uh.recordObjectDownload(packageUID, obj, digest.size-offset, uh.clock().Now().Sub(started))
+
+	uh.addDownloadedObject(offset + contentLength)
+
+	return uh.setObjectCompleted(UpdateHubStateDownloading, packageUID, objectUID)
+}
+
+// fetchObjectBody requests the object at "uri" from "offset". The
+// server is given up on when it doesn't answer in
+// "DownloadStallTimeout", so the object can be retried instead of
+// waiting forever on a dead connection. A late answer is discarded.
+// The body read is accounted to the data usage. The request is
+// aborted once "ctx" is cancelled.
+func (uh *UpdateHub) fetchObjectBody(ctx context.Context, uri string, offset int64) (io.ReadCloser, int64, error) {
+	type response struct {
+		body          io.ReadCloser
+		contentLength int64
+		err           error
+	}
+
+	responses := make(chan response, 1)
+
+	go func() {
+		body, contentLength, err := uh.updater().FetchUpdate(ctx, uh.API.Request(), uri, offset)
+		responses <- response{body, contentLength, err}
+	}()
+
+	discardResponse := func() {
+		if r := <-responses; r.err == nil && r.body != nil {
+			r.body.Close()
+		}
+	}
+
+	timer := time.NewTimer(uh.settings.DownloadStallTimeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-responses:
+		if r.err != nil {
+			return nil, -1, r.err
+		}
+
+		return uh.meterDownload(r.body), r.contentLength, nil
+	case <-ctx.Done():
+		go discardResponse()
+
+		return nil, -1, ctx.Err()
+	case <-timer.C:
+		go discardResponse()
+
+		return nil, -1, fmt.Errorf("no answer from the server in %s", uh.settings.DownloadStallTimeout)
+	}
+}
+
+// cancelChannel returns a channel which receives a value once "ctx"
+// is cancelled, for the copy backend. The "release" function must be
+// called once the channel isn't used anymore. It's nil if "ctx" is
+// never cancelled.
+func cancelChannel(ctx context.Context) (<-chan bool, func()) {
+	if ctx.Done() == nil {
+		return nil, func() {}
+	}
+
+	cancel := make(chan bool, 1)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel <- true
+		case <-done:
+		}
+	}()
+
+	return cancel, func() { close(done) }
+}
+
+// digestWriter hashes and counts the data written to the object being
+// downloaded
+type digestWriter struct {
+	io.Writer
+
+	hash      hash.Hash
+	size      int64
+	heartbeat *heartbeat // beats as the object is written, if set
+}
+
+func (w *digestWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+
+	if n > 0 && w.heartbeat != nil {
+		w.heartbeat.beat()
+	}
+
+	return n, err
+}
+
+func (uh *UpdateHub) hashDownloadedPart(digest hash.Hash, objectPath string, size int64) error {
+	file, err := uh.Store.Open(objectPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.CopyN(digest, file, size)
+
+	return err
+}
+
+func (uh *UpdateHub) writeDownloadDigest(digestPath string, digest *digestWriter) error {
+	data, err := json.Marshal(downloadDigest{
+		Sha256sum: hex.EncodeToString(digest.hash.Sum(nil)),
+		Size:      digest.size,
+	})
+	if err != nil {
+		return err
+	}
+
+	return afero.WriteFile(uh.Store, digestPath, data, 0644)
+}
+
+// readDownloadDigest returns the sha256sum calculated while the object
+// at "objectPath" was downloaded. It fails when there isn't one or
+// the object size changed since then.
+func readDownloadDigest(fsBackend afero.Fs, objectPath string) (string, error) {
+	data, err := afero.ReadFile(fsBackend, objectPath+downloadDigestSuffix)
+	if err != nil {
+		return "", err
+	}
+
+	var digest downloadDigest
+
+	err = json.Unmarshal(data, &digest)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := fsBackend.Stat(objectPath)
+	if err != nil {
+		return "", err
+	}
+
+	if info.Size() != digest.Size {
+		return "", fmt.Errorf("the size of '%s' changed after it was downloaded", objectPath)
+	}
+
+	return digest.Sha256sum, nil
+}
+
+// sha256Checker returns the Sha256Checker of the downloaded objects.
+// The digests written by the unprivileged fetcher aren't trusted by
+// the privileged half of the agent, which reads the objects again.
+func (uh *UpdateHub) sha256Checker() *Sha256CheckerImpl {
+	_, separated := uh.Controller.(*FetcherController)
+
+	return &Sha256CheckerImpl{Paranoid: uh.settings.ParanoidSha256Check || separated}
+}
+
+// reusableObject tells whether the object "objectUID" is already
+// fully downloaded and matches its sha256sum
+func (uh *UpdateHub) reusableObject(objectUID string) bool {
+	objectPath := path.Join(uh.settings.DownloadDir, objectUID)
+
+	if _, err := uh.Store.Stat(objectPath + partialDownloadSuffix); err == nil {
+		return false
+	}
+
+	if _, err := uh.Store.Stat(objectPath); err != nil {
+		return false
+	}
+
+	return uh.sha256Checker().CheckDownloadedObjectSha256sum(uh.Store, uh.settings.DownloadDir, objectUID) == nil
+}
+
+// openDownloadTarget opens the file which an object will be
+// downloaded into. If a partial download marker is found, the
+// existing file is reused and the returned offset is where the
+// download must be resumed from. Otherwise a new marker is written and
+// the file is truncated.
+func (uh *UpdateHub) openDownloadTarget(objectPath string) (afero.File, int64, error) {
+	markerPath := objectPath + partialDownloadSuffix
+
+	if _, err := uh.Store.Stat(markerPath); err == nil {
+		file, err := uh.Store.OpenFile(objectPath, os.O_WRONLY|os.O_CREATE, 0666)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		offset, err := file.Seek(0, io.SeekEnd)
+		if err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+
+		return file, offset, nil
+	}
+
+	marker, err := uh.Store.Create(markerPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	marker.Close()
+
+	file, err := uh.Store.Create(objectPath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return file, 0, nil
+}
@@ -0,0 +1,696 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/bouk/monkey"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/copy"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/updatermock"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+func TestUpdateHubFetchUpdateInParallel(t *testing.T) {
+	mode := newTestInstallMode()
+
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	aim.On("Active").Return(1, nil)
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.CopyBackend = copy.ExtendedIO{}
+	uh.settings.DownloadConcurrency = 4
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validUpdateMetadataWithActiveInactive))
+	assert.NoError(t, err)
+
+	packageUID := utils.DataSha256sum([]byte(validUpdateMetadataWithActiveInactive))
+
+	um := &updatermock.UpdaterMock{}
+
+	contents := map[string][]byte{}
+
+	for i, obj := range updateMetadata.Objects[0] {
+		objectUID := obj.GetObjectMetadata().Sha256sum
+		content := []byte{byte('a' + i)}
+		contents[objectUID] = content
+
+		uri := path.Join("/", uh.FirmwareMetadata.ProductUID, packageUID, objectUID)
+		um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(ioutil.NopCloser(bytes.NewReader(content)), int64(len(content)), nil)
+	}
+
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.NoError(t, err)
+
+	for objectUID, content := range contents {
+		data, err := afero.ReadFile(uh.Store, path.Join(uh.settings.DownloadDir, objectUID))
+		assert.NoError(t, err)
+		assert.Equal(t, content, data)
+	}
+
+	assert.Equal(t, DownloadProgress{TotalObjects: 2, DownloadedObjects: 2, DownloadedBytes: 2}, uh.DownloadProgress())
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestUpdateHubFetchUpdateInParallelWithCancel(t *testing.T) {
+	mode := newTestInstallMode()
+
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	aim.On("Active").Return(1, nil)
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.CopyBackend = copy.ExtendedIO{}
+	uh.settings.DownloadConcurrency = 2
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validUpdateMetadataWithActiveInactive))
+	assert.NoError(t, err)
+
+	packageUID := utils.DataSha256sum([]byte(validUpdateMetadataWithActiveInactive))
+
+	um := &updatermock.UpdaterMock{}
+
+	started := make(chan bool, 2)
+
+	for _, obj := range updateMetadata.Objects[0] {
+		objectUID := obj.GetObjectMetadata().Sha256sum
+
+		// never written, so the download blocks until it is cancelled
+		rd, wr := io.Pipe()
+		defer wr.Close()
+
+		uri := path.Join("/", uh.FirmwareMetadata.ProductUID, packageUID, objectUID)
+		um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(rd, int64(-1), nil).Run(func(args mock.Arguments) {
+			started <- true
+		})
+	}
+
+	uh.Updater = um
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		<-started
+		<-started
+		cancel()
+	}()
+
+	err = uh.FetchUpdate(ctx, updateMetadata)
+	assert.NoError(t, err)
+
+	for _, obj := range updateMetadata.Objects[0] {
+		markerPath := path.Join(uh.settings.DownloadDir, obj.GetObjectMetadata().Sha256sum+partialDownloadSuffix)
+
+		exists, err := afero.Exists(uh.Store, markerPath)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	}
+
+	assert.Equal(t, 0, uh.DownloadProgress().DownloadedObjects)
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestUpdateHubFetchUpdateInParallelWithPermanentError(t *testing.T) {
+	mode := newTestInstallMode()
+
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	aim.On("Active").Return(1, nil)
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.CopyBackend = copy.ExtendedIO{}
+	uh.settings.DownloadConcurrency = 2
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validUpdateMetadataWithActiveInactive))
+	assert.NoError(t, err)
+
+	packageUID := utils.DataSha256sum([]byte(validUpdateMetadataWithActiveInactive))
+
+	notFound := &client.StatusError{StatusCode: 404}
+
+	um := &updatermock.UpdaterMock{}
+
+	started := make(chan bool, 1)
+
+	objects := updateMetadata.Objects[0]
+
+	// never written, so the download blocks until it is cancelled
+	rd, wr := io.Pipe()
+	defer wr.Close()
+
+	blockedUID := objects[0].GetObjectMetadata().Sha256sum
+	uri := path.Join("/", uh.FirmwareMetadata.ProductUID, packageUID, blockedUID)
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(rd, int64(-1), nil).Run(func(args mock.Arguments) {
+		started <- true
+	})
+
+	// fails only once the other download is in progress
+	failingUID := objects[1].GetObjectMetadata().Sha256sum
+	uri = path.Join("/", uh.FirmwareMetadata.ProductUID, packageUID, failingUID)
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(ioutil.NopCloser(bytes.NewReader(nil)), int64(-1), notFound).Run(func(args mock.Arguments) {
+		<-started
+	}).Once()
+
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.Equal(t, notFound, err)
+
+	assert.Equal(t, 0, uh.DownloadProgress().DownloadedObjects)
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestUpdateHubFetchUpdateWithMaxDownloadRate(t *testing.T) {
+	mode := newTestInstallMode()
+
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	aim.On("Active").Return(1, nil)
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.CopyBackend = copy.ExtendedIO{}
+	uh.settings.DownloadConcurrency = 2
+	uh.settings.MaxDownloadRate = 10000
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validUpdateMetadataWithActiveInactive))
+	assert.NoError(t, err)
+
+	packageUID := utils.DataSha256sum([]byte(validUpdateMetadataWithActiveInactive))
+
+	um := &updatermock.UpdaterMock{}
+
+	content := bytes.Repeat([]byte("a"), 1000)
+
+	for _, obj := range updateMetadata.Objects[0] {
+		uri := path.Join("/", uh.FirmwareMetadata.ProductUID, packageUID, obj.GetObjectMetadata().Sha256sum)
+		um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(ioutil.NopCloser(bytes.NewReader(content)), int64(len(content)), nil)
+	}
+
+	uh.Updater = um
+
+	start := time.Now()
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.NoError(t, err)
+
+	// 2000 bytes at 10000 bytes/s, even when downloaded in parallel
+	assert.True(t, time.Since(start) >= 200*time.Millisecond)
+	assert.Equal(t, DownloadProgress{TotalObjects: 2, DownloadedObjects: 2, DownloadedBytes: 2000}, uh.DownloadProgress())
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+const validJSONMetadataWithSizes = `{
+  "product-uid": "0123456789",
+  "objects": [
+    [
+      { "mode": "test", "sha256sum": "a", "size": 1000 },
+      { "mode": "test", "sha256sum": "b", "size": 3000 }
+    ]
+  ]
+}`
+
+func TestCheckDownloadSpace(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.settings.DownloadSpaceMargin = 500
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadataWithSizes))
+	assert.NoError(t, err)
+
+	var available uint64
+	var checkedPath string
+
+	guard := monkey.Patch(utils.FreeSpace, func(path string) (uint64, error) {
+		checkedPath = path
+		return available, nil
+	})
+	defer guard.Unpatch()
+
+	available = 4500
+	assert.NoError(t, uh.checkDownloadSpace(updateMetadata))
+	assert.Equal(t, uh.settings.DownloadDir, checkedPath)
+
+	available = 4499
+	err = uh.checkDownloadSpace(updateMetadata)
+	assert.EqualError(t, err, "not enough space to download the update at '/tmp': 4500 bytes required, 4499 bytes available")
+
+	// the bytes downloaded by a previous attempt are discounted
+	err = afero.WriteFile(uh.Store, path.Join(uh.settings.DownloadDir, "b"), make([]byte, 1000), 0644)
+	assert.NoError(t, err)
+	assert.NoError(t, uh.checkDownloadSpace(updateMetadata))
+
+	aim.AssertExpectations(t)
+}
+
+func TestCheckDownloadSpaceWithoutSizes(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	guard := monkey.Patch(utils.FreeSpace, func(path string) (uint64, error) {
+		return 0, nil
+	})
+	defer guard.Unpatch()
+
+	assert.NoError(t, uh.checkDownloadSpace(updateMetadata))
+
+	aim.AssertExpectations(t)
+}
+
+func TestDownloadingStateWithoutEnoughSpace(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadataWithSizes))
+	assert.NoError(t, err)
+
+	uh, _ := newTestUpdateHub(NewDownloadingState(updateMetadata), aim)
+
+	// it must fail before trying to download
+	uh.Controller = &testController{fetchUpdateError: errors.New("not expected")}
+
+	guard := monkey.Patch(utils.FreeSpace, func(path string) (uint64, error) {
+		return 100, nil
+	})
+	defer guard.Unpatch()
+
+	next, _ := uh.State.Handle(uh)
+	assert.IsType(t, &ErrorState{}, next)
+
+	cause := next.(*ErrorState).cause
+	assert.False(t, cause.IsFatal())
+	assert.Contains(t, cause.Error(), "not enough space to download the update")
+
+	aim.AssertExpectations(t)
+}
+
+func TestUpdateHubFetchUpdateWritesDownloadDigest(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.CopyBackend = copy.ExtendedIO{}
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	// "test", resumed after the first half was downloaded
+	objectUID := updateMetadata.Objects[0][0].GetObjectMetadata().Sha256sum
+	objectPath := path.Join(uh.settings.DownloadDir, objectUID)
+
+	err = afero.WriteFile(uh.Store, objectPath, []byte("te"), 0644)
+	assert.NoError(t, err)
+	err = afero.WriteFile(uh.Store, objectPath+partialDownloadSuffix, nil, 0644)
+	assert.NoError(t, err)
+
+	// a stale digest must not be kept
+	err = afero.WriteFile(uh.Store, objectPath+downloadDigestSuffix, []byte("stale"), 0644)
+	assert.NoError(t, err)
+
+	uri := path.Join("/", uh.FirmwareMetadata.ProductUID, updateMetadata.PackageUID(), objectUID)
+
+	um := &updatermock.UpdaterMock{}
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(2)).Return(ioutil.NopCloser(bytes.NewReader([]byte("st"))), int64(2), nil)
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.NoError(t, err)
+
+	digest, err := readDownloadDigest(uh.Store, objectPath)
+	assert.NoError(t, err)
+	assert.Equal(t, objectUID, digest)
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestUpdateHubFetchUpdateReusesDownloadedObject(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.CopyBackend = copy.ExtendedIO{}
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	objectUID := updateMetadata.Objects[0][0].GetObjectMetadata().Sha256sum
+	objectPath := path.Join(uh.settings.DownloadDir, objectUID)
+
+	err = afero.WriteFile(uh.Store, objectPath, []byte("test"), 0644)
+	assert.NoError(t, err)
+
+	// it must not be fetched
+	um := &updatermock.UpdaterMock{}
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.NoError(t, err)
+
+	assert.Equal(t, DownloadProgress{TotalObjects: 1, DownloadedObjects: 1, DownloadedBytes: 4}, uh.DownloadProgress())
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestUpdateHubFetchUpdateWithInvalidDownloadedObject(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.CopyBackend = copy.ExtendedIO{}
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	objectUID := updateMetadata.Objects[0][0].GetObjectMetadata().Sha256sum
+	objectPath := path.Join(uh.settings.DownloadDir, objectUID)
+
+	err = afero.WriteFile(uh.Store, objectPath, []byte("tset"), 0644)
+	assert.NoError(t, err)
+
+	uri := path.Join("/", uh.FirmwareMetadata.ProductUID, updateMetadata.PackageUID(), objectUID)
+
+	um := &updatermock.UpdaterMock{}
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(ioutil.NopCloser(bytes.NewReader([]byte("test"))), int64(4), nil).Once()
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.NoError(t, err)
+
+	data, err := afero.ReadFile(uh.Store, objectPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", string(data))
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestUpdateHubFetchUpdateCancelledWithoutDownloadDigest(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.CopyBackend = copy.ExtendedIO{}
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	objectUID := updateMetadata.Objects[0][0].GetObjectMetadata().Sha256sum
+	uri := path.Join("/", uh.FirmwareMetadata.ProductUID, updateMetadata.PackageUID(), objectUID)
+
+	// never written, so the download blocks until it is cancelled
+	rd, wr := io.Pipe()
+	defer wr.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	um := &updatermock.UpdaterMock{}
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(rd, int64(-1), nil).Run(func(args mock.Arguments) {
+		cancel()
+	})
+	uh.Updater = um
+
+	err = uh.FetchUpdate(ctx, updateMetadata)
+	assert.NoError(t, err)
+
+	exists, err := afero.Exists(uh.Store, path.Join(uh.settings.DownloadDir, objectUID+downloadDigestSuffix))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+// failingReader fails as a dropped connection would
+type failingReader struct{}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestUpdateHubFetchUpdateWithRetries(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.CopyBackend = copy.ExtendedIO{}
+	uh.settings.DownloadMaxAttempts = 3
+	uh.settings.DownloadRetryInterval = time.Millisecond
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	objectUID := updateMetadata.Objects[0][0].GetObjectMetadata().Sha256sum
+	uri := path.Join("/", uh.FirmwareMetadata.ProductUID, updateMetadata.PackageUID(), objectUID)
+
+	// the connection drops after "te" and the download is resumed
+	um := &updatermock.UpdaterMock{}
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(ioutil.NopCloser(io.MultiReader(bytes.NewReader([]byte("te")), &failingReader{})), int64(4), nil).Once()
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(2)).Return(ioutil.NopCloser(bytes.NewReader(nil)), int64(-1), errors.New("fetch update request failed")).Once()
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(2)).Return(ioutil.NopCloser(bytes.NewReader([]byte("st"))), int64(2), nil).Once()
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.NoError(t, err)
+
+	data, err := afero.ReadFile(uh.Store, path.Join(uh.settings.DownloadDir, objectUID))
+	assert.NoError(t, err)
+	assert.Equal(t, "test", string(data))
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestUpdateHubFetchUpdateWithPermanentError(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.settings.DownloadMaxAttempts = 3
+	uh.settings.DownloadRetryInterval = time.Millisecond
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	objectUID := updateMetadata.Objects[0][0].GetObjectMetadata().Sha256sum
+	uri := path.Join("/", uh.FirmwareMetadata.ProductUID, updateMetadata.PackageUID(), objectUID)
+
+	notFound := &client.StatusError{StatusCode: 404}
+
+	um := &updatermock.UpdaterMock{}
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(ioutil.NopCloser(bytes.NewReader(nil)), int64(-1), notFound).Once()
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.Equal(t, notFound, err)
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestUpdateHubFetchUpdateCancelledWhileWaitingToRetry(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.settings.DownloadMaxAttempts = 3
+	uh.settings.DownloadRetryInterval = time.Hour
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	objectUID := updateMetadata.Objects[0][0].GetObjectMetadata().Sha256sum
+	uri := path.Join("/", uh.FirmwareMetadata.ProductUID, updateMetadata.PackageUID(), objectUID)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	um := &updatermock.UpdaterMock{}
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(ioutil.NopCloser(bytes.NewReader(nil)), int64(-1), errors.New("fetch update request failed")).Once().Run(func(args mock.Arguments) {
+		cancel()
+	})
+	uh.Updater = um
+
+	err = uh.FetchUpdate(ctx, updateMetadata)
+	assert.NoError(t, err)
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestUpdateHubFetchUpdateWithStalledDownload(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.CopyBackend = copy.ExtendedIO{}
+	uh.settings.DownloadMaxAttempts = 3
+	uh.settings.DownloadRetryInterval = time.Millisecond
+	uh.settings.DownloadStallTimeout = 10 * time.Millisecond
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	objectUID := updateMetadata.Objects[0][0].GetObjectMetadata().Sha256sum
+	uri := path.Join("/", uh.FirmwareMetadata.ProductUID, updateMetadata.PackageUID(), objectUID)
+
+	// the server doesn't answer the first request and stops sending
+	// data after "te" on the second one
+	answer := make(chan bool)
+	defer close(answer)
+
+	rd, wr := io.Pipe()
+	defer wr.Close()
+
+	go wr.Write([]byte("te"))
+
+	um := &updatermock.UpdaterMock{}
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(ioutil.NopCloser(bytes.NewReader(nil)), int64(-1), nil).Once().Run(func(args mock.Arguments) {
+		<-answer
+	})
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(rd, int64(4), nil).Once()
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(2)).Return(ioutil.NopCloser(bytes.NewReader([]byte("st"))), int64(2), nil).Once()
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.NoError(t, err)
+
+	data, err := afero.ReadFile(uh.Store, path.Join(uh.settings.DownloadDir, objectUID))
+	assert.NoError(t, err)
+	assert.Equal(t, "test", string(data))
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestUpdateHubFetchUpdateWithDownloadTimeout(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.CopyBackend = copy.ExtendedIO{}
+	uh.settings.DownloadTimeout = 10 * time.Millisecond
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	objectUID := updateMetadata.Objects[0][0].GetObjectMetadata().Sha256sum
+	uri := path.Join("/", uh.FirmwareMetadata.ProductUID, updateMetadata.PackageUID(), objectUID)
+
+	// never written, so the download never finishes
+	rd, wr := io.Pipe()
+	defer wr.Close()
+
+	um := &updatermock.UpdaterMock{}
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(rd, int64(4), nil).Once()
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.EqualError(t, err, "the download didn't finish in 10ms")
+
+	// kept to be resumed by the next attempt
+	exists, err := afero.Exists(uh.Store, path.Join(uh.settings.DownloadDir, objectUID+partialDownloadSuffix))
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestDownloadRetryDelay(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.settings.DownloadRetryInterval = time.Second
+	uh.settings.DownloadMaxRetryInterval = 10 * time.Second
+
+	testCases := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+
+	for _, tc := range testCases {
+		for i := 0; i < 10; i++ {
+			delay := uh.downloadRetryDelay(tc.attempt)
+			assert.True(t, delay <= tc.max, "attempt %d: %s", tc.attempt, delay)
+			assert.True(t, delay >= tc.max/2, "attempt %d: %s", tc.attempt, delay)
+		}
+	}
+
+	uh.settings.DownloadRetryInterval = 0
+	assert.Equal(t, time.Duration(0), uh.downloadRetryDelay(3))
+
+	aim.AssertExpectations(t)
+}
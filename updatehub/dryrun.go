@@ -0,0 +1,49 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+
+	"github.com/UpdateHub/updatehub/installifdifferent"
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+// isSimulatedState tells whether "state" is only simulated by a dry
+// run, which checks for and downloads the updates but never installs
+// them
+func isSimulatedState(state UpdateHubState) bool {
+	return state == UpdateHubStateInstalling || state == UpdateHubStateInstalled
+}
+
+// simulateObjectInstall logs what the installation of "o" would do,
+// without running its handler. Whether it's installed is still decided
+// by "iid", as it only reads the target.
+func (uh *UpdateHub) simulateObjectInstall(o metadata.Object, iid installifdifferent.Interface) error {
+	objectUID := o.GetObjectMetadata().Sha256sum
+
+	install, err := iid.Proceed(o)
+	if err != nil {
+		return err
+	}
+
+	if install {
+		log.Info(fmt.Sprintf("dry run: object '%s' would be installed with mode '%s'", objectUID, o.GetObjectMetadata().Mode))
+	} else {
+		log.Info(fmt.Sprintf("dry run: object '%s' would be skipped since it's already installed", objectUID))
+	}
+
+	return nil
+}
+
+// simulateSetActive logs the installation set which would be set as
+// active
+func (uh *UpdateHub) simulateSetActive(index int) {
+	log.Info(fmt.Sprintf("dry run: installation set %d would be set as active", index))
+}
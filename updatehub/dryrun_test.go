@@ -0,0 +1,175 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/installifdifferentmock"
+	"github.com/UpdateHub/updatehub/testsmocks/objectmock"
+	"github.com/UpdateHub/updatehub/testsmocks/statesmock"
+)
+
+type simulatedReporter struct {
+	recordingReporter
+}
+
+func (r *simulatedReporter) ReportSimulatedState(api client.ApiRequester, packageUID string, state string) error {
+	r.reports = append(r.reports, fmt.Sprintf("%s:%s:simulated", packageUID, state))
+	return nil
+}
+
+func TestStateInstallingWithDryRun(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+
+	om := &objectmock.ObjectMock{}
+
+	mode := installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "test",
+		CheckRequirements: func() error { return nil },
+		GetObject:         func() interface{} { return om },
+	})
+	defer mode.Unregister()
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadataWithActiveInactive))
+	assert.NoError(t, err)
+
+	// no SetActive is expected
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	aim.On("Active").Return(1, nil)
+
+	scm := &statesmock.Sha256CheckerMock{}
+
+	iidm := &installifdifferentmock.InstallIfDifferentMock{}
+	iidm.On("Proceed", om).Return(true, nil)
+
+	s := NewInstallingState(m, scm, memFs, iidm, &metadata.FirmwareMetadata{})
+
+	uh, err := newTestUpdateHub(s, aim)
+	assert.NoError(t, err)
+
+	uh.DryRun = true
+	uh.RuntimeSettingsPath = "/runtime.conf"
+
+	// "expectedSha256sum" got from "validJSONMetadataWithActiveInactive" content
+	expectedSha256sum := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	scm.On("CheckDownloadedObjectSha256sum", memFs, uh.settings.DownloadDir, expectedSha256sum).Return(nil)
+
+	// no Setup, Install or Cleanup is expected
+	nextState, _ := s.Handle(uh)
+	assert.Equal(t, NewInstalledState(m), nextState)
+
+	assert.Equal(t, 1, uh.InstallProgress().InstalledObjects)
+
+	// nothing is left to be validated and it can be done again
+	assert.Equal(t, PersistentUpdateSettings{}, uh.settings.PersistentUpdateSettings)
+	assert.Equal(t, "", uh.lastInstalledPackageUID)
+
+	exists, err := afero.Exists(uh.Store, uh.RuntimeSettingsPath)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	aim.AssertExpectations(t)
+	om.AssertExpectations(t)
+	scm.AssertExpectations(t)
+	iidm.AssertExpectations(t)
+}
+
+func TestStateInstallingWithDryRunAndInstallIfDifferentError(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+
+	om := &objectmock.ObjectMock{}
+
+	mode := installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "test",
+		CheckRequirements: func() error { return nil },
+		GetObject:         func() interface{} { return om },
+	})
+	defer mode.Unregister()
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	scm := &statesmock.Sha256CheckerMock{}
+
+	iidm := &installifdifferentmock.InstallIfDifferentMock{}
+	iidm.On("Proceed", om).Return(false, fmt.Errorf("probe error"))
+
+	s := NewInstallingState(m, scm, memFs, iidm, &metadata.FirmwareMetadata{})
+
+	uh, err := newTestUpdateHub(s, nil)
+	assert.NoError(t, err)
+
+	uh.DryRun = true
+
+	scm.On("CheckDownloadedObjectSha256sum", memFs, uh.settings.DownloadDir, m.Objects[0][0].GetObjectMetadata().Sha256sum).Return(nil)
+
+	nextState, _ := s.Handle(uh)
+	assert.Equal(t, NewErrorState(m, NewTransientError(fmt.Errorf("probe error"))), nextState)
+
+	om.AssertExpectations(t)
+	scm.AssertExpectations(t)
+	iidm.AssertExpectations(t)
+}
+
+func TestStateInstalledWithDryRun(t *testing.T) {
+	m := &metadata.UpdateMetadata{}
+	s := NewInstalledState(m)
+
+	uh, err := newTestUpdateHub(s, nil)
+	assert.NoError(t, err)
+
+	uh.DryRun = true
+
+	nextState, _ := s.Handle(uh)
+	assert.IsType(t, &IdleState{}, nextState)
+}
+
+func TestReportCurrentStateWithDryRun(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	m, err := metadata.NewUpdateMetadata([]byte(validUpdateMetadata))
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name           string
+		state          State
+		dryRun         bool
+		expectedReport string
+	}{
+		{"Downloading", NewDownloadingState(m), true, m.PackageUID() + ":downloading"},
+		{"Installing", NewInstallingState(m, nil, nil, nil, nil), true, m.PackageUID() + ":installing:simulated"},
+		{"Installed", NewInstalledState(m), true, m.PackageUID() + ":installed:simulated"},
+		{"InstalledWithoutDryRun", NewInstalledState(m), false, m.PackageUID() + ":installed"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			uh, err := newTestUpdateHub(tc.state, nil)
+			assert.NoError(t, err)
+
+			reporter := &simulatedReporter{}
+
+			uh.Reporter = reporter
+			uh.DryRun = tc.dryRun
+
+			assert.NoError(t, uh.ReportCurrentState())
+			assert.Equal(t, []string{tc.expectedReport}, reporter.reports)
+		})
+	}
+}
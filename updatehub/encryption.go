@@ -0,0 +1,235 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// EncryptionAlgorithmAESGCM is the only algorithm the objects can be
+// encrypted with, as described by metadata.Encryption
+const EncryptionAlgorithmAESGCM = "aes-gcm"
+
+// objectDecrypter decrypts the segments of an encrypted object
+type objectDecrypter struct {
+	aead        cipher.AEAD
+	nonce       []byte
+	segmentSize int64
+}
+
+// objectDecrypter returns the decrypter of "o", or nil if it isn't
+// encrypted. The content key is unwrapped by the key provider command
+// or, if there is none, by the device key.
+func (uh *UpdateHub) objectDecrypter(o metadata.Object) (*objectDecrypter, error) {
+	encryption := o.GetObjectMetadata().Encryption
+	if encryption == nil {
+		return nil, nil
+	}
+
+	objectUID := o.GetObjectMetadata().Sha256sum
+
+	if encryption.Algorithm != EncryptionAlgorithmAESGCM {
+		return nil, fmt.Errorf("the object '%s' is encrypted with the unsupported algorithm '%s'", objectUID, encryption.Algorithm)
+	}
+
+	if len(encryption.Nonce) != 8 || encryption.SegmentSize <= 0 {
+		return nil, fmt.Errorf("invalid encryption of the object '%s'", objectUID)
+	}
+
+	key, err := uh.unwrapContentKey(objectUID, encryption.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content key of the object '%s': %s", objectUID, err)
+	}
+
+	return &objectDecrypter{aead: aead, nonce: encryption.Nonce, segmentSize: encryption.SegmentSize}, nil
+}
+
+// unwrapContentKey runs the key provider command as:
+//
+//	<key-provider> <object-uid>
+//
+// with the base64 encoded "wrappedKey" at its standard input, and it
+// must output the base64 encoded content key. Without a key provider,
+// the device key is used to unwrap it instead.
+func (uh *UpdateHub) unwrapContentKey(objectUID string, wrappedKey []byte) ([]byte, error) {
+	if provider := uh.settings.EncryptionKeyProvider; provider != "" {
+		var executer utils.CmdLineExecuter = uh.CmdLineExecuter
+		if executer == nil {
+			executer = &utils.CmdLine{}
+		}
+
+		stdin := strings.NewReader(base64.StdEncoding.EncodeToString(wrappedKey) + "\n")
+
+		output, err := executer.ExecuteWithStdin(fmt.Sprintf("'%s' %s", provider, objectUID), stdin)
+		if err != nil {
+			return nil, fmt.Errorf("the key provider failed to unwrap the key of the object '%s': %s", objectUID, err)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(output)))
+		if err != nil {
+			return nil, fmt.Errorf("the key provider output of the object '%s' isn't base64 encoded", objectUID)
+		}
+
+		return key, nil
+	}
+
+	if uh.settings.EncryptionDeviceKeyPath == "" {
+		return nil, fmt.Errorf("the object '%s' is encrypted but there is no device key", objectUID)
+	}
+
+	deviceKey, err := afero.ReadFile(uh.Store, uh.settings.EncryptionDeviceKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the device key: %s", err)
+	}
+
+	aead, err := newGCM(deviceKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid device key: %s", err)
+	}
+
+	if len(wrappedKey) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid wrapped key of the object '%s'", objectUID)
+	}
+
+	key, err := aead.Open(nil, wrappedKey[:aead.NonceSize()], wrappedKey[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap the key of the object '%s': %s", objectUID, err)
+	}
+
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// align returns the plaintext "offset" moved back to the start of its
+// segment, which is where a download can be resumed from
+func (d *objectDecrypter) align(offset int64) int64 {
+	return offset - offset%d.segmentSize
+}
+
+// ciphertextOffset returns the offset of the ciphertext of the segment
+// starting at the aligned plaintext "offset"
+func (d *objectDecrypter) ciphertextOffset(offset int64) int64 {
+	return offset / d.segmentSize * (d.segmentSize + int64(d.aead.Overhead()))
+}
+
+// reader returns the plaintext of the ciphertext read from "rd", which
+// starts at the segment of the aligned plaintext "offset"
+func (d *objectDecrypter) reader(rd io.ReadCloser, offset int64) io.ReadCloser {
+	return &decryptingReader{
+		ReadCloser: rd,
+		decrypter:  d,
+		index:      uint64(offset / d.segmentSize),
+		segment:    make([]byte, d.segmentSize+int64(d.aead.Overhead())+1),
+	}
+}
+
+// decryptingReader reads a segment ahead, plus one byte, so it knows
+// whether a segment is the last one
+type decryptingReader struct {
+	io.ReadCloser
+
+	decrypter *objectDecrypter
+	index     uint64
+	segment   []byte
+	carried   int
+	plaintext []byte
+	done      bool
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		if err := r.fetch(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+
+	return n, nil
+}
+
+// fetch decrypts the next segment
+func (r *decryptingReader) fetch() error {
+	n, err := io.ReadFull(r.ReadCloser, r.segment[r.carried:])
+	n += r.carried
+
+	last := false
+
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		return err
+	}
+
+	if r.index > 0xffffffff {
+		return errors.New("failed to decrypt the object: too many segments")
+	}
+
+	nonce := make([]byte, r.decrypter.aead.NonceSize())
+	copy(nonce, r.decrypter.nonce)
+	binary.BigEndian.PutUint32(nonce[len(r.decrypter.nonce):], uint32(r.index))
+
+	ciphertext := r.segment[:n]
+	additionalData := []byte{1}
+
+	if !last {
+		ciphertext = r.segment[:n-1]
+		additionalData = []byte{0}
+	}
+
+	r.plaintext, err = r.decrypter.aead.Open(r.plaintext[:0], nonce, ciphertext, additionalData)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt the object: %s", err)
+	}
+
+	if last {
+		r.done = true
+	} else {
+		// the byte read ahead starts the next segment
+		r.segment[0] = r.segment[n-1]
+		r.carried = 1
+	}
+
+	r.index++
+
+	return nil
+}
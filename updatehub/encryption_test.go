@@ -0,0 +1,260 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/UpdateHub/updatehub/copy"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+	"github.com/UpdateHub/updatehub/testsmocks/updatermock"
+)
+
+var (
+	testDeviceKey  = bytes.Repeat([]byte{1}, 32)
+	testContentKey = bytes.Repeat([]byte{2}, 16)
+	testNonce      = []byte("12345678")
+)
+
+// encryptTestObject encrypts "plaintext" as described by
+// metadata.Encryption
+func encryptTestObject(t *testing.T, plaintext []byte, segmentSize int) []byte {
+	aead, err := newGCM(testContentKey)
+	assert.NoError(t, err)
+
+	ciphertext := []byte{}
+
+	for index := 0; ; index++ {
+		nonce := append(append([]byte{}, testNonce...), 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(nonce[8:], uint32(index))
+
+		segment := plaintext
+		additionalData := []byte{1}
+
+		if len(plaintext) > segmentSize {
+			segment = plaintext[:segmentSize]
+			additionalData = []byte{0}
+		}
+
+		ciphertext = aead.Seal(ciphertext, nonce, segment, additionalData)
+		plaintext = plaintext[len(segment):]
+
+		if additionalData[0] == 1 {
+			return ciphertext
+		}
+	}
+}
+
+func wrapTestContentKey(t *testing.T) []byte {
+	aead, err := newGCM(testDeviceKey)
+	assert.NoError(t, err)
+
+	nonce := bytes.Repeat([]byte{3}, aead.NonceSize())
+
+	return aead.Seal(nonce, nonce, testContentKey, nil)
+}
+
+func newTestEncryptedObject(t *testing.T, wrappedKey []byte, segmentSize int) metadata.Object {
+	return &testObject{
+		metadata.ObjectMetadata{
+			Sha256sum: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+			Mode:      "test",
+			Encryption: &metadata.Encryption{
+				Algorithm:   EncryptionAlgorithmAESGCM,
+				WrappedKey:  wrappedKey,
+				Nonce:       testNonce,
+				SegmentSize: int64(segmentSize),
+			},
+		},
+	}
+}
+
+func TestDecryptingReader(t *testing.T) {
+	d := &objectDecrypter{nonce: testNonce, segmentSize: 4}
+
+	aead, err := newGCM(testContentKey)
+	assert.NoError(t, err)
+	d.aead = aead
+
+	for _, plaintext := range []string{"", "abc", "abcd", "abcdefgh", "abcdefghij"} {
+		t.Run(fmt.Sprintf("Size%d", len(plaintext)), func(t *testing.T) {
+			ciphertext := encryptTestObject(t, []byte(plaintext), 4)
+
+			data, err := ioutil.ReadAll(d.reader(ioutil.NopCloser(bytes.NewReader(ciphertext)), 0))
+			assert.NoError(t, err)
+			assert.Equal(t, plaintext, string(data))
+
+			// resumed at the second segment
+			if len(plaintext) > 4 {
+				offset := d.align(6)
+				assert.Equal(t, int64(4), offset)
+
+				rd := d.reader(ioutil.NopCloser(bytes.NewReader(ciphertext[d.ciphertextOffset(offset):])), offset)
+
+				data, err = ioutil.ReadAll(rd)
+				assert.NoError(t, err)
+				assert.Equal(t, plaintext[4:], string(data))
+			}
+		})
+	}
+
+	ciphertext := encryptTestObject(t, []byte("abcdefgh"), 4)
+
+	// the last segment is missing
+	_, err = ioutil.ReadAll(d.reader(ioutil.NopCloser(bytes.NewReader(ciphertext[:20])), 0))
+	assert.EqualError(t, err, "failed to decrypt the object: cipher: message authentication failed")
+
+	tampered := append([]byte{}, ciphertext...)
+	tampered[0] ^= 0xff
+
+	_, err = ioutil.ReadAll(d.reader(ioutil.NopCloser(bytes.NewReader(tampered)), 0))
+	assert.EqualError(t, err, "failed to decrypt the object: cipher: message authentication failed")
+}
+
+func TestObjectDecrypterWithDeviceKey(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	o := newTestEncryptedObject(t, wrapTestContentKey(t), 4)
+
+	d, err := uh.objectDecrypter(o)
+	assert.EqualError(t, err, "the object '9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08' is encrypted but there is no device key")
+	assert.Nil(t, d)
+
+	uh.settings.EncryptionDeviceKeyPath = "/device.key"
+
+	err = afero.WriteFile(uh.Store, "/device.key", testDeviceKey, 0600)
+	assert.NoError(t, err)
+
+	d, err = uh.objectDecrypter(o)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), d.segmentSize)
+
+	err = afero.WriteFile(uh.Store, "/device.key", bytes.Repeat([]byte{4}, 32), 0600)
+	assert.NoError(t, err)
+
+	_, err = uh.objectDecrypter(o)
+	assert.EqualError(t, err, "failed to unwrap the key of the object '9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08': cipher: message authentication failed")
+
+	// plain objects don't need a decrypter
+	d, err = uh.objectDecrypter(&testObject{})
+	assert.NoError(t, err)
+	assert.Nil(t, d)
+}
+
+func TestObjectDecrypterWithKeyProvider(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.CmdLineExecuter = clm
+	uh.settings.EncryptionKeyProvider = "/usr/bin/unwrap-key"
+
+	o := newTestEncryptedObject(t, []byte("wrapped"), 4)
+	cmdline := "'/usr/bin/unwrap-key' 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+	stdin := mock.MatchedBy(func(r *strings.Reader) bool {
+		data, _ := ioutil.ReadAll(r)
+		r.Seek(0, 0)
+
+		return string(data) == base64.StdEncoding.EncodeToString([]byte("wrapped"))+"\n"
+	})
+
+	clm.On("ExecuteWithStdin", cmdline, stdin).Return([]byte(base64.StdEncoding.EncodeToString(testContentKey)+"\n"), nil).Once()
+
+	d, err := uh.objectDecrypter(o)
+	assert.NoError(t, err)
+	assert.NotNil(t, d)
+
+	clm.On("ExecuteWithStdin", cmdline, stdin).Return([]byte{}, errors.New("no key")).Once()
+
+	_, err = uh.objectDecrypter(o)
+	assert.EqualError(t, err, "the key provider failed to unwrap the key of the object '9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08': no key")
+
+	clm.AssertExpectations(t)
+}
+
+func TestObjectDecrypterWithUnsupportedAlgorithm(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	o := newTestEncryptedObject(t, nil, 4)
+	o.GetObjectMetadata().Encryption.Algorithm = "rot13"
+
+	_, err := uh.objectDecrypter(o)
+	assert.EqualError(t, err, "the object '9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08' is encrypted with the unsupported algorithm 'rot13'")
+}
+
+func TestUpdateHubFetchUpdateWithEncryptedObject(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.CopyBackend = copy.ExtendedIO{}
+	uh.settings.EncryptionDeviceKeyPath = "/device.key"
+
+	err := afero.WriteFile(uh.Store, "/device.key", testDeviceKey, 0600)
+	assert.NoError(t, err)
+
+	object, err := json.Marshal(newTestEncryptedObject(t, wrapTestContentKey(t), 2).GetObjectMetadata())
+	assert.NoError(t, err)
+
+	rawMetadata := fmt.Sprintf(`{"product-uid": "0123456789", "objects": [[%s]]}`, object)
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(rawMetadata))
+	assert.NoError(t, err)
+
+	// "test", resumed in the middle of the second segment
+	objectUID := updateMetadata.Objects[0][0].GetObjectMetadata().Sha256sum
+	objectPath := path.Join(uh.settings.DownloadDir, objectUID)
+
+	err = afero.WriteFile(uh.Store, objectPath, []byte("tes"), 0644)
+	assert.NoError(t, err)
+	err = afero.WriteFile(uh.Store, objectPath+partialDownloadSuffix, nil, 0644)
+	assert.NoError(t, err)
+
+	ciphertext := encryptTestObject(t, []byte("test"), 2)
+
+	uri := path.Join("/", uh.FirmwareMetadata.ProductUID, updateMetadata.PackageUID(), objectUID)
+
+	um := &updatermock.UpdaterMock{}
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(18)).Return(ioutil.NopCloser(bytes.NewReader(ciphertext[18:])), int64(18), nil)
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.NoError(t, err)
+
+	data, err := afero.ReadFile(uh.Store, objectPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", string(data))
+
+	digest, err := readDownloadDigest(uh.Store, objectPath)
+	assert.NoError(t, err)
+	assert.Equal(t, objectUID, digest)
+
+	assert.Equal(t, DownloadProgress{TotalObjects: 1, DownloadedObjects: 1, DownloadedBytes: 4}, uh.DownloadProgress())
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
@@ -0,0 +1,166 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/UpdateHub/updatehub/client"
+)
+
+// the state reported when a package marked bad is offered again
+const badPackageReportState = "bad-package"
+
+// maxFailures returns how many times in a row a package may fail at
+// "state" before it's marked bad, 0 means no limit
+func (uh *UpdateHub) maxFailures(state UpdateHubState) int {
+	switch state {
+	case UpdateHubStateDownloading:
+		return uh.settings.ErrorPolicyMaxDownloadFailures
+	case UpdateHubStateInstalling:
+		return uh.settings.ErrorPolicyMaxInstallFailures
+	}
+
+	return 0
+}
+
+// trackFailures applies the error policy to the transition from
+// "handled" to "next". The failures of the same package at the same
+// state are counted until the package is installed.
+func (uh *UpdateHub) trackFailures(handled State, next State) {
+	p := &uh.settings.PersistentErrorPolicySettings
+
+	if next.ID() == UpdateHubStateInstalled {
+		if p.Failures == 0 {
+			return
+		}
+
+		p.FailedPackageUID = ""
+		p.FailedState = ""
+		p.Failures = 0
+
+		uh.saveErrorPolicy()
+		return
+	}
+
+	es, ok := next.(*ErrorState)
+	if !ok || es.UpdateMetadata() == nil {
+		return
+	}
+
+	packageUID := es.UpdateMetadata().PackageUID()
+	state := StateToString(handled.ID())
+
+	if p.FailedPackageUID == packageUID && p.FailedState == state {
+		p.Failures++
+	} else {
+		p.FailedPackageUID = packageUID
+		p.FailedState = state
+		p.Failures = 1
+	}
+
+	max := uh.maxFailures(handled.ID())
+	if max > 0 && p.Failures >= max {
+		uh.markBadPackage(packageUID, fmt.Sprintf("failed %d times in a row at state '%s'", p.Failures, state))
+	}
+
+	uh.saveErrorPolicy()
+}
+
+// markBadPackage marks the package "packageUID" bad so it isn't tried
+// again, "reason" is reported whenever the package is offered. It's
+// up to the caller to save the runtime settings.
+func (uh *UpdateHub) markBadPackage(packageUID string, reason string) {
+	if uh.isBadPackage(packageUID) {
+		return
+	}
+
+	log.Warn(fmt.Sprintf("package '%s' %s, it won't be tried again", packageUID, reason))
+
+	p := &uh.settings.PersistentErrorPolicySettings
+
+	// the reasons are missing for the packages marked bad by an agent
+	// which didn't keep them
+	for len(p.BadPackageReasons) < len(p.BadPackageUIDs) {
+		p.BadPackageReasons = append(p.BadPackageReasons, "")
+	}
+
+	p.BadPackageUIDs = append(p.BadPackageUIDs, packageUID)
+	// the settings lists are comma separated
+	p.BadPackageReasons = append(p.BadPackageReasons, strings.Replace(reason, ",", ";", -1))
+}
+
+// isBadPackage tells whether the package "packageUID" was marked bad
+func (uh *UpdateHub) isBadPackage(packageUID string) bool {
+	for _, uid := range uh.settings.BadPackageUIDs {
+		if uid == packageUID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// badPackageReason returns why the package "packageUID" was marked bad
+func (uh *UpdateHub) badPackageReason(packageUID string) string {
+	p := uh.settings.PersistentErrorPolicySettings
+
+	for i, uid := range p.BadPackageUIDs {
+		if uid == packageUID && i < len(p.BadPackageReasons) && p.BadPackageReasons[i] != "" {
+			return p.BadPackageReasons[i]
+		}
+	}
+
+	return "was marked bad"
+}
+
+// reportBadPackage tells the server that the package "packageUID",
+// which it keeps offering, is ignored and why
+func (uh *UpdateHub) reportBadPackage(packageUID string) error {
+	if uh.Reporter == nil {
+		return nil
+	}
+
+	reason := uh.badPackageReason(packageUID)
+
+	if er, ok := uh.Reporter.(client.ErrorReporter); ok {
+		return er.ReportError(uh.API.Request(), packageUID, badPackageReportState, reason, nil)
+	}
+
+	return uh.Reporter.ReportState(uh.API.Request(), packageUID, badPackageReportState)
+}
+
+// nextAfterError returns the state which follows a transient error: a
+// retry after the backoff, the exit once there were too many failures
+// in a row, or the idle state.
+func (uh *UpdateHub) nextAfterError() State {
+	p := uh.settings.PersistentErrorPolicySettings
+
+	if uh.settings.ErrorPolicyFatalAfter > 0 && p.Failures >= uh.settings.ErrorPolicyFatalAfter {
+		log.Error(fmt.Sprintf("%d failures in a row at state '%s', exiting", p.Failures, p.FailedState))
+		return NewExitState(1)
+	}
+
+	if uh.settings.ErrorPolicyRetryInterval <= 0 || p.Failures == 0 || uh.isBadPackage(p.FailedPackageUID) {
+		return NewIdleState()
+	}
+
+	poll := NewPollState(uh)
+	poll.interval = uh.backoffInterval(uh.settings.ErrorPolicyRetryInterval, p.Failures, 0)
+
+	return poll
+}
+
+func (uh *UpdateHub) saveErrorPolicy() {
+	err := uh.saveRuntimeSettings()
+	if err != nil {
+		log.Warn("failed to save the error policy state: ", err)
+	}
+}
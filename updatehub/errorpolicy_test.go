@@ -0,0 +1,203 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/updatermock"
+)
+
+func TestTrackFailures(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.RuntimeSettingsPath = "/runtime.conf"
+	uh.settings.ErrorPolicyMaxInstallFailures = 3
+
+	m := &metadata.UpdateMetadata{RawBytes: []byte("1")}
+	other := &metadata.UpdateMetadata{RawBytes: []byte("2")}
+
+	installing := NewInstallingState(m, nil, nil, nil, nil)
+	failure := NewErrorState(m, NewTransientError(errors.New("install failed")))
+
+	uh.trackFailures(installing, failure)
+	uh.trackFailures(installing, failure)
+	assert.Equal(t, 2, uh.settings.Failures)
+	assert.False(t, uh.isBadPackage(m.PackageUID()))
+
+	// a failure at another state starts over
+	uh.trackFailures(NewDownloadingState(m), failure)
+	assert.Equal(t, 1, uh.settings.Failures)
+	assert.Equal(t, "downloading", uh.settings.FailedState)
+
+	uh.trackFailures(installing, failure)
+	uh.trackFailures(installing, failure)
+	uh.trackFailures(installing, failure)
+	assert.Equal(t, 3, uh.settings.Failures)
+	assert.True(t, uh.isBadPackage(m.PackageUID()))
+
+	// it's marked bad only once
+	uh.trackFailures(installing, failure)
+	assert.Equal(t, []string{m.PackageUID()}, uh.settings.BadPackageUIDs)
+
+	// saved so it survives a restart
+	data, err := afero.ReadFile(uh.Store, uh.RuntimeSettingsPath)
+	assert.NoError(t, err)
+
+	runtimeSettings, err := LoadSettings(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, uh.settings.PersistentErrorPolicySettings, runtimeSettings.PersistentErrorPolicySettings)
+
+	// the failures in a row end once a package is installed
+	uh.trackFailures(NewInstallingState(other, nil, nil, nil, nil), NewInstalledState(other))
+	assert.Equal(t, PersistentErrorPolicySettings{
+		BadPackageUIDs:    []string{m.PackageUID()},
+		BadPackageReasons: []string{"failed 3 times in a row at state 'installing'"},
+	}, uh.settings.PersistentErrorPolicySettings)
+}
+
+func TestTrackFailuresWithoutLimit(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	m := &metadata.UpdateMetadata{RawBytes: []byte("1")}
+	failure := NewErrorState(m, NewTransientError(errors.New("download failed")))
+
+	for i := 0; i < 10; i++ {
+		uh.trackFailures(NewDownloadingState(m), failure)
+	}
+
+	assert.Equal(t, 10, uh.settings.Failures)
+	assert.False(t, uh.isBadPackage(m.PackageUID()))
+
+	// an error without an update isn't counted
+	uh.trackFailures(NewUpdateCheckState(), NewErrorState(nil, NewTransientError(errors.New("check failed"))))
+	assert.Equal(t, 10, uh.settings.Failures)
+}
+
+func TestErrorStateWithErrorPolicy(t *testing.T) {
+	m := &metadata.UpdateMetadata{RawBytes: []byte("1")}
+
+	testCases := []struct {
+		name             string
+		retryInterval    time.Duration
+		fatalAfter       int
+		failures         int
+		bad              bool
+		expectedState    UpdateHubState
+		expectedInterval time.Duration
+	}{
+		{"WithoutPolicy", 0, 0, 5, false, UpdateHubStateIdle, 0},
+		{"WithFirstRetry", time.Minute, 0, 1, false, UpdateHubStatePoll, time.Minute},
+		{"WithBackoff", time.Minute, 0, 3, false, UpdateHubStatePoll, 4 * time.Minute},
+		{"WithBackoffLimitedByPolling", time.Minute, 0, 10, false, UpdateHubStatePoll, time.Hour},
+		{"WithBadPackage", time.Minute, 0, 3, true, UpdateHubStateIdle, 0},
+		{"WithFatalAfter", time.Minute, 3, 3, false, UpdateHubStateExit, 0},
+		{"BeforeFatalAfter", 0, 3, 2, false, UpdateHubStateIdle, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := NewErrorState(m, NewTransientError(errors.New("install failed")))
+
+			uh, _ := newTestUpdateHub(state, nil)
+			uh.TimeStep = time.Second
+			uh.settings.PollingInterval = time.Hour
+			uh.settings.ErrorPolicyRetryInterval = tc.retryInterval
+			uh.settings.ErrorPolicyFatalAfter = tc.fatalAfter
+			uh.settings.FailedPackageUID = m.PackageUID()
+			uh.settings.FailedState = "installing"
+			uh.settings.Failures = tc.failures
+
+			if tc.bad {
+				uh.settings.BadPackageUIDs = []string{m.PackageUID()}
+			}
+
+			next, _ := state.Handle(uh)
+			assert.Equal(t, tc.expectedState, next.ID())
+
+			if poll, ok := next.(*PollState); ok {
+				assert.Equal(t, tc.expectedInterval, poll.interval)
+			}
+		})
+	}
+}
+
+func TestStateUpdateCheckWithBadPackage(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	uh, _ := newTestUpdateHub(NewUpdateCheckState(), nil)
+	uh.Controller = uh
+
+	m, err := metadata.NewUpdateMetadata([]byte(validUpdateMetadata))
+	assert.NoError(t, err)
+
+	uh.settings.BadPackageUIDs = []string{m.PackageUID()}
+	uh.settings.BadPackageReasons = []string{"was rolled back after failing the validation"}
+
+	reporter := &errorReporter{}
+	uh.Reporter = reporter
+
+	var data struct {
+		Retries int `json:"retries"`
+		metadata.FirmwareMetadata
+	}
+
+	data.FirmwareMetadata = uh.FirmwareMetadata
+
+	um := &updatermock.UpdaterMock{}
+	um.On("CheckUpdate", uh.API.Request(), client.UpgradesEndpoint, data).Return(m, time.Duration(0), nil)
+	uh.Updater = um
+
+	next, _ := uh.State.Handle(uh)
+	assert.IsType(t, &IdleState{}, next)
+
+	// the server is told why it's ignored
+	assert.Equal(t, []string{m.PackageUID() + ":bad-package"}, reporter.reports)
+	assert.Equal(t, "was rolled back after failing the validation", reporter.message)
+
+	um.AssertExpectations(t)
+}
+
+func TestMarkBadPackage(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	// marked bad by an agent which didn't keep the reasons
+	uh.settings.BadPackageUIDs = []string{"old"}
+
+	uh.markBadPackage("puid", "failed to boot, twice")
+	uh.markBadPackage("puid", "failed again")
+
+	assert.Equal(t, []string{"old", "puid"}, uh.settings.BadPackageUIDs)
+	assert.Equal(t, []string{"", "failed to boot; twice"}, uh.settings.BadPackageReasons)
+
+	assert.Equal(t, "was marked bad", uh.badPackageReason("old"))
+	assert.Equal(t, "failed to boot; twice", uh.badPackageReason("puid"))
+}
+
+func TestReportBadPackage(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	// without a reporter
+	assert.NoError(t, uh.reportBadPackage("puid"))
+
+	reporter := &recordingReporter{}
+	uh.Reporter = reporter
+
+	// the reason is only sent by the error reporters
+	assert.NoError(t, uh.reportBadPackage("puid"))
+	assert.Equal(t, []string{"puid:bad-package"}, reporter.reports)
+}
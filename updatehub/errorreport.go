@@ -0,0 +1,137 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// the classes of the errors sent to the server
+const (
+	ErrorClassNetwork  = "network"
+	ErrorClassVerify   = "verify"
+	ErrorClassInstall  = "install"
+	ErrorClassHardware = "hardware"
+)
+
+// stderrExcerptSize is how many of the last bytes of the output of a
+// failed handler command are sent along with the error report
+const stderrExcerptSize = 1024
+
+// ErrorDetails are sent to the server along with the cause of an
+// error, so the failures can be told apart without the device log
+type ErrorDetails struct {
+	Class           string   `json:"class,omitempty"`
+	ObjectMode      string   `json:"object-mode,omitempty"`
+	ObjectSha256sum string   `json:"object-sha256sum,omitempty"`
+	Stderr          string   `json:"stderr,omitempty"`
+	Log             []string `json:"log,omitempty"`
+}
+
+// failure is what failed, as recorded where it happened
+type failure struct {
+	class  string
+	object metadata.Object
+	stderr string
+}
+
+// recordFailure records that "object", which may be nil, failed with
+// "errs" at a step of the "class". The I/O errors of the device are of
+// the hardware class instead. It's sent along with the report of the
+// error state which follows.
+func (uh *UpdateHub) recordFailure(class string, object metadata.Object, errs ...error) {
+	f := &failure{class: class, object: object}
+
+	for _, err := range errs {
+		if isHardwareError(err) {
+			f.class = ErrorClassHardware
+		}
+
+		if ce, ok := errors.Cause(err).(*utils.CommandError); ok && f.stderr == "" {
+			f.stderr = excerpt(string(ce.Output), stderrExcerptSize)
+		}
+	}
+
+	uh.failure = f
+}
+
+// isHardwareError tells whether "err" was caused by the storage of the
+// device instead of by the update
+func isHardwareError(err error) bool {
+	err = errors.Cause(err)
+
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	}
+
+	switch err {
+	case syscall.EIO, syscall.ENOSPC, syscall.EROFS, syscall.ENODEV, syscall.ENXIO:
+		return true
+	}
+
+	return false
+}
+
+// excerpt returns the last "size" bytes of "s"
+func excerpt(s string, size int) string {
+	if len(s) <= size {
+		return s
+	}
+
+	return s[len(s)-size:]
+}
+
+// describeError gathers the details of the error "next", caused by
+// handling "handled", before the agent moves on. The failures which
+// weren't recorded where they happened are classified by the state
+// they happened at.
+func (uh *UpdateHub) describeError(handled State, next State) {
+	f := uh.failure
+	uh.failure = nil
+
+	es, ok := next.(*ErrorState)
+	if !ok {
+		return
+	}
+
+	details := &ErrorDetails{Log: lastLogLines.Lines()}
+
+	switch {
+	case f != nil:
+		details.Class = f.class
+		details.Stderr = f.stderr
+
+		if f.object != nil {
+			details.ObjectMode = f.object.GetObjectMetadata().Mode
+			details.ObjectSha256sum = f.object.GetObjectMetadata().Sha256sum
+		}
+	case isHardwareError(es.cause.Cause()):
+		details.Class = ErrorClassHardware
+	default:
+		switch handled.(type) {
+		case *UpdateCheckState, *DownloadingState:
+			details.Class = ErrorClassNetwork
+		case *InstallingState, *RebootingState, *RollingBackState:
+			details.Class = ErrorClassInstall
+		}
+	}
+
+	es.details = details
+}
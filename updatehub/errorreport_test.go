@@ -0,0 +1,218 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+type detailedErrorReporter struct {
+	recordingReporter
+
+	message   string
+	details   interface{}
+	telemetry interface{}
+}
+
+func (r *detailedErrorReporter) ReportDetailedError(api client.ApiRequester, packageUID string, state string, errorMessage string, details interface{}, entries interface{}, telemetry interface{}) error {
+	r.reports = append(r.reports, packageUID+":"+state)
+	r.message = errorMessage
+	r.details = details
+	r.telemetry = telemetry
+
+	return nil
+}
+
+func TestRecordFailure(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	obj := m.Objects[0][0]
+
+	commandErr := &utils.CommandError{Cmdline: "flash", Output: []byte(strings.Repeat("x", stderrExcerptSize) + "bad block")}
+
+	testCases := []struct {
+		Name            string
+		Class           string
+		Object          metadata.Object
+		Errors          []error
+		ExpectedDetails ErrorDetails
+	}{
+		{
+			"Verify",
+			ErrorClassVerify,
+			obj,
+			[]error{errors.New("sha256sum's don't match")},
+			ErrorDetails{Class: "verify", ObjectMode: "test", ObjectSha256sum: testObjectUID},
+		},
+		{
+			"InstallWithStderr",
+			ErrorClassInstall,
+			obj,
+			[]error{commandErr, errors.New("cleanup error")},
+			ErrorDetails{Class: "install", ObjectMode: "test", ObjectSha256sum: testObjectUID, Stderr: strings.Repeat("x", stderrExcerptSize-9) + "bad block"},
+		},
+		{
+			"InstallWithIOError",
+			ErrorClassInstall,
+			obj,
+			[]error{&os.PathError{Op: "write", Path: "/dev/mmcblk0p2", Err: syscall.EIO}},
+			ErrorDetails{Class: "hardware", ObjectMode: "test", ObjectSha256sum: testObjectUID},
+		},
+		{
+			"WithoutObject",
+			ErrorClassHardware,
+			nil,
+			[]error{errors.New("the hardware isn't supported")},
+			ErrorDetails{Class: "hardware"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			uh, err := newTestUpdateHub(nil, nil)
+			assert.NoError(t, err)
+
+			uh.recordFailure(tc.Class, tc.Object, tc.Errors...)
+
+			es := NewErrorState(m, NewTransientError(utils.MergeErrorList(tc.Errors))).(*ErrorState)
+			uh.describeError(&InstallingState{}, es)
+
+			assert.NotNil(t, es.details)
+
+			details := *es.details
+			details.Log = nil
+
+			assert.Equal(t, tc.ExpectedDetails, details)
+			assert.Nil(t, uh.failure)
+		})
+	}
+}
+
+func TestDescribeErrorByState(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		Name          string
+		Handled       State
+		Cause         error
+		ExpectedClass string
+	}{
+		{"UpdateCheck", NewUpdateCheckState(), errors.New("check failed"), "network"},
+		{"Downloading", NewDownloadingState(m), errors.New("download failed"), "network"},
+		{"Installing", &InstallingState{}, errors.New("install failed"), "install"},
+		{"Rebooting", NewRebootingState(m), errors.New("reboot failed"), "install"},
+		{"NoSpace", NewDownloadingState(m), &os.PathError{Op: "write", Path: "/tmp/download", Err: syscall.ENOSPC}, "hardware"},
+		{"Unknown", NewIdleState(), errors.New("failed"), ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			uh, err := newTestUpdateHub(nil, nil)
+			assert.NoError(t, err)
+
+			es := NewErrorState(m, NewTransientError(tc.Cause)).(*ErrorState)
+			uh.describeError(tc.Handled, es)
+
+			assert.Equal(t, tc.ExpectedClass, es.details.Class)
+			assert.Equal(t, "", es.details.ObjectSha256sum)
+		})
+	}
+}
+
+func TestDescribeErrorWithLog(t *testing.T) {
+	uh, err := newTestUpdateHub(nil, nil)
+	assert.NoError(t, err)
+
+	log.WithFields(LogFields{"object": "sha256sum"}).Warn("failed to write the object")
+
+	es := NewErrorState(nil, NewTransientError(errors.New("install failed"))).(*ErrorState)
+	uh.describeError(&InstallingState{}, es)
+
+	assert.True(t, len(es.details.Log) > 0)
+	assert.True(t, len(es.details.Log) <= recentLogSize)
+	assert.True(t, strings.HasSuffix(es.details.Log[len(es.details.Log)-1], "warning: failed to write the object object=sha256sum"))
+}
+
+func TestDescribeErrorDiscardsFailure(t *testing.T) {
+	uh, err := newTestUpdateHub(nil, nil)
+	assert.NoError(t, err)
+
+	// a failure which didn't lead to the error state isn't kept for
+	// the next one
+	uh.recordFailure(ErrorClassVerify, nil, errors.New("verify failed"))
+	uh.describeError(NewUpdateCheckState(), NewIdleState())
+
+	assert.Nil(t, uh.failure)
+
+	es := NewErrorState(nil, NewTransientError(errors.New("check failed"))).(*ErrorState)
+	uh.describeError(NewUpdateCheckState(), es)
+
+	assert.Equal(t, "network", es.details.Class)
+}
+
+func TestReportCurrentStateWithErrorDetails(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	uh, err := newTestUpdateHub(nil, nil)
+	assert.NoError(t, err)
+
+	reporter := &detailedErrorReporter{}
+	uh.Reporter = reporter
+
+	uh.recordObjectFailure(m.PackageUID(), m.Objects[0][0])
+
+	es := NewErrorState(m, NewTransientError(errors.New("install failed"))).(*ErrorState)
+	es.details = &ErrorDetails{Class: ErrorClassInstall}
+
+	uh.State = es
+
+	err = uh.ReportCurrentState()
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{m.PackageUID() + ":error"}, reporter.reports)
+	assert.Equal(t, "transient error: install failed", reporter.message)
+	assert.Equal(t, queued(t, es.details), reporter.details)
+	assert.Equal(t, queued(t, uh.packageTelemetry(m.PackageUID())), reporter.telemetry)
+
+	// an error which wasn't described is reported as before
+	reporter.reports = nil
+	uh.State = NewErrorState(m, NewTransientError(errors.New("reboot failed")))
+
+	err = uh.ReportCurrentState()
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{m.PackageUID() + ":error"}, reporter.reports)
+}
+
+func TestExcerpt(t *testing.T) {
+	assert.Equal(t, "output", excerpt("output", 10))
+	assert.Equal(t, "put", excerpt("output", 3))
+}
@@ -0,0 +1,223 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/client"
+)
+
+// eventLogBatchSize is the maximum number of events shipped at once
+const eventLogBatchSize = 50
+
+// Event is an entry of the agent event log
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	State      string    `json:"state"`
+	PackageUID string    `json:"package-uid,omitempty"`
+	Message    string    `json:"message,omitempty"`
+}
+
+// EventLog keeps the last events of the agent, saved at "path" so they
+// survive a restart. It is kept only in memory when "path" is empty.
+type EventLog struct {
+	fs     afero.Fs
+	path   string
+	size   int
+	events []Event
+	mutex  sync.Mutex
+}
+
+// NewEventLog creates an event log holding up to "size" events, the
+// ones previously saved at "path" are loaded
+func NewEventLog(fs afero.Fs, path string, size int) (*EventLog, error) {
+	l := &EventLog{
+		fs:   fs,
+		path: path,
+		size: size,
+	}
+
+	if path == "" {
+		return l, nil
+	}
+
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return l, nil
+		}
+
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &l.events)
+	if err != nil {
+		return nil, err
+	}
+
+	l.trim()
+
+	return l, nil
+}
+
+// Add appends "e" to the log, discarding the oldest events when it is
+// full
+func (l *EventLog) Add(e Event) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.events = append(l.events, e)
+	l.trim()
+
+	return l.save()
+}
+
+// Events returns a copy of the events in the log, the oldest first
+func (l *EventLog) Events() []Event {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	events := make([]Event, len(l.events))
+	copy(events, l.events)
+
+	return events
+}
+
+// Remove discards the "n" oldest events
+func (l *EventLog) Remove(n int) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if n > len(l.events) {
+		n = len(l.events)
+	}
+
+	l.events = l.events[n:]
+
+	return l.save()
+}
+
+func (l *EventLog) trim() {
+	if l.size > 0 && len(l.events) > l.size {
+		l.events = l.events[len(l.events)-l.size:]
+	}
+}
+
+func (l *EventLog) save() error {
+	if l.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(l.events)
+	if err != nil {
+		return err
+	}
+
+	err = l.fs.MkdirAll(filepath.Dir(l.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	return afero.WriteFile(l.fs, l.path, data, 0644)
+}
+
+// EventLog returns the events in the agent event log, the oldest first
+func (uh *UpdateHub) EventLog() []Event {
+	if uh.eventLog == nil {
+		return []Event{}
+	}
+
+	return uh.eventLog.Events()
+}
+
+// errorReportEvents returns the events attached to the error reports,
+// which are none unless "AttachToErrorReports" is set
+func (uh *UpdateHub) errorReportEvents() interface{} {
+	if uh.eventLog == nil || !uh.settings.EventLogAttachToErrorReports {
+		return nil
+	}
+
+	return uh.eventLog.Events()
+}
+
+// recordState adds the handling of "state" to the event log, the
+// errors are recorded along with their cause
+func (uh *UpdateHub) recordState(state State) {
+	if uh.eventLog == nil {
+		return
+	}
+
+	e := Event{
+		Time:  uh.clock().Now(),
+		Type:  "state",
+		State: StateToString(state.ID()),
+	}
+
+	if rs, ok := state.(ReportableState); ok && rs.UpdateMetadata() != nil {
+		e.PackageUID = rs.UpdateMetadata().PackageUID()
+	}
+
+	if es, ok := state.(*ErrorState); ok {
+		e.Type = "error"
+		e.Message = es.cause.Error()
+	}
+
+	err := uh.eventLog.Add(e)
+	if err != nil {
+		log.Warn("failed to record event: ", err)
+	}
+}
+
+// shipEvents sends the event log to the configured endpoint, in
+// batches, while the server accepts them. The shipped events are
+// removed from the log.
+func (uh *UpdateHub) shipEvents() error {
+	if uh.eventLog == nil || !uh.settings.EventLogShippingEnabled {
+		return nil
+	}
+
+	reporter, ok := uh.Reporter.(client.LogReporter)
+	if !ok {
+		return nil
+	}
+
+	endpoint := uh.settings.EventLogEndpoint
+	if endpoint == "" {
+		endpoint = client.LogsEndpoint
+	}
+
+	for {
+		events := uh.eventLog.Events()
+		if len(events) == 0 {
+			return nil
+		}
+
+		if len(events) > eventLogBatchSize {
+			events = events[:eventLogBatchSize]
+		}
+
+		err := reporter.ReportLogs(uh.API.Request(), endpoint, events)
+		if err != nil {
+			return err
+		}
+
+		err = uh.eventLog.Remove(len(events))
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,287 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/updatermock"
+)
+
+type logReporter struct {
+	recordingReporter
+
+	uri     string
+	batches [][]Event
+	err     error
+}
+
+func (r *logReporter) ReportLogs(api client.ApiRequester, uri string, entries interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	r.uri = uri
+	r.batches = append(r.batches, entries.([]Event))
+
+	return nil
+}
+
+type errorReporter struct {
+	recordingReporter
+
+	message string
+	entries interface{}
+}
+
+func (r *errorReporter) ReportError(api client.ApiRequester, packageUID string, state string, errorMessage string, entries interface{}) error {
+	r.reports = append(r.reports, packageUID+":"+state)
+	r.message = errorMessage
+	r.entries = entries
+
+	return nil
+}
+
+func TestEventLog(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	l, err := NewEventLog(fs, "/var/lib/updatehub/event-log.json", 2)
+	assert.NoError(t, err)
+	assert.Empty(t, l.Events())
+
+	first := Event{Time: time.Unix(1, 0).UTC(), Type: "state", State: "idle"}
+	second := Event{Time: time.Unix(2, 0).UTC(), Type: "state", State: "downloading", PackageUID: "puid"}
+	third := Event{Time: time.Unix(3, 0).UTC(), Type: "error", State: "error", Message: "failed"}
+
+	assert.NoError(t, l.Add(first))
+	assert.NoError(t, l.Add(second))
+	assert.Equal(t, []Event{first, second}, l.Events())
+
+	// the oldest is discarded when it is full
+	assert.NoError(t, l.Add(third))
+	assert.Equal(t, []Event{second, third}, l.Events())
+
+	// it is loaded back
+	l, err = NewEventLog(fs, "/var/lib/updatehub/event-log.json", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []Event{second, third}, l.Events())
+
+	assert.NoError(t, l.Remove(1))
+	assert.Equal(t, []Event{third}, l.Events())
+
+	assert.NoError(t, l.Remove(5))
+	assert.Empty(t, l.Events())
+}
+
+func TestNewEventLogWithCorruptedFile(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	err := afero.WriteFile(fs, "/event-log.json", []byte("{"), 0644)
+	assert.NoError(t, err)
+
+	l, err := NewEventLog(fs, "/event-log.json", 2)
+	assert.Error(t, err)
+	assert.Nil(t, l)
+}
+
+func TestRecordState(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.eventLog, _ = NewEventLog(uh.Store, "", 10)
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	uh.recordState(NewDownloadingState(m))
+	uh.recordState(NewErrorState(m, NewTransientError(errors.New("download failed"))))
+
+	events := uh.eventLog.Events()
+	assert.Equal(t, 2, len(events))
+
+	assert.Equal(t, "state", events[0].Type)
+	assert.Equal(t, "downloading", events[0].State)
+	assert.Equal(t, m.PackageUID(), events[0].PackageUID)
+
+	assert.Equal(t, "error", events[1].Type)
+	assert.Equal(t, "error", events[1].State)
+	assert.Equal(t, "transient error: download failed", events[1].Message)
+
+	aim.AssertExpectations(t)
+}
+
+func TestShipEvents(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.eventLog, _ = NewEventLog(uh.Store, "", 100)
+	uh.settings.EventLogShippingEnabled = true
+
+	reporter := &logReporter{}
+	uh.Reporter = reporter
+
+	for i := 0; i < eventLogBatchSize+1; i++ {
+		uh.recordState(NewIdleState())
+	}
+
+	err := uh.shipEvents()
+	assert.NoError(t, err)
+
+	assert.Equal(t, client.LogsEndpoint, reporter.uri)
+	assert.Equal(t, 2, len(reporter.batches))
+	assert.Equal(t, eventLogBatchSize, len(reporter.batches[0]))
+	assert.Equal(t, 1, len(reporter.batches[1]))
+	assert.Empty(t, uh.eventLog.Events())
+
+	aim.AssertExpectations(t)
+}
+
+func TestShipEventsWithFailure(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.eventLog, _ = NewEventLog(uh.Store, "", 100)
+	uh.settings.EventLogShippingEnabled = true
+	uh.settings.EventLogEndpoint = "https://logs.updatehub.io"
+
+	reporter := &logReporter{err: errors.New("report request failed")}
+	uh.Reporter = reporter
+
+	uh.recordState(NewIdleState())
+
+	err := uh.shipEvents()
+	assert.EqualError(t, err, "report request failed")
+
+	// kept to be shipped later
+	assert.Equal(t, 1, len(uh.eventLog.Events()))
+
+	reporter.err = nil
+
+	err = uh.shipEvents()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://logs.updatehub.io", reporter.uri)
+	assert.Empty(t, uh.eventLog.Events())
+
+	aim.AssertExpectations(t)
+}
+
+func TestShipEventsWhenDisabled(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.eventLog, _ = NewEventLog(uh.Store, "", 100)
+
+	reporter := &logReporter{}
+	uh.Reporter = reporter
+
+	uh.recordState(NewIdleState())
+
+	err := uh.shipEvents()
+	assert.NoError(t, err)
+	assert.Empty(t, reporter.batches)
+	assert.Equal(t, 1, len(uh.eventLog.Events()))
+
+	aim.AssertExpectations(t)
+}
+
+func TestCheckUpdateShipsEvents(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.eventLog, _ = NewEventLog(uh.Store, "", 100)
+	uh.settings.EventLogShippingEnabled = true
+
+	reporter := &logReporter{}
+	uh.Reporter = reporter
+
+	uh.recordState(NewIdleState())
+
+	var data struct {
+		Retries int `json:"retries"`
+		metadata.FirmwareMetadata
+	}
+
+	data.FirmwareMetadata = uh.FirmwareMetadata
+
+	um := &updatermock.UpdaterMock{}
+	um.On("CheckUpdate", uh.API.Request(), client.UpgradesEndpoint, data).Return(nil, time.Duration(0), nil)
+
+	uh.Updater = um
+
+	updateMetadata, _ := uh.CheckUpdate(context.Background(), 0)
+	assert.Nil(t, updateMetadata)
+
+	assert.Equal(t, 1, len(reporter.batches))
+	assert.Empty(t, uh.eventLog.Events())
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestUpdateHubEventLog(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	// there is no log until the settings are loaded
+	assert.Equal(t, []Event{}, uh.EventLog())
+
+	uh.eventLog, _ = NewEventLog(uh.Store, "", 100)
+
+	uh.recordState(NewIdleState())
+
+	events := uh.EventLog()
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "idle", events[0].State)
+}
+
+func TestReportCurrentStateWithError(t *testing.T) {
+	m := &metadata.UpdateMetadata{RawBytes: []byte("{}")}
+
+	testCases := []struct {
+		name            string
+		attach          bool
+		expectedEntries interface{}
+	}{
+		{"WithoutEventLog", false, nil},
+		{"WithEventLog", true, []Event{{Type: "state", State: "idle"}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := NewErrorState(m, NewTransientError(errors.New("install failed")))
+
+			uh, _ := newTestUpdateHub(state, nil)
+			uh.eventLog, _ = NewEventLog(uh.Store, "", 100)
+			uh.settings.EventLogAttachToErrorReports = tc.attach
+
+			uh.eventLog.Add(Event{Type: "state", State: "idle"})
+
+			reporter := &errorReporter{}
+			uh.Reporter = reporter
+
+			err := uh.ReportCurrentState()
+			assert.NoError(t, err)
+
+			assert.Equal(t, []string{m.PackageUID() + ":error"}, reporter.reports)
+			assert.Equal(t, "transient error: install failed", reporter.message)
+			assert.Equal(t, queued(t, tc.expectedEntries), reporter.entries)
+		})
+	}
+}
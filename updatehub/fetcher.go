@@ -0,0 +1,339 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+// FetcherCommand is the argument which makes the agent to run as the
+// unprivileged fetcher, serving the requests at the standard input
+const FetcherCommand = "fetcher"
+
+// CheckUpdateArgs are the arguments of the Fetcher.CheckUpdate call
+type CheckUpdateArgs struct {
+	Retries          int
+	FirmwareMetadata metadata.FirmwareMetadata
+	// Server overrides the configured servers when it isn't empty
+	Server string
+}
+
+// CheckUpdateReply is the reply of the Fetcher.CheckUpdate call, the
+// metadata is empty when there is no update
+type CheckUpdateReply struct {
+	RawMetadata []byte
+	Signature   []byte
+	ExtraPoll   time.Duration
+
+	// the polling interval told by the server, if PollingIntervalSet
+	PollingInterval    time.Duration
+	PollingIntervalSet bool
+}
+
+// FetchUpdateArgs are the arguments of the Fetcher.FetchUpdate call
+type FetchUpdateArgs struct {
+	RawMetadata []byte
+	Signature   []byte
+	// FirmwareMetadata is the identity of the device, the fetcher
+	// has none of its own and needs it to build the object URIs
+	FirmwareMetadata metadata.FirmwareMetadata
+	// Server overrides the configured servers when it isn't empty
+	Server string
+}
+
+// Fetcher is served by the unprivileged half of the agent. It talks to
+// the server and downloads the objects, the privileged half installs
+// them.
+type Fetcher struct {
+	uh *UpdateHub
+
+	cancel      context.CancelFunc
+	cancelMutex sync.Mutex
+}
+
+// start returns the context of the call being served, it's cancelled
+// by Cancel. The "done" function must be called once the call returns.
+func (f *Fetcher) start() (ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	f.cancelMutex.Lock()
+	f.cancel = cancel
+	f.cancelMutex.Unlock()
+
+	return ctx, func() {
+		f.cancelMutex.Lock()
+		f.cancel = nil
+		f.cancelMutex.Unlock()
+
+		cancel()
+	}
+}
+
+// CheckUpdate asks the server for an update to the given firmware
+func (f *Fetcher) CheckUpdate(args CheckUpdateArgs, reply *CheckUpdateReply) error {
+	var data struct {
+		Retries int `json:"retries"`
+		metadata.FirmwareMetadata
+	}
+
+	data.Retries = args.Retries
+	data.FirmwareMetadata = args.FirmwareMetadata
+
+	f.uh.overrideServer(args.Server)
+
+	ctx, done := f.start()
+	defer done()
+
+	updater := f.uh.updater()
+
+	updateMetadata, extraPoll, err := updater.CheckUpdate(ctx, f.uh.API.Request(), client.UpgradesEndpoint, data)
+	if err != nil {
+		return err
+	}
+
+	reply.ExtraPoll = extraPoll
+
+	if r, ok := updater.(client.PollingIntervalReader); ok {
+		reply.PollingInterval, reply.PollingIntervalSet = r.LastPollingInterval()
+	}
+
+	if um, ok := updateMetadata.(*metadata.UpdateMetadata); ok && um != nil {
+		reply.RawMetadata = um.RawBytes
+		reply.Signature = um.Signature
+	}
+
+	return nil
+}
+
+// FetchUpdate downloads the objects of the update, until it is done
+// or cancelled
+func (f *Fetcher) FetchUpdate(args FetchUpdateArgs, reply *struct{}) error {
+	updateMetadata, err := metadata.NewUpdateMetadata(args.RawMetadata)
+	if err != nil {
+		return err
+	}
+
+	updateMetadata.Signature = args.Signature
+
+	f.uh.firmwareMetadataMutex.Lock()
+	f.uh.FirmwareMetadata = args.FirmwareMetadata
+	f.uh.firmwareMetadataMutex.Unlock()
+
+	f.uh.overrideServer(args.Server)
+
+	ctx, done := f.start()
+	defer done()
+
+	return f.uh.FetchUpdate(ctx, updateMetadata)
+}
+
+// Cancel cancels the update check or the download in progress, if any
+func (f *Fetcher) Cancel(args struct{}, reply *struct{}) error {
+	f.cancelMutex.Lock()
+	defer f.cancelMutex.Unlock()
+
+	if f.cancel != nil {
+		f.cancel()
+	}
+
+	return nil
+}
+
+// ServeFetcher serves the Fetcher calls read from "conn" until it is
+// closed
+func ServeFetcher(uh *UpdateHub, conn io.ReadWriteCloser) error {
+	server := rpc.NewServer()
+
+	err := server.Register(&Fetcher{uh: uh})
+	if err != nil {
+		return err
+	}
+
+	server.ServeCodec(jsonrpc.NewServerCodec(conn))
+
+	return nil
+}
+
+// FetcherController is the Controller of the privileged half of the
+// agent, the update checks and downloads are forwarded to the
+// unprivileged fetcher
+type FetcherController struct {
+	uh     *UpdateHub
+	client *rpc.Client
+}
+
+// NewFetcherController creates a FetcherController talking to the
+// fetcher through "conn"
+func NewFetcherController(uh *UpdateHub, conn io.ReadWriteCloser) *FetcherController {
+	return &FetcherController{
+		uh:     uh,
+		client: rpc.NewClientWithCodec(jsonrpc.NewClientCodec(conn)),
+	}
+}
+
+// call calls "method" of the fetcher, which is told to abort it once
+// "ctx" is cancelled
+func (fc *FetcherController) call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	call := fc.client.Go(method, args, reply, make(chan *rpc.Call, 1))
+
+	cancel := ctx.Done()
+
+	for {
+		select {
+		case <-call.Done:
+			return call.Error
+		case <-cancel:
+			// the call returns once the fetcher aborted it
+			cancel = nil
+
+			err := fc.client.Call("Fetcher.Cancel", struct{}{}, &struct{}{})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// CheckUpdate implementation of the Controller interface
+func (fc *FetcherController) CheckUpdate(ctx context.Context, retries int) (*metadata.UpdateMetadata, time.Duration) {
+	fc.uh.refreshFirmwareMetadata()
+
+	args := CheckUpdateArgs{
+		Retries:          retries,
+		FirmwareMetadata: fc.uh.checkUpdateFirmwareMetadata(),
+		Server:           fc.uh.overriddenServer(),
+	}
+
+	var reply CheckUpdateReply
+
+	err := fc.call(ctx, "Fetcher.CheckUpdate", args, &reply)
+	if err != nil {
+		log.Warn("failed to check for an update through the fetcher: ", err)
+		return nil, -1
+	}
+
+	if reply.PollingIntervalSet {
+		fc.uh.setServerPollingInterval(reply.PollingInterval)
+	}
+
+	// the server is reachable, so it's a good time to ship the events
+	if err = fc.uh.shipEvents(); err != nil {
+		log.Warn("failed to ship the event log: ", err)
+	}
+
+	if len(reply.RawMetadata) == 0 {
+		return nil, reply.ExtraPoll
+	}
+
+	updateMetadata, err := metadata.NewUpdateMetadata(reply.RawMetadata)
+	if err != nil {
+		log.Warn("invalid update metadata from the fetcher: ", err)
+		return nil, -1
+	}
+
+	updateMetadata.Signature = reply.Signature
+
+	return updateMetadata, reply.ExtraPoll
+}
+
+// FetchUpdate implementation of the Controller interface
+func (fc *FetcherController) FetchUpdate(ctx context.Context, updateMetadata *metadata.UpdateMetadata) error {
+	args := FetchUpdateArgs{
+		RawMetadata:      updateMetadata.RawBytes,
+		Signature:        updateMetadata.Signature,
+		FirmwareMetadata: fc.uh.GetFirmwareMetadata(),
+		Server:           fc.uh.overriddenServer(),
+	}
+
+	return fc.call(ctx, "Fetcher.FetchUpdate", args, &struct{}{})
+}
+
+// ReportCurrentState implementation of the Controller interface, the
+// state is known only by the privileged half
+func (fc *FetcherController) ReportCurrentState() error {
+	return fc.uh.ReportCurrentState()
+}
+
+// fetcherProcess is the connection to the standard input and output
+// of the fetcher process
+type fetcherProcess struct {
+	io.Reader
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (p *fetcherProcess) Close() error {
+	p.WriteCloser.Close()
+	return p.cmd.Wait()
+}
+
+// SetupPrivilegeSeparation starts "executable" as the fetcher, run
+// by the "User" of the privilege separation settings, and makes it to
+// check for updates and to download them. It does nothing unless the
+// privilege separation is enabled.
+func (uh *UpdateHub) SetupPrivilegeSeparation(executable string) error {
+	if !uh.settings.PrivilegeSeparationEnabled {
+		return nil
+	}
+
+	u, err := user.Lookup(uh.settings.PrivilegeSeparationUser)
+	if err != nil {
+		return err
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return err
+	}
+
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(executable, FetcherCommand)
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+		Pdeathsig:  syscall.SIGTERM,
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start the fetcher: %s", err)
+	}
+
+	uh.Controller = NewFetcherController(uh, &fetcherProcess{Reader: stdout, WriteCloser: stdin, cmd: cmd})
+
+	return nil
+}
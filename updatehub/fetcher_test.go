@@ -0,0 +1,245 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/copy"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/updatermock"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// newTestFetcherController returns a controller of "uh" talking to a
+// fetcher served by "fetcherUH"
+func newTestFetcherController(uh *UpdateHub, fetcherUH *UpdateHub) *FetcherController {
+	parent, child := net.Pipe()
+
+	go ServeFetcher(fetcherUH, child)
+
+	return NewFetcherController(uh, parent)
+}
+
+func TestFetcherControllerCheckUpdate(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	testCases := []struct {
+		name              string
+		updateMetadata    string
+		extraPoll         time.Duration
+		expectedExtraPoll time.Duration
+		server            string
+	}{
+		{"WithUpdate", validUpdateMetadata, 13, 13, ""},
+		{"WithoutUpdate", "", 13, 13, ""},
+		{"WithServer", validUpdateMetadata, 13, 13, "commissioning:8080"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			uh, _ := newTestUpdateHub(&PollState{}, nil)
+			fetcherUH, _ := newTestUpdateHub(nil, nil)
+
+			var data struct {
+				Retries int `json:"retries"`
+				metadata.FirmwareMetadata
+			}
+
+			data.FirmwareMetadata = uh.FirmwareMetadata
+			data.Retries = 2
+
+			var updateMetadata interface{}
+			if tc.updateMetadata != "" {
+				um, err := metadata.NewUpdateMetadata([]byte(tc.updateMetadata))
+				assert.NoError(t, err)
+
+				updateMetadata = um
+			}
+
+			um := &updatermock.UpdaterMock{}
+			um.On("CheckUpdate", fetcherUH.API.Request(), client.UpgradesEndpoint, data).Return(updateMetadata, tc.extraPoll, nil)
+			fetcherUH.Updater = um
+
+			uh.API.OverrideServer(tc.server)
+
+			fc := newTestFetcherController(uh, fetcherUH)
+
+			received, extraPoll := fc.CheckUpdate(context.Background(), 2)
+			assert.Equal(t, tc.server, fetcherUH.API.OverriddenServer())
+
+			if updateMetadata == nil {
+				assert.Nil(t, received)
+			} else {
+				assert.Equal(t, updateMetadata, received)
+			}
+
+			assert.Equal(t, tc.expectedExtraPoll, extraPoll)
+
+			um.AssertExpectations(t)
+		})
+	}
+}
+
+func TestFetcherControllerCheckUpdateWithError(t *testing.T) {
+	uh, _ := newTestUpdateHub(&PollState{}, nil)
+	fetcherUH, _ := newTestUpdateHub(nil, nil)
+
+	var data struct {
+		Retries int `json:"retries"`
+		metadata.FirmwareMetadata
+	}
+
+	data.FirmwareMetadata = uh.FirmwareMetadata
+
+	um := &updatermock.UpdaterMock{}
+	um.On("CheckUpdate", fetcherUH.API.Request(), client.UpgradesEndpoint, data).Return(nil, time.Duration(0), fmt.Errorf("server unreachable"))
+	fetcherUH.Updater = um
+
+	fc := newTestFetcherController(uh, fetcherUH)
+
+	updateMetadata, extraPoll := fc.CheckUpdate(context.Background(), 0)
+	assert.Nil(t, updateMetadata)
+	assert.Equal(t, time.Duration(-1), extraPoll)
+
+	um.AssertExpectations(t)
+}
+
+func TestFetcherControllerFetchUpdateWithCancel(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	aim.On("Active").Return(1, nil)
+
+	uh, _ := newTestUpdateHub(&PollState{}, nil)
+	fetcherUH, _ := newTestUpdateHub(nil, aim)
+	// like runFetcher, the fetcher doesn't load the firmware metadata
+	fetcherUH.FirmwareMetadata = metadata.FirmwareMetadata{}
+	fetcherUH.CopyBackend = copy.ExtendedIO{}
+	fetcherUH.settings.DownloadConcurrency = 2
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validUpdateMetadataWithActiveInactive))
+	assert.NoError(t, err)
+
+	packageUID := utils.DataSha256sum([]byte(validUpdateMetadataWithActiveInactive))
+
+	um := &updatermock.UpdaterMock{}
+
+	started := make(chan bool, 2)
+
+	for _, obj := range updateMetadata.Objects[0] {
+		objectUID := obj.GetObjectMetadata().Sha256sum
+
+		// never written, so the download blocks until it is cancelled
+		rd, wr := io.Pipe()
+		defer wr.Close()
+
+		uri := path.Join("/", uh.FirmwareMetadata.ProductUID, packageUID, objectUID)
+		um.On("FetchUpdate", fetcherUH.API.Request(), uri, int64(0)).Return(rd, int64(-1), nil).Run(func(args mock.Arguments) {
+			started <- true
+		})
+	}
+
+	fetcherUH.Updater = um
+
+	fc := newTestFetcherController(uh, fetcherUH)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		<-started
+		<-started
+		cancel()
+	}()
+
+	err = fc.FetchUpdate(ctx, updateMetadata)
+	assert.NoError(t, err)
+
+	// the partial objects are kept by the fetcher
+	for _, obj := range updateMetadata.Objects[0] {
+		markerPath := path.Join(fetcherUH.settings.DownloadDir, obj.GetObjectMetadata().Sha256sum+partialDownloadSuffix)
+
+		exists, err := afero.Exists(fetcherUH.Store, markerPath)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	}
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestFetcherControllerFetchUpdateWithInvalidMetadata(t *testing.T) {
+	uh, _ := newTestUpdateHub(&PollState{}, nil)
+	fetcherUH, _ := newTestUpdateHub(nil, nil)
+
+	fc := newTestFetcherController(uh, fetcherUH)
+
+	err := fc.FetchUpdate(context.Background(), &metadata.UpdateMetadata{RawBytes: []byte("{")})
+	assert.EqualError(t, err, "unexpected end of JSON input")
+}
+
+func TestSetupPrivilegeSeparationWhenDisabled(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.Controller = uh
+
+	err := uh.SetupPrivilegeSeparation("/nonexistent")
+	assert.NoError(t, err)
+	assert.Equal(t, uh, uh.Controller)
+}
+
+func TestSetupPrivilegeSeparationWithUnknownUser(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.Controller = uh
+	uh.settings.PrivilegeSeparationEnabled = true
+	uh.settings.PrivilegeSeparationUser = "updatehub-nonexistent-user"
+
+	err := uh.SetupPrivilegeSeparation("/nonexistent")
+	assert.EqualError(t, err, "user: unknown user updatehub-nonexistent-user")
+	assert.Equal(t, uh, uh.Controller)
+}
+
+func TestPrivilegedHalfDoesNotTrustTheFetcherDigests(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.Controller = uh
+	uh.settings.DownloadDir = "/download"
+
+	// the digest of the fetcher claims a content other than the
+	// downloaded one
+	expectedSha256sum := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	objectPath := path.Join("/download", expectedSha256sum)
+
+	err := afero.WriteFile(uh.Store, objectPath, []byte("tset"), 0666)
+	assert.NoError(t, err)
+
+	err = afero.WriteFile(uh.Store, objectPath+downloadDigestSuffix, []byte(`{"sha256sum":"`+expectedSha256sum+`","size":4}`), 0666)
+	assert.NoError(t, err)
+
+	assert.True(t, uh.reusableObject(expectedSha256sum))
+
+	uh.Controller = newTestFetcherController(uh, uh)
+
+	assert.False(t, uh.reusableObject(expectedSha256sum))
+
+	err = uh.sha256Checker().CheckDownloadedObjectSha256sum(uh.Store, "/download", expectedSha256sum)
+	assert.Error(t, err)
+}
@@ -0,0 +1,392 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/client"
+)
+
+// gatewayReportQueueFileName is the file, inside the gateway cache
+// dir, which keeps the reports of the downstream agents not sent yet
+const gatewayReportQueueFileName = "report-queue.json"
+
+// gateway holds the state of the gateway mode
+type gateway struct {
+	caching      map[string]bool // the objects being cached
+	cachingMutex sync.Mutex
+	reports      reportQueue
+}
+
+// StartGateway serves, if enabled, the downstream agents through
+// "handler", see GatewaySettings. The objects left half cached by a
+// previous run are removed.
+func (uh *UpdateHub) StartGateway(handler http.Handler) error {
+	s := uh.settings.GatewaySettings
+
+	if !s.GatewayEnabled {
+		return nil
+	}
+
+	config, err := uh.gatewayTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	err = uh.Store.MkdirAll(s.GatewayCacheDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	uh.removePartialGatewayObjects()
+	uh.evictGatewayObjects()
+
+	listener, err := net.Listen("tcp", s.GatewayListenAddress)
+	if err != nil {
+		return err
+	}
+
+	listener = tls.NewListener(listener, config)
+
+	go func() {
+		if err := http.Serve(listener, handler); err != nil {
+			log.Error("the downstream agents aren't served anymore: ", err)
+		}
+	}()
+
+	return nil
+}
+
+// gatewayTLSConfig returns the TLS config of the gateway, which only
+// accepts the downstream agents whose client certificate is signed by
+// the "ClientCACertificate"
+func (uh *UpdateHub) gatewayTLSConfig() (*tls.Config, error) {
+	s := uh.settings.GatewaySettings
+
+	if s.GatewayCertificatePath == "" || s.GatewayClientCACertificatePath == "" {
+		return nil, errors.New("the gateway requires a certificate and the CA of the downstream agents")
+	}
+
+	config, err := client.NewTLSConfig(uh.Store, s.GatewayCertificatePath, s.GatewayKeyPath, s.GatewayClientCACertificatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	config.ClientCAs = config.RootCAs
+	config.RootCAs = nil
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return config, nil
+}
+
+// GatewayCheckUpdate forwards the update check "request" of a
+// downstream agent to the server
+func (uh *UpdateHub) GatewayCheckUpdate(request []byte) (*client.ForwardedUpdate, error) {
+	forwarder, ok := uh.Updater.(client.UpdateForwarder)
+	if !ok {
+		return nil, errors.New("the update checks can't be forwarded")
+	}
+
+	update, err := forwarder.ForwardCheckUpdate(uh.API.Request(), client.UpgradesEndpoint, json.RawMessage(request))
+	if err != nil {
+		return nil, err
+	}
+
+	// the server is reachable, so it's a good time to send the
+	// queued reports
+	uh.flushGatewayReports()
+
+	return update, nil
+}
+
+// GatewayReport forwards the "report" of a downstream agent to the
+// server. The reports which can't be sent are queued and sent, in
+// order, once the server is reachable again. Only the latest
+// "MaxQueuedReports" are kept.
+func (uh *UpdateHub) GatewayReport(report []byte) error {
+	if !json.Valid(report) {
+		return errors.New("the report isn't valid JSON")
+	}
+
+	queue := uh.openGatewayReportQueue()
+	queue.push(json.RawMessage(report))
+	queue.send(uh.forwardReport)
+
+	return queue.close()
+}
+
+// QueuedGatewayReports returns how many reports of the downstream
+// agents are waiting to be sent
+func (uh *UpdateHub) QueuedGatewayReports() int {
+	queue := uh.openGatewayReportQueue()
+	defer queue.close()
+
+	return len(queue.reports)
+}
+
+// flushGatewayReports sends the queued reports, the failure is only
+// logged
+func (uh *UpdateHub) flushGatewayReports() {
+	queue := uh.openGatewayReportQueue()
+	queue.send(uh.forwardReport)
+
+	if err := queue.close(); err != nil {
+		log.Warn("failed to write the queued reports: ", err)
+	}
+}
+
+func (uh *UpdateHub) openGatewayReportQueue() *openReportQueue {
+	return uh.gateway.reports.open(uh.Store, path.Join(uh.settings.GatewayCacheDir, gatewayReportQueueFileName), uh.settings.GatewayMaxQueuedReports)
+}
+
+// forwardReport sends "report" of a downstream agent to the server
+func (uh *UpdateHub) forwardReport(report json.RawMessage) error {
+	forwarder, ok := uh.Reporter.(client.ReportForwarder)
+	if !ok {
+		return errors.New("the reports can't be forwarded")
+	}
+
+	return forwarder.ForwardReport(uh.API.Request(), report)
+}
+
+// CachedGatewayObject opens the object "objectUID" if it's cached. It
+// becomes the most recently served one, the last to be evicted.
+func (uh *UpdateHub) CachedGatewayObject(objectUID string) (afero.File, error) {
+	if !isObjectUID(objectUID) {
+		return nil, os.ErrNotExist
+	}
+
+	objectPath := path.Join(uh.settings.GatewayCacheDir, objectUID)
+
+	file, err := uh.Store.Open(objectPath)
+	if err != nil {
+		return nil, err
+	}
+
+	now := uh.clock().Now()
+	uh.Store.Chtimes(objectPath, now, now)
+
+	return file, nil
+}
+
+// evictGatewayObjects removes the cached objects, least recently
+// served first, while the cache holds more than "MaxCacheSize" bytes
+func (uh *UpdateHub) evictGatewayObjects() {
+	max := uh.settings.GatewayMaxCacheSize
+	if max <= 0 {
+		return
+	}
+
+	files, err := afero.ReadDir(uh.Store, uh.settings.GatewayCacheDir)
+	if err != nil {
+		log.Warn("failed to read the gateway cache: ", err)
+		return
+	}
+
+	objects := []os.FileInfo{}
+
+	var total int64
+
+	for _, f := range files {
+		if f.Mode().IsRegular() && isObjectUID(f.Name()) {
+			objects = append(objects, f)
+			total += f.Size()
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].ModTime().Before(objects[j].ModTime())
+	})
+
+	for _, f := range objects {
+		if total <= max {
+			break
+		}
+
+		err := uh.Store.Remove(path.Join(uh.settings.GatewayCacheDir, f.Name()))
+		if err != nil {
+			log.Warn(fmt.Sprintf("failed to evict the object '%s' from the gateway cache: %s", f.Name(), err))
+			continue
+		}
+
+		log.Debug(fmt.Sprintf("the object '%s' was evicted from the gateway cache", f.Name()))
+
+		total -= f.Size()
+	}
+}
+
+// removePartialGatewayObjects removes the objects left half cached
+func (uh *UpdateHub) removePartialGatewayObjects() {
+	files, err := afero.ReadDir(uh.Store, uh.settings.GatewayCacheDir)
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), partialDownloadSuffix) {
+			uh.Store.Remove(path.Join(uh.settings.GatewayCacheDir, f.Name()))
+		}
+	}
+}
+
+// FetchGatewayObject fetches, from "offset", the object "objectUID"
+// of the package "packageUID" of the product "productUID" from the
+// server and returns its body and length. The object is cached while
+// it's read when fetched from its start, it's kept once the whole
+// object is read and matches its sha256sum.
+func (uh *UpdateHub) FetchGatewayObject(productUID string, packageUID string, objectUID string, offset int64) (io.ReadCloser, int64, error) {
+	if !isObjectUID(objectUID) {
+		return nil, -1, fmt.Errorf("invalid object '%s'", objectUID)
+	}
+
+	// the body outlives this call, it's read by the downstream agent
+	body, contentLength, err := uh.Updater.FetchUpdate(context.Background(), uh.API.Request(), path.Join("/", productUID, packageUID, objectUID), offset)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	// the object is already being cached by another request
+	if offset > 0 || !uh.gateway.startCaching(objectUID) {
+		return body, contentLength, nil
+	}
+
+	partialPath := path.Join(uh.settings.GatewayCacheDir, objectUID+partialDownloadSuffix)
+
+	file, err := uh.Store.Create(partialPath)
+	if err != nil {
+		log.Warn(fmt.Sprintf("the object '%s' won't be cached: %s", objectUID, err))
+		uh.gateway.stopCaching(objectUID)
+		return body, contentLength, nil
+	}
+
+	return &cachingReader{ReadCloser: body, uh: uh, objectUID: objectUID, file: file, hash: sha256.New()}, contentLength, nil
+}
+
+// startCaching tells whether "objectUID" can be cached, which is the
+// case if no other request is caching it
+func (g *gateway) startCaching(objectUID string) bool {
+	g.cachingMutex.Lock()
+	defer g.cachingMutex.Unlock()
+
+	if g.caching == nil {
+		g.caching = map[string]bool{}
+	}
+
+	if g.caching[objectUID] {
+		return false
+	}
+
+	g.caching[objectUID] = true
+
+	return true
+}
+
+func (g *gateway) stopCaching(objectUID string) {
+	g.cachingMutex.Lock()
+	defer g.cachingMutex.Unlock()
+
+	delete(g.caching, objectUID)
+}
+
+// cachingReader writes the object it reads to the cache
+type cachingReader struct {
+	io.ReadCloser
+
+	uh        *UpdateHub
+	objectUID string
+	file      afero.File // nil once the object is cached or discarded
+	hash      hash.Hash
+	closed    bool
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+
+	if n > 0 && r.file != nil {
+		if _, werr := r.file.Write(p[:n]); werr != nil {
+			log.Warn(fmt.Sprintf("the object '%s' won't be cached: %s", r.objectUID, werr))
+			r.discard()
+		} else {
+			r.hash.Write(p[:n])
+		}
+	}
+
+	if err == io.EOF && r.file != nil {
+		r.commit()
+	}
+
+	return n, err
+}
+
+func (r *cachingReader) Close() error {
+	if r.closed {
+		return nil
+	}
+
+	r.closed = true
+
+	// the object wasn't read to its end
+	if r.file != nil {
+		r.discard()
+	}
+
+	r.uh.gateway.stopCaching(r.objectUID)
+
+	return r.ReadCloser.Close()
+}
+
+// commit keeps the object in the cache if it matches its sha256sum
+func (r *cachingReader) commit() {
+	partialPath := r.file.Name()
+
+	r.file.Close()
+	r.file = nil
+
+	if hex.EncodeToString(r.hash.Sum(nil)) != r.objectUID {
+		log.Warn(fmt.Sprintf("the object '%s' isn't cached since it doesn't match its sha256sum", r.objectUID))
+		r.uh.Store.Remove(partialPath)
+		return
+	}
+
+	err := r.uh.Store.Rename(partialPath, path.Join(r.uh.settings.GatewayCacheDir, r.objectUID))
+	if err != nil {
+		log.Warn(fmt.Sprintf("failed to cache the object '%s': %s", r.objectUID, err))
+		r.uh.Store.Remove(partialPath)
+		return
+	}
+
+	r.uh.evictGatewayObjects()
+}
+
+func (r *cachingReader) discard() {
+	partialPath := r.file.Name()
+
+	r.file.Close()
+	r.file = nil
+
+	r.uh.Store.Remove(partialPath)
+}
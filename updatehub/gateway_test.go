@@ -0,0 +1,409 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/client"
+)
+
+// gatewayTestServer is the server upstream of the gateway
+type gatewayTestServer struct {
+	*httptest.Server
+
+	offline bool
+	reports []string
+	mutex   sync.Mutex
+}
+
+func newGatewayTestServer(t *testing.T) *gatewayTestServer {
+	s := &gatewayTestServer{}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		if s.offline {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		switch r.URL.Path {
+		case client.UpgradesEndpoint:
+			w.Header().Set(client.SignatureHeader, "c2lnbmF0dXJl")
+			fmt.Fprint(w, `{"product-uid": "0123456789"}`)
+		case client.StateReportEndpoint:
+			s.reports = append(s.reports, string(body))
+		case path.Join("/0123456789", "package", testObjectUID):
+			fmt.Fprint(w, "test")
+		case path.Join("/0123456789", "package", olderObjectUID):
+			fmt.Fprint(w, "corrupted")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	return s
+}
+
+func (s *gatewayTestServer) setOffline(offline bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.offline = offline
+}
+
+func newGatewayTestUpdateHub(t *testing.T, s *gatewayTestServer) *UpdateHub {
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	uh.API = client.NewApiClient(u.Host)
+	uh.Updater = client.NewUpdateClient()
+	uh.Reporter = client.NewReportClient()
+	uh.settings.GatewayCacheDir = "/cache"
+
+	err = uh.Store.MkdirAll(uh.settings.GatewayCacheDir, 0755)
+	assert.NoError(t, err)
+
+	return uh
+}
+
+func TestGatewayCheckUpdate(t *testing.T) {
+	s := newGatewayTestServer(t)
+	defer s.Close()
+
+	uh := newGatewayTestUpdateHub(t, s)
+
+	update, err := uh.GatewayCheckUpdate([]byte(`{"product-uid": "0123456789"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, &client.ForwardedUpdate{Metadata: []byte(`{"product-uid": "0123456789"}`), Signature: "c2lnbmF0dXJl"}, update)
+
+	s.setOffline(true)
+
+	_, err = uh.GatewayCheckUpdate([]byte(`{}`))
+	assert.Error(t, err)
+}
+
+func TestGatewayReportIsQueuedWhileOffline(t *testing.T) {
+	s := newGatewayTestServer(t)
+	defer s.Close()
+
+	uh := newGatewayTestUpdateHub(t, s)
+	uh.settings.GatewayMaxQueuedReports = 2
+
+	s.setOffline(true)
+
+	for _, state := range []string{"downloading", "downloaded", "installing"} {
+		err := uh.GatewayReport([]byte(fmt.Sprintf(`{"status":"%s"}`, state)))
+		assert.NoError(t, err)
+	}
+
+	// the oldest report was dropped
+	assert.Equal(t, 2, uh.QueuedGatewayReports())
+
+	s.setOffline(false)
+
+	err := uh.GatewayReport([]byte(`{"status":"installed"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, uh.QueuedGatewayReports())
+	assert.Equal(t, []string{`{"status":"downloaded"}`, `{"status":"installing"}`, `{"status":"installed"}`}, s.reports)
+
+	exists, err := afero.Exists(uh.Store, path.Join(uh.settings.GatewayCacheDir, gatewayReportQueueFileName))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	err = uh.GatewayReport([]byte(`{"status":`))
+	assert.EqualError(t, err, "the report isn't valid JSON")
+}
+
+func TestGatewayCheckUpdateFlushesQueuedReports(t *testing.T) {
+	s := newGatewayTestServer(t)
+	defer s.Close()
+
+	uh := newGatewayTestUpdateHub(t, s)
+
+	s.setOffline(true)
+
+	err := uh.GatewayReport([]byte(`{"status":"installed"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, uh.QueuedGatewayReports())
+
+	s.setOffline(false)
+
+	_, err = uh.GatewayCheckUpdate([]byte(`{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, uh.QueuedGatewayReports())
+	assert.Equal(t, []string{`{"status":"installed"}`}, s.reports)
+}
+
+func TestFetchGatewayObject(t *testing.T) {
+	s := newGatewayTestServer(t)
+	defer s.Close()
+
+	uh := newGatewayTestUpdateHub(t, s)
+
+	_, err := uh.CachedGatewayObject(testObjectUID)
+	assert.Error(t, err)
+
+	body, _, err := uh.FetchGatewayObject("0123456789", "package", testObjectUID, 0)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", string(data))
+	assert.NoError(t, body.Close())
+
+	// served from the cache from now on
+	s.setOffline(true)
+
+	file, err := uh.CachedGatewayObject(testObjectUID)
+	assert.NoError(t, err)
+
+	data, err = ioutil.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", string(data))
+	file.Close()
+
+	_, err = uh.CachedGatewayObject("../etc/passwd")
+	assert.Error(t, err)
+}
+
+func TestFetchGatewayObjectNotCached(t *testing.T) {
+	s := newGatewayTestServer(t)
+	defer s.Close()
+
+	uh := newGatewayTestUpdateHub(t, s)
+
+	// it doesn't match its sha256sum
+	body, _, err := uh.FetchGatewayObject("0123456789", "package", olderObjectUID, 0)
+	assert.NoError(t, err)
+
+	_, err = ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.NoError(t, body.Close())
+
+	_, err = uh.CachedGatewayObject(olderObjectUID)
+	assert.Error(t, err)
+
+	// it wasn't read to its end
+	body, _, err = uh.FetchGatewayObject("0123456789", "package", testObjectUID, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, body.Close())
+
+	_, err = uh.CachedGatewayObject(testObjectUID)
+	assert.Error(t, err)
+
+	// only the whole objects are cached
+	body, _, err = uh.FetchGatewayObject("0123456789", "package", testObjectUID, 2)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, "st", string(data))
+	assert.NoError(t, body.Close())
+
+	_, err = uh.CachedGatewayObject(testObjectUID)
+	assert.Error(t, err)
+
+	files, err := afero.ReadDir(uh.Store, uh.settings.GatewayCacheDir)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(files))
+}
+
+func TestEvictGatewayObjects(t *testing.T) {
+	s := newGatewayTestServer(t)
+	defer s.Close()
+
+	uh := newGatewayTestUpdateHub(t, s)
+	uh.settings.GatewayMaxCacheSize = 8
+
+	now := time.Now()
+
+	uids := []string{strings.Repeat("1", 64), strings.Repeat("2", 64), strings.Repeat("3", 64)}
+
+	for i, uid := range uids {
+		objectPath := path.Join(uh.settings.GatewayCacheDir, uid)
+
+		err := afero.WriteFile(uh.Store, objectPath, []byte("test"), 0644)
+		assert.NoError(t, err)
+
+		err = uh.Store.Chtimes(objectPath, now.Add(time.Duration(i)*time.Minute), now.Add(time.Duration(i)*time.Minute))
+		assert.NoError(t, err)
+	}
+
+	// the queued reports aren't evicted
+	err := afero.WriteFile(uh.Store, path.Join(uh.settings.GatewayCacheDir, gatewayReportQueueFileName), []byte("[]"), 0644)
+	assert.NoError(t, err)
+
+	uh.Clock = &testClock{now: now.Add(time.Hour)}
+
+	// the oldest one is served, so it becomes the most recent
+	file, err := uh.CachedGatewayObject(uids[0])
+	assert.NoError(t, err)
+	file.Close()
+
+	uh.evictGatewayObjects()
+
+	for i, exists := range []bool{true, false, true} {
+		ok, err := afero.Exists(uh.Store, path.Join(uh.settings.GatewayCacheDir, uids[i]))
+		assert.NoError(t, err)
+		assert.Equal(t, exists, ok)
+	}
+
+	ok, err := afero.Exists(uh.Store, path.Join(uh.settings.GatewayCacheDir, gatewayReportQueueFileName))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+// generateGatewayCertificate creates a certificate signed by "parent",
+// or a self-signed CA if "parent" is nil, and writes it and its key
+// to "certPath" and "keyPath"
+func generateGatewayCertificate(t *testing.T, fs afero.Fs, parent *tls.Certificate, certPath string, keyPath string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "gateway"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+
+	parentCert := template
+	var parentKey interface{} = key
+
+	if parent != nil {
+		parentCert, err = x509.ParseCertificate(parent.Certificate[0])
+		assert.NoError(t, err)
+		parentKey = parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	assert.NoError(t, afero.WriteFile(fs, certPath, certPEM, 0644))
+	assert.NoError(t, afero.WriteFile(fs, keyPath, keyPEM, 0600))
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.NoError(t, err)
+
+	return cert
+}
+
+func TestStartGatewayAuthenticatesTheAgents(t *testing.T) {
+	s := newGatewayTestServer(t)
+	defer s.Close()
+
+	uh := newGatewayTestUpdateHub(t, s)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := l.Addr().String()
+	l.Close()
+
+	uh.settings.GatewayEnabled = true
+	uh.settings.GatewayListenAddress = address
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "served")
+	})
+
+	err = uh.StartGateway(handler)
+	assert.EqualError(t, err, "the gateway requires a certificate and the CA of the downstream agents")
+
+	ca := generateGatewayCertificate(t, uh.Store, nil, "/ca.crt", "/ca.key")
+	generateGatewayCertificate(t, uh.Store, &ca, "/gateway.crt", "/gateway.key")
+	agent := generateGatewayCertificate(t, uh.Store, &ca, "/agent.crt", "/agent.key")
+	stranger := generateGatewayCertificate(t, uh.Store, nil, "/stranger.crt", "/stranger.key")
+
+	uh.settings.GatewayCertificatePath = "/gateway.crt"
+	uh.settings.GatewayKeyPath = "/gateway.key"
+	uh.settings.GatewayClientCACertificatePath = "/ca.crt"
+
+	// left by a previous run
+	partialPath := path.Join(uh.settings.GatewayCacheDir, testObjectUID+partialDownloadSuffix)
+	assert.NoError(t, afero.WriteFile(uh.Store, partialPath, []byte("te"), 0644))
+
+	err = uh.StartGateway(handler)
+	assert.NoError(t, err)
+
+	exists, err := afero.Exists(uh.Store, partialPath)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	assert.NoError(t, err)
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(caCert)
+
+	get := func(certificates []tls.Certificate) (string, error) {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      caPool,
+			Certificates: certificates,
+		}}}
+
+		r, err := c.Get("https://" + address + "/")
+		if err != nil {
+			return "", err
+		}
+		defer r.Body.Close()
+
+		body, err := ioutil.ReadAll(r.Body)
+		return string(body), err
+	}
+
+	body, err := get([]tls.Certificate{agent})
+	assert.NoError(t, err)
+	assert.Equal(t, "served", body)
+
+	_, err = get(nil)
+	assert.Error(t, err)
+
+	_, err = get([]tls.Certificate{stranger})
+	assert.Error(t, err)
+}
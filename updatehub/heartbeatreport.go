@@ -0,0 +1,95 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"time"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// heartbeatReport tells the server the agent is alive, so a device
+// idle for days isn't taken for a dead one, see HeartbeatSettings
+type heartbeatReport struct {
+	metadata.FirmwareMetadata
+	Time          time.Time `json:"time"`
+	State         string    `json:"state"`
+	Uptime        int64     `json:"uptime,omitempty"`          // in seconds
+	FreeDiskSpace uint64    `json:"free-disk-space,omitempty"` // at the download dir
+}
+
+// currentHeartbeatReport describes the device as it's now, the health
+// figures which can't be read are left out
+func (uh *UpdateHub) currentHeartbeatReport() *heartbeatReport {
+	r := &heartbeatReport{
+		FirmwareMetadata: uh.checkUpdateFirmwareMetadata(),
+		Time:             uh.clock().Now(),
+	}
+
+	if state := uh.CurrentState(); state != nil {
+		r.State = StateToString(state.ID())
+	}
+
+	uptime, err := utils.Uptime(uh.Store)
+	if err != nil {
+		log.Debug("failed to read the uptime: ", err)
+	} else {
+		r.Uptime = int64(uptime / time.Second)
+	}
+
+	free, err := utils.FreeSpace(uh.settings.DownloadDir)
+	if err != nil {
+		log.Debug("failed to read the free disk space: ", err)
+	} else {
+		r.FreeDiskSpace = free
+	}
+
+	return r
+}
+
+// reportHeartbeat sends the heartbeat, if the reporter is able to
+func (uh *UpdateHub) reportHeartbeat() error {
+	reporter, ok := uh.Reporter.(client.HeartbeatReporter)
+	if !ok {
+		return nil
+	}
+
+	return reporter.ReportHeartbeat(uh.API.Request(), uh.currentHeartbeatReport())
+}
+
+// startHeartbeatReports sends the heartbeat every "interval" while the
+// daemon runs, regardless of its state. The returned function stops
+// them.
+func (d *Daemon) startHeartbeatReports(interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan bool)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := d.uh.reportHeartbeat(); err != nil {
+					log.Warn("failed to report the heartbeat: ", err)
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,122 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bouk/monkey"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+type heartbeatReporter struct {
+	recordingReporter
+
+	heartbeats chan interface{}
+}
+
+func (r *heartbeatReporter) ReportHeartbeat(api client.ApiRequester, heartbeat interface{}) error {
+	r.heartbeats <- heartbeat
+	return nil
+}
+
+func TestReportHeartbeat(t *testing.T) {
+	uh, err := newTestUpdateHub(NewIdleState(), nil)
+	assert.NoError(t, err)
+
+	now := time.Date(2017, time.June, 1, 10, 0, 0, 0, time.UTC)
+	uh.Clock = &testClock{now: now}
+	uh.FirmwareMetadata = metadata.FirmwareMetadata{ProductUID: "productuid", Version: "1.0"}
+
+	err = afero.WriteFile(uh.Store, "/proc/uptime", []byte("3600.52 1000.00\n"), 0444)
+	assert.NoError(t, err)
+
+	guard := monkey.Patch(utils.FreeSpace, func(path string) (uint64, error) {
+		return 4096, nil
+	})
+	defer guard.Unpatch()
+
+	reporter := &heartbeatReporter{heartbeats: make(chan interface{}, 1)}
+	uh.Reporter = reporter
+
+	assert.NoError(t, uh.reportHeartbeat())
+
+	expected := &heartbeatReport{
+		FirmwareMetadata: metadata.FirmwareMetadata{ProductUID: "productuid", Version: "1.0"},
+		Time:             now,
+		State:            "idle",
+		Uptime:           3600,
+		FreeDiskSpace:    4096,
+	}
+
+	assert.Equal(t, expected, <-reporter.heartbeats)
+}
+
+func TestReportHeartbeatWithoutHealth(t *testing.T) {
+	uh, err := newTestUpdateHub(NewIdleState(), nil)
+	assert.NoError(t, err)
+
+	guard := monkey.Patch(utils.FreeSpace, func(path string) (uint64, error) {
+		return 0, errors.New("statfs failed")
+	})
+	defer guard.Unpatch()
+
+	reporter := &heartbeatReporter{heartbeats: make(chan interface{}, 1)}
+	uh.Reporter = reporter
+
+	// the agent is alive regardless
+	assert.NoError(t, uh.reportHeartbeat())
+
+	r := (<-reporter.heartbeats).(*heartbeatReport)
+	assert.Equal(t, "idle", r.State)
+	assert.Equal(t, int64(0), r.Uptime)
+	assert.Equal(t, uint64(0), r.FreeDiskSpace)
+}
+
+func TestReportHeartbeatWithoutHeartbeatReporter(t *testing.T) {
+	uh, err := newTestUpdateHub(NewIdleState(), nil)
+	assert.NoError(t, err)
+
+	uh.Reporter = &recordingReporter{}
+
+	assert.NoError(t, uh.reportHeartbeat())
+}
+
+func TestStartHeartbeatReports(t *testing.T) {
+	uh, err := newTestUpdateHub(NewIdleState(), nil)
+	assert.NoError(t, err)
+
+	reporter := &heartbeatReporter{heartbeats: make(chan interface{}, 10)}
+	uh.Reporter = reporter
+
+	d := NewDaemon(uh)
+
+	stop := d.startHeartbeatReports(10 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-reporter.heartbeats:
+		case <-time.After(time.Second):
+			t.Fatal("the heartbeat wasn't reported")
+		}
+	}
+
+	stop()
+
+	// disabled
+	stop = d.startHeartbeatReports(0)
+	stop()
+}
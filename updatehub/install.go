@@ -0,0 +1,181 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/UpdateHub/updatehub/client"
+)
+
+// installProgressReportStep is the minimum increase of the overall
+// install percentage that is reported to the server
+const installProgressReportStep = 10
+
+// InstallProgress holds the progress of the objects being installed
+type InstallProgress struct {
+	TotalObjects     int   `json:"total-objects"`
+	InstalledObjects int   `json:"installed-objects"`
+	ObjectSize       int64 `json:"object-size"`
+	ObjectInstalled  int64 `json:"object-installed-bytes"`
+	Percentage       int   `json:"percentage"`
+
+	reportedPercentage int
+}
+
+// installProgressSender sends the install progress to the server from
+// its own goroutine, so a slow server doesn't hold the installation
+// back. Only the latest progress not sent yet is kept.
+type installProgressSender struct {
+	mutex      sync.Mutex
+	packageUID string
+	percentage int
+	pending    bool
+	done       chan struct{} // closed once the reports are sent, nil while idle
+}
+
+// InstallProgress returns the progress of the current (or last)
+// installation
+func (uh *UpdateHub) InstallProgress() InstallProgress {
+	uh.installProgressMutex.Lock()
+	defer uh.installProgressMutex.Unlock()
+
+	return uh.installProgress
+}
+
+func (uh *UpdateHub) resetInstallProgress(totalObjects int) {
+	uh.installProgressMutex.Lock()
+	defer uh.installProgressMutex.Unlock()
+
+	uh.installProgress = InstallProgress{TotalObjects: totalObjects}
+}
+
+// setObjectInstallProgress updates the progress of the object being
+// installed. It is used as the handlers.ProgressFunc given to the
+// handlers.
+func (uh *UpdateHub) setObjectInstallProgress(packageUID string, installed int64, total int64) {
+	uh.updateInstallProgress(packageUID, func(p *InstallProgress) {
+		p.ObjectInstalled = installed
+		p.ObjectSize = total
+	})
+}
+
+func (uh *UpdateHub) addInstalledObject(packageUID string) {
+	uh.updateInstallProgress(packageUID, func(p *InstallProgress) {
+		p.InstalledObjects++
+		p.ObjectInstalled = 0
+		p.ObjectSize = 0
+	})
+}
+
+func (uh *UpdateHub) updateInstallProgress(packageUID string, update func(p *InstallProgress)) {
+	uh.heartbeat.beat()
+
+	uh.installProgressMutex.Lock()
+
+	p := &uh.installProgress
+	update(p)
+
+	if p.TotalObjects > 0 {
+		done := float64(p.InstalledObjects)
+		if p.ObjectSize > 0 {
+			done += float64(p.ObjectInstalled) / float64(p.ObjectSize)
+		}
+
+		p.Percentage = int(done * 100 / float64(p.TotalObjects))
+		if p.Percentage > 100 {
+			p.Percentage = 100
+		}
+	}
+
+	report := p.Percentage >= p.reportedPercentage+installProgressReportStep ||
+		(p.Percentage == 100 && p.reportedPercentage < 100)
+	if report {
+		p.reportedPercentage = p.Percentage
+	}
+
+	percentage := p.Percentage
+
+	uh.installProgressMutex.Unlock()
+
+	if report {
+		uh.queueInstallProgress(packageUID, percentage)
+	}
+}
+
+// queueInstallProgress sends "percentage" in the background, replacing
+// the one not sent yet, if any
+func (uh *UpdateHub) queueInstallProgress(packageUID string, percentage int) {
+	s := &uh.installProgressSender
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.packageUID = packageUID
+	s.percentage = percentage
+	s.pending = true
+
+	if s.done == nil {
+		s.done = make(chan struct{})
+		go uh.sendInstallProgress()
+	}
+}
+
+// sendInstallProgress sends the queued progress until there's none left
+func (uh *UpdateHub) sendInstallProgress() {
+	s := &uh.installProgressSender
+
+	for {
+		s.mutex.Lock()
+
+		if !s.pending {
+			close(s.done)
+			s.done = nil
+			s.mutex.Unlock()
+			return
+		}
+
+		packageUID, percentage := s.packageUID, s.percentage
+		s.pending = false
+
+		s.mutex.Unlock()
+
+		uh.reportInstallProgress(packageUID, percentage)
+	}
+}
+
+// flushInstallProgress waits for the queued progress to be sent, so it
+// doesn't reach the server after the state which follows the install
+func (uh *UpdateHub) flushInstallProgress() {
+	s := &uh.installProgressSender
+
+	s.mutex.Lock()
+	done := s.done
+	s.mutex.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// reportInstallProgress sends the install progress to the server when
+// the reporter supports it. Failures are only logged since they must
+// not interrupt the installation.
+func (uh *UpdateHub) reportInstallProgress(packageUID string, percentage int) {
+	reporter, ok := uh.Reporter.(client.ProgressReporter)
+	if !ok {
+		return
+	}
+
+	err := reporter.ReportProgress(uh.API.Request(), packageUID, StateToString(UpdateHubStateInstalling), percentage)
+	if err != nil {
+		log.Warn(fmt.Sprintf("failed to report install progress: %s", err))
+	}
+}
@@ -0,0 +1,236 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/handlers"
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/installifdifferentmock"
+	"github.com/UpdateHub/updatehub/testsmocks/objectmock"
+	"github.com/UpdateHub/updatehub/testsmocks/statesmock"
+)
+
+type progressReporter struct {
+	recordingReporter
+	progress []int
+	sending  chan int      // told each report being sent when not nil
+	hold     chan struct{} // each report waits on it when not nil
+	mutex    sync.Mutex
+}
+
+func (r *progressReporter) ReportProgress(api client.ApiRequester, packageUID string, state string, progress int) error {
+	if r.sending != nil {
+		r.sending <- progress
+	}
+
+	if r.hold != nil {
+		<-r.hold
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.progress = append(r.progress, progress)
+	return nil
+}
+
+func (r *progressReporter) reported() []int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]int{}, r.progress...)
+}
+
+type progressObjectMock struct {
+	objectmock.ObjectMock
+	progress handlers.ProgressFunc
+}
+
+func (om *progressObjectMock) SetProgressFunc(fn handlers.ProgressFunc) {
+	om.progress = fn
+}
+
+func TestUpdateHubInstallProgress(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+
+	reporter := &progressReporter{}
+	uh.Reporter = reporter
+
+	uh.resetInstallProgress(2)
+
+	uh.setObjectInstallProgress("puid", 50, 100)
+	assert.Equal(t, InstallProgress{TotalObjects: 2, ObjectSize: 100, ObjectInstalled: 50, Percentage: 25, reportedPercentage: 25}, uh.InstallProgress())
+	uh.flushInstallProgress()
+
+	// below the report step
+	uh.setObjectInstallProgress("puid", 60, 100)
+
+	uh.addInstalledObject("puid")
+	uh.flushInstallProgress()
+
+	uh.setObjectInstallProgress("puid", 100, 100)
+	uh.flushInstallProgress()
+
+	assert.Equal(t, 100, uh.InstallProgress().Percentage)
+	assert.Equal(t, []int{25, 50, 100}, reporter.reported())
+
+	// "100" must be reported only once
+	uh.addInstalledObject("puid")
+	uh.flushInstallProgress()
+	assert.Equal(t, []int{25, 50, 100}, reporter.reported())
+
+	aim.AssertExpectations(t)
+}
+
+func TestUpdateHubInstallProgressIsSentInBackground(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+
+	reporter := &progressReporter{sending: make(chan int, 10), hold: make(chan struct{})}
+	uh.Reporter = reporter
+
+	uh.resetInstallProgress(10)
+
+	uh.addInstalledObject("puid")
+	assert.Equal(t, 10, <-reporter.sending)
+
+	installed := make(chan struct{})
+
+	// the installation goes on while the server doesn't answer
+	go func() {
+		for i := 1; i < 10; i++ {
+			uh.addInstalledObject("puid")
+		}
+
+		close(installed)
+	}()
+
+	select {
+	case <-installed:
+	case <-time.After(time.Second):
+		assert.Fail(t, "the installation was held back by the progress report")
+	}
+
+	assert.Equal(t, 100, uh.InstallProgress().Percentage)
+
+	// only the latest progress is sent after the one in flight
+	close(reporter.hold)
+	uh.flushInstallProgress()
+
+	assert.Equal(t, []int{10, 100}, reporter.reported())
+
+	aim.AssertExpectations(t)
+}
+
+func TestUpdateHubInstallProgressWithUnknownObjectSize(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+
+	uh.resetInstallProgress(4)
+
+	uh.setObjectInstallProgress("puid", 50, 0)
+	assert.Equal(t, 0, uh.InstallProgress().Percentage)
+
+	uh.addInstalledObject("puid")
+	assert.Equal(t, 25, uh.InstallProgress().Percentage)
+
+	aim.AssertExpectations(t)
+}
+
+func TestStateInstallingForwardsProgress(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+
+	om := &progressObjectMock{}
+
+	mode := installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "test",
+		CheckRequirements: func() error { return nil },
+		GetObject:         func() interface{} { return om },
+	})
+	defer mode.Unregister()
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	scm := &statesmock.Sha256CheckerMock{}
+
+	iidm := &installifdifferentmock.InstallIfDifferentMock{}
+	iidm.On("Proceed", om).Return(true, nil)
+
+	s := NewInstallingState(m, scm, memFs, iidm, &metadata.FirmwareMetadata{})
+
+	uh, err := newTestUpdateHub(s, aim)
+	assert.NoError(t, err)
+
+	reporter := &progressReporter{}
+	uh.Reporter = reporter
+
+	om.On("Setup").Return(nil)
+	om.On("Install", uh.settings.DownloadDir).Return(nil).Run(func(args mock.Arguments) {
+		om.progress(30, 60)
+		assert.Equal(t, InstallProgress{TotalObjects: 1, ObjectSize: 60, ObjectInstalled: 30, Percentage: 50, reportedPercentage: 50}, uh.Status().InstallProgress)
+		uh.flushInstallProgress()
+	})
+	om.On("Cleanup").Return(nil)
+
+	scm.On("CheckDownloadedObjectSha256sum", memFs, uh.settings.DownloadDir, mock.Anything).Return(nil)
+
+	nextState, _ := s.Handle(uh)
+	assert.IsType(t, &InstalledState{}, nextState)
+
+	assert.Equal(t, 1, uh.InstallProgress().InstalledObjects)
+	// sent before the install is over
+	assert.Equal(t, []int{50, 100}, reporter.reported())
+
+	aim.AssertExpectations(t)
+	om.AssertExpectations(t)
+	scm.AssertExpectations(t)
+	iidm.AssertExpectations(t)
+}
+
+func TestReportInstallProgressWithError(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.Reporter = &failingProgressReporter{}
+
+	uh.resetInstallProgress(1)
+
+	// failing to report must not affect the local progress
+	uh.setObjectInstallProgress("puid", 1, 1)
+	assert.Equal(t, 100, uh.InstallProgress().Percentage)
+
+	aim.AssertExpectations(t)
+}
+
+type failingProgressReporter struct {
+	recordingReporter
+}
+
+func (r *failingProgressReporter) ReportProgress(api client.ApiRequester, packageUID string, state string, progress int) error {
+	return fmt.Errorf("report error")
+}
@@ -0,0 +1,48 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"crypto/tls"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// newTLSConfig creates the TLS config of "certPath" and "keyPath" as
+// client.NewTLSConfig does, except that "keyPath" may be a token key
+// whose handshake signatures are made by the key store helper
+func (uh *UpdateHub) newTLSConfig(certPath string, keyPath string, caPath string) (*tls.Config, error) {
+	if certPath == "" || !client.IsTokenKey(keyPath) {
+		return client.NewTLSConfig(uh.Store, certPath, keyPath, caPath)
+	}
+
+	config, err := client.NewTLSConfig(uh.Store, "", "", caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := client.TokenKeyPair(uh.Store, certPath, uh.keyStoreExecuter(), uh.settings.KeyStoreHelper, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Certificates = []tls.Certificate{cert}
+
+	return config, nil
+}
+
+func (uh *UpdateHub) keyStoreExecuter() utils.CmdLineExecuter {
+	var executer utils.CmdLineExecuter = uh.CmdLineExecuter
+	if executer == nil {
+		executer = &utils.CmdLine{}
+	}
+
+	return executer
+}
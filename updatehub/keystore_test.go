@@ -0,0 +1,96 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+)
+
+func TestUpdateHubVerifyUpdateMetadataWithTokenKey(t *testing.T) {
+	mode := newTestInstallMode()
+
+	defer mode.Unregister()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+
+	digest := sha256.Sum256([]byte(validUpdateMetadata))
+	signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err)
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "'/usr/bin/token-helper' public-key 'pkcs11:token=device;object=metadata'").Return(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil)
+
+	uh, _ := newTestUpdateHub(&PollState{}, nil)
+	uh.CmdLineExecuter = clm
+	uh.settings.KeyStoreHelper = "/usr/bin/token-helper"
+	uh.settings.MetadataPublicKeyPath = "pkcs11:token=device;object=metadata"
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validUpdateMetadata))
+	assert.NoError(t, err)
+	updateMetadata.Signature = signature
+
+	err = uh.VerifyUpdateMetadata(updateMetadata)
+	assert.NoError(t, err)
+
+	clm.AssertExpectations(t)
+}
+
+func TestUpdateHubNewTLSConfigWithTokenKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	uh, _ := newTestUpdateHub(&PollState{}, nil)
+	uh.CmdLineExecuter = &cmdlinemock.CmdLineExecuterMock{}
+
+	err = afero.WriteFile(uh.Store, "/client.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	assert.NoError(t, err)
+
+	config, err := uh.newTLSConfig("/client.crt", "tpm2:0x81000001", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(config.Certificates))
+
+	signer, ok := config.Certificates[0].PrivateKey.(*client.TokenSigner)
+	assert.True(t, ok)
+	assert.Equal(t, &key.PublicKey, signer.Public())
+
+	// a plain key file is still loaded by client.NewTLSConfig
+	_, err = uh.newTLSConfig("/client.crt", "/client.key", "")
+	assert.EqualError(t, err, "failed to read client key: open /client.key: file does not exist")
+}
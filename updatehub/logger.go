@@ -0,0 +1,293 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	sharedlog "github.com/UpdateHub/updatehub/log"
+)
+
+// LogFields are the fields attached to the log entries
+type LogFields map[string]interface{}
+
+// Logger is where the agent writes its log. The default one writes to
+// the standard error through logrus and it can be replaced by the
+// embedders through SetLogger. The entries below the log level are
+// dropped before reaching it.
+type Logger interface {
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Warn(args ...interface{})
+	Error(args ...interface{})
+	WithFields(fields LogFields) Logger
+}
+
+// LogLevel is how much the agent logs
+type LogLevel int32
+
+const (
+	// LogLevelSilent logs the errors only
+	LogLevelSilent LogLevel = iota
+	// LogLevelWarning logs the warnings as well
+	LogLevelWarning
+	// LogLevelInfo logs what the agent is doing as well
+	LogLevelInfo
+	// LogLevelVerbose logs everything, including the debug entries
+	LogLevelVerbose
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogLevelSilent:  "silent",
+	LogLevelWarning: "warning",
+	LogLevelInfo:    "info",
+	LogLevelVerbose: "verbose",
+}
+
+func (level LogLevel) String() string {
+	return logLevelNames[level]
+}
+
+// ParseLogLevel returns the LogLevel called "name"
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, levelName := range logLevelNames {
+		if levelName == name {
+			return level, nil
+		}
+	}
+
+	return LogLevelSilent, fmt.Errorf("invalid log level '%s'", name)
+}
+
+// journaldPriorities are the syslog priorities of the logrus levels,
+// as understood by journald
+var journaldPriorities = map[logrus.Level]int{
+	logrus.PanicLevel: 0,
+	logrus.FatalLevel: 2,
+	logrus.ErrorLevel: 3,
+	logrus.WarnLevel:  4,
+	logrus.InfoLevel:  6,
+	logrus.DebugLevel: 7,
+}
+
+// LogrusLogger is the Logger writing to a logrus entry. With
+// "Journald", the entries carry the "PRIORITY" field of journald.
+type LogrusLogger struct {
+	Entry    *logrus.Entry
+	Journald bool
+}
+
+// NewLogrusLogger creates a LogrusLogger writing to "logger"
+func NewLogrusLogger(logger *logrus.Logger) *LogrusLogger {
+	return &LogrusLogger{Entry: logrus.NewEntry(logger)}
+}
+
+func (l *LogrusLogger) Debug(args ...interface{}) {
+	l.entry(logrus.DebugLevel).Debug(args...)
+}
+
+func (l *LogrusLogger) Info(args ...interface{}) {
+	l.entry(logrus.InfoLevel).Info(args...)
+}
+
+func (l *LogrusLogger) Warn(args ...interface{}) {
+	l.entry(logrus.WarnLevel).Warn(args...)
+}
+
+func (l *LogrusLogger) Error(args ...interface{}) {
+	l.entry(logrus.ErrorLevel).Error(args...)
+}
+
+func (l *LogrusLogger) WithFields(fields LogFields) Logger {
+	return &LogrusLogger{
+		Entry:    l.Entry.WithFields(logrus.Fields(fields)),
+		Journald: l.Journald,
+	}
+}
+
+func (l *LogrusLogger) entry(level logrus.Level) *logrus.Entry {
+	if !l.Journald {
+		return l.Entry
+	}
+
+	return l.Entry.WithField("PRIORITY", journaldPriorities[level])
+}
+
+// JournaldFormatter prefixes the lines formatted by "Formatter" with
+// their syslog priority, which is how journald tells the levels apart
+// on the standard error of a service
+type JournaldFormatter struct {
+	Formatter logrus.Formatter
+}
+
+func (f *JournaldFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	line, err := f.Formatter.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(fmt.Sprintf("<%d>", journaldPriorities[entry.Level])), line...), nil
+}
+
+var (
+	logLevel    = int32(LogLevelInfo)
+	logger      = defaultLogger()
+	loggerMutex sync.RWMutex
+)
+
+func defaultLogger() Logger {
+	l := logrus.New()
+	// the entries are filtered by the log level of the agent instead
+	l.Level = logrus.DebugLevel
+
+	return NewLogrusLogger(l)
+}
+
+// SetLogger makes the agent to write its log to "l", nil restores the
+// default logger
+func SetLogger(l Logger) {
+	if l == nil {
+		l = defaultLogger()
+	}
+
+	loggerMutex.Lock()
+	defer loggerMutex.Unlock()
+
+	logger = l
+}
+
+// SetLogLevel changes the log level, it takes effect right away
+func SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+// GetLogLevel returns the current log level
+func GetLogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&logLevel))
+}
+
+// recentLogSize is how many of the last log lines are kept to be sent
+// along with the error reports
+const recentLogSize = 20
+
+// recentLog keeps the last lines of the agent log, regardless of the
+// log level, except for the debug ones
+type recentLog struct {
+	lines []string
+	mutex sync.Mutex
+}
+
+var lastLogLines = &recentLog{}
+
+func (r *recentLog) add(level string, fields LogFields, args ...interface{}) {
+	line := fmt.Sprintf("%s %s: %s", time.Now().UTC().Format(time.RFC3339), level, fmt.Sprint(args...))
+
+	keys := []string{}
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		line += fmt.Sprintf(" %s=%v", k, fields[k])
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.lines = append(r.lines, strings.TrimSpace(line))
+	if len(r.lines) > recentLogSize {
+		r.lines = r.lines[len(r.lines)-recentLogSize:]
+	}
+}
+
+// Lines returns the last lines of the log, the oldest first
+func (r *recentLog) Lines() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]string{}, r.lines...)
+}
+
+// agentLog is the log of the agent, it drops the entries below the log
+// level and writes the others to the current Logger
+type agentLog struct {
+	fields LogFields
+}
+
+var log = agentLog{}
+
+func init() {
+	// the clients, the install modes and the server write to the log
+	// of the agent as well
+	sharedlog.SetWriter(log)
+}
+
+func (l agentLog) WithFields(fields LogFields) agentLog {
+	merged := LogFields{}
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	return agentLog{fields: merged}
+}
+
+func (l agentLog) Debug(args ...interface{}) {
+	if l.enabled(LogLevelVerbose) {
+		l.logger().Debug(args...)
+	}
+}
+
+func (l agentLog) Info(args ...interface{}) {
+	lastLogLines.add("info", l.fields, args...)
+
+	if l.enabled(LogLevelInfo) {
+		l.logger().Info(args...)
+	}
+}
+
+func (l agentLog) Warn(args ...interface{}) {
+	lastLogLines.add("warning", l.fields, args...)
+
+	if l.enabled(LogLevelWarning) {
+		l.logger().Warn(args...)
+	}
+}
+
+func (l agentLog) Error(args ...interface{}) {
+	lastLogLines.add("error", l.fields, args...)
+
+	l.logger().Error(args...)
+}
+
+func (l agentLog) enabled(level LogLevel) bool {
+	return GetLogLevel() >= level
+}
+
+func (l agentLog) logger() Logger {
+	loggerMutex.RLock()
+	current := logger
+	loggerMutex.RUnlock()
+
+	if len(l.fields) == 0 {
+		return current
+	}
+
+	return current.WithFields(l.fields)
+}
@@ -0,0 +1,135 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+
+	sharedlog "github.com/UpdateHub/updatehub/log"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for _, level := range []LogLevel{LogLevelSilent, LogLevelWarning, LogLevelInfo, LogLevelVerbose} {
+		parsed, err := ParseLogLevel(level.String())
+		assert.NoError(t, err)
+		assert.Equal(t, level, parsed)
+	}
+
+	_, err := ParseLogLevel("loud")
+	assert.EqualError(t, err, "invalid log level 'loud'")
+}
+
+func TestLogLevels(t *testing.T) {
+	l, hook := test.NewNullLogger()
+	l.Level = logrus.DebugLevel
+
+	SetLogger(NewLogrusLogger(l))
+	defer SetLogger(nil)
+
+	defer SetLogLevel(GetLogLevel())
+
+	testCases := []struct {
+		Level    LogLevel
+		Expected []logrus.Level
+	}{
+		{LogLevelSilent, []logrus.Level{logrus.ErrorLevel}},
+		{LogLevelWarning, []logrus.Level{logrus.WarnLevel, logrus.ErrorLevel}},
+		{LogLevelInfo, []logrus.Level{logrus.InfoLevel, logrus.WarnLevel, logrus.ErrorLevel}},
+		{LogLevelVerbose, []logrus.Level{logrus.DebugLevel, logrus.InfoLevel, logrus.WarnLevel, logrus.ErrorLevel}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Level.String(), func(t *testing.T) {
+			hook.Reset()
+
+			SetLogLevel(tc.Level)
+			assert.Equal(t, tc.Level, GetLogLevel())
+
+			log.Debug("debug")
+			log.Info("info")
+			log.Warn("warn")
+			log.Error("error")
+
+			levels := []logrus.Level{}
+			for _, entry := range hook.Entries {
+				levels = append(levels, entry.Level)
+			}
+
+			assert.Equal(t, tc.Expected, levels)
+		})
+	}
+}
+
+func TestSharedLogIsTheAgentLog(t *testing.T) {
+	l, hook := test.NewNullLogger()
+	l.Level = logrus.DebugLevel
+
+	SetLogger(NewLogrusLogger(l))
+	defer SetLogger(nil)
+
+	defer SetLogLevel(GetLogLevel())
+
+	SetLogLevel(LogLevelWarning)
+
+	sharedlog.Info("info")
+	sharedlog.Warn("warn")
+
+	assert.Equal(t, 1, len(hook.Entries))
+	assert.Equal(t, "warn", hook.LastEntry().Message)
+}
+
+func TestLogWithFields(t *testing.T) {
+	l, hook := test.NewNullLogger()
+
+	SetLogger(NewLogrusLogger(l))
+	defer SetLogger(nil)
+
+	log.WithFields(LogFields{"state": "idle"}).WithFields(LogFields{"retries": 2}).Warn("message")
+
+	assert.Equal(t, 1, len(hook.Entries))
+	assert.Equal(t, "message", hook.LastEntry().Message)
+	assert.Equal(t, logrus.Fields{"state": "idle", "retries": 2}, hook.LastEntry().Data)
+}
+
+func TestLogrusLoggerWithJournald(t *testing.T) {
+	l, hook := test.NewNullLogger()
+
+	logger := NewLogrusLogger(l)
+	logger.Journald = true
+
+	logger.WithFields(LogFields{"state": "idle"}).Warn("message")
+
+	assert.Equal(t, logrus.Fields{"state": "idle", "PRIORITY": 4}, hook.LastEntry().Data)
+
+	logger.Error("message")
+
+	assert.Equal(t, logrus.Fields{"PRIORITY": 3}, hook.LastEntry().Data)
+}
+
+type testFormatter struct{}
+
+func (testFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return []byte(entry.Message + "\n"), nil
+}
+
+func TestJournaldFormatter(t *testing.T) {
+	f := &JournaldFormatter{Formatter: testFormatter{}}
+
+	line, err := f.Format(&logrus.Entry{Level: logrus.WarnLevel, Message: "message"})
+	assert.NoError(t, err)
+	assert.Equal(t, "<4>message\n", string(line))
+
+	line, err = f.Format(&logrus.Entry{Level: logrus.DebugLevel, Message: "message"})
+	assert.NoError(t, err)
+	assert.Equal(t, "<7>message\n", string(line))
+}
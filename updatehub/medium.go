@@ -0,0 +1,193 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/client"
+)
+
+// mediumReportFile is where the states of an update installed from a
+// medium are written back to it, one JSON report per line
+const mediumReportFile = "updatehub-report.json"
+
+// medium is the dir of the medium (e.g. an USB stick or a SD card) the
+// update is installed from, if any, see MediumSettings
+type medium struct {
+	mutex sync.Mutex
+	dir   string
+
+	// scanned holds the modification time of the update metadata of
+	// each medium already probed, by dir
+	scanned map[string]time.Time
+}
+
+// overrideServer makes the update be checked at and fetched from
+// "server" instead of the configured servers, until it's called again
+// with an empty one. A "file://" server is the dir of a medium.
+func (uh *UpdateHub) overrideServer(server string) {
+	scheme, dir := splitServerScheme(server)
+	if scheme != "file" {
+		dir = ""
+	}
+
+	uh.medium.mutex.Lock()
+	uh.medium.dir = dir
+	uh.medium.mutex.Unlock()
+
+	if dir != "" {
+		server = ""
+	}
+
+	if uh.API != nil {
+		uh.API.OverrideServer(server)
+	}
+}
+
+// overriddenServer returns the server given to overrideServer
+func (uh *UpdateHub) overriddenServer() string {
+	if dir := uh.mediumDir(); dir != "" {
+		return "file://" + dir
+	}
+
+	if uh.API == nil {
+		return ""
+	}
+
+	return uh.API.OverriddenServer()
+}
+
+func (uh *UpdateHub) mediumDir() string {
+	uh.medium.mutex.Lock()
+	defer uh.medium.mutex.Unlock()
+
+	return uh.medium.dir
+}
+
+// updater returns the Updater of the medium being probed, if any, or
+// the configured one
+func (uh *UpdateHub) updater() client.Updater {
+	if dir := uh.mediumDir(); dir != "" {
+		fileClient := client.NewFileClient(uh.Store, dir)
+		fileClient.AllowDowngrade = uh.settings.AllowDowngrade
+
+		return fileClient
+	}
+
+	return uh.Updater
+}
+
+// writeMediumReport appends "r" to the reports of the medium being
+// probed, if any, so the field service knows how the update went
+func (uh *UpdateHub) writeMediumReport(r *stateReport) {
+	dir := uh.mediumDir()
+	if dir == "" {
+		return
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		log.Warn("failed to write the report to the medium: ", err)
+		return
+	}
+
+	file, err := uh.Store.OpenFile(path.Join(dir, mediumReportFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Warn("failed to write the report to the medium: ", err)
+		return
+	}
+
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		log.Warn("failed to write the report to the medium: ", err)
+	}
+}
+
+// scanMedia probes for the update of each medium found at the mount
+// points. A medium is probed once, unless its update metadata changes
+// or it's removed and inserted again. The probes refused since the
+// agent is busy are tried again on the next scan.
+func (uh *UpdateHub) scanMedia() {
+	found := map[string]time.Time{}
+
+	for _, pattern := range uh.settings.MediumMountPoints {
+		mountPoints, err := afero.Glob(uh.Store, pattern)
+		if err != nil {
+			log.Warn(fmt.Sprintf("invalid medium mount point '%s': %s", pattern, err))
+			continue
+		}
+
+		for _, mountPoint := range mountPoints {
+			dir := path.Join(mountPoint, uh.settings.MediumDir)
+
+			info, err := uh.Store.Stat(path.Join(dir, client.UpgradesEndpoint))
+			if err != nil {
+				continue
+			}
+
+			found[dir] = info.ModTime()
+		}
+	}
+
+	for dir, modTime := range found {
+		if scanned, ok := uh.medium.scanned[dir]; ok && scanned.Equal(modTime) {
+			continue
+		}
+
+		err := uh.probeAt("file://" + dir)
+		if err != nil {
+			log.Debug(fmt.Sprintf("deferring the medium '%s': %s", dir, err))
+			delete(found, dir)
+			continue
+		}
+
+		log.Info(fmt.Sprintf("probing for an update at the medium '%s'", dir))
+	}
+
+	uh.medium.scanned = found
+}
+
+// startMediumWatcher scans the media every "ScanInterval" while the
+// daemon runs, if enabled. The returned function stops it.
+func (d *Daemon) startMediumWatcher() func() {
+	s := d.uh.settings.MediumSettings
+
+	if !s.MediumEnabled || s.MediumScanInterval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan bool)
+
+	go func() {
+		ticker := time.NewTicker(s.MediumScanInterval)
+		defer ticker.Stop()
+
+		for {
+			d.uh.scanMedia()
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
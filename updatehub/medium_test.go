@@ -0,0 +1,169 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+func pendingProbe(uh *UpdateHub) (string, bool) {
+	select {
+	case server := <-uh.probeRequests():
+		return server, true
+	default:
+		return "", false
+	}
+}
+
+func TestScanMedia(t *testing.T) {
+	uh, err := newTestUpdateHub(NewIdleState(), nil)
+	assert.NoError(t, err)
+
+	uh.settings.MediumMountPoints = []string{"/media/*"}
+
+	err = afero.WriteFile(uh.Store, "/media/usb0/updatehub/upgrades", []byte(validUpdateMetadata), 0644)
+	assert.NoError(t, err)
+
+	// a medium without updates
+	err = uh.Store.MkdirAll("/media/usb1", 0755)
+	assert.NoError(t, err)
+
+	uh.scanMedia()
+
+	server, ok := pendingProbe(uh)
+	assert.True(t, ok)
+	assert.Equal(t, "file:///media/usb0/updatehub", server)
+
+	// the medium is probed once
+	uh.scanMedia()
+
+	_, ok = pendingProbe(uh)
+	assert.False(t, ok)
+
+	// removed and inserted again
+	err = uh.Store.RemoveAll("/media/usb0")
+	assert.NoError(t, err)
+
+	uh.scanMedia()
+
+	err = afero.WriteFile(uh.Store, "/media/usb0/updatehub/upgrades", []byte(validUpdateMetadata), 0644)
+	assert.NoError(t, err)
+
+	uh.scanMedia()
+
+	server, ok = pendingProbe(uh)
+	assert.True(t, ok)
+	assert.Equal(t, "file:///media/usb0/updatehub", server)
+}
+
+func TestScanMediaWhileBusy(t *testing.T) {
+	uh, err := newTestUpdateHub(NewDownloadingState(&metadata.UpdateMetadata{}), nil)
+	assert.NoError(t, err)
+
+	uh.settings.MediumMountPoints = []string{"/media/*"}
+
+	err = afero.WriteFile(uh.Store, "/media/usb0/updatehub/upgrades", []byte(validUpdateMetadata), 0644)
+	assert.NoError(t, err)
+
+	uh.scanMedia()
+
+	_, ok := pendingProbe(uh)
+	assert.False(t, ok)
+
+	// tried again once the agent is idle
+	uh.State = NewIdleState()
+
+	uh.scanMedia()
+
+	server, ok := pendingProbe(uh)
+	assert.True(t, ok)
+	assert.Equal(t, "file:///media/usb0/updatehub", server)
+}
+
+func TestOverrideServerWithMedium(t *testing.T) {
+	uh, err := newTestUpdateHub(NewIdleState(), nil)
+	assert.NoError(t, err)
+
+	uh.Updater = client.NewUpdateClient()
+
+	uh.overrideServer("file:///media/usb0/updatehub")
+	assert.Equal(t, "file:///media/usb0/updatehub", uh.overriddenServer())
+	assert.Equal(t, "", uh.API.OverriddenServer())
+	assert.IsType(t, &client.FileClient{}, uh.updater())
+
+	err = afero.WriteFile(uh.Store, "/media/usb0/updatehub/upgrades", []byte(`{"product-uid": "123", "version": "2.0", "objects": [[]]}`), 0644)
+	assert.NoError(t, err)
+
+	uh.FirmwareMetadata = metadata.FirmwareMetadata{ProductUID: "123", Version: "1.0"}
+
+	updateMetadata, _ := uh.CheckUpdate(context.Background(), 0)
+	assert.NotNil(t, updateMetadata)
+
+	uh.overrideServer("otherserver:8080")
+	assert.Equal(t, "otherserver:8080", uh.overriddenServer())
+	assert.Equal(t, uh.Updater, uh.updater())
+
+	uh.overrideServer("")
+	assert.Equal(t, "", uh.overriddenServer())
+	assert.Equal(t, uh.Updater, uh.updater())
+}
+
+func TestProbeUpdateWithMediumServer(t *testing.T) {
+	uh, err := newTestUpdateHub(NewIdleState(), nil)
+	assert.NoError(t, err)
+
+	err = uh.ProbeUpdateWithServer("file:///etc")
+	assert.EqualError(t, err, "can't probe for updates at 'file:///etc'")
+
+	_, ok := pendingProbe(uh)
+	assert.False(t, ok)
+}
+
+func TestWriteMediumReport(t *testing.T) {
+	uh, err := newTestUpdateHub(NewIdleState(), nil)
+	assert.NoError(t, err)
+
+	now := time.Date(2017, time.June, 1, 10, 0, 0, 0, time.UTC)
+
+	// not probing a medium
+	uh.writeMediumReport(&stateReport{Time: now, PackageUID: "puid", State: "downloading"})
+
+	exists, err := afero.Exists(uh.Store, "/media/usb0/updatehub/"+mediumReportFile)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	err = uh.Store.MkdirAll("/media/usb0/updatehub", 0755)
+	assert.NoError(t, err)
+
+	uh.overrideServer("file:///media/usb0/updatehub")
+
+	uh.writeMediumReport(&stateReport{Time: now, PackageUID: "puid", State: "downloading"})
+	uh.writeMediumReport(&stateReport{Time: now, PackageUID: "puid", State: "error", ErrorMessage: "install failed"})
+
+	data, err := afero.ReadFile(uh.Store, "/media/usb0/updatehub/"+mediumReportFile)
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, 2, len(lines))
+
+	var r stateReport
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &r))
+	assert.Equal(t, "error", r.State)
+	assert.Equal(t, "install failed", r.ErrorMessage)
+}
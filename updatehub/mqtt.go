@@ -0,0 +1,56 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/UpdateHub/updatehub/client"
+)
+
+// StartMQTT connects, if enabled, to the MQTT broker and subscribes to
+// the device topic. Each message received there makes the agent check
+// for updates right away if it is idle or polling.
+func (uh *UpdateHub) StartMQTT() error {
+	s := uh.settings.MQTTSettings
+
+	if !s.MQTTEnabled {
+		return nil
+	}
+
+	if s.MQTTBroker == "" || s.MQTTTopic == "" {
+		return errors.New("the MQTT broker and topic must be set")
+	}
+
+	var tlsConfig *tls.Config
+
+	if s.MQTTClientCertificatePath != "" || s.MQTTCACertificatePath != "" {
+		var err error
+
+		tlsConfig, err = uh.newTLSConfig(s.MQTTClientCertificatePath, s.MQTTClientKeyPath, s.MQTTCACertificatePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	notifier := client.NewMQTTNotifier(s.MQTTBroker, s.MQTTClientID, s.MQTTTopic, tlsConfig, uh.notifyUpdate)
+
+	return notifier.Connect()
+}
+
+// notifyUpdate is called when the server notifies that an update may
+// be available
+func (uh *UpdateHub) notifyUpdate() {
+	err := uh.ProbeUpdate()
+	if err != nil {
+		log.Debug(fmt.Sprintf("ignoring update notification: %s", err))
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+)
+
+func TestStartMQTTDisabled(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+
+	err := uh.StartMQTT()
+	assert.NoError(t, err)
+
+	aim.AssertExpectations(t)
+}
+
+func TestStartMQTTWithInvalidSettings(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.settings.MQTTEnabled = true
+
+	err := uh.StartMQTT()
+	assert.EqualError(t, err, "the MQTT broker and topic must be set")
+
+	uh.settings.MQTTBroker = "ssl://localhost:8883"
+	uh.settings.MQTTTopic = "updatehub/device"
+	uh.settings.MQTTCACertificatePath = "/ca.crt"
+
+	err = uh.StartMQTT()
+	assert.EqualError(t, err, "failed to read CA bundle: open /ca.crt: file does not exist")
+
+	aim.AssertExpectations(t)
+}
+
+func TestNotifyUpdateWhilePolling(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+
+	poll := NewPollState(uh)
+	poll.interval = time.Hour
+	uh.State = poll
+
+	uh.notifyUpdate()
+
+	next, _ := poll.Handle(uh)
+	assert.IsType(t, &UpdateCheckState{}, next)
+
+	aim.AssertExpectations(t)
+}
+
+func TestNotifyUpdateWhileDownloading(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(NewDownloadingState(&metadata.UpdateMetadata{}), aim)
+
+	// the notification is ignored
+	uh.notifyUpdate()
+
+	select {
+	case <-uh.probeRequests():
+		t.Error("a probe shouldn't be requested while downloading")
+	default:
+	}
+
+	aim.AssertExpectations(t)
+}
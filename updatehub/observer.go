@@ -0,0 +1,100 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"sync"
+)
+
+// StateObserver is told about each transition of the agent from the
+// "previous" state to the "next" one
+type StateObserver func(previous State, next State)
+
+// stateObservers holds the observers subscribed to the state changes
+type stateObservers struct {
+	observers map[int]StateObserver
+	lastID    int
+	mutex     sync.Mutex
+}
+
+// Subscribe makes "observer" to be called on each state transition,
+// so an application embedding the agent can react to them, like
+// turning on a LED while the update is installed. The observers are
+// called by the daemon before it handles the next state, so they must
+// not block. The returned function unsubscribes it.
+func (uh *UpdateHub) Subscribe(observer StateObserver) (unsubscribe func()) {
+	o := &uh.observers
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.observers == nil {
+		o.observers = map[int]StateObserver{}
+	}
+
+	o.lastID++
+	id := o.lastID
+
+	o.observers[id] = observer
+
+	return func() {
+		o.mutex.Lock()
+		defer o.mutex.Unlock()
+
+		delete(o.observers, id)
+	}
+}
+
+// CurrentState returns the state the agent is in. Unlike the State
+// field, it may be read while the daemon is running.
+func (uh *UpdateHub) CurrentState() State {
+	uh.stateMutex.Lock()
+	defer uh.stateMutex.Unlock()
+
+	return uh.State
+}
+
+// setState makes "state" the current one, see CurrentState
+func (uh *UpdateHub) setState(state State) {
+	uh.stateMutex.Lock()
+	defer uh.stateMutex.Unlock()
+
+	uh.State = state
+}
+
+// changeState makes "next" the current state, the observers are
+// notified if it's another state
+func (uh *UpdateHub) changeState(next State) {
+	previous := uh.CurrentState()
+	uh.setState(next)
+
+	if previous == next {
+		return
+	}
+
+	// the observers are called unlocked, so they can unsubscribe
+	for _, observer := range uh.observers.list() {
+		observer(previous, next)
+	}
+}
+
+// list returns the observers in the order they subscribed
+func (o *stateObservers) list() []StateObserver {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	list := make([]StateObserver, 0, len(o.observers))
+	for id := 1; id <= o.lastID; id++ {
+		if observer, ok := o.observers[id]; ok {
+			list = append(list, observer)
+		}
+	}
+
+	return list
+}
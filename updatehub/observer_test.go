@@ -0,0 +1,113 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+)
+
+type transition struct {
+	previous State
+	next     State
+}
+
+func TestUpdateHubSubscribe(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, err := newTestUpdateHub(NewUpdateCheckState(), aim)
+	assert.NoError(t, err)
+
+	uh.Controller = &testController{updateAvailable: false, extraPoll: -1}
+
+	transitions := []transition{}
+	unsubscribe := uh.Subscribe(func(previous State, next State) {
+		transitions = append(transitions, transition{previous, next})
+	})
+
+	previous := uh.State
+
+	d := NewDaemon(uh)
+	next := d.Step()
+
+	assert.IsType(t, &IdleState{}, next)
+	assert.Equal(t, []transition{{previous, next}}, transitions)
+
+	// staying at the same state isn't a transition
+	uh.changeState(next)
+	assert.Equal(t, 1, len(transitions))
+
+	unsubscribe()
+
+	uh.changeState(NewUpdateCheckState())
+	assert.Equal(t, 1, len(transitions))
+
+	aim.AssertExpectations(t)
+}
+
+func TestUpdateHubSubscribeWithManyObservers(t *testing.T) {
+	uh, err := newTestUpdateHub(NewIdleState(), nil)
+	assert.NoError(t, err)
+
+	calls := []string{}
+
+	uh.Subscribe(func(previous State, next State) {
+		calls = append(calls, "first")
+	})
+
+	var unsubscribe func()
+	unsubscribe = uh.Subscribe(func(previous State, next State) {
+		calls = append(calls, "second")
+
+		// an observer may unsubscribe itself
+		unsubscribe()
+	})
+
+	uh.Subscribe(func(previous State, next State) {
+		calls = append(calls, "third")
+	})
+
+	uh.changeState(NewUpdateCheckState())
+	assert.Equal(t, []string{"first", "second", "third"}, calls)
+
+	uh.changeState(NewIdleState())
+	assert.Equal(t, []string{"first", "second", "third", "first", "third"}, calls)
+}
+
+func TestUpdateHubCurrentState(t *testing.T) {
+	uh, err := newTestUpdateHub(NewIdleState(), nil)
+	assert.NoError(t, err)
+
+	assert.IsType(t, &IdleState{}, uh.CurrentState())
+
+	// read while the daemon changes it
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 100; i++ {
+			uh.Status()
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		uh.changeState(NewUpdateCheckState())
+		uh.changeState(NewIdleState())
+	}
+
+	wg.Wait()
+
+	assert.IsType(t, &IdleState{}, uh.CurrentState())
+}
@@ -0,0 +1,133 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/activeinactive"
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/copy"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+const (
+	// DefaultSystemSettingsPath is the read-only settings configured
+	// in the device
+	DefaultSystemSettingsPath = "/etc/updatehub.conf"
+	// DefaultRuntimeSettingsPath is the settings changed by the agent,
+	// they are kept across the reboots
+	DefaultRuntimeSettingsPath = "/var/lib/updatehub.conf"
+)
+
+// Option customizes the UpdateHub created by New
+type Option func(uh *UpdateHub)
+
+// New creates an UpdateHub set up as the shipped agent, which talks
+// to the server through HTTP and keeps its files at the root
+// filesystem, changed by "opts". It's idle and its settings aren't
+// loaded yet.
+func New(opts ...Option) *UpdateHub {
+	uh := &UpdateHub{
+		State:               NewIdleState(),
+		API:                 client.NewApiClient("localhost:8080"),
+		Updater:             client.NewUpdateClient(),
+		Reporter:            client.NewReportClient(),
+		CopyBackend:         copy.ExtendedIO{},
+		TimeStep:            time.Minute,
+		Store:               afero.NewOsFs(),
+		SystemSettingsPath:  DefaultSystemSettingsPath,
+		RuntimeSettingsPath: DefaultRuntimeSettingsPath,
+		CmdLineExecuter:     &utils.CmdLine{},
+	}
+
+	uh.Controller = uh
+
+	for _, opt := range opts {
+		opt(uh)
+	}
+
+	return uh
+}
+
+// WithUpdater makes the agent to check for the updates and to fetch
+// them through "updater"
+func WithUpdater(updater client.Updater) Option {
+	return func(uh *UpdateHub) {
+		uh.Updater = updater
+	}
+}
+
+// WithReporter makes the agent to report the states through "reporter"
+func WithReporter(reporter client.Reporter) Option {
+	return func(uh *UpdateHub) {
+		uh.Reporter = reporter
+	}
+}
+
+// WithActiveInactiveBackend makes the agent to switch the installation
+// sets through "aii", as done by SetActiveInactiveBackend
+func WithActiveInactiveBackend(aii activeinactive.Interface) Option {
+	return func(uh *UpdateHub) {
+		uh.activeInactiveBackend = aii
+	}
+}
+
+// WithFileSystem makes the agent to keep its files, like the settings
+// and the downloaded objects, at "fs"
+func WithFileSystem(fs afero.Fs) Option {
+	return func(uh *UpdateHub) {
+		uh.Store = fs
+	}
+}
+
+// WithClock makes the state machine to take the time from "clock"
+func WithClock(clock Clock) Option {
+	return func(uh *UpdateHub) {
+		uh.Clock = clock
+	}
+}
+
+// WithCmdLineExecuter makes the agent to run the external commands,
+// like the callbacks, through "cle"
+func WithCmdLineExecuter(cle utils.CmdLineExecuter) Option {
+	return func(uh *UpdateHub) {
+		uh.CmdLineExecuter = cle
+	}
+}
+
+// WithSettingsPaths makes the agent to read its settings from the
+// "system" and "runtime" files
+func WithSettingsPaths(system string, runtime string) Option {
+	return func(uh *UpdateHub) {
+		uh.SystemSettingsPath = system
+		uh.RuntimeSettingsPath = runtime
+	}
+}
+
+// WithFirmwareMetadata makes "fm" the identity of the device. It's
+// refreshed through "loader", when it isn't nil, before each update
+// check.
+func WithFirmwareMetadata(fm metadata.FirmwareMetadata, loader *metadata.FirmwareMetadataLoader) Option {
+	return func(uh *UpdateHub) {
+		uh.FirmwareMetadata = fm
+		uh.FirmwareMetadataLoader = loader
+	}
+}
+
+// WithDryRun makes the agent to check for, download and verify the
+// updates without installing them
+func WithDryRun(dryRun bool) Option {
+	return func(uh *UpdateHub) {
+		uh.DryRun = dryRun
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/copy"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+	"github.com/UpdateHub/updatehub/testsmocks/updatermock"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+func TestNew(t *testing.T) {
+	uh := New()
+
+	assert.IsType(t, &IdleState{}, uh.State)
+	assert.Equal(t, uh, uh.Controller)
+	assert.IsType(t, &client.UpdateClient{}, uh.Updater)
+	assert.IsType(t, &client.ReportClient{}, uh.Reporter)
+	assert.IsType(t, copy.ExtendedIO{}, uh.CopyBackend)
+	assert.IsType(t, &afero.OsFs{}, uh.Store)
+	assert.IsType(t, &utils.CmdLine{}, uh.CmdLineExecuter)
+	assert.Equal(t, time.Minute, uh.TimeStep)
+	assert.Equal(t, DefaultSystemSettingsPath, uh.SystemSettingsPath)
+	assert.Equal(t, DefaultRuntimeSettingsPath, uh.RuntimeSettingsPath)
+	assert.Nil(t, uh.activeInactiveBackend)
+	assert.False(t, uh.DryRun)
+}
+
+func TestNewWithOptions(t *testing.T) {
+	um := &updatermock.UpdaterMock{}
+	rm := testReporter{}
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	memFs := afero.NewMemMapFs()
+	clock := &testClock{now: time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)}
+	fm := metadata.FirmwareMetadata{ProductUID: "229ffd7e08721d716163fc81a2dbaf6c90d449f0a3b009b6a2defe8a0b0d7381"}
+	loader := &metadata.FirmwareMetadataLoader{Store: memFs}
+
+	uh := New(
+		WithUpdater(um),
+		WithReporter(rm),
+		WithActiveInactiveBackend(aim),
+		WithFileSystem(memFs),
+		WithClock(clock),
+		WithCmdLineExecuter(clm),
+		WithSettingsPaths("/system.conf", "/runtime.conf"),
+		WithFirmwareMetadata(fm, loader),
+		WithDryRun(true),
+	)
+
+	assert.Equal(t, um, uh.Updater)
+	assert.Equal(t, rm, uh.Reporter)
+	assert.Equal(t, aim, uh.activeInactiveBackend)
+	assert.Equal(t, memFs, uh.Store)
+	assert.Equal(t, clock, uh.Clock)
+	assert.Equal(t, clm, uh.CmdLineExecuter)
+	assert.Equal(t, "/system.conf", uh.SystemSettingsPath)
+	assert.Equal(t, "/runtime.conf", uh.RuntimeSettingsPath)
+	assert.Equal(t, fm, uh.FirmwareMetadata)
+	assert.Equal(t, loader, uh.FirmwareMetadataLoader)
+	assert.True(t, uh.DryRun)
+
+	// the backend is kept by the settings which don't choose another
+	err := afero.WriteFile(memFs, "/system.conf", []byte(""), 0644)
+	assert.NoError(t, err)
+
+	err = uh.LoadSettings()
+	assert.NoError(t, err)
+	assert.Equal(t, aim, uh.activeInactiveBackend)
+
+	aim.AssertExpectations(t)
+}
@@ -0,0 +1,240 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+// peerListTTL is for how long the peers discovered are used before
+// they are discovered again
+const peerListTTL = 5 * time.Minute
+
+// lanPeers caches the peers discovered in the LAN
+type lanPeers struct {
+	addresses    []string
+	discoveredAt time.Time
+	mutex        sync.Mutex
+}
+
+// StartPeers serves, if enabled, the objects of the download dir to
+// the peers of the LAN through "handler" and advertises them through
+// mDNS
+func (uh *UpdateHub) StartPeers(handler http.Handler) error {
+	s := uh.settings.PeerSettings
+
+	if !s.PeerEnabled {
+		return nil
+	}
+
+	if _, err := uh.peerKey(); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", s.PeerListenAddress)
+	if err != nil {
+		return err
+	}
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	if _, err = client.AdvertisePeer(uh.FirmwareMetadata.ProductUID, p); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to advertise the objects to the peers: %s", err)
+	}
+
+	go func() {
+		if err := http.Serve(listener, handler); err != nil {
+			log.Error("the objects aren't served to the peers anymore: ", err)
+		}
+	}()
+
+	return nil
+}
+
+// AuthorizedPeer tells whether "signature" is the one of a peer
+// requesting the object "objectUID" just now, see
+// client.VerifyPeerSignature
+func (uh *UpdateHub) AuthorizedPeer(objectUID string, signature string) bool {
+	key, err := uh.peerKey()
+	if err != nil {
+		log.Warn(err)
+		return false
+	}
+
+	return client.VerifyPeerSignature(key, objectUID, signature, uh.clock().Now())
+}
+
+// OpenPeerObject opens the object "objectUID" to be served to a peer.
+// Only the objects of the current and installed packages which were
+// completely downloaded and verified are served, the encrypted ones
+// are kept to the device.
+func (uh *UpdateHub) OpenPeerObject(objectUID string) (afero.File, error) {
+	if !isObjectUID(objectUID) || !uh.peerObject(objectUID) || !uh.reusableObject(objectUID) {
+		return nil, os.ErrNotExist
+	}
+
+	return uh.Store.Open(path.Join(uh.settings.DownloadDir, objectUID))
+}
+
+// peerObject tells whether "objectUID" is a plain object of the
+// current or installed packages
+func (uh *UpdateHub) peerObject(objectUID string) bool {
+	for _, name := range []string{currentMetadataFileName, installedMetadataFileName} {
+		updateMetadata, err := uh.keptUpdateMetadata(name)
+		if err != nil {
+			continue
+		}
+
+		for _, objects := range updateMetadata.Objects {
+			for _, o := range objects {
+				om := o.GetObjectMetadata()
+
+				if om.Sha256sum == objectUID {
+					return om.Encryption == nil
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// peerKey returns the key shared by the peers of the site
+func (uh *UpdateHub) peerKey() ([]byte, error) {
+	if uh.settings.PeerKeyPath == "" {
+		return nil, errors.New("the peer key must be set")
+	}
+
+	key, err := afero.ReadFile(uh.Store, uh.settings.PeerKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the peer key: %s", err)
+	}
+
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, errors.New("the peer key is empty")
+	}
+
+	return key, nil
+}
+
+// corruptPeerObjectError is returned when the object served by a
+// peer doesn't match its sha256sum
+type corruptPeerObjectError struct {
+	peer      string
+	objectUID string
+}
+
+func (e *corruptPeerObjectError) Error() string {
+	return fmt.Sprintf("the object '%s' served by the peer '%s' is corrupted", e.objectUID, e.peer)
+}
+
+// fetchObjectFromPeers requests the object "obj", from "offset", to
+// the peers of the LAN, one at a time, and returns the body of the
+// first one serving it along with its address. The encrypted objects
+// are only fetched from the server.
+func (uh *UpdateHub) fetchObjectFromPeers(obj metadata.Object, offset int64) (io.ReadCloser, int64, string, error) {
+	if !uh.settings.PeerEnabled {
+		return nil, -1, "", errors.New("the peers are disabled")
+	}
+
+	om := obj.GetObjectMetadata()
+	if om.Encryption != nil {
+		return nil, -1, "", errors.New("the encrypted objects aren't fetched from the peers")
+	}
+
+	objectUID := om.Sha256sum
+
+	key, err := uh.peerKey()
+	if err != nil {
+		return nil, -1, "", err
+	}
+
+	for _, address := range uh.discoverPeers() {
+		body, contentLength, err := client.FetchPeerObject(address, objectUID, key, offset, uh.settings.DownloadStallTimeout)
+		if err == nil {
+			log.Info(fmt.Sprintf("fetching the object '%s' from the peer '%s'", objectUID, address))
+			return body, contentLength, address, nil
+		}
+
+		log.Debug(err)
+	}
+
+	return nil, -1, "", fmt.Errorf("no peer serves the object '%s'", objectUID)
+}
+
+// dropPeer removes "address" from the peers discovered, so it isn't
+// asked for the objects anymore until the peers are discovered again
+func (uh *UpdateHub) dropPeer(address string) {
+	uh.peers.mutex.Lock()
+	defer uh.peers.mutex.Unlock()
+
+	addresses := []string{}
+	for _, a := range uh.peers.addresses {
+		if a != address {
+			addresses = append(addresses, a)
+		}
+	}
+
+	uh.peers.addresses = addresses
+}
+
+// discoverPeers returns the peers of the LAN serving the objects of
+// the product, they are discovered again after "peerListTTL"
+func (uh *UpdateHub) discoverPeers() []string {
+	uh.peers.mutex.Lock()
+	defer uh.peers.mutex.Unlock()
+
+	now := uh.clock().Now()
+
+	if !uh.peers.discoveredAt.IsZero() && now.Sub(uh.peers.discoveredAt) < peerListTTL {
+		return uh.peers.addresses
+	}
+
+	discover := uh.peerDiscoverer
+	if discover == nil {
+		discover = client.DiscoverPeers
+	}
+
+	addresses, err := discover(uh.FirmwareMetadata.ProductUID, uh.settings.PeerDiscoveryTimeout)
+	if err != nil {
+		log.Warn("failed to discover the peers: ", err)
+	}
+
+	uh.peers.addresses = addresses
+	uh.peers.discoveredAt = now
+
+	return addresses
+}
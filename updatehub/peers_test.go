@@ -0,0 +1,233 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/copy"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/updatermock"
+)
+
+func newPeerTestUpdateHub(t *testing.T) *UpdateHub {
+	uh, _ := newTestUpdateHub(&PollState{}, &activeinactivemock.ActiveInactiveMock{})
+	uh.CopyBackend = copy.ExtendedIO{}
+	uh.settings.PeerEnabled = true
+	uh.settings.PeerKeyPath = "/etc/peer.key"
+
+	err := afero.WriteFile(uh.Store, uh.settings.PeerKeyPath, []byte("secret\n"), 0600)
+	assert.NoError(t, err)
+
+	return uh
+}
+
+func TestAuthorizedPeer(t *testing.T) {
+	uh := newPeerTestUpdateHub(t)
+
+	clock := &testClock{now: time.Now()}
+	uh.Clock = clock
+
+	signature := client.PeerSignature([]byte("secret"), testObjectUID, clock.now)
+
+	assert.True(t, uh.AuthorizedPeer(testObjectUID, signature))
+	assert.False(t, uh.AuthorizedPeer(testObjectUID, client.PeerSignature([]byte("other"), testObjectUID, clock.now)))
+	assert.False(t, uh.AuthorizedPeer(testObjectUID, ""))
+
+	// a signature seen in the LAN can't be replayed later
+	clock.now = clock.now.Add(client.PeerSignatureMaxAge + time.Second)
+	assert.False(t, uh.AuthorizedPeer(testObjectUID, signature))
+
+	uh.settings.PeerKeyPath = ""
+	assert.False(t, uh.AuthorizedPeer(testObjectUID, client.PeerSignature(nil, testObjectUID, clock.now)))
+}
+
+func TestOpenPeerObject(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	uh := newPeerTestUpdateHub(t)
+
+	objectPath := path.Join(uh.settings.DownloadDir, testObjectUID)
+
+	err := afero.WriteFile(uh.Store, objectPath, []byte("test"), 0644)
+	assert.NoError(t, err)
+
+	// no package refers to it
+	_, err = uh.OpenPeerObject(testObjectUID)
+	assert.Equal(t, os.ErrNotExist, err)
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	err = uh.keepUpdateMetadata(currentMetadataFileName, updateMetadata)
+	assert.NoError(t, err)
+
+	file, err := uh.OpenPeerObject(testObjectUID)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", string(data))
+	file.Close()
+
+	// still being downloaded
+	err = afero.WriteFile(uh.Store, objectPath+partialDownloadSuffix, nil, 0644)
+	assert.NoError(t, err)
+
+	_, err = uh.OpenPeerObject(testObjectUID)
+	assert.Equal(t, os.ErrNotExist, err)
+
+	_, err = uh.OpenPeerObject("../etc/peer.key")
+	assert.Equal(t, os.ErrNotExist, err)
+}
+
+func TestUpdateHubFetchUpdateFromPeers(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	uh := newPeerTestUpdateHub(t)
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, client.PeerObjectsEndpoint+"/"+testObjectUID, r.URL.Path)
+		assert.True(t, client.VerifyPeerSignature([]byte("secret"), testObjectUID, r.Header.Get(client.PeerSignatureHeader), time.Now()))
+
+		http.ServeContent(w, r, testObjectUID, time.Time{}, bytes.NewReader([]byte("test")))
+	}))
+	defer peer.Close()
+
+	uh.peerDiscoverer = func(productUID string, timeout time.Duration) ([]string, error) {
+		assert.Equal(t, uh.FirmwareMetadata.ProductUID, productUID)
+		assert.Equal(t, uh.settings.PeerDiscoveryTimeout, timeout)
+
+		return []string{strings.TrimPrefix(missing.URL, "http://"), strings.TrimPrefix(peer.URL, "http://")}, nil
+	}
+
+	// the server isn't requested
+	um := &updatermock.UpdaterMock{}
+	uh.Updater = um
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.NoError(t, err)
+
+	data, err := afero.ReadFile(uh.Store, path.Join(uh.settings.DownloadDir, testObjectUID))
+	assert.NoError(t, err)
+	assert.Equal(t, "test", string(data))
+
+	um.AssertExpectations(t)
+}
+
+func TestUpdateHubFetchUpdateFromCorruptPeer(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	uh := newPeerTestUpdateHub(t)
+
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testObjectUID, time.Time{}, bytes.NewReader([]byte("evil")))
+	}))
+	defer peer.Close()
+
+	address := strings.TrimPrefix(peer.URL, "http://")
+
+	uh.peerDiscoverer = func(productUID string, timeout time.Duration) ([]string, error) {
+		return []string{address, "10.0.0.1:8085"}, nil
+	}
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	uri := path.Join("/", uh.FirmwareMetadata.ProductUID, updateMetadata.PackageUID(), testObjectUID)
+
+	// downloaded again, from its start, from the server
+	um := &updatermock.UpdaterMock{}
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(ioutil.NopCloser(bytes.NewReader([]byte("test"))), int64(4), nil).Once()
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.NoError(t, err)
+
+	data, err := afero.ReadFile(uh.Store, path.Join(uh.settings.DownloadDir, testObjectUID))
+	assert.NoError(t, err)
+	assert.Equal(t, "test", string(data))
+
+	// the peer isn't asked anymore
+	assert.Equal(t, []string{"10.0.0.1:8085"}, uh.discoverPeers())
+
+	um.AssertExpectations(t)
+}
+
+func TestUpdateHubFetchUpdateWithoutPeers(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	uh := newPeerTestUpdateHub(t)
+
+	uh.peerDiscoverer = func(productUID string, timeout time.Duration) ([]string, error) {
+		return nil, errors.New("no network")
+	}
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	uri := path.Join("/", uh.FirmwareMetadata.ProductUID, updateMetadata.PackageUID(), testObjectUID)
+
+	um := &updatermock.UpdaterMock{}
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(ioutil.NopCloser(bytes.NewReader([]byte("test"))), int64(4), nil).Once()
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.NoError(t, err)
+
+	um.AssertExpectations(t)
+}
+
+func TestDiscoverPeersIsCached(t *testing.T) {
+	uh := newPeerTestUpdateHub(t)
+
+	clock := &testClock{now: time.Now()}
+	uh.Clock = clock
+
+	discoveries := 0
+
+	uh.peerDiscoverer = func(productUID string, timeout time.Duration) ([]string, error) {
+		discoveries++
+		return []string{"10.0.0.1:8085"}, nil
+	}
+
+	assert.Equal(t, []string{"10.0.0.1:8085"}, uh.discoverPeers())
+	assert.Equal(t, []string{"10.0.0.1:8085"}, uh.discoverPeers())
+	assert.Equal(t, 1, discoveries)
+
+	clock.now = clock.now.Add(peerListTTL)
+
+	uh.discoverPeers()
+	assert.Equal(t, 2, discoveries)
+}
@@ -0,0 +1,266 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/handlers"
+	"github.com/UpdateHub/updatehub/installifdifferent"
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+// persistedMetadataFileName is the file, inside the download dir,
+// which keeps the update metadata of the persisted state
+const persistedMetadataFileName = "update-metadata.json"
+
+// resumable tells whether "state" can be resumed after a restart
+func resumable(state State) bool {
+	switch state.(type) {
+	case *DownloadingState, *InstallingState:
+		return true
+	}
+
+	return false
+}
+
+// persistState records "state" at the runtime settings so it can be
+// resumed after a restart. The objects already completed are kept
+// while the state and package remain the same. Non resumable states
+// clear the persisted one.
+func (uh *UpdateHub) persistState(state State) error {
+	uh.persistedStateMutex.Lock()
+	defer uh.persistedStateMutex.Unlock()
+
+	persisted := &uh.settings.PersistentStateSettings
+
+	// the state waiting for the window or the power is resumed instead
+	switch w := state.(type) {
+	case *WaitingForWindowState:
+		state = w.Next()
+	case *WaitingForPowerState:
+		state = w.Next()
+	}
+
+	var name, packageUID string
+	var updateMetadata *metadata.UpdateMetadata
+
+	if resumable(state) {
+		updateMetadata = state.(ReportableState).UpdateMetadata()
+		name = StateToString(state.ID())
+		packageUID = updateMetadata.PackageUID()
+	}
+
+	if name == persisted.State && packageUID == persisted.PackageUID {
+		return nil
+	}
+
+	metadataPath := path.Join(uh.settings.DownloadDir, persistedMetadataFileName)
+
+	if updateMetadata == nil {
+		err := uh.Store.Remove(metadataPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if packageUID != persisted.PackageUID {
+		err := uh.Store.MkdirAll(uh.settings.DownloadDir, 0755)
+		if err != nil {
+			return err
+		}
+
+		err = afero.WriteFile(uh.Store, metadataPath, updateMetadata.RawBytes, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	*persisted = PersistentStateSettings{
+		State:      name,
+		PackageUID: packageUID,
+	}
+
+	return uh.saveRuntimeSettings()
+}
+
+// objectCompleted tells whether the object "objectUID" was already
+// completed by the persisted state
+func (uh *UpdateHub) objectCompleted(id UpdateHubState, packageUID string, objectUID string) bool {
+	uh.persistedStateMutex.Lock()
+	defer uh.persistedStateMutex.Unlock()
+
+	persisted := &uh.settings.PersistentStateSettings
+
+	if persisted.State != StateToString(id) || persisted.PackageUID != packageUID {
+		return false
+	}
+
+	for _, o := range persisted.CompletedObjects {
+		if o == objectUID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setObjectCompleted records that the object "objectUID" was completed
+// by the state "id". It does nothing if "id" isn't the persisted
+// state.
+func (uh *UpdateHub) setObjectCompleted(id UpdateHubState, packageUID string, objectUID string) error {
+	uh.persistedStateMutex.Lock()
+	defer uh.persistedStateMutex.Unlock()
+
+	persisted := &uh.settings.PersistentStateSettings
+
+	if persisted.State != StateToString(id) || persisted.PackageUID != packageUID {
+		return nil
+	}
+
+	persisted.CompletedObjects = append(persisted.CompletedObjects, objectUID)
+	persisted.InstallingObject = ""
+
+	return uh.saveRuntimeSettings()
+}
+
+// setObjectInstalling records at the install journal that the object
+// "objectUID" is about to be installed, so an installation interrupted
+// by a power loss can be told apart from one that didn't start. It
+// does nothing if the installing state isn't the persisted one.
+func (uh *UpdateHub) setObjectInstalling(packageUID string, objectUID string) error {
+	uh.persistedStateMutex.Lock()
+	defer uh.persistedStateMutex.Unlock()
+
+	persisted := &uh.settings.PersistentStateSettings
+
+	if persisted.State != StateToString(UpdateHubStateInstalling) || persisted.PackageUID != packageUID {
+		return nil
+	}
+
+	persisted.InstallingObject = objectUID
+
+	return uh.saveRuntimeSettings()
+}
+
+// interruptedObject returns the object of "packageUID" whose
+// installation was interrupted, "" if there is none
+func (uh *UpdateHub) interruptedObject(packageUID string) string {
+	uh.persistedStateMutex.Lock()
+	defer uh.persistedStateMutex.Unlock()
+
+	persisted := &uh.settings.PersistentStateSettings
+
+	if persisted.State != StateToString(UpdateHubStateInstalling) || persisted.PackageUID != packageUID {
+		return ""
+	}
+
+	return persisted.InstallingObject
+}
+
+// restartInstall forgets the objects of "packageUID" already
+// installed, so the whole package is installed again over the dirty
+// installation set
+func (uh *UpdateHub) restartInstall(packageUID string) error {
+	uh.persistedStateMutex.Lock()
+	defer uh.persistedStateMutex.Unlock()
+
+	persisted := &uh.settings.PersistentStateSettings
+
+	if persisted.State != StateToString(UpdateHubStateInstalling) || persisted.PackageUID != packageUID {
+		return nil
+	}
+
+	persisted.CompletedObjects = nil
+	persisted.InstallingObject = ""
+
+	return uh.saveRuntimeSettings()
+}
+
+// resumeInterruptedInstall checks the install journal of "packageUID".
+// The installation is resumed at the interrupted object when its
+// handler is idempotent, otherwise the installation set is dirty and
+// the whole package is installed again.
+func (uh *UpdateHub) resumeInterruptedInstall(packageUID string, objects []metadata.Object) error {
+	objectUID := uh.interruptedObject(packageUID)
+	if objectUID == "" {
+		return nil
+	}
+
+	for _, o := range objects {
+		if o.GetObjectMetadata().Sha256sum != objectUID {
+			continue
+		}
+
+		if ii, ok := o.(handlers.IdempotentInstaller); ok && ii.Idempotent() {
+			log.Info(fmt.Sprintf("resuming the installation at the interrupted object '%s'", objectUID))
+			return nil
+		}
+	}
+
+	log.Warn(fmt.Sprintf("the installation of the object '%s' was interrupted, installing the whole package again", objectUID))
+
+	return uh.restartInstall(packageUID)
+}
+
+// RestoreState returns the state persisted before the agent was
+// restarted or nil if there isn't any. A persisted state that can't be
+// restored is discarded.
+func (uh *UpdateHub) RestoreState() State {
+	persisted := uh.settings.PersistentStateSettings
+
+	if persisted.State == "" {
+		return nil
+	}
+
+	state, err := uh.restoreState(persisted)
+	if err != nil {
+		log.Warn(fmt.Sprintf("failed to restore the '%s' state: %s", persisted.State, err))
+
+		err = uh.persistState(NewIdleState())
+		if err != nil {
+			log.Warn(err)
+		}
+
+		return nil
+	}
+
+	return state
+}
+
+func (uh *UpdateHub) restoreState(persisted PersistentStateSettings) (State, error) {
+	data, err := afero.ReadFile(uh.Store, path.Join(uh.settings.DownloadDir, persistedMetadataFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	updateMetadata, err := metadata.NewUpdateMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if updateMetadata.PackageUID() != persisted.PackageUID {
+		return nil, fmt.Errorf("the update metadata doesn't match the package '%s'", persisted.PackageUID)
+	}
+
+	switch persisted.State {
+	case StateToString(UpdateHubStateDownloading):
+		return NewDownloadingState(updateMetadata), nil
+	case StateToString(UpdateHubStateInstalling):
+		return NewInstallingState(updateMetadata,
+			uh.sha256Checker(),
+			uh.Store,
+			&installifdifferent.DefaultImpl{FileSystemBackend: uh.Store, CmdLineExecuter: uh.CmdLineExecuter},
+			&uh.FirmwareMetadata), nil
+	}
+
+	return nil, fmt.Errorf("the state can't be resumed")
+}
@@ -0,0 +1,358 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/installifdifferentmock"
+	"github.com/UpdateHub/updatehub/testsmocks/objectmock"
+	"github.com/UpdateHub/updatehub/testsmocks/statesmock"
+)
+
+const testObjectUID = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+func TestPersistState(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.RuntimeSettingsPath = "/runtime.conf"
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	metadataPath := path.Join(uh.settings.DownloadDir, persistedMetadataFileName)
+
+	err = uh.persistState(NewDownloadingState(m))
+	assert.NoError(t, err)
+
+	data, err := afero.ReadFile(uh.Store, metadataPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(validJSONMetadata), data)
+
+	err = uh.setObjectCompleted(UpdateHubStateDownloading, m.PackageUID(), testObjectUID)
+	assert.NoError(t, err)
+
+	expected := PersistentStateSettings{
+		State:            "downloading",
+		PackageUID:       m.PackageUID(),
+		CompletedObjects: []string{testObjectUID},
+	}
+	assert.Equal(t, expected, loadTestRuntimeSettings(t, uh).PersistentStateSettings)
+
+	// handling the same state again must keep the completed objects
+	err = uh.persistState(NewDownloadingState(m))
+	assert.NoError(t, err)
+	assert.True(t, uh.objectCompleted(UpdateHubStateDownloading, m.PackageUID(), testObjectUID))
+	assert.False(t, uh.objectCompleted(UpdateHubStateInstalling, m.PackageUID(), testObjectUID))
+
+	err = uh.persistState(NewInstallingState(m, nil, nil, nil, nil))
+	assert.NoError(t, err)
+
+	expected = PersistentStateSettings{
+		State:      "installing",
+		PackageUID: m.PackageUID(),
+	}
+	assert.Equal(t, expected, loadTestRuntimeSettings(t, uh).PersistentStateSettings)
+
+	err = uh.persistState(NewIdleState())
+	assert.NoError(t, err)
+
+	assert.Equal(t, PersistentStateSettings{}, loadTestRuntimeSettings(t, uh).PersistentStateSettings)
+
+	_, err = uh.Store.Stat(metadataPath)
+	assert.True(t, os.IsNotExist(err))
+
+	aim.AssertExpectations(t)
+}
+
+func TestRestoreState(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name          string
+		state         State
+		expectedState State
+	}{
+		{
+			"Downloading",
+			NewDownloadingState(m),
+			NewDownloadingState(m),
+		},
+		{
+			"Installing",
+			NewInstallingState(m, nil, nil, nil, nil),
+			&InstallingState{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			aim := &activeinactivemock.ActiveInactiveMock{}
+
+			uh, _ := newTestUpdateHub(nil, aim)
+
+			err := uh.persistState(tc.state)
+			assert.NoError(t, err)
+
+			state := uh.RestoreState()
+			assert.IsType(t, tc.expectedState, state)
+			assert.Equal(t, tc.state.ID(), state.ID())
+			assert.Equal(t, m.PackageUID(), state.(ReportableState).UpdateMetadata().PackageUID())
+
+			aim.AssertExpectations(t)
+		})
+	}
+}
+
+func TestRestoreStateWithoutPersistedState(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+
+	assert.Nil(t, uh.RestoreState())
+
+	aim.AssertExpectations(t)
+}
+
+func TestRestoreStateWithMismatchingMetadata(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	err = uh.persistState(NewDownloadingState(m))
+	assert.NoError(t, err)
+
+	uh.settings.PackageUID = "another-package"
+
+	assert.Nil(t, uh.RestoreState())
+	assert.Equal(t, PersistentStateSettings{}, uh.settings.PersistentStateSettings)
+
+	aim.AssertExpectations(t)
+}
+
+func TestStateInstallingSkipsCompletedObjects(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+
+	om := &objectmock.ObjectMock{}
+
+	mode := installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "test",
+		CheckRequirements: func() error { return nil },
+		GetObject:         func() interface{} { return om },
+	})
+	defer mode.Unregister()
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	scm := &statesmock.Sha256CheckerMock{}
+	iidm := &installifdifferentmock.InstallIfDifferentMock{}
+
+	s := NewInstallingState(m, scm, memFs, iidm, &metadata.FirmwareMetadata{})
+
+	uh, err := newTestUpdateHub(s, aim)
+	assert.NoError(t, err)
+
+	uh.settings.PersistentStateSettings = PersistentStateSettings{
+		State:            "installing",
+		PackageUID:       m.PackageUID(),
+		CompletedObjects: []string{testObjectUID},
+	}
+
+	nextState, _ := s.Handle(uh)
+	assert.IsType(t, &InstalledState{}, nextState)
+	assert.Equal(t, 1, uh.InstallProgress().InstalledObjects)
+
+	aim.AssertExpectations(t)
+	om.AssertExpectations(t)
+	scm.AssertExpectations(t)
+	iidm.AssertExpectations(t)
+}
+
+type idempotentObjectMock struct {
+	objectmock.ObjectMock
+
+	idempotent bool
+}
+
+func (o *idempotentObjectMock) Idempotent() bool {
+	return o.idempotent
+}
+
+func TestInstallJournal(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.RuntimeSettingsPath = "/runtime.conf"
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	// only the installing state keeps the journal
+	err = uh.persistState(NewDownloadingState(m))
+	assert.NoError(t, err)
+
+	err = uh.setObjectInstalling(m.PackageUID(), testObjectUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "", uh.interruptedObject(m.PackageUID()))
+
+	err = uh.persistState(NewInstallingState(m, nil, nil, nil, nil))
+	assert.NoError(t, err)
+
+	err = uh.setObjectInstalling(m.PackageUID(), testObjectUID)
+	assert.NoError(t, err)
+	assert.Equal(t, testObjectUID, uh.interruptedObject(m.PackageUID()))
+	assert.Equal(t, "", uh.interruptedObject("other-puid"))
+	assert.Equal(t, testObjectUID, loadTestRuntimeSettings(t, uh).InstallingObject)
+
+	err = uh.setObjectCompleted(UpdateHubStateInstalling, m.PackageUID(), testObjectUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "", uh.interruptedObject(m.PackageUID()))
+
+	expected := PersistentStateSettings{
+		State:            "installing",
+		PackageUID:       m.PackageUID(),
+		CompletedObjects: []string{testObjectUID},
+	}
+	assert.Equal(t, expected, loadTestRuntimeSettings(t, uh).PersistentStateSettings)
+}
+
+func TestStateInstallingWithInterruptedObject(t *testing.T) {
+	testCases := []struct {
+		name                  string
+		idempotent            bool
+		expectedFirstInstalls int
+	}{
+		{"ResumedAtIdempotentObject", true, 0},
+		{"ReinstalledWhenNotIdempotent", false, 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			memFs := afero.NewMemMapFs()
+
+			objects := []*idempotentObjectMock{}
+
+			mode := installmodes.RegisterInstallMode(installmodes.InstallMode{
+				Name:              "test",
+				CheckRequirements: func() error { return nil },
+				GetObject: func() interface{} {
+					o := &idempotentObjectMock{idempotent: tc.idempotent}
+					o.On("Setup").Return(nil)
+					o.On("Install", mock.Anything).Return(nil)
+					o.On("Cleanup").Return(nil)
+
+					objects = append(objects, o)
+
+					return o
+				},
+			})
+			defer mode.Unregister()
+
+			m, err := metadata.NewUpdateMetadata([]byte(`{
+			  "product-uid": "0123456789",
+			  "objects": [
+			    [
+			      {"mode": "test", "sha256sum": "` + testObjectUID + `"},
+			      {"mode": "test", "sha256sum": "` + olderObjectUID + `"}
+			    ]
+			  ]
+			}`))
+			assert.NoError(t, err)
+
+			scm := &statesmock.Sha256CheckerMock{}
+			scm.On("CheckDownloadedObjectSha256sum", memFs, mock.Anything, mock.Anything).Return(nil)
+
+			iidm := &installifdifferentmock.InstallIfDifferentMock{}
+			iidm.On("Proceed", mock.Anything).Return(true, nil)
+
+			s := NewInstallingState(m, scm, memFs, iidm, &metadata.FirmwareMetadata{})
+
+			uh, err := newTestUpdateHub(s, nil)
+			assert.NoError(t, err)
+			uh.RuntimeSettingsPath = "/runtime.conf"
+
+			// the power was lost while the second object was installed
+			uh.settings.PersistentStateSettings = PersistentStateSettings{
+				State:            "installing",
+				PackageUID:       m.PackageUID(),
+				CompletedObjects: []string{testObjectUID},
+				InstallingObject: olderObjectUID,
+			}
+
+			nextState, _ := s.Handle(uh)
+			assert.IsType(t, &InstalledState{}, nextState)
+
+			assert.Equal(t, 2, len(objects))
+			objects[0].AssertNumberOfCalls(t, "Install", tc.expectedFirstInstalls)
+			objects[1].AssertNumberOfCalls(t, "Install", 1)
+
+			expected := PersistentStateSettings{
+				State:            "installing",
+				PackageUID:       m.PackageUID(),
+				CompletedObjects: []string{testObjectUID, olderObjectUID},
+			}
+			assert.Equal(t, expected, uh.settings.PersistentStateSettings)
+		})
+	}
+}
+
+func TestUpdateHubFetchUpdateSkipsCompletedObjects(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	err = afero.WriteFile(uh.Store, path.Join(uh.settings.DownloadDir, testObjectUID), []byte("test"), 0644)
+	assert.NoError(t, err)
+
+	uh.settings.PersistentStateSettings = PersistentStateSettings{
+		State:            "downloading",
+		PackageUID:       m.PackageUID(),
+		CompletedObjects: []string{testObjectUID},
+	}
+
+	// there is no Updater, so fetching any object would panic
+	err = uh.FetchUpdate(context.Background(), m)
+	assert.NoError(t, err)
+	assert.Equal(t, DownloadProgress{TotalObjects: 1, DownloadedObjects: 1, DownloadedBytes: 4}, uh.DownloadProgress())
+
+	aim.AssertExpectations(t)
+}
@@ -0,0 +1,170 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+// pollingInterval returns the interval between the polls: the one told
+// by the server, kept within the "MinInterval" and "MaxInterval"
+// bounds, or the configured one
+func (uh *UpdateHub) pollingInterval() time.Duration {
+	interval := uh.settings.ServerPollingInterval
+	if interval <= 0 {
+		return uh.settings.PollingInterval
+	}
+
+	if uh.settings.PollingMinInterval > 0 && interval < uh.settings.PollingMinInterval {
+		interval = uh.settings.PollingMinInterval
+	}
+
+	if uh.settings.PollingMaxInterval > 0 && interval > uh.settings.PollingMaxInterval {
+		interval = uh.settings.PollingMaxInterval
+	}
+
+	// it must be at least a tick of the poll
+	if interval < uh.TimeStep {
+		interval = uh.TimeStep
+	}
+
+	return interval
+}
+
+// nextPollInterval returns the interval to the next poll. While the
+// update checks fail it's shorter, so the agent recovers quickly, but
+// backs off on each failure in a row so a struggling server isn't
+// hammered. A probe checks right away regardless.
+func (uh *UpdateHub) nextPollInterval() time.Duration {
+	retries := uh.settings.PollingRetries
+	if retries == 0 || uh.settings.PollingRetryInterval <= 0 {
+		return uh.pollingInterval()
+	}
+
+	return uh.backoffInterval(uh.settings.PollingRetryInterval, retries, uh.settings.PollingMaxRetryInterval)
+}
+
+// backoffInterval returns the interval to the retry after "failures"
+// in a row: "interval" doubled on each failure after the first, up to
+// "max" when it's greater than 0. It's never later than the next poll
+// and at least a tick of the poll.
+func (uh *UpdateHub) backoffInterval(interval time.Duration, failures int, max time.Duration) time.Duration {
+	pollingInterval := uh.pollingInterval()
+
+	for i := 1; i < failures && interval < pollingInterval; i++ {
+		interval *= 2
+	}
+
+	if max > 0 && interval > max {
+		interval = max
+	}
+
+	// it's never later than the next poll
+	if interval > pollingInterval {
+		interval = pollingInterval
+	}
+
+	// and must be at least a tick of the poll
+	if interval < uh.TimeStep {
+		interval = uh.TimeStep
+	}
+
+	return interval
+}
+
+// readServerPollingInterval takes the polling interval told by the
+// server on the last update check of "updater", if any
+func (uh *UpdateHub) readServerPollingInterval(updater client.Updater) {
+	reader, ok := updater.(client.PollingIntervalReader)
+	if !ok {
+		return
+	}
+
+	if interval, ok := reader.LastPollingInterval(); ok {
+		uh.setServerPollingInterval(interval)
+	}
+}
+
+// setServerPollingInterval overrides the polling interval by the one
+// told by the server, from the next poll on. A zero interval drops the
+// override. It's persisted, so it outlives the restarts.
+func (uh *UpdateHub) setServerPollingInterval(interval time.Duration) {
+	if interval == uh.settings.ServerPollingInterval {
+		return
+	}
+
+	uh.settings.ServerPollingInterval = interval
+
+	if interval > 0 {
+		log.Info(fmt.Sprintf("the server set the polling interval to %s", uh.pollingInterval()))
+	} else {
+		log.Info(fmt.Sprintf("the server dropped its polling interval, back to %s", uh.settings.PollingInterval))
+	}
+
+	uh.persistedStateMutex.Lock()
+	defer uh.persistedStateMutex.Unlock()
+
+	err := uh.saveRuntimeSettings()
+	if err != nil {
+		log.Warn("failed to save the polling interval: ", err)
+	}
+}
+
+// firstPollTime returns the time of the first poll, from "now" on. The
+// polls are spread along the "interval" by a stable offset of each
+// device, so the devices provisioned at once don't check for updates
+// at once. It's random for the devices without identity.
+func (uh *UpdateHub) firstPollTime(now time.Time, interval time.Duration) time.Time {
+	offset, ok := devicePollOffset(uh.GetFirmwareMetadata(), interval)
+	if !ok {
+		return now.Add(time.Duration(rand.Int63n(int64(interval))))
+	}
+
+	first := now.Truncate(interval).Add(offset)
+	if first.Before(now) {
+		first = first.Add(interval)
+	}
+
+	return first
+}
+
+// devicePollOffset returns the offset of the polls of the device "fm"
+// within "interval", derived from the hash of its identity
+func devicePollOffset(fm metadata.FirmwareMetadata, interval time.Duration) (time.Duration, bool) {
+	if len(fm.DeviceIdentity) == 0 || interval <= 0 {
+		return 0, false
+	}
+
+	keys := []string{}
+	for key := range fm.DeviceIdentity {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	h := sha256.New()
+	io.WriteString(h, fm.ProductUID)
+
+	for _, key := range keys {
+		fmt.Fprintf(h, "\x00%s=%s", key, fm.DeviceIdentity[key])
+	}
+
+	n := binary.BigEndian.Uint64(h.Sum(nil)[:8])
+
+	return time.Duration(n % uint64(interval)), true
+}
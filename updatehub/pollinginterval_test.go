@@ -0,0 +1,250 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+// pollingIntervalUpdater is an updater without updates whose server
+// tells the polling interval
+type pollingIntervalUpdater struct {
+	interval time.Duration
+	set      bool
+}
+
+func (u *pollingIntervalUpdater) CheckUpdate(ctx context.Context, api client.ApiRequester, uri string, data interface{}) (interface{}, time.Duration, error) {
+	return nil, 0, nil
+}
+
+func (u *pollingIntervalUpdater) FetchUpdate(ctx context.Context, api client.ApiRequester, uri string, offset int64) (io.ReadCloser, int64, error) {
+	return nil, -1, nil
+}
+
+func (u *pollingIntervalUpdater) LastPollingInterval() (time.Duration, bool) {
+	return u.interval, u.set
+}
+
+func TestPollingInterval(t *testing.T) {
+	testCases := []struct {
+		name             string
+		serverInterval   time.Duration
+		expectedInterval time.Duration
+	}{
+		{"Configured", 0, time.Hour},
+		{"Server", 2 * time.Hour, 2 * time.Hour},
+		{"BelowMinimum", time.Minute, 5 * time.Minute},
+		{"AboveMaximum", 30 * 24 * time.Hour, 7 * 24 * time.Hour},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			uh, err := newTestUpdateHub(NewIdleState(), nil)
+			assert.NoError(t, err)
+
+			uh.settings.PollingInterval = time.Hour
+			uh.settings.ServerPollingInterval = tc.serverInterval
+
+			assert.Equal(t, tc.expectedInterval, uh.pollingInterval())
+			assert.Equal(t, tc.expectedInterval, NewPollState(uh).interval)
+		})
+	}
+}
+
+func TestCheckUpdateWithServerPollingInterval(t *testing.T) {
+	uh, err := newTestUpdateHub(NewIdleState(), nil)
+	assert.NoError(t, err)
+
+	uh.RuntimeSettingsPath = "/runtime.conf"
+	uh.settings.PollingInterval = time.Hour
+
+	updater := &pollingIntervalUpdater{interval: 2 * time.Hour, set: true}
+	uh.Updater = updater
+
+	uh.CheckUpdate(context.Background(), 0)
+	assert.Equal(t, 2*time.Hour, uh.pollingInterval())
+
+	// it's persisted
+	data, err := afero.ReadFile(uh.Store, uh.RuntimeSettingsPath)
+	assert.NoError(t, err)
+
+	s, err := LoadSettings(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Hour, s.ServerPollingInterval)
+
+	// kept while the server doesn't tell another one
+	updater.set = false
+
+	uh.CheckUpdate(context.Background(), 0)
+	assert.Equal(t, 2*time.Hour, uh.pollingInterval())
+
+	// and dropped by a zero one
+	updater.interval = 0
+	updater.set = true
+
+	uh.CheckUpdate(context.Background(), 0)
+	assert.Equal(t, time.Hour, uh.pollingInterval())
+}
+
+func TestNextPollInterval(t *testing.T) {
+	testCases := []struct {
+		name             string
+		retries          int
+		retryInterval    time.Duration
+		expectedInterval time.Duration
+	}{
+		{"WithoutFailures", 0, time.Minute, time.Hour},
+		{"FirstFailure", 1, time.Minute, time.Minute},
+		{"SecondFailure", 2, time.Minute, 2 * time.Minute},
+		{"ThirdFailure", 3, time.Minute, 4 * time.Minute},
+		{"Capped", 10, time.Minute, 30 * time.Minute},
+		{"WithoutBackoff", 3, 0, time.Hour},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			uh, err := newTestUpdateHub(NewIdleState(), nil)
+			assert.NoError(t, err)
+
+			uh.settings.PollingInterval = time.Hour
+			uh.settings.PollingRetries = tc.retries
+			uh.settings.PollingRetryInterval = tc.retryInterval
+
+			assert.Equal(t, tc.expectedInterval, uh.nextPollInterval())
+		})
+	}
+}
+
+func TestBackoffInterval(t *testing.T) {
+	testCases := []struct {
+		name             string
+		interval         time.Duration
+		failures         int
+		max              time.Duration
+		expectedInterval time.Duration
+	}{
+		{"FirstFailure", time.Minute, 1, 0, time.Minute},
+		{"ThirdFailure", time.Minute, 3, 0, 4 * time.Minute},
+		{"Max", time.Minute, 10, 30 * time.Minute, 30 * time.Minute},
+		{"NeverLaterThanThePoll", time.Minute, 10, 0, time.Hour},
+		{"AtLeastATick", time.Millisecond, 1, 0, time.Second},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			uh, err := newTestUpdateHub(NewIdleState(), nil)
+			assert.NoError(t, err)
+
+			uh.settings.PollingInterval = time.Hour
+			uh.TimeStep = time.Second
+
+			assert.Equal(t, tc.expectedInterval, uh.backoffInterval(tc.interval, tc.failures, tc.max))
+		})
+	}
+}
+
+func TestFailedUpdateCheckIsRetriedWithBackoff(t *testing.T) {
+	uh, err := newTestUpdateHub(NewUpdateCheckState(), nil)
+	assert.NoError(t, err)
+
+	uh.settings.PollingInterval = time.Hour
+	uh.Controller = &testController{updateAvailable: false, extraPoll: -1}
+
+	for _, expectedInterval := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		idle, _ := NewUpdateCheckState().Handle(uh)
+		assert.IsType(t, &IdleState{}, idle)
+
+		poll, _ := idle.Handle(uh)
+		assert.IsType(t, &PollState{}, poll)
+		assert.Equal(t, expectedInterval, poll.(*PollState).interval)
+	}
+
+	// back to the polling interval once a check succeeds, even without
+	// an update
+	uh.Controller = &testController{updateAvailable: false, extraPoll: 0}
+
+	idle, _ := NewUpdateCheckState().Handle(uh)
+	assert.IsType(t, &IdleState{}, idle)
+	assert.Equal(t, 0, uh.settings.PollingRetries)
+
+	poll, _ := idle.Handle(uh)
+	assert.Equal(t, time.Hour, poll.(*PollState).interval)
+}
+
+func TestDevicePollOffset(t *testing.T) {
+	fm := metadata.FirmwareMetadata{
+		ProductUID:     "productuid",
+		DeviceIdentity: map[string]string{"mac": "00:11:22:33:44:55", "serial": "1234"},
+	}
+
+	offset, ok := devicePollOffset(fm, time.Hour)
+	assert.True(t, ok)
+	assert.True(t, offset >= 0 && offset < time.Hour)
+
+	// stable
+	other, ok := devicePollOffset(metadata.FirmwareMetadata{
+		ProductUID:     "productuid",
+		DeviceIdentity: map[string]string{"serial": "1234", "mac": "00:11:22:33:44:55"},
+	}, time.Hour)
+	assert.True(t, ok)
+	assert.Equal(t, offset, other)
+
+	// another device
+	other, ok = devicePollOffset(metadata.FirmwareMetadata{
+		ProductUID:     "productuid",
+		DeviceIdentity: map[string]string{"mac": "00:11:22:33:44:56", "serial": "1235"},
+	}, time.Hour)
+	assert.True(t, ok)
+	assert.NotEqual(t, offset, other)
+
+	// without identity
+	_, ok = devicePollOffset(metadata.FirmwareMetadata{ProductUID: "productuid"}, time.Hour)
+	assert.False(t, ok)
+}
+
+func TestFirstPollTime(t *testing.T) {
+	uh, err := newTestUpdateHub(NewIdleState(), nil)
+	assert.NoError(t, err)
+
+	uh.FirmwareMetadata = metadata.FirmwareMetadata{
+		ProductUID:     "productuid",
+		DeviceIdentity: map[string]string{"serial": "1234"},
+	}
+
+	offset, _ := devicePollOffset(uh.FirmwareMetadata, time.Hour)
+
+	now := time.Date(2017, time.June, 1, 10, 0, 0, 0, time.UTC)
+
+	// the device polls at the same offset of each interval
+	assert.Equal(t, now.Add(offset), uh.firstPollTime(now, time.Hour))
+	assert.Equal(t, now.Add(time.Hour+offset), uh.firstPollTime(now.Add(offset+time.Second), time.Hour))
+
+	for _, from := range []time.Time{now, now.Add(offset), now.Add(30 * time.Minute)} {
+		first := uh.firstPollTime(from, time.Hour)
+		assert.False(t, first.Before(from))
+		assert.True(t, first.Before(from.Add(time.Hour)))
+	}
+
+	// random without identity
+	uh.FirmwareMetadata = metadata.FirmwareMetadata{ProductUID: "productuid"}
+
+	first := uh.firstPollTime(now, time.Hour)
+	assert.False(t, first.Before(now))
+	assert.True(t, first.Before(now.Add(time.Hour)))
+}
@@ -0,0 +1,218 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// PowerStatus is the power of the device as told by the
+// "power_supply" class of the sysfs
+type PowerStatus struct {
+	ExternalPower bool // a mains or USB supply is online
+	Batteries     int  // the number of system batteries
+	BatteryLevel  int  // the average capacity of the batteries, in percent
+}
+
+// ReadPowerStatus reads the power supplies found at "dir". The
+// batteries of the peripherals, like those of a wireless mouse, are
+// ignored.
+func ReadPowerStatus(fs afero.Fs, dir string) (*PowerStatus, error) {
+	entries, err := afero.ReadDir(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &PowerStatus{}
+	capacity := 0
+
+	for _, entry := range entries {
+		supplyDir := path.Join(dir, entry.Name())
+
+		switch readSupplyAttribute(fs, supplyDir, "type") {
+		case "Battery":
+			if readSupplyAttribute(fs, supplyDir, "scope") == "Device" {
+				continue
+			}
+
+			level, err := strconv.Atoi(readSupplyAttribute(fs, supplyDir, "capacity"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid capacity of the battery '%s'", entry.Name())
+			}
+
+			status.Batteries++
+			capacity += level
+		case "Mains", "USB", "USB_C", "USB_PD", "USB_DCP", "USB_CDP", "USB_ACA":
+			if readSupplyAttribute(fs, supplyDir, "online") == "1" {
+				status.ExternalPower = true
+			}
+		}
+	}
+
+	if status.Batteries > 0 {
+		status.BatteryLevel = capacity / status.Batteries
+	}
+
+	return status, nil
+}
+
+// readSupplyAttribute returns the value of the "name" attribute of
+// the supply at "supplyDir", an empty string if it can't be read
+func readSupplyAttribute(fs afero.Fs, supplyDir string, name string) string {
+	data, err := afero.ReadFile(fs, path.Join(supplyDir, name))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+// powerGated tells whether the installation and the reboot depend on
+// the power of the device
+func (uh *UpdateHub) powerGated() bool {
+	return uh.settings.PowerMinBatteryLevel > 0 || uh.settings.PowerRequireAC || uh.settings.PowerCheckCommand != ""
+}
+
+// checkPower returns why the device hasn't enough power to install an
+// update or reboot, nil if it has. The "CheckCommand", when set, must
+// succeed. Otherwise the device must be on external power, if
+// "RequireAC" is set, or its batteries must be at least at
+// "MinBatteryLevel". A device without batteries runs on external
+// power.
+func (uh *UpdateHub) checkPower() error {
+	if uh.settings.PowerCheckCommand != "" {
+		var executer utils.CmdLineExecuter = uh.CmdLineExecuter
+		if executer == nil {
+			executer = &utils.CmdLine{}
+		}
+
+		_, err := executer.Execute(uh.settings.PowerCheckCommand)
+		if err != nil {
+			return fmt.Errorf("the power check command failed: %s", err)
+		}
+
+		return nil
+	}
+
+	status, err := ReadPowerStatus(uh.Store, uh.settings.PowerSupplyDir)
+	if err != nil {
+		return fmt.Errorf("failed to read the power supplies: %s", err)
+	}
+
+	if status.ExternalPower || status.Batteries == 0 {
+		return nil
+	}
+
+	if uh.settings.PowerRequireAC {
+		return fmt.Errorf("the device isn't on AC power")
+	}
+
+	if status.BatteryLevel < uh.settings.PowerMinBatteryLevel {
+		return fmt.Errorf("the battery level is %d%%, at least %d%% is required", status.BatteryLevel, uh.settings.PowerMinBatteryLevel)
+	}
+
+	return nil
+}
+
+// requiresPower tells whether "state" can only be handled while the
+// device has enough power
+func requiresPower(state State) bool {
+	switch state.(type) {
+	case *InstallingState, *RebootingState:
+		return true
+	}
+
+	return false
+}
+
+// waitForPower returns a WaitingForPowerState holding "state" if it
+// requires enough power and the device hasn't it. Otherwise "state" is
+// returned as is.
+func (uh *UpdateHub) waitForPower(state State) State {
+	if !requiresPower(state) || !uh.powerGated() {
+		return state
+	}
+
+	err := uh.checkPower()
+	if err == nil {
+		return state
+	}
+
+	log.Info(fmt.Sprintf("deferring the '%s' state: %s", StateToString(state.ID()), err))
+
+	return NewWaitingForPowerState(state.(ReportableState).UpdateMetadata(), state)
+}
+
+// WaitingForPowerState is the State interface implementation for the UpdateHubStateWaitingForPower
+type WaitingForPowerState struct {
+	BaseState
+	CancellableState
+
+	updateMetadata *metadata.UpdateMetadata
+	next           State
+}
+
+// ID returns the state id
+func (state *WaitingForPowerState) ID() UpdateHubState {
+	return state.id
+}
+
+// UpdateMetadata is the ReportableState interface implementation
+func (state *WaitingForPowerState) UpdateMetadata() *metadata.UpdateMetadata {
+	return state.updateMetadata
+}
+
+// Cancel cancels a state if it is cancellable
+func (state *WaitingForPowerState) Cancel(ok bool) bool {
+	return state.CancellableState.Cancel(ok)
+}
+
+// Next returns the state that is handled once the device has enough
+// power
+func (state *WaitingForPowerState) Next() State {
+	return state.next
+}
+
+// Handle for WaitingForPowerState checks the power every
+// "CheckInterval" and goes to the state it was holding once the device
+// has enough. It goes back to the idle state if cancelled.
+func (state *WaitingForPowerState) Handle(uh *UpdateHub) (State, bool) {
+	for {
+		select {
+		case <-uh.clock().After(uh.settings.PowerCheckInterval):
+		case <-state.cancel:
+			return NewIdleState(), false
+		}
+
+		if err := uh.checkPower(); err == nil {
+			return state.next, false
+		}
+	}
+}
+
+// NewWaitingForPowerState creates a new WaitingForPowerState which
+// goes to "next" once the device has enough power
+func NewWaitingForPowerState(updateMetadata *metadata.UpdateMetadata, next State) *WaitingForPowerState {
+	state := &WaitingForPowerState{
+		BaseState:        BaseState{id: UpdateHubStateWaitingForPower},
+		CancellableState: CancellableState{cancel: make(chan bool, 1)},
+		updateMetadata:   updateMetadata,
+		next:             next,
+	}
+
+	return state
+}
@@ -0,0 +1,216 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+)
+
+// writePowerSupply writes the "attributes" of the supply "name" at the
+// sysfs "dir"
+func writePowerSupply(t *testing.T, fs afero.Fs, dir string, name string, attributes map[string]string) {
+	for attribute, value := range attributes {
+		err := afero.WriteFile(fs, path.Join(dir, name, attribute), []byte(value+"\n"), 0644)
+		assert.NoError(t, err)
+	}
+}
+
+func TestReadPowerStatus(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	writePowerSupply(t, fs, "/sys/class/power_supply", "AC", map[string]string{"type": "Mains", "online": "0"})
+	writePowerSupply(t, fs, "/sys/class/power_supply", "BAT0", map[string]string{"type": "Battery", "capacity": "80"})
+	writePowerSupply(t, fs, "/sys/class/power_supply", "BAT1", map[string]string{"type": "Battery", "capacity": "40"})
+	writePowerSupply(t, fs, "/sys/class/power_supply", "hid-mouse", map[string]string{"type": "Battery", "scope": "Device", "capacity": "5"})
+
+	status, err := ReadPowerStatus(fs, "/sys/class/power_supply")
+	assert.NoError(t, err)
+	assert.Equal(t, &PowerStatus{ExternalPower: false, Batteries: 2, BatteryLevel: 60}, status)
+
+	writePowerSupply(t, fs, "/sys/class/power_supply", "usb", map[string]string{"type": "USB", "online": "1"})
+
+	status, err = ReadPowerStatus(fs, "/sys/class/power_supply")
+	assert.NoError(t, err)
+	assert.True(t, status.ExternalPower)
+}
+
+func TestReadPowerStatusWithErrors(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	_, err := ReadPowerStatus(fs, "/sys/class/power_supply")
+	assert.EqualError(t, err, "open /sys/class/power_supply: file does not exist")
+
+	writePowerSupply(t, fs, "/sys/class/power_supply", "BAT0", map[string]string{"type": "Battery", "capacity": "unknown"})
+
+	_, err = ReadPowerStatus(fs, "/sys/class/power_supply")
+	assert.EqualError(t, err, "invalid capacity of the battery 'BAT0'")
+}
+
+func TestCheckPower(t *testing.T) {
+	testCases := []struct {
+		name            string
+		online          string
+		capacity        string
+		minBatteryLevel int
+		requireAC       bool
+		expectedError   string
+	}{
+		{"BatteryAboveMinimum", "0", "50", 30, false, ""},
+		{"BatteryAtMinimum", "0", "30", 30, false, ""},
+		{"BatteryBelowMinimum", "0", "20", 30, false, "the battery level is 20%, at least 30% is required"},
+		{"BatteryBelowMinimumOnAC", "1", "20", 30, false, ""},
+		{"RequireACOnAC", "1", "100", 0, true, ""},
+		{"RequireACOnBattery", "0", "100", 0, true, "the device isn't on AC power"},
+		{"WithoutBattery", "0", "", 30, true, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			uh, _ := newTestUpdateHub(nil, nil)
+			uh.settings.PowerMinBatteryLevel = tc.minBatteryLevel
+			uh.settings.PowerRequireAC = tc.requireAC
+
+			writePowerSupply(t, uh.Store, uh.settings.PowerSupplyDir, "AC", map[string]string{"type": "Mains", "online": tc.online})
+			if tc.capacity != "" {
+				writePowerSupply(t, uh.Store, uh.settings.PowerSupplyDir, "BAT0", map[string]string{"type": "Battery", "capacity": tc.capacity})
+			}
+
+			err := uh.checkPower()
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedError)
+			}
+		})
+	}
+}
+
+func TestCheckPowerWithoutPowerSupplies(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.settings.PowerRequireAC = true
+
+	assert.EqualError(t, uh.checkPower(), "failed to read the power supplies: open /sys/class/power_supply: file does not exist")
+}
+
+func TestCheckPowerWithCommand(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.CmdLineExecuter = clm
+	uh.settings.PowerRequireAC = true
+	uh.settings.PowerCheckCommand = "/usr/bin/check-power"
+
+	// the power supplies aren't read
+	clm.On("Execute", "/usr/bin/check-power").Return([]byte(""), nil).Once()
+	assert.NoError(t, uh.checkPower())
+
+	clm.On("Execute", "/usr/bin/check-power").Return([]byte(""), fmt.Errorf("exit status 1")).Once()
+	assert.EqualError(t, uh.checkPower(), "the power check command failed: exit status 1")
+
+	clm.AssertExpectations(t)
+}
+
+func TestWaitForPower(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	m := &metadata.UpdateMetadata{}
+
+	installing := NewInstallingState(m, nil, nil, nil, nil)
+	rebooting := NewRebootingState(m)
+	downloading := NewDownloadingState(m)
+
+	// not gated
+	assert.Equal(t, installing, uh.waitForPower(installing))
+
+	uh.settings.PowerMinBatteryLevel = 30
+
+	writePowerSupply(t, uh.Store, uh.settings.PowerSupplyDir, "BAT0", map[string]string{"type": "Battery", "capacity": "10"})
+
+	state := uh.waitForPower(installing)
+	assert.IsType(t, &WaitingForPowerState{}, state)
+	assert.Equal(t, installing, state.(*WaitingForPowerState).Next())
+	assert.Equal(t, m, state.(*WaitingForPowerState).UpdateMetadata())
+	assert.Equal(t, "waiting-for-power", StateToString(state.ID()))
+
+	assert.IsType(t, &WaitingForPowerState{}, uh.waitForPower(rebooting))
+	assert.Equal(t, downloading, uh.waitForPower(downloading))
+
+	writePowerSupply(t, uh.Store, uh.settings.PowerSupplyDir, "BAT0", map[string]string{"capacity": "90"})
+
+	assert.Equal(t, installing, uh.waitForPower(installing))
+}
+
+func TestStateWaitingForPower(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.settings.PowerMinBatteryLevel = 30
+
+	writePowerSupply(t, uh.Store, uh.settings.PowerSupplyDir, "BAT0", map[string]string{"type": "Battery", "capacity": "10"})
+
+	checks := 0
+
+	uh.Clock = &testClock{after: func(d time.Duration) <-chan time.Time {
+		assert.Equal(t, 5*time.Minute, d)
+
+		// charged by the second check
+		checks++
+		if checks == 2 {
+			writePowerSupply(t, uh.Store, uh.settings.PowerSupplyDir, "BAT0", map[string]string{"capacity": "35"})
+		}
+
+		c := make(chan time.Time, 1)
+		c <- time.Now()
+		return c
+	}}
+
+	m := &metadata.UpdateMetadata{}
+	installing := NewInstallingState(m, nil, nil, nil, nil)
+
+	next, _ := NewWaitingForPowerState(m, installing).Handle(uh)
+	assert.Equal(t, installing, next)
+	assert.Equal(t, 2, checks)
+}
+
+func TestStateWaitingForPowerCancel(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	m := &metadata.UpdateMetadata{}
+
+	s := NewWaitingForPowerState(m, NewInstallingState(m, nil, nil, nil, nil))
+
+	go func() {
+		s.Cancel(true)
+	}()
+
+	next, _ := s.Handle(uh)
+	assert.IsType(t, &IdleState{}, next)
+}
+
+func TestPersistStateWhileWaitingForPower(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	err = uh.persistState(NewWaitingForPowerState(m, NewInstallingState(m, nil, nil, nil, nil)))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "installing", uh.settings.PersistentStateSettings.State)
+}
@@ -0,0 +1,58 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/UpdateHub/updatehub/client"
+)
+
+// StartPush requests, if enabled, the stream of the events pushed by
+// the server. The "update-available" and "probe" events make the agent
+// check for updates right away if it is idle or polling, and the
+// "rollback" event reverts the last update. The polling isn't
+// interrupted, so it's the fallback while the stream is down.
+func (uh *UpdateHub) StartPush() (*client.SSENotifier, error) {
+	s := uh.settings.PushSettings
+
+	if !s.PushEnabled {
+		return nil, nil
+	}
+
+	if s.PushEndpoint == "" {
+		return nil, errors.New("the push endpoint must be set")
+	}
+
+	notifier := client.NewSSENotifier(uh.API.Request(), s.PushEndpoint, uh.pushRequestData, s.PushRetryInterval, uh.handlePushEvent)
+	notifier.Start()
+
+	return notifier, nil
+}
+
+// pushRequestData identifies the device to the server when the stream
+// is requested, as done by the update checks
+func (uh *UpdateHub) pushRequestData() interface{} {
+	return uh.checkUpdateFirmwareMetadata()
+}
+
+func (uh *UpdateHub) handlePushEvent(event client.SSEEvent) {
+	switch event.Name {
+	case client.UpdateAvailableEvent, client.ProbeEvent:
+		uh.notifyUpdate()
+	case client.RollbackEvent:
+		err := uh.RollbackUpdate()
+		if err != nil {
+			log.Warn(fmt.Sprintf("ignoring the rollback event: %s", err))
+		}
+	default:
+		log.Debug(fmt.Sprintf("ignoring the pushed event '%s'", event.Name))
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/client"
+)
+
+func TestStartPushDisabled(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	notifier, err := uh.StartPush()
+	assert.NoError(t, err)
+	assert.Nil(t, notifier)
+}
+
+func TestStartPushWithoutEndpoint(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.settings.PushEnabled = true
+	uh.settings.PushEndpoint = ""
+
+	notifier, err := uh.StartPush()
+	assert.EqualError(t, err, "the push endpoint must be set")
+	assert.Nil(t, notifier)
+}
+
+func TestHandlePushEvent(t *testing.T) {
+	testCases := []struct {
+		name          string
+		event         string
+		expectedProbe bool
+	}{
+		{"UpdateAvailable", client.UpdateAvailableEvent, true},
+		{"Probe", client.ProbeEvent, true},
+		{"Unknown", "message", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			uh, _ := newTestUpdateHub(NewIdleState(), nil)
+
+			uh.handlePushEvent(client.SSEEvent{Name: tc.event})
+
+			select {
+			case <-uh.probeRequests():
+				assert.True(t, tc.expectedProbe)
+			default:
+				assert.False(t, tc.expectedProbe)
+			}
+		})
+	}
+}
+
+func TestStartPush(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/push", r.URL.Path)
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "event: update-available\n\n")
+		w.(http.Flusher).Flush()
+
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.API = client.NewApiClient(u.Host)
+	uh.settings.PushEnabled = true
+	uh.settings.PushEndpoint = "/push"
+
+	poll := NewPollState(uh)
+	poll.interval = time.Hour
+	uh.State = poll
+
+	notifier, err := uh.StartPush()
+	assert.NoError(t, err)
+	defer notifier.Stop()
+
+	next, _ := poll.Handle(uh)
+	assert.IsType(t, &UpdateCheckState{}, next)
+}
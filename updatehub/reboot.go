@@ -0,0 +1,34 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// reboot runs the "RebootCommand"
+func (uh *UpdateHub) reboot() error {
+	if uh.settings.RebootCommand == "" {
+		return fmt.Errorf("there is no reboot command set")
+	}
+
+	var executer utils.CmdLineExecuter = uh.CmdLineExecuter
+	if executer == nil {
+		executer = &utils.CmdLine{}
+	}
+
+	_, err := executer.Execute(uh.settings.RebootCommand)
+	if err != nil {
+		return fmt.Errorf("failed to run the reboot command: %s", err)
+	}
+
+	return nil
+}
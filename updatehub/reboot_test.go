@@ -0,0 +1,131 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+)
+
+func newTestRebootingUpdateHub(t *testing.T, aim *activeinactivemock.ActiveInactiveMock, clm *cmdlinemock.CmdLineExecuterMock) *UpdateHub {
+	uh, err := newTestUpdateHub(nil, aim)
+	assert.NoError(t, err)
+
+	uh.CmdLineExecuter = clm
+	uh.settings.RebootCallbacksDir = "/reboot.d"
+
+	err = afero.WriteFile(uh.Store, "/reboot.d/approve", []byte(""), 0755)
+	assert.NoError(t, err)
+
+	return uh
+}
+
+func TestStateRebooting(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	m := &metadata.UpdateMetadata{}
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", fmt.Sprintf("'/reboot.d/approve' %s", m.PackageUID())).Return([]byte(""), nil).Once()
+	clm.On("Execute", "systemctl reboot").Return([]byte(""), nil).Once()
+
+	uh := newTestRebootingUpdateHub(t, aim, clm)
+
+	s := NewRebootingState(m)
+	assert.Equal(t, "rebooting", StateToString(s.ID()))
+	assert.Equal(t, m, s.UpdateMetadata())
+
+	nextState, _ := s.Handle(uh)
+	assert.IsType(t, &IdleState{}, nextState)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestStateRebootingNotApproved(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	m := &metadata.UpdateMetadata{}
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", fmt.Sprintf("'/reboot.d/approve' %s", m.PackageUID())).Return([]byte(""), fmt.Errorf("user session active")).Once()
+
+	uh := newTestRebootingUpdateHub(t, aim, clm)
+
+	nextState, _ := NewRebootingState(m).Handle(uh)
+	assert.IsType(t, &IdleState{}, nextState)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestStateRebootingWithRebootCommandError(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	m := &metadata.UpdateMetadata{}
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", fmt.Sprintf("'/reboot.d/approve' %s", m.PackageUID())).Return([]byte(""), nil).Once()
+	clm.On("Execute", "/sbin/reboot").Return([]byte(""), fmt.Errorf("exit status 1")).Once()
+
+	uh := newTestRebootingUpdateHub(t, aim, clm)
+	uh.settings.RebootCommand = "/sbin/reboot"
+
+	nextState, _ := NewRebootingState(m).Handle(uh)
+	assert.Equal(t, NewErrorState(m, NewTransientError(fmt.Errorf("failed to run the reboot command: exit status 1"))), nextState)
+
+	uh.settings.RebootCommand = ""
+
+	err := uh.reboot()
+	assert.EqualError(t, err, "there is no reboot command set")
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestStateRebootingRecordsPendingValidation(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	aim.On("Active").Return(1, nil)
+
+	m, err := metadata.NewUpdateMetadata([]byte(validUpdateMetadataWithActiveInactive))
+	assert.NoError(t, err)
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", fmt.Sprintf("'/reboot.d/approve' %s", m.PackageUID())).Return([]byte(""), nil).Once()
+	clm.On("Execute", "systemctl reboot").Return([]byte(""), nil).Once()
+
+	uh := newTestRebootingUpdateHub(t, aim, clm)
+
+	nextState, _ := NewRebootingState(m).Handle(uh)
+	assert.IsType(t, &IdleState{}, nextState)
+
+	expected := PersistentUpdateSettings{
+		PendingValidationPackageUID: m.PackageUID(),
+		UpgradeToInstallation:       1,
+		BootAttempts:                0,
+	}
+	assert.Equal(t, expected, uh.settings.PersistentUpdateSettings)
+
+	// an already recorded validation is kept as is
+	err = uh.ensurePendingValidation(m)
+	assert.NoError(t, err)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
@@ -0,0 +1,136 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"reflect"
+	"sync/atomic"
+)
+
+// settingsReload hands the settings read again to the daemon, which
+// applies them and tells the result through "result"
+type settingsReload struct {
+	settings *Settings
+	result   chan error
+}
+
+// ReloadSettings reads the settings again and applies the following
+// ones without dropping the current state:
+//
+//	[Polling] Interval
+//	[Network] UpdateHubServerAddress (but not its scheme)
+//	[Network] FallbackServerAddresses
+//	[Network] ServerCooldown
+//	[Update] DownloadDir (only while idle or polling)
+//
+// The other settings only take effect after a restart, a warning is
+// logged when any of them changes. The reload is rejected as a whole if
+// the settings are invalid, the current ones are kept in that case.
+//
+// While the daemon is running the settings are applied by it, right
+// away while it's idle or polling, or else once the current state is
+// handled, so they don't change under the state. It returns once they
+// are applied.
+func (uh *UpdateHub) ReloadSettings() error {
+	s, problems, err := uh.readSettings()
+	if err != nil {
+		return fmt.Errorf("failed to reload the settings: %s", err)
+	}
+
+	err = settingsError(append(problems, uh.checkSettings(s)...))
+	if err != nil {
+		return fmt.Errorf("failed to reload the settings: %s", err)
+	}
+
+	if atomic.LoadInt32(&uh.daemonRunning) == 0 {
+		return uh.applySettings(s)
+	}
+
+	r := &settingsReload{settings: s, result: make(chan error, 1)}
+
+	select {
+	case uh.settingsReloads() <- r:
+	case <-uh.agentContext().Done():
+		return fmt.Errorf("failed to reload the settings: the agent is stopping")
+	}
+
+	return <-r.result
+}
+
+// applySettingsReloads applies the reloads handed to the daemon
+// meanwhile, see ReloadSettings
+func (uh *UpdateHub) applySettingsReloads() {
+	for {
+		select {
+		case r := <-uh.settingsReloads():
+			r.result <- uh.applySettings(r.settings)
+		default:
+			return
+		}
+	}
+}
+
+// applySettings applies the reloadable settings of "s", see
+// ReloadSettings
+func (uh *UpdateHub) applySettings(s *Settings) error {
+	current := uh.settings
+
+	scheme, _ := splitServerScheme(s.ServerAddress)
+	currentScheme, _ := splitServerScheme(current.ServerAddress)
+
+	if scheme != currentScheme {
+		return fmt.Errorf("failed to reload the settings: the server address scheme can't be changed without a restart")
+	}
+
+	if s.DownloadDir != current.DownloadDir {
+		switch state := uh.CurrentState(); state.(type) {
+		case *IdleState, *PollState:
+		default:
+			return fmt.Errorf("failed to reload the settings: the download dir can't be changed while in the '%s' state", StateToString(state.ID()))
+		}
+	}
+
+	// the runtime state is kept as it is
+	s.PersistentPollingSettings = current.PersistentPollingSettings
+	s.PersistentUpdateSettings = current.PersistentUpdateSettings
+	s.PersistentStateSettings = current.PersistentStateSettings
+	s.PersistentErrorPolicySettings = current.PersistentErrorPolicySettings
+
+	restartOnly := *s
+	restartOnly.PollingInterval = current.PollingInterval
+	restartOnly.ServerAddress = current.ServerAddress
+	restartOnly.FallbackServerAddresses = current.FallbackServerAddresses
+	restartOnly.ServerCooldown = current.ServerCooldown
+	restartOnly.DownloadDir = current.DownloadDir
+
+	if !reflect.DeepEqual(&restartOnly, current) {
+		log.Warn("some of the changed settings only take effect after a restart")
+	}
+
+	current.PollingInterval = s.PollingInterval
+	current.ServerAddress = s.ServerAddress
+	current.FallbackServerAddresses = s.FallbackServerAddresses
+	current.ServerCooldown = s.ServerCooldown
+	current.DownloadDir = s.DownloadDir
+
+	uh.setupServers()
+
+	log.Info("settings reloaded")
+
+	return nil
+}
+
+func (uh *UpdateHub) settingsReloads() chan *settingsReload {
+	uh.reloadOnce.Do(func() {
+		uh.reload = make(chan *settingsReload)
+	})
+
+	return uh.reload
+}
@@ -0,0 +1,194 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+)
+
+const reloadTestSettings = `[Polling]
+Interval=1h
+
+[Network]
+UpdateHubServerAddress=localhost:8080
+
+[Update]
+DownloadDir=/downloads
+`
+
+func newReloadTestUpdateHub(t *testing.T, state State) *UpdateHub {
+	uh, _ := newTestUpdateHub(state, &activeinactivemock.ActiveInactiveMock{})
+	uh.SystemSettingsPath = "/systempath"
+	uh.RuntimeSettingsPath = "/runtimepath"
+
+	err := afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte(reloadTestSettings), 0644)
+	assert.NoError(t, err)
+
+	err = uh.LoadSettings()
+	assert.NoError(t, err)
+
+	return uh
+}
+
+func TestUpdateHubReloadSettings(t *testing.T) {
+	uh := newReloadTestUpdateHub(t, NewIdleState())
+
+	lastPoll := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	uh.settings.LastPoll = lastPoll
+	uh.settings.PackageUID = "puid"
+
+	settings := `[Polling]
+Interval=2h
+
+[Network]
+UpdateHubServerAddress=other:8080
+FallbackServerAddresses=backup:8080
+
+[Update]
+DownloadDir=/other-downloads
+`
+
+	err := afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte(settings), 0644)
+	assert.NoError(t, err)
+
+	err = uh.ReloadSettings()
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2*time.Hour, uh.settings.PollingInterval)
+	assert.Equal(t, "other:8080", uh.settings.ServerAddress)
+	assert.Equal(t, []string{"backup:8080"}, uh.settings.FallbackServerAddresses)
+	assert.Equal(t, "/other-downloads", uh.settings.DownloadDir)
+
+	// the runtime state isn't dropped
+	assert.Equal(t, lastPoll, uh.settings.LastPoll)
+	assert.Equal(t, "puid", uh.settings.PackageUID)
+}
+
+func TestUpdateHubReloadSettingsThroughTheDaemon(t *testing.T) {
+	uh := newReloadTestUpdateHub(t, NewIdleState())
+	uh.daemonRunning = 1
+
+	poll := NewPollState(uh)
+	uh.State = poll
+
+	next := make(chan State)
+	go func() {
+		state, _ := poll.Handle(uh)
+		next <- state
+	}()
+
+	err := afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte("[Polling]\nInterval=2h\n\n[Network]\nUpdateHubServerAddress=localhost:8080\n\n[Update]\nDownloadDir=/other-downloads\n"), 0644)
+	assert.NoError(t, err)
+
+	// applied by the poll in progress
+	err = uh.ReloadSettings()
+	assert.NoError(t, err)
+
+	poll.Cancel(true)
+	<-next
+
+	assert.Equal(t, 2*time.Hour, uh.settings.PollingInterval)
+	assert.Equal(t, "/other-downloads", uh.settings.DownloadDir)
+
+	// while another state is handled they are applied before the next
+	// one, which must not be changing the download dir
+	uh.State = NewDownloadingState(&metadata.UpdateMetadata{})
+
+	err = afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte(reloadTestSettings), 0644)
+	assert.NoError(t, err)
+
+	errs := make(chan error)
+	go func() {
+		errs <- uh.ReloadSettings()
+	}()
+
+	select {
+	case <-errs:
+		t.Fatal("the settings were reloaded while the state was handled")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	uh.applySettingsReloads()
+
+	assert.EqualError(t, <-errs, "failed to reload the settings: the download dir can't be changed while in the 'downloading' state")
+	assert.Equal(t, "/other-downloads", uh.settings.DownloadDir)
+}
+
+func TestUpdateHubReloadSettingsWithRestartOnlyChanges(t *testing.T) {
+	uh := newReloadTestUpdateHub(t, NewIdleState())
+
+	err := afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte(reloadTestSettings+"\n[Approval]\nInstallMode=manual\n"), 0644)
+	assert.NoError(t, err)
+
+	err = uh.ReloadSettings()
+	assert.NoError(t, err)
+
+	assert.Equal(t, "auto", uh.settings.ApprovalInstallMode)
+}
+
+func TestUpdateHubReloadSettingsWithInvalidSettings(t *testing.T) {
+	testCases := []struct {
+		name          string
+		state         State
+		settings      string
+		expectedError string
+	}{
+		{
+			"InvalidApprovalMode",
+			NewIdleState(),
+			reloadTestSettings + "\n[Approval]\nInstallMode=later\n",
+			"failed to reload the settings: invalid settings: [Approval] InstallMode: invalid approval mode 'later'",
+		},
+
+		{
+			"ShortPollingInterval",
+			NewIdleState(),
+			"[Polling]\nInterval=1ms\n\n[Network]\nUpdateHubServerAddress=localhost:8080\n\n[Update]\nDownloadDir=/downloads\n",
+			"failed to reload the settings: invalid settings: [Polling] Interval: the polling interval must be at least 1s",
+		},
+
+		{
+			"ServerAddressScheme",
+			NewIdleState(),
+			"[Polling]\nInterval=1h\n\n[Network]\nUpdateHubServerAddress=grpc://localhost:50051\n\n[Update]\nDownloadDir=/downloads\n",
+			"failed to reload the settings: the server address scheme can't be changed without a restart",
+		},
+
+		{
+			"DownloadDirWhileDownloading",
+			NewDownloadingState(&metadata.UpdateMetadata{}),
+			"[Polling]\nInterval=1h\n\n[Network]\nUpdateHubServerAddress=localhost:8080\n\n[Update]\nDownloadDir=/other-downloads\n",
+			"failed to reload the settings: the download dir can't be changed while in the 'downloading' state",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			uh := newReloadTestUpdateHub(t, tc.state)
+
+			err := afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte(tc.settings), 0644)
+			assert.NoError(t, err)
+
+			err = uh.ReloadSettings()
+			assert.EqualError(t, err, tc.expectedError)
+
+			// nothing is applied
+			assert.Equal(t, time.Hour, uh.settings.PollingInterval)
+			assert.Equal(t, "localhost:8080", uh.settings.ServerAddress)
+			assert.Equal(t, "/downloads", uh.settings.DownloadDir)
+		})
+	}
+}
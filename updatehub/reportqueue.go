@@ -0,0 +1,304 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/client"
+)
+
+// stateReport is a state reported to the server, it's kept at the
+// report queue while it can't be sent
+type stateReport struct {
+	Time         time.Time   `json:"time"`
+	PackageUID   string      `json:"package-uid"`
+	State        string      `json:"state"`
+	ErrorMessage string      `json:"error-message,omitempty"`
+	Simulated    bool        `json:"simulated,omitempty"`
+	Details      interface{} `json:"error-details,omitempty"`
+	Entries      interface{} `json:"event-log,omitempty"`
+	Telemetry    interface{} `json:"telemetry,omitempty"`
+}
+
+// sameState tells whether "r" and "other" report the same state, so
+// only the first of them is sent
+func (r *stateReport) sameState(other *stateReport) bool {
+	return r.PackageUID == other.PackageUID &&
+		r.State == other.State &&
+		r.ErrorMessage == other.ErrorMessage &&
+		r.Simulated == other.Simulated
+}
+
+// reportedRecently tells whether "r" was the last state reported,
+// less than the repeat interval ago
+func (uh *UpdateHub) reportedRecently(r *stateReport) bool {
+	last := uh.lastReport
+	if last == nil || uh.settings == nil || !last.sameState(r) {
+		return false
+	}
+
+	return r.Time.Sub(last.Time) < uh.settings.ReportRepeatInterval
+}
+
+// reportQueue keeps, as a JSON array in a file, the reports which
+// couldn't be sent, so they are sent in order, before the newer ones,
+// once the server is reachable again. The state reports of the agent
+// and the reports the gateway forwards for the downstream agents are
+// kept in their own queue.
+type reportQueue struct {
+	mutex sync.Mutex
+}
+
+// openReportQueue holds the reports of a report queue while it's
+// locked, see reportQueue.open
+type openReportQueue struct {
+	queue      *reportQueue
+	fs         afero.Fs
+	path       string
+	maxReports int
+	reports    []json.RawMessage
+	changed    bool
+}
+
+// open locks the queue kept at "queuePath" and reads its reports, a
+// queue which can't be read is started over. The queue is written
+// back and unlocked by close, which only keeps the latest "maxReports"
+// when it's greater than 0.
+func (q *reportQueue) open(fs afero.Fs, queuePath string, maxReports int) *openReportQueue {
+	q.mutex.Lock()
+
+	o := &openReportQueue{queue: q, fs: fs, path: queuePath, maxReports: maxReports}
+
+	data, err := afero.ReadFile(fs, queuePath)
+	if err == nil {
+		err = json.Unmarshal(data, &o.reports)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn("failed to read the queued reports: ", err)
+		o.reports = nil
+		o.changed = true
+	}
+
+	return o
+}
+
+// push appends "report" to the queue
+func (o *openReportQueue) push(report json.RawMessage) {
+	o.reports = append(o.reports, report)
+	o.changed = true
+}
+
+// send sends the queued reports through "send", in order, until one of
+// them fails, whose error is returned. The reports refused by the
+// server won't ever be sent, so they are dropped instead.
+func (o *openReportQueue) send(send func(report json.RawMessage) error) error {
+	for len(o.reports) > 0 {
+		err := send(o.reports[0])
+		if client.IsPermanentError(err) {
+			log.Warn("dropping a queued report refused by the server: ", err)
+		} else if err != nil {
+			log.Debug(fmt.Sprintf("%d reports queued: %s", len(o.reports), err))
+			return err
+		}
+
+		o.reports = o.reports[1:]
+		o.changed = true
+	}
+
+	return nil
+}
+
+// close writes the queue back, if it was changed, and unlocks it. The
+// file is removed once the queue is empty.
+func (o *openReportQueue) close() error {
+	defer o.queue.mutex.Unlock()
+
+	if !o.changed {
+		return nil
+	}
+
+	if len(o.reports) == 0 {
+		err := o.fs.Remove(o.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	reports := o.reports
+
+	if max := o.maxReports; max > 0 && len(reports) > max {
+		log.Warn(fmt.Sprintf("dropping the %d oldest queued reports", len(reports)-max))
+		reports = reports[len(reports)-max:]
+	}
+
+	data, err := json.Marshal(reports)
+	if err != nil {
+		return err
+	}
+
+	err = o.fs.MkdirAll(path.Dir(o.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	return afero.WriteFile(o.fs, o.path, data, 0644)
+}
+
+// currentStateReport returns the report of the current state "rs"
+func (uh *UpdateHub) currentStateReport(rs ReportableState) *stateReport {
+	state := uh.CurrentState()
+	id := state.ID()
+
+	r := &stateReport{
+		Time:       uh.clock().Now(),
+		PackageUID: rs.UpdateMetadata().PackageUID(),
+		State:      StateToString(id),
+		Simulated:  uh.DryRun && isSimulatedState(id),
+	}
+
+	// the outcome of the update is reported along with the telemetry
+	// of its objects
+	if isOutcomeState(state) {
+		if telemetry := uh.packageTelemetry(r.PackageUID); telemetry != nil {
+			r.Telemetry = telemetry
+		}
+	}
+
+	// the errors are reported along with their cause and details
+	if es, ok := state.(*ErrorState); ok {
+		r.ErrorMessage = es.cause.Error()
+		r.Entries = uh.errorReportEvents()
+
+		if es.details != nil {
+			r.Details = es.details
+		}
+	}
+
+	return r
+}
+
+// sendStateReport sends "r" through the most detailed report the
+// reporter is able to send
+func (uh *UpdateHub) sendStateReport(r *stateReport) error {
+	api := uh.API.Request()
+
+	// the queued reports are sent along with the time of their state
+	if tr, ok := uh.Reporter.(client.TimedReporter); ok {
+		return tr.ReportStateAt(api, &client.StateReport{
+			Time:         r.Time,
+			PackageUID:   r.PackageUID,
+			State:        r.State,
+			ErrorMessage: r.ErrorMessage,
+			Simulated:    r.Simulated,
+			Details:      r.Details,
+			Entries:      r.Entries,
+			Telemetry:    r.Telemetry,
+		})
+	}
+
+	// the server is told which states were only simulated
+	if sr, ok := uh.Reporter.(client.SimulatedReporter); ok && r.Simulated {
+		return sr.ReportSimulatedState(api, r.PackageUID, r.State)
+	}
+
+	if dr, ok := uh.Reporter.(client.DetailedErrorReporter); ok && r.Details != nil {
+		return dr.ReportDetailedError(api, r.PackageUID, r.State, r.ErrorMessage, r.Details, r.Entries, r.Telemetry)
+	}
+
+	if tr, ok := uh.Reporter.(client.TelemetryReporter); ok && r.Telemetry != nil {
+		return tr.ReportTelemetry(api, r.PackageUID, r.State, r.ErrorMessage, r.Entries, r.Telemetry)
+	}
+
+	if er, ok := uh.Reporter.(client.ErrorReporter); ok && r.ErrorMessage != "" {
+		return er.ReportError(api, r.PackageUID, r.State, r.ErrorMessage, r.Entries)
+	}
+
+	return uh.Reporter.ReportState(api, r.PackageUID, r.State)
+}
+
+// reportState sends "r" after the queued reports, so the server gets
+// them in order. The reports which can't be sent are queued, the
+// same state isn't queued twice in a row. The error of "r", or of a
+// report before it, is returned.
+func (uh *UpdateHub) reportState(r *stateReport) error {
+	if uh.settings == nil || uh.settings.ReportQueuePath == "" {
+		return uh.sendStateReport(r)
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	queue := uh.openReportQueue()
+
+	last := &stateReport{}
+	if n := len(queue.reports); n == 0 || json.Unmarshal(queue.reports[n-1], last) != nil || !last.sameState(r) {
+		queue.push(data)
+	}
+
+	err = queue.send(uh.sendQueuedStateReport)
+
+	if werr := queue.close(); werr != nil {
+		log.Warn("failed to write the queued reports: ", werr)
+	}
+
+	return err
+}
+
+// flushReportQueue sends the queued reports, the failure is only
+// logged
+func (uh *UpdateHub) flushReportQueue() {
+	if uh.settings.ReportQueuePath == "" {
+		return
+	}
+
+	queue := uh.openReportQueue()
+	queue.send(uh.sendQueuedStateReport)
+
+	if err := queue.close(); err != nil {
+		log.Warn("failed to write the queued reports: ", err)
+	}
+}
+
+// QueuedReports returns how many state reports are waiting to be sent
+func (uh *UpdateHub) QueuedReports() int {
+	queue := uh.openReportQueue()
+	defer queue.close()
+
+	return len(queue.reports)
+}
+
+func (uh *UpdateHub) openReportQueue() *openReportQueue {
+	return uh.reportQueue.open(uh.Store, uh.settings.ReportQueuePath, uh.settings.ReportQueueMaxReports)
+}
+
+// sendQueuedStateReport sends the queued state report "data", the
+// reports which can't be decoded are dropped
+func (uh *UpdateHub) sendQueuedStateReport(data json.RawMessage) error {
+	r := &stateReport{}
+
+	if err := json.Unmarshal(data, r); err != nil {
+		log.Warn("dropping a queued report which can't be decoded: ", err)
+		return nil
+	}
+
+	return uh.sendStateReport(r)
+}
@@ -0,0 +1,303 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+// queued returns "v" as the reporters get it once the report went
+// through the queue, which keeps it as JSON
+func queued(t *testing.T, v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	assert.NoError(t, err)
+
+	var decoded interface{}
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+
+	return decoded
+}
+
+type unreachableReporter struct {
+	recordingReporter
+
+	err error
+}
+
+func (r *unreachableReporter) ReportState(api client.ApiRequester, packageUID string, state string) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	return r.recordingReporter.ReportState(api, packageUID, state)
+}
+
+// timedReporter records the time of the reported states
+type timedReporter struct {
+	unreachableReporter
+
+	times []time.Time
+}
+
+func (r *timedReporter) ReportStateAt(api client.ApiRequester, report *client.StateReport) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	r.times = append(r.times, report.Time)
+
+	return r.recordingReporter.ReportState(api, report.PackageUID, report.State)
+}
+
+func queuedStateReports(t *testing.T, uh *UpdateHub) []*stateReport {
+	data, err := afero.ReadFile(uh.Store, uh.settings.ReportQueuePath)
+	assert.NoError(t, err)
+
+	queue := []*stateReport{}
+
+	err = json.Unmarshal(data, &queue)
+	assert.NoError(t, err)
+
+	return queue
+}
+
+func newTestReportQueueUpdateHub(t *testing.T) (*UpdateHub, *unreachableReporter, *metadata.UpdateMetadata) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	uh, err := newTestUpdateHub(nil, nil)
+	assert.NoError(t, err)
+
+	uh.Clock = &testClock{now: time.Date(2017, time.June, 1, 10, 0, 0, 0, time.UTC)}
+
+	reporter := &unreachableReporter{}
+	uh.Reporter = reporter
+
+	return uh, reporter, m
+}
+
+func TestReportQueue(t *testing.T) {
+	uh, reporter, m := newTestReportQueueUpdateHub(t)
+
+	reporter.err = errors.New("report request failed")
+
+	states := []State{
+		NewDownloadingState(m),
+		NewDownloadingState(m),
+		NewInstallingState(m, nil, nil, nil, nil),
+		NewInstalledState(m),
+	}
+
+	for _, state := range states {
+		uh.State = state
+		assert.EqualError(t, uh.ReportCurrentState(), "report request failed")
+	}
+
+	// the same state isn't queued twice in a row
+	assert.Equal(t, 3, uh.QueuedReports())
+	assert.Nil(t, reporter.reports)
+
+	exists, err := afero.Exists(uh.Store, uh.settings.ReportQueuePath)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// the queued reports are sent, in order, before the current one
+	reporter.err = nil
+
+	uh.State = NewWaitingForRebootState(m)
+	assert.NoError(t, uh.ReportCurrentState())
+
+	puid := m.PackageUID()
+	assert.Equal(t, []string{puid + ":downloading", puid + ":installing", puid + ":installed", puid + ":waiting-for-reboot"}, reporter.reports)
+	assert.Equal(t, 0, uh.QueuedReports())
+
+	exists, err = afero.Exists(uh.Store, uh.settings.ReportQueuePath)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestReportQueueKeepsTheTime(t *testing.T) {
+	uh, reporter, m := newTestReportQueueUpdateHub(t)
+
+	reporter.err = errors.New("report request failed")
+
+	uh.State = NewDownloadingState(m)
+	assert.Error(t, uh.ReportCurrentState())
+
+	queue := queuedStateReports(t, uh)
+	assert.Equal(t, 1, len(queue))
+	assert.Equal(t, time.Date(2017, time.June, 1, 10, 0, 0, 0, time.UTC), queue[0].Time.UTC())
+	assert.Equal(t, m.PackageUID(), queue[0].PackageUID)
+	assert.Equal(t, "downloading", queue[0].State)
+}
+
+func TestReportQueueSendsTheTime(t *testing.T) {
+	uh, _, m := newTestReportQueueUpdateHub(t)
+
+	reporter := &timedReporter{}
+	reporter.err = errors.New("report request failed")
+	uh.Reporter = reporter
+
+	clock := uh.Clock.(*testClock)
+	queuedAt := clock.now
+
+	uh.State = NewDownloadingState(m)
+	assert.Error(t, uh.ReportCurrentState())
+
+	// the queued report is sent with the time of its state
+	reporter.err = nil
+	clock.now = clock.now.Add(time.Hour)
+
+	uh.State = NewInstalledState(m)
+	assert.NoError(t, uh.ReportCurrentState())
+
+	puid := m.PackageUID()
+	assert.Equal(t, []string{puid + ":downloading", puid + ":installed"}, reporter.reports)
+	assert.Equal(t, 2, len(reporter.times))
+	assert.True(t, queuedAt.Equal(reporter.times[0]))
+	assert.True(t, clock.now.Equal(reporter.times[1]))
+}
+
+func TestReportQueueStartsOverWhenUnreadable(t *testing.T) {
+	uh, reporter, m := newTestReportQueueUpdateHub(t)
+
+	err := afero.WriteFile(uh.Store, uh.settings.ReportQueuePath, []byte("["), 0644)
+	assert.NoError(t, err)
+
+	uh.State = NewDownloadingState(m)
+	assert.NoError(t, uh.ReportCurrentState())
+
+	assert.Equal(t, []string{m.PackageUID() + ":downloading"}, reporter.reports)
+	assert.Equal(t, 0, uh.QueuedReports())
+}
+
+func TestReportQueueDropsRefusedReports(t *testing.T) {
+	uh, reporter, m := newTestReportQueueUpdateHub(t)
+
+	reporter.err = &client.StatusError{StatusCode: http.StatusBadRequest}
+
+	uh.State = NewDownloadingState(m)
+	assert.NoError(t, uh.ReportCurrentState())
+
+	assert.Equal(t, 0, uh.QueuedReports())
+}
+
+func TestReportQueueMaxReports(t *testing.T) {
+	uh, reporter, m := newTestReportQueueUpdateHub(t)
+
+	uh.settings.ReportQueueMaxReports = 2
+	reporter.err = errors.New("report request failed")
+
+	for _, state := range []State{NewDownloadingState(m), NewInstalledState(m), NewWaitingForRebootState(m)} {
+		uh.State = state
+		assert.Error(t, uh.ReportCurrentState())
+	}
+
+	queue := queuedStateReports(t, uh)
+	assert.Equal(t, 2, len(queue))
+	assert.Equal(t, "installed", queue[0].State)
+	assert.Equal(t, "waiting-for-reboot", queue[1].State)
+}
+
+func TestFlushReportQueue(t *testing.T) {
+	uh, reporter, m := newTestReportQueueUpdateHub(t)
+
+	reporter.err = errors.New("report request failed")
+
+	uh.State = NewDownloadingState(m)
+	assert.Error(t, uh.ReportCurrentState())
+
+	uh.flushReportQueue()
+	assert.Equal(t, 1, uh.QueuedReports())
+
+	reporter.err = nil
+
+	uh.flushReportQueue()
+	assert.Equal(t, 0, uh.QueuedReports())
+	assert.Equal(t, []string{m.PackageUID() + ":downloading"}, reporter.reports)
+}
+
+func TestReportQueueDisabled(t *testing.T) {
+	uh, reporter, m := newTestReportQueueUpdateHub(t)
+
+	uh.settings.ReportQueuePath = ""
+	reporter.err = errors.New("report request failed")
+
+	uh.State = NewDownloadingState(m)
+	assert.EqualError(t, uh.ReportCurrentState(), "report request failed")
+
+	reporter.err = nil
+
+	uh.State = NewInstalledState(m)
+	assert.NoError(t, uh.ReportCurrentState())
+
+	// the failed report is lost
+	assert.Equal(t, []string{m.PackageUID() + ":installed"}, reporter.reports)
+}
+
+func TestReportRepeatedState(t *testing.T) {
+	uh, reporter, m := newTestReportQueueUpdateHub(t)
+
+	clock := uh.Clock.(*testClock)
+	puid := m.PackageUID()
+
+	uh.settings.ReportRepeatInterval = time.Hour
+
+	uh.State = NewErrorState(m, NewTransientError(errors.New("check failed")))
+	assert.NoError(t, uh.ReportCurrentState())
+
+	// the agent going back to the same state isn't reported
+	clock.now = clock.now.Add(30 * time.Minute)
+	assert.NoError(t, uh.ReportCurrentState())
+	assert.Equal(t, []string{puid + ":error"}, reporter.reports)
+
+	// unless it's been there for the repeat interval
+	clock.now = clock.now.Add(30 * time.Minute)
+	assert.NoError(t, uh.ReportCurrentState())
+	assert.Equal(t, []string{puid + ":error", puid + ":error"}, reporter.reports)
+
+	// another error is a transition
+	uh.State = NewErrorState(m, NewTransientError(errors.New("download failed")))
+	assert.NoError(t, uh.ReportCurrentState())
+	assert.Equal(t, []string{puid + ":error", puid + ":error", puid + ":error"}, reporter.reports)
+
+	uh.State = NewDownloadingState(m)
+	assert.NoError(t, uh.ReportCurrentState())
+	assert.Equal(t, puid+":downloading", reporter.reports[len(reporter.reports)-1])
+}
+
+func TestReportRepeatedStateAfterFailure(t *testing.T) {
+	uh, reporter, m := newTestReportQueueUpdateHub(t)
+
+	uh.settings.ReportQueuePath = ""
+	reporter.err = errors.New("report request failed")
+
+	uh.State = NewDownloadingState(m)
+	assert.Error(t, uh.ReportCurrentState())
+
+	// a state which wasn't reported is tried again
+	reporter.err = nil
+
+	assert.NoError(t, uh.ReportCurrentState())
+	assert.NoError(t, uh.ReportCurrentState())
+	assert.Equal(t, []string{m.PackageUID() + ":downloading"}, reporter.reports)
+}
@@ -0,0 +1,162 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+// RollbackUpdate reverts the device, as commanded by the server, to
+// the installation set that was active before the last update was
+// installed. It is only possible while the agent is idle or polling.
+func (uh *UpdateHub) RollbackUpdate() error {
+	switch state := uh.CurrentState(); state.(type) {
+	case *IdleState, *PollState:
+	default:
+		return fmt.Errorf("can't roll back while in the '%s' state", StateToString(state.ID()))
+	}
+
+	updateMetadata, err := uh.keptUpdateMetadata(installedMetadataFileName)
+	if err != nil {
+		return fmt.Errorf("there is no installed update to roll back")
+	}
+
+	if !isActiveInactive(updateMetadata) {
+		return fmt.Errorf("the update '%s' can't be rolled back, it has a single installation set", updateMetadata.PackageUID())
+	}
+
+	select {
+	case uh.rollbackRequests() <- updateMetadata:
+	default:
+		// a rollback is already pending
+	}
+
+	return nil
+}
+
+func (uh *UpdateHub) rollbackRequests() chan *metadata.UpdateMetadata {
+	uh.rollbackOnce.Do(func() {
+		uh.rollbackRequest = make(chan *metadata.UpdateMetadata, 1)
+	})
+
+	return uh.rollbackRequest
+}
+
+// revertInstallationSet activates the installation set preceding the
+// active one, which is where the update "packageUID" was installed
+// from
+func (uh *UpdateHub) revertInstallationSet(packageUID string) error {
+	active, err := uh.activeInactiveBackend.Active()
+	if err != nil {
+		return err
+	}
+
+	slots, err := uh.activeInactiveBackend.Slots()
+	if err != nil {
+		return err
+	}
+
+	previous := (active - 1 + slots) % slots
+
+	log.Warn(fmt.Sprintf("rolling back to installation set %d as commanded by the server", previous))
+
+	err = uh.activeInactiveBackend.SetActive(previous)
+
+	uh.auditSwitchSlot(packageUID, previous, err)
+
+	if err != nil {
+		return err
+	}
+
+	// the previous installation set is known to be good
+	return uh.setValidated()
+}
+
+// RollingBackState is the State interface implementation for the UpdateHubStateRollingBack
+type RollingBackState struct {
+	BaseState
+	ReportableState
+
+	updateMetadata *metadata.UpdateMetadata
+}
+
+// ID returns the state id
+func (state *RollingBackState) ID() UpdateHubState {
+	return state.id
+}
+
+// UpdateMetadata is the ReportableState interface implementation
+func (state *RollingBackState) UpdateMetadata() *metadata.UpdateMetadata {
+	return state.updateMetadata
+}
+
+// Handle for RollingBackState activates the previous installation set,
+// marks the rolled back package bad, so it isn't installed again, and
+// reports the rollback. It waits for the reboot, or for its approval,
+// if "AutoRebootAfterInstall" is set. It goes to the idle state
+// otherwise, or to the error state if the rollback fails.
+func (state *RollingBackState) Handle(uh *UpdateHub) (State, bool) {
+	packageUID := state.updateMetadata.PackageUID()
+
+	err := uh.revertInstallationSet(packageUID)
+	if err != nil {
+		return NewErrorState(state.updateMetadata, NewTransientError(fmt.Errorf("failed to roll back: %s", err))), false
+	}
+
+	uh.markBadPackage(packageUID, "was rolled back by the server")
+
+	// an update rolled back before being validated isn't validated
+	// anymore
+	if uh.settings.PendingValidationPackageUID == packageUID {
+		err = uh.clearPendingValidation()
+	} else {
+		err = uh.saveRuntimeSettings()
+	}
+
+	if err != nil {
+		log.Warn("failed to save the rollback: ", err)
+	}
+
+	// so it isn't rolled back twice, its objects are removed as well
+	err = uh.Store.Remove(path.Join(uh.settings.DownloadDir, installedMetadataFileName))
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn("failed to remove the installed update metadata: ", err)
+	}
+
+	if uh.Reporter != nil {
+		err = uh.Reporter.ReportState(uh.API.Request(), packageUID, rollbackReportState)
+		if err != nil {
+			log.Warn("failed to report the rollback: ", err)
+		}
+	}
+
+	if uh.settings.AutoRebootAfterInstall {
+		next := NewWaitingForRebootState(state.updateMetadata)
+		next.rollback = true
+
+		return uh.awaitApproval(next), false
+	}
+
+	return NewIdleState(), false
+}
+
+// NewRollingBackState creates a new RollingBackState which rolls back
+// the update of "updateMetadata"
+func NewRollingBackState(updateMetadata *metadata.UpdateMetadata) *RollingBackState {
+	state := &RollingBackState{
+		BaseState:      BaseState{id: UpdateHubStateRollingBack},
+		updateMetadata: updateMetadata,
+	}
+
+	return state
+}
@@ -0,0 +1,247 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+)
+
+func newTestRollbackUpdateHub(t *testing.T, state State, aii *activeinactivemock.ActiveInactiveMock) (*UpdateHub, *metadata.UpdateMetadata) {
+	uh, err := newTestUpdateHub(state, aii)
+	assert.NoError(t, err)
+
+	uh.RuntimeSettingsPath = "/runtime.conf"
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadataWithActiveInactive))
+	assert.NoError(t, err)
+
+	err = uh.keepUpdateMetadata(installedMetadataFileName, m)
+	assert.NoError(t, err)
+
+	return uh, m
+}
+
+func TestRollbackUpdate(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	uh, m := newTestRollbackUpdateHub(t, NewIdleState(), nil)
+	uh.settings.PollingEnabled = false
+
+	err := uh.RollbackUpdate()
+	assert.NoError(t, err)
+
+	// a second request is merged with the pending one
+	err = uh.RollbackUpdate()
+	assert.NoError(t, err)
+
+	next, _ := uh.State.Handle(uh)
+	assert.IsType(t, &RollingBackState{}, next)
+	assert.Equal(t, m, next.(*RollingBackState).UpdateMetadata())
+	assert.Equal(t, "rolling-back", StateToString(next.ID()))
+}
+
+func TestRollbackUpdateWhilePolling(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	uh, _ := newTestRollbackUpdateHub(t, nil, nil)
+
+	poll := NewPollState(uh)
+	uh.State = poll
+
+	err := uh.RollbackUpdate()
+	assert.NoError(t, err)
+
+	next, _ := poll.Handle(uh)
+	assert.IsType(t, &RollingBackState{}, next)
+}
+
+func TestRollbackUpdateWithErrors(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	uh, _ := newTestRollbackUpdateHub(t, NewDownloadingState(&metadata.UpdateMetadata{}), nil)
+
+	err := uh.RollbackUpdate()
+	assert.EqualError(t, err, "can't roll back while in the 'downloading' state")
+
+	uh.State = NewIdleState()
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	err = uh.keepUpdateMetadata(installedMetadataFileName, m)
+	assert.NoError(t, err)
+
+	err = uh.RollbackUpdate()
+	assert.EqualError(t, err, fmt.Sprintf("the update '%s' can't be rolled back, it has a single installation set", m.PackageUID()))
+
+	err = uh.Store.Remove(path.Join(uh.settings.DownloadDir, installedMetadataFileName))
+	assert.NoError(t, err)
+
+	err = uh.RollbackUpdate()
+	assert.EqualError(t, err, "there is no installed update to roll back")
+
+	select {
+	case <-uh.rollbackRequests():
+		t.Error("a rollback was requested")
+	default:
+	}
+}
+
+func TestStateRollingBack(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	testCases := []struct {
+		name          string
+		autoReboot    bool
+		rebootMode    string
+		expectedState State
+	}{
+		{"WithoutAutoReboot", false, ApprovalModeAuto, &IdleState{}},
+		{"WithAutoReboot", true, ApprovalModeAuto, &WaitingForRebootState{}},
+		{"WithRebootApproval", true, ApprovalModeManual, &AwaitingApprovalState{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			aim := &activeinactivemock.ActiveInactiveMock{}
+			aim.On("Active").Return(1, nil)
+			aim.On("Slots").Return(2, nil)
+			aim.On("SetActive", 0).Return(nil)
+
+			uh, m := newTestRollbackUpdateHub(t, nil, aim)
+			uh.settings.AutoRebootAfterInstall = tc.autoReboot
+			uh.settings.ApprovalRebootMode = tc.rebootMode
+
+			reporter := &recordingReporter{}
+			uh.Reporter = reporter
+
+			next, _ := NewRollingBackState(m).Handle(uh)
+			assert.IsType(t, tc.expectedState, next)
+
+			assert.Equal(t, []string{m.PackageUID() + ":rollback"}, reporter.reports)
+
+			// it isn't installed or rolled back again
+			assert.True(t, uh.isBadPackage(m.PackageUID()))
+			assert.Equal(t, []string{m.PackageUID()}, loadTestRuntimeSettings(t, uh).BadPackageUIDs)
+
+			exists, err := afero.Exists(uh.Store, path.Join(uh.settings.DownloadDir, installedMetadataFileName))
+			assert.NoError(t, err)
+			assert.False(t, exists)
+
+			aim.AssertExpectations(t)
+		})
+	}
+}
+
+func TestStateRollingBackWithThreeInstallationSets(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	vaim := &activeinactivemock.ValidatorActiveInactiveMock{}
+	vaim.On("Active").Return(0, nil)
+	vaim.On("Slots").Return(3, nil)
+	vaim.On("SetActive", 2).Return(nil)
+	vaim.On("SetValidated").Return(nil)
+
+	uh, m := newTestRollbackUpdateHub(t, nil, &vaim.ActiveInactiveMock)
+	uh.activeInactiveBackend = vaim
+
+	// rolled back before being validated
+	uh.settings.PersistentUpdateSettings = PersistentUpdateSettings{
+		PendingValidationPackageUID: m.PackageUID(),
+		UpgradeToInstallation:       0,
+		PreviousInstallation:        2,
+	}
+
+	next, _ := NewRollingBackState(m).Handle(uh)
+	assert.IsType(t, &WaitingForRebootState{}, next)
+
+	assert.Equal(t, PersistentUpdateSettings{}, loadTestRuntimeSettings(t, uh).PersistentUpdateSettings)
+
+	vaim.AssertExpectations(t)
+}
+
+func TestStateRollingBackWithSetActiveError(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	aim.On("Active").Return(1, nil)
+	aim.On("Slots").Return(2, nil)
+	aim.On("SetActive", 0).Return(fmt.Errorf("set active error"))
+
+	uh, m := newTestRollbackUpdateHub(t, nil, aim)
+
+	next, _ := NewRollingBackState(m).Handle(uh)
+	assert.IsType(t, &ErrorState{}, next)
+	assert.EqualError(t, next.(*ErrorState).cause, "transient error: failed to roll back: set active error")
+
+	assert.False(t, uh.isBadPackage(m.PackageUID()))
+
+	aim.AssertExpectations(t)
+}
+
+func TestStateRebootingAfterRollback(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	// the active installation set isn't queried to be validated
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "systemctl reboot").Return([]byte(""), nil)
+
+	uh, m := newTestRollbackUpdateHub(t, nil, aim)
+	uh.CmdLineExecuter = clm
+	uh.settings.RebootCallbacksDir = "/reboot-callbacks.d"
+
+	waiting := NewWaitingForRebootState(m)
+	waiting.rollback = true
+
+	rebooting, _ := waiting.Handle(uh)
+	assert.True(t, rebooting.(*RebootingState).rollback)
+
+	next, _ := rebooting.Handle(uh)
+	assert.IsType(t, &IdleState{}, next)
+
+	assert.Equal(t, "", uh.settings.PendingValidationPackageUID)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestHandleRollbackCommand(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	uh, _ := newTestRollbackUpdateHub(t, NewIdleState(), nil)
+
+	err := uh.handleChannelCommand(client.AgentMessage{Command: "rollback"})
+	assert.NoError(t, err)
+
+	<-uh.rollbackRequests()
+
+	uh.handlePushEvent(client.SSEEvent{Name: client.RollbackEvent})
+
+	<-uh.rollbackRequests()
+}
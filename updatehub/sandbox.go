@@ -0,0 +1,130 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+
+	"github.com/go-ini/ini"
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+var cmdLineExecuterType = reflect.TypeOf((*utils.CmdLineExecuter)(nil)).Elem()
+
+// sandboxed tells whether the commands run by the handlers of "mode"
+// are sandboxed
+func (uh *UpdateHub) sandboxed(mode string) bool {
+	if !uh.settings.SandboxEnabled {
+		return false
+	}
+
+	if len(uh.settings.SandboxModes) == 0 {
+		return true
+	}
+
+	for _, m := range uh.settings.SandboxModes {
+		if m == mode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sandboxProfile loads the profile of "mode" from the "<mode>.conf"
+// file of the "ProfilesDir". A mode without profile is sandboxed
+// without network and without resource limits.
+func (uh *UpdateHub) sandboxProfile(mode string) (utils.SandboxProfile, error) {
+	profile := utils.SandboxProfile{}
+
+	data, err := afero.ReadFile(uh.Store, path.Join(uh.settings.SandboxProfilesDir, mode+".conf"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return profile, nil
+		}
+
+		return profile, err
+	}
+
+	cfg, err := ini.Load(data)
+	if err != nil {
+		return profile, fmt.Errorf("invalid sandbox profile of the '%s' mode: %s", mode, err)
+	}
+
+	err = cfg.Section("").MapTo(&profile)
+	if err != nil {
+		return profile, fmt.Errorf("invalid sandbox profile of the '%s' mode: %s", mode, err)
+	}
+
+	if profile.SeccompProfile != "" && uh.settings.SandboxSeccompHelper == "" {
+		return profile, fmt.Errorf("the sandbox profile of the '%s' mode has a seccomp profile, but no 'SeccompHelper' is configured", mode)
+	}
+
+	return profile, nil
+}
+
+// sandboxHandler makes the handler of "o" run its commands inside a
+// sandbox, if its mode is sandboxed. The handlers that run commands
+// embed a utils.CmdLineExecuter, which is wrapped by the sandbox. The
+// "Target" of the handler, when it's an existing path, is the only one
+// writable besides the "WritablePaths" of the profile.
+func (uh *UpdateHub) sandboxHandler(o metadata.Object) error {
+	mode := o.GetObjectMetadata().Mode
+	if !uh.sandboxed(mode) {
+		return nil
+	}
+
+	value := reflect.ValueOf(o)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+
+	field := value.Elem().FieldByName("CmdLineExecuter")
+	if !field.IsValid() || !field.CanSet() || field.Type() != cmdLineExecuterType || field.IsNil() {
+		// the handler doesn't run commands
+		return nil
+	}
+
+	profile, err := uh.sandboxProfile(mode)
+	if err != nil {
+		return err
+	}
+
+	executer := field.Interface().(utils.CmdLineExecuter)
+
+	// sandboxed by a previous attempt to install it
+	if sandbox, ok := executer.(*utils.Sandbox); ok {
+		executer = sandbox.CmdLineExecuter
+	}
+
+	writable := []string{}
+
+	if target := value.Elem().FieldByName("Target"); target.IsValid() && target.Kind() == reflect.String {
+		if p := target.String(); path.IsAbs(p) {
+			if _, err := uh.Store.Stat(p); err == nil {
+				writable = append(writable, p)
+			}
+		}
+	}
+
+	field.Set(reflect.ValueOf(&utils.Sandbox{
+		CmdLineExecuter: executer,
+		Profile:         profile,
+		SeccompHelper:   uh.settings.SandboxSeccompHelper,
+		Writable:        writable,
+	}))
+
+	return nil
+}
@@ -0,0 +1,147 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// testCommandObject is the object of a mode whose handler runs commands
+type testCommandObject struct {
+	metadata.ObjectMetadata
+	utils.CmdLineExecuter
+
+	Target string
+}
+
+func TestSandboxed(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	assert.False(t, uh.sandboxed("raw"))
+
+	uh.settings.SandboxEnabled = true
+	assert.True(t, uh.sandboxed("raw"))
+
+	uh.settings.SandboxModes = []string{"imxkobs", "flash"}
+	assert.True(t, uh.sandboxed("flash"))
+	assert.False(t, uh.sandboxed("raw"))
+}
+
+func TestSandboxProfile(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.settings.SandboxSeccompHelper = "/usr/bin/seccomp-exec"
+
+	profile, err := uh.sandboxProfile("raw")
+	assert.NoError(t, err)
+	assert.Equal(t, utils.SandboxProfile{}, profile)
+
+	err = afero.WriteFile(uh.Store, "/etc/updatehub/sandbox.d/imxkobs.conf", []byte(`AllowNetwork=true
+Capabilities=CAP_SYS_RAWIO
+WritablePaths=/var/lib/firmware,/dev/mtd1
+MemoryLimit=67108864
+CPUTimeLimit=60
+MaxProcesses=8
+MaxOpenFiles=64
+SeccompProfile=/etc/updatehub/seccomp/imxkobs.json
+`), 0644)
+	assert.NoError(t, err)
+
+	profile, err = uh.sandboxProfile("imxkobs")
+	assert.NoError(t, err)
+	assert.Equal(t, utils.SandboxProfile{
+		AllowNetwork:   true,
+		Capabilities:   []string{"CAP_SYS_RAWIO"},
+		WritablePaths:  []string{"/var/lib/firmware", "/dev/mtd1"},
+		MemoryLimit:    67108864,
+		CPUTimeLimit:   60,
+		MaxProcesses:   8,
+		MaxOpenFiles:   64,
+		SeccompProfile: "/etc/updatehub/seccomp/imxkobs.json",
+	}, profile)
+
+	uh.settings.SandboxSeccompHelper = ""
+
+	_, err = uh.sandboxProfile("imxkobs")
+	assert.EqualError(t, err, "the sandbox profile of the 'imxkobs' mode has a seccomp profile, but no 'SeccompHelper' is configured")
+}
+
+func TestSandboxHandler(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "bwrap --ro-bind / / --dev /dev --proc /proc --dev-bind '/dev/mtd0' '/dev/mtd0' --unshare-pid --unshare-ipc --unshare-uts --unshare-net --cap-drop ALL --die-with-parent --new-session -- prlimit --cpu=60 -- kobs-ng init /tmp/file").Return([]byte(""), nil)
+
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.settings.SandboxEnabled = true
+
+	err := afero.WriteFile(uh.Store, "/etc/updatehub/sandbox.d/imxkobs.conf", []byte("CPUTimeLimit=60\n"), 0644)
+	assert.NoError(t, err)
+
+	err = afero.WriteFile(uh.Store, "/dev/mtd0", nil, 0644)
+	assert.NoError(t, err)
+
+	o := &testCommandObject{CmdLineExecuter: clm, Target: "/dev/mtd0"}
+	o.Mode = "imxkobs"
+
+	err = uh.sandboxHandler(o)
+	assert.NoError(t, err)
+
+	// sandboxed once, even if the install is retried
+	err = uh.sandboxHandler(o)
+	assert.NoError(t, err)
+
+	assert.IsType(t, &utils.Sandbox{}, o.CmdLineExecuter)
+	assert.Equal(t, clm, o.CmdLineExecuter.(*utils.Sandbox).CmdLineExecuter)
+
+	_, err = o.Execute("kobs-ng init /tmp/file")
+	assert.NoError(t, err)
+
+	clm.AssertExpectations(t)
+}
+
+func TestSandboxHandlerWithoutCommands(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.settings.SandboxEnabled = true
+
+	// a broken profile isn't loaded for the handlers without commands
+	err := afero.WriteFile(uh.Store, "/etc/updatehub/sandbox.d/test.conf", []byte("SeccompProfile=/seccomp.json\n"), 0644)
+	assert.NoError(t, err)
+
+	o := &testObject{}
+	o.Mode = "test"
+
+	assert.NoError(t, uh.sandboxHandler(o))
+
+	// a mode which isn't sandboxed is left as is
+	c := &testCommandObject{CmdLineExecuter: &utils.CmdLine{}}
+	c.Mode = "raw"
+
+	uh.settings.SandboxModes = []string{"imxkobs"}
+
+	assert.NoError(t, uh.sandboxHandler(c))
+	assert.IsType(t, &utils.CmdLine{}, c.CmdLineExecuter)
+}
+
+func TestSandboxHandlerWithoutTargetPath(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.settings.SandboxEnabled = true
+
+	for _, target := range []string{"", "rootfs", "/dev/missing"} {
+		o := &testCommandObject{CmdLineExecuter: &utils.CmdLine{}, Target: target}
+		o.Mode = "flash"
+
+		assert.NoError(t, uh.sandboxHandler(o))
+		assert.Equal(t, []string{}, o.CmdLineExecuter.(*utils.Sandbox).Writable)
+	}
+}
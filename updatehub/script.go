@@ -0,0 +1,311 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/spf13/afero"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// installScript returns the name and the source of the starlark script
+// which installs "updateMetadata", an empty source if it's installed
+// by the state machine. The script of the package, which must be one
+// of the "TrustedScripts", comes before the "ScriptPath" of the device.
+func (uh *UpdateHub) installScript(updateMetadata *metadata.UpdateMetadata) (string, []byte, error) {
+	if updateMetadata.Script != "" {
+		if !uh.settings.ScriptingEnabled {
+			return "", nil, fmt.Errorf("the update has an install script, but the scripting is disabled")
+		}
+
+		digest := sha256.Sum256([]byte(updateMetadata.Script))
+		sha256sum := hex.EncodeToString(digest[:])
+
+		for _, trusted := range uh.settings.ScriptingTrustedScripts {
+			if trusted == sha256sum {
+				return "package.star", []byte(updateMetadata.Script), nil
+			}
+		}
+
+		return "", nil, fmt.Errorf("the install script '%s' of the update isn't trusted", sha256sum)
+	}
+
+	if !uh.settings.ScriptingEnabled || uh.settings.ScriptingScriptPath == "" {
+		return "", nil, nil
+	}
+
+	src, err := afero.ReadFile(uh.Store, uh.settings.ScriptingScriptPath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return uh.settings.ScriptingScriptPath, src, nil
+}
+
+// installScriptRun is a run of the install script of an update
+type installScriptRun struct {
+	uh             *UpdateHub
+	state          *InstallingState
+	objects        []metadata.Object
+	indexToInstall int
+	activated      int // the installation set set as active, -1 if none
+}
+
+// runInstallScript installs the update of "state" by calling the
+// "install" function of the starlark script "src". The script can only
+// reach the device through the narrow API below, and its number of
+// execution steps is limited by "MaxSteps":
+//
+//	update                  the package-uid, product-uid, version,
+//	                        installation-set to install and objects
+//	                        (index, sha256sum, mode and size) of the
+//	                        update
+//	firmware                the product-uid, version, hardware and
+//	                        device-attributes of the device
+//	install_object(index)   installs the object "index" by its handler
+//	active()                returns the active installation set
+//	set_active(index)       sets the active installation set
+//
+// The installation set set as active is validated after the reboot.
+func (uh *UpdateHub) runInstallScript(state *InstallingState, name string, src []byte, indexToInstall int) error {
+	run := &installScriptRun{
+		uh:             uh,
+		state:          state,
+		objects:        state.updateMetadata.Objects[indexToInstall],
+		indexToInstall: indexToInstall,
+		activated:      -1,
+	}
+
+	thread := &starlark.Thread{
+		Name: name,
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Info(fmt.Sprintf("install script: %s", msg))
+		},
+	}
+
+	if uh.settings.ScriptingMaxSteps > 0 {
+		thread.SetMaxExecutionSteps(uint64(uh.settings.ScriptingMaxSteps))
+	}
+
+	globals, err := starlark.ExecFile(thread, name, src, run.predeclared())
+	if err != nil {
+		return fmt.Errorf("install script failed: %s", err)
+	}
+
+	install, ok := globals["install"].(starlark.Callable)
+	if !ok {
+		return fmt.Errorf("the install script has no 'install' function")
+	}
+
+	_, err = starlark.Call(thread, install, nil, nil)
+	if err != nil {
+		return fmt.Errorf("install script failed: %s", err)
+	}
+
+	if run.activated >= 0 && isActiveInactive(state.updateMetadata) && !uh.DryRun {
+		return uh.setPendingValidation(state.updateMetadata.PackageUID(), run.activated, len(state.updateMetadata.Objects))
+	}
+
+	return nil
+}
+
+func (run *installScriptRun) predeclared() starlark.StringDict {
+	m := run.state.updateMetadata
+	fm := run.uh.GetFirmwareMetadata()
+
+	objects := []starlark.Value{}
+	for i, o := range run.objects {
+		om := o.GetObjectMetadata()
+
+		objects = append(objects, starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"index":     starlark.MakeInt(i),
+			"sha256sum": starlark.String(om.Sha256sum),
+			"mode":      starlark.String(om.Mode),
+			"size":      starlark.MakeInt64(om.Size),
+		}))
+	}
+
+	attributes := starlark.NewDict(len(fm.DeviceAttributes))
+	for k, v := range fm.DeviceAttributes {
+		attributes.SetKey(starlark.String(k), starlark.String(v))
+	}
+
+	return starlark.StringDict{
+		"update": starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"package_uid":      starlark.String(m.PackageUID()),
+			"product_uid":      starlark.String(m.ProductUID),
+			"version":          starlark.String(m.Version),
+			"installation_set": starlark.MakeInt(run.indexToInstall),
+			"objects":          starlark.NewList(objects),
+		}),
+		"firmware": starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"product_uid":       starlark.String(fm.ProductUID),
+			"version":           starlark.String(fm.Version),
+			"hardware":          starlark.String(fm.Hardware),
+			"device_attributes": attributes,
+		}),
+		"install_object": starlark.NewBuiltin("install_object", run.installObject),
+		"active":         starlark.NewBuiltin("active", run.active),
+		"set_active":     starlark.NewBuiltin("set_active", run.setActive),
+	}
+}
+
+func (run *installScriptRun) installObject(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var index int
+
+	err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &index)
+	if err != nil {
+		return nil, err
+	}
+
+	if index < 0 || index >= len(run.objects) {
+		return nil, fmt.Errorf("%s: there is no object %d", b.Name(), index)
+	}
+
+	err = run.uh.installScriptObject(run.state, run.objects[index])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", b.Name(), err)
+	}
+
+	return starlark.None, nil
+}
+
+func (run *installScriptRun) active(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if run.uh.activeInactiveBackend == nil {
+		return nil, fmt.Errorf("%s: there is no active/inactive backend", b.Name())
+	}
+
+	active, err := run.uh.activeInactiveBackend.Active()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", b.Name(), err)
+	}
+
+	return starlark.MakeInt(active), nil
+}
+
+func (run *installScriptRun) setActive(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var index int
+
+	err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &index)
+	if err != nil {
+		return nil, err
+	}
+
+	if index < 0 || index >= len(run.state.updateMetadata.Objects) {
+		return nil, fmt.Errorf("%s: there is no installation set %d", b.Name(), index)
+	}
+
+	if run.uh.DryRun {
+		run.uh.simulateSetActive(index)
+		run.activated = index
+		return starlark.None, nil
+	}
+
+	if run.uh.activeInactiveBackend == nil {
+		return nil, fmt.Errorf("%s: there is no active/inactive backend", b.Name())
+	}
+
+	err = run.uh.activeInactiveBackend.SetActive(index)
+
+	run.uh.auditSwitchSlot(run.state.updateMetadata.PackageUID(), index, err)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", b.Name(), err)
+	}
+
+	run.activated = index
+
+	return starlark.None, nil
+}
+
+// installScriptObject installs "o" by its handler, as the state machine
+// does, for the install script
+func (uh *UpdateHub) installScriptObject(state *InstallingState, o metadata.Object) error {
+	packageUID := state.updateMetadata.PackageUID()
+	objectUID := o.GetObjectMetadata().Sha256sum
+
+	err := uh.VerifyObjectSignature(o)
+	if err != nil {
+		uh.auditObject(AuditVerifyObject, packageUID, objectUID, err)
+		return err
+	}
+
+	installer, streamed := uh.streamInstaller(o)
+
+	if !streamed {
+		err = state.CheckDownloadedObjectSha256sum(state.FileSystemBackend, uh.settings.DownloadDir, objectUID)
+
+		uh.auditObject(AuditVerifyObject, packageUID, objectUID, err)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if uh.DryRun {
+		return uh.simulateObjectInstall(o, state.InstallIfDifferentBackend)
+	}
+
+	err = uh.sandboxHandler(o)
+	if err != nil {
+		return err
+	}
+
+	err = o.Setup()
+	if err != nil {
+		return err
+	}
+
+	errorList := []error{}
+
+	install, err := state.InstallIfDifferentBackend.Proceed(o)
+	if err != nil {
+		errorList = append(errorList, err)
+	}
+
+	if install {
+		if streamed {
+			err = uh.installFromStream(uh.agentContext(), packageUID, o, installer)
+		} else {
+			err = o.Install(uh.settings.DownloadDir)
+		}
+		if err != nil {
+			errorList = append(errorList, err)
+		}
+	}
+
+	err = o.Cleanup()
+	if err != nil {
+		errorList = append(errorList, err)
+	}
+
+	if len(errorList) > 0 {
+		err = utils.MergeErrorList(errorList)
+		uh.auditObject(AuditInstall, packageUID, objectUID, err)
+		return err
+	}
+
+	uh.auditObject(AuditInstall, packageUID, objectUID, nil)
+
+	uh.addInstalledObject(packageUID)
+
+	return nil
+}
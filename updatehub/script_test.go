@@ -0,0 +1,290 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/installifdifferentmock"
+	"github.com/UpdateHub/updatehub/testsmocks/objectmock"
+	"github.com/UpdateHub/updatehub/testsmocks/statesmock"
+)
+
+// withScript returns the "jsonMetadata" carrying the install "script"
+func withScript(t *testing.T, jsonMetadata string, script string) string {
+	data, err := json.Marshal(script)
+	assert.NoError(t, err)
+
+	return strings.Replace(jsonMetadata, `"product-uid": "0123456789",`, fmt.Sprintf(`"product-uid": "0123456789", "script": %s,`, data), 1)
+}
+
+func scriptSha256sum(script string) string {
+	digest := sha256.Sum256([]byte(script))
+
+	return hex.EncodeToString(digest[:])
+}
+
+func TestInstallScript(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	script := "def install():\n    install_object(0)\n"
+
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	// installed by the state machine
+	_, src, err := uh.installScript(m)
+	assert.NoError(t, err)
+	assert.Nil(t, src)
+
+	m.Script = script
+
+	_, _, err = uh.installScript(m)
+	assert.EqualError(t, err, "the update has an install script, but the scripting is disabled")
+
+	uh.settings.ScriptingEnabled = true
+
+	_, _, err = uh.installScript(m)
+	assert.EqualError(t, err, fmt.Sprintf("the install script '%s' of the update isn't trusted", scriptSha256sum(script)))
+
+	uh.settings.ScriptingTrustedScripts = []string{scriptSha256sum(script)}
+
+	name, src, err := uh.installScript(m)
+	assert.NoError(t, err)
+	assert.Equal(t, "package.star", name)
+	assert.Equal(t, []byte(script), src)
+
+	// the script of the device is run if the package has none
+	m.Script = ""
+	uh.settings.ScriptingScriptPath = "/etc/updatehub/install.star"
+
+	_, _, err = uh.installScript(m)
+	assert.EqualError(t, err, "open /etc/updatehub/install.star: file does not exist")
+
+	err = afero.WriteFile(uh.Store, "/etc/updatehub/install.star", []byte(script), 0644)
+	assert.NoError(t, err)
+
+	name, src, err = uh.installScript(m)
+	assert.NoError(t, err)
+	assert.Equal(t, "/etc/updatehub/install.star", name)
+	assert.Equal(t, []byte(script), src)
+}
+
+func TestStateInstallingWithInstallScript(t *testing.T) {
+	script := `
+def install():
+    if firmware.device_attributes["board"] != "rev-b":
+        fail("unsupported board")
+
+    for o in update.objects:
+        print("installing %s" % o.sha256sum)
+        install_object(o.index)
+`
+
+	testCases := []struct {
+		name          string
+		board         string
+		expectedError string
+	}{
+		{"WithSupportedBoard", "rev-b", ""},
+		{"WithUnsupportedBoard", "rev-a", "transient error: install script failed: fail: unsupported board"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			memFs := afero.NewMemMapFs()
+
+			om := &objectmock.ObjectMock{}
+
+			mode := installmodes.RegisterInstallMode(installmodes.InstallMode{
+				Name:              "test",
+				CheckRequirements: func() error { return nil },
+				GetObject:         func() interface{} { return om },
+			})
+			defer mode.Unregister()
+
+			m, err := metadata.NewUpdateMetadata([]byte(withScript(t, validJSONMetadata, script)))
+			assert.NoError(t, err)
+
+			scm := &statesmock.Sha256CheckerMock{}
+			iidm := &installifdifferentmock.InstallIfDifferentMock{}
+
+			s := NewInstallingState(m, scm, memFs, iidm, &metadata.FirmwareMetadata{})
+
+			uh, err := newTestUpdateHub(s, nil)
+			assert.NoError(t, err)
+
+			uh.settings.ScriptingEnabled = true
+			uh.settings.ScriptingTrustedScripts = []string{scriptSha256sum(script)}
+			uh.FirmwareMetadata.DeviceAttributes = map[string]string{"board": tc.board}
+
+			if tc.expectedError == "" {
+				iidm.On("Proceed", om).Return(true, nil)
+				om.On("Setup").Return(nil)
+				om.On("Install", uh.settings.DownloadDir).Return(nil)
+				om.On("Cleanup").Return(nil)
+				scm.On("CheckDownloadedObjectSha256sum", memFs, uh.settings.DownloadDir, "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08").Return(nil)
+			}
+
+			next, _ := s.Handle(uh)
+
+			if tc.expectedError == "" {
+				assert.Equal(t, NewInstalledState(m), next)
+			} else {
+				assert.IsType(t, &ErrorState{}, next)
+				assert.EqualError(t, next.(*ErrorState).cause, tc.expectedError)
+			}
+
+			om.AssertExpectations(t)
+			scm.AssertExpectations(t)
+			iidm.AssertExpectations(t)
+		})
+	}
+}
+
+func TestStateInstallingWithInstallScriptSettingActive(t *testing.T) {
+	script := `
+def install():
+    install_object(0)
+
+    if active() != update.installation_set:
+        set_active(update.installation_set)
+`
+
+	memFs := afero.NewMemMapFs()
+
+	om := &objectmock.ObjectMock{}
+
+	mode := installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "test",
+		CheckRequirements: func() error { return nil },
+		GetObject:         func() interface{} { return om },
+	})
+	defer mode.Unregister()
+
+	m, err := metadata.NewUpdateMetadata([]byte(withScript(t, validJSONMetadataWithActiveInactive, script)))
+	assert.NoError(t, err)
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	aim.On("Active").Return(1, nil)
+	aim.On("SetActive", 0).Return(nil)
+
+	scm := &statesmock.Sha256CheckerMock{}
+
+	iidm := &installifdifferentmock.InstallIfDifferentMock{}
+	iidm.On("Proceed", om).Return(true, nil)
+
+	s := NewInstallingState(m, scm, memFs, iidm, &metadata.FirmwareMetadata{})
+
+	uh, err := newTestUpdateHub(s, aim)
+	assert.NoError(t, err)
+
+	uh.RuntimeSettingsPath = "/runtime.conf"
+	uh.settings.ScriptingEnabled = true
+	uh.settings.ScriptingTrustedScripts = []string{scriptSha256sum(script)}
+
+	om.On("Setup").Return(nil)
+	om.On("Install", uh.settings.DownloadDir).Return(nil)
+	om.On("Cleanup").Return(nil)
+	scm.On("CheckDownloadedObjectSha256sum", memFs, uh.settings.DownloadDir, "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08").Return(nil)
+
+	next, _ := s.Handle(uh)
+	assert.Equal(t, NewInstalledState(m), next)
+
+	// the installation set set as active is validated after the reboot
+	assert.Equal(t, PersistentUpdateSettings{
+		PendingValidationPackageUID: m.PackageUID(),
+		UpgradeToInstallation:       0,
+		PreviousInstallation:        1,
+	}, loadTestRuntimeSettings(t, uh).PersistentUpdateSettings)
+
+	aim.AssertExpectations(t)
+	om.AssertExpectations(t)
+	scm.AssertExpectations(t)
+	iidm.AssertExpectations(t)
+}
+
+func TestRunInstallScriptWithErrors(t *testing.T) {
+	testCases := []struct {
+		name          string
+		script        string
+		expectedError string
+	}{
+		{
+			"WithoutInstallFunction",
+			"def setup():\n    pass\n",
+			"the install script has no 'install' function",
+		},
+
+		{
+			"WithSyntaxError",
+			"def install(:\n",
+			"install script failed: package.star:1:",
+		},
+
+		{
+			"WithTooManySteps",
+			"def install():\n    for i in range(1000000000):\n        pass\n",
+			"install script failed: Starlark computation cancelled: too many steps",
+		},
+
+		{
+			"WithUnknownObject",
+			"def install():\n    install_object(5)\n",
+			"install script failed: install_object: there is no object 5",
+		},
+
+		{
+			"WithUnknownInstallationSet",
+			"def install():\n    set_active(2)\n",
+			"install script failed: set_active: there is no installation set 2",
+		},
+
+		{
+			"WithoutActiveInactiveBackend",
+			"def install():\n    set_active(0)\n",
+			"install script failed: set_active: there is no active/inactive backend",
+		},
+	}
+
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+			assert.NoError(t, err)
+
+			s := NewInstallingState(m, nil, nil, nil, nil)
+
+			uh, err := newTestUpdateHub(s, nil)
+			assert.NoError(t, err)
+
+			uh.settings.ScriptingMaxSteps = 1000
+
+			err = uh.runInstallScript(s, "package.star", []byte(tc.script), 0)
+			assert.Error(t, err)
+			assert.True(t, strings.HasPrefix(err.Error(), tc.expectedError), err.Error())
+		})
+	}
+}
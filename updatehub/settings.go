@@ -11,6 +11,7 @@ package updatehub
 import (
 	"io"
 	"io/ioutil"
+	"reflect"
 	"time"
 
 	"github.com/go-ini/ini"
@@ -25,24 +26,70 @@ type Settings struct {
 	StorageSettings  `ini:"Storage"`
 	UpdateSettings   `ini:"Update"`
 	NetworkSettings  `ini:"Network"`
+	MQTTSettings     `ini:"MQTT"`
+	PushSettings     `ini:"Push"`
+	ChannelSettings  `ini:"Channel"`
+	EventLogSettings `ini:"EventLog"`
 	FirmwareSettings `ini:"Firmware"`
+
+	ActiveInactiveSettings `ini:"ActiveInactive"`
+	WatchdogSettings       `ini:"Watchdog"`
+
+	PrivilegeSeparationSettings `ini:"PrivilegeSeparation"`
+	ErrorPolicySettings         `ini:"ErrorPolicy"`
+	ApprovalSettings            `ini:"Approval"`
+	EncryptionSettings          `ini:"Encryption"`
+	KeyStoreSettings            `ini:"KeyStore"`
+	DataUsageSettings           `ini:"DataUsage"`
+	PeerSettings                `ini:"Peer"`
+	GatewaySettings             `ini:"Gateway"`
+	PowerSettings               `ini:"Power"`
+	AuditLogSettings            `ini:"AuditLog"`
+	ReportSettings              `ini:"Report"`
+	HeartbeatSettings           `ini:"Heartbeat"`
+	ReportQueueSettings         `ini:"ReportQueue"`
+	SandboxSettings             `ini:"Sandbox"`
+	ScriptingSettings           `ini:"Scripting"`
+	SFTPSettings                `ini:"SFTP"`
+	MediumSettings              `ini:"Medium"`
+
+	PersistentStateSettings `ini:"State"`
 }
 
 type PersistentSettings struct {
-	PersistentPollingSettings `ini:"Polling"`
+	PersistentPollingSettings     `ini:"Polling"`
+	PersistentUpdateSettings      `ini:"Update"`
+	PersistentStateSettings       `ini:"State"`
+	PersistentErrorPolicySettings `ini:"ErrorPolicy"`
+	PersistentDataUsageSettings   `ini:"DataUsage"`
 }
 
+// PollingSettings configures how often the agent checks for updates.
+// The server may override the "Interval" (see ServerPollingInterval),
+// within "MinInterval" and "MaxInterval". A failed check is retried
+// after "RetryInterval", doubled on each failure in a row up to
+// "MaxRetryInterval", instead of on the next poll. It only covers the
+// update checks, the failures of an update once it's offered are
+// retried by the "RetryInterval" of the ErrorPolicySettings.
 type PollingSettings struct {
 	PollingInterval           time.Duration `ini:"Interval,omitempty"`
 	PollingEnabled            bool          `ini:"Enabled,omitempty"`
+	PollingMinInterval        time.Duration `ini:"MinInterval"`
+	PollingMaxInterval        time.Duration `ini:"MaxInterval"`
+	PollingRetryInterval      time.Duration `ini:"RetryInterval"` // 0 means on the next poll
+	PollingMaxRetryInterval   time.Duration `ini:"MaxRetryInterval"`
 	PersistentPollingSettings `ini:"Polling"`
 }
 
+// PersistentPollingSettings holds the polls done. The
+// "ServerInterval" is the polling interval told by the server, which
+// overrides the configured one until the server drops it.
 type PersistentPollingSettings struct {
-	LastPoll             time.Time     `ini:"LastPoll"`
-	FirstPoll            time.Time     `ini:"FirstPoll"`
-	ExtraPollingInterval time.Duration `ini:"ExtraInterval"`
-	PollingRetries       int           `ini:"Retries"`
+	LastPoll              time.Time     `ini:"LastPoll"`
+	FirstPoll             time.Time     `ini:"FirstPoll"`
+	ExtraPollingInterval  time.Duration `ini:"ExtraInterval"`
+	PollingRetries        int           `ini:"Retries"`
+	ServerPollingInterval time.Duration `ini:"ServerInterval"`
 }
 
 type StorageSettings struct {
@@ -50,41 +97,422 @@ type StorageSettings struct {
 }
 
 type UpdateSettings struct {
-	DownloadDir               string   `ini:"DownloadDir"`
-	AutoDownloadWhenAvailable bool     `ini:"AutoDownloadWhenAvailable"`
-	AutoInstallAfterDownload  bool     `ini:"AutoInstallAfterDownload"`
-	AutoRebootAfterInstall    bool     `ini:"AutoRebootAfterInstall"`
-	SupportedInstallModes     []string `ini:"SupportedInstallModes"`
+	DownloadDir               string        `ini:"DownloadDir"`
+	AutoDownloadWhenAvailable bool          `ini:"AutoDownloadWhenAvailable"`
+	AutoInstallAfterDownload  bool          `ini:"AutoInstallAfterDownload"`
+	AutoRebootAfterInstall    bool          `ini:"AutoRebootAfterInstall"`
+	SupportedInstallModes     []string      `ini:"SupportedInstallModes"`
+	DownloadConcurrency       int           `ini:"DownloadConcurrency"`
+	MaxDownloadRate           int64         `ini:"MaxDownloadRate"`     // in bytes per second, 0 means no limit
+	DownloadSpaceMargin       int64         `ini:"DownloadSpaceMargin"` // in bytes, kept free after downloading
+	DownloadDirMaxSize        int64         `ini:"DownloadDirMaxSize"`  // in bytes, 0 means no limit
+	StreamingInstall          bool          `ini:"StreamingInstall"`    // install the raw/flash objects while downloading them
+	ParanoidSha256Check       bool          `ini:"ParanoidSha256Check"` // read the objects again to check them
+	DownloadMaxAttempts       int           `ini:"DownloadMaxAttempts"`
+	DownloadRetryInterval     time.Duration `ini:"DownloadRetryInterval"`    // doubled on each new attempt
+	DownloadMaxRetryInterval  time.Duration `ini:"DownloadMaxRetryInterval"` // 0 means no limit
+	DownloadStallTimeout      time.Duration `ini:"DownloadStallTimeout"`     // an object is retried after this long without data
+	DownloadTimeout           time.Duration `ini:"DownloadTimeout"`          // for all the objects, 0 means no limit
+	MetadataPublicKeyPath     string        `ini:"MetadataPublicKeyPath"`
+	ObjectPublicKeyPaths      []string      `ini:"ObjectPublicKeyPaths"` // the object signatures aren't checked when empty
+	TrustedKeysDir            string        `ini:"TrustedKeysDir"`       // the keys delivered by the updates
+	StateChangeCallbacksDir   string        `ini:"StateChangeCallbacksDir"`
+	ValidationCallbacksDir    string        `ini:"ValidationCallbacksDir"`
+	MaxBootAttempts           int           `ini:"MaxBootAttempts"`
+	MaintenanceWindow         string        `ini:"MaintenanceWindow"`     // "HH:MM-HH:MM" in local time, empty means always
+	MaintenanceWindowDays     []string      `ini:"MaintenanceWindowDays"` // "mon", "tue"... empty means every day
+	RebootCommand             string        `ini:"RebootCommand"`
+	RebootCallbacksDir        string        `ini:"RebootCallbacksDir"`
+	AllowDowngrade            bool          `ini:"AllowDowngrade"` // install the older versions found in a dir, a medium or over SFTP
+	PersistentUpdateSettings  `ini:"Update"`
+}
+
+type PersistentUpdateSettings struct {
+	PendingValidationPackageUID string `ini:"PendingValidationPackageUID"`
+	UpgradeToInstallation       int    `ini:"UpgradeToInstallation"`
+	PreviousInstallation        int    `ini:"PreviousInstallation"`
+	BootAttempts                int    `ini:"BootAttempts"`
+}
+
+// MQTTSettings configures the MQTT broker whose messages at "Topic"
+// make the agent check for updates right away
+type MQTTSettings struct {
+	MQTTEnabled               bool   `ini:"Enabled"`
+	MQTTBroker                string `ini:"Broker"`
+	MQTTTopic                 string `ini:"Topic"`
+	MQTTClientID              string `ini:"ClientID"`
+	MQTTClientCertificatePath string `ini:"ClientCertificate"`
+	MQTTClientKeyPath         string `ini:"ClientKey"`
+	MQTTCACertificatePath     string `ini:"CACertificate"`
+}
+
+// PushSettings configures the Server-Sent Events stream, requested at
+// "Endpoint" of the server, whose "update-available" and "probe"
+// events make the agent check for updates right away. The stream is
+// requested again "RetryInterval" after it drops, the polling goes on
+// meanwhile.
+type PushSettings struct {
+	PushEnabled       bool          `ini:"Enabled"`
+	PushEndpoint      string        `ini:"Endpoint"`
+	PushRetryInterval time.Duration `ini:"RetryInterval"`
+}
+
+// ChannelSettings configures the WebSocket session opened at
+// "Endpoint" of the server, which carries the state reports upstream
+// and the commands downstream. It's opened again whenever it drops,
+// after "RetryInterval", doubled on each failed attempt up to
+// "MaxRetryInterval".
+type ChannelSettings struct {
+	ChannelEnabled          bool          `ini:"Enabled"`
+	ChannelEndpoint         string        `ini:"Endpoint"`
+	ChannelRetryInterval    time.Duration `ini:"RetryInterval"`
+	ChannelMaxRetryInterval time.Duration `ini:"MaxRetryInterval"`
+}
+
+// EventLogSettings configures the log of the agent events and its
+// shipping to the server, or to "Endpoint" when it is set. The log can
+// also be attached to the error reports.
+type EventLogSettings struct {
+	EventLogPath                 string `ini:"Path"`
+	EventLogMaxEntries           int    `ini:"MaxEntries"`
+	EventLogShippingEnabled      bool   `ini:"ShippingEnabled"`
+	EventLogEndpoint             string `ini:"Endpoint"`
+	EventLogAttachToErrorReports bool   `ini:"AttachToErrorReports"`
+}
+
+// PowerSettings holds the installation and the reboot until the device
+// has enough power: its batteries must be at least at
+// "MinBatteryLevel", unless on external power, and it must be on
+// external power if "RequireAC" is set. The power supplies are read
+// from "SupplyDir" or, when "CheckCommand" is set, that command must
+// succeed instead. The power is checked again every "CheckInterval".
+type PowerSettings struct {
+	PowerMinBatteryLevel int           `ini:"MinBatteryLevel"` // in percent, 0 means no minimum
+	PowerRequireAC       bool          `ini:"RequireAC"`
+	PowerSupplyDir       string        `ini:"SupplyDir"`
+	PowerCheckCommand    string        `ini:"CheckCommand"`
+	PowerCheckInterval   time.Duration `ini:"CheckInterval"`
 }
 
+// AuditLogSettings configures the append-only, hash-chained log of the
+// update operations, kept at "Path". There is no audit log when "Path"
+// is empty. The entries are chained by the key of the device found at
+// "Key". Once the log gets bigger than "MaxSize" it's rotated, up to
+// "MaxFiles" rotated files are kept.
+type AuditLogSettings struct {
+	AuditLogPath     string `ini:"Path"`
+	AuditLogKeyPath  string `ini:"Key"`
+	AuditLogMaxSize  int64  `ini:"MaxSize"` // in bytes, 0 means it's never rotated
+	AuditLogMaxFiles int    `ini:"MaxFiles"`
+}
+
+// SandboxSettings runs the commands of the install handlers of the
+// "Modes", or of every mode when it's empty, inside a sandbox (see
+// utils.Sandbox). The sandbox of each mode is constrained by the
+// "<mode>.conf" profile of the "ProfilesDir" (see
+// utils.SandboxProfile), whose seccomp profile is applied by the
+// "SeccompHelper".
+type SandboxSettings struct {
+	SandboxEnabled       bool     `ini:"Enabled"`
+	SandboxModes         []string `ini:"Modes"`
+	SandboxProfilesDir   string   `ini:"ProfilesDir"`
+	SandboxSeccompHelper string   `ini:"SeccompHelper"`
+}
+
+// ScriptingSettings lets a starlark script install the updates instead
+// of the state machine. The script of a package is run only if its
+// sha256sum is one of the "TrustedScripts", otherwise the device script
+// at "ScriptPath", if any, is run. A script is stopped after "MaxSteps"
+// execution steps.
+type ScriptingSettings struct {
+	ScriptingEnabled        bool     `ini:"Enabled"`
+	ScriptingScriptPath     string   `ini:"ScriptPath"`
+	ScriptingTrustedScripts []string `ini:"TrustedScripts"`
+	ScriptingMaxSteps       int      `ini:"MaxSteps"` // 0 means no limit
+}
+
+// SFTPSettings configures the "sftp://" server address. The device
+// authenticates with its "Key" and the server must have one of the
+// "HostKeys", given as their SHA-256 fingerprints ("SHA256:...").
+type SFTPSettings struct {
+	SFTPKeyPath  string   `ini:"Key"`
+	SFTPHostKeys []string `ini:"HostKeys"`
+}
+
+// MediumSettings makes the agent install the updates found on the
+// media (e.g. USB sticks or SD cards) mounted at the "MountPoints"
+// (glob patterns), which are scanned every "ScanInterval". The update
+// is laid out at the "Dir" of the medium as for a "file://" server
+// address and the states of its installation are written back there.
+type MediumSettings struct {
+	MediumEnabled      bool          `ini:"Enabled"`
+	MediumMountPoints  []string      `ini:"MountPoints"`
+	MediumDir          string        `ini:"Dir"`
+	MediumScanInterval time.Duration `ini:"ScanInterval"`
+}
+
+// PersistentStateSettings holds the state the agent was at, so it can
+// be resumed after a restart. "InstallingObject" is the install
+// journal: the object being installed, which is cleared once it's
+// completed.
+type PersistentStateSettings struct {
+	State            string   `ini:"State"`
+	PackageUID       string   `ini:"PackageUID"`
+	CompletedObjects []string `ini:"CompletedObjects"`
+	InstallingObject string   `ini:"InstallingObject"`
+}
+
+// NetworkSettings configures how the server is reached. The
+// "CACertificate" bundle replaces the system pool for the server
+// certificate verification and the "PinnedPublicKeys" (base64 encoded
+// SHA-256 hashes of the SubjectPublicKeyInfo) restrict it further to
+// the chains holding one of those keys. The redirects of the object
+// downloads from HTTPS to plain HTTP are refused unless
+// "AllowInsecureRedirects" is set.
 type NetworkSettings struct {
-	DisableHTTPS  bool   `ini:"DisableHttps"`
-	ServerAddress string `ini:"UpdateHubServerAddress"`
+	DisableHTTPS            bool          `ini:"DisableHttps"`
+	ServerAddress           string        `ini:"UpdateHubServerAddress"`
+	ClientCertificatePath   string        `ini:"ClientCertificate"`
+	ClientKeyPath           string        `ini:"ClientKey"`
+	CACertificatePath       string        `ini:"CACertificate"`
+	PinnedPublicKeys        []string      `ini:"PinnedPublicKeys"`
+	Transport               string        `ini:"Transport"`
+	Proxy                   string        `ini:"Proxy"`
+	NoProxy                 []string      `ini:"NoProxy"`
+	FallbackServerAddresses []string      `ini:"FallbackServerAddresses"`
+	AllowInsecureRedirects  bool          `ini:"AllowInsecureRedirects"`
+	ServerCooldown          time.Duration `ini:"ServerCooldown"`
+	RequestRetries          int           `ini:"RequestRetries"`
+	RequestRetryInterval    time.Duration `ini:"RequestRetryInterval"`    // doubled on each new attempt
+	RequestMaxRetryInterval time.Duration `ini:"RequestMaxRetryInterval"` // 0 means no limit
+	CircuitBreakerThreshold int           `ini:"CircuitBreakerThreshold"`
+	CircuitBreakerCooldown  time.Duration `ini:"CircuitBreakerCooldown"`
+	ConnectTimeout          time.Duration `ini:"ConnectTimeout"`
+	TLSHandshakeTimeout     time.Duration `ini:"TLSHandshakeTimeout"`
+	ResponseHeaderTimeout   time.Duration `ini:"ResponseHeaderTimeout"`
+	IdleConnTimeout         time.Duration `ini:"IdleConnTimeout"`
+	KeepAliveInterval       time.Duration `ini:"KeepAliveInterval"`
 }
 
+// FirmwareSettings configures the firmware metadata. The
+// "DeviceAttributes" are "<key>=<value>" pairs sent along with the
+// device attributes of the firmware metadata, which override them.
 type FirmwareSettings struct {
-	FirmwareMetadataPath string `ini:"MetadataPath"`
+	FirmwareMetadataPath     string   `ini:"MetadataPath"`
+	FirmwareDeviceAttributes []string `ini:"DeviceAttributes"`
+}
+
+// ActiveInactiveSettings selects how the installation sets are
+// switched: through the "updatehub-active-*" executables, through the
+// GRUB environment block at "GrubEnvPath", through the U-Boot
+// environment, whose boot count falls back after "UBootBootLimit"
+// boots without validation, or through the "EFIBootEntries" boot
+// entries, one for each installation set
+type ActiveInactiveSettings struct {
+	ActiveInactiveBackend string   `ini:"Backend"`
+	GrubEnvPath           string   `ini:"GrubEnvPath"`
+	UBootBootLimit        int      `ini:"UBootBootLimit"`
+	EFIBootEntries        []string `ini:"EFIBootEntries"`
+}
+
+// WatchdogSettings configures when the agent is considered stalled
+// by the systemd watchdog: no progress (e.g. no downloaded bytes) for
+// "StallTimeout" at a state which doesn't wait for a request or a
+// condition, like idle, waiting for the window, an approval or the
+// power, or a paused download. A zero "StallTimeout" disables the
+// stall detection.
+type WatchdogSettings struct {
+	WatchdogStallTimeout time.Duration `ini:"StallTimeout"`
+}
+
+// PrivilegeSeparationSettings makes the update checks and downloads
+// to run in a child process owned by "User", only the installation is
+// run with the privileges of the agent. The download dir must be
+// writable by "User". The objects are read again to be checked before
+// they are installed, as if "ParanoidSha256Check" was set.
+type PrivilegeSeparationSettings struct {
+	PrivilegeSeparationEnabled bool   `ini:"Enabled"`
+	PrivilegeSeparationUser    string `ini:"User"`
+}
+
+// ErrorPolicySettings decides what follows an error of an update. A
+// package which fails "MaxDownloadFailures" or "MaxInstallFailures"
+// times in a row at the same state is marked bad and isn't tried
+// again. The update is retried after "RetryInterval", doubled on each
+// new failure, instead of waiting for the next poll, and the agent
+// exits after "FatalAfter" failures in a row. A zero disables each of
+// them. Unlike the "RetryInterval" of the PollingSettings, which only
+// covers the failed update checks, it covers the downloads and the
+// installs. Both back off the same way, but this one only up to the
+// polling interval.
+type ErrorPolicySettings struct {
+	ErrorPolicyMaxDownloadFailures int           `ini:"MaxDownloadFailures"`
+	ErrorPolicyMaxInstallFailures  int           `ini:"MaxInstallFailures"`
+	ErrorPolicyRetryInterval       time.Duration `ini:"RetryInterval"`
+	ErrorPolicyFatalAfter          int           `ini:"FatalAfter"`
+	PersistentErrorPolicySettings  `ini:"ErrorPolicy"`
+}
+
+// PersistentErrorPolicySettings holds the failures in a row of the
+// package "FailedPackageUID" at the state "FailedState" and the
+// packages marked bad, along with why each one was marked
+type PersistentErrorPolicySettings struct {
+	FailedPackageUID  string   `ini:"FailedPackageUID"`
+	FailedState       string   `ini:"FailedState"`
+	Failures          int      `ini:"Failures"`
+	BadPackageUIDs    []string `ini:"BadPackageUIDs"`
+	BadPackageReasons []string `ini:"BadPackageReasons"`
+}
+
+// ApprovalSettings decides whether the installation and the reboot
+// wait for an approval, given through the agent API or by the
+// callbacks at "CallbacksDir": "auto" doesn't wait and "manual" does.
+type ApprovalSettings struct {
+	ApprovalInstallMode  string `ini:"InstallMode"`
+	ApprovalRebootMode   string `ini:"RebootMode"`
+	ApprovalCallbacksDir string `ini:"CallbacksDir"`
+}
+
+// EncryptionSettings tells how the content keys of the encrypted
+// objects are unwrapped: by the "DeviceKey" found at the given path or
+// by the "KeyProvider" command, which takes precedence.
+type EncryptionSettings struct {
+	EncryptionDeviceKeyPath string `ini:"DeviceKey"`
+	EncryptionKeyProvider   string `ini:"KeyProvider"`
+}
+
+// KeyStoreSettings configures the "Helper" command through which the
+// keys kept by a hardware token are used. Any client key or public key
+// setting may then refer to a PKCS#11 URI ("pkcs11:...") or a TPM2
+// handle ("tpm2:0x81000001") instead of a file.
+type KeyStoreSettings struct {
+	KeyStoreHelper string `ini:"Helper"`
+}
+
+// DataUsageSettings caps the bytes downloaded by the updates on each
+// day and on each month, in local time. Once a cap is reached the
+// downloads are deferred to the next period. A zero disables each cap.
+type DataUsageSettings struct {
+	DataUsageDailyCap           int64 `ini:"DailyCap"`   // in bytes
+	DataUsageMonthlyCap         int64 `ini:"MonthlyCap"` // in bytes
+	PersistentDataUsageSettings `ini:"DataUsage"`
+}
+
+// PersistentDataUsageSettings holds the bytes downloaded on the day
+// "Day" ("2006-01-02") and on the month "Month" ("2006-01")
+type PersistentDataUsageSettings struct {
+	DataUsageDay        string `ini:"Day"`
+	DataUsageDayBytes   int64  `ini:"DayBytes"`
+	DataUsageMonth      string `ini:"Month"`
+	DataUsageMonthBytes int64  `ini:"MonthBytes"`
+}
+
+// PeerSettings configures the distribution of the objects among the
+// devices of the same LAN. The objects downloaded and verified are
+// served at "ListenAddress" and advertised through mDNS, and the
+// objects are requested to the peers found in "DiscoveryTimeout"
+// before the server. The peers are authenticated by the "Key" file
+// shared by the devices of the site, their clocks must agree within
+// a couple of minutes. An object a peer served which doesn't match
+// its sha256sum is downloaded again from the server and that peer
+// isn't asked anymore.
+type PeerSettings struct {
+	PeerEnabled          bool          `ini:"Enabled"`
+	PeerListenAddress    string        `ini:"ListenAddress"`
+	PeerKeyPath          string        `ini:"Key"`
+	PeerDiscoveryTimeout time.Duration `ini:"DiscoveryTimeout"`
+}
+
+// ReportSettings configures the state reports. A state is reported
+// when the agent gets to it, while the agent keeps coming back to the
+// same state it's reported again every "RepeatInterval" only. Unlike
+// the "Interval" of the HeartbeatSettings, it doesn't send anything by
+// itself.
+type ReportSettings struct {
+	ReportRepeatInterval time.Duration `ini:"RepeatInterval"`
+}
+
+// HeartbeatSettings makes the agent to tell the server it's alive
+// every "Interval", along with its firmware metadata, state, free disk
+// space and uptime, regardless of its state. It's disabled when
+// "Interval" is zero.
+type HeartbeatSettings struct {
+	HeartbeatInterval time.Duration `ini:"Interval"`
+}
+
+// ReportQueueSettings keeps, at "Path", the state reports which can't
+// be sent while the server is unreachable, up to "MaxReports". They
+// are sent, in order, once it's reachable again. They are dropped
+// when "Path" is empty.
+type ReportQueueSettings struct {
+	ReportQueuePath       string `ini:"Path"`
+	ReportQueueMaxReports int    `ini:"MaxReports"`
+}
+
+// GatewaySettings makes the agent the update gateway of the
+// downstream agents of the site, which use "ListenAddress" as their
+// server. Their update checks and reports are forwarded to the server,
+// the reports being queued while it can't be reached, up to
+// "MaxQueuedReports", and the objects they download are cached at
+// "CacheDir", the least recently served ones being evicted once it
+// holds more than "MaxCacheSize" bytes. The gateway is served over TLS
+// with the "Certificate" and "Key" and only the downstream agents with
+// a client certificate signed by the "ClientCACertificate" are served.
+type GatewaySettings struct {
+	GatewayEnabled                 bool   `ini:"Enabled"`
+	GatewayListenAddress           string `ini:"ListenAddress"`
+	GatewayCacheDir                string `ini:"CacheDir"`
+	GatewayMaxCacheSize            int64  `ini:"MaxCacheSize"` // in bytes, 0 means no limit
+	GatewayMaxQueuedReports        int    `ini:"MaxQueuedReports"`
+	GatewayCertificatePath         string `ini:"Certificate"`
+	GatewayKeyPath                 string `ini:"Key"`
+	GatewayClientCACertificatePath string `ini:"ClientCACertificate"`
 }
 
 func init() {
 	ini.PrettyFormat = false
 }
 
+// LoadSettings parses the settings read from "r", it fails with a
+// SettingsError listing every value that can't be parsed
 func LoadSettings(r io.Reader) (*Settings, error) {
+	s, problems, err := loadSettings(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(problems) > 0 {
+		return nil, &SettingsError{Problems: problems}
+	}
+
+	return s, nil
+}
+
+// loadSettings is like LoadSettings, but the values that can't be
+// parsed are returned as problems along with the settings, which keep
+// the defaults of those
+func loadSettings(r io.Reader) (*Settings, []SettingsProblem, error) {
 	cfg, err := ini.Load(ioutil.NopCloser(r))
 	if err != nil || cfg == nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	s := &Settings{
 		PollingSettings: PollingSettings{
-			PollingInterval: defaultPollingInterval,
-			PollingEnabled:  true,
+			PollingInterval:    defaultPollingInterval * time.Second,
+			PollingEnabled:     true,
+			PollingMinInterval: 5 * time.Minute,
+			PollingMaxInterval: 7 * 24 * time.Hour,
+
+			PollingRetryInterval:    time.Minute,
+			PollingMaxRetryInterval: 30 * time.Minute,
+
 			PersistentPollingSettings: PersistentPollingSettings{
-				LastPoll:             (time.Time{}).UTC(),
-				FirstPoll:            (time.Time{}).UTC(),
-				ExtraPollingInterval: 0,
-				PollingRetries:       0,
+				LastPoll:              (time.Time{}).UTC(),
+				FirstPoll:             (time.Time{}).UTC(),
+				ExtraPollingInterval:  0,
+				PollingRetries:        0,
+				ServerPollingInterval: 0,
 			},
 		},
 
@@ -98,29 +526,250 @@ func LoadSettings(r io.Reader) (*Settings, error) {
 			AutoInstallAfterDownload:  true,
 			AutoRebootAfterInstall:    true,
 			SupportedInstallModes:     []string{"dry-run", "copy", "flash", "imxkobs", "raw", "tarball", "ubifs"},
+			DownloadConcurrency:       1,
+			MaxDownloadRate:           0,
+			DownloadSpaceMargin:       1048576,
+			DownloadDirMaxSize:        0,
+			StreamingInstall:          false,
+			ParanoidSha256Check:       false,
+			DownloadMaxAttempts:       5,
+			DownloadRetryInterval:     time.Second,
+			DownloadMaxRetryInterval:  time.Minute,
+			DownloadStallTimeout:      30 * time.Second,
+			DownloadTimeout:           0,
+			MetadataPublicKeyPath:     "",
+			ObjectPublicKeyPaths:      nil,
+			TrustedKeysDir:            "/var/lib/updatehub/trusted-keys",
+			StateChangeCallbacksDir:   "/usr/share/updatehub/state-change-callbacks.d",
+			ValidationCallbacksDir:    "/usr/share/updatehub/validate-callbacks.d",
+			MaxBootAttempts:           3,
+			MaintenanceWindow:         "",
+			MaintenanceWindowDays:     nil,
+			RebootCommand:             "systemctl reboot",
+			RebootCallbacksDir:        "/usr/share/updatehub/reboot-callbacks.d",
+			AllowDowngrade:            false,
+			PersistentUpdateSettings: PersistentUpdateSettings{
+				PendingValidationPackageUID: "",
+				UpgradeToInstallation:       0,
+				PreviousInstallation:        0,
+				BootAttempts:                0,
+			},
 		},
 
 		NetworkSettings: NetworkSettings{
-			DisableHTTPS:  false,
-			ServerAddress: "",
+			DisableHTTPS:            false,
+			ServerAddress:           "",
+			ClientCertificatePath:   "",
+			ClientKeyPath:           "",
+			CACertificatePath:       "",
+			PinnedPublicKeys:        nil,
+			Transport:               "http",
+			Proxy:                   "",
+			NoProxy:                 nil,
+			FallbackServerAddresses: nil,
+			AllowInsecureRedirects:  false,
+			ServerCooldown:          5 * time.Minute,
+			RequestRetries:          2,
+			RequestRetryInterval:    time.Second,
+			RequestMaxRetryInterval: 10 * time.Second,
+			CircuitBreakerThreshold: 5,
+			CircuitBreakerCooldown:  time.Minute,
+			ConnectTimeout:          30 * time.Second,
+			TLSHandshakeTimeout:     10 * time.Second,
+			ResponseHeaderTimeout:   time.Minute,
+			IdleConnTimeout:         90 * time.Second,
+			KeepAliveInterval:       30 * time.Second,
+		},
+
+		MQTTSettings: MQTTSettings{
+			MQTTEnabled:               false,
+			MQTTBroker:                "",
+			MQTTTopic:                 "",
+			MQTTClientID:              "",
+			MQTTClientCertificatePath: "",
+			MQTTClientKeyPath:         "",
+			MQTTCACertificatePath:     "",
+		},
+
+		PushSettings: PushSettings{
+			PushEnabled:       false,
+			PushEndpoint:      "/notifications",
+			PushRetryInterval: 30 * time.Second,
+		},
+
+		ChannelSettings: ChannelSettings{
+			ChannelEnabled:          false,
+			ChannelEndpoint:         "/agent",
+			ChannelRetryInterval:    time.Second,
+			ChannelMaxRetryInterval: 5 * time.Minute,
+		},
+
+		EventLogSettings: EventLogSettings{
+			EventLogPath:                 "/var/lib/updatehub/event-log.json",
+			EventLogMaxEntries:           200,
+			EventLogShippingEnabled:      false,
+			EventLogEndpoint:             "",
+			EventLogAttachToErrorReports: false,
 		},
 
 		FirmwareSettings: FirmwareSettings{
-			FirmwareMetadataPath: "",
+			FirmwareMetadataPath:     "",
+			FirmwareDeviceAttributes: nil,
+		},
+
+		ActiveInactiveSettings: ActiveInactiveSettings{
+			ActiveInactiveBackend: "executables",
+			GrubEnvPath:           "/boot/grub/grubenv",
+			UBootBootLimit:        3,
+			EFIBootEntries:        nil,
+		},
+
+		WatchdogSettings: WatchdogSettings{
+			WatchdogStallTimeout: 2 * time.Hour,
+		},
+
+		PrivilegeSeparationSettings: PrivilegeSeparationSettings{
+			PrivilegeSeparationEnabled: false,
+			PrivilegeSeparationUser:    "updatehub",
+		},
+
+		ErrorPolicySettings: ErrorPolicySettings{
+			ErrorPolicyMaxDownloadFailures: 0,
+			ErrorPolicyMaxInstallFailures:  0,
+			ErrorPolicyRetryInterval:       0,
+			ErrorPolicyFatalAfter:          0,
+			PersistentErrorPolicySettings: PersistentErrorPolicySettings{
+				FailedPackageUID:  "",
+				FailedState:       "",
+				Failures:          0,
+				BadPackageUIDs:    nil,
+				BadPackageReasons: nil,
+			},
+		},
+
+		ApprovalSettings: ApprovalSettings{
+			ApprovalInstallMode:  "auto",
+			ApprovalRebootMode:   "auto",
+			ApprovalCallbacksDir: "/usr/share/updatehub/approval-callbacks.d",
+		},
+
+		EncryptionSettings: EncryptionSettings{
+			EncryptionDeviceKeyPath: "",
+			EncryptionKeyProvider:   "",
+		},
+
+		KeyStoreSettings: KeyStoreSettings{
+			KeyStoreHelper: "/usr/share/updatehub/key-store-helper",
+		},
+
+		DataUsageSettings: DataUsageSettings{
+			DataUsageDailyCap:   0,
+			DataUsageMonthlyCap: 0,
+			PersistentDataUsageSettings: PersistentDataUsageSettings{
+				DataUsageDay:        "",
+				DataUsageDayBytes:   0,
+				DataUsageMonth:      "",
+				DataUsageMonthBytes: 0,
+			},
+		},
+
+		PeerSettings: PeerSettings{
+			PeerEnabled:          false,
+			PeerListenAddress:    ":8085",
+			PeerKeyPath:          "",
+			PeerDiscoveryTimeout: 2 * time.Second,
+		},
+
+		GatewaySettings: GatewaySettings{
+			GatewayEnabled:                 false,
+			GatewayListenAddress:           ":8088",
+			GatewayCacheDir:                "/var/cache/updatehub-gateway",
+			GatewayMaxCacheSize:            2 << 30,
+			GatewayMaxQueuedReports:        1000,
+			GatewayCertificatePath:         "",
+			GatewayKeyPath:                 "",
+			GatewayClientCACertificatePath: "",
+		},
+
+		PowerSettings: PowerSettings{
+			PowerMinBatteryLevel: 0,
+			PowerRequireAC:       false,
+			PowerSupplyDir:       "/sys/class/power_supply",
+			PowerCheckCommand:    "",
+			PowerCheckInterval:   5 * time.Minute,
+		},
+
+		AuditLogSettings: AuditLogSettings{
+			AuditLogPath:     "",
+			AuditLogKeyPath:  "",
+			AuditLogMaxSize:  1024 * 1024,
+			AuditLogMaxFiles: 4,
+		},
+
+		ReportSettings: ReportSettings{
+			ReportRepeatInterval: time.Hour,
+		},
+
+		HeartbeatSettings: HeartbeatSettings{
+			HeartbeatInterval: 0,
+		},
+
+		ReportQueueSettings: ReportQueueSettings{
+			ReportQueuePath:       "/var/lib/updatehub/report-queue.json",
+			ReportQueueMaxReports: 500,
+		},
+
+		SandboxSettings: SandboxSettings{
+			SandboxEnabled:       false,
+			SandboxModes:         nil,
+			SandboxProfilesDir:   "/etc/updatehub/sandbox.d",
+			SandboxSeccompHelper: "",
+		},
+
+		ScriptingSettings: ScriptingSettings{
+			ScriptingEnabled:        false,
+			ScriptingScriptPath:     "",
+			ScriptingTrustedScripts: nil,
+			ScriptingMaxSteps:       1000000,
+		},
+
+		SFTPSettings: SFTPSettings{
+			SFTPKeyPath:  "",
+			SFTPHostKeys: nil,
+		},
+
+		MediumSettings: MediumSettings{
+			MediumEnabled:      false,
+			MediumMountPoints:  []string{"/media/*", "/run/media/*/*"},
+			MediumDir:          "updatehub",
+			MediumScanInterval: 5 * time.Second,
+		},
+
+		PersistentStateSettings: PersistentStateSettings{
+			State:            "",
+			PackageUID:       "",
+			CompletedObjects: nil,
 		},
 	}
 
+	defaults := *s
+
 	err = cfg.MapTo(s)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return s, nil
+	return s, checkSettingsValues(cfg, reflect.ValueOf(&defaults).Elem(), ""), nil
 }
 
 func SaveSettings(s *Settings, w io.Writer) error {
 	ps := &PersistentSettings{
 		PersistentPollingSettings: s.PollingSettings.PersistentPollingSettings,
+		PersistentUpdateSettings:  s.UpdateSettings.PersistentUpdateSettings,
+		PersistentStateSettings:   s.PersistentStateSettings,
+
+		PersistentErrorPolicySettings: s.ErrorPolicySettings.PersistentErrorPolicySettings,
+		PersistentDataUsageSettings:   s.DataUsageSettings.PersistentDataUsageSettings,
 	}
 
 	cfg := ini.Empty()
@@ -0,0 +1,354 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/spf13/afero"
+)
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// SettingsProblem tells what is wrong with the "Key" setting of the
+// "Section" section
+type SettingsProblem struct {
+	Section string
+	Key     string
+	Message string
+}
+
+func (p SettingsProblem) String() string {
+	return fmt.Sprintf("[%s] %s: %s", p.Section, p.Key, p.Message)
+}
+
+// SettingsError lists every invalid setting found, so all of them can
+// be fixed at once
+type SettingsError struct {
+	Problems []SettingsProblem
+}
+
+func (e *SettingsError) Error() string {
+	problems := []string{}
+	for _, p := range e.Problems {
+		problems = append(problems, p.String())
+	}
+
+	return "invalid settings: " + strings.Join(problems, "; ")
+}
+
+// CheckSettings reads the system and runtime settings and validates them
+// as LoadSettings does, but nothing is set up
+func (uh *UpdateHub) CheckSettings() error {
+	s, problems, err := uh.readSettings()
+	if err != nil {
+		return err
+	}
+
+	return settingsError(append(problems, uh.checkSettings(s)...))
+}
+
+// settingsError returns the SettingsError of "problems", or nil if
+// there is none
+func settingsError(problems []SettingsProblem) error {
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return &SettingsError{Problems: problems}
+}
+
+// checkSettingsValues returns the values of "cfg" that can't be
+// parsed as the type of the setting they are mapped to, which MapTo
+// silently leaves with the default found at "defaults". So are the
+// zero and empty values, which MapTo skips.
+func checkSettingsValues(cfg *ini.File, defaults reflect.Value, section string) []SettingsProblem {
+	problems := []SettingsProblem{}
+
+	t := defaults.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("ini"), ",")[0]
+
+		if field.Anonymous {
+			problems = append(problems, checkSettingsValues(cfg, defaults.Field(i), name)...)
+			continue
+		}
+
+		s, err := cfg.GetSection(section)
+		if err != nil {
+			return problems
+		}
+
+		key, err := s.GetKey(name)
+		if err != nil {
+			continue
+		}
+
+		if message := checkSettingValue(key, field.Type, defaults.Field(i)); message != "" {
+			problems = append(problems, SettingsProblem{Section: section, Key: name, Message: message})
+		}
+	}
+
+	return problems
+}
+
+// checkSettingValue tells what is wrong with "key" as a value of type
+// "t", whose default is "def", if anything
+func checkSettingValue(key *ini.Key, t reflect.Type, def reflect.Value) string {
+	value := key.String()
+
+	zero := false
+
+	switch {
+	case t == durationType:
+		d, err := key.Duration()
+		if err != nil {
+			// a plain integer is taken as nanoseconds
+			n, err := key.Int64()
+			if err != nil {
+				return fmt.Sprintf("invalid duration '%s', it must be like '30s' or '1h'", value)
+			}
+
+			d = time.Duration(n)
+		}
+
+		if d < 0 {
+			return fmt.Sprintf("the duration '%s' is negative", value)
+		}
+
+		zero = d == 0
+	case t == timeType:
+		_, err := key.Time()
+		if err != nil {
+			return fmt.Sprintf("invalid time '%s', it must be RFC 3339 formatted", value)
+		}
+	case t.Kind() == reflect.Bool:
+		_, err := key.Bool()
+		if err != nil {
+			return fmt.Sprintf("invalid boolean '%s'", value)
+		}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64:
+		n, err := key.Int64()
+		if err != nil {
+			return fmt.Sprintf("invalid integer '%s'", value)
+		}
+
+		zero = n == 0
+	case t.Kind() >= reflect.Uint && t.Kind() <= reflect.Uint64:
+		n, err := key.Uint64()
+		if err != nil {
+			return fmt.Sprintf("invalid unsigned integer '%s'", value)
+		}
+
+		zero = n == 0
+	case t.Kind() == reflect.String:
+		zero = value == ""
+	}
+
+	if zero && def.Interface() != reflect.Zero(t).Interface() {
+		return fmt.Sprintf("the '%s' value is ignored, leave the setting out for its default (%v)", value, def.Interface())
+	}
+
+	return ""
+}
+
+// checkSettings returns the problems of the settings that are only
+// parsed when used and of those the agent can't work with
+func (uh *UpdateHub) checkSettings(s *Settings) []SettingsProblem {
+	problems := []SettingsProblem{}
+
+	add := func(section string, key string, err error) {
+		if err != nil {
+			problems = append(problems, SettingsProblem{Section: section, Key: key, Message: err.Error()})
+		}
+	}
+
+	if uh.TimeStep > 0 && s.PollingInterval < uh.TimeStep {
+		add("Polling", "Interval", fmt.Errorf("the polling interval must be at least %s", uh.TimeStep))
+	}
+
+	if uh.Store != nil {
+		add("Update", "DownloadDir", checkWritableDir(uh.Store, s.DownloadDir))
+	}
+
+	_, err := ParseMaintenanceWindow(s.MaintenanceWindow, s.MaintenanceWindowDays)
+	add("Update", "MaintenanceWindow", err)
+
+	add("Network", "UpdateHubServerAddress", checkServerAddress(s.ServerAddress))
+
+	for _, address := range s.FallbackServerAddresses {
+		add("Network", "FallbackServerAddresses", checkServerAddress(address))
+	}
+
+	add("Network", "Proxy", checkProxy(s.Proxy))
+
+	switch s.Transport {
+	case "", "http", "coap":
+	default:
+		add("Network", "Transport", fmt.Errorf("invalid transport '%s'", s.Transport))
+	}
+
+	if s.MQTTBroker != "" {
+		u, err := url.Parse(s.MQTTBroker)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			add("MQTT", "Broker", fmt.Errorf("malformed MQTT broker '%s', it must be like 'tcp://broker:1883'", s.MQTTBroker))
+		}
+	}
+
+	add("Push", "Endpoint", checkEndpoint(s.PushEndpoint))
+	add("Channel", "Endpoint", checkEndpoint(s.ChannelEndpoint))
+	add("EventLog", "Endpoint", checkEndpoint(s.EventLogEndpoint))
+
+	_, err = parseDeviceAttributes(s.FirmwareDeviceAttributes)
+	add("Firmware", "DeviceAttributes", err)
+
+	switch s.ActiveInactiveBackend {
+	case "", "executables", "grub", "uboot", "efi":
+	default:
+		add("ActiveInactive", "Backend", fmt.Errorf("invalid active/inactive backend '%s'", s.ActiveInactiveBackend))
+	}
+
+	add("Approval", "InstallMode", validateApprovalMode(s.ApprovalInstallMode))
+	add("Approval", "RebootMode", validateApprovalMode(s.ApprovalRebootMode))
+
+	if s.GatewayEnabled {
+		if s.GatewayCertificatePath == "" || s.GatewayKeyPath == "" {
+			add("Gateway", "Certificate", fmt.Errorf("the gateway requires a certificate and its key"))
+		}
+
+		if s.GatewayClientCACertificatePath == "" {
+			add("Gateway", "ClientCACertificate", fmt.Errorf("the gateway requires the CA of the downstream agents"))
+		}
+	}
+
+	if s.PowerMinBatteryLevel < 0 || s.PowerMinBatteryLevel > 100 {
+		add("Power", "MinBatteryLevel", fmt.Errorf("the minimum battery level must be between 0 and 100"))
+	}
+
+	if s.AuditLogPath != "" && s.AuditLogKeyPath == "" {
+		add("AuditLog", "Key", fmt.Errorf("the audit log requires the key of the device"))
+	}
+
+	return problems
+}
+
+// checkServerAddress fails if "address" isn't a "host[:port]" with an
+// optional transport scheme, a "file://" absolute path or a
+// "sftp://user@host/dir" URL
+func checkServerAddress(address string) error {
+	scheme, hostport := splitServerScheme(address)
+
+	switch scheme {
+	case "", "grpc", "grpcs":
+	case "file":
+		if !filepath.IsAbs(hostport) {
+			return fmt.Errorf("malformed server address '%s', it must be like 'file:///media/updates'", address)
+		}
+
+		return nil
+	case "sftp":
+		u, err := url.Parse(address)
+		if err != nil || u.Host == "" || u.User == nil || u.User.Username() == "" {
+			return fmt.Errorf("malformed server address '%s', it must be like 'sftp://user@host/dir'", address)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("invalid server address scheme '%s'", scheme)
+	}
+
+	if address == "" {
+		return nil
+	}
+
+	u, err := url.Parse("//" + hostport)
+	if err != nil || u.Host == "" || u.Path != "" || u.User != nil {
+		return fmt.Errorf("malformed server address '%s', it must be like 'host:port'", address)
+	}
+
+	return nil
+}
+
+// checkProxy fails if "proxy" isn't an URL of a supported scheme
+func checkProxy(proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("malformed proxy '%s', it must be like 'http://proxy:3128'", proxy)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return nil
+	}
+
+	return fmt.Errorf("unsupported proxy scheme '%s'", u.Scheme)
+}
+
+// checkEndpoint fails if "endpoint" isn't a path of the server
+func checkEndpoint(endpoint string) error {
+	if endpoint == "" {
+		return nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || !strings.HasPrefix(endpoint, "/") || u.Host != "" {
+		return fmt.Errorf("malformed endpoint '%s', it must be a path of the server (e.g. '/notifications')", endpoint)
+	}
+
+	return nil
+}
+
+// checkWritableDir fails if "dir", or its closest existing parent when
+// it's yet to be created, can't be written
+func checkWritableDir(fs afero.Fs, dir string) error {
+	path := filepath.Clean(dir)
+
+	for {
+		info, err := fs.Stat(path)
+		if os.IsNotExist(err) && filepath.Dir(path) != path {
+			path = filepath.Dir(path)
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("the '%s' dir can't be checked: %s", dir, err)
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("'%s' isn't a dir", path)
+		}
+
+		break
+	}
+
+	file, err := afero.TempFile(fs, path, ".updatehub-check")
+	if err != nil {
+		return fmt.Errorf("the '%s' dir isn't writable", path)
+	}
+
+	file.Close()
+
+	return fs.Remove(file.Name())
+}
@@ -0,0 +1,131 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadSettingsWithInvalidValues(t *testing.T) {
+	settings := `[Polling]
+Interval=often
+Enabled=maybe
+
+[Update]
+DownloadConcurrency=two
+DownloadDir=
+
+[Network]
+ServerCooldown=0
+`
+
+	s, err := LoadSettings(strings.NewReader(settings))
+	assert.Nil(t, s)
+	assert.Equal(t, &SettingsError{Problems: []SettingsProblem{
+		{"Polling", "Interval", "invalid duration 'often', it must be like '30s' or '1h'"},
+		{"Polling", "Enabled", "invalid boolean 'maybe'"},
+		{"Update", "DownloadDir", "the '' value is ignored, leave the setting out for its default (/tmp)"},
+		{"Update", "DownloadConcurrency", "invalid integer 'two'"},
+		{"Network", "ServerCooldown", "the '0' value is ignored, leave the setting out for its default (5m0s)"},
+	}}, err)
+}
+
+func TestLoadSettingsWithNegativeDuration(t *testing.T) {
+	_, err := LoadSettings(strings.NewReader("[Watchdog]\nStallTimeout=-1h\n"))
+	assert.EqualError(t, err, "invalid settings: [Watchdog] StallTimeout: the duration '-1h' is negative")
+}
+
+func TestUpdateHubCheckSettings(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.SystemSettingsPath = "/systempath"
+	uh.RuntimeSettingsPath = "/runtimepath"
+
+	err := uh.CheckSettings()
+	assert.NoError(t, err)
+
+	settings := `[Update]
+DownloadDir=/downloads/objects
+
+[Network]
+UpdateHubServerAddress=localhost/path
+FallbackServerAddresses=backup:8080,ftp://backup,file://updates,file:///media/updates,sftp://host/updates,sftp://updatehub@host/updates
+Proxy=proxy
+
+[MQTT]
+Broker=broker
+
+[Push]
+Endpoint=notifications
+
+[Approval]
+RebootMode=later
+
+[Gateway]
+Enabled=true
+Certificate=/etc/updatehub/gateway.crt
+
+[Power]
+MinBatteryLevel=120
+
+[AuditLog]
+Path=/var/lib/updatehub/audit.log
+`
+
+	err = afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte(settings), 0644)
+	assert.NoError(t, err)
+
+	err = afero.WriteFile(uh.Store, uh.RuntimeSettingsPath, []byte("[Polling]\nLastPoll=yesterday\n"), 0644)
+	assert.NoError(t, err)
+
+	// the parent of the download dir is a file
+	err = afero.WriteFile(uh.Store, "/downloads", nil, 0644)
+	assert.NoError(t, err)
+
+	err = uh.CheckSettings()
+	assert.Equal(t, &SettingsError{Problems: []SettingsProblem{
+		{"Polling", "LastPoll", "invalid time 'yesterday', it must be RFC 3339 formatted"},
+		{"Update", "DownloadDir", "'/downloads' isn't a dir"},
+		{"Network", "UpdateHubServerAddress", "malformed server address 'localhost/path', it must be like 'host:port'"},
+		{"Network", "FallbackServerAddresses", "invalid server address scheme 'ftp'"},
+		{"Network", "FallbackServerAddresses", "malformed server address 'file://updates', it must be like 'file:///media/updates'"},
+		{"Network", "FallbackServerAddresses", "malformed server address 'sftp://host/updates', it must be like 'sftp://user@host/dir'"},
+		{"Network", "Proxy", "malformed proxy 'proxy', it must be like 'http://proxy:3128'"},
+		{"MQTT", "Broker", "malformed MQTT broker 'broker', it must be like 'tcp://broker:1883'"},
+		{"Push", "Endpoint", "malformed endpoint 'notifications', it must be a path of the server (e.g. '/notifications')"},
+		{"Approval", "RebootMode", "invalid approval mode 'later'"},
+		{"Gateway", "Certificate", "the gateway requires a certificate and its key"},
+		{"Gateway", "ClientCACertificate", "the gateway requires the CA of the downstream agents"},
+		{"Power", "MinBatteryLevel", "the minimum battery level must be between 0 and 100"},
+		{"AuditLog", "Key", "the audit log requires the key of the device"},
+	}}, err)
+
+	// nothing is set up by the check
+	assert.Equal(t, "/tmp", uh.settings.DownloadDir)
+}
+
+func TestCheckWritableDir(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	err := fs.MkdirAll("/var/lib", 0755)
+	assert.NoError(t, err)
+
+	assert.NoError(t, checkWritableDir(fs, "/var/lib"))
+	// yet to be created
+	assert.NoError(t, checkWritableDir(fs, "/var/lib/updatehub/downloads"))
+
+	files, err := afero.ReadDir(fs, "/var/lib")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(files))
+
+	assert.EqualError(t, checkWritableDir(afero.NewReadOnlyFs(fs), "/var/lib"), "the '/var/lib' dir isn't writable")
+}
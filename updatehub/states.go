@@ -12,9 +12,9 @@ import (
 	"errors"
 	"fmt"
 	"path"
+	"sync/atomic"
 	"time"
 
-	"github.com/OSSystems/pkg/log"
 	"github.com/UpdateHub/updatehub/activeinactive"
 	"github.com/UpdateHub/updatehub/handlers"
 	"github.com/UpdateHub/updatehub/installifdifferent"
@@ -52,6 +52,24 @@ const (
 	UpdateHubStateExit
 	// UpdateHubStateError is set when an error occured on the agent
 	UpdateHubStateError
+	// UpdateHubStateWaitingForWindow is set when the agent is waiting
+	// for the maintenance window to open
+	UpdateHubStateWaitingForWindow
+	// UpdateHubStateRebooting is set when the agent is rebooting the
+	// device
+	UpdateHubStateRebooting
+	// UpdateHubStateAwaitingInstallApproval is set when the agent is
+	// waiting for the approval to install an update
+	UpdateHubStateAwaitingInstallApproval
+	// UpdateHubStateAwaitingRebootApproval is set when the agent is
+	// waiting for the approval to reboot into an update
+	UpdateHubStateAwaitingRebootApproval
+	// UpdateHubStateWaitingForPower is set when the agent is waiting
+	// for the device to have enough power to install or reboot
+	UpdateHubStateWaitingForPower
+	// UpdateHubStateRollingBack is set when the agent is reverting,
+	// as commanded by the server, to the previous installation set
+	UpdateHubStateRollingBack
 )
 
 var statusNames = map[UpdateHubState]string{
@@ -64,19 +82,35 @@ var statusNames = map[UpdateHubState]string{
 	UpdateHubStateWaitingForReboot: "waiting-for-reboot",
 	UpdateHubStateExit:             "exit",
 	UpdateHubStateError:            "error",
+	UpdateHubStateWaitingForWindow: "waiting-for-window",
+	UpdateHubStateRebooting:        "rebooting",
+
+	UpdateHubStateAwaitingInstallApproval: "awaiting-install-approval",
+	UpdateHubStateAwaitingRebootApproval:  "awaiting-reboot-approval",
+	UpdateHubStateWaitingForPower:         "waiting-for-power",
+	UpdateHubStateRollingBack:             "rolling-back",
 }
 
 type Sha256Checker interface {
 	CheckDownloadedObjectSha256sum(fsBackend afero.Fs, downloadDir string, expectedSha256sum string) error
 }
 
+// Sha256CheckerImpl checks the objects against the sha256sum calculated
+// while they were downloaded, if there is one. Otherwise, or when
+// "Paranoid" is set, the whole object is read again.
 type Sha256CheckerImpl struct {
+	Paranoid bool
 }
 
 func (s *Sha256CheckerImpl) CheckDownloadedObjectSha256sum(fsBackend afero.Fs, downloadDir string, expectedSha256sum string) error {
-	calculatedSha256sum, err := utils.FileSha256sum(fsBackend, path.Join(downloadDir, expectedSha256sum))
-	if err != nil {
-		return err
+	objectPath := path.Join(downloadDir, expectedSha256sum)
+
+	calculatedSha256sum, err := readDownloadDigest(fsBackend, objectPath)
+	if err != nil || s.Paranoid {
+		calculatedSha256sum, err = utils.FileSha256sum(fsBackend, objectPath)
+		if err != nil {
+			return err
+		}
 	}
 
 	if calculatedSha256sum != expectedSha256sum {
@@ -120,6 +154,7 @@ type ErrorState struct {
 	ReportableState
 
 	updateMetadata *metadata.UpdateMetadata
+	details        *ErrorDetails // sent along with the error report
 }
 
 // UpdateMetadata is the ReportableState interface implementation
@@ -127,8 +162,8 @@ func (state *ErrorState) UpdateMetadata() *metadata.UpdateMetadata {
 	return state.updateMetadata
 }
 
-// Handle for ErrorState calls "panic" if the error is fatal or
-// triggers a poll state otherwise
+// Handle for ErrorState calls "panic" if the error is fatal or follows
+// the error policy otherwise
 func (state *ErrorState) Handle(uh *UpdateHub) (State, bool) {
 	log.Warn(state.cause)
 
@@ -136,7 +171,7 @@ func (state *ErrorState) Handle(uh *UpdateHub) (State, bool) {
 		return NewExitState(1), false
 	}
 
-	return NewIdleState(), false
+	return uh.nextAfterError(), false
 }
 
 // NewErrorState creates a new ErrorState from a UpdateHubErrorReporter
@@ -161,7 +196,6 @@ type ReportableState interface {
 type IdleState struct {
 	BaseState
 	CancellableState
-	ReportableState
 }
 
 // ID returns the state id
@@ -176,12 +210,28 @@ func (state *IdleState) Cancel(ok bool) bool {
 
 // Handle for IdleState
 func (state *IdleState) Handle(uh *UpdateHub) (State, bool) {
+	// a probe against another server lasts until the agent is idle
+	uh.overrideServer("")
+
+	uh.cleanupDownloadDir()
+
 	if !uh.settings.PollingEnabled {
-		state.Wait()
+		select {
+		case <-state.cancel:
+		case server := <-uh.probeRequests():
+			return newProbeState(server), false
+		case m := <-uh.rollbackRequests():
+			return NewRollingBackState(m), false
+		case r := <-uh.settingsReloads():
+			r.result <- uh.applySettings(r.settings)
+		}
+
 		return state, false
 	}
 
-	now := time.Now()
+	uh.recalibratePolling()
+
+	now := uh.clock().Now()
 
 	if uh.settings.ExtraPollingInterval > 0 {
 		extraPollTime := uh.settings.LastPoll.Add(uh.settings.ExtraPollingInterval)
@@ -191,7 +241,10 @@ func (state *IdleState) Handle(uh *UpdateHub) (State, bool) {
 		}
 	}
 
-	return NewPollState(uh), false
+	poll := NewPollState(uh)
+	poll.interval = uh.nextPollInterval()
+
+	return poll, false
 }
 
 // NewIdleState creates a new IdleState
@@ -229,34 +282,42 @@ func (state *PollState) Handle(uh *UpdateHub) (State, bool) {
 
 	nextState = state
 
-	go func() {
-		ticks := state.ticksCount
+	ticks := state.ticksCount
 
-	polling:
-		for {
-			ticker := time.NewTicker(uh.TimeStep)
+polling:
+	for {
+		tick := uh.clock().After(uh.TimeStep)
 
-			defer ticker.Stop()
+		select {
+		case <-tick:
+			uh.heartbeat.beat()
+			uh.recalibratePolling()
 
-			select {
-			case <-ticker.C:
-				ticks++
+			ticks++
 
-				if ticks > 0 && ticks%int64(state.interval/uh.TimeStep) == 0 {
-					nextState = NewUpdateCheckState()
-					break polling
-				}
-			case <-state.cancel:
-				break
+			if ticks > 0 && ticks%int64(state.interval/uh.TimeStep) == 0 {
+				nextState = NewUpdateCheckState()
+				break polling
+			}
+		case server := <-uh.probeRequests():
+			nextState = newProbeState(server)
+			break polling
+		case m := <-uh.rollbackRequests():
+			nextState = NewRollingBackState(m)
+			break polling
+		case r := <-uh.settingsReloads():
+			r.result <- uh.applySettings(r.settings)
+
+			// an extra poll keeps its own interval
+			if uh.settings.ExtraPollingInterval == 0 {
+				state.interval = uh.nextPollInterval()
 			}
+		case <-state.cancel:
+			break polling
 		}
+	}
 
-		state.Cancel(true)
-
-		state.ticksCount = ticks
-	}()
-
-	state.Wait()
+	state.ticksCount = ticks
 
 	return nextState, false
 }
@@ -268,7 +329,7 @@ func NewPollState(uh *UpdateHub) *PollState {
 		CancellableState: CancellableState{cancel: make(chan bool)},
 	}
 
-	state.interval = uh.settings.PollingInterval
+	state.interval = uh.pollingInterval()
 
 	return state
 }
@@ -276,6 +337,10 @@ func NewPollState(uh *UpdateHub) *PollState {
 // UpdateCheckState is the State interface implementation for the UpdateHubStateUpdateCheck
 type UpdateCheckState struct {
 	BaseState
+
+	// server is where the update is checked at, instead of the
+	// configured servers, when it's probed against another one
+	server string
 }
 
 // ID returns the state id
@@ -287,27 +352,77 @@ func (state *UpdateCheckState) ID() UpdateHubState {
 // proceed to download the update if there is one. It goes back to the
 // polling state otherwise.
 func (state *UpdateCheckState) Handle(uh *UpdateHub) (State, bool) {
-	updateMetadata, extraPoll := uh.Controller.CheckUpdate(uh.settings.PollingRetries)
+	if state.server != "" {
+		log.Info(fmt.Sprintf("probing for an update at '%s'", state.server))
+		uh.overrideServer(state.server)
+	}
+
+	updateMetadata, extraPoll := uh.Controller.CheckUpdate(uh.agentContext(), uh.settings.PollingRetries)
+
+	// the check aborted by the daemon being stopped isn't a failure
+	if uh.agentContext().Err() != nil {
+		return NewIdleState(), false
+	}
 
 	// Reset polling retries in case of CheckUpdate success
 	if extraPoll != -1 {
 		uh.settings.PollingRetries = 0
+
+		// the server is reachable, so it's a good time to send the
+		// queued reports
+		uh.flushReportQueue()
 	}
 
-	uh.settings.LastPoll = time.Now()
+	uh.recalibratePolling()
+
+	uh.settings.LastPoll = uh.clock().Now()
+	uh.wallClock.lastPoll = true
 	uh.settings.ExtraPollingInterval = 0
 
 	if updateMetadata != nil {
+		uh.auditUpdate(AuditCheck, updateMetadata, nil)
+	} else {
+		uh.audit(AuditEntry{Operation: AuditCheck}, nil)
+	}
+
+	if updateMetadata != nil && uh.isBadPackage(updateMetadata.PackageUID()) {
+		packageUID := updateMetadata.PackageUID()
+
+		log.Info(fmt.Sprintf("ignoring the update '%s' since it %s", packageUID, uh.badPackageReason(packageUID)))
+
+		err := uh.reportBadPackage(packageUID)
+		if err != nil {
+			log.Warn("failed to report the bad package: ", err)
+		}
+
+		return NewIdleState(), false
+	}
+
+	if updateMetadata != nil && uh.dataCapReached() {
+		log.Info(fmt.Sprintf("deferring the update '%s' to %s since the data cap was reached", updateMetadata.PackageUID(), uh.nextDataUsagePeriod().Format(time.RFC3339)))
+		return NewIdleState(), false
+	}
+
+	if updateMetadata != nil {
+		err := uh.VerifyUpdateMetadata(updateMetadata)
+
+		uh.auditUpdate(AuditVerifyMetadata, updateMetadata, err)
+
+		if err != nil {
+			uh.recordFailure(ErrorClassVerify, nil, err)
+			return NewErrorState(updateMetadata, NewTransientError(err)), false
+		}
+
 		return NewDownloadingState(updateMetadata), false
 	}
 
 	if extraPoll > 0 {
-		now := time.Now()
+		now := uh.clock().Now()
 		nextPoll := time.Unix(uh.settings.FirstPoll.Unix(), 0)
 		extraPollTime := now.Add(extraPoll)
 
 		for nextPoll.Before(now) {
-			nextPoll = nextPoll.Add(uh.settings.PollingInterval)
+			nextPoll = nextPoll.Add(uh.pollingInterval())
 		}
 
 		if extraPollTime.Before(nextPoll) {
@@ -320,8 +435,14 @@ func (state *UpdateCheckState) Handle(uh *UpdateHub) (State, bool) {
 		}
 	}
 
-	// Increment the number of polling retries in case of CheckUpdate failure
-	uh.settings.PollingRetries++
+	if extraPoll == -1 {
+		// Increment the number of polling retries in case of CheckUpdate failure
+		uh.settings.PollingRetries++
+
+		if uh.settings.PollingEnabled {
+			log.Info(fmt.Sprintf("the update check failed %d time(s) in a row, checking again in %s", uh.settings.PollingRetries, uh.nextPollInterval()))
+		}
+	}
 
 	return NewIdleState(), false
 }
@@ -335,6 +456,15 @@ func NewUpdateCheckState() *UpdateCheckState {
 	return state
 }
 
+// newProbeState creates the UpdateCheckState of a probe request, which
+// checks at "server" when it isn't empty
+func newProbeState(server string) *UpdateCheckState {
+	state := NewUpdateCheckState()
+	state.server = server
+
+	return state
+}
+
 // DownloadingState is the State interface implementation for the UpdateHubStateDownloading
 type DownloadingState struct {
 	BaseState
@@ -342,6 +472,9 @@ type DownloadingState struct {
 	ReportableState
 
 	updateMetadata *metadata.UpdateMetadata
+	cancelled      int32
+	paused         int32
+	resume         chan bool
 }
 
 // ID returns the state id
@@ -351,7 +484,16 @@ func (state *DownloadingState) ID() UpdateHubState {
 
 // Cancel cancels a state if it is cancellable
 func (state *DownloadingState) Cancel(ok bool) bool {
-	state.CancellableState.Cancel(ok)
+	// only the first cancel is delivered. Since the channel is
+	// buffered it never blocks, even if the download already finished.
+	// It may be full only if a pause already interrupted the download.
+	if atomic.CompareAndSwapInt32(&state.cancelled, 0, 1) {
+		select {
+		case state.cancel <- ok:
+		default:
+		}
+	}
+
 	return ok
 }
 
@@ -360,27 +502,139 @@ func (state *DownloadingState) UpdateMetadata() *metadata.UpdateMetadata {
 	return state.updateMetadata
 }
 
+// Pause interrupts the download, keeping the partial objects, until
+// Resume is called. It returns false if it was already paused.
+func (state *DownloadingState) Pause() bool {
+	if !atomic.CompareAndSwapInt32(&state.paused, 0, 1) {
+		return false
+	}
+
+	// the download in progress is interrupted the same way it is
+	// cancelled, the "paused" flag tells them apart
+	select {
+	case state.cancel <- true:
+	default:
+	}
+
+	return true
+}
+
+// Resume continues a paused download. It returns false if it wasn't
+// paused.
+func (state *DownloadingState) Resume() bool {
+	if !atomic.CompareAndSwapInt32(&state.paused, 1, 0) {
+		return false
+	}
+
+	select {
+	case state.resume <- true:
+	default:
+	}
+
+	return true
+}
+
+// Paused tells whether the download is paused
+func (state *DownloadingState) Paused() bool {
+	return atomic.LoadInt32(&state.paused) == 1
+}
+
+// waitResume blocks while the download is paused. It returns false if
+// the download was cancelled meanwhile.
+func (state *DownloadingState) waitResume() bool {
+	for state.Paused() && atomic.LoadInt32(&state.cancelled) == 0 {
+		select {
+		case <-state.resume:
+		case <-state.cancel:
+		}
+	}
+
+	// discards the interruption of a pause that came after the
+	// download had finished, so it doesn't stop the next one
+	select {
+	case <-state.cancel:
+	default:
+	}
+
+	return atomic.LoadInt32(&state.cancelled) == 0
+}
+
 // Handle for DownloadingState starts the objects downloads. It goes
-// to the installing state if successfull. It goes back to the error
-// state otherwise.
+// to the installing state, or to the one awaiting its approval, if
+// successfull. It goes back to the error state otherwise.
 func (state *DownloadingState) Handle(uh *UpdateHub) (State, bool) {
-	err := uh.Controller.FetchUpdate(state.updateMetadata, state.cancel)
+	// fails before downloading anything instead of running out of
+	// space in the middle of the download
+	err := uh.checkDownloadSpace(state.updateMetadata)
+	if err != nil {
+		uh.recordFailure(ErrorClassHardware, nil, err)
+		return NewErrorState(state.updateMetadata, NewTransientError(err)), false
+	}
+
+	// the objects of the package are kept by the download dir cleanup,
+	// even if the download is aborted or deferred
+	err = uh.keepUpdateMetadata(currentMetadataFileName, state.updateMetadata)
+	if err != nil {
+		return NewErrorState(state.updateMetadata, NewTransientError(err)), false
+	}
+
+	for {
+		ctx, release := state.Context(uh.agentContext())
+		err = uh.Controller.FetchUpdate(ctx, state.updateMetadata)
+		interrupted := ctx.Err() != nil
+		release()
+
+		// an aborted download goes back to idle, the partial objects
+		// are kept so the download can be resumed later. So does one
+		// aborted by the daemon being stopped.
+		if atomic.LoadInt32(&state.cancelled) == 1 || uh.agentContext().Err() != nil {
+			return NewIdleState(), false
+		}
+
+		// only a download interrupted by a pause is resumed, from the
+		// partial objects. It may have been resumed already, before
+		// the interrupted download returned, so the pause flag can't
+		// tell.
+		if !interrupted {
+			break
+		}
+
+		uh.heartbeat.wait(true)
+		resumed := state.waitResume()
+		uh.heartbeat.wait(false)
+
+		if !resumed {
+			return NewIdleState(), false
+		}
+	}
+
+	// the partial objects are kept so the download is resumed once
+	// the data cap is lifted
+	if err != nil && uh.dataCapReached() {
+		log.Info(fmt.Sprintf("deferring the download to %s since the data cap was reached", uh.nextDataUsagePeriod().Format(time.RFC3339)))
+		return NewIdleState(), false
+	}
+
+	uh.auditUpdate(AuditDownload, state.updateMetadata, err)
+
 	if err != nil {
 		return NewErrorState(state.updateMetadata, NewTransientError(err)), false
 	}
 
-	return NewInstallingState(state.updateMetadata,
-		&Sha256CheckerImpl{},
+	return uh.awaitApproval(NewInstallingState(state.updateMetadata,
+		uh.sha256Checker(),
 		uh.Store,
-		&installifdifferent.DefaultImpl{FileSystemBackend: uh.Store},
-		&uh.FirmwareMetadata), false
+		&installifdifferent.DefaultImpl{FileSystemBackend: uh.Store, CmdLineExecuter: uh.CmdLineExecuter},
+		&uh.FirmwareMetadata)), false
 }
 
 // NewDownloadingState creates a new DownloadingState from a metadata.UpdateMetadata
 func NewDownloadingState(updateMetadata *metadata.UpdateMetadata) *DownloadingState {
 	state := &DownloadingState{
-		BaseState:      BaseState{id: UpdateHubStateDownloading},
-		updateMetadata: updateMetadata,
+		BaseState:        BaseState{id: UpdateHubStateDownloading},
+		CancellableState: CancellableState{cancel: make(chan bool, 1)},
+		updateMetadata:   updateMetadata,
+		resume:           make(chan bool, 1),
 	}
 
 	return state
@@ -404,6 +658,11 @@ func (state *InstallingState) ID() UpdateHubState {
 	return state.id
 }
 
+// UpdateMetadata is the ReportableState interface implementation
+func (state *InstallingState) UpdateMetadata() *metadata.UpdateMetadata {
+	return state.updateMetadata
+}
+
 // Cancel cancels a state if it is cancellable
 func (state *InstallingState) Cancel(ok bool) bool {
 	return state.CancellableState.Cancel(ok)
@@ -411,17 +670,23 @@ func (state *InstallingState) Cancel(ok bool) bool {
 
 // Handle for InstallingState implements the installation process itself
 func (state *InstallingState) Handle(uh *UpdateHub) (State, bool) {
+	defer uh.flushInstallProgress()
+
 	packageUID := state.updateMetadata.PackageUID()
-	if packageUID == uh.lastInstalledPackageUID {
-		return NewWaitingForRebootState(state.updateMetadata), false
+	if !uh.DryRun && packageUID == uh.lastInstalledPackageUID {
+		return uh.awaitApproval(NewWaitingForRebootState(state.updateMetadata)), false
 	}
 
 	// register the packageUID at the start so it won't redo the
-	// operations in case of an install error occurs
-	uh.lastInstalledPackageUID = packageUID
+	// operations in case of an install error occurs. A dry run
+	// installs nothing so it can be done again.
+	if !uh.DryRun {
+		uh.lastInstalledPackageUID = packageUID
+	}
 
 	err := state.CheckSupportedHardware(state.updateMetadata)
 	if err != nil {
+		uh.recordFailure(ErrorClassHardware, nil, err)
 		return NewErrorState(state.updateMetadata, NewTransientError(err)), false
 	}
 
@@ -430,16 +695,106 @@ func (state *InstallingState) Handle(uh *UpdateHub) (State, bool) {
 		return NewErrorState(state.updateMetadata, NewTransientError(err)), false
 	}
 
-	for _, o := range state.updateMetadata.Objects[indexToInstall] {
+	objects := state.updateMetadata.Objects[indexToInstall]
+
+	uh.resetInstallProgress(len(objects))
+
+	name, script, err := uh.installScript(state.updateMetadata)
+	if err != nil {
+		return NewErrorState(state.updateMetadata, NewTransientError(err)), false
+	}
+
+	if script != nil {
+		err = uh.runInstallScript(state, name, script, indexToInstall)
+		if err != nil {
+			return NewErrorState(state.updateMetadata, NewTransientError(err)), false
+		}
+
+		return NewInstalledState(state.updateMetadata), false
+	}
+
+	// an installation interrupted by a power loss is resumed at the
+	// interrupted object, unless its handler can't install it again
+	// over the partial one
+	err = uh.resumeInterruptedInstall(packageUID, objects)
+	if err != nil {
+		return NewErrorState(state.updateMetadata, NewTransientError(err)), false
+	}
+
+	for _, o := range objects {
 		var handler handlers.InstallUpdateHandler = o
 
-		err := state.CheckDownloadedObjectSha256sum(state.FileSystemBackend, uh.settings.DownloadDir, o.GetObjectMetadata().Sha256sum)
+		objectUID := o.GetObjectMetadata().Sha256sum
+
+		// already installed before the agent was restarted
+		if uh.objectCompleted(UpdateHubStateInstalling, packageUID, objectUID) {
+			uh.addInstalledObject(packageUID)
+			continue
+		}
+
+		// forward the progress of long running installations
+		if pr, ok := handler.(handlers.ProgressReporter); ok {
+			pr.SetProgressFunc(func(installed int64, total int64) {
+				uh.setObjectInstallProgress(packageUID, installed, total)
+			})
+		}
+
+		err := uh.VerifyObjectSignature(o)
+		if err != nil {
+			uh.auditObject(AuditVerifyObject, packageUID, objectUID, err)
+			uh.recordFailure(ErrorClassVerify, o, err)
+			return NewErrorState(state.updateMetadata, NewTransientError(err)), false
+		}
+
+		// the streamed objects are checked while they are installed
+		installer, streamed := uh.streamInstaller(o)
+
+		if !streamed {
+			started := uh.clock().Now()
+
+			err := state.CheckDownloadedObjectSha256sum(state.FileSystemBackend, uh.settings.DownloadDir, objectUID)
+
+			uh.recordObjectVerification(packageUID, o, uh.clock().Now().Sub(started))
+			uh.auditObject(AuditVerifyObject, packageUID, objectUID, err)
+
+			if err != nil {
+				uh.recordObjectFailure(packageUID, o)
+				uh.recordFailure(ErrorClassVerify, o, err)
+				return NewErrorState(state.updateMetadata, NewTransientError(err)), false
+			}
+		}
+
+		// the handler isn't run by a dry run, the streamed objects
+		// aren't even downloaded
+		if uh.DryRun {
+			err := uh.simulateObjectInstall(o, state.InstallIfDifferentBackend)
+			if err != nil {
+				return NewErrorState(state.updateMetadata, NewTransientError(err)), false
+			}
+
+			uh.addInstalledObject(packageUID)
+
+			if isActiveInactive(state.updateMetadata) {
+				uh.simulateSetActive(indexToInstall)
+			}
+
+			continue
+		}
+
+		err = uh.sandboxHandler(o)
+		if err != nil {
+			return NewErrorState(state.updateMetadata, NewTransientError(err)), false
+		}
+
+		err = uh.setObjectInstalling(packageUID, objectUID)
 		if err != nil {
 			return NewErrorState(state.updateMetadata, NewTransientError(err)), false
 		}
 
 		err = handler.Setup()
 		if err != nil {
+			uh.recordObjectFailure(packageUID, o)
+			uh.recordFailure(ErrorClassInstall, o, err)
 			return NewErrorState(state.updateMetadata, NewTransientError(err)), false
 		}
 
@@ -450,11 +805,20 @@ func (state *InstallingState) Handle(uh *UpdateHub) (State, bool) {
 			errorList = append(errorList, err)
 		}
 
+		outcome := objectOutcomeSkipped
+		started := uh.clock().Now()
+
 		if install {
-			err = handler.Install(uh.settings.DownloadDir)
+			if streamed {
+				err = uh.installFromStream(uh.agentContext(), packageUID, o, installer)
+			} else {
+				err = handler.Install(uh.settings.DownloadDir)
+			}
 			if err != nil {
 				errorList = append(errorList, err)
 			}
+
+			outcome = objectOutcomeInstalled
 		}
 
 		err = handler.Cleanup()
@@ -463,17 +827,46 @@ func (state *InstallingState) Handle(uh *UpdateHub) (State, bool) {
 		}
 
 		if len(errorList) > 0 {
-			return NewErrorState(state.updateMetadata, NewTransientError(utils.MergeErrorList(errorList))), false
+			outcome = objectOutcomeFailed
+		}
+
+		uh.recordObjectInstall(packageUID, o, uh.clock().Now().Sub(started), outcome)
+
+		if len(errorList) > 0 {
+			err = utils.MergeErrorList(errorList)
+			uh.auditObject(AuditInstall, packageUID, objectUID, err)
+			uh.recordFailure(ErrorClassInstall, o, errorList...)
+			return NewErrorState(state.updateMetadata, NewTransientError(err)), false
 		}
 
-		// 2 objects means that ActiveInactive is enabled, so we need
-		// to set the new active object
-		if len(state.updateMetadata.Objects) == 2 {
+		uh.auditObject(AuditInstall, packageUID, objectUID, nil)
+
+		uh.addInstalledObject(packageUID)
+
+		// ActiveInactive is enabled, so we need to set the new active
+		// object
+		if isActiveInactive(state.updateMetadata) {
 			err := uh.activeInactiveBackend.SetActive(indexToInstall)
+
+			uh.auditSwitchSlot(packageUID, indexToInstall, err)
+
 			if err != nil {
 				return NewErrorState(state.updateMetadata, NewTransientError(err)), false
 			}
 		}
+
+		err = uh.setObjectCompleted(UpdateHubStateInstalling, packageUID, objectUID)
+		if err != nil {
+			return NewErrorState(state.updateMetadata, NewTransientError(err)), false
+		}
+	}
+
+	// the new installation set must be validated after the reboot
+	if isActiveInactive(state.updateMetadata) && !uh.DryRun {
+		err := uh.setPendingValidation(packageUID, indexToInstall, len(state.updateMetadata.Objects))
+		if err != nil {
+			return NewErrorState(state.updateMetadata, NewTransientError(err)), false
+		}
 	}
 
 	return NewInstalledState(state.updateMetadata), false
@@ -504,6 +897,7 @@ type WaitingForRebootState struct {
 	ReportableState
 
 	updateMetadata *metadata.UpdateMetadata
+	rollback       bool // reboots into the installation set rolled back to
 }
 
 // ID returns the state id
@@ -511,10 +905,18 @@ func (state *WaitingForRebootState) ID() UpdateHubState {
 	return state.id
 }
 
+// UpdateMetadata is the ReportableState interface implementation
+func (state *WaitingForRebootState) UpdateMetadata() *metadata.UpdateMetadata {
+	return state.updateMetadata
+}
+
 // Handle for WaitingForRebootState tells us that an installation has
 // been made and it is waiting for a reboot
 func (state *WaitingForRebootState) Handle(uh *UpdateHub) (State, bool) {
-	return NewIdleState(), false
+	next := NewRebootingState(state.updateMetadata)
+	next.rollback = state.rollback
+
+	return next, false
 }
 
 // NewWaitingForRebootState creates a new WaitingForRebootState
@@ -527,6 +929,120 @@ func NewWaitingForRebootState(updateMetadata *metadata.UpdateMetadata) *WaitingF
 	return state
 }
 
+// RebootingState is the State interface implementation for the UpdateHubStateRebooting
+type RebootingState struct {
+	BaseState
+
+	updateMetadata *metadata.UpdateMetadata
+	rollback       bool
+}
+
+// ID returns the state id
+func (state *RebootingState) ID() UpdateHubState {
+	return state.id
+}
+
+// UpdateMetadata is the ReportableState interface implementation
+func (state *RebootingState) UpdateMetadata() *metadata.UpdateMetadata {
+	return state.updateMetadata
+}
+
+// Handle for RebootingState runs the reboot callbacks, which must all
+// approve the reboot, and then runs the reboot command. It goes back
+// to the idle state if the reboot isn't approved.
+func (state *RebootingState) Handle(uh *UpdateHub) (State, bool) {
+	packageUID := state.updateMetadata.PackageUID()
+
+	err := uh.runCallbacks(uh.settings.RebootCallbacksDir, packageUID)
+	if err != nil {
+		log.Info(fmt.Sprintf("reboot not approved by callback: %s", err))
+		return NewIdleState(), false
+	}
+
+	// the installation set rolled back to was already validated
+	if !state.rollback {
+		err = uh.ensurePendingValidation(state.updateMetadata)
+		if err != nil {
+			return NewErrorState(state.updateMetadata, NewTransientError(err)), false
+		}
+	}
+
+	err = uh.reboot()
+	if err != nil {
+		return NewErrorState(state.updateMetadata, NewTransientError(err)), false
+	}
+
+	return NewIdleState(), false
+}
+
+// NewRebootingState creates a new RebootingState
+func NewRebootingState(updateMetadata *metadata.UpdateMetadata) *RebootingState {
+	state := &RebootingState{
+		BaseState:      BaseState{id: UpdateHubStateRebooting},
+		updateMetadata: updateMetadata,
+	}
+
+	return state
+}
+
+// WaitingForWindowState is the State interface implementation for the UpdateHubStateWaitingForWindow
+type WaitingForWindowState struct {
+	BaseState
+	CancellableState
+
+	updateMetadata *metadata.UpdateMetadata
+	next           State
+	window         *MaintenanceWindow
+}
+
+// ID returns the state id
+func (state *WaitingForWindowState) ID() UpdateHubState {
+	return state.id
+}
+
+// UpdateMetadata is the ReportableState interface implementation
+func (state *WaitingForWindowState) UpdateMetadata() *metadata.UpdateMetadata {
+	return state.updateMetadata
+}
+
+// Cancel cancels a state if it is cancellable
+func (state *WaitingForWindowState) Cancel(ok bool) bool {
+	return state.CancellableState.Cancel(ok)
+}
+
+// Next returns the state that is handled once the window opens
+func (state *WaitingForWindowState) Next() State {
+	return state.next
+}
+
+// Handle for WaitingForWindowState blocks until the maintenance window
+// opens and then goes to the state it was holding. It goes back to the
+// idle state if cancelled.
+func (state *WaitingForWindowState) Handle(uh *UpdateHub) (State, bool) {
+	now := uh.clock().Now()
+
+	select {
+	case <-uh.clock().After(state.window.NextOpening(now).Sub(now)):
+		return state.next, false
+	case <-state.cancel:
+		return NewIdleState(), false
+	}
+}
+
+// NewWaitingForWindowState creates a new WaitingForWindowState which
+// goes to "next" once "window" opens
+func NewWaitingForWindowState(updateMetadata *metadata.UpdateMetadata, next State, window *MaintenanceWindow) *WaitingForWindowState {
+	state := &WaitingForWindowState{
+		BaseState:        BaseState{id: UpdateHubStateWaitingForWindow},
+		CancellableState: CancellableState{cancel: make(chan bool, 1)},
+		updateMetadata:   updateMetadata,
+		next:             next,
+		window:           window,
+	}
+
+	return state
+}
+
 // InstalledState is the State interface implementation for the UpdateHubStateInstalled
 type InstalledState struct {
 	BaseState
@@ -540,8 +1056,26 @@ func (state *InstalledState) ID() UpdateHubState {
 	return state.id
 }
 
-// Handle for InstalledState implements the installation process itself
+// UpdateMetadata is the ReportableState interface implementation
+func (state *InstalledState) UpdateMetadata() *metadata.UpdateMetadata {
+	return state.updateMetadata
+}
+
+// Handle for InstalledState waits for the reboot, or for its approval,
+// if "AutoRebootAfterInstall" is set, unless it's a dry run. It goes
+// to the idle state otherwise.
 func (state *InstalledState) Handle(uh *UpdateHub) (State, bool) {
+	if !uh.DryRun {
+		err := uh.keepUpdateMetadata(installedMetadataFileName, state.updateMetadata)
+		if err != nil {
+			log.Warn("failed to keep the installed update metadata: ", err)
+		}
+	}
+
+	if uh.settings.AutoRebootAfterInstall && !uh.DryRun {
+		return uh.awaitApproval(NewWaitingForRebootState(state.updateMetadata)), false
+	}
+
 	return NewIdleState(), false
 }
 
@@ -575,23 +1109,46 @@ func (state *ExitState) Handle(uh *UpdateHub) (State, bool) {
 	panic("ExitState handler should not be called")
 }
 
-// GetIndexOfObjectToBeInstalled selects which object will be installed from the update metadata
+// GetIndexOfObjectToBeInstalled selects which object will be installed
+// from the update metadata. When ActiveInactive is enabled the update
+// has an object for each installation set and the one following the
+// active set is selected.
 func GetIndexOfObjectToBeInstalled(aii activeinactive.Interface, um *metadata.UpdateMetadata) (int, error) {
-	if len(um.Objects) < 1 || len(um.Objects) > 2 {
-		return 0, fmt.Errorf("update metadata must have 1 or 2 objects. Found %d", len(um.Objects))
+	if len(um.Objects) < 1 {
+		return 0, fmt.Errorf("update metadata must have at least 1 object. Found %d", len(um.Objects))
+	}
+
+	if !isActiveInactive(um) {
+		return 0, nil
 	}
 
-	// 2 objects means that ActiveInactive is enabled
-	if len(um.Objects) == 2 {
-		activeIndex, err := aii.Active()
+	// only the devices with more than 2 installation sets need to tell
+	// how many they have
+	if len(um.Objects) > 2 {
+		slots, err := aii.Slots()
 		if err != nil {
 			return 0, err
 		}
 
-		inactiveIndex := (activeIndex - 1) * -1
+		if slots != len(um.Objects) {
+			return 0, fmt.Errorf("update metadata has %d objects but the device has %d installation sets", len(um.Objects), slots)
+		}
+	}
 
-		return inactiveIndex, nil
+	activeIndex, err := aii.Active()
+	if err != nil {
+		return 0, err
 	}
 
-	return 0, nil
+	if activeIndex < 0 || activeIndex >= len(um.Objects) {
+		return 0, fmt.Errorf("active installation set %d is out of range", activeIndex)
+	}
+
+	return (activeIndex + 1) % len(um.Objects), nil
+}
+
+// isActiveInactive tells whether "um" has an object for each
+// installation set
+func isActiveInactive(um *metadata.UpdateMetadata) bool {
+	return len(um.Objects) > 1
 }
@@ -9,6 +9,13 @@
 package updatehub
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"os"
@@ -25,7 +32,6 @@ import (
 	"github.com/UpdateHub/updatehub/testsmocks/installifdifferentmock"
 	"github.com/UpdateHub/updatehub/testsmocks/objectmock"
 	"github.com/UpdateHub/updatehub/testsmocks/statesmock"
-	"github.com/bouk/monkey"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 )
@@ -92,6 +98,21 @@ var checkUpdateCases = []struct {
 		func(t *testing.T, uh *UpdateHub, state State) {},
 	},
 
+	{
+		"UpdateAvailableWithSignatureVerificationFailure",
+		&testController{updateAvailable: true},
+		&Settings{
+			UpdateSettings: UpdateSettings{
+				MetadataPublicKeyPath: "/metadata.pub",
+			},
+		},
+		NewUpdateCheckState(),
+		&ErrorState{},
+		func(t *testing.T, uh *UpdateHub, state State) {
+			assert.False(t, state.(*ErrorState).cause.IsFatal())
+		},
+	},
+
 	{
 		"UpdateNotAvailable",
 		&testController{updateAvailable: false},
@@ -122,7 +143,7 @@ var checkUpdateCases = []struct {
 	},
 }
 
-func (c *testController) CheckUpdate(retries int) (*metadata.UpdateMetadata, time.Duration) {
+func (c *testController) CheckUpdate(ctx context.Context, retries int) (*metadata.UpdateMetadata, time.Duration) {
 	if c.updateAvailable {
 		return &metadata.UpdateMetadata{}, c.extraPoll
 	}
@@ -130,7 +151,7 @@ func (c *testController) CheckUpdate(retries int) (*metadata.UpdateMetadata, tim
 	return nil, c.extraPoll
 }
 
-func (c *testController) FetchUpdate(updateMetadata *metadata.UpdateMetadata, cancel <-chan bool) error {
+func (c *testController) FetchUpdate(ctx context.Context, updateMetadata *metadata.UpdateMetadata) error {
 	return c.fetchUpdateError
 }
 
@@ -160,6 +181,7 @@ func TestCheckDownloadedObjectSha256sumWithOpenError(t *testing.T) {
 	dummySha256sum := "dummy_hash"
 
 	fsm := &filesystemmock.FileSystemBackendMock{}
+	fsm.On("Open", path.Join(dummyPath, dummySha256sum+downloadDigestSuffix)).Return(&filemock.FileMock{}, os.ErrNotExist)
 	fsm.On("Open", path.Join(dummyPath, dummySha256sum)).Return(&filemock.FileMock{}, fmt.Errorf("open error"))
 
 	sci := &Sha256CheckerImpl{}
@@ -186,6 +208,37 @@ func TestCheckDownloadedObjectSha256sumWithSumsDontMatching(t *testing.T) {
 	assert.EqualError(t, err, "sha256sum's don't match. Expected: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08 / Calculated: ae448ac86c4e8e4dec645729708ef41873ae79c6dff84eff73360989487f08e5")
 }
 
+func TestCheckDownloadedObjectSha256sumWithDownloadDigest(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+
+	expectedSha256sum := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	objectPath := path.Join("/download", expectedSha256sum)
+
+	// the content doesn't match so it is only accepted when it isn't
+	// read again
+	err := afero.WriteFile(memFs, objectPath, []byte("tset"), 0666)
+	assert.NoError(t, err)
+
+	err = afero.WriteFile(memFs, objectPath+downloadDigestSuffix, []byte(`{"sha256sum":"`+expectedSha256sum+`","size":4}`), 0666)
+	assert.NoError(t, err)
+
+	sci := &Sha256CheckerImpl{}
+	err = sci.CheckDownloadedObjectSha256sum(memFs, "/download", expectedSha256sum)
+	assert.NoError(t, err)
+
+	sci = &Sha256CheckerImpl{Paranoid: true}
+	err = sci.CheckDownloadedObjectSha256sum(memFs, "/download", expectedSha256sum)
+	assert.EqualError(t, err, "sha256sum's don't match. Expected: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08 / Calculated: 18ea285983df355f3024e412fb46ad6cbd98a7ffe6872e26612e35f38aa39c41")
+
+	// the object changed after it was downloaded
+	err = afero.WriteFile(memFs, objectPath, []byte("tset!"), 0666)
+	assert.NoError(t, err)
+
+	sci = &Sha256CheckerImpl{}
+	err = sci.CheckDownloadedObjectSha256sum(memFs, "/download", expectedSha256sum)
+	assert.Error(t, err)
+}
+
 func TestStateUpdateCheck(t *testing.T) {
 	for _, tc := range checkUpdateCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -208,6 +261,29 @@ func TestStateUpdateCheck(t *testing.T) {
 	}
 }
 
+func TestStateUpdateCheckAbortedByDaemonStop(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, err := newTestUpdateHub(NewUpdateCheckState(), aim)
+	assert.NoError(t, err)
+
+	uh.Controller = &testController{updateAvailable: false, extraPoll: -1}
+	uh.settings.PollingRetries = 2
+
+	d := NewDaemon(uh)
+	uh.ctx = d.ctx
+
+	d.Stop()
+
+	next, _ := uh.State.Handle(uh)
+	assert.IsType(t, &IdleState{}, next)
+
+	// the aborted check isn't counted as a failure
+	assert.Equal(t, 2, uh.settings.PollingRetries)
+
+	aim.AssertExpectations(t)
+}
+
 func TestStateDownloading(t *testing.T) {
 	testCases := []struct {
 		name         string
@@ -272,20 +348,14 @@ func TestPollingRetries(t *testing.T) {
 	var elapsed time.Duration
 
 	// Simulate ticker
-	defer func() *monkey.PatchGuard {
-		return monkey.Patch(time.NewTicker, func(d time.Duration) *time.Ticker {
-			elapsed += d
+	uh.Clock = &testClock{after: func(d time.Duration) <-chan time.Time {
+		elapsed += d
 
-			c := make(chan time.Time, 1)
-			ticker := &time.Ticker{
-				C: c,
-			}
+		c := make(chan time.Time, 1)
+		c <- time.Now().Add(elapsed)
 
-			c <- time.Now().Add(elapsed)
-
-			return ticker
-		})
-	}().Unpatch()
+		return c
+	}}
 
 	c := &testController{
 		updateAvailable: false,
@@ -321,6 +391,28 @@ func TestPollingRetries(t *testing.T) {
 	aim.AssertExpectations(t)
 }
 
+// testClock is the system clock unless "now" or "after" are set
+type testClock struct {
+	now   time.Time
+	after func(d time.Duration) <-chan time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	if c.now.IsZero() {
+		return time.Now()
+	}
+
+	return c.now
+}
+
+func (c *testClock) After(d time.Duration) <-chan time.Time {
+	if c.after == nil {
+		return time.After(d)
+	}
+
+	return c.after(d)
+}
+
 func TestPolling(t *testing.T) {
 	now := time.Now()
 
@@ -354,29 +446,14 @@ func TestPolling(t *testing.T) {
 			var elapsed time.Duration
 
 			// Simulate ticker
-			defer func() *monkey.PatchGuard {
-				return monkey.Patch(time.NewTicker, func(d time.Duration) *time.Ticker {
-					elapsed += d
-
-					c := make(chan time.Time, 1)
-					ticker := &time.Ticker{
-						C: c,
-					}
-
-					c <- now.Add(elapsed)
-
-					return ticker
-				})
-			}().Unpatch()
-
-			// Simulate time passage from now
-			defer func() *monkey.PatchGuard {
-				seconds := -1
-				return monkey.Patch(time.Now, func() time.Time {
-					seconds++
-					return now.Add(time.Second * time.Duration(seconds))
-				})
-			}().Unpatch()
+			uh.Clock = &testClock{now: now, after: func(d time.Duration) <-chan time.Time {
+				elapsed += d
+
+				c := make(chan time.Time, 1)
+				c <- now.Add(elapsed)
+
+				return c
+			}}
 
 			uh.settings.PollingInterval = tc.pollingInterval
 			uh.settings.FirstPoll = tc.firstPoll
@@ -695,10 +772,27 @@ func TestStateInstallingWithActiveInactive(t *testing.T) {
 	expectedSha256sum := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
 	scm.On("CheckDownloadedObjectSha256sum", memFs, uh.settings.DownloadDir, expectedSha256sum).Return(nil)
 
+	uh.RuntimeSettingsPath = "/runtime.conf"
+
 	nextState, _ := s.Handle(uh)
 	expectedState := NewInstalledState(m)
 	assert.Equal(t, expectedState, nextState)
 
+	expectedPending := PersistentUpdateSettings{
+		PendingValidationPackageUID: m.PackageUID(),
+		UpgradeToInstallation:       0,
+		PreviousInstallation:        1,
+		BootAttempts:                0,
+	}
+	assert.Equal(t, expectedPending, uh.settings.PersistentUpdateSettings)
+
+	data, err := afero.ReadFile(uh.Store, uh.RuntimeSettingsPath)
+	assert.NoError(t, err)
+
+	runtimeSettings, err := LoadSettings(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, expectedPending, runtimeSettings.PersistentUpdateSettings)
+
 	aim.AssertExpectations(t)
 	om.AssertExpectations(t)
 	scm.AssertExpectations(t)
@@ -1080,6 +1174,62 @@ func TestStateInstallingWithSha256Error(t *testing.T) {
 	iidm.AssertExpectations(t)
 }
 
+func TestStateInstallingWithUnsignedObject(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+
+	om := &objectmock.ObjectMock{}
+
+	mode := installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "test",
+		CheckRequirements: func() error { return nil },
+		GetObject:         func() interface{} { return om },
+	})
+	defer mode.Unregister()
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	scm := &statesmock.Sha256CheckerMock{}
+
+	iidm := &installifdifferentmock.InstallIfDifferentMock{}
+
+	fm := &metadata.FirmwareMetadata{
+		ProductUID:       "productuid-value",
+		DeviceIdentity:   map[string]string{"id1": "id1-value"},
+		DeviceAttributes: map[string]string{"attr1": "attr1-value"},
+		Hardware:         "",
+		HardwareRevision: "",
+		Version:          "version-value",
+	}
+
+	s := NewInstallingState(m, scm, memFs, iidm, fm)
+
+	uh, err := newTestUpdateHub(s, aim)
+	assert.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+
+	err = afero.WriteFile(uh.Store, "/objects.pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+	assert.NoError(t, err)
+
+	uh.settings.ObjectPublicKeyPaths = []string{"/objects.pub"}
+
+	nextState, _ := s.Handle(uh)
+	expectedState := NewErrorState(m, NewTransientError(fmt.Errorf("object '9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08' is not signed")))
+	assert.Equal(t, expectedState, nextState)
+
+	aim.AssertExpectations(t)
+	om.AssertExpectations(t)
+	scm.AssertExpectations(t)
+	iidm.AssertExpectations(t)
+}
+
 func TestStateInstallingWithInstallIfDifferentError(t *testing.T) {
 	memFs := afero.NewMemMapFs()
 
@@ -1235,10 +1385,45 @@ func TestGetIndexOfObjectToBeInstalledWithMoreThanTwoObjects(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 3, len(m.Objects))
 
+	testCases := []struct {
+		name          string
+		active        int
+		slots         int
+		expectedIndex int
+		expectedErr   string
+	}{
+		{"FirstActive", 0, 3, 1, ""},
+		{"LastActive", 2, 3, 0, ""},
+		{"WithSlotsMismatch", 0, 2, 0, "update metadata has 3 objects but the device has 2 installation sets"},
+		{"WithActiveOutOfRange", 3, 3, 0, "active installation set 3 is out of range"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			aim := &activeinactivemock.ActiveInactiveMock{}
+			aim.On("Slots").Return(tc.slots, nil)
+			if tc.slots == 3 {
+				aim.On("Active").Return(tc.active, nil)
+			}
+
+			index, err := GetIndexOfObjectToBeInstalled(aim, m)
+			if tc.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedErr)
+			}
+			assert.Equal(t, tc.expectedIndex, index)
+
+			aim.AssertExpectations(t)
+		})
+	}
+
 	aim := &activeinactivemock.ActiveInactiveMock{}
+	aim.On("Slots").Return(0, fmt.Errorf("slots error"))
 	index, err := GetIndexOfObjectToBeInstalled(aim, m)
-	assert.EqualError(t, err, "update metadata must have 1 or 2 objects. Found 3")
+	assert.EqualError(t, err, "slots error")
 	assert.Equal(t, 0, index)
+	aim.AssertExpectations(t)
 }
 
 func TestGetIndexOfObjectToBeInstalledWithNoObjects(t *testing.T) {
@@ -1254,7 +1439,7 @@ func TestGetIndexOfObjectToBeInstalledWithNoObjects(t *testing.T) {
 
 	aim := &activeinactivemock.ActiveInactiveMock{}
 	index, err := GetIndexOfObjectToBeInstalled(aim, m)
-	assert.EqualError(t, err, "update metadata must have 1 or 2 objects. Found 0")
+	assert.EqualError(t, err, "update metadata must have at least 1 object. Found 0")
 	assert.Equal(t, 0, index)
 }
 
@@ -1268,10 +1453,7 @@ func TestStateWaitingForReboot(t *testing.T) {
 	assert.NoError(t, err)
 
 	nextState, _ := s.Handle(uh)
-	expectedState := NewIdleState()
-	// we can't assert Equal here because NewPollState() creates a
-	// channel dynamically
-	assert.IsType(t, expectedState, nextState)
+	assert.Equal(t, NewRebootingState(m), nextState)
 
 	aim.AssertExpectations(t)
 }
@@ -1285,6 +1467,23 @@ func TestStateInstalled(t *testing.T) {
 	uh, err := newTestUpdateHub(s, aim)
 	assert.NoError(t, err)
 
+	nextState, _ := s.Handle(uh)
+	assert.Equal(t, NewWaitingForRebootState(m), nextState)
+
+	aim.AssertExpectations(t)
+}
+
+func TestStateInstalledWithoutAutoReboot(t *testing.T) {
+	m := &metadata.UpdateMetadata{}
+	s := NewInstalledState(m)
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, err := newTestUpdateHub(s, aim)
+	assert.NoError(t, err)
+
+	uh.settings.AutoRebootAfterInstall = false
+
 	nextState, _ := s.Handle(uh)
 	expectedState := NewIdleState()
 	// we can't assert Equal here because NewPollState() creates a
@@ -0,0 +1,82 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/UpdateHub/updatehub/handlers"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// streamInstaller returns the handlers.StreamInstaller of "o" when the
+// streaming install is enabled and "o" can be installed that way
+func (uh *UpdateHub) streamInstaller(o metadata.Object) (handlers.StreamInstaller, bool) {
+	if !uh.settings.StreamingInstall {
+		return nil, false
+	}
+
+	installer, ok := o.(handlers.StreamInstaller)
+	if !ok || !installer.Streamable() {
+		return nil, false
+	}
+
+	return installer, true
+}
+
+// installFromStream downloads "o" straight into its handler, decrypted
+// if needed. Its sha256sum is calculated on the fly and checked once
+// the handler is done, so a corrupted download still fails the
+// installation. The download is aborted once "ctx" is cancelled.
+func (uh *UpdateHub) installFromStream(ctx context.Context, packageUID string, o metadata.Object, installer handlers.StreamInstaller) error {
+	objectUID := o.GetObjectMetadata().Sha256sum
+
+	decrypter, err := uh.objectDecrypter(o)
+	if err != nil {
+		return err
+	}
+
+	body, _, err := uh.fetchObjectBody(ctx, uh.objectURI(packageUID, objectUID), 0)
+	if err != nil {
+		return err
+	}
+
+	if decrypter != nil {
+		body = decrypter.reader(body, 0)
+	}
+
+	rd := utils.NewRateLimiter(uh.settings.MaxDownloadRate).Reader(body)
+	defer rd.Close()
+
+	hash := sha256.New()
+
+	err = installer.InstallFromStream(io.TeeReader(rd, hash))
+	if err != nil {
+		return err
+	}
+
+	// the handler may not consume the whole object (e.g. "count" of
+	// the raw handler) but all of it must be hashed
+	_, err = io.Copy(hash, rd)
+	if err != nil {
+		return err
+	}
+
+	calculatedSha256sum := hex.EncodeToString(hash.Sum(nil))
+	if calculatedSha256sum != objectUID {
+		return fmt.Errorf("sha256sum's don't match. Expected: %s / Calculated: %s", objectUID, calculatedSha256sum)
+	}
+
+	return nil
+}
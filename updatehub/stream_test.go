@@ -0,0 +1,205 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/installifdifferentmock"
+	"github.com/UpdateHub/updatehub/testsmocks/statesmock"
+	"github.com/UpdateHub/updatehub/testsmocks/updatermock"
+)
+
+const validJSONMetadataWithStreamObject = `{
+  "product-uid": "0123456789",
+  "objects": [
+    [
+      { "mode": "stream", "sha256sum": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08" }
+    ]
+  ]
+}`
+
+// testStreamObject writes the first "limit" bytes of the stream to
+// "written", all of them when "limit" is 0
+type testStreamObject struct {
+	metadata.ObjectMetadata
+
+	limit   int64
+	written *bytes.Buffer
+}
+
+func (o *testStreamObject) Setup() error {
+	return nil
+}
+
+func (o *testStreamObject) Install(downloadDir string) error {
+	return nil
+}
+
+func (o *testStreamObject) Cleanup() error {
+	return nil
+}
+
+func (o *testStreamObject) Streamable() bool {
+	return true
+}
+
+func (o *testStreamObject) InstallFromStream(rd io.Reader) error {
+	if o.limit > 0 {
+		rd = io.LimitReader(rd, o.limit)
+	}
+
+	_, err := io.Copy(o.written, rd)
+	return err
+}
+
+func newTestStreamInstallMode(written *bytes.Buffer, limit int64) installmodes.InstallMode {
+	return installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              "stream",
+		CheckRequirements: func() error { return nil },
+		GetObject:         func() interface{} { return &testStreamObject{written: written, limit: limit} },
+	})
+}
+
+func TestStateInstallingWithStreamingInstall(t *testing.T) {
+	testCases := []struct {
+		name          string
+		content       string
+		limit         int64
+		expectedState State
+		written       string
+	}{
+		{
+			"WithSuccess",
+			"test",
+			0,
+			&InstalledState{},
+			"test",
+		},
+		{
+			"WithPartiallyConsumedStream",
+			"test",
+			2,
+			&InstalledState{},
+			"te",
+		},
+		{
+			"WithCorruptedObject",
+			"tset",
+			0,
+			&ErrorState{},
+			"tset",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			written := &bytes.Buffer{}
+
+			mode := newTestStreamInstallMode(written, tc.limit)
+			defer mode.Unregister()
+
+			m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadataWithStreamObject))
+			assert.NoError(t, err)
+
+			aim := &activeinactivemock.ActiveInactiveMock{}
+
+			// the object isn't in the download dir to be checked
+			scm := &statesmock.Sha256CheckerMock{}
+
+			o := m.Objects[0][0]
+
+			iidm := &installifdifferentmock.InstallIfDifferentMock{}
+			iidm.On("Proceed", o).Return(true, nil)
+
+			s := NewInstallingState(m, scm, nil, iidm, &metadata.FirmwareMetadata{})
+
+			uh, err := newTestUpdateHub(s, aim)
+			assert.NoError(t, err)
+
+			uh.settings.StreamingInstall = true
+
+			uri := path.Join("/", uh.FirmwareMetadata.ProductUID, m.PackageUID(), o.GetObjectMetadata().Sha256sum)
+
+			um := &updatermock.UpdaterMock{}
+			um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(ioutil.NopCloser(bytes.NewReader([]byte(tc.content))), int64(len(tc.content)), nil)
+
+			uh.Updater = um
+
+			next, _ := s.Handle(uh)
+			assert.IsType(t, tc.expectedState, next)
+			assert.Equal(t, tc.written, written.String())
+
+			if es, ok := next.(*ErrorState); ok {
+				assert.Contains(t, es.cause.Error(), "sha256sum's don't match")
+			}
+
+			aim.AssertExpectations(t)
+			scm.AssertExpectations(t)
+			iidm.AssertExpectations(t)
+			um.AssertExpectations(t)
+		})
+	}
+}
+
+func TestFetchUpdateSkipsStreamedObjects(t *testing.T) {
+	mode := newTestStreamInstallMode(&bytes.Buffer{}, 0)
+	defer mode.Unregister()
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadataWithStreamObject))
+	assert.NoError(t, err)
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, err := newTestUpdateHub(nil, aim)
+	assert.NoError(t, err)
+
+	uh.settings.StreamingInstall = true
+
+	um := &updatermock.UpdaterMock{}
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), m)
+	assert.NoError(t, err)
+	assert.Equal(t, DownloadProgress{TotalObjects: 0}, uh.DownloadProgress())
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestStreamInstaller(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, err := newTestUpdateHub(nil, aim)
+	assert.NoError(t, err)
+
+	o := &testStreamObject{}
+
+	// opt-in
+	_, ok := uh.streamInstaller(o)
+	assert.False(t, ok)
+
+	uh.settings.StreamingInstall = true
+
+	installer, ok := uh.streamInstaller(o)
+	assert.True(t, ok)
+	assert.Equal(t, o, installer)
+
+	aim.AssertExpectations(t)
+}
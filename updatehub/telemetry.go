@@ -0,0 +1,144 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"time"
+
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+// the outcomes of an object
+const (
+	objectOutcomeDownloaded = "downloaded"
+	objectOutcomeInstalled  = "installed"
+	objectOutcomeSkipped    = "skipped" // it was already installed
+	objectOutcomeFailed     = "failed"
+)
+
+// ObjectTelemetry holds how long each step of an object of the current
+// (or last) update took, so the devices whose flash is degrading can
+// be spotted. The times are in milliseconds and the download speed is
+// in bytes per second. A step not done by the agent, like the download
+// of an object resumed after a restart, is left as 0.
+type ObjectTelemetry struct {
+	Object          string `json:"object"`
+	Mode            string `json:"mode"`
+	Size            int64  `json:"size"`
+	DownloadedBytes int64  `json:"downloaded-bytes"`
+	DownloadTime    int64  `json:"download-time-ms"`
+	DownloadSpeed   int64  `json:"download-speed"`
+	VerifyTime      int64  `json:"verify-time-ms"`
+	InstallTime     int64  `json:"install-time-ms"`
+	Outcome         string `json:"outcome"`
+}
+
+// objectTelemetry holds the telemetry of the objects of "packageUID"
+type objectTelemetry struct {
+	packageUID string
+	objects    []ObjectTelemetry
+}
+
+// ObjectTelemetry returns the telemetry of the objects of the current
+// (or last) update
+func (uh *UpdateHub) ObjectTelemetry() []ObjectTelemetry {
+	uh.telemetryMutex.Lock()
+	defer uh.telemetryMutex.Unlock()
+
+	if len(uh.telemetry.objects) == 0 {
+		return nil
+	}
+
+	return append([]ObjectTelemetry{}, uh.telemetry.objects...)
+}
+
+// packageTelemetry returns the telemetry of the objects of
+// "packageUID", nil if there is none
+func (uh *UpdateHub) packageTelemetry(packageUID string) []ObjectTelemetry {
+	uh.telemetryMutex.Lock()
+	defer uh.telemetryMutex.Unlock()
+
+	if uh.telemetry.packageUID != packageUID || len(uh.telemetry.objects) == 0 {
+		return nil
+	}
+
+	return append([]ObjectTelemetry{}, uh.telemetry.objects...)
+}
+
+// updateObjectTelemetry calls "update" with the telemetry of "obj",
+// the telemetry of the previous update is dropped once another one
+// starts
+func (uh *UpdateHub) updateObjectTelemetry(packageUID string, obj metadata.Object, update func(t *ObjectTelemetry)) {
+	uh.telemetryMutex.Lock()
+	defer uh.telemetryMutex.Unlock()
+
+	if uh.telemetry.packageUID != packageUID {
+		uh.telemetry = objectTelemetry{packageUID: packageUID}
+	}
+
+	om := obj.GetObjectMetadata()
+
+	for i := range uh.telemetry.objects {
+		if uh.telemetry.objects[i].Object == om.Sha256sum {
+			update(&uh.telemetry.objects[i])
+			return
+		}
+	}
+
+	t := ObjectTelemetry{Object: om.Sha256sum, Mode: om.Mode, Size: om.Size}
+	update(&t)
+
+	uh.telemetry.objects = append(uh.telemetry.objects, t)
+}
+
+func (uh *UpdateHub) recordObjectDownload(packageUID string, obj metadata.Object, downloaded int64, elapsed time.Duration) {
+	uh.updateObjectTelemetry(packageUID, obj, func(t *ObjectTelemetry) {
+		t.DownloadedBytes = downloaded
+		t.DownloadTime = milliseconds(elapsed)
+		t.DownloadSpeed = 0
+		if elapsed > 0 {
+			t.DownloadSpeed = int64(float64(downloaded) / elapsed.Seconds())
+		}
+		t.Outcome = objectOutcomeDownloaded
+	})
+}
+
+func (uh *UpdateHub) recordObjectVerification(packageUID string, obj metadata.Object, elapsed time.Duration) {
+	uh.updateObjectTelemetry(packageUID, obj, func(t *ObjectTelemetry) {
+		t.VerifyTime = milliseconds(elapsed)
+	})
+}
+
+func (uh *UpdateHub) recordObjectInstall(packageUID string, obj metadata.Object, elapsed time.Duration, outcome string) {
+	uh.updateObjectTelemetry(packageUID, obj, func(t *ObjectTelemetry) {
+		t.InstallTime = milliseconds(elapsed)
+		t.Outcome = outcome
+	})
+}
+
+func (uh *UpdateHub) recordObjectFailure(packageUID string, obj metadata.Object) {
+	uh.updateObjectTelemetry(packageUID, obj, func(t *ObjectTelemetry) {
+		t.Outcome = objectOutcomeFailed
+	})
+}
+
+func milliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// isOutcomeState tells whether "state" is the outcome of an update,
+// whose report carries the objects telemetry
+func isOutcomeState(state State) bool {
+	switch state.(type) {
+	case *ErrorState, *InstalledState:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,177 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/copy"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/updatermock"
+)
+
+type telemetryReporter struct {
+	recordingReporter
+
+	message   string
+	entries   interface{}
+	telemetry interface{}
+}
+
+func (r *telemetryReporter) ReportTelemetry(api client.ApiRequester, packageUID string, state string, errorMessage string, entries interface{}, telemetry interface{}) error {
+	r.reports = append(r.reports, packageUID+":"+state)
+	r.message = errorMessage
+	r.entries = entries
+	r.telemetry = telemetry
+
+	return nil
+}
+
+func TestObjectTelemetry(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	obj := m.Objects[0][0]
+
+	uh, _ := newTestUpdateHub(nil, nil)
+	assert.Nil(t, uh.ObjectTelemetry())
+
+	uh.recordObjectDownload("puid", obj, 4096, 2*time.Second)
+	uh.recordObjectVerification("puid", obj, 150*time.Millisecond)
+	uh.recordObjectInstall("puid", obj, 3*time.Second, objectOutcomeInstalled)
+
+	expected := []ObjectTelemetry{
+		{
+			Object:          testObjectUID,
+			Mode:            "test",
+			DownloadedBytes: 4096,
+			DownloadTime:    2000,
+			DownloadSpeed:   2048,
+			VerifyTime:      150,
+			InstallTime:     3000,
+			Outcome:         "installed",
+		},
+	}
+
+	assert.Equal(t, expected, uh.ObjectTelemetry())
+	assert.Equal(t, expected, uh.packageTelemetry("puid"))
+	assert.Equal(t, expected, uh.Status().Telemetry)
+	assert.Nil(t, uh.packageTelemetry("other-puid"))
+
+	// another update starts over
+	uh.recordObjectFailure("other-puid", obj)
+
+	assert.Equal(t, []ObjectTelemetry{{Object: testObjectUID, Mode: "test", Outcome: "failed"}}, uh.ObjectTelemetry())
+	assert.Nil(t, uh.packageTelemetry("puid"))
+}
+
+func TestUpdateHubFetchUpdateRecordsTelemetry(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.CopyBackend = copy.ExtendedIO{}
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	uri := path.Join("/", uh.FirmwareMetadata.ProductUID, updateMetadata.PackageUID(), testObjectUID)
+
+	um := &updatermock.UpdaterMock{}
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(ioutil.NopCloser(bytes.NewReader([]byte("test"))), int64(4), nil)
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.NoError(t, err)
+
+	telemetry := uh.packageTelemetry(updateMetadata.PackageUID())
+	assert.Equal(t, 1, len(telemetry))
+	assert.Equal(t, testObjectUID, telemetry[0].Object)
+	assert.Equal(t, int64(4), telemetry[0].DownloadedBytes)
+	assert.Equal(t, "downloaded", telemetry[0].Outcome)
+
+	exists, err := afero.Exists(uh.Store, path.Join(uh.settings.DownloadDir, testObjectUID))
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestReportCurrentStateWithTelemetry(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name            string
+		state           State
+		expectedReport  string
+		expectedMessage string
+	}{
+		{"Installed", NewInstalledState(m), "installed", ""},
+		{"Error", NewErrorState(m, NewTransientError(errors.New("install failed"))), "error", "transient error: install failed"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			uh, _ := newTestUpdateHub(tc.state, nil)
+
+			reporter := &telemetryReporter{}
+			uh.Reporter = reporter
+
+			uh.recordObjectInstall(m.PackageUID(), m.Objects[0][0], time.Second, objectOutcomeInstalled)
+
+			err := uh.ReportCurrentState()
+			assert.NoError(t, err)
+
+			assert.Equal(t, []string{m.PackageUID() + ":" + tc.expectedReport}, reporter.reports)
+			assert.Equal(t, tc.expectedMessage, reporter.message)
+			assert.Equal(t, queued(t, uh.ObjectTelemetry()), reporter.telemetry)
+		})
+	}
+}
+
+func TestReportCurrentStateWithoutTelemetry(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	uh, _ := newTestUpdateHub(NewInstalledState(m), nil)
+
+	reporter := &telemetryReporter{}
+	uh.Reporter = reporter
+
+	err = uh.ReportCurrentState()
+	assert.NoError(t, err)
+
+	// reported without the telemetry
+	assert.Equal(t, []string{m.PackageUID() + ":installed"}, reporter.reports)
+	assert.Nil(t, reporter.telemetry)
+}
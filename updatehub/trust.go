@@ -0,0 +1,235 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+// revokedKeysFileName is the file of the "TrustedKeysDir" listing the
+// fingerprints of the revoked keys, one per line
+const revokedKeysFileName = "revoked"
+
+// trustAnchor is a key trusted to verify the signatures
+type trustAnchor struct {
+	*metadata.TrustedKey
+	source      string // where it was read from
+	fingerprint string
+}
+
+// readTrustAnchor reads the key at "keyPath", which is either a PEM
+// file or a token key. A token key is valid forever.
+func (uh *UpdateHub) readTrustAnchor(keyPath string) (*trustAnchor, error) {
+	var tk *metadata.TrustedKey
+
+	if client.IsTokenKey(keyPath) {
+		key, err := client.TokenPublicKey(uh.keyStoreExecuter(), uh.settings.KeyStoreHelper, keyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		tk = &metadata.TrustedKey{Key: key}
+	} else {
+		data, err := afero.ReadFile(uh.Store, keyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		tk, err = metadata.ParseTrustedKey(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fingerprint, err := metadata.KeyFingerprint(tk.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &trustAnchor{TrustedKey: tk, source: keyPath, fingerprint: fingerprint}, nil
+}
+
+// loadTrustAnchors reads the keys at "keyPaths" and the "*.pem" keys of
+// the "TrustedKeysDir". A configured key that can't be read is an
+// error, while a broken key of the dir is skipped so a single bad
+// delivery doesn't break the verification.
+func (uh *UpdateHub) loadTrustAnchors(keyPaths []string) ([]*trustAnchor, error) {
+	anchors := []*trustAnchor{}
+
+	for _, keyPath := range keyPaths {
+		anchor, err := uh.readTrustAnchor(keyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		anchors = append(anchors, anchor)
+	}
+
+	if uh.settings.TrustedKeysDir == "" {
+		return anchors, nil
+	}
+
+	keyPaths, err := afero.Glob(uh.Store, path.Join(uh.settings.TrustedKeysDir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(keyPaths)
+
+	for _, keyPath := range keyPaths {
+		anchor, err := uh.readTrustAnchor(keyPath)
+		if err != nil {
+			log.Warn(fmt.Sprintf("ignoring the trusted key '%s': %s", keyPath, err))
+			continue
+		}
+
+		anchors = append(anchors, anchor)
+	}
+
+	return anchors, nil
+}
+
+// revokedKeys returns the fingerprints of the revoked keys
+func (uh *UpdateHub) revokedKeys() map[string]bool {
+	revoked := map[string]bool{}
+
+	if uh.settings.TrustedKeysDir == "" {
+		return revoked
+	}
+
+	data, err := afero.ReadFile(uh.Store, path.Join(uh.settings.TrustedKeysDir, revokedKeysFileName))
+	if err != nil {
+		return revoked
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if fingerprint := strings.TrimSpace(line); fingerprint != "" {
+			revoked[fingerprint] = true
+		}
+	}
+
+	return revoked
+}
+
+// validKeys returns the keys of "anchors" that are valid now and
+// weren't revoked
+func (uh *UpdateHub) validKeys(anchors []*trustAnchor) []crypto.PublicKey {
+	now := uh.clock().Now()
+	revoked := uh.revokedKeys()
+
+	keys := []crypto.PublicKey{}
+
+	for _, anchor := range anchors {
+		if !anchor.ValidAt(now) || revoked[anchor.fingerprint] {
+			continue
+		}
+
+		keys = append(keys, anchor.Key)
+	}
+
+	return keys
+}
+
+// updateTrustAnchors stores the keys delivered by the verified
+// "updateMetadata" into the "TrustedKeysDir" and revokes the keys it
+// tells to. The changes are refused if no valid key would be left to
+// verify the next updates.
+func (uh *UpdateHub) updateTrustAnchors(updateMetadata *metadata.UpdateMetadata, anchors []*trustAnchor) error {
+	if len(updateMetadata.TrustedKeys) == 0 && len(updateMetadata.RevokedKeys) == 0 {
+		return nil
+	}
+
+	if uh.settings.TrustedKeysDir == "" {
+		return fmt.Errorf("the update delivers trusted keys, but no 'TrustedKeysDir' is configured")
+	}
+
+	revoked := uh.revokedKeys()
+	for _, fingerprint := range updateMetadata.RevokedKeys {
+		revoked[strings.ToLower(fingerprint)] = true
+	}
+
+	delivered := map[string][]byte{}
+	remaining := 0
+	now := uh.clock().Now()
+
+	for _, data := range updateMetadata.TrustedKeys {
+		tk, err := metadata.ParseTrustedKey([]byte(data))
+		if err != nil {
+			return fmt.Errorf("invalid trusted key: %s", err)
+		}
+
+		fingerprint, err := metadata.KeyFingerprint(tk.Key)
+		if err != nil {
+			return err
+		}
+
+		delivered[fingerprint] = []byte(data)
+
+		if tk.ValidAt(now) && !revoked[fingerprint] {
+			remaining++
+		}
+	}
+
+	for _, anchor := range anchors {
+		if _, ok := delivered[anchor.fingerprint]; ok {
+			continue
+		}
+
+		if anchor.ValidAt(now) && !revoked[anchor.fingerprint] {
+			remaining++
+		}
+	}
+
+	if remaining == 0 {
+		return fmt.Errorf("refusing the trusted keys of the update, no valid key would be left")
+	}
+
+	err := uh.Store.MkdirAll(uh.settings.TrustedKeysDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	for fingerprint, data := range delivered {
+		err = afero.WriteFile(uh.Store, path.Join(uh.settings.TrustedKeysDir, fingerprint+".pem"), data, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	fingerprints := []string{}
+	for fingerprint := range revoked {
+		fingerprints = append(fingerprints, fingerprint)
+
+		// a revoked key of the dir isn't needed anymore
+		err = uh.Store.Remove(path.Join(uh.settings.TrustedKeysDir, fingerprint+".pem"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	sort.Strings(fingerprints)
+
+	if len(fingerprints) == 0 {
+		return nil
+	}
+
+	data := strings.Join(fingerprints, "\n") + "\n"
+
+	return afero.WriteFile(uh.Store, path.Join(uh.settings.TrustedKeysDir, revokedKeysFileName), []byte(data), 0644)
+}
@@ -0,0 +1,237 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+// trustedKeyPEM encodes the public key of "key" valid from "notBefore"
+// to "notAfter", a zero time isn't encoded
+func trustedKeyPEM(t *testing.T, key *ecdsa.PrivateKey, notBefore time.Time, notAfter time.Time) []byte {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+
+	headers := map[string]string{}
+	if !notBefore.IsZero() {
+		headers["Not-Before"] = notBefore.Format(time.RFC3339)
+	}
+	if !notAfter.IsZero() {
+		headers["Not-After"] = notAfter.Format(time.RFC3339)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Headers: headers, Bytes: der})
+}
+
+func signedTestUpdateMetadata(t *testing.T, key *ecdsa.PrivateKey) *metadata.UpdateMetadata {
+	m, err := metadata.NewUpdateMetadata([]byte(validUpdateMetadata))
+	assert.NoError(t, err)
+
+	digest := sha256.Sum256(m.RawBytes)
+	m.Signature, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err)
+
+	return m
+}
+
+func fingerprintOf(t *testing.T, key *ecdsa.PrivateKey) string {
+	fingerprint, err := metadata.KeyFingerprint(&key.PublicKey)
+	assert.NoError(t, err)
+
+	return fingerprint
+}
+
+func TestVerifyUpdateMetadataWithTrustedKeys(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	now := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name          string
+		oldNotAfter   time.Time
+		newNotBefore  time.Time
+		signer        *ecdsa.PrivateKey
+		revoked       string
+		expectedError string
+	}{
+		{"SignedByTheOldKey", time.Time{}, time.Time{}, oldKey, "", ""},
+		{"SignedByTheNewKey", time.Time{}, time.Time{}, newKey, "", ""},
+		{"SignedByAnExpiredKey", now.Add(-time.Hour), time.Time{}, oldKey, "", "invalid update metadata signature"},
+		{"SignedByANotYetValidKey", time.Time{}, now.Add(time.Hour), newKey, "", "invalid update metadata signature"},
+		{"SignedByARevokedKey", time.Time{}, time.Time{}, newKey, fingerprintOf(t, newKey), "invalid update metadata signature"},
+		{"WithoutValidKeys", now.Add(-time.Hour), now.Add(time.Hour), newKey, "", "none of the public keys is valid to verify the update metadata"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			uh, _ := newTestUpdateHub(&PollState{}, nil)
+			uh.Clock = &testClock{now: now}
+			uh.settings.MetadataPublicKeyPath = "/metadata.pub"
+
+			err := afero.WriteFile(uh.Store, "/metadata.pub", trustedKeyPEM(t, oldKey, time.Time{}, tc.oldNotAfter), 0644)
+			assert.NoError(t, err)
+
+			err = afero.WriteFile(uh.Store, path.Join(uh.settings.TrustedKeysDir, "new.pem"), trustedKeyPEM(t, newKey, tc.newNotBefore, time.Time{}), 0644)
+			assert.NoError(t, err)
+
+			// a broken key doesn't break the verification
+			err = afero.WriteFile(uh.Store, path.Join(uh.settings.TrustedKeysDir, "broken.pem"), []byte("broken"), 0644)
+			assert.NoError(t, err)
+
+			if tc.revoked != "" {
+				err = afero.WriteFile(uh.Store, path.Join(uh.settings.TrustedKeysDir, revokedKeysFileName), []byte(tc.revoked+"\n"), 0644)
+				assert.NoError(t, err)
+			}
+
+			err = uh.VerifyUpdateMetadata(signedTestUpdateMetadata(t, tc.signer))
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedError)
+			}
+		})
+	}
+}
+
+func TestVerifyUpdateMetadataWithTrustedKeysOnly(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	uh, _ := newTestUpdateHub(&PollState{}, nil)
+
+	// nothing is verified without keys
+	m := signedTestUpdateMetadata(t, key)
+	m.Signature = nil
+	assert.NoError(t, uh.VerifyUpdateMetadata(m))
+
+	err = afero.WriteFile(uh.Store, path.Join(uh.settings.TrustedKeysDir, "key.pem"), trustedKeyPEM(t, key, time.Time{}, time.Time{}), 0644)
+	assert.NoError(t, err)
+
+	assert.EqualError(t, uh.VerifyUpdateMetadata(m), "update metadata is not signed")
+	assert.NoError(t, uh.VerifyUpdateMetadata(signedTestUpdateMetadata(t, key)))
+}
+
+func TestRotateTrustedKeys(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	uh, _ := newTestUpdateHub(&PollState{}, nil)
+	uh.settings.MetadataPublicKeyPath = "/metadata.pub"
+
+	err = afero.WriteFile(uh.Store, "/metadata.pub", trustedKeyPEM(t, oldKey, time.Time{}, time.Time{}), 0644)
+	assert.NoError(t, err)
+
+	// the update signed by the old key delivers the new one and revokes
+	// the old one
+	m := signedTestUpdateMetadata(t, oldKey)
+	m.TrustedKeys = []string{string(trustedKeyPEM(t, newKey, time.Time{}, time.Time{}))}
+	m.RevokedKeys = []string{fingerprintOf(t, oldKey)}
+
+	assert.NoError(t, uh.VerifyUpdateMetadata(m))
+
+	data, err := afero.ReadFile(uh.Store, path.Join(uh.settings.TrustedKeysDir, fingerprintOf(t, newKey)+".pem"))
+	assert.NoError(t, err)
+	assert.Equal(t, m.TrustedKeys[0], string(data))
+
+	data, err = afero.ReadFile(uh.Store, path.Join(uh.settings.TrustedKeysDir, revokedKeysFileName))
+	assert.NoError(t, err)
+	assert.Equal(t, fingerprintOf(t, oldKey)+"\n", string(data))
+
+	assert.NoError(t, uh.VerifyUpdateMetadata(signedTestUpdateMetadata(t, newKey)))
+
+	err = uh.VerifyUpdateMetadata(signedTestUpdateMetadata(t, oldKey))
+	assert.EqualError(t, err, "invalid update metadata signature")
+}
+
+func TestRotateTrustedKeysWithoutValidKeysLeft(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	expiredKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	uh, _ := newTestUpdateHub(&PollState{}, nil)
+	uh.settings.MetadataPublicKeyPath = "/metadata.pub"
+
+	err = afero.WriteFile(uh.Store, "/metadata.pub", trustedKeyPEM(t, key, time.Time{}, time.Time{}), 0644)
+	assert.NoError(t, err)
+
+	m := signedTestUpdateMetadata(t, key)
+	m.TrustedKeys = []string{string(trustedKeyPEM(t, expiredKey, time.Time{}, time.Now().Add(-time.Hour)))}
+	m.RevokedKeys = []string{fingerprintOf(t, key)}
+
+	anchors, err := uh.loadTrustAnchors([]string{"/metadata.pub"})
+	assert.NoError(t, err)
+
+	err = uh.updateTrustAnchors(m, anchors)
+	assert.EqualError(t, err, "refusing the trusted keys of the update, no valid key would be left")
+
+	// the verification succeeds, but nothing is changed
+	assert.NoError(t, uh.VerifyUpdateMetadata(m))
+
+	exists, err := afero.DirExists(uh.Store, uh.settings.TrustedKeysDir)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestVerifyObjectSignatureWithTrustedKeys(t *testing.T) {
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	uh, _ := newTestUpdateHub(&PollState{}, nil)
+	uh.settings.ObjectPublicKeyPaths = []string{"/objects.pub"}
+
+	err = afero.WriteFile(uh.Store, "/objects.pub", trustedKeyPEM(t, oldKey, time.Time{}, time.Time{}), 0644)
+	assert.NoError(t, err)
+
+	err = afero.WriteFile(uh.Store, path.Join(uh.settings.TrustedKeysDir, "new.pem"), trustedKeyPEM(t, newKey, time.Time{}, time.Time{}), 0644)
+	assert.NoError(t, err)
+
+	anchors, err := uh.loadTrustAnchors(uh.settings.ObjectPublicKeyPaths)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(uh.validKeys(anchors)))
+	assert.Equal(t, "/objects.pub", anchors[0].source)
+	assert.Equal(t, path.Join(uh.settings.TrustedKeysDir, "new.pem"), anchors[1].source)
+}
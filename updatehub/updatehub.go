@@ -10,15 +10,21 @@ package updatehub
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"math/rand"
+	"net/http"
 	"os"
-	"path"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/imdario/mergo"
 	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
 
 	"github.com/UpdateHub/updatehub/activeinactive"
 	"github.com/UpdateHub/updatehub/client"
@@ -34,84 +40,314 @@ type UpdateHub struct {
 	settings                *Settings
 	Store                   afero.Fs
 	FirmwareMetadata        metadata.FirmwareMetadata
+	FirmwareMetadataLoader  *metadata.FirmwareMetadataLoader
+	firmwareMetadataMutex   sync.Mutex
 	State                   State
+	stateMutex              sync.Mutex
 	TimeStep                time.Duration
 	API                     *client.ApiClient
 	Updater                 client.Updater
 	Reporter                client.Reporter
+	CmdLineExecuter         utils.CmdLineExecuter
 	lastInstalledPackageUID string
 	activeInactiveBackend   activeinactive.Interface
 	SystemSettingsPath      string
 	RuntimeSettingsPath     string
+	downloadProgress        DownloadProgress
+	downloadProgressMutex   sync.Mutex
+	installProgress         InstallProgress
+	installProgressMutex    sync.Mutex
+	installProgressSender   installProgressSender
+	persistedStateMutex     sync.Mutex
+	probe                   chan string
+	eventLog                *EventLog
+	auditLog                *AuditLog
+	probeOnce               sync.Once
+	heartbeat               heartbeat
+	Clock                   Clock
+	DryRun                  bool
+	channel                 *client.AgentChannel
+	reload                  chan *settingsReload
+	daemonRunning           int32
+	reloadOnce              sync.Once
+	rollbackRequest         chan *metadata.UpdateMetadata
+	rollbackOnce            sync.Once
+	peers                   lanPeers
+	peerDiscoverer          func(productUID string, timeout time.Duration) ([]string, error)
+	gateway                 gateway
+	telemetry               objectTelemetry
+	telemetryMutex          sync.Mutex
+	ctx                     context.Context
+	observers               stateObservers
+	wallClock               wallClock
+	failure                 *failure
+	reportQueue             reportQueue
+	lastReport              *stateReport
+	medium                  medium
 }
 
+// Controller checks for updates and downloads them. The requests in
+// flight are aborted once "ctx" is cancelled.
 type Controller interface {
-	CheckUpdate(int) (*metadata.UpdateMetadata, time.Duration)
-	FetchUpdate(*metadata.UpdateMetadata, <-chan bool) error
+	CheckUpdate(ctx context.Context, retries int) (*metadata.UpdateMetadata, time.Duration)
+	FetchUpdate(ctx context.Context, updateMetadata *metadata.UpdateMetadata) error
 	ReportCurrentState() error
 }
 
-func (uh *UpdateHub) CheckUpdate(retries int) (*metadata.UpdateMetadata, time.Duration) {
+// agentContext returns the context of the agent, it's cancelled when
+// the daemon is stopped
+func (uh *UpdateHub) agentContext() context.Context {
+	if uh.ctx == nil {
+		return context.Background()
+	}
+
+	return uh.ctx
+}
+
+func (uh *UpdateHub) CheckUpdate(ctx context.Context, retries int) (*metadata.UpdateMetadata, time.Duration) {
 	var data struct {
 		Retries int `json:"retries"`
 		metadata.FirmwareMetadata
 	}
 
-	data.FirmwareMetadata = uh.FirmwareMetadata
+	uh.refreshFirmwareMetadata()
+
+	data.FirmwareMetadata = uh.checkUpdateFirmwareMetadata()
 	data.Retries = retries
 
-	updateMetadata, extraPoll, err := uh.Updater.CheckUpdate(uh.API.Request(), client.UpgradesEndpoint, data)
-	if err != nil || updateMetadata == nil {
+	updater := uh.updater()
+
+	updateMetadata, extraPoll, err := updater.CheckUpdate(ctx, uh.API.Request(), client.UpgradesEndpoint, data)
+	if err != nil {
 		return nil, -1
 	}
 
+	uh.readServerPollingInterval(updater)
+
+	// the server is reachable, so it's a good time to ship the events
+	if err = uh.shipEvents(); err != nil {
+		log.Warn("failed to ship the event log: ", err)
+	}
+
+	if updateMetadata == nil {
+		return nil, extraPoll
+	}
+
 	return updateMetadata.(*metadata.UpdateMetadata), extraPoll
 }
 
-func (uh *UpdateHub) FetchUpdate(updateMetadata *metadata.UpdateMetadata, cancel <-chan bool) error {
+// GetFirmwareMetadata returns a copy of the firmware metadata, which
+// may be refreshed while it is read
+func (uh *UpdateHub) GetFirmwareMetadata() metadata.FirmwareMetadata {
+	uh.firmwareMetadataMutex.Lock()
+	defer uh.firmwareMetadataMutex.Unlock()
+
+	return uh.FirmwareMetadata
+}
+
+// checkUpdateFirmwareMetadata returns the firmware metadata sent with
+// the update checks, whose device attributes are overridden by the
+// "DeviceAttributes" settings
+func (uh *UpdateHub) checkUpdateFirmwareMetadata() metadata.FirmwareMetadata {
+	fm := uh.GetFirmwareMetadata()
+
+	if len(uh.settings.FirmwareDeviceAttributes) == 0 {
+		return fm
+	}
+
+	// they were already validated when the settings were loaded
+	attributes, _ := parseDeviceAttributes(uh.settings.FirmwareDeviceAttributes)
+
+	// the firmware metadata is shared, so its map is left untouched
+	merged := map[string]string{}
+	for k, v := range fm.DeviceAttributes {
+		merged[k] = v
+	}
+
+	for k, v := range attributes {
+		merged[k] = v
+	}
+
+	fm.DeviceAttributes = merged
+
+	return fm
+}
+
+// parseDeviceAttributes parses the "<key>=<value>" device attributes
+func parseDeviceAttributes(attributes []string) (map[string]string, error) {
+	parsed := map[string]string{}
+
+	for _, attribute := range attributes {
+		kv := strings.SplitN(attribute, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid device attribute '%s', it must be '<key>=<value>'", attribute)
+		}
+
+		parsed[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	return parsed, nil
+}
+
+// refreshFirmwareMetadata loads the firmware metadata again, since it
+// may come from sources that change at runtime. The current metadata
+// is kept if it fails.
+func (uh *UpdateHub) refreshFirmwareMetadata() {
+	if uh.FirmwareMetadataLoader == nil {
+		return
+	}
+
+	fm, err := uh.FirmwareMetadataLoader.Load()
+	if err != nil {
+		log.Warn("failed to refresh the firmware metadata: ", err)
+		return
+	}
+
+	if fm == nil {
+		log.Warn("failed to refresh the firmware metadata: no device identity was found")
+		return
+	}
+
+	uh.firmwareMetadataMutex.Lock()
+	uh.FirmwareMetadata = *fm
+	uh.firmwareMetadataMutex.Unlock()
+}
+
+// VerifyUpdateMetadata checks the signature of "updateMetadata"
+// against the public key configured in "MetadataPublicKeyPath" and the
+// keys of the "TrustedKeysDir", any of them that is valid now may have
+// signed it. When no key is configured nothing is verified. Once
+// verified, the keys delivered or revoked by "updateMetadata" are
+// applied to the "TrustedKeysDir".
+func (uh *UpdateHub) VerifyUpdateMetadata(updateMetadata *metadata.UpdateMetadata) error {
+	keyPaths := []string{}
+	if uh.settings.MetadataPublicKeyPath != "" {
+		keyPaths = append(keyPaths, uh.settings.MetadataPublicKeyPath)
+	}
+
+	anchors, err := uh.loadTrustAnchors(keyPaths)
+	if err != nil {
+		return err
+	}
+
+	if len(anchors) == 0 {
+		return nil
+	}
+
+	keys := uh.validKeys(anchors)
+	if len(keys) == 0 {
+		return fmt.Errorf("none of the public keys is valid to verify the update metadata")
+	}
+
+	err = updateMetadata.VerifySignatureWithKeys(keys)
+	if err != nil {
+		return err
+	}
+
+	err = uh.updateTrustAnchors(updateMetadata, anchors)
+	if err != nil {
+		log.Warn("failed to update the trusted keys: ", err)
+	}
+
+	return nil
+}
+
+// VerifyObjectSignature checks the signature of "o" against the public
+// keys configured in "ObjectPublicKeyPaths" and the keys of the
+// "TrustedKeysDir", any of them that is valid now may have signed it.
+// When no key is configured in "ObjectPublicKeyPaths" nothing is
+// verified.
+func (uh *UpdateHub) VerifyObjectSignature(o metadata.Object) error {
+	if len(uh.settings.ObjectPublicKeyPaths) == 0 {
+		return nil
+	}
+
+	anchors, err := uh.loadTrustAnchors(uh.settings.ObjectPublicKeyPaths)
+	if err != nil {
+		return err
+	}
+
+	return o.GetObjectMetadata().VerifySignature(uh.validKeys(anchors))
+}
+
+// FetchUpdate downloads the objects that will be installed into the
+// download dir. The objects are downloaded by up to
+// "DownloadConcurrency" workers at the same time. The download fails
+// when it doesn't finish in "DownloadTimeout", the objects downloaded
+// so far are kept so it can be resumed later. A download cancelled
+// through "ctx" returns no error.
+func (uh *UpdateHub) FetchUpdate(ctx context.Context, updateMetadata *metadata.UpdateMetadata) error {
+	if uh.settings.DownloadTimeout <= 0 {
+		return uh.fetchObjects(ctx, updateMetadata)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, uh.settings.DownloadTimeout)
+	defer cancel()
+
+	err := uh.fetchObjects(ctx, updateMetadata)
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("the download didn't finish in %s", uh.settings.DownloadTimeout)
+	}
+
+	return err
+}
+
+func (uh *UpdateHub) fetchObjects(ctx context.Context, updateMetadata *metadata.UpdateMetadata) error {
 	indexToInstall, err := GetIndexOfObjectToBeInstalled(uh.activeInactiveBackend, updateMetadata)
 	if err != nil {
 		return err
 	}
 
 	packageUID := updateMetadata.PackageUID()
+	objects := uh.objectsToDownload(updateMetadata.Objects[indexToInstall])
 
-	for _, obj := range updateMetadata.Objects[indexToInstall] {
-		objectUID := obj.GetObjectMetadata().Sha256sum
+	uh.resetDownloadProgress(len(objects))
 
-		uri := "/"
-		uri = path.Join(uri, uh.FirmwareMetadata.ProductUID)
-		uri = path.Join(uri, packageUID)
-		uri = path.Join(uri, objectUID)
+	// the limiter is shared by all objects so the overall download
+	// rate never exceeds the configured one
+	limiter := utils.NewRateLimiter(uh.settings.MaxDownloadRate)
 
-		wr, err := uh.Store.Create(path.Join(uh.settings.DownloadDir, objectUID))
-		if err != nil {
-			return err
-		}
-		defer wr.Close()
+	workers := uh.settings.DownloadConcurrency
+	if workers > len(objects) {
+		workers = len(objects)
+	}
 
-		rd, _, err := uh.Updater.FetchUpdate(uh.API.Request(), uri)
-		if err != nil {
-			return err
+	if workers <= 1 {
+		for _, obj := range objects {
+			err := uh.fetchObjectWithRetries(ctx, packageUID, obj, limiter)
+			if err != nil {
+				return err
+			}
 		}
-		defer rd.Close()
 
-		_, err = uh.CopyBackend.Copy(wr, rd, 30*time.Second, cancel, utils.ChunkSize, 0, -1, false)
-		if err != nil {
-			return err
-		}
+		return nil
 	}
 
-	return nil
+	return uh.fetchObjectsInParallel(ctx, packageUID, objects, workers, limiter)
 }
 
 func (uh *UpdateHub) ReportCurrentState() error {
-	if rs, ok := uh.State.(ReportableState); ok {
-		packageUID := rs.UpdateMetadata().PackageUID()
-		err := uh.Reporter.ReportState(uh.API.Request(), packageUID, StateToString(uh.State.ID()))
+	if rs, ok := uh.CurrentState().(ReportableState); ok {
+		r := uh.currentStateReport(rs)
+
+		// the agent going back to the same state isn't news, only a
+		// heartbeat for the server
+		if uh.reportedRecently(r) {
+			return nil
+		}
+
+		if uh.channel != nil {
+			uh.channel.ReportState(r.PackageUID, r.State)
+		}
+
+		uh.writeMediumReport(r)
+
+		err := uh.reportState(r)
 		if err != nil {
 			return err
 		}
+
+		uh.lastReport = r
 	}
 
 	return nil
@@ -119,8 +355,50 @@ func (uh *UpdateHub) ReportCurrentState() error {
 
 // LoadSettings loads system and runtime settings
 func (uh *UpdateHub) LoadSettings() error {
+	s, problems, err := uh.readSettings()
+	if err != nil {
+		return err
+	}
+
+	uh.settings = s
+
+	err = settingsError(append(problems, uh.checkSettings(s)...))
+	if err != nil {
+		return err
+	}
+
+	uh.setupEventLog()
+	uh.setupAuditLog()
+
+	uh.setupServers()
+	uh.setupRetries()
+	uh.setupTimeouts()
+	uh.setupRedirects()
+
+	err = uh.setupProxy()
+	if err != nil {
+		return err
+	}
+
+	err = uh.setupTLS()
+	if err != nil {
+		return err
+	}
+
+	err = uh.setupActiveInactive()
+	if err != nil {
+		return err
+	}
+
+	return uh.setupTransport()
+}
+
+// readSettings reads the system settings merged with the runtime ones,
+// along with the problems of the values that can't be parsed
+func (uh *UpdateHub) readSettings() (*Settings, []SettingsProblem, error) {
 	files := []string{uh.SystemSettingsPath, uh.RuntimeSettingsPath}
 	settings := []*Settings{}
+	problems := []SettingsProblem{}
 
 	var file io.ReadCloser
 	var err error
@@ -131,52 +409,388 @@ func (uh *UpdateHub) LoadSettings() error {
 			if os.IsNotExist(err) {
 				file = ioutil.NopCloser(bytes.NewReader(nil))
 			} else {
-				return err
+				return nil, nil, err
 			}
 		}
 
-		s, err := LoadSettings(file)
+		s, p, err := loadSettings(file)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
 		settings = append(settings, s)
+		problems = append(problems, p...)
 	}
 
 	err = mergo.Merge(settings[0], settings[1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return settings[0], problems, nil
+}
+
+// setupEventLog loads the event log, a corrupted one is discarded
+func (uh *UpdateHub) setupEventLog() {
+	var err error
+
+	uh.eventLog, err = NewEventLog(uh.Store, uh.settings.EventLogPath, uh.settings.EventLogMaxEntries)
+	if err != nil {
+		log.Warn("discarding the event log: ", err)
+
+		uh.Store.Remove(uh.settings.EventLogPath)
+		uh.eventLog, _ = NewEventLog(uh.Store, uh.settings.EventLogPath, uh.settings.EventLogMaxEntries)
+	}
+}
+
+// setupServers makes the API client fail over from the server address
+// to the fallback ones, in this order. Their scheme is left out, it
+// only selects the transport. The "file://" and "sftp://" ones aren't
+// API servers.
+func (uh *UpdateHub) setupServers() {
+	if uh.API == nil || (uh.settings.ServerAddress == "" && len(uh.settings.FallbackServerAddresses) == 0) {
+		return
+	}
+
+	servers := []string{}
+	for _, address := range append([]string{uh.settings.ServerAddress}, uh.settings.FallbackServerAddresses...) {
+		scheme, address := splitServerScheme(address)
+		if scheme == "file" || scheme == "sftp" {
+			continue
+		}
+
+		servers = append(servers, address)
+	}
+
+	if len(servers) == 0 {
+		return
+	}
+
+	uh.API.SetServers(servers, uh.settings.ServerCooldown)
+}
+
+// setupRetries makes the API client retry the requests the server
+// fails and stop sending them for a while once it keeps failing
+func (uh *UpdateHub) setupRetries() {
+	if uh.API == nil {
+		return
+	}
+
+	uh.API.SetRetryPolicy(client.RetryPolicy{
+		Retries:          uh.settings.RequestRetries,
+		Backoff:          uh.settings.RequestRetryInterval,
+		MaxBackoff:       uh.settings.RequestMaxRetryInterval,
+		BreakerThreshold: uh.settings.CircuitBreakerThreshold,
+		BreakerCooldown:  uh.settings.CircuitBreakerCooldown,
+	})
+
+	uh.API.SetRequestHooks(client.RequestHooks{
+		OnAttempt: func(req *http.Request, attempt int, statusCode int, err error, duration time.Duration) {
+			if err != nil {
+				log.Debug(fmt.Sprintf("attempt %d of '%s' failed after %s: %s", attempt, req.URL.Path, duration, err))
+			} else if statusCode >= 500 {
+				log.Debug(fmt.Sprintf("attempt %d of '%s' answered with %d after %s", attempt, req.URL.Path, statusCode, duration))
+			}
+		},
+		OnBreakerChange: func(open bool) {
+			if open {
+				log.Warn(fmt.Sprintf("the server keeps failing, no requests are sent to it for %s", uh.settings.CircuitBreakerCooldown))
+			} else {
+				log.Info("the server is back")
+			}
+		},
+	})
+}
+
+// setupTimeouts bounds the requests of the API client, so they don't
+// hang on a half-open connection
+func (uh *UpdateHub) setupTimeouts() {
+	if uh.API == nil {
+		return
+	}
+
+	uh.API.SetTimeouts(client.Timeouts{
+		Connect:        uh.settings.ConnectTimeout,
+		TLSHandshake:   uh.settings.TLSHandshakeTimeout,
+		ResponseHeader: uh.settings.ResponseHeaderTimeout,
+		IdleConn:       uh.settings.IdleConnTimeout,
+		KeepAlive:      uh.settings.KeepAliveInterval,
+	})
+}
+
+// setupRedirects makes the API client follow the redirects from HTTPS
+// to plain HTTP if they are allowed
+func (uh *UpdateHub) setupRedirects() {
+	if uh.API == nil {
+		return
+	}
+
+	uh.API.AllowInsecureRedirects(uh.settings.AllowInsecureRedirects)
+}
+
+// setupProxy makes the API client honor the proxy settings. The
+// default transport already honors the environment ones.
+func (uh *UpdateHub) setupProxy() error {
+	if uh.API == nil || (uh.settings.Proxy == "" && len(uh.settings.NoProxy) == 0) {
+		return nil
+	}
+
+	return uh.API.EnableProxy(uh.settings.Proxy, uh.settings.NoProxy)
+}
+
+// setupTLS makes the API client talk to the server through HTTPS when
+// a client certificate, a CA bundle or pinned public keys are configured
+func (uh *UpdateHub) setupTLS() error {
+	if uh.API == nil {
+		return nil
+	}
+
+	config, err := uh.tlsConfig()
+	if err != nil || config == nil {
+		return err
+	}
+
+	uh.API.EnableTLS(config)
+
+	return nil
+}
+
+// tlsConfig returns the TLS config of the connections to the server,
+// or nil when there are no TLS settings
+func (uh *UpdateHub) tlsConfig() (*tls.Config, error) {
+	if uh.settings.ClientCertificatePath == "" && uh.settings.CACertificatePath == "" && len(uh.settings.PinnedPublicKeys) == 0 {
+		return nil, nil
+	}
+
+	config, err := uh.newTLSConfig(uh.settings.ClientCertificatePath, uh.settings.ClientKeyPath, uh.settings.CACertificatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(uh.settings.PinnedPublicKeys) > 0 {
+		err = client.PinPublicKeys(config, uh.settings.PinnedPublicKeys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+// setupTransport selects the Updater according to the "Transport"
+// setting. The CoAP one talks to the server through DTLS when there
+// are TLS settings. The state reports are still
+// sent through the API client.
+//
+// The "grpc://" and "grpcs://" schemes of the server address select the
+// gRPC transport instead, which sends the state reports as well. The
+// "file://" one checks for and fetches the updates from a local dir
+// (e.g. a mounted medium) for the air-gapped devices, the state reports
+// are kept in the report queue meanwhile. The "sftp://" one does the
+// same over SFTP, with the "[SFTP]" settings.
+func (uh *UpdateHub) setupTransport() error {
+	scheme, address := splitServerScheme(uh.settings.ServerAddress)
+
+	switch scheme {
+	case "":
+	case "grpc", "grpcs":
+		if uh.settings.Transport != "" && uh.settings.Transport != "http" {
+			return fmt.Errorf("the '%s' server address scheme can't be used with the '%s' transport", scheme, uh.settings.Transport)
+		}
+
+		return uh.setupGRPC(scheme == "grpcs")
+	case "file", "sftp":
+		if uh.settings.Transport != "" && uh.settings.Transport != "http" {
+			return fmt.Errorf("the '%s' server address scheme can't be used with the '%s' transport", scheme, uh.settings.Transport)
+		}
+
+		if scheme == "sftp" {
+			return uh.setupSFTP()
+		}
+
+		fileClient := client.NewFileClient(uh.Store, address)
+		fileClient.AllowDowngrade = uh.settings.AllowDowngrade
+
+		uh.Updater = fileClient
+
+		return nil
+	default:
+		return fmt.Errorf("invalid server address scheme '%s'", scheme)
+	}
+
+	switch uh.settings.Transport {
+	case "", "http":
+		return nil
+	case "coap":
+		coap := client.NewCoAPClient()
+
+		config, err := uh.tlsConfig()
+		if err != nil {
+			return err
+		}
+
+		if config != nil {
+			err = coap.EnableDTLS(config)
+			if err != nil {
+				return err
+			}
+		}
+
+		uh.Updater = coap
+
+		return nil
+	}
+
+	return fmt.Errorf("invalid transport '%s'", uh.settings.Transport)
+}
+
+// setupGRPC makes both the Updater and the Reporter talk to the server
+// through gRPC. The "secure" one uses the TLS settings, if any.
+func (uh *UpdateHub) setupGRPC(secure bool) error {
+	var config *tls.Config
+
+	if secure {
+		var err error
+
+		config, err = uh.tlsConfig()
+		if err != nil {
+			return err
+		}
+
+		if config == nil {
+			config = &tls.Config{}
+		}
+	}
+
+	grpc := client.NewGRPCClient(config)
+
+	uh.Updater = grpc
+	uh.Reporter = grpc
+
+	return nil
+}
+
+// setupSFTP makes the Updater fetch the updates from the "sftp://"
+// server address
+func (uh *UpdateHub) setupSFTP() error {
+	if uh.settings.SFTPKeyPath == "" {
+		return errors.New("the SFTP server address needs a key ('Key' at the '[SFTP]' settings)")
+	}
+
+	key, err := afero.ReadFile(uh.Store, uh.settings.SFTPKeyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read the SFTP key: %s", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to parse the SFTP key: %s", err)
+	}
+
+	sftp, err := client.NewSFTPClient(uh.settings.ServerAddress, client.SFTPConfig{
+		Signer:         signer,
+		HostKeys:       uh.settings.SFTPHostKeys,
+		ConnectTimeout: uh.settings.ConnectTimeout,
+		AllowDowngrade: uh.settings.AllowDowngrade,
+	})
 	if err != nil {
 		return err
 	}
 
-	uh.settings = settings[0]
+	uh.Updater = sftp
 
 	return nil
 }
 
+// splitServerScheme splits the "<scheme>://" prefix, if any, from the
+// server "address"
+func splitServerScheme(address string) (string, string) {
+	if i := strings.Index(address, "://"); i >= 0 {
+		return address[:i], address[i+3:]
+	}
+
+	return "", address
+}
+
+// setupActiveInactive picks the active/inactive backend from the
+// "Backend" setting. The executables one is used unless a backend was
+// already given.
+func (uh *UpdateHub) setupActiveInactive() error {
+	switch uh.settings.ActiveInactiveBackend {
+	case "", "executables":
+		if uh.activeInactiveBackend == nil {
+			uh.activeInactiveBackend = &activeinactive.DefaultImpl{CmdLineExecuter: uh.CmdLineExecuter}
+		}
+
+		return nil
+	case "grub":
+		uh.activeInactiveBackend = &activeinactive.GrubImpl{
+			CmdLineExecuter: uh.CmdLineExecuter,
+			EnvPath:         uh.settings.GrubEnvPath,
+		}
+
+		return nil
+	case "uboot":
+		uh.activeInactiveBackend = &activeinactive.UBootImpl{
+			CmdLineExecuter: uh.CmdLineExecuter,
+			BootLimit:       uh.settings.UBootBootLimit,
+		}
+
+		return nil
+	case "efi":
+		uh.activeInactiveBackend = &activeinactive.EFIImpl{
+			CmdLineExecuter: uh.CmdLineExecuter,
+			Entries:         uh.settings.EFIBootEntries,
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("invalid active/inactive backend '%s'", uh.settings.ActiveInactiveBackend)
+}
+
+// SetActiveInactiveBackend replaces the backend which switches the
+// installation sets. It's kept by LoadSettings unless another one is
+// chosen by the "Backend" setting.
+func (uh *UpdateHub) SetActiveInactiveBackend(aii activeinactive.Interface) {
+	uh.activeInactiveBackend = aii
+}
+
 // StartPolling starts the polling process
 func (uh *UpdateHub) StartPolling() {
-	now := time.Now()
+	uh.recalibratePolling()
+
+	now := uh.clock().Now()
 	now = time.Unix(now.Unix(), 0)
 
+	interval := uh.pollingInterval()
+
 	poll := NewPollState(uh)
 
-	uh.State = poll
+	uh.setState(poll)
 
 	timeZero := (time.Time{}).UTC()
 
 	if uh.settings.FirstPoll == timeZero {
 		// Apply an offset in first poll
-		uh.settings.FirstPoll = now.Add(time.Duration(rand.Int63n(int64(uh.settings.PollingInterval))))
+		uh.settings.FirstPoll = uh.firstPollTime(now, interval)
+		uh.wallClock.firstPoll = true
 	} else if uh.settings.LastPoll == timeZero && now.After(uh.settings.FirstPoll) {
 		// it never did a poll before
-		uh.State = NewUpdateCheckState()
-	} else if uh.settings.LastPoll.Add(uh.settings.PollingInterval).Before(now) {
+		uh.setState(NewUpdateCheckState())
+	} else if uh.settings.LastPoll.Add(interval).Before(now) {
 		// pending regular interval
-		uh.State = NewUpdateCheckState()
+		uh.setState(NewUpdateCheckState())
 	} else {
 		nextPoll := time.Unix(uh.settings.FirstPoll.Unix(), 0)
 		for nextPoll.Before(now) {
-			nextPoll = nextPoll.Add(uh.settings.PollingInterval)
+			nextPoll = nextPoll.Add(interval)
+		}
+
+		// the wall clock went back since the polls were scheduled, so
+		// the next one is a whole interval away instead
+		if nextPoll.Sub(now) > interval {
+			nextPoll = now.Add(interval)
 		}
 
 		if uh.settings.ExtraPollingInterval > 0 {
@@ -187,7 +801,7 @@ func (uh *UpdateHub) StartPolling() {
 				poll.interval = uh.settings.ExtraPollingInterval
 			}
 		} else {
-			poll.ticksCount = (int64(uh.settings.PollingInterval) - nextPoll.Sub(now).Nanoseconds()) / int64(uh.TimeStep)
+			poll.ticksCount = (int64(interval) - nextPoll.Sub(now).Nanoseconds()) / int64(uh.TimeStep)
 		}
 	}
 }
@@ -10,25 +10,41 @@ package updatehub
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"testing"
 	"time"
 
-	"github.com/bouk/monkey"
 	"github.com/go-ini/ini"
 	"github.com/spf13/afero"
+	"github.com/spf13/afero/mem"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 
 	"github.com/UpdateHub/updatehub/activeinactive"
 	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/copy"
 	"github.com/UpdateHub/updatehub/installmodes"
 	"github.com/UpdateHub/updatehub/metadata"
 	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
 	"github.com/UpdateHub/updatehub/testsmocks/copymock"
 	"github.com/UpdateHub/updatehub/testsmocks/filemock"
 	"github.com/UpdateHub/updatehub/testsmocks/filesystemmock"
@@ -111,7 +127,7 @@ func TestUpdateHubCheckUpdate(t *testing.T) {
 
 			uh.Updater = um
 
-			updateMetadata, extraPoll := uh.CheckUpdate(0)
+			updateMetadata, extraPoll := uh.CheckUpdate(context.Background(), 0)
 
 			assert.Equal(t, expectedUpdateMetadata, updateMetadata)
 			assert.Equal(t, tc.extraPoll, extraPoll)
@@ -122,6 +138,259 @@ func TestUpdateHubCheckUpdate(t *testing.T) {
 	aim.AssertExpectations(t)
 }
 
+func TestUpdateHubCheckUpdateRefreshesFirmwareMetadata(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "/metadata/product-uid").Return([]byte("productuid-value"), nil)
+	clm.On("Execute", "/metadata/hardware").Return([]byte(""), nil)
+	clm.On("Execute", "/metadata/hardware-revision").Return([]byte(""), nil)
+	clm.On("Execute", "/metadata/version").Return([]byte("2.0"), nil)
+	clm.On("Execute", "/metadata/firmware-metadata.d/imei").Return([]byte("device-identity.imei=356938035643809"), nil).Once()
+
+	err := afero.WriteFile(uh.Store, "/metadata/firmware-metadata.d/imei", []byte(""), 0700)
+	assert.NoError(t, err)
+
+	uh.FirmwareMetadataLoader = &metadata.FirmwareMetadataLoader{
+		BasePath:        "/metadata",
+		Store:           uh.Store,
+		CmdLineExecuter: clm,
+	}
+
+	expected := metadata.FirmwareMetadata{
+		ProductUID:       "productuid-value",
+		DeviceIdentity:   map[string]string{"imei": "356938035643809"},
+		DeviceAttributes: map[string]string{},
+		Version:          "2.0",
+	}
+
+	var data struct {
+		Retries int `json:"retries"`
+		metadata.FirmwareMetadata
+	}
+
+	data.FirmwareMetadata = expected
+
+	um := &updatermock.UpdaterMock{}
+	um.On("CheckUpdate", uh.API.Request(), client.UpgradesEndpoint, data).Return(nil, time.Duration(0), nil).Twice()
+
+	uh.Updater = um
+
+	uh.CheckUpdate(context.Background(), 0)
+	assert.Equal(t, expected, uh.GetFirmwareMetadata())
+
+	// the current metadata is kept when it fails
+	clm.On("Execute", "/metadata/firmware-metadata.d/imei").Return([]byte(""), fmt.Errorf("modem error")).Once()
+
+	uh.CheckUpdate(context.Background(), 0)
+	assert.Equal(t, expected, uh.GetFirmwareMetadata())
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestUpdateHubCheckUpdateWithDeviceAttributes(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.FirmwareMetadata.DeviceAttributes = map[string]string{"location": "unknown", "carrier": "acme"}
+	uh.settings.FirmwareDeviceAttributes = []string{"location=lab", "tenant = acme"}
+
+	var data struct {
+		Retries int `json:"retries"`
+		metadata.FirmwareMetadata
+	}
+
+	data.FirmwareMetadata = uh.FirmwareMetadata
+	data.FirmwareMetadata.DeviceAttributes = map[string]string{"location": "lab", "carrier": "acme", "tenant": "acme"}
+
+	um := &updatermock.UpdaterMock{}
+	um.On("CheckUpdate", uh.API.Request(), client.UpgradesEndpoint, data).Return(nil, time.Duration(0), nil).Once()
+
+	uh.Updater = um
+
+	uh.CheckUpdate(context.Background(), 0)
+
+	// the firmware metadata itself is kept
+	assert.Equal(t, map[string]string{"location": "unknown", "carrier": "acme"}, uh.FirmwareMetadata.DeviceAttributes)
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestUpdateHubVerifyUpdateMetadata(t *testing.T) {
+	mode := newTestInstallMode()
+
+	defer mode.Unregister()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+
+	digest := sha256.Sum256([]byte(validUpdateMetadata))
+	signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err)
+
+	otherDigest := sha256.Sum256([]byte(validUpdateMetadataWithActiveInactive))
+	otherSignature, err := key.Sign(rand.Reader, otherDigest[:], crypto.SHA256)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name          string
+		publicKeyPath string
+		signature     []byte
+		expectedError string
+	}{
+		{
+			"WithoutPublicKey",
+			"",
+			nil,
+			"",
+		},
+
+		{
+			"WithValidSignature",
+			"/metadata.pub",
+			signature,
+			"",
+		},
+
+		{
+			"WithoutSignature",
+			"/metadata.pub",
+			nil,
+			"update metadata is not signed",
+		},
+
+		{
+			"WithInvalidSignature",
+			"/metadata.pub",
+			otherSignature,
+			"invalid update metadata signature",
+		},
+
+		{
+			"WithPublicKeyNotFound",
+			"/missing.pub",
+			signature,
+			"open /missing.pub: file does not exist",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			aim := &activeinactivemock.ActiveInactiveMock{}
+
+			uh, _ := newTestUpdateHub(&PollState{}, aim)
+			uh.settings.MetadataPublicKeyPath = tc.publicKeyPath
+
+			err := afero.WriteFile(uh.Store, "/metadata.pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+			assert.NoError(t, err)
+
+			updateMetadata, err := metadata.NewUpdateMetadata([]byte(validUpdateMetadata))
+			assert.NoError(t, err)
+			updateMetadata.Signature = tc.signature
+
+			err = uh.VerifyUpdateMetadata(updateMetadata)
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedError)
+			}
+
+			aim.AssertExpectations(t)
+		})
+	}
+}
+
+func TestUpdateHubVerifyObjectSignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	otherDer, err := x509.MarshalPKIXPublicKey(&otherKey.PublicKey)
+	assert.NoError(t, err)
+
+	// the digest of "test"
+	digest := sha256.Sum256([]byte("test"))
+	signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name           string
+		publicKeyPaths []string
+		signature      []byte
+		expectedError  string
+	}{
+		{
+			"WithoutPublicKeys",
+			nil,
+			nil,
+			"",
+		},
+
+		{
+			"WithValidSignature",
+			[]string{"/other.pub", "/objects.pub"},
+			signature,
+			"",
+		},
+
+		{
+			"WithoutSignature",
+			[]string{"/objects.pub"},
+			nil,
+			"object '9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08' is not signed",
+		},
+
+		{
+			"WithSignatureOfAnotherKey",
+			[]string{"/other.pub"},
+			signature,
+			"invalid object '9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08' signature",
+		},
+
+		{
+			"WithPublicKeyNotFound",
+			[]string{"/missing.pub"},
+			signature,
+			"open /missing.pub: file does not exist",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			uh, _ := newTestUpdateHub(&PollState{}, nil)
+			uh.settings.ObjectPublicKeyPaths = tc.publicKeyPaths
+
+			err := afero.WriteFile(uh.Store, "/objects.pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+			assert.NoError(t, err)
+
+			err = afero.WriteFile(uh.Store, "/other.pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: otherDer}), 0644)
+			assert.NoError(t, err)
+
+			o := &testObject{metadata.ObjectMetadata{Sha256sum: hex.EncodeToString(digest[:]), Signature: tc.signature}}
+
+			err = uh.VerifyObjectSignature(o)
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedError)
+			}
+		})
+	}
+}
+
 func TestUpdateHubFetchUpdate(t *testing.T) {
 	mode := newTestInstallMode()
 
@@ -144,7 +413,7 @@ func TestUpdateHubFetchUpdate(t *testing.T) {
 	sourceContent := []byte("content")
 
 	um := &updatermock.UpdaterMock{}
-	um.On("FetchUpdate", uh.API.Request(), uri).Return(source, int64(len(sourceContent)), nil)
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(source, int64(len(sourceContent)), nil)
 	uh.Updater = um
 
 	// setup filesystembackend
@@ -153,14 +422,23 @@ func TestUpdateHubFetchUpdate(t *testing.T) {
 	target.On("Close").Return(nil)
 
 	cpm := &copymock.CopyMock{}
-	cpm.On("Copy", target, source, 30*time.Second, (<-chan bool)(nil), utils.ChunkSize, 0, -1, false).Return(false, nil)
+	cpm.On("Copy", mock.MatchedBy(func(w *digestWriter) bool { return w.Writer == target }), mock.MatchedBy(func(r *meteredReader) bool { return r.ReadCloser == source }), 30*time.Second, (<-chan bool)(nil), utils.ChunkSize, 0, -1, false).Return(false, nil)
 	uh.CopyBackend = cpm
 
+	marker := &filemock.FileMock{}
+	marker.On("Close").Return(nil)
+
 	fsm := &filesystemmock.FileSystemBackendMock{}
+	fsm.On("Remove", path.Join(uh.settings.DownloadDir, objectUID+downloadDigestSuffix)).Return(os.ErrNotExist)
+	fsm.On("Stat", path.Join(uh.settings.DownloadDir, objectUID+partialDownloadSuffix)).Return((*mem.FileInfo)(nil), os.ErrNotExist)
+	fsm.On("Stat", path.Join(uh.settings.DownloadDir, objectUID)).Return((*mem.FileInfo)(nil), os.ErrNotExist)
+	fsm.On("Create", path.Join(uh.settings.DownloadDir, objectUID+partialDownloadSuffix)).Return(marker, nil)
 	fsm.On("Create", path.Join(uh.settings.DownloadDir, objectUID)).Return(target, nil)
+	fsm.On("Remove", path.Join(uh.settings.DownloadDir, objectUID+partialDownloadSuffix)).Return(nil)
+	fsm.On("OpenFile", path.Join(uh.settings.DownloadDir, objectUID+downloadDigestSuffix), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0644)).Return(newDownloadDigestMock(), nil)
 	uh.Store = fsm
 
-	err = uh.FetchUpdate(updateMetadata, nil)
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
 	assert.NoError(t, err)
 
 	aim.AssertExpectations(t)
@@ -179,6 +457,7 @@ func TestUpdateHubFetchUpdateWithTargetFileError(t *testing.T) {
 	aim := &activeinactivemock.ActiveInactiveMock{}
 
 	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.settings.DownloadMaxAttempts = 1
 
 	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validUpdateMetadata))
 	assert.NoError(t, err)
@@ -192,11 +471,18 @@ func TestUpdateHubFetchUpdateWithTargetFileError(t *testing.T) {
 	cpm := &copymock.CopyMock{}
 	uh.CopyBackend = cpm
 
+	marker := &filemock.FileMock{}
+	marker.On("Close").Return(nil)
+
 	fsm := &filesystemmock.FileSystemBackendMock{}
+	fsm.On("Remove", path.Join(uh.settings.DownloadDir, objectUID+downloadDigestSuffix)).Return(os.ErrNotExist)
+	fsm.On("Stat", path.Join(uh.settings.DownloadDir, objectUID+partialDownloadSuffix)).Return((*mem.FileInfo)(nil), os.ErrNotExist)
+	fsm.On("Stat", path.Join(uh.settings.DownloadDir, objectUID)).Return((*mem.FileInfo)(nil), os.ErrNotExist)
+	fsm.On("Create", path.Join(uh.settings.DownloadDir, objectUID+partialDownloadSuffix)).Return(marker, nil)
 	fsm.On("Create", path.Join(uh.settings.DownloadDir, objectUID)).Return((*filemock.FileMock)(nil), fmt.Errorf("create error"))
 	uh.Store = fsm
 
-	err = uh.FetchUpdate(updateMetadata, nil)
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
 	assert.EqualError(t, err, "create error")
 
 	aim.AssertExpectations(t)
@@ -213,6 +499,7 @@ func TestUpdateHubFetchUpdateWithUpdaterError(t *testing.T) {
 	aim := &activeinactivemock.ActiveInactiveMock{}
 
 	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.settings.DownloadMaxAttempts = 1
 
 	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validUpdateMetadata))
 	assert.NoError(t, err)
@@ -225,7 +512,7 @@ func TestUpdateHubFetchUpdateWithUpdaterError(t *testing.T) {
 	source := &filemock.FileMock{}
 
 	um := &updatermock.UpdaterMock{}
-	um.On("FetchUpdate", uh.API.Request(), uri).Return(source, int64(0), fmt.Errorf("updater error"))
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(source, int64(0), fmt.Errorf("updater error"))
 	uh.Updater = um
 
 	// setup filesystembackend
@@ -236,11 +523,18 @@ func TestUpdateHubFetchUpdateWithUpdaterError(t *testing.T) {
 	cpm := &copymock.CopyMock{}
 	uh.CopyBackend = cpm
 
+	marker := &filemock.FileMock{}
+	marker.On("Close").Return(nil)
+
 	fsm := &filesystemmock.FileSystemBackendMock{}
+	fsm.On("Remove", path.Join(uh.settings.DownloadDir, objectUID+downloadDigestSuffix)).Return(os.ErrNotExist)
+	fsm.On("Stat", path.Join(uh.settings.DownloadDir, objectUID+partialDownloadSuffix)).Return((*mem.FileInfo)(nil), os.ErrNotExist)
+	fsm.On("Stat", path.Join(uh.settings.DownloadDir, objectUID)).Return((*mem.FileInfo)(nil), os.ErrNotExist)
+	fsm.On("Create", path.Join(uh.settings.DownloadDir, objectUID+partialDownloadSuffix)).Return(marker, nil)
 	fsm.On("Create", path.Join(uh.settings.DownloadDir, objectUID)).Return(target, nil)
 	uh.Store = fsm
 
-	err = uh.FetchUpdate(updateMetadata, nil)
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
 	assert.EqualError(t, err, "updater error")
 
 	aim.AssertExpectations(t)
@@ -259,6 +553,7 @@ func TestUpdateHubFetchUpdateWithCopyError(t *testing.T) {
 	aim := &activeinactivemock.ActiveInactiveMock{}
 
 	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.settings.DownloadMaxAttempts = 1
 
 	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validUpdateMetadata))
 	assert.NoError(t, err)
@@ -273,7 +568,7 @@ func TestUpdateHubFetchUpdateWithCopyError(t *testing.T) {
 	sourceContent := []byte("content")
 
 	um := &updatermock.UpdaterMock{}
-	um.On("FetchUpdate", uh.API.Request(), uri).Return(source, int64(len(sourceContent)), nil)
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(0)).Return(source, int64(len(sourceContent)), nil)
 	uh.Updater = um
 
 	// setup filesystembackend
@@ -282,14 +577,21 @@ func TestUpdateHubFetchUpdateWithCopyError(t *testing.T) {
 	target.On("Close").Return(nil)
 
 	cpm := &copymock.CopyMock{}
-	cpm.On("Copy", target, source, 30*time.Second, (<-chan bool)(nil), utils.ChunkSize, 0, -1, false).Return(false, fmt.Errorf("copy error"))
+	cpm.On("Copy", mock.MatchedBy(func(w *digestWriter) bool { return w.Writer == target }), mock.MatchedBy(func(r *meteredReader) bool { return r.ReadCloser == source }), 30*time.Second, (<-chan bool)(nil), utils.ChunkSize, 0, -1, false).Return(false, fmt.Errorf("copy error"))
 	uh.CopyBackend = cpm
 
+	marker := &filemock.FileMock{}
+	marker.On("Close").Return(nil)
+
 	fsm := &filesystemmock.FileSystemBackendMock{}
+	fsm.On("Remove", path.Join(uh.settings.DownloadDir, objectUID+downloadDigestSuffix)).Return(os.ErrNotExist)
+	fsm.On("Stat", path.Join(uh.settings.DownloadDir, objectUID+partialDownloadSuffix)).Return((*mem.FileInfo)(nil), os.ErrNotExist)
+	fsm.On("Stat", path.Join(uh.settings.DownloadDir, objectUID)).Return((*mem.FileInfo)(nil), os.ErrNotExist)
+	fsm.On("Create", path.Join(uh.settings.DownloadDir, objectUID+partialDownloadSuffix)).Return(marker, nil)
 	fsm.On("Create", path.Join(uh.settings.DownloadDir, objectUID)).Return(target, nil)
 	uh.Store = fsm
 
-	err = uh.FetchUpdate(updateMetadata, nil)
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
 	assert.EqualError(t, err, "copy error")
 
 	aim.AssertExpectations(t)
@@ -330,7 +632,7 @@ func TestUpdateHubFetchUpdateWithActiveInactive(t *testing.T) {
 
 	objectUIDFirst := updateMetadata.Objects[1][0].GetObjectMetadata().Sha256sum
 	uri1 := path.Join(expectedURIPrefix, objectUIDFirst)
-	um.On("FetchUpdate", uh.API.Request(), uri1).Return(source1, int64(len(file1Content)), nil)
+	um.On("FetchUpdate", uh.API.Request(), uri1, int64(0)).Return(source1, int64(len(file1Content)), nil)
 
 	// download of file 2 setup
 	file2Content := []byte("content2butbigger") // this matches with the sha256sum in "validUpdateMetadataWithActiveInactive"
@@ -340,7 +642,7 @@ func TestUpdateHubFetchUpdateWithActiveInactive(t *testing.T) {
 
 	objectUIDSecond := updateMetadata.Objects[1][1].GetObjectMetadata().Sha256sum
 	uri2 := path.Join(expectedURIPrefix, objectUIDSecond)
-	um.On("FetchUpdate", uh.API.Request(), uri2).Return(source2, int64(len(file2Content)), nil)
+	um.On("FetchUpdate", uh.API.Request(), uri2, int64(0)).Return(source2, int64(len(file2Content)), nil)
 
 	// setup filesystembackend
 	target1 := &filemock.FileMock{}
@@ -348,7 +650,20 @@ func TestUpdateHubFetchUpdateWithActiveInactive(t *testing.T) {
 	target2 := &filemock.FileMock{}
 	target2.On("Close").Return(nil)
 
+	marker := &filemock.FileMock{}
+	marker.On("Close").Return(nil)
+
 	fsm := &filesystemmock.FileSystemBackendMock{}
+	for _, objectUID := range []string{objectUIDFirst, objectUIDSecond} {
+		markerPath := path.Join(uh.settings.DownloadDir, objectUID+partialDownloadSuffix)
+		digestPath := path.Join(uh.settings.DownloadDir, objectUID+downloadDigestSuffix)
+		fsm.On("Remove", digestPath).Return(os.ErrNotExist)
+		fsm.On("Stat", markerPath).Return((*mem.FileInfo)(nil), os.ErrNotExist)
+		fsm.On("Stat", path.Join(uh.settings.DownloadDir, objectUID)).Return((*mem.FileInfo)(nil), os.ErrNotExist)
+		fsm.On("Create", markerPath).Return(marker, nil)
+		fsm.On("Remove", markerPath).Return(nil)
+		fsm.On("OpenFile", digestPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0644)).Return(newDownloadDigestMock(), nil)
+	}
 	fsm.On("Create", path.Join(uh.settings.DownloadDir, objectUIDFirst)).Return(target1, nil)
 	fsm.On("Create", path.Join(uh.settings.DownloadDir, objectUIDSecond)).Return(target2, nil)
 	uh.Store = fsm
@@ -357,11 +672,11 @@ func TestUpdateHubFetchUpdateWithActiveInactive(t *testing.T) {
 	uh.Updater = um
 
 	cpm := &copymock.CopyMock{}
-	cpm.On("Copy", target1, source1, 30*time.Second, (<-chan bool)(nil), utils.ChunkSize, 0, -1, false).Return(false, nil)
-	cpm.On("Copy", target2, source2, 30*time.Second, (<-chan bool)(nil), utils.ChunkSize, 0, -1, false).Return(false, nil)
+	cpm.On("Copy", mock.MatchedBy(func(w *digestWriter) bool { return w.Writer == target1 }), mock.MatchedBy(func(r *meteredReader) bool { return r.ReadCloser == source1 }), 30*time.Second, (<-chan bool)(nil), utils.ChunkSize, 0, -1, false).Return(false, nil)
+	cpm.On("Copy", mock.MatchedBy(func(w *digestWriter) bool { return w.Writer == target2 }), mock.MatchedBy(func(r *meteredReader) bool { return r.ReadCloser == source2 }), 30*time.Second, (<-chan bool)(nil), utils.ChunkSize, 0, -1, false).Return(false, nil)
 	uh.CopyBackend = cpm
 
-	err = uh.FetchUpdate(updateMetadata, nil)
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
 	assert.NoError(t, err)
 
 	aim.AssertExpectations(t)
@@ -389,8 +704,100 @@ func TestUpdateHubFetchUpdateWithActiveInactiveError(t *testing.T) {
 	um := &updatermock.UpdaterMock{}
 	uh.Updater = um
 
-	err = uh.FetchUpdate(updateMetadata, nil)
-	assert.EqualError(t, err, "update metadata must have 1 or 2 objects. Found 0")
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.EqualError(t, err, "update metadata must have at least 1 object. Found 0")
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestUpdateHubFetchUpdateWithPartialDownload(t *testing.T) {
+	mode := newTestInstallMode()
+
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.CopyBackend = copy.ExtendedIO{}
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validUpdateMetadata))
+	assert.NoError(t, err)
+
+	packageUID := utils.DataSha256sum([]byte(validUpdateMetadata))
+	objectUID := updateMetadata.Objects[0][0].GetObjectMetadata().Sha256sum
+
+	uri := path.Join("/", uh.FirmwareMetadata.ProductUID, packageUID, objectUID)
+
+	objectPath := path.Join(uh.settings.DownloadDir, objectUID)
+	markerPath := objectPath + partialDownloadSuffix
+
+	err = afero.WriteFile(uh.Store, objectPath, []byte("partial"), 0666)
+	assert.NoError(t, err)
+	err = afero.WriteFile(uh.Store, markerPath, []byte(""), 0666)
+	assert.NoError(t, err)
+
+	um := &updatermock.UpdaterMock{}
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(len("partial"))).Return(ioutil.NopCloser(bytes.NewReader([]byte(" content"))), int64(len(" content")), nil)
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.NoError(t, err)
+
+	data, err := afero.ReadFile(uh.Store, objectPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("partial content"), data)
+
+	markerExists, err := afero.Exists(uh.Store, markerPath)
+	assert.NoError(t, err)
+	assert.False(t, markerExists)
+
+	aim.AssertExpectations(t)
+	um.AssertExpectations(t)
+}
+
+func TestUpdateHubFetchUpdateWithCompletePartialDownload(t *testing.T) {
+	mode := newTestInstallMode()
+
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(&PollState{}, aim)
+	uh.CopyBackend = copy.ExtendedIO{}
+
+	updateMetadata, err := metadata.NewUpdateMetadata([]byte(validUpdateMetadata))
+	assert.NoError(t, err)
+
+	packageUID := utils.DataSha256sum([]byte(validUpdateMetadata))
+	objectUID := updateMetadata.Objects[0][0].GetObjectMetadata().Sha256sum
+
+	uri := path.Join("/", uh.FirmwareMetadata.ProductUID, packageUID, objectUID)
+
+	objectPath := path.Join(uh.settings.DownloadDir, objectUID)
+	markerPath := objectPath + partialDownloadSuffix
+
+	// interrupted after the last byte was written
+	err = afero.WriteFile(uh.Store, objectPath, []byte("partial content"), 0666)
+	assert.NoError(t, err)
+	err = afero.WriteFile(uh.Store, markerPath, []byte(""), 0666)
+	assert.NoError(t, err)
+
+	// as the client answers a "416 Range Not Satisfiable"
+	um := &updatermock.UpdaterMock{}
+	um.On("FetchUpdate", uh.API.Request(), uri, int64(len("partial content"))).Return(ioutil.NopCloser(bytes.NewReader(nil)), int64(0), nil)
+	uh.Updater = um
+
+	err = uh.FetchUpdate(context.Background(), updateMetadata)
+	assert.NoError(t, err)
+
+	data, err := afero.ReadFile(uh.Store, objectPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("partial content"), data)
+
+	markerExists, err := afero.Exists(uh.Store, markerPath)
+	assert.NoError(t, err)
+	assert.False(t, markerExists)
 
 	aim.AssertExpectations(t)
 	um.AssertExpectations(t)
@@ -412,6 +819,9 @@ func TestUpdateHubReportState(t *testing.T) {
 	uh, _ := newTestUpdateHub(state, aim)
 	uh.Reporter = client.Reporter(testReporter{})
 
+	// the same state is reported again right away
+	uh.settings.ReportRepeatInterval = 0
+
 	err = uh.ReportCurrentState()
 	assert.NoError(t, err)
 
@@ -478,22 +888,28 @@ func TestStartPolling(t *testing.T) {
 				assert.Equal(t, 3*time.Second, poll.interval)
 			},
 		},
+
+		{
+			"ClockWentBack",
+			10 * time.Second,
+			0,
+			now.Add(time.Hour),
+			now.Add(time.Hour),
+			&PollState{},
+			func(t *testing.T, uh *UpdateHub, state State) {
+				poll := state.(*PollState)
+				assert.Equal(t, 10*time.Second, poll.interval)
+				assert.Equal(t, int64(0), poll.ticksCount)
+			},
+		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			// Simulate time passage from now
-			defer func() *monkey.PatchGuard {
-				seconds := -1
-				return monkey.Patch(time.Now, func() time.Time {
-					seconds++
-					return now.Add(time.Second * time.Duration(seconds))
-				})
-			}().Unpatch()
-
 			aim := &activeinactivemock.ActiveInactiveMock{}
 
 			uh, _ := newTestUpdateHub(nil, aim)
+			uh.Clock = &testClock{now: now}
 
 			uh.settings.PollingInterval = tc.pollingInterval
 			uh.settings.ExtraPollingInterval = tc.extraPollingInterval
@@ -528,6 +944,411 @@ func TestLoadUpdateHubSettingsWithOpenError(t *testing.T) {
 	fsbm.AssertExpectations(t)
 }
 
+func TestLoadUpdateHubSettingsWithClientCertificateError(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.SystemSettingsPath = "/systempath"
+	uh.RuntimeSettingsPath = "/runtimepath"
+
+	err := afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte("[Network]\nClientCertificate=/client.crt\nClientKey=/client.key\n"), 0644)
+	assert.NoError(t, err)
+
+	err = uh.LoadSettings()
+	assert.EqualError(t, err, "failed to read client certificate: open /client.crt: file does not exist")
+
+	aim.AssertExpectations(t)
+}
+
+func TestLoadUpdateHubSettingsWithInvalidMaintenanceWindow(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.SystemSettingsPath = "/systempath"
+	uh.RuntimeSettingsPath = "/runtimepath"
+
+	err := afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte("[Update]\nMaintenanceWindow=02:00\n"), 0644)
+	assert.NoError(t, err)
+
+	err = uh.LoadSettings()
+	assert.EqualError(t, err, "invalid settings: [Update] MaintenanceWindow: invalid maintenance window '02:00'")
+
+	aim.AssertExpectations(t)
+}
+
+func TestLoadUpdateHubSettingsWithInvalidDeviceAttribute(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.SystemSettingsPath = "/systempath"
+	uh.RuntimeSettingsPath = "/runtimepath"
+
+	err := afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte("[Firmware]\nDeviceAttributes=location=lab,tenant\n"), 0644)
+	assert.NoError(t, err)
+
+	err = uh.LoadSettings()
+	assert.EqualError(t, err, "invalid settings: [Firmware] DeviceAttributes: invalid device attribute 'tenant', it must be '<key>=<value>'")
+
+	aim.AssertExpectations(t)
+}
+
+func TestLoadUpdateHubSettingsWithInvalidProxy(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.SystemSettingsPath = "/systempath"
+	uh.RuntimeSettingsPath = "/runtimepath"
+
+	err := afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte("[Network]\nProxy=ftp://proxy\n"), 0644)
+	assert.NoError(t, err)
+
+	err = uh.LoadSettings()
+	assert.EqualError(t, err, "invalid settings: [Network] Proxy: unsupported proxy scheme 'ftp'")
+
+	aim.AssertExpectations(t)
+}
+
+func TestLoadUpdateHubSettingsWithFallbackServers(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	unreachable := l.Addr().String()
+	l.Close()
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.Updater = client.NewUpdateClient()
+	uh.SystemSettingsPath = "/systempath"
+	uh.RuntimeSettingsPath = "/runtimepath"
+
+	settings := fmt.Sprintf("[Network]\nUpdateHubServerAddress=%s\nFallbackServerAddresses=%s\n", unreachable, u.Host)
+
+	err = afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte(settings), 0644)
+	assert.NoError(t, err)
+
+	err = uh.LoadSettings()
+	assert.NoError(t, err)
+
+	updateMetadata, _, err := uh.Updater.CheckUpdate(context.Background(), uh.API.Request(), client.UpgradesEndpoint, &metadata.FirmwareMetadata{})
+	assert.NoError(t, err)
+	assert.Nil(t, updateMetadata)
+
+	aim.AssertExpectations(t)
+}
+
+func TestLoadUpdateHubSettingsWithCoAPTransport(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.SystemSettingsPath = "/systempath"
+	uh.RuntimeSettingsPath = "/runtimepath"
+
+	err := afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte("[Network]\nTransport=coap\n"), 0644)
+	assert.NoError(t, err)
+
+	err = uh.LoadSettings()
+	assert.NoError(t, err)
+	assert.IsType(t, &client.CoAPClient{}, uh.Updater)
+
+	aim.AssertExpectations(t)
+}
+
+func TestLoadUpdateHubSettingsWithInvalidPinnedPublicKey(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.SystemSettingsPath = "/systempath"
+	uh.RuntimeSettingsPath = "/runtimepath"
+
+	err := afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte("[Network]\nPinnedPublicKeys=invalid\n"), 0644)
+	assert.NoError(t, err)
+
+	err = uh.LoadSettings()
+	assert.EqualError(t, err, "invalid public key pin 'invalid'")
+
+	aim.AssertExpectations(t)
+}
+
+func TestLoadUpdateHubSettingsWithGRPCTransport(t *testing.T) {
+	testCases := []struct {
+		name          string
+		settings      string
+		expectedError string
+	}{
+		{
+			"PlainText",
+			"[Network]\nUpdateHubServerAddress=grpc://localhost:50051\nFallbackServerAddresses=grpcs://backup:50051\n",
+			"",
+		},
+
+		{
+			"TLS",
+			"[Network]\nUpdateHubServerAddress=grpcs://localhost:50051\n",
+			"",
+		},
+
+		{
+			"WithCoAPTransport",
+			"[Network]\nUpdateHubServerAddress=grpc://localhost:50051\nTransport=coap\n",
+			"the 'grpc' server address scheme can't be used with the 'coap' transport",
+		},
+
+		{
+			"InvalidScheme",
+			"[Network]\nUpdateHubServerAddress=ftp://localhost\n",
+			"invalid settings: [Network] UpdateHubServerAddress: invalid server address scheme 'ftp'",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			aim := &activeinactivemock.ActiveInactiveMock{}
+
+			uh, _ := newTestUpdateHub(nil, aim)
+			uh.SystemSettingsPath = "/systempath"
+			uh.RuntimeSettingsPath = "/runtimepath"
+
+			err := afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte(tc.settings), 0644)
+			assert.NoError(t, err)
+
+			err = uh.LoadSettings()
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.IsType(t, &client.GRPCClient{}, uh.Updater)
+			assert.Equal(t, uh.Updater, uh.Reporter)
+
+			aim.AssertExpectations(t)
+		})
+	}
+}
+
+func TestLoadUpdateHubSettingsWithFileServerAddress(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.SystemSettingsPath = "/systempath"
+	uh.RuntimeSettingsPath = "/runtimepath"
+
+	err := afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte("[Network]\nUpdateHubServerAddress=file:///media/updates\n"), 0644)
+	assert.NoError(t, err)
+
+	err = afero.WriteFile(uh.Store, "/media/updates/upgrades", []byte(`{"product-uid": "0123456789", "version": "2.0", "objects": [[]]}`), 0644)
+	assert.NoError(t, err)
+
+	err = uh.LoadSettings()
+	assert.NoError(t, err)
+	assert.IsType(t, &client.FileClient{}, uh.Updater)
+
+	// the update metadata is read from the dir
+	device := struct {
+		ProductUID string `json:"product-uid"`
+		Version    string `json:"version"`
+	}{"0123456789", "1.0"}
+
+	updateMetadata, _, err := uh.Updater.CheckUpdate(context.Background(), nil, client.UpgradesEndpoint, device)
+	assert.NoError(t, err)
+	assert.Equal(t, "2.0", updateMetadata.(*metadata.UpdateMetadata).Version)
+
+	aim.AssertExpectations(t)
+
+	// with another transport
+	err = afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte("[Network]\nUpdateHubServerAddress=file:///media/updates\nTransport=coap\n"), 0644)
+	assert.NoError(t, err)
+
+	err = uh.LoadSettings()
+	assert.EqualError(t, err, "the 'file' server address scheme can't be used with the 'coap' transport")
+}
+
+func TestLoadUpdateHubSettingsWithSFTPServerAddress(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name          string
+		settings      string
+		expectedError string
+	}{
+		{
+			"WithKey",
+			"[Network]\nUpdateHubServerAddress=sftp://updatehub@localhost/srv/updates\n[SFTP]\nKey=/sftp-key\nHostKeys=SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s\n",
+			"",
+		},
+
+		{
+			"WithoutKey",
+			"[Network]\nUpdateHubServerAddress=sftp://updatehub@localhost/srv/updates\n",
+			"the SFTP server address needs a key ('Key' at the '[SFTP]' settings)",
+		},
+
+		{
+			"WithoutHostKeys",
+			"[Network]\nUpdateHubServerAddress=sftp://updatehub@localhost/srv/updates\n[SFTP]\nKey=/sftp-key\n",
+			"no SFTP host key is pinned",
+		},
+
+		{
+			"WithoutUser",
+			"[Network]\nUpdateHubServerAddress=sftp://localhost/srv/updates\n",
+			"invalid settings: [Network] UpdateHubServerAddress: malformed server address 'sftp://localhost/srv/updates', it must be like 'sftp://user@host/dir'",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			aim := &activeinactivemock.ActiveInactiveMock{}
+
+			uh, _ := newTestUpdateHub(nil, aim)
+			uh.SystemSettingsPath = "/systempath"
+			uh.RuntimeSettingsPath = "/runtimepath"
+
+			err := afero.WriteFile(uh.Store, "/sftp-key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+			assert.NoError(t, err)
+
+			err = afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte(tc.settings), 0644)
+			assert.NoError(t, err)
+
+			err = uh.LoadSettings()
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.IsType(t, &client.SFTPClient{}, uh.Updater)
+
+			aim.AssertExpectations(t)
+		})
+	}
+}
+
+func TestSplitServerScheme(t *testing.T) {
+	scheme, address := splitServerScheme("grpcs://localhost:50051")
+	assert.Equal(t, "grpcs", scheme)
+	assert.Equal(t, "localhost:50051", address)
+
+	scheme, address = splitServerScheme("localhost:8080")
+	assert.Equal(t, "", scheme)
+	assert.Equal(t, "localhost:8080", address)
+}
+
+func TestLoadUpdateHubSettingsWithInvalidTransport(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.SystemSettingsPath = "/systempath"
+	uh.RuntimeSettingsPath = "/runtimepath"
+
+	err := afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte("[Network]\nTransport=carrier-pigeon\n"), 0644)
+	assert.NoError(t, err)
+
+	err = uh.LoadSettings()
+	assert.EqualError(t, err, "invalid settings: [Network] Transport: invalid transport 'carrier-pigeon'")
+
+	aim.AssertExpectations(t)
+}
+
+func TestLoadUpdateHubSettingsWithGrubActiveInactiveBackend(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.CmdLineExecuter = clm
+	uh.SystemSettingsPath = "/systempath"
+	uh.RuntimeSettingsPath = "/runtimepath"
+
+	err := afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte("[ActiveInactive]\nBackend=grub\nGrubEnvPath=/boot/efi/grubenv\n"), 0644)
+	assert.NoError(t, err)
+
+	err = uh.LoadSettings()
+	assert.NoError(t, err)
+	assert.Equal(t, &activeinactive.GrubImpl{CmdLineExecuter: clm, EnvPath: "/boot/efi/grubenv"}, uh.activeInactiveBackend)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestLoadUpdateHubSettingsWithUBootActiveInactiveBackend(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.CmdLineExecuter = clm
+	uh.SystemSettingsPath = "/systempath"
+	uh.RuntimeSettingsPath = "/runtimepath"
+
+	err := afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte("[ActiveInactive]\nBackend=uboot\nUBootBootLimit=5\n"), 0644)
+	assert.NoError(t, err)
+
+	err = uh.LoadSettings()
+	assert.NoError(t, err)
+	assert.Equal(t, &activeinactive.UBootImpl{CmdLineExecuter: clm, BootLimit: 5}, uh.activeInactiveBackend)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestLoadUpdateHubSettingsWithEFIActiveInactiveBackend(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.CmdLineExecuter = clm
+	uh.SystemSettingsPath = "/systempath"
+	uh.RuntimeSettingsPath = "/runtimepath"
+
+	err := afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte("[ActiveInactive]\nBackend=efi\nEFIBootEntries=0001,0002\n"), 0644)
+	assert.NoError(t, err)
+
+	err = uh.LoadSettings()
+	assert.NoError(t, err)
+	assert.Equal(t, &activeinactive.EFIImpl{CmdLineExecuter: clm, Entries: []string{"0001", "0002"}}, uh.activeInactiveBackend)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestLoadUpdateHubSettingsWithExecutablesActiveInactiveBackend(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.CmdLineExecuter = &utils.CmdLine{}
+	uh.SystemSettingsPath = "/systempath"
+	uh.RuntimeSettingsPath = "/runtimepath"
+
+	err := uh.LoadSettings()
+	assert.NoError(t, err)
+	assert.Equal(t, &activeinactive.DefaultImpl{CmdLineExecuter: uh.CmdLineExecuter}, uh.activeInactiveBackend)
+}
+
+func TestLoadUpdateHubSettingsWithInvalidActiveInactiveBackend(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+	uh.SystemSettingsPath = "/systempath"
+	uh.RuntimeSettingsPath = "/runtimepath"
+
+	err := afero.WriteFile(uh.Store, uh.SystemSettingsPath, []byte("[ActiveInactive]\nBackend=lilo\n"), 0644)
+	assert.NoError(t, err)
+
+	err = uh.LoadSettings()
+	assert.EqualError(t, err, "invalid settings: [ActiveInactive] Backend: invalid active/inactive backend 'lilo'")
+
+	aim.AssertExpectations(t)
+}
+
 func TestLoadUpdateHubSettings(t *testing.T) {
 	testPath, err := ioutil.TempDir("", "updatehub-test")
 	assert.NoError(t, err)
@@ -614,6 +1435,19 @@ func TestLoadUpdateHubSettings(t *testing.T) {
 	}
 }
 
+// newDownloadDigestMock returns the file the download digest is
+// written to when the object is downloaded through a copy mock, which
+// writes nothing
+func newDownloadDigestMock() *filemock.FileMock {
+	digest := []byte(`{"sha256sum":"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855","size":0}`)
+
+	f := &filemock.FileMock{}
+	f.On("Write", digest).Return(len(digest), nil)
+	f.On("Close").Return(nil)
+
+	return f
+}
+
 type testObject struct {
 	metadata.ObjectMetadata
 }
@@ -653,3 +1487,58 @@ func newTestUpdateHub(state State, aii activeinactive.Interface) (*UpdateHub, er
 
 	return uh, err
 }
+
+func TestSetupRetries(t *testing.T) {
+	requests := 0
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	uh, err := newTestUpdateHub(nil, nil)
+	assert.NoError(t, err)
+
+	uh.API = client.NewApiClient(u.Host)
+	uh.settings.RequestRetries = 1
+	uh.settings.RequestRetryInterval = time.Millisecond
+
+	uh.setupRetries()
+
+	req, err := http.NewRequest(http.MethodGet, s.URL+client.UpgradesEndpoint, nil)
+	assert.NoError(t, err)
+
+	// the flapping server doesn't fail the request
+	res, err := uh.API.Request().Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, 2, requests)
+}
+
+func TestSetupTimeouts(t *testing.T) {
+	uh, err := newTestUpdateHub(nil, nil)
+	assert.NoError(t, err)
+
+	uh.API = client.NewApiClient("localhost")
+	uh.settings.TLSHandshakeTimeout = 5 * time.Second
+	uh.settings.ResponseHeaderTimeout = 20 * time.Second
+	uh.settings.IdleConnTimeout = time.Minute
+
+	uh.setupTimeouts()
+
+	transport := uh.API.Transport.(*http.Transport)
+	assert.NotNil(t, transport.DialContext)
+	assert.Equal(t, 5*time.Second, transport.TLSHandshakeTimeout)
+	assert.Equal(t, 20*time.Second, transport.ResponseHeaderTimeout)
+	assert.Equal(t, time.Minute, transport.IdleConnTimeout)
+}
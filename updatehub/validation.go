@@ -0,0 +1,186 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+
+	"github.com/UpdateHub/updatehub/activeinactive"
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+const rollbackReportState = "rollback"
+
+// setPendingValidation records that the package "packageUID" was
+// installed on the installation set "index", out of "slots", so it
+// must be validated after the reboot
+func (uh *UpdateHub) setPendingValidation(packageUID string, index int, slots int) error {
+	uh.settings.PersistentUpdateSettings = PersistentUpdateSettings{
+		PendingValidationPackageUID: packageUID,
+		UpgradeToInstallation:       index,
+		PreviousInstallation:        (index - 1 + slots) % slots,
+		BootAttempts:                0,
+	}
+
+	return uh.saveRuntimeSettings()
+}
+
+// ensurePendingValidation makes sure the installation set which is
+// going to be booted is validated after the reboot
+func (uh *UpdateHub) ensurePendingValidation(updateMetadata *metadata.UpdateMetadata) error {
+	packageUID := updateMetadata.PackageUID()
+
+	// only the active/inactive updates can be validated
+	if !isActiveInactive(updateMetadata) || uh.settings.PendingValidationPackageUID == packageUID {
+		return nil
+	}
+
+	active, err := uh.activeInactiveBackend.Active()
+	if err != nil {
+		return err
+	}
+
+	return uh.setPendingValidation(packageUID, active, len(updateMetadata.Objects))
+}
+
+func (uh *UpdateHub) clearPendingValidation() error {
+	uh.settings.PersistentUpdateSettings = PersistentUpdateSettings{}
+
+	return uh.saveRuntimeSettings()
+}
+
+// ValidateUpdate must be called when the agent starts. If an update was
+// installed on the inactive installation set before the reboot, it
+// checks whether the system booted into it and runs the executables
+// found at "ValidationCallbacksDir" as health checks. When a check
+// fails or the new installation set was booted more than
+// "MaxBootAttempts" times without being validated, the previous
+// installation set is activated back, a rollback is reported and the
+// package is marked bad.
+func (uh *UpdateHub) ValidateUpdate() error {
+	pending := &uh.settings.PersistentUpdateSettings
+
+	if pending.PendingValidationPackageUID == "" {
+		return nil
+	}
+
+	packageUID := pending.PendingValidationPackageUID
+
+	active, err := uh.activeInactiveBackend.Active()
+	if err != nil {
+		return err
+	}
+
+	// the bootloader already fell back to the previous installation set
+	if active != pending.UpgradeToInstallation {
+		log.Warn(fmt.Sprintf("failed to boot into installation set %d, the previous one is active", pending.UpgradeToInstallation))
+
+		err = uh.setValidated()
+		if err != nil {
+			return err
+		}
+
+		return uh.finishRollback(packageUID)
+	}
+
+	pending.BootAttempts++
+
+	err = uh.saveRuntimeSettings()
+	if err != nil {
+		return err
+	}
+
+	if pending.BootAttempts > uh.settings.MaxBootAttempts {
+		return uh.rollback(packageUID, fmt.Errorf("installation set %d was booted %d times without being validated", active, pending.BootAttempts-1))
+	}
+
+	err = uh.runCallbacks(uh.settings.ValidationCallbacksDir, packageUID)
+	if err != nil {
+		return uh.rollback(packageUID, fmt.Errorf("health check failed: %s", err))
+	}
+
+	err = uh.setValidated()
+	if err != nil {
+		return err
+	}
+
+	return uh.clearPendingValidation()
+}
+
+// rollback activates the installation set that was active before the
+// update was installed
+func (uh *UpdateHub) rollback(packageUID string, cause error) error {
+	previous := uh.settings.PreviousInstallation
+
+	// recorded by an agent which supported only 2 installation sets
+	if previous == uh.settings.UpgradeToInstallation {
+		previous = (uh.settings.UpgradeToInstallation - 1) * -1
+	}
+
+	log.Warn(fmt.Sprintf("rolling back to installation set %d: %s", previous, cause))
+
+	err := uh.activeInactiveBackend.SetActive(previous)
+
+	uh.auditSwitchSlot(packageUID, previous, err)
+
+	if err != nil {
+		return err
+	}
+
+	// the previous installation set is known to be good
+	err = uh.setValidated()
+	if err != nil {
+		return err
+	}
+
+	return uh.finishRollback(packageUID)
+}
+
+// setValidated disarms the bootloader fallback of the backends which
+// keep one
+func (uh *UpdateHub) setValidated() error {
+	if v, ok := uh.activeInactiveBackend.(activeinactive.Validator); ok {
+		return v.SetValidated()
+	}
+
+	return nil
+}
+
+// finishRollback marks the package "packageUID" bad, so it isn't
+// installed again, and reports the rollback
+func (uh *UpdateHub) finishRollback(packageUID string) error {
+	uh.markBadPackage(packageUID, "was rolled back after failing the validation")
+
+	err := uh.clearPendingValidation()
+	if err != nil {
+		return err
+	}
+
+	if uh.Reporter == nil {
+		return nil
+	}
+
+	return uh.Reporter.ReportState(uh.API.Request(), packageUID, rollbackReportState)
+}
+
+// saveRuntimeSettings persists the runtime settings at
+// "RuntimeSettingsPath"
+func (uh *UpdateHub) saveRuntimeSettings() error {
+	if uh.settings.ReadOnly || uh.RuntimeSettingsPath == "" {
+		return nil
+	}
+
+	file, err := uh.Store.Create(uh.RuntimeSettingsPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return SaveSettings(uh.settings, file)
+}
@@ -0,0 +1,307 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+)
+
+type recordingReporter struct {
+	reports []string
+}
+
+func (r *recordingReporter) ReportState(api client.ApiRequester, packageUID string, state string) error {
+	r.reports = append(r.reports, fmt.Sprintf("%s:%s", packageUID, state))
+	return nil
+}
+
+func newTestValidationUpdateHub(t *testing.T, aim *activeinactivemock.ActiveInactiveMock, clm *cmdlinemock.CmdLineExecuterMock) (*UpdateHub, *recordingReporter) {
+	uh, err := newTestUpdateHub(nil, aim)
+	assert.NoError(t, err)
+
+	reporter := &recordingReporter{}
+
+	uh.Reporter = reporter
+	uh.CmdLineExecuter = clm
+	uh.RuntimeSettingsPath = "/runtime.conf"
+	uh.settings.ValidationCallbacksDir = "/validate.d"
+	uh.settings.PersistentUpdateSettings = PersistentUpdateSettings{
+		PendingValidationPackageUID: "puid",
+		UpgradeToInstallation:       1,
+		BootAttempts:                0,
+	}
+
+	err = afero.WriteFile(uh.Store, "/validate.d/check", []byte(""), 0755)
+	assert.NoError(t, err)
+
+	return uh, reporter
+}
+
+func loadTestRuntimeSettings(t *testing.T, uh *UpdateHub) *Settings {
+	data, err := afero.ReadFile(uh.Store, uh.RuntimeSettingsPath)
+	assert.NoError(t, err)
+
+	s, err := LoadSettings(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	return s
+}
+
+func TestValidateUpdateWithoutPendingValidation(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	uh, reporter := newTestValidationUpdateHub(t, aim, clm)
+	uh.settings.PersistentUpdateSettings = PersistentUpdateSettings{}
+
+	err := uh.ValidateUpdate()
+	assert.NoError(t, err)
+	assert.Empty(t, reporter.reports)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestValidateUpdateWithSuccess(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	aim.On("Active").Return(1, nil)
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "'/validate.d/check' puid").Return([]byte(""), nil)
+
+	uh, reporter := newTestValidationUpdateHub(t, aim, clm)
+
+	err := uh.ValidateUpdate()
+	assert.NoError(t, err)
+	assert.Empty(t, reporter.reports)
+	assert.False(t, uh.isBadPackage("puid"))
+
+	assert.Equal(t, PersistentUpdateSettings{}, uh.settings.PersistentUpdateSettings)
+	assert.Equal(t, PersistentUpdateSettings{}, loadTestRuntimeSettings(t, uh).PersistentUpdateSettings)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestValidateUpdateWithHealthCheckFailure(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	aim.On("Active").Return(1, nil)
+	aim.On("SetActive", 0).Return(nil)
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "'/validate.d/check' puid").Return([]byte(""), fmt.Errorf("service not running"))
+
+	uh, reporter := newTestValidationUpdateHub(t, aim, clm)
+
+	err := uh.ValidateUpdate()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"puid:rollback"}, reporter.reports)
+
+	assert.Equal(t, PersistentUpdateSettings{}, loadTestRuntimeSettings(t, uh).PersistentUpdateSettings)
+
+	// it isn't installed again
+	assert.True(t, uh.isBadPackage("puid"))
+	assert.Equal(t, "was rolled back after failing the validation", uh.badPackageReason("puid"))
+	assert.Equal(t, []string{"puid"}, loadTestRuntimeSettings(t, uh).BadPackageUIDs)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestValidateUpdateWithHealthCheckFailureAndThreeInstallationSets(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	aim.On("Active").Return(0, nil)
+	aim.On("SetActive", 2).Return(nil)
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "'/validate.d/check' puid").Return([]byte(""), fmt.Errorf("service not running"))
+
+	uh, reporter := newTestValidationUpdateHub(t, aim, clm)
+	uh.settings.PersistentUpdateSettings = PersistentUpdateSettings{
+		PendingValidationPackageUID: "puid",
+		UpgradeToInstallation:       0,
+		PreviousInstallation:        2,
+		BootAttempts:                0,
+	}
+
+	err := uh.ValidateUpdate()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"puid:rollback"}, reporter.reports)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestValidateUpdateWithTooManyBootAttempts(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	aim.On("Active").Return(1, nil)
+	aim.On("SetActive", 0).Return(nil)
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	uh, reporter := newTestValidationUpdateHub(t, aim, clm)
+	uh.settings.MaxBootAttempts = 3
+	uh.settings.BootAttempts = 3
+
+	err := uh.ValidateUpdate()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"puid:rollback"}, reporter.reports)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestValidateUpdateCountsBootAttempts(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	aim.On("Active").Return(1, nil)
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	uh, _ := newTestValidationUpdateHub(t, aim, clm)
+	uh.settings.BootAttempts = 1
+
+	// the attempt must be persisted before running the health checks
+	// so a crash while running them still counts as a boot
+	clm.On("Execute", "'/validate.d/check' puid").Return([]byte(""), nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, 2, loadTestRuntimeSettings(t, uh).BootAttempts)
+	})
+
+	err := uh.ValidateUpdate()
+	assert.NoError(t, err)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestValidateUpdateWhenBootloaderFellBack(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	aim.On("Active").Return(0, nil)
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	uh, reporter := newTestValidationUpdateHub(t, aim, clm)
+
+	err := uh.ValidateUpdate()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"puid:rollback"}, reporter.reports)
+	assert.True(t, uh.isBadPackage("puid"))
+
+	assert.Equal(t, PersistentUpdateSettings{}, uh.settings.PersistentUpdateSettings)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestValidateUpdateSetsValidated(t *testing.T) {
+	testCases := []struct {
+		name            string
+		active          int
+		checkErr        error
+		expectedReports []string
+	}{
+		{"WithSuccess", 1, nil, nil},
+		{"WithHealthCheckFailure", 1, fmt.Errorf("service not running"), []string{"puid:rollback"}},
+		{"WhenBootloaderFellBack", 0, nil, []string{"puid:rollback"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			vaim := &activeinactivemock.ValidatorActiveInactiveMock{}
+			vaim.On("Active").Return(tc.active, nil)
+			vaim.On("SetValidated").Return(nil).Once()
+
+			clm := &cmdlinemock.CmdLineExecuterMock{}
+
+			if tc.active == 1 {
+				clm.On("Execute", "'/validate.d/check' puid").Return([]byte(""), tc.checkErr)
+			}
+
+			if tc.checkErr != nil {
+				vaim.On("SetActive", 0).Return(nil)
+			}
+
+			uh, reporter := newTestValidationUpdateHub(t, &vaim.ActiveInactiveMock, clm)
+			uh.activeInactiveBackend = vaim
+
+			err := uh.ValidateUpdate()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedReports, reporter.reports)
+			assert.Equal(t, PersistentUpdateSettings{}, uh.settings.PersistentUpdateSettings)
+
+			vaim.AssertExpectations(t)
+			clm.AssertExpectations(t)
+		})
+	}
+}
+
+func TestValidateUpdateWithSetValidatedError(t *testing.T) {
+	vaim := &activeinactivemock.ValidatorActiveInactiveMock{}
+	vaim.On("Active").Return(1, nil)
+	vaim.On("SetValidated").Return(fmt.Errorf("fw_setenv error"))
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "'/validate.d/check' puid").Return([]byte(""), nil)
+
+	uh, reporter := newTestValidationUpdateHub(t, &vaim.ActiveInactiveMock, clm)
+	uh.activeInactiveBackend = vaim
+
+	err := uh.ValidateUpdate()
+	assert.EqualError(t, err, "fw_setenv error")
+	assert.Empty(t, reporter.reports)
+
+	// it is validated again on the next start
+	assert.Equal(t, "puid", uh.settings.PendingValidationPackageUID)
+
+	vaim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestValidateUpdateWithActiveError(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	aim.On("Active").Return(0, fmt.Errorf("active error"))
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+
+	uh, reporter := newTestValidationUpdateHub(t, aim, clm)
+
+	err := uh.ValidateUpdate()
+	assert.EqualError(t, err, "active error")
+	assert.Empty(t, reporter.reports)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
+
+func TestValidateUpdateWithSetActiveError(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+	aim.On("Active").Return(1, nil)
+	aim.On("SetActive", 0).Return(fmt.Errorf("set active error"))
+
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "'/validate.d/check' puid").Return([]byte(""), fmt.Errorf("health check error"))
+
+	uh, reporter := newTestValidationUpdateHub(t, aim, clm)
+
+	err := uh.ValidateUpdate()
+	assert.EqualError(t, err, "set active error")
+	assert.Empty(t, reporter.reports)
+
+	aim.AssertExpectations(t)
+	clm.AssertExpectations(t)
+}
@@ -0,0 +1,90 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"time"
+)
+
+// wallClockStepThreshold is how much the wall clock has to be set,
+// between two readings, for the polling schedule to be moved along.
+// The smaller adjustments are left alone.
+const wallClockStepThreshold = time.Minute
+
+// wallClock follows the wall clock against the monotonic one, so the
+// polls scheduled in wall time survive the wall clock being set, like
+// when NTP fixes a wrong RTC some time after the boot
+type wallClock struct {
+	// anchor is the last reading of the clock, along with its
+	// monotonic part
+	anchor time.Time
+	// firstPoll and lastPoll tell whether the "FirstPoll" and the
+	// "LastPoll" settings were taken in this run, the ones loaded
+	// from the runtime settings belong to an unknown wall clock
+	firstPoll bool
+	lastPoll  bool
+}
+
+// wallClockStep returns how much the wall clock was set between the
+// "anchor" and "now" readings. It's 0 when any of them lacks the
+// monotonic part, like the times of a simulated clock.
+func wallClockStep(anchor time.Time, now time.Time) time.Duration {
+	return now.Round(0).Sub(anchor.Round(0)) - now.Sub(anchor)
+}
+
+// recalibratePolling moves the polling schedule taken in this run by
+// the amount the wall clock was set since the last call, so the next
+// poll stays as far away as it was instead of happening right away
+// or hours later
+func (uh *UpdateHub) recalibratePolling() {
+	now := uh.clock().Now()
+
+	anchor := uh.wallClock.anchor
+	uh.wallClock.anchor = now
+
+	if anchor.IsZero() {
+		return
+	}
+
+	step := wallClockStep(anchor, now)
+	if step > -wallClockStepThreshold && step < wallClockStepThreshold {
+		return
+	}
+
+	log.Info(fmt.Sprintf("the wall clock was set by %s, moving the polling schedule along", step))
+
+	if uh.shiftPollingSchedule(step) {
+		uh.persistedStateMutex.Lock()
+		defer uh.persistedStateMutex.Unlock()
+
+		err := uh.saveRuntimeSettings()
+		if err != nil {
+			log.Warn("failed to save the polling schedule: ", err)
+		}
+	}
+}
+
+// shiftPollingSchedule moves the polls taken in this run by "step"
+// and tells whether any of them was moved
+func (uh *UpdateHub) shiftPollingSchedule(step time.Duration) bool {
+	shifted := false
+
+	if uh.wallClock.firstPoll && !uh.settings.FirstPoll.IsZero() {
+		uh.settings.FirstPoll = uh.settings.FirstPoll.Add(step)
+		shifted = true
+	}
+
+	if uh.wallClock.lastPoll && !uh.settings.LastPoll.IsZero() {
+		uh.settings.LastPoll = uh.settings.LastPoll.Add(step)
+		shifted = true
+	}
+
+	return shifted
+}
@@ -0,0 +1,94 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWallClockStep(t *testing.T) {
+	anchor := time.Now()
+
+	assert.Equal(t, time.Duration(0), wallClockStep(anchor, anchor.Add(time.Hour)))
+
+	// the readings of a simulated clock lack the monotonic part
+	assert.Equal(t, time.Duration(0), wallClockStep(anchor.Round(0), anchor.Round(0).Add(time.Hour)))
+	assert.Equal(t, time.Duration(0), wallClockStep(anchor, anchor.Round(0).Add(time.Hour)))
+}
+
+func TestRecalibratePollingWithoutStep(t *testing.T) {
+	now := time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+	clock := &testClock{now: now}
+
+	uh, err := newTestUpdateHub(NewIdleState(), nil)
+	assert.NoError(t, err)
+
+	uh.Clock = clock
+	uh.settings.FirstPoll = now
+	uh.settings.LastPoll = now
+	uh.wallClock.firstPoll = true
+	uh.wallClock.lastPoll = true
+
+	uh.recalibratePolling()
+	assert.Equal(t, now, uh.wallClock.anchor)
+
+	clock.now = now.Add(10 * time.Hour)
+
+	uh.recalibratePolling()
+	assert.Equal(t, now.Add(10*time.Hour), uh.wallClock.anchor)
+	assert.Equal(t, now, uh.settings.FirstPoll)
+	assert.Equal(t, now, uh.settings.LastPoll)
+}
+
+func TestShiftPollingSchedule(t *testing.T) {
+	firstPoll := time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+	lastPoll := time.Date(2017, time.January, 2, 0, 0, 0, 0, time.UTC)
+	step := 7 * time.Hour
+
+	testCases := []struct {
+		Name              string
+		FirstPollTaken    bool
+		LastPollTaken     bool
+		ExpectedShifted   bool
+		ExpectedFirstPoll time.Time
+		ExpectedLastPoll  time.Time
+	}{
+		{"Loaded", false, false, false, firstPoll, lastPoll},
+		{"FirstPollTaken", true, false, true, firstPoll.Add(step), lastPoll},
+		{"LastPollTaken", false, true, true, firstPoll, lastPoll.Add(step)},
+		{"BothTaken", true, true, true, firstPoll.Add(step), lastPoll.Add(step)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			uh, err := newTestUpdateHub(NewIdleState(), nil)
+			assert.NoError(t, err)
+
+			uh.settings.FirstPoll = firstPoll
+			uh.settings.LastPoll = lastPoll
+			uh.wallClock.firstPoll = tc.FirstPollTaken
+			uh.wallClock.lastPoll = tc.LastPollTaken
+
+			assert.Equal(t, tc.ExpectedShifted, uh.shiftPollingSchedule(step))
+			assert.Equal(t, tc.ExpectedFirstPoll, uh.settings.FirstPoll)
+			assert.Equal(t, tc.ExpectedLastPoll, uh.settings.LastPoll)
+		})
+	}
+
+	uh, err := newTestUpdateHub(NewIdleState(), nil)
+	assert.NoError(t, err)
+
+	// a poll never done isn't scheduled by the shift
+	uh.wallClock.lastPoll = true
+	assert.False(t, uh.shiftPollingSchedule(step))
+	assert.True(t, uh.settings.LastPoll.IsZero())
+}
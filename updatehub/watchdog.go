@@ -0,0 +1,156 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sdNotify sends "state" to systemd through the socket at
+// "NOTIFY_SOCKET", it does nothing when the agent wasn't started by
+// systemd
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+
+	// abstract namespace socket
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often the watchdog keepalives must be
+// sent to systemd, which is half of "WATCHDOG_USEC". It is 0 when the
+// watchdog isn't enabled for the agent.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// heartbeat records when the agent last made progress and at which
+// state
+type heartbeat struct {
+	mutex   sync.Mutex
+	time    time.Time
+	state   UpdateHubState
+	waiting bool // see wait
+}
+
+// waitingStates wait for a request or a condition, which may take
+// indefinitely long, so they are never considered stalled
+var waitingStates = map[UpdateHubState]bool{
+	UpdateHubStateIdle:                    true,
+	UpdateHubStateWaitingForWindow:        true,
+	UpdateHubStateAwaitingInstallApproval: true,
+	UpdateHubStateAwaitingRebootApproval:  true,
+	UpdateHubStateWaitingForPower:         true,
+}
+
+// enter records that the agent entered "state"
+func (h *heartbeat) enter(state UpdateHubState) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.time = time.Now()
+	h.state = state
+	h.waiting = false
+}
+
+// wait records whether the agent waits for a request at the current
+// state (e.g. for a paused download to be resumed), it isn't
+// considered stalled meanwhile
+func (h *heartbeat) wait(waiting bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.time = time.Now()
+	h.waiting = waiting
+}
+
+// beat records that the agent made progress at the current state
+func (h *heartbeat) beat() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.time = time.Now()
+}
+
+// stalled tells whether the agent made no progress for "timeout". The
+// waiting states are never considered stalled.
+func (h *heartbeat) stalled(timeout time.Duration) (bool, UpdateHubState) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if timeout <= 0 || waitingStates[h.state] || h.waiting {
+		return false, h.state
+	}
+
+	return time.Since(h.time) > timeout, h.state
+}
+
+// startWatchdog sends the watchdog keepalives every "interval" while
+// the agent isn't stalled, so systemd restarts it otherwise. The
+// returned function stops them.
+func (d *Daemon) startWatchdog(interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan bool)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				d.keepAlive()
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+func (d *Daemon) keepAlive() {
+	stalled, state := d.uh.heartbeat.stalled(d.uh.settings.WatchdogStallTimeout)
+	if stalled {
+		log.Error(fmt.Sprintf("no progress at state '%s' for %s, the watchdog keepalive isn't sent", StateToString(state), d.uh.settings.WatchdogStallTimeout))
+		return
+	}
+
+	d.sdNotify("WATCHDOG=1")
+}
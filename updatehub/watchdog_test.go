@@ -0,0 +1,189 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSdNotify(t *testing.T) {
+	testPath, err := ioutil.TempDir("", "updatehub-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(testPath)
+
+	socketPath := path.Join(testPath, "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socketPath)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	err = sdNotify("READY=1")
+	assert.NoError(t, err)
+
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "READY=1", string(buf[:n]))
+}
+
+func TestSdNotifyWithoutSystemd(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+
+	assert.NoError(t, sdNotify("READY=1"))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	testCases := []struct {
+		name             string
+		usec             string
+		pid              string
+		expectedInterval time.Duration
+	}{
+		{"Disabled", "", "", 0},
+		{"Enabled", "30000000", "", 15 * time.Second},
+		{"EnabledForTheAgent", "30000000", strconv.Itoa(os.Getpid()), 15 * time.Second},
+		{"EnabledForAnotherProcess", "30000000", "1", 0},
+		{"Invalid", "a", "", 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			os.Setenv("WATCHDOG_USEC", tc.usec)
+			os.Setenv("WATCHDOG_PID", tc.pid)
+
+			assert.Equal(t, tc.expectedInterval, watchdogInterval())
+		})
+	}
+}
+
+func TestHeartbeatStalled(t *testing.T) {
+	h := &heartbeat{}
+
+	h.enter(UpdateHubStateDownloading)
+
+	stalled, state := h.stalled(time.Hour)
+	assert.False(t, stalled)
+	assert.Equal(t, UpdateHubState(UpdateHubStateDownloading), state)
+
+	h.time = time.Now().Add(-2 * time.Hour)
+
+	stalled, _ = h.stalled(time.Hour)
+	assert.True(t, stalled)
+
+	// the stall detection is disabled
+	stalled, _ = h.stalled(0)
+	assert.False(t, stalled)
+
+	h.beat()
+
+	stalled, _ = h.stalled(time.Hour)
+	assert.False(t, stalled)
+
+	// waiting at idle isn't a stall
+	h.enter(UpdateHubStateIdle)
+	h.time = time.Now().Add(-2 * time.Hour)
+
+	stalled, state = h.stalled(time.Hour)
+	assert.False(t, stalled)
+	assert.Equal(t, UpdateHubState(UpdateHubStateIdle), state)
+
+	// nor waiting for the window, an approval or the power
+	for _, s := range []UpdateHubState{UpdateHubStateWaitingForWindow, UpdateHubStateAwaitingInstallApproval, UpdateHubStateAwaitingRebootApproval, UpdateHubStateWaitingForPower} {
+		h.enter(s)
+		h.time = time.Now().Add(-2 * time.Hour)
+
+		stalled, _ = h.stalled(time.Hour)
+		assert.False(t, stalled)
+	}
+
+	// nor waiting for a paused download to be resumed
+	h.enter(UpdateHubStateDownloading)
+	h.wait(true)
+	h.time = time.Now().Add(-2 * time.Hour)
+
+	stalled, _ = h.stalled(time.Hour)
+	assert.False(t, stalled)
+
+	h.wait(false)
+	h.time = time.Now().Add(-2 * time.Hour)
+
+	stalled, _ = h.stalled(time.Hour)
+	assert.True(t, stalled)
+}
+
+func TestDigestWriterBeats(t *testing.T) {
+	h := &heartbeat{}
+	h.enter(UpdateHubStateDownloading)
+	h.time = time.Now().Add(-2 * time.Hour)
+
+	w := &digestWriter{Writer: ioutil.Discard, hash: sha256.New(), heartbeat: h}
+
+	_, err := w.Write([]byte("part of an object"))
+	assert.NoError(t, err)
+
+	stalled, _ := h.stalled(time.Hour)
+	assert.False(t, stalled)
+}
+
+func TestDaemonKeepAlive(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+	uh.settings.WatchdogStallTimeout = time.Hour
+
+	var notified []string
+
+	d := NewDaemon(uh)
+	d.notify = func(state string) error {
+		notified = append(notified, state)
+		return nil
+	}
+
+	uh.heartbeat.enter(UpdateHubStateInstalling)
+
+	d.keepAlive()
+	assert.Equal(t, []string{"WATCHDOG=1"}, notified)
+
+	// stalled
+	uh.heartbeat.time = time.Now().Add(-2 * time.Hour)
+
+	d.keepAlive()
+	assert.Equal(t, []string{"WATCHDOG=1"}, notified)
+}
+
+func TestDaemonRunNotifiesSystemd(t *testing.T) {
+	uh, _ := newTestUpdateHub(nil, nil)
+
+	var notified []string
+
+	d := NewDaemon(uh)
+	d.notify = func(state string) error {
+		notified = append(notified, state)
+		return nil
+	}
+
+	uh.State = NewStateTest(d)
+
+	d.Run()
+
+	assert.Equal(t, []string{"READY=1", "STATUS=" + StateToString(UpdateHubDummyState)}, notified)
+}
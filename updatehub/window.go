@@ -0,0 +1,163 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// MaintenanceWindow is the daily period, in local time, in which the
+// updates can be installed and the device rebooted
+type MaintenanceWindow struct {
+	start time.Duration
+	end   time.Duration
+	days  map[time.Weekday]bool
+}
+
+// ParseMaintenanceWindow parses a window in the "HH:MM-HH:MM" format.
+// A window ending before its start spans midnight. "days" restricts
+// the days of the week ("mon", "tue", ...) in which the window opens,
+// every day is allowed when it is empty. It returns nil, meaning
+// always open, when "window" is empty.
+func ParseMaintenanceWindow(window string, days []string) (*MaintenanceWindow, error) {
+	if window == "" {
+		return nil, nil
+	}
+
+	limits := strings.Split(window, "-")
+	if len(limits) != 2 {
+		return nil, fmt.Errorf("invalid maintenance window '%s'", window)
+	}
+
+	w := &MaintenanceWindow{days: map[time.Weekday]bool{}}
+
+	var err error
+
+	w.start, err = parseTimeOfDay(limits[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid maintenance window '%s': %s", window, err)
+	}
+
+	w.end, err = parseTimeOfDay(limits[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid maintenance window '%s': %s", window, err)
+	}
+
+	if w.start == w.end {
+		return nil, fmt.Errorf("invalid maintenance window '%s': it is empty", window)
+	}
+
+	for _, day := range days {
+		weekday, ok := weekdays[strings.ToLower(strings.TrimSpace(day))]
+		if !ok {
+			return nil, fmt.Errorf("invalid maintenance window day '%s'", day)
+		}
+
+		w.days[weekday] = true
+	}
+
+	return w, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// IsOpen tells whether "t" is inside the window
+func (w *MaintenanceWindow) IsOpen(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end && w.allowed(t.Weekday())
+	}
+
+	// the window spans midnight, so it belongs to the day it started
+	if offset >= w.start {
+		return w.allowed(t.Weekday())
+	}
+
+	return offset < w.end && w.allowed((t.Weekday()+6)%7)
+}
+
+// NextOpening returns when the window opens after "t", or "t" itself
+// if the window is already open
+func (w *MaintenanceWindow) NextOpening(t time.Time) time.Time {
+	if w.IsOpen(t) {
+		return t
+	}
+
+	for day := 0; day <= 7; day++ {
+		opening := time.Date(t.Year(), t.Month(), t.Day()+day, 0, 0, 0, 0, t.Location()).Add(w.start)
+
+		if opening.After(t) && w.allowed(opening.Weekday()) {
+			return opening
+		}
+	}
+
+	return t
+}
+
+func (w *MaintenanceWindow) allowed(day time.Weekday) bool {
+	return len(w.days) == 0 || w.days[day]
+}
+
+// maintenanceWindow returns the configured maintenance window, nil
+// means it is always open
+func (uh *UpdateHub) maintenanceWindow() (*MaintenanceWindow, error) {
+	return ParseMaintenanceWindow(uh.settings.MaintenanceWindow, uh.settings.MaintenanceWindowDays)
+}
+
+// requiresMaintenanceWindow tells whether "state" can only be handled
+// while the maintenance window is open
+func requiresMaintenanceWindow(state State) bool {
+	switch state.(type) {
+	case *InstallingState, *WaitingForRebootState, *RebootingState:
+		return true
+	}
+
+	return false
+}
+
+// waitForMaintenanceWindow returns a WaitingForWindowState holding
+// "state" if it requires the maintenance window and it is closed.
+// Otherwise "state" is returned as is.
+func (uh *UpdateHub) waitForMaintenanceWindow(state State) State {
+	if !requiresMaintenanceWindow(state) {
+		return state
+	}
+
+	window, err := uh.maintenanceWindow()
+	if err != nil || window.IsOpen(uh.clock().Now()) {
+		return state
+	}
+
+	return NewWaitingForWindowState(state.(ReportableState).UpdateMetadata(), state, window)
+}
@@ -0,0 +1,222 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/testsmocks/activeinactivemock"
+)
+
+// 2017-01-02 is a monday
+func testLocalTime(day int, hour int, min int) time.Time {
+	return time.Date(2017, time.January, day, hour, min, 0, 0, time.Local)
+}
+
+func TestParseMaintenanceWindowWithInvalidValues(t *testing.T) {
+	testCases := []struct {
+		name          string
+		window        string
+		days          []string
+		expectedError string
+	}{
+		{
+			"MissingEnd",
+			"02:00",
+			nil,
+			"invalid maintenance window '02:00'",
+		},
+		{
+			"InvalidTime",
+			"02:00-25:00",
+			nil,
+			"invalid maintenance window '02:00-25:00': parsing time \"25:00\": hour out of range",
+		},
+		{
+			"Empty",
+			"02:00-02:00",
+			nil,
+			"invalid maintenance window '02:00-02:00': it is empty",
+		},
+		{
+			"InvalidDay",
+			"02:00-05:00",
+			[]string{"mon", "someday"},
+			"invalid maintenance window day 'someday'",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w, err := ParseMaintenanceWindow(tc.window, tc.days)
+			assert.EqualError(t, err, tc.expectedError)
+			assert.Nil(t, w)
+		})
+	}
+}
+
+func TestMaintenanceWindowIsOpen(t *testing.T) {
+	testCases := []struct {
+		name     string
+		window   string
+		days     []string
+		time     time.Time
+		expected bool
+	}{
+		{"Inside", "02:00-05:00", nil, testLocalTime(2, 3, 0), true},
+		{"AtStart", "02:00-05:00", nil, testLocalTime(2, 2, 0), true},
+		{"AtEnd", "02:00-05:00", nil, testLocalTime(2, 5, 0), false},
+		{"Before", "02:00-05:00", nil, testLocalTime(2, 1, 59), false},
+		{"AllowedDay", "02:00-05:00", []string{"Mon"}, testLocalTime(2, 3, 0), true},
+		{"NotAllowedDay", "02:00-05:00", []string{"tue"}, testLocalTime(2, 3, 0), false},
+		{"SpanningMidnightBefore", "22:00-02:00", nil, testLocalTime(2, 23, 0), true},
+		{"SpanningMidnightAfter", "22:00-02:00", nil, testLocalTime(3, 1, 0), true},
+		{"SpanningMidnightOutside", "22:00-02:00", nil, testLocalTime(3, 12, 0), false},
+		{"SpanningMidnightFromAllowedDay", "22:00-02:00", []string{"mon"}, testLocalTime(3, 1, 0), true},
+		{"SpanningMidnightFromNotAllowedDay", "22:00-02:00", []string{"tue"}, testLocalTime(3, 1, 0), false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w, err := ParseMaintenanceWindow(tc.window, tc.days)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, w.IsOpen(tc.time))
+		})
+	}
+}
+
+func TestMaintenanceWindowNextOpening(t *testing.T) {
+	testCases := []struct {
+		name     string
+		window   string
+		days     []string
+		time     time.Time
+		expected time.Time
+	}{
+		{"AlreadyOpen", "02:00-05:00", nil, testLocalTime(2, 3, 0), testLocalTime(2, 3, 0)},
+		{"SameDay", "02:00-05:00", nil, testLocalTime(2, 1, 0), testLocalTime(2, 2, 0)},
+		{"NextDay", "02:00-05:00", nil, testLocalTime(2, 6, 0), testLocalTime(3, 2, 0)},
+		{"NextAllowedDay", "02:00-05:00", []string{"sat"}, testLocalTime(2, 6, 0), testLocalTime(7, 2, 0)},
+		{"NextWeek", "02:00-05:00", []string{"mon"}, testLocalTime(2, 6, 0), testLocalTime(9, 2, 0)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w, err := ParseMaintenanceWindow(tc.window, tc.days)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, w.NextOpening(tc.time))
+		})
+	}
+}
+
+func TestNilMaintenanceWindowIsAlwaysOpen(t *testing.T) {
+	w, err := ParseMaintenanceWindow("", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, w)
+
+	now := time.Now()
+
+	assert.True(t, w.IsOpen(now))
+	assert.Equal(t, now, w.NextOpening(now))
+}
+
+func TestWaitForMaintenanceWindow(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+
+	m := &metadata.UpdateMetadata{}
+
+	// a window which is closed right now
+	now := time.Now()
+	start := now.Add(time.Hour)
+	end := now.Add(2 * time.Hour)
+	uh.settings.MaintenanceWindow = start.Format("15:04") + "-" + end.Format("15:04")
+
+	installing := NewInstallingState(m, nil, nil, nil, nil)
+
+	state := uh.waitForMaintenanceWindow(installing)
+	assert.IsType(t, &WaitingForWindowState{}, state)
+	assert.Equal(t, installing, state.(*WaitingForWindowState).Next())
+	assert.Equal(t, m, state.(*WaitingForWindowState).UpdateMetadata())
+
+	rebooting := NewWaitingForRebootState(m)
+	assert.IsType(t, &WaitingForWindowState{}, uh.waitForMaintenanceWindow(rebooting))
+
+	downloading := NewDownloadingState(m)
+	assert.Equal(t, downloading, uh.waitForMaintenanceWindow(downloading))
+
+	uh.settings.MaintenanceWindow = ""
+	assert.Equal(t, installing, uh.waitForMaintenanceWindow(installing))
+
+	aim.AssertExpectations(t)
+}
+
+func TestStateWaitingForWindow(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+
+	m := &metadata.UpdateMetadata{}
+	installing := NewInstallingState(m, nil, nil, nil, nil)
+
+	// a nil window is always open
+	s := NewWaitingForWindowState(m, installing, nil)
+	assert.Equal(t, "waiting-for-window", StateToString(s.ID()))
+
+	next, _ := s.Handle(uh)
+	assert.Equal(t, installing, next)
+
+	aim.AssertExpectations(t)
+}
+
+func TestStateWaitingForWindowCancel(t *testing.T) {
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+
+	m := &metadata.UpdateMetadata{}
+
+	w, err := ParseMaintenanceWindow("02:00-03:00", []string{"mon"})
+	assert.NoError(t, err)
+
+	s := NewWaitingForWindowState(m, NewInstallingState(m, nil, nil, nil, nil), w)
+
+	go func() {
+		s.Cancel(true)
+	}()
+
+	next, _ := s.Handle(uh)
+	assert.IsType(t, &IdleState{}, next)
+
+	aim.AssertExpectations(t)
+}
+
+func TestPersistStateWhileWaitingForWindow(t *testing.T) {
+	mode := newTestInstallMode()
+	defer mode.Unregister()
+
+	aim := &activeinactivemock.ActiveInactiveMock{}
+
+	uh, _ := newTestUpdateHub(nil, aim)
+
+	m, err := metadata.NewUpdateMetadata([]byte(validJSONMetadata))
+	assert.NoError(t, err)
+
+	err = uh.persistState(NewWaitingForWindowState(m, NewInstallingState(m, nil, nil, nil, nil), nil))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "installing", uh.settings.PersistentStateSettings.State)
+
+	aim.AssertExpectations(t)
+}
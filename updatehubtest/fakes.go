@@ -0,0 +1,266 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehubtest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sync"
+	"time"
+
+	shellwords "github.com/mattn/go-shellwords"
+
+	"github.com/UpdateHub/updatehub/client"
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+// Clock is a fake updatehub.Clock. Its time changes only through
+// Advance and whenever the agent waits, when it jumps to the end of
+// the wait, so the simulation never sleeps.
+type Clock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// NewClock creates a Clock set to "now"
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the current time of the clock
+func (c *Clock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+// Advance moves the clock forward by "d"
+func (c *Clock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if d > 0 {
+		c.now = c.now.Add(d)
+	}
+}
+
+// After advances the clock by "d" and returns a channel which already
+// has the new time
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.Advance(d)
+
+	ch := make(chan time.Time, 1)
+	ch <- c.Now()
+
+	return ch
+}
+
+// Updater is a fake server. It has no update until one is published.
+type Updater struct {
+	mutex     sync.Mutex
+	raw       []byte
+	extraPoll time.Duration
+	objects   map[string][]byte
+
+	// Checks is how many times the agent checked for an update
+	Checks int
+	// Err, when set, fails the update checks and the downloads
+	Err error
+}
+
+// Publish makes the update checks return the update metadata "raw".
+// The objects are served by their sha256sum, which is how the agent
+// downloads them.
+func (u *Updater) Publish(raw string, objects ...[]byte) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.raw = []byte(raw)
+	u.objects = map[string][]byte{}
+
+	for _, o := range objects {
+		u.objects[utils.DataSha256sum(o)] = o
+	}
+}
+
+// Unpublish removes the published update
+func (u *Updater) Unpublish() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.raw = nil
+	u.objects = nil
+}
+
+// SetExtraPoll makes the update checks ask for an extra poll after "d"
+func (u *Updater) SetExtraPoll(d time.Duration) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.extraPoll = d
+}
+
+// CheckUpdate implementation of the client.Updater interface
+func (u *Updater) CheckUpdate(ctx context.Context, api client.ApiRequester, uri string, data interface{}) (interface{}, time.Duration, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.Checks++
+
+	if u.Err != nil {
+		return nil, 0, u.Err
+	}
+
+	if u.raw == nil {
+		return nil, u.extraPoll, nil
+	}
+
+	updateMetadata, err := metadata.NewUpdateMetadata(u.raw)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return updateMetadata, u.extraPoll, nil
+}
+
+// FetchUpdate implementation of the client.Updater interface
+func (u *Updater) FetchUpdate(ctx context.Context, api client.ApiRequester, uri string, offset int64) (io.ReadCloser, int64, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.Err != nil {
+		return nil, -1, u.Err
+	}
+
+	content, ok := u.objects[path.Base(uri)]
+	if !ok || offset > int64(len(content)) {
+		return nil, -1, fmt.Errorf("object '%s' not found", path.Base(uri))
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(content[offset:])), int64(len(content)) - offset, nil
+}
+
+// Report is a state reported to the server
+type Report struct {
+	PackageUID string
+	State      string
+}
+
+// Reporter is a fake server which records the reported states
+type Reporter struct {
+	Reports []Report
+}
+
+// ReportState implementation of the client.Reporter interface
+func (r *Reporter) ReportState(api client.ApiRequester, packageUID string, state string) error {
+	r.Reports = append(r.Reports, Report{PackageUID: packageUID, State: state})
+	return nil
+}
+
+// States returns the states reported for "packageUID"
+func (r *Reporter) States(packageUID string) []string {
+	states := []string{}
+
+	for _, report := range r.Reports {
+		if report.PackageUID == packageUID {
+			states = append(states, report.State)
+		}
+	}
+
+	return states
+}
+
+// ActiveInactive is a fake bootloader. The installation set activated
+// by the agent is booted only by Harness.Reboot.
+type ActiveInactive struct {
+	// Booted is the installation set running
+	Booted int
+	// Next is the installation set booted by the next reboot
+	Next int
+	// Sets is the number of installation sets, 2 when not set
+	Sets int
+}
+
+// Active implementation of the activeinactive.Interface
+func (a *ActiveInactive) Active() (int, error) {
+	return a.Booted, nil
+}
+
+// SetActive implementation of the activeinactive.Interface
+func (a *ActiveInactive) SetActive(active int) error {
+	a.Next = active
+	return nil
+}
+
+// Slots implementation of the activeinactive.Interface
+func (a *ActiveInactive) Slots() (int, error) {
+	if a.Sets == 0 {
+		return 2, nil
+	}
+
+	return a.Sets, nil
+}
+
+func (a *ActiveInactive) boot() {
+	a.Booted = a.Next
+}
+
+// CommandFunc runs a fake command, "args" doesn't include the program
+type CommandFunc func(args []string) ([]byte, error)
+
+// CmdLine is a fake utils.CmdLineExecuter. The programs without a
+// CommandFunc succeed with no output.
+type CmdLine struct {
+	handlers map[string]CommandFunc
+
+	// Executed has the command lines executed, in order
+	Executed []string
+}
+
+// Handle makes "fn" run whenever "program" is executed
+func (c *CmdLine) Handle(program string, fn CommandFunc) {
+	if c.handlers == nil {
+		c.handlers = map[string]CommandFunc{}
+	}
+
+	c.handlers[program] = fn
+}
+
+// Execute implementation of the utils.CmdLineExecuter interface
+func (c *CmdLine) Execute(cmdline string) ([]byte, error) {
+	return c.ExecuteWithStdin(cmdline, nil)
+}
+
+// ExecuteWithStdin implementation of the utils.CmdLineExecuter
+// interface, "stdin" is discarded
+func (c *CmdLine) ExecuteWithStdin(cmdline string, stdin io.Reader) ([]byte, error) {
+	c.Executed = append(c.Executed, cmdline)
+
+	list, err := shellwords.NewParser().Parse(cmdline)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(list) == 0 {
+		return nil, fmt.Errorf("empty command line")
+	}
+
+	fn, ok := c.handlers[list[0]]
+	if !ok {
+		return []byte{}, nil
+	}
+
+	return fn(list[1:])
+}
@@ -0,0 +1,153 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+// Package updatehubtest runs the agent state machine in memory, so the
+// hooks and the settings of a product can be tested without a device
+// nor a server. The file system is an afero.MemMapFs and the server,
+// the bootloader, the commands and the clock are all fakes controlled
+// by the test.
+package updatehubtest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/updatehub"
+)
+
+const (
+	// SystemSettingsPath is where the settings given to New are written
+	SystemSettingsPath = "/etc/updatehub.conf"
+	// RuntimeSettingsPath is where the agent keeps its runtime settings
+	RuntimeSettingsPath = "/var/lib/updatehub.conf"
+)
+
+// Harness is an agent running in memory
+type Harness struct {
+	Store            afero.Fs
+	FirmwareMetadata metadata.FirmwareMetadata
+	Clock            *Clock
+	Updater          *Updater
+	Reporter         *Reporter
+	ActiveInactive   *ActiveInactive
+	CmdLine          *CmdLine
+
+	// Installed has the objects installed through the install modes
+	// registered by RegisterInstallMode, in the installation order
+	Installed []Installation
+
+	// UpdateHub is the agent, replaced by each Start
+	UpdateHub *updatehub.UpdateHub
+
+	daemon *updatehub.Daemon
+}
+
+// New creates a harness whose agent is started with "settings", which
+// has the same format of the "/etc/updatehub.conf" file, and the
+// firmware metadata "fm"
+func New(settings string, fm metadata.FirmwareMetadata) (*Harness, error) {
+	h := &Harness{
+		Store:            afero.NewMemMapFs(),
+		FirmwareMetadata: fm,
+		Clock:            NewClock(time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)),
+		Updater:          &Updater{},
+		Reporter:         &Reporter{},
+		ActiveInactive:   &ActiveInactive{},
+		CmdLine:          &CmdLine{},
+	}
+
+	err := afero.WriteFile(h.Store, SystemSettingsPath, []byte(settings), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return h, h.Start()
+}
+
+// Start starts the agent as it's done when the device boots: the
+// settings are loaded, a pending update is validated and the state
+// the agent was at is resumed. The store, the fakes and what was
+// installed are kept.
+func (h *Harness) Start() error {
+	uh := updatehub.New(
+		updatehub.WithFileSystem(h.Store),
+		updatehub.WithClock(h.Clock),
+		updatehub.WithUpdater(h.Updater),
+		updatehub.WithReporter(h.Reporter),
+		updatehub.WithCmdLineExecuter(h.CmdLine),
+		updatehub.WithActiveInactiveBackend(h.ActiveInactive),
+		updatehub.WithFirmwareMetadata(h.FirmwareMetadata, nil),
+		updatehub.WithSettingsPaths(SystemSettingsPath, RuntimeSettingsPath),
+	)
+
+	err := uh.LoadSettings()
+	if err != nil {
+		return err
+	}
+
+	err = uh.ValidateUpdate()
+	if err != nil {
+		return err
+	}
+
+	uh.StartPolling()
+
+	if state := uh.RestoreState(); state != nil {
+		uh.State = state
+	}
+
+	h.UpdateHub = uh
+	h.daemon = updatehub.NewDaemon(uh)
+
+	return nil
+}
+
+// Reboot boots the installation set activated by the agent and starts
+// the agent again
+func (h *Harness) Reboot() error {
+	h.ActiveInactive.boot()
+
+	return h.Start()
+}
+
+// Step handles the current state of the agent, as the daemon does, and
+// returns the next one. The waits for the clock return right away, but
+// the idle state blocks until an update probe when the polling is
+// disabled.
+func (h *Harness) Step() updatehub.State {
+	return h.daemon.Step()
+}
+
+// RunUntil steps until the agent goes to the state "id", giving up
+// after "maxSteps"
+func (h *Harness) RunUntil(id updatehub.UpdateHubState, maxSteps int) error {
+	for i := 0; i < maxSteps; i++ {
+		if h.Step().ID() == id {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("state '%s' not reached in %d steps, the agent is at '%s'",
+		updatehub.StateToString(id), maxSteps, updatehub.StateToString(h.UpdateHub.State.ID()))
+}
+
+// AddHook creates an executable at "path", to be found by the agent
+// in its callback directories, which runs "fn" when executed
+func (h *Harness) AddHook(path string, fn CommandFunc) error {
+	err := afero.WriteFile(h.Store, path, []byte{}, 0755)
+	if err != nil {
+		return err
+	}
+
+	h.CmdLine.Handle(path, fn)
+
+	return nil
+}
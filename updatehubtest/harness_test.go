@@ -0,0 +1,140 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehubtest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/metadata"
+	"github.com/UpdateHub/updatehub/updatehub"
+	"github.com/UpdateHub/updatehub/utils"
+)
+
+var testFirmwareMetadata = metadata.FirmwareMetadata{
+	ProductUID:     "229ffd7e08721d716163fc81a2dbaf6c90d449f0a3b009b6a2defe8a0b0d7381",
+	DeviceIdentity: map[string]string{"id1": "value1"},
+	Version:        "1.0",
+}
+
+func updateMetadataWithActiveInactive(objects ...[]byte) string {
+	return fmt.Sprintf(`{
+  "product-uid": "229ffd7e08721d716163fc81a2dbaf6c90d449f0a3b009b6a2defe8a0b0d7381",
+  "version": "2.0",
+  "supported-hardware": [],
+  "objects": [
+    [ { "mode": "harness", "target": "/dev/xxa1", "sha256sum": "%s" } ],
+    [ { "mode": "harness", "target": "/dev/xxb1", "sha256sum": "%s" } ]
+  ]
+}`, utils.DataSha256sum(objects[0]), utils.DataSha256sum(objects[1]))
+}
+
+func TestHarnessInstallsAndValidatesAnUpdate(t *testing.T) {
+	h, err := New("[Polling]\nInterval=1h\n", testFirmwareMetadata)
+	assert.NoError(t, err)
+
+	mode := h.RegisterInstallMode("harness")
+	defer mode.Unregister()
+
+	objects := [][]byte{[]byte("image a"), []byte("image b")}
+	raw := updateMetadataWithActiveInactive(objects...)
+
+	h.Updater.Publish(raw, objects...)
+
+	validated := false
+	err = h.AddHook("/usr/share/updatehub/validate-callbacks.d/check", func(args []string) ([]byte, error) {
+		validated = true
+		return nil, nil
+	})
+	assert.NoError(t, err)
+
+	start := h.Clock.Now()
+
+	err = h.RunUntil(updatehub.UpdateHubStateRebooting, 20)
+	assert.NoError(t, err)
+
+	// polling waits up to an interval for the first check
+	assert.Equal(t, 1, h.Updater.Checks)
+	assert.True(t, h.Clock.Now().Sub(start) <= time.Hour)
+
+	// the inactive installation set is installed and activated
+	assert.Equal(t, []Installation{{
+		Mode:      "harness",
+		Target:    "/dev/xxb1",
+		Sha256sum: utils.DataSha256sum(objects[1]),
+		Content:   objects[1],
+	}}, h.Installed)
+	assert.Equal(t, 0, h.ActiveInactive.Booted)
+	assert.Equal(t, 1, h.ActiveInactive.Next)
+
+	h.Step()
+	assert.Contains(t, h.CmdLine.Executed, "systemctl reboot")
+
+	err = h.Reboot()
+	assert.NoError(t, err)
+	assert.True(t, validated)
+
+	m, err := metadata.NewUpdateMetadata([]byte(raw))
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"downloading", "installing", "installed", "waiting-for-reboot", "rebooting"},
+		h.Reporter.States(m.PackageUID()))
+}
+
+func TestHarnessRollsBackWhenTheHealthCheckFails(t *testing.T) {
+	h, err := New("", testFirmwareMetadata)
+	assert.NoError(t, err)
+
+	mode := h.RegisterInstallMode("harness")
+	defer mode.Unregister()
+
+	objects := [][]byte{[]byte("image a"), []byte("image b")}
+	h.Updater.Publish(updateMetadataWithActiveInactive(objects...), objects...)
+
+	err = h.AddHook("/usr/share/updatehub/validate-callbacks.d/check", func(args []string) ([]byte, error) {
+		return nil, fmt.Errorf("unhealthy")
+	})
+	assert.NoError(t, err)
+
+	err = h.RunUntil(updatehub.UpdateHubStateRebooting, 20)
+	assert.NoError(t, err)
+
+	err = h.Reboot()
+	assert.NoError(t, err)
+
+	// the previous installation set boots next
+	assert.Equal(t, 1, h.ActiveInactive.Booted)
+	assert.Equal(t, 0, h.ActiveInactive.Next)
+}
+
+func TestHarnessRunUntilGivesUp(t *testing.T) {
+	h, err := New("", testFirmwareMetadata)
+	assert.NoError(t, err)
+
+	// there is no update, so it keeps polling
+	err = h.RunUntil(updatehub.UpdateHubStateInstalling, 5)
+	assert.Error(t, err)
+	assert.True(t, h.Updater.Checks > 0)
+}
+
+func TestClock(t *testing.T) {
+	now := time.Now()
+
+	c := NewClock(now)
+	assert.Equal(t, now, c.Now())
+
+	c.Advance(time.Minute)
+	assert.Equal(t, now.Add(time.Minute), c.Now())
+
+	// waits return right away
+	assert.Equal(t, now.Add(time.Hour+time.Minute), <-c.After(time.Hour))
+}
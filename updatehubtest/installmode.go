@@ -0,0 +1,75 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package updatehubtest
+
+import (
+	"path"
+
+	"github.com/spf13/afero"
+
+	"github.com/UpdateHub/updatehub/installmodes"
+	"github.com/UpdateHub/updatehub/metadata"
+)
+
+// Installation is an object installed by the agent
+type Installation struct {
+	Mode      string
+	Target    string
+	Sha256sum string
+	Content   []byte
+}
+
+// Object is the object of the install modes registered by
+// RegisterInstallMode
+type Object struct {
+	metadata.ObjectMetadata
+
+	Target string `json:"target"`
+
+	h *Harness
+}
+
+// Setup implementation of the handlers.InstallUpdateHandler interface
+func (o *Object) Setup() error {
+	return nil
+}
+
+// Install records the downloaded object at Harness.Installed
+func (o *Object) Install(downloadDir string) error {
+	content, err := afero.ReadFile(o.h.Store, path.Join(downloadDir, o.Sha256sum))
+	if err != nil {
+		return err
+	}
+
+	o.h.Installed = append(o.h.Installed, Installation{
+		Mode:      o.Mode,
+		Target:    o.Target,
+		Sha256sum: o.Sha256sum,
+		Content:   content,
+	})
+
+	return nil
+}
+
+// Cleanup implementation of the handlers.InstallUpdateHandler interface
+func (o *Object) Cleanup() error {
+	return nil
+}
+
+// RegisterInstallMode registers the install mode "name", which installs
+// the objects into Harness.Installed. It replaces an install mode of
+// the same name, so the returned one must be unregistered at the end
+// of the test.
+func (h *Harness) RegisterInstallMode(name string) installmodes.InstallMode {
+	return installmodes.RegisterInstallMode(installmodes.InstallMode{
+		Name:              name,
+		CheckRequirements: func() error { return nil },
+		GetObject:         func() interface{} { return &Object{h: h} },
+	})
+}
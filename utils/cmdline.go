@@ -10,6 +10,7 @@ package utils
 
 import (
 	"fmt"
+	"io"
 	"os/exec"
 
 	shellwords "github.com/mattn/go-shellwords"
@@ -17,12 +18,30 @@ import (
 
 type CmdLineExecuter interface {
 	Execute(cmdline string) ([]byte, error)
+	ExecuteWithStdin(cmdline string, stdin io.Reader) ([]byte, error)
 }
 
 type CmdLine struct {
 }
 
+// CommandError is the error of a command which didn't succeed, along
+// with its combined output
+type CommandError struct {
+	Cmdline string
+	Output  []byte
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("Error executing command '%s': %s", e.Cmdline, string(e.Output))
+}
+
 func (cl *CmdLine) Execute(cmdline string) ([]byte, error) {
+	return cl.ExecuteWithStdin(cmdline, nil)
+}
+
+// ExecuteWithStdin runs "cmdline" feeding "stdin" to the process
+// standard input
+func (cl *CmdLine) ExecuteWithStdin(cmdline string, stdin io.Reader) ([]byte, error) {
 	p := shellwords.NewParser()
 	list, err := p.Parse(cmdline)
 	if err != nil {
@@ -30,11 +49,12 @@ func (cl *CmdLine) Execute(cmdline string) ([]byte, error) {
 	}
 
 	cmd := exec.Command(list[0], list[1:]...)
+	cmd.Stdin = stdin
 	ret, err := cmd.CombinedOutput()
 
 	if exitErr, ok := err.(*exec.ExitError); ok {
 		if !exitErr.Success() {
-			return ret, fmt.Errorf("Error executing command '%s': %s", cmdline, string(ret))
+			return ret, &CommandError{Cmdline: cmdline, Output: ret}
 		}
 	}
 
@@ -9,6 +9,7 @@
 package utils
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -125,6 +126,14 @@ exit 0
 	assert.Equal(t, []byte("stdout string -c arg.gz\n"), data)
 }
 
+func TestCmdLineExecuteWithStdin(t *testing.T) {
+	c := &CmdLine{}
+	output, err := c.ExecuteWithStdin("cat -", bytes.NewReader([]byte("stdin content")))
+
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("stdin content"), output)
+}
+
 func TestCmdLineExecuteWithBinaryNotFound(t *testing.T) {
 	testPath, err := ioutil.TempDir("", "CmdLineExecute-test")
 	assert.Nil(t, err)
@@ -219,6 +228,10 @@ exit 1
 
 			assert.EqualError(t, err, fmt.Sprintf("Error executing command '%s': %s", cmdString, tc.ExpectedOutput))
 			assert.Equal(t, tc.ExpectedOutput, output)
+
+			ce, ok := err.(*CommandError)
+			assert.True(t, ok)
+			assert.Equal(t, tc.ExpectedOutput, ce.Output)
 		})
 	}
 }
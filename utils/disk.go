@@ -0,0 +1,38 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// FreeSpace returns the number of bytes available to unprivileged
+// users at the filesystem holding "path". When "path" doesn't exist
+// yet, its nearest existing parent is used.
+func FreeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+
+	for {
+		err := syscall.Statfs(path, &stat)
+		if err == nil {
+			break
+		}
+
+		parent := filepath.Dir(path)
+		if !os.IsNotExist(err) || parent == path {
+			return 0, err
+		}
+
+		path = parent
+	}
+
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
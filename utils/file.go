@@ -13,6 +13,8 @@ import (
 	"os"
 	"os/user"
 	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/spf13/afero"
 )
@@ -20,6 +22,7 @@ import (
 type Permissions interface {
 	ApplyChmod(fsb afero.Fs, filepath string, modestr string) error
 	ApplyChown(filepath string, uid interface{}, gid interface{}) error
+	CopyAttributes(fsb afero.Fs, source string, target string, mode bool, owner bool) error
 }
 
 type PermissionsDefaultImpl struct {
@@ -129,3 +132,80 @@ func (pdi *PermissionsDefaultImpl) ApplyChown(filepath string, uid interface{},
 
 	return nil
 }
+
+// CopyAttributes copies the extended attributes of "source" onto
+// "target" and, when asked to, its mode and its owner. Nothing is
+// copied when there is no "source".
+func (pdi *PermissionsDefaultImpl) CopyAttributes(fsb afero.Fs, source string, target string, mode bool, owner bool) error {
+	fi, err := fsb.Stat(source)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// the owner is changed first since it clears the setuid and setgid
+	// bits
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && owner {
+		err = os.Chown(target, int(st.Uid), int(st.Gid))
+		if err != nil {
+			return err
+		}
+	}
+
+	if mode {
+		err = fsb.Chmod(target, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+		if err != nil {
+			return err
+		}
+	}
+
+	// the extended attributes, like the SELinux label, are only found
+	// on the OS filesystem
+	if _, ok := fsb.(*afero.OsFs); ok {
+		return copyXattrs(source, target)
+	}
+
+	return nil
+}
+
+func copyXattrs(source string, target string) error {
+	size, err := syscall.Listxattr(source, nil)
+	if err == syscall.ENOTSUP {
+		return nil
+	}
+
+	if err != nil || size == 0 {
+		return err
+	}
+
+	names := make([]byte, size)
+
+	size, err = syscall.Listxattr(source, names)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range strings.Split(strings.TrimRight(string(names[:size]), "\x00"), "\x00") {
+		size, err = syscall.Getxattr(source, name, nil)
+		if err != nil {
+			return err
+		}
+
+		value := make([]byte, size)
+
+		size, err = syscall.Getxattr(source, name, value)
+		if err != nil {
+			return err
+		}
+
+		err = syscall.Setxattr(target, name, value[:size], 0)
+		if err != nil {
+			return fmt.Errorf("failed to copy the extended attribute '%s': %s", name, err)
+		}
+	}
+
+	return nil
+}
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"syscall"
 	"testing"
 
 	"github.com/UpdateHub/updatehub/testsmocks/filesystemmock"
@@ -145,3 +146,55 @@ func TestApplyChmodWithLstatError(t *testing.T) {
 	fileExists, err := afero.Exists(fsb, filePath)
 	assert.False(t, fileExists)
 }
+
+func TestCopyAttributes(t *testing.T) {
+	fsb := afero.NewOsFs()
+
+	pdi := &PermissionsDefaultImpl{}
+
+	tempDirPath, err := afero.TempDir(fsb, "", "attributes-test")
+	assert.NoError(t, err)
+	defer fsb.RemoveAll(tempDirPath)
+
+	source := path.Join(tempDirPath, "source")
+	target := path.Join(tempDirPath, "target")
+
+	err = afero.WriteFile(fsb, source, []byte("previous"), 0640)
+	assert.NoError(t, err)
+
+	err = afero.WriteFile(fsb, target, []byte("content"), 0644)
+	assert.NoError(t, err)
+
+	xattrs := syscall.Setxattr(source, "user.updatehub", []byte("value"), 0) == nil
+
+	err = pdi.CopyAttributes(fsb, source, target, true, true)
+	assert.NoError(t, err)
+
+	fi, err := fsb.Stat(target)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), fi.Mode())
+
+	// only where the filesystem supports them
+	if xattrs {
+		value := make([]byte, 16)
+
+		size, err := syscall.Getxattr(target, "user.updatehub", value)
+		assert.NoError(t, err)
+		assert.Equal(t, "value", string(value[:size]))
+	}
+
+	// the mode isn't copied when it's set
+	err = fsb.Chmod(target, 0644)
+	assert.NoError(t, err)
+
+	err = pdi.CopyAttributes(fsb, source, target, false, true)
+	assert.NoError(t, err)
+
+	fi, err = fsb.Stat(target)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), fi.Mode())
+
+	// a new target has nothing to keep
+	err = pdi.CopyAttributes(fsb, path.Join(tempDirPath, "missing"), target, true, true)
+	assert.NoError(t, err)
+}
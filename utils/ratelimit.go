@@ -0,0 +1,80 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package utils
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter caps the throughput shared by all the readers wrapped by
+// it to "rate" bytes per second
+type RateLimiter struct {
+	rate  int64
+	next  time.Time
+	mutex sync.Mutex
+}
+
+// NewRateLimiter creates a RateLimiter that allows "rate" bytes per
+// second. A rate lower or equal to 0 means no limit, in that case nil
+// is returned.
+func NewRateLimiter(rate int64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &RateLimiter{rate: rate}
+}
+
+// Reader wraps "rd" so reading from it is throttled by the rate
+// limiter. A nil RateLimiter returns "rd" as is.
+func (rl *RateLimiter) Reader(rd io.ReadCloser) io.ReadCloser {
+	if rl == nil {
+		return rd
+	}
+
+	return &rateLimitedReader{ReadCloser: rd, limiter: rl}
+}
+
+// reserve accounts "n" bytes just read and returns how long the
+// reader must wait before handing them over
+func (rl *RateLimiter) reserve(n int) time.Duration {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+
+	rl.next = rl.next.Add(time.Duration(n) * time.Second / time.Duration(rl.rate))
+
+	return rl.next.Sub(now)
+}
+
+type rateLimitedReader struct {
+	io.ReadCloser
+	limiter *RateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	// never read more than a second worth of data at once to avoid
+	// bursts
+	if int64(len(p)) > r.limiter.rate {
+		p = p[:r.limiter.rate]
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		time.Sleep(r.limiter.reserve(n))
+	}
+
+	return n, err
+}
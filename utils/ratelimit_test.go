@@ -0,0 +1,63 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRateLimiterWithoutLimit(t *testing.T) {
+	assert.Nil(t, NewRateLimiter(0))
+	assert.Nil(t, NewRateLimiter(-1))
+
+	rd := ioutil.NopCloser(bytes.NewReader([]byte("content")))
+
+	var rl *RateLimiter
+	assert.Equal(t, rd, rl.Reader(rd))
+}
+
+func TestRateLimiterReader(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 3000)
+
+	rl := NewRateLimiter(10000)
+	rd := rl.Reader(ioutil.NopCloser(bytes.NewReader(content)))
+
+	start := time.Now()
+
+	data, err := ioutil.ReadAll(rd)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	// 3000 bytes at 10000 bytes/s must take at least 300ms
+	assert.True(t, time.Since(start) >= 300*time.Millisecond)
+	assert.NoError(t, rd.Close())
+}
+
+func TestRateLimiterSharedBetweenReaders(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 1000)
+
+	rl := NewRateLimiter(10000)
+	rd1 := rl.Reader(ioutil.NopCloser(bytes.NewReader(content)))
+	rd2 := rl.Reader(ioutil.NopCloser(bytes.NewReader(content)))
+
+	start := time.Now()
+
+	_, err := ioutil.ReadAll(rd1)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(rd2)
+	assert.NoError(t, err)
+
+	// both readers share the same budget
+	assert.True(t, time.Since(start) >= 200*time.Millisecond)
+}
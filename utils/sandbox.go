@@ -0,0 +1,121 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package utils
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SandboxProfile constrains the commands run inside a Sandbox. A zero
+// limit means no limit.
+type SandboxProfile struct {
+	AllowNetwork   bool     `ini:"AllowNetwork"`
+	Capabilities   []string `ini:"Capabilities"`  // kept, e.g. "CAP_SYS_RAWIO"
+	WritablePaths  []string `ini:"WritablePaths"` // besides the ones of the Sandbox
+	MemoryLimit    int64    `ini:"MemoryLimit"`   // of the address space, in bytes
+	CPUTimeLimit   int      `ini:"CPUTimeLimit"`  // in seconds
+	MaxProcesses   int      `ini:"MaxProcesses"`
+	MaxOpenFiles   int      `ini:"MaxOpenFiles"`
+	SeccompProfile string   `ini:"SeccompProfile"` // applied by the "SeccompHelper"
+}
+
+// Sandbox is a CmdLineExecuter which runs the commands in their own
+// mount, PID, IPC and UTS namespaces, and in a network namespace
+// without interfaces unless the profile allows the network. The
+// commands see the root filesystem read-only and a "/dev" holding only
+// the basic devices, only the "Writable" paths and the "WritablePaths"
+// of the profile are writable, the devices among them being the only
+// other reachable ones. They run with no new privileges and without
+// the capabilities not kept by the profile, so they can't remount the
+// filesystem, load kernel modules and so on, with the resource limits
+// of the profile. The namespaces and the mounts are set by
+// "bwrap" (bubblewrap) and the limits by "prlimit" of util-linux. The
+// seccomp profile, if any, is applied by the "SeccompHelper", run as:
+//
+//	<helper> <profile> <command line>
+//
+// which must exec the command line once the profile is loaded.
+type Sandbox struct {
+	CmdLineExecuter
+
+	Profile       SandboxProfile
+	SeccompHelper string
+	Writable      []string // e.g. the target of the object being installed
+}
+
+// Execute runs "cmdline" inside the sandbox
+func (s *Sandbox) Execute(cmdline string) ([]byte, error) {
+	return s.CmdLineExecuter.Execute(s.Wrap(cmdline))
+}
+
+// ExecuteWithStdin runs "cmdline" inside the sandbox feeding "stdin" to
+// the process standard input
+func (s *Sandbox) ExecuteWithStdin(cmdline string, stdin io.Reader) ([]byte, error) {
+	return s.CmdLineExecuter.ExecuteWithStdin(s.Wrap(cmdline), stdin)
+}
+
+// Wrap returns the command line which runs "cmdline" inside the
+// sandbox
+func (s *Sandbox) Wrap(cmdline string) string {
+	args := []string{"bwrap", "--ro-bind", "/", "/", "--dev", "/dev", "--proc", "/proc"}
+
+	for _, p := range append(append([]string{}, s.Writable...), s.Profile.WritablePaths...) {
+		option := "--bind"
+		if strings.HasPrefix(p, "/dev/") {
+			option = "--dev-bind"
+		}
+
+		args = append(args, option, fmt.Sprintf("'%s'", p), fmt.Sprintf("'%s'", p))
+	}
+
+	args = append(args, "--unshare-pid", "--unshare-ipc", "--unshare-uts")
+
+	if !s.Profile.AllowNetwork {
+		args = append(args, "--unshare-net")
+	}
+
+	args = append(args, "--cap-drop", "ALL")
+
+	for _, c := range s.Profile.Capabilities {
+		args = append(args, "--cap-add", c)
+	}
+
+	// the command is killed along with bwrap and can't inject input
+	// into the terminal of the agent
+	args = append(args, "--die-with-parent", "--new-session", "--")
+
+	limits := []struct {
+		option string
+		value  int64
+	}{
+		{"--as", s.Profile.MemoryLimit},
+		{"--cpu", int64(s.Profile.CPUTimeLimit)},
+		{"--nproc", int64(s.Profile.MaxProcesses)},
+		{"--nofile", int64(s.Profile.MaxOpenFiles)},
+	}
+
+	prlimit := []string{"prlimit"}
+	for _, l := range limits {
+		if l.value > 0 {
+			prlimit = append(prlimit, fmt.Sprintf("%s=%d", l.option, l.value))
+		}
+	}
+
+	if len(prlimit) > 1 {
+		args = append(append(args, prlimit...), "--")
+	}
+
+	if s.Profile.SeccompProfile != "" {
+		args = append(args, fmt.Sprintf("'%s'", s.SeccompHelper), fmt.Sprintf("'%s'", s.Profile.SeccompProfile))
+	}
+
+	return strings.Join(append(args, cmdline), " ")
+}
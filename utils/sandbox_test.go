@@ -0,0 +1,103 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package utils
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/UpdateHub/updatehub/testsmocks/cmdlinemock"
+)
+
+func TestSandboxWrap(t *testing.T) {
+	testCases := []struct {
+		name            string
+		profile         SandboxProfile
+		writable        []string
+		expectedCmdline string
+	}{
+		{
+			"WithDefaultProfile",
+			SandboxProfile{},
+			nil,
+			"bwrap --ro-bind / / --dev /dev --proc /proc --unshare-pid --unshare-ipc --unshare-uts --unshare-net --cap-drop ALL --die-with-parent --new-session -- kobs-ng init '/tmp/file'",
+		},
+
+		{
+			"WithNetwork",
+			SandboxProfile{AllowNetwork: true},
+			nil,
+			"bwrap --ro-bind / / --dev /dev --proc /proc --unshare-pid --unshare-ipc --unshare-uts --cap-drop ALL --die-with-parent --new-session -- kobs-ng init '/tmp/file'",
+		},
+
+		{
+			"WithLimits",
+			SandboxProfile{MemoryLimit: 67108864, CPUTimeLimit: 60, MaxProcesses: 8, MaxOpenFiles: 64},
+			nil,
+			"bwrap --ro-bind / / --dev /dev --proc /proc --unshare-pid --unshare-ipc --unshare-uts --unshare-net --cap-drop ALL --die-with-parent --new-session -- prlimit --as=67108864 --cpu=60 --nproc=8 --nofile=64 -- kobs-ng init '/tmp/file'",
+		},
+
+		{
+			"WithSomeLimits",
+			SandboxProfile{CPUTimeLimit: 60},
+			nil,
+			"bwrap --ro-bind / / --dev /dev --proc /proc --unshare-pid --unshare-ipc --unshare-uts --unshare-net --cap-drop ALL --die-with-parent --new-session -- prlimit --cpu=60 -- kobs-ng init '/tmp/file'",
+		},
+
+		{
+			"WithSeccompProfile",
+			SandboxProfile{SeccompProfile: "/etc/updatehub/seccomp/imxkobs.json"},
+			nil,
+			"bwrap --ro-bind / / --dev /dev --proc /proc --unshare-pid --unshare-ipc --unshare-uts --unshare-net --cap-drop ALL --die-with-parent --new-session -- '/usr/bin/seccomp-exec' '/etc/updatehub/seccomp/imxkobs.json' kobs-ng init '/tmp/file'",
+		},
+
+		{
+			"WithWritablePaths",
+			SandboxProfile{WritablePaths: []string{"/var/lib/firmware"}},
+			[]string{"/dev/mtd0"},
+			"bwrap --ro-bind / / --dev /dev --proc /proc --dev-bind '/dev/mtd0' '/dev/mtd0' --bind '/var/lib/firmware' '/var/lib/firmware' --unshare-pid --unshare-ipc --unshare-uts --unshare-net --cap-drop ALL --die-with-parent --new-session -- kobs-ng init '/tmp/file'",
+		},
+
+		{
+			"WithCapabilities",
+			SandboxProfile{Capabilities: []string{"CAP_SYS_RAWIO", "CAP_DAC_OVERRIDE"}},
+			nil,
+			"bwrap --ro-bind / / --dev /dev --proc /proc --unshare-pid --unshare-ipc --unshare-uts --unshare-net --cap-drop ALL --cap-add CAP_SYS_RAWIO --cap-add CAP_DAC_OVERRIDE --die-with-parent --new-session -- kobs-ng init '/tmp/file'",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Sandbox{Profile: tc.profile, SeccompHelper: "/usr/bin/seccomp-exec", Writable: tc.writable}
+
+			assert.Equal(t, tc.expectedCmdline, s.Wrap("kobs-ng init '/tmp/file'"))
+		})
+	}
+}
+
+func TestSandboxExecute(t *testing.T) {
+	clm := &cmdlinemock.CmdLineExecuterMock{}
+	clm.On("Execute", "bwrap --ro-bind / / --dev /dev --proc /proc --unshare-pid --unshare-ipc --unshare-uts --unshare-net --cap-drop ALL --die-with-parent --new-session -- flashcp /tmp/file /dev/mtd0").Return([]byte("output"), nil)
+
+	stdin := bytes.NewBufferString("bootdelay 3\n")
+	clm.On("ExecuteWithStdin", "bwrap --ro-bind / / --dev /dev --proc /proc --unshare-pid --unshare-ipc --unshare-uts --unshare-net --cap-drop ALL --die-with-parent --new-session -- fw_setenv -s -", stdin).Return([]byte(""), nil)
+
+	s := &Sandbox{CmdLineExecuter: clm}
+
+	output, err := s.Execute("flashcp /tmp/file /dev/mtd0")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("output"), output)
+
+	_, err = s.ExecuteWithStdin("fw_setenv -s -", stdin)
+	assert.NoError(t, err)
+
+	clm.AssertExpectations(t)
+}
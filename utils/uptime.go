@@ -0,0 +1,39 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Uptime returns for how long the system has been running, as told by
+// "/proc/uptime"
+func Uptime(fsBackend afero.Fs) (time.Duration, error) {
+	data, err := afero.ReadFile(fsBackend, "/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("malformed uptime '%s'", strings.TrimSpace(string(data)))
+	}
+
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed uptime '%s'", fields[0])
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
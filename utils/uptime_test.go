@@ -0,0 +1,49 @@
+/*
+ * UpdateHub
+ * Copyright (C) 2017
+ * O.S. Systems Sofware LTDA: contato@ossystems.com.br
+ *
+ * SPDX-License-Identifier:     GPL-2.0
+ */
+
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUptime(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+
+	err := afero.WriteFile(memFs, "/proc/uptime", []byte("350735.47 234388.90\n"), 0444)
+	assert.NoError(t, err)
+
+	uptime, err := Uptime(memFs)
+	assert.NoError(t, err)
+	assert.Equal(t, 350735*time.Second+470*time.Millisecond, uptime.Round(time.Millisecond))
+}
+
+func TestUptimeWithMalformedFile(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+
+	err := afero.WriteFile(memFs, "/proc/uptime", []byte("forever\n"), 0444)
+	assert.NoError(t, err)
+
+	_, err = Uptime(memFs)
+	assert.EqualError(t, err, "malformed uptime 'forever'")
+
+	err = afero.WriteFile(memFs, "/proc/uptime", []byte("\n"), 0444)
+	assert.NoError(t, err)
+
+	_, err = Uptime(memFs)
+	assert.EqualError(t, err, "malformed uptime ''")
+}
+
+func TestUptimeWithoutProc(t *testing.T) {
+	_, err := Uptime(afero.NewMemMapFs())
+	assert.Error(t, err)
+}